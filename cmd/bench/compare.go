@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// comparison states of a model
+const (
+	deltaOK        = "ok"
+	deltaRegressed = "regressed"
+	// in the current run only
+	deltaNew = "new"
+	// in the baseline only
+	deltaMissing = "missing"
+)
+
+// Delta is one model of the current run against the baseline. changes are
+// percentages, NaN when either side has nothing to compare
+type Delta struct {
+	Model     string
+	Status    string
+	BaseTPS   float64
+	TPS       float64
+	TPSChange float64
+	BaseP50   float64
+	P50       float64
+	P50Change float64
+	// every run failed now, while the baseline had results
+	Failed bool
+}
+
+func loadBaseline(path string) (jsonReport, error) {
+	var report jsonReport
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return report, fmt.Errorf("%s: %w", path, err)
+	}
+	return report, nil
+}
+
+// compare lines the current run up against the baseline by model name. a
+// model regressed when its tokens/sec fell or its median latency rose by
+// more than threshold percent, or when it now fails outright
+func compare(base, current jsonReport, threshold float64) []Delta {
+	byName := make(map[string]jsonModel, len(base.Models))
+	for _, m := range base.Models {
+		byName[m.Model] = m
+	}
+
+	var deltas []Delta
+	for _, m := range current.Models {
+		d := Delta{Model: m.Model, TPS: m.TokensPerSec.Avg, P50: m.DurationMs.P50, TPSChange: math.NaN(), P50Change: math.NaN()}
+		b, ok := byName[m.Model]
+		delete(byName, m.Model)
+		if !ok {
+			d.Status = deltaNew
+			deltas = append(deltas, d)
+			continue
+		}
+
+		d.BaseTPS, d.BaseP50 = b.TokensPerSec.Avg, b.DurationMs.P50
+		baseOK, nowOK := b.Errors < b.Runs, m.Errors < m.Runs
+		if baseOK && nowOK {
+			d.TPSChange = change(d.BaseTPS, d.TPS)
+			d.P50Change = change(d.BaseP50, d.P50)
+		}
+		d.Failed = baseOK && !nowOK
+
+		d.Status = deltaOK
+		if d.Failed || d.TPSChange < -threshold || d.P50Change > threshold {
+			d.Status = deltaRegressed
+		}
+		deltas = append(deltas, d)
+	}
+
+	for _, b := range base.Models {
+		if _, ok := byName[b.Model]; ok {
+			deltas = append(deltas, Delta{
+				Model:     b.Model,
+				Status:    deltaMissing,
+				BaseTPS:   b.TokensPerSec.Avg,
+				BaseP50:   b.DurationMs.P50,
+				TPSChange: math.NaN(),
+				P50Change: math.NaN(),
+			})
+		}
+	}
+	return deltas
+}
+
+// change is the percentage from base to now, NaN without a base
+func change(base, now float64) float64 {
+	if base == 0 {
+		return math.NaN()
+	}
+	return (now - base) / base * 100
+}
+
+func regressed(deltas []Delta) bool {
+	return slices.ContainsFunc(deltas, func(d Delta) bool { return d.Status == deltaRegressed })
+}
+
+func writeComparison(w io.Writer, deltas []Delta, threshold float64) {
+	fmt.Fprintf(w, "\n%scompared to baseline, regression past %.1f%%%s\n", bold, threshold, reset)
+	fmt.Fprintf(w, "%s%-20s %10s %10s %9s %10s %10s %9s  %s%s\n",
+		bold, "MODEL", "BASE TOK/S", "TOK/S", "CHANGE", "BASE P50", "P50", "CHANGE", "STATUS", reset)
+	fmt.Fprintln(w, strings.Repeat("-", 100))
+
+	for _, d := range deltas {
+		color := green
+		switch d.Status {
+		case deltaRegressed:
+			color = red
+		case deltaNew, deltaMissing:
+			color = yellow
+		}
+		status := d.Status
+		if d.Failed {
+			status += " (all runs failed)"
+		}
+
+		fmt.Fprintf(w, "%s%-20s %10s %10s %9s %10s %10s %9s  %s%s\n",
+			color,
+			truncate(d.Model, 20),
+			value(d.BaseTPS, d.Status == deltaNew, "%.1f"),
+			value(d.TPS, d.Status == deltaMissing, "%.1f"),
+			percent(d.TPSChange),
+			value(d.BaseP50, d.Status == deltaNew, "%.0fms"),
+			value(d.P50, d.Status == deltaMissing, "%.0fms"),
+			percent(d.P50Change),
+			status,
+			reset)
+	}
+}
+
+func value(v float64, absent bool, format string) string {
+	if absent {
+		return "-"
+	}
+	return fmt.Sprintf(format, v)
+}
+
+func percent(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", v)
+}
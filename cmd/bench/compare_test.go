@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func model(name string, tps, p50 float64) jsonModel {
+	return jsonModel{Model: name, Runs: 3, TokensPerSec: jsonRate{Avg: tps}, DurationMs: jsonLatency{P50: p50}}
+}
+
+func TestCompareThreshold(t *testing.T) {
+	base := jsonReport{Models: []jsonModel{
+		model("steady", 100, 1000),
+		model("slower", 100, 1000),
+		model("laggy", 100, 1000),
+		model("faster", 100, 1000),
+	}}
+	current := jsonReport{Models: []jsonModel{
+		model("steady", 95, 1080),
+		model("slower", 85, 1000),
+		model("laggy", 100, 1150),
+		model("faster", 140, 700),
+	}}
+
+	deltas := compare(base, current, 10)
+	status := map[string]string{}
+	for _, d := range deltas {
+		status[d.Model] = d.Status
+	}
+	assert.Equal(t, map[string]string{
+		"steady": deltaOK,
+		"slower": deltaRegressed,
+		"laggy":  deltaRegressed,
+		"faster": deltaOK,
+	}, status)
+	assert.InDelta(t, -15.0, deltas[1].TPSChange, 1e-9)
+	assert.InDelta(t, 15.0, deltas[2].P50Change, 1e-9)
+	assert.True(t, regressed(deltas))
+
+	assert.False(t, regressed(compare(base, current, 20)), "a looser threshold lets both through")
+}
+
+func TestCompareOneSided(t *testing.T) {
+	base := jsonReport{Models: []jsonModel{model("kept", 100, 1000), model("dropped", 50, 2000)}}
+	current := jsonReport{Models: []jsonModel{model("kept", 100, 1000), model("added", 70, 900)}}
+
+	deltas := compare(base, current, 10)
+	require.Len(t, deltas, 3)
+	assert.Equal(t, Delta{Model: "kept", Status: deltaOK, BaseTPS: 100, TPS: 100, BaseP50: 1000, P50: 1000}, deltas[0])
+	assert.Equal(t, "added", deltas[1].Model)
+	assert.Equal(t, deltaNew, deltas[1].Status)
+	assert.True(t, math.IsNaN(deltas[1].TPSChange))
+	assert.Equal(t, "dropped", deltas[2].Model)
+	assert.Equal(t, deltaMissing, deltas[2].Status)
+	assert.False(t, regressed(deltas), "a model in one run only is reported, not failed")
+
+	var out bytes.Buffer
+	writeComparison(&out, deltas, 10)
+	assert.Contains(t, out.String(), "added")
+	assert.Contains(t, out.String(), "missing")
+}
+
+func TestCompareFailures(t *testing.T) {
+	broken := model("m", 0, 0)
+	broken.Errors = broken.Runs
+
+	deltas := compare(jsonReport{Models: []jsonModel{model("m", 100, 1000)}}, jsonReport{Models: []jsonModel{broken}}, 10)
+	assert.Equal(t, deltaRegressed, deltas[0].Status, "failing every run is a regression")
+	assert.True(t, deltas[0].Failed)
+
+	deltas = compare(jsonReport{Models: []jsonModel{broken}}, jsonReport{Models: []jsonModel{model("m", 100, 1000)}}, 10)
+	assert.Equal(t, deltaOK, deltas[0].Status, "recovering from a broken baseline is not")
+}
+
+func TestBaselineRoundTrip(t *testing.T) {
+	stats := []ModelStats{{Model: "m", Runs: 1, AvgTPS: 42, Results: []BenchResult{{Tokens: 1}}}}
+	path := filepath.Join(t.TempDir(), "base.json")
+
+	var buf bytes.Buffer
+	require.NoError(t, writeJSON(&buf, stats))
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+
+	base, err := loadBaseline(path)
+	require.NoError(t, err)
+	assert.Equal(t, buildReport(stats), base)
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+	_, err = loadBaseline(path)
+	assert.Error(t, err)
+	_, err = loadBaseline(filepath.Join(t.TempDir(), "none.json"))
+	assert.Error(t, err)
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
-	"sync"
+	"strings"
 	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/pkg/client"
 )
 
 // ansi colors
@@ -33,14 +39,20 @@ type ModelsResponse struct {
 }
 
 type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Message struct {
 	Role    string `json:"role"`
-	Content string `json:"content"`
+	Content any    `json:"content"`
 }
 
 type ChatResponse struct {
@@ -52,32 +64,94 @@ type ChatResponse struct {
 
 type BenchResult struct {
 	Model        string
+	Prompt       string
 	Duration     time.Duration
 	Tokens       int
 	TokensPerSec float64
 	Error        error
+
+	// streamed runs only. Connect is the wait for response headers, TTFT
+	// for the first content chunk, Generation from there to the last one
+	Connect    time.Duration
+	TTFT       time.Duration
+	Generation time.Duration
+	AvgGap     time.Duration
+	MaxGap     time.Duration
 }
 
 type ModelStats struct {
-	Model       string
+	Model string
+	// set on the per prompt stats of a model
+	Prompt      string
 	Runs        int
 	AvgDuration time.Duration
 	MinDuration time.Duration
 	MaxDuration time.Duration
+	P50Duration time.Duration
+	P90Duration time.Duration
+	P99Duration time.Duration
 	AvgTokens   float64
 	AvgTPS      float64
+	P50TPS      float64
+	P90TPS      float64
+	P99TPS      float64
 	Errors      int
+
+	AvgConnect    time.Duration
+	AvgTTFT       time.Duration
+	AvgGeneration time.Duration
+	AvgGap        time.Duration
+	MaxGap        time.Duration
+
+	// every run in order, failed ones included
+	Results []BenchResult
+	// from the first run to the last, AggregateTPS is every token over it
+	Wall         time.Duration
+	AggregateTPS float64
+	// the same split by prompt, when there is more than one
+	Prompts []ModelStats
 }
 
 var (
 	baseURL = flag.String("url", "http://localhost:8804", "API base URL")
-	runs    = flag.Int("runs", 6, "number of runs per model")
+	runs    = flag.Int("runs", 6, "number of runs per model, the prompts take turns")
 	prompt  = flag.String("prompt", "напиши короткую историю в 50 слов", "test prompt")
+
+	promptFile   = flag.String("prompts", "", "jsonl of {\"name\": ..., \"messages\": [...], \"max_tokens\": ...} to run instead of -prompt")
+	suiteNames   = flag.String("suite", "", "built-in prompts to run: short, long-form, code, reasoning, comma separated, or all")
+	serverSample = flag.Bool("use-server-sample", false, "use the prompts the target serves at /admin/bench/sample")
+	perPrompt    = flag.Int("samples", 0, "runs per model and prompt, replaces -runs when set")
+
+	apiKey = flag.String("key", os.Getenv("OPENAI_API_KEY"), "api key sent as a bearer token, defaults to $OPENAI_API_KEY")
+	header headerFlag
+
+	stream       = flag.Bool("stream", false, "stream replies and measure time to first token and inter-chunk gaps")
+	includeUsage = flag.Bool("include-usage", false, "with -stream, count tokens from the usage chunk instead of estimating them")
+
+	format = flag.String("format", "table", "report format: table, json or csv, the last two list every run")
+	output = flag.String("o", "", "write the report to this file instead of stdout")
+	sortBy = flag.String("sort", "tps", "order models by tps, latency or name")
+
+	concurrency = flag.Int("concurrency", 1, "models benchmarked at once, 0 runs them all together")
+	parallel    = flag.Int("parallel", 1, "requests of one model in flight at once, throughput is also reported in aggregate")
+	modelFilter = flag.String("models", "", "comma separated models to run, /regex/ items match by pattern")
+	warmup      = flag.Int("warmup", 0, "runs per model sent first and left out of the stats")
+	timeout     = flag.Duration("timeout", 60*time.Second, "per request, a stream must finish within it too")
+
+	baseline  = flag.String("baseline", "", "json report of an earlier run (-format json) to compare against, exits 1 on a regression")
+	threshold = flag.Float64("threshold", 10, "percent tokens/sec may drop or median latency may rise before it counts as a regression")
 )
 
+// console takes progress and warnings, stderr when a machine readable
+// report goes to stdout
+var console io.Writer = os.Stdout
+
 var httpClient *http.Client
 
 func init() {
+	flag.StringVar(promptFile, "prompt-file", "", "same as -prompts")
+	flag.Var(&header, "header", "extra request header as \"Name: value\", repeatable")
+
 	transport := &http.Transport{}
 
 	// check ALL_PROXY env
@@ -94,45 +168,134 @@ func init() {
 	}
 }
 
+// headerFlag collects -header values
+type headerFlag []string
+
+func (h *headerFlag) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlag) Set(v string) error {
+	name, _, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("want \"Name: value\", got %q", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+// requestHeader is what every request carries: the api key, then -header
+// values, which may replace the Authorization the key set
+func requestHeader() http.Header {
+	h := http.Header{}
+	if *apiKey != "" {
+		h.Set("Authorization", "Bearer "+*apiKey)
+	}
+	custom := http.Header{}
+	for _, v := range header {
+		name, value, _ := strings.Cut(v, ":")
+		custom.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	for name, values := range custom {
+		h[name] = values
+	}
+	return h
+}
+
+// withHeaders adds header to every request, models and server sample
+// included, so a key protected mo can be benchmarked
+type withHeaders struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+func (t withHeaders) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	for name, values := range t.header {
+		r.Header[name] = values
+	}
+	return t.base.RoundTrip(r)
+}
+
 func main() {
 	flag.Parse()
+	if !slices.Contains(formats, *format) {
+		fmt.Fprintf(os.Stderr, "%serror:%s unknown format %q, want one of %v\n", red, reset, *format, formats)
+		os.Exit(2)
+	}
+	if !slices.Contains(sorts, *sortBy) {
+		fmt.Fprintf(os.Stderr, "%serror:%s unknown sort %q, want one of %v\n", red, reset, *sortBy, sorts)
+		os.Exit(2)
+	}
+	if *format != "table" && *output == "" {
+		console = os.Stderr
+	}
+	httpClient.Timeout = *timeout
+	httpClient.Transport = withHeaders{base: httpClient.Transport, header: requestHeader()}
+
+	var base jsonReport
+	if *baseline != "" {
+		var err error
+		if base, err = loadBaseline(*baseline); err != nil {
+			fmt.Fprintf(os.Stderr, "%serror:%s baseline: %v\n", red, reset, err)
+			os.Exit(2)
+		}
+	}
 
-	fmt.Printf("%smo-bench%s\n", bold, reset)
-	fmt.Printf("  url:  %s\n", *baseURL)
-	fmt.Printf("  runs: %d\n", *runs)
-	fmt.Println()
+	samples, source := loadPrompts()
+	total := totalRuns(*runs, *perPrompt, len(samples))
+
+	fmt.Fprintf(console, "%smo-bench%s\n", bold, reset)
+	fmt.Fprintf(console, "  url:  %s\n", *baseURL)
+	fmt.Fprintf(console, "  runs: %d (+%d warmup), %d in parallel\n", total, *warmup, *parallel)
+	if *stream {
+		fmt.Fprintf(console, "  mode: stream\n")
+	}
+	fmt.Fprintf(console, "  prompts: %d (%s)\n", len(samples), source)
+	fmt.Fprintln(console)
 
 	models, err := getModels(*baseURL)
 	if err != nil {
-		fmt.Printf("%serror:%s %v\n", red, reset, err)
+		fmt.Fprintf(console, "%serror:%s %v\n", red, reset, err)
 		return
 	}
 
-	fmt.Printf("found %d models, running benchmarks...\n\n", len(models))
-
-	statsChan := make(chan ModelStats, len(models))
-	var wg sync.WaitGroup
+	found := len(models)
+	if models, err = filterModels(models, *modelFilter); err != nil {
+		fmt.Fprintf(console, "%serror:%s %v\n", red, reset, err)
+		os.Exit(2)
+	}
+	if len(models) == 0 {
+		fmt.Fprintf(console, "%serror:%s none of %d models match %q\n", red, reset, found, *modelFilter)
+		os.Exit(1)
+	}
 
-	for _, model := range models {
-		wg.Add(1)
-		go func(m string) {
-			defer wg.Done()
-			stats := benchmarkModel(*baseURL, m, *runs, *prompt)
-			statsChan <- stats
-		}(model)
+	atOnce := *concurrency
+	if atOnce < 1 || atOnce > len(models) {
+		atOnce = len(models)
 	}
+	fmt.Fprintf(console, "found %d models, running benchmarks on %d, %d at a time...\n\n", found, len(models), atOnce)
 
-	go func() {
-		wg.Wait()
-		close(statsChan)
-	}()
+	allStats := schedule(len(models), *concurrency, func(i int) ModelStats {
+		return benchmarkModel(*baseURL, models[i], total, samples)
+	})
 
-	allStats := make([]ModelStats, 0, len(models))
-	for stats := range statsChan {
-		allStats = append(allStats, stats)
+	sortStats(allStats, *sortBy)
+	if err := writeReport(allStats); err != nil {
+		fmt.Fprintf(console, "%serror:%s %v\n", red, reset, err)
+		os.Exit(1)
 	}
 
-	printResults(allStats)
+	if *baseline != "" {
+		if base.Stream != *stream {
+			fmt.Fprintf(console, "%swarning:%s baseline stream=%v, this run stream=%v\n", yellow, reset, base.Stream, *stream)
+		}
+		deltas := compare(base, buildReport(allStats), *threshold)
+		writeComparison(console, deltas, *threshold)
+		if regressed(deltas) {
+			os.Exit(1)
+		}
+	}
 }
 
 func getModels(baseURL string) ([]string, error) {
@@ -154,59 +317,92 @@ func getModels(baseURL string) ([]string, error) {
 	return models, nil
 }
 
-func benchmarkModel(baseURL, model string, runs int, prompt string) ModelStats {
-	var durations []time.Duration
-	var tokens []int
-	var tps []float64
-	errors := 0
-
-	// run requests sequentially
-	for i := 0; i < runs; i++ {
-		r := runSingleBench(baseURL, model, prompt)
-		if r.Error != nil {
-			errors++
-			continue
-		}
-		durations = append(durations, r.Duration)
-		tokens = append(tokens, r.Tokens)
-		tps = append(tps, r.TokensPerSec)
+// benchmarkModel sends model runs requests in all, the prompts taking turns
+func benchmarkModel(baseURL, model string, runs int, samples []Sample) ModelStats {
+	run := runSingleBench
+	if *stream {
+		run = runStreamBench
 	}
 
-	stats := ModelStats{
-		Model:  model,
-		Runs:   runs,
-		Errors: errors,
+	// warm up connections and upstream caches, the results are dropped
+	for i := 0; i < *warmup; i++ {
+		run(baseURL, model, samples[i%len(samples)])
 	}
 
-	if len(durations) > 0 {
-		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	stats := ModelStats{Model: model, Runs: runs}
+	start := time.Now()
+	stats.Results = schedule(runs, *parallel, func(i int) BenchResult {
+		sample := samples[i%len(samples)]
+		r := run(baseURL, model, sample)
+		r.Prompt = sample.Name
+		return r
+	})
+	stats.Wall = time.Since(start)
 
-		var totalDur time.Duration
-		var totalTokens, totalTPS float64
-		for i := range durations {
-			totalDur += durations[i]
-			totalTokens += float64(tokens[i])
-			totalTPS += tps[i]
+	tally(&stats)
+	stats.Prompts = byPrompt(stats)
+	return stats
+}
+
+// tally counts the failed runs of stats and summarizes the others
+func tally(stats *ModelStats) {
+	var ok []BenchResult
+	for _, r := range stats.Results {
+		if r.Error != nil {
+			stats.Errors++
+			continue
 		}
+		ok = append(ok, r)
+	}
+	summarize(stats, ok)
+}
 
-		n := len(durations)
-		stats.AvgDuration = totalDur / time.Duration(n)
-		stats.MinDuration = durations[0]
-		stats.MaxDuration = durations[n-1]
-		stats.AvgTokens = totalTokens / float64(n)
-		stats.AvgTPS = totalTPS / float64(n)
+// summarize fills the aggregates of stats from the successful runs
+func summarize(stats *ModelStats, ok []BenchResult) {
+	n := len(ok)
+	if n == 0 {
+		return
 	}
 
-	return stats
+	durations := make([]float64, n)
+	tps := make([]float64, n)
+	var totalTokens float64
+	for i, r := range ok {
+		durations[i] = float64(r.Duration)
+		tps[i] = r.TokensPerSec
+		totalTokens += float64(r.Tokens)
+
+		stats.AvgConnect += r.Connect / time.Duration(n)
+		stats.AvgTTFT += r.TTFT / time.Duration(n)
+		stats.AvgGeneration += r.Generation / time.Duration(n)
+		stats.AvgGap += r.AvgGap / time.Duration(n)
+		stats.MaxGap = max(stats.MaxGap, r.MaxGap)
+	}
+	sort.Float64s(durations)
+	sort.Float64s(tps)
+
+	stats.AvgDuration = time.Duration(mean(durations))
+	stats.MinDuration = time.Duration(durations[0])
+	stats.MaxDuration = time.Duration(durations[n-1])
+	stats.P50Duration = time.Duration(percentile(durations, 50))
+	stats.P90Duration = time.Duration(percentile(durations, 90))
+	stats.P99Duration = time.Duration(percentile(durations, 99))
+	stats.AvgTokens = totalTokens / float64(n)
+	stats.AvgTPS = mean(tps)
+	if stats.Wall > 0 {
+		stats.AggregateTPS = totalTokens / stats.Wall.Seconds()
+	}
+	stats.P50TPS = percentile(tps, 50)
+	stats.P90TPS = percentile(tps, 90)
+	stats.P99TPS = percentile(tps, 99)
 }
 
-func runSingleBench(baseURL, model, prompt string) BenchResult {
+func runSingleBench(baseURL, model string, sample Sample) BenchResult {
 	req := ChatRequest{
-		Model:  model,
-		Stream: false,
-		Messages: []Message{
-			{Role: "user", Content: prompt},
-		},
+		Model:     model,
+		Stream:    false,
+		Messages:  sample.Messages,
+		MaxTokens: sample.MaxTokens,
 	}
 
 	body, _ := json.Marshal(req)
@@ -248,44 +444,105 @@ func runSingleBench(baseURL, model, prompt string) BenchResult {
 	}
 }
 
-func printResults(stats []ModelStats) {
-	sort.Slice(stats, func(i, j int) bool {
-		return stats[i].AvgTPS > stats[j].AvgTPS
-	})
+// runStreamBench sends stream:true and times the chunks as they arrive.
+// tokens/sec is over generation time only, the wait for the first token is
+// reported as TTFT instead
+func runStreamBench(baseURL, model string, sample Sample) BenchResult {
+	req := ChatRequest{
+		Model:     model,
+		Stream:    true,
+		Messages:  sample.Messages,
+		MaxTokens: sample.MaxTokens,
+	}
+	if *includeUsage {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	body, _ := json.Marshal(req)
+
+	start := time.Now()
+	resp, err := httpClient.Post(
+		baseURL+"/v1/chat/completions",
+		"application/json",
+		bytes.NewReader(body),
+	)
+	connect := time.Since(start)
 
-	fmt.Printf("%s%-20s %10s %10s %10s %10s %6s%s\n",
-		bold, "MODEL", "AVG", "MIN", "MAX", "TOK/S", "ERR", reset)
-	fmt.Println("----------------------------------------------------------------------")
+	if err != nil {
+		return BenchResult{Model: model, Error: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return BenchResult{
+			Model: model,
+			Error: fmt.Errorf("status %d: %s", resp.StatusCode, string(bodyBytes)),
+		}
+	}
 
-	for _, s := range stats {
-		color := green
-		if s.Errors > 0 {
-			color = yellow
+	var content strings.Builder
+	var first, last time.Time
+	var gaps []time.Duration
+	usageTokens := -1
+
+	stream := client.NewStream(context.Background(), resp)
+	defer stream.Close()
+	for stream.Next() {
+		chunk := stream.Chunk()
+		if chunk.Usage != nil {
+			usageTokens = chunk.Usage.CompletionTokens
 		}
-		if s.Errors == s.Runs {
-			color = red
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta == nil {
+			continue
 		}
 
-		if s.Errors == s.Runs {
-			fmt.Printf("%s%-20s %10s %10s %10s %10s %6d%s\n",
-				color, truncate(s.Model, 20), "-", "-", "-", "-", s.Errors, reset)
+		text := chunk.Choices[0].Delta.ReasoningContent + chunk.Choices[0].Delta.Content
+		if text == "" {
+			continue
+		}
+		now := time.Now()
+		if first.IsZero() {
+			first = now
 		} else {
-			fmt.Printf("%s%-20s %10v %10v %10v %10.1f %6d%s\n",
-				color,
-				truncate(s.Model, 20),
-				s.AvgDuration.Round(time.Millisecond),
-				s.MinDuration.Round(time.Millisecond),
-				s.MaxDuration.Round(time.Millisecond),
-				s.AvgTPS,
-				s.Errors,
-				reset)
+			gaps = append(gaps, now.Sub(last))
 		}
+		last = now
+		content.WriteString(text)
+	}
+	if err := stream.Err(); err != nil {
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) {
+			return BenchResult{Model: model, Error: fmt.Errorf("stream error: %s", apiErr.Message)}
+		}
+		return BenchResult{Model: model, Error: err}
+	}
+	if first.IsZero() {
+		return BenchResult{Model: model, Error: fmt.Errorf("no content streamed")}
+	}
+
+	tokens := usageTokens
+	if tokens < 0 {
+		tokens = utils.EstimateTokens(content.String())
 	}
-}
 
-func truncate(s string, max int) string {
-	if len(s) <= max {
-		return s
+	r := BenchResult{
+		Model:      model,
+		Duration:   time.Since(start),
+		Tokens:     tokens,
+		Connect:    connect,
+		TTFT:       first.Sub(start),
+		Generation: last.Sub(first),
+	}
+	// a reply in a single chunk has no generation time of its own
+	if r.Generation > 0 {
+		r.TokensPerSec = float64(tokens) / r.Generation.Seconds()
+	} else {
+		r.TokensPerSec = float64(tokens) / r.Duration.Seconds()
+	}
+	for _, g := range gaps {
+		r.AvgGap += g / time.Duration(len(gaps))
+		r.MaxGap = max(r.MaxGap, g)
 	}
-	return s[:max-3] + "..."
+	return r
 }
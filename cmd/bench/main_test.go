@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStreamBench(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		tokens int
+		err    string
+	}{
+		{
+			name: "usage chunk",
+			body: ": ping\n\n" +
+				"data: {\"choices\":[{\"index\":0,\"delta\":{\"reasoning_content\":\"hm\"}}]}\n\n" +
+				"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"completion_tokens\":7}}\n\n" +
+				"data: [DONE]\n\n",
+			tokens: 7,
+		},
+		{
+			name: "error event",
+			body: "data: {\"error\":{\"message\":\"upstream down\"}}\n\ndata: [DONE]\n\n",
+			err:  "stream error: upstream down",
+		},
+		{
+			name: "cut short",
+			body: "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n",
+			err:  "unexpected EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+			httpClient = srv.Client()
+
+			res := runStreamBench(srv.URL, "glm", Sample{Messages: userPrompt("hi")})
+			if tt.err != "" {
+				require.Error(t, res.Error)
+				assert.Equal(t, tt.err, res.Error.Error())
+				return
+			}
+			require.NoError(t, res.Error)
+			assert.Equal(t, tt.tokens, res.Tokens)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// schedule runs job for every index below n on at most workers goroutines,
+// fewer than one means all at once. results come back in index order
+func schedule[T any](n, workers int, job func(i int) T) []T {
+	if workers < 1 || workers > n {
+		workers = n
+	}
+
+	results := make([]T, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = job(i)
+			}
+		}()
+	}
+	for i := range n {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// filterModels keeps the models spec selects. spec is comma separated, an
+// item is an exact name or a regex between slashes: glm-4.6,/^qwen3-/
+func filterModels(models []string, spec string) ([]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return models, nil
+	}
+
+	var names []string
+	var patterns []*regexp.Regexp
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 1 && strings.HasPrefix(item, "/") && strings.HasSuffix(item, "/") {
+			re, err := regexp.Compile(item[1 : len(item)-1])
+			if err != nil {
+				return nil, fmt.Errorf("models %s: %w", item, err)
+			}
+			patterns = append(patterns, re)
+			continue
+		}
+		if item != "" {
+			names = append(names, item)
+		}
+	}
+
+	var out []string
+	for _, m := range models {
+		if slices.Contains(names, m) || slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool { return re.MatchString(m) }) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// peakJob records how many jobs ran at once
+func peakJob(active, peak *atomic.Int64) func(i int) int {
+	return func(i int) int {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		active.Add(-1)
+		return i * i
+	}
+}
+
+func TestScheduleBoundsWorkers(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		n, workers int
+		peak       int64
+	}{
+		{"sequential", 6, 1, 1},
+		{"bounded", 9, 3, 3},
+		{"more workers than jobs", 2, 8, 2},
+		{"zero means all at once", 5, 0, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var active, peak atomic.Int64
+			got := schedule(tc.n, tc.workers, peakJob(&active, &peak))
+
+			require.Len(t, got, tc.n)
+			for i, v := range got {
+				assert.Equal(t, i*i, v, "results keep index order")
+			}
+			assert.Equal(t, tc.peak, peak.Load())
+		})
+	}
+}
+
+func TestScheduleEmpty(t *testing.T) {
+	got := schedule(0, 4, func(int) int {
+		t.Fatal("no job to run")
+		return 0
+	})
+	assert.Empty(t, got)
+}
+
+func TestFilterModels(t *testing.T) {
+	models := []string{"glm-4.6", "glm-4x6", "qwen3-max", "qwen3-coder", "GLM-4-6-API-V1"}
+
+	got, err := filterModels(models, "")
+	require.NoError(t, err)
+	assert.Equal(t, models, got)
+
+	got, err = filterModels(models, "glm-4.6, qwen3-max")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"glm-4.6", "qwen3-max"}, got, "plain items are exact names")
+
+	got, err = filterModels(models, "/^qwen3-/,GLM-4-6-API-V1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"qwen3-max", "qwen3-coder", "GLM-4-6-API-V1"}, got)
+
+	_, err = filterModels(models, "/(/")
+	assert.Error(t, err)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Sample is one line of a prompt file, the same jsonl the server hands
+// out at /admin/bench/sample. name and max_tokens are optional
+type Sample struct {
+	Name      string    `json:"name"`
+	Messages  []Message `json:"messages"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+}
+
+func userPrompt(text string) []Message {
+	return []Message{{Role: "user", Content: text}}
+}
+
+// suite is the built-in workload mix, -suite picks from it by name
+var suite = []Sample{
+	{
+		Name:      "short",
+		Messages:  userPrompt("In one sentence: what is the capital of France?"),
+		MaxTokens: 64,
+	},
+	{
+		Name:      "long-form",
+		Messages:  userPrompt("Write an essay of about 800 words on the history of the printing press and how it changed literacy in Europe."),
+		MaxTokens: 1500,
+	},
+	{
+		Name:      "code",
+		Messages:  userPrompt("Write a Go package implementing a generic LRU cache that is safe for concurrent use, with table-driven tests."),
+		MaxTokens: 1500,
+	},
+	{
+		Name: "reasoning",
+		Messages: userPrompt("Three boxes are labeled apples, oranges and mixed, and every label is wrong. " +
+			"You may take one fruit from one box without looking inside. Which box do you pick, and how do you relabel all three? Reason step by step."),
+		MaxTokens: 1000,
+	},
+}
+
+// selectSuite picks built-in prompts by comma separated name, all for every one
+func selectSuite(names string) ([]Sample, error) {
+	if strings.TrimSpace(names) == "all" {
+		return suite, nil
+	}
+
+	var out []Sample
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(suite, func(s Sample) bool { return s.Name == name })
+		if i < 0 {
+			var known []string
+			for _, s := range suite {
+				known = append(known, s.Name)
+			}
+			return nil, fmt.Errorf("unknown prompt %q, the suite has %s", name, strings.Join(known, ", "))
+		}
+		out = append(out, suite[i])
+	}
+	return out, nil
+}
+
+// loadPrompts picks the prompt set: a prompt file, the built-in suite, the
+// server sample, or the -prompt text when none is given or the server has none
+func loadPrompts() ([]Sample, string) {
+	builtin := []Sample{{Name: "prompt", Messages: userPrompt(*prompt)}}
+
+	if *promptFile != "" {
+		f, err := os.Open(*promptFile)
+		if err != nil {
+			fmt.Fprintf(console, "%serror:%s %v\n", red, reset, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		samples, err := parseSamples(f)
+		if err != nil {
+			fmt.Fprintf(console, "%serror:%s %s: %v\n", red, reset, *promptFile, err)
+			os.Exit(1)
+		}
+		return samples, *promptFile
+	}
+
+	if *suiteNames != "" {
+		samples, err := selectSuite(*suiteNames)
+		if err != nil {
+			fmt.Fprintf(console, "%serror:%s %v\n", red, reset, err)
+			os.Exit(2)
+		}
+		return samples, "suite"
+	}
+
+	if *serverSample {
+		samples, err := getServerSample(*baseURL)
+		if err != nil {
+			fmt.Fprintf(console, "%swarning:%s server sample unavailable (%v), using built-in prompt\n", yellow, reset, err)
+			return builtin, "built-in"
+		}
+		return samples, "server sample"
+	}
+
+	return builtin, "built-in"
+}
+
+func getServerSample(baseURL string) ([]Sample, error) {
+	resp, err := httpClient.Get(baseURL + "/admin/bench/sample")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return parseSamples(resp.Body)
+}
+
+// parseSamples reads jsonl prompts. a line without a name is named after
+// its line number, stats are kept per name so names must be unique
+func parseSamples(r io.Reader) ([]Sample, error) {
+	var samples []Sample
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var s Sample
+		if err := json.Unmarshal(line, &s); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(s.Messages) == 0 {
+			return nil, fmt.Errorf("line %d: no messages", n)
+		}
+		if s.MaxTokens < 0 {
+			return nil, fmt.Errorf("line %d: max_tokens must not be negative", n)
+		}
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("#%d", n)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("line %d: duplicate name %q", n, s.Name)
+		}
+		seen[s.Name] = true
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no prompts")
+	}
+	return samples, nil
+}
+
+// totalRuns is the runs per model: -runs as given, or -samples for each
+// of the prompts when it is set
+func totalRuns(runs, perPrompt, prompts int) int {
+	if perPrompt > 0 {
+		return perPrompt * prompts
+	}
+	return runs
+}
+
+// byPrompt splits the runs of a model by prompt, in the order the prompts
+// first ran. nil with a single prompt, the model stats already are its stats
+func byPrompt(stats ModelStats) []ModelStats {
+	var order []string
+	groups := map[string][]BenchResult{}
+	for _, r := range stats.Results {
+		if _, ok := groups[r.Prompt]; !ok {
+			order = append(order, r.Prompt)
+		}
+		groups[r.Prompt] = append(groups[r.Prompt], r)
+	}
+	if len(order) < 2 {
+		return nil
+	}
+
+	out := make([]ModelStats, 0, len(order))
+	for _, name := range order {
+		ps := ModelStats{Model: stats.Model, Prompt: name, Runs: len(groups[name]), Results: groups[name]}
+		tally(&ps)
+		out = append(out, ps)
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSamples(t *testing.T) {
+	in := `{"name": "greeting", "messages": [{"role": "user", "content": "hi"}], "max_tokens": 32}
+
+{"messages": [{"role": "system", "content": "be brief"}, {"role": "user", "content": "why?"}]}
+`
+	samples, err := parseSamples(strings.NewReader(in))
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+
+	assert.Equal(t, Sample{Name: "greeting", Messages: userPrompt("hi"), MaxTokens: 32}, samples[0])
+	assert.Equal(t, "#3", samples[1].Name, "unnamed prompts are named after their line")
+	assert.Zero(t, samples[1].MaxTokens)
+	assert.Len(t, samples[1].Messages, 2)
+}
+
+func TestParseSamplesErrors(t *testing.T) {
+	for name, in := range map[string]string{
+		"empty":      "\n\n",
+		"bad json":   `{"messages": [`,
+		"no message": `{"name": "x", "messages": []}`,
+		"negative":   `{"messages": [{"role": "user", "content": "a"}], "max_tokens": -1}`,
+		"duplicate": `{"name": "a", "messages": [{"role": "user", "content": "1"}]}
+{"name": "a", "messages": [{"role": "user", "content": "2"}]}`,
+	} {
+		_, err := parseSamples(strings.NewReader(in))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSelectSuite(t *testing.T) {
+	all, err := selectSuite("all")
+	require.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	picked, err := selectSuite("code, short")
+	require.NoError(t, err)
+	require.Len(t, picked, 2)
+	assert.Equal(t, "code", picked[0].Name)
+	assert.Equal(t, "short", picked[1].Name)
+
+	_, err = selectSuite("short,poetry")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "long-form")
+}
+
+func TestTotalRuns(t *testing.T) {
+	tests := []struct {
+		name                     string
+		runs, perPrompt, prompts int
+		want                     int
+	}{
+		{"runs is the total", 6, 0, 4, 6},
+		{"samples per prompt", 6, 3, 4, 12},
+		{"one prompt", 6, 2, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, totalRuns(tt.runs, tt.perPrompt, tt.prompts))
+		})
+	}
+}
+
+func TestByPrompt(t *testing.T) {
+	stats := ModelStats{Model: "glm", Runs: 5, Results: []BenchResult{
+		{Prompt: "short", Duration: time.Second, Tokens: 10, TokensPerSec: 10},
+		{Prompt: "code", Duration: 4 * time.Second, Tokens: 400, TokensPerSec: 100},
+		{Prompt: "short", Duration: 3 * time.Second, Tokens: 30, TokensPerSec: 10},
+		{Prompt: "code", Error: errors.New("timeout")},
+		{Prompt: "code", Duration: 6 * time.Second, Tokens: 600, TokensPerSec: 100},
+	}}
+	tally(&stats)
+	assert.Equal(t, 1, stats.Errors)
+	assert.Equal(t, 3500*time.Millisecond, stats.AvgDuration, "the model row mixes every prompt")
+
+	prompts := byPrompt(stats)
+	require.Len(t, prompts, 2)
+
+	short, code := prompts[0], prompts[1]
+	assert.Equal(t, "short", short.Prompt)
+	assert.Equal(t, 2, short.Runs)
+	assert.Equal(t, 0, short.Errors)
+	assert.Equal(t, 2*time.Second, short.AvgDuration)
+	assert.Equal(t, 20.0, short.AvgTokens)
+
+	assert.Equal(t, "code", code.Prompt)
+	assert.Equal(t, "glm", code.Model)
+	assert.Equal(t, 3, code.Runs)
+	assert.Equal(t, 1, code.Errors)
+	assert.Equal(t, 5*time.Second, code.AvgDuration)
+	assert.Equal(t, 100.0, code.AvgTPS)
+
+	single := ModelStats{Results: []BenchResult{{Prompt: "prompt"}, {Prompt: "prompt"}}}
+	assert.Nil(t, byPrompt(single), "one prompt needs no split")
+}
+
+func TestRequestHeader(t *testing.T) {
+	defer func(key string, h headerFlag) { *apiKey, header = key, h }(*apiKey, header)
+
+	*apiKey = "sk-test"
+	header = nil
+	assert.Equal(t, "Bearer sk-test", requestHeader().Get("Authorization"))
+
+	require.NoError(t, header.Set("X-Team: bench"))
+	require.NoError(t, header.Set("Authorization: Basic abc"))
+	assert.Error(t, header.Set("no colon"))
+
+	h := requestHeader()
+	assert.Equal(t, "bench", h.Get("X-Team"))
+	assert.Equal(t, "Basic abc", h.Get("Authorization"), "an explicit header wins over -key")
+}
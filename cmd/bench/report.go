@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	formats = []string{"table", "json", "csv"}
+	sorts   = []string{"tps", "latency", "name"}
+)
+
+// percentile interpolates between the closest ranks of sorted, p is 0..100
+func percentile(sorted []float64, p float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(n-1)
+	lo := int(rank)
+	if lo >= n-1 {
+		return sorted[n-1]
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+func mean(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum / float64(len(v))
+}
+
+// sortStats orders models by throughput, latency or name. models without a
+// single successful run have no latency and go last
+func sortStats(stats []ModelStats, by string) {
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		switch by {
+		case "latency":
+			if failedA, failedB := a.Errors == a.Runs, b.Errors == b.Runs; failedA != failedB {
+				return failedB
+			}
+			return a.P50Duration < b.P50Duration
+		case "name":
+			return a.Model < b.Model
+		default:
+			return a.AvgTPS > b.AvgTPS
+		}
+	})
+}
+
+// writeReport writes stats in the chosen format to -o or stdout, the table
+// is only colored on stdout
+func writeReport(stats []ModelStats) error {
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "json":
+		return writeJSON(w, stats)
+	case "csv":
+		return writeCSV(w, stats)
+	default:
+		writeTable(w, stats, *output == "")
+		return nil
+	}
+}
+
+func writeTable(w io.Writer, stats []ModelStats, colored bool) {
+	paint := func(c string) string {
+		if colored {
+			return c
+		}
+		return ""
+	}
+
+	// streamed runs add where the time went: waiting for headers, for the
+	// first token, and generating the rest
+	var extraHead, extraDash string
+	if *stream {
+		extraHead = fmt.Sprintf(" %10s %10s %10s %10s %10s", "CONNECT", "TTFT", "GEN", "GAP", "MAX GAP")
+		extraDash = strings.Repeat("-", 55)
+	}
+	// parallel runs overlap, their combined rate is what the server sustained
+	if *parallel > 1 {
+		extraHead = fmt.Sprintf(" %10s", "AGG TOK/S") + extraHead
+		extraDash += strings.Repeat("-", 11)
+	}
+
+	fmt.Fprintf(w, "%s%-20s %10s %10s %10s %10s %10s %10s %6s%s%s\n",
+		paint(bold), "MODEL", "AVG", "MIN", "MAX", "P90", "P99", "TOK/S", "ERR", extraHead, paint(reset))
+	fmt.Fprintln(w, strings.Repeat("-", 92)+extraDash)
+
+	row := func(label string, s ModelStats) {
+		color := green
+		if s.Errors > 0 {
+			color = yellow
+		}
+		if s.Errors == s.Runs {
+			color = red
+		}
+
+		if s.Errors == s.Runs {
+			var extraCols string
+			if *parallel > 1 {
+				extraCols = fmt.Sprintf(" %10s", "-")
+			}
+			if *stream {
+				extraCols += fmt.Sprintf(" %10s %10s %10s %10s %10s", "-", "-", "-", "-", "-")
+			}
+			fmt.Fprintf(w, "%s%-20s %10s %10s %10s %10s %10s %10s %6d%s%s\n",
+				paint(color), truncate(label, 20), "-", "-", "-", "-", "-", "-", s.Errors, extraCols, paint(reset))
+			return
+		}
+
+		var extraCols string
+		if *parallel > 1 {
+			extraCols = fmt.Sprintf(" %10.1f", s.AggregateTPS)
+		}
+		if *stream {
+			extraCols += fmt.Sprintf(" %10v %10v %10v %10v %10v",
+				s.AvgConnect.Round(time.Millisecond),
+				s.AvgTTFT.Round(time.Millisecond),
+				s.AvgGeneration.Round(time.Millisecond),
+				s.AvgGap.Round(time.Millisecond),
+				s.MaxGap.Round(time.Millisecond))
+		}
+		fmt.Fprintf(w, "%s%-20s %10v %10v %10v %10v %10v %10.1f %6d%s%s\n",
+			paint(color),
+			truncate(label, 20),
+			s.AvgDuration.Round(time.Millisecond),
+			s.MinDuration.Round(time.Millisecond),
+			s.MaxDuration.Round(time.Millisecond),
+			s.P90Duration.Round(time.Millisecond),
+			s.P99Duration.Round(time.Millisecond),
+			s.AvgTPS,
+			s.Errors,
+			extraCols,
+			paint(reset))
+	}
+
+	for _, s := range stats {
+		row(s.Model, s)
+	}
+
+	// with several prompts the rows above mix workloads, split them up
+	titled := false
+	for _, s := range stats {
+		if len(s.Prompts) == 0 {
+			continue
+		}
+		if !titled {
+			fmt.Fprintf(w, "\n%sper prompt%s\n", paint(bold), paint(reset))
+			titled = true
+		}
+		fmt.Fprintln(w, s.Model)
+		for _, p := range s.Prompts {
+			row("  "+p.Prompt, p)
+		}
+	}
+}
+
+// json report, times in milliseconds
+type jsonReport struct {
+	URL      string      `json:"url"`
+	Stream   bool        `json:"stream"`
+	Parallel int         `json:"parallel"`
+	Warmup   int         `json:"warmup"`
+	Models   []jsonModel `json:"models"`
+}
+
+type jsonModel struct {
+	Model        string      `json:"model"`
+	Prompt       string      `json:"prompt,omitempty"`
+	Runs         int         `json:"runs"`
+	Errors       int         `json:"errors"`
+	AvgTokens    float64     `json:"avg_tokens"`
+	DurationMs   jsonLatency `json:"duration_ms"`
+	TokensPerSec jsonRate    `json:"tokens_per_sec"`
+	// all runs together, they overlap with -parallel
+	WallMs       float64      `json:"wall_ms"`
+	AggregateTPS float64      `json:"aggregate_tokens_per_sec"`
+	Stream       *jsonStream  `json:"stream,omitempty"`
+	Results      []jsonResult `json:"results,omitempty"`
+	Prompts      []jsonModel  `json:"prompts,omitempty"`
+}
+
+type jsonLatency struct {
+	Avg float64 `json:"avg"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+type jsonRate struct {
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+type jsonStream struct {
+	ConnectMs    float64 `json:"avg_connect_ms"`
+	TTFTMs       float64 `json:"avg_ttft_ms"`
+	GenerationMs float64 `json:"avg_generation_ms"`
+	GapMs        float64 `json:"avg_gap_ms"`
+	MaxGapMs     float64 `json:"max_gap_ms"`
+}
+
+type jsonResult struct {
+	Prompt       string  `json:"prompt,omitempty"`
+	DurationMs   float64 `json:"duration_ms"`
+	Tokens       int     `json:"tokens"`
+	TokensPerSec float64 `json:"tokens_per_sec"`
+	ConnectMs    float64 `json:"connect_ms,omitempty"`
+	TTFTMs       float64 `json:"ttft_ms,omitempty"`
+	GenerationMs float64 `json:"generation_ms,omitempty"`
+	AvgGapMs     float64 `json:"avg_gap_ms,omitempty"`
+	MaxGapMs     float64 `json:"max_gap_ms,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+func writeJSON(w io.Writer, stats []ModelStats) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(buildReport(stats))
+}
+
+// buildReport is the json report of stats, also what -baseline reads back
+func buildReport(stats []ModelStats) jsonReport {
+	report := jsonReport{URL: *baseURL, Stream: *stream, Parallel: *parallel, Warmup: *warmup, Models: make([]jsonModel, 0, len(stats))}
+	for _, s := range stats {
+		m := jsonStats(s)
+		for _, r := range s.Results {
+			res := jsonResult{
+				Prompt:       r.Prompt,
+				DurationMs:   ms(r.Duration),
+				Tokens:       r.Tokens,
+				TokensPerSec: r.TokensPerSec,
+				ConnectMs:    ms(r.Connect),
+				TTFTMs:       ms(r.TTFT),
+				GenerationMs: ms(r.Generation),
+				AvgGapMs:     ms(r.AvgGap),
+				MaxGapMs:     ms(r.MaxGap),
+			}
+			if r.Error != nil {
+				res.Error = r.Error.Error()
+			}
+			m.Results = append(m.Results, res)
+		}
+		// the runs are listed once, on the model
+		for _, p := range s.Prompts {
+			m.Prompts = append(m.Prompts, jsonStats(p))
+		}
+		report.Models = append(report.Models, m)
+	}
+	return report
+}
+
+// jsonStats is the aggregates of s, without its runs
+func jsonStats(s ModelStats) jsonModel {
+	m := jsonModel{
+		Model:     s.Model,
+		Prompt:    s.Prompt,
+		Runs:      s.Runs,
+		Errors:    s.Errors,
+		AvgTokens: s.AvgTokens,
+		DurationMs: jsonLatency{
+			Avg: ms(s.AvgDuration),
+			Min: ms(s.MinDuration),
+			Max: ms(s.MaxDuration),
+			P50: ms(s.P50Duration),
+			P90: ms(s.P90Duration),
+			P99: ms(s.P99Duration),
+		},
+		TokensPerSec: jsonRate{Avg: s.AvgTPS, P50: s.P50TPS, P90: s.P90TPS, P99: s.P99TPS},
+		WallMs:       ms(s.Wall),
+		AggregateTPS: s.AggregateTPS,
+	}
+	if *stream {
+		m.Stream = &jsonStream{
+			ConnectMs:    ms(s.AvgConnect),
+			TTFTMs:       ms(s.AvgTTFT),
+			GenerationMs: ms(s.AvgGeneration),
+			GapMs:        ms(s.AvgGap),
+			MaxGapMs:     ms(s.MaxGap),
+		}
+	}
+	return m
+}
+
+var csvHeader = []string{
+	"model", "prompt", "run", "duration_ms", "tokens", "tokens_per_sec",
+	"connect_ms", "ttft_ms", "generation_ms", "avg_gap_ms", "max_gap_ms", "error",
+}
+
+// writeCSV writes one row per run, aggregates are left to the consumer.
+// stream columns are empty for runs that did not stream
+func writeCSV(w io.Writer, stats []ModelStats) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	num := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, s := range stats {
+		for i, r := range s.Results {
+			row := make([]string, len(csvHeader))
+			row[0], row[1], row[2] = s.Model, r.Prompt, strconv.Itoa(i+1)
+			if r.Error != nil {
+				row[11] = r.Error.Error()
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+				continue
+			}
+			row[3], row[4], row[5] = num(ms(r.Duration)), strconv.Itoa(r.Tokens), num(r.TokensPerSec)
+			if *stream {
+				row[6], row[7], row[8] = num(ms(r.Connect)), num(ms(r.TTFT)), num(ms(r.Generation))
+				row[9], row[10] = num(ms(r.AvgGap)), num(ms(r.MaxGap))
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max-3] + "..."
+}
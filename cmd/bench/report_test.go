@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+
+	assert.Equal(t, 10.0, percentile(sorted, 0))
+	assert.Equal(t, 100.0, percentile(sorted, 100))
+	assert.InDelta(t, 55.0, percentile(sorted, 50), 1e-9, "between the two middle runs")
+	assert.InDelta(t, 91.0, percentile(sorted, 90), 1e-9)
+	assert.InDelta(t, 99.1, percentile(sorted, 99), 1e-9)
+
+	assert.Equal(t, 7.0, percentile([]float64{7}, 99), "a single run is every percentile")
+	assert.Equal(t, 0.0, percentile(nil, 50))
+	assert.Equal(t, 0.0, mean(nil))
+}
+
+func TestSummarize(t *testing.T) {
+	var ok []BenchResult
+	for i := 1; i <= 5; i++ {
+		ok = append(ok, BenchResult{Duration: time.Duration(6-i) * time.Second, Tokens: 10 * i, TokensPerSec: float64(i)})
+	}
+	stats := ModelStats{Runs: 5}
+	summarize(&stats, ok)
+
+	assert.Equal(t, 3*time.Second, stats.AvgDuration)
+	assert.Equal(t, time.Second, stats.MinDuration)
+	assert.Equal(t, 5*time.Second, stats.MaxDuration)
+	assert.Equal(t, 3*time.Second, stats.P50Duration)
+	assert.Equal(t, 4600*time.Millisecond, stats.P90Duration)
+	assert.Equal(t, 3.0, stats.P50TPS)
+	assert.InDelta(t, 4.96, stats.P99TPS, 1e-9)
+	assert.Equal(t, 30.0, stats.AvgTokens)
+}
+
+func TestCSVEscapesModel(t *testing.T) {
+	stats := []ModelStats{{
+		Model: `glm-4.6,"fast"`,
+		Runs:  2,
+		Results: []BenchResult{
+			{Prompt: "short", Duration: 1500 * time.Millisecond, Tokens: 30, TokensPerSec: 20},
+			{Error: errors.New("status 502: bad, gateway")},
+		},
+	}}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeCSV(&buf, stats))
+	assert.Contains(t, buf.String(), `"glm-4.6,""fast"""`)
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, csvHeader, rows[0])
+	assert.Equal(t, []string{`glm-4.6,"fast"`, "short", "1", "1500.000", "30", "20.000", "", "", "", "", "", ""}, rows[1])
+	assert.Equal(t, `glm-4.6,"fast"`, rows[2][0])
+	assert.Equal(t, "status 502: bad, gateway", rows[2][11])
+}
+
+func TestJSONListsEveryRun(t *testing.T) {
+	stats := []ModelStats{{
+		Model:       "glm",
+		Runs:        2,
+		Errors:      1,
+		AvgDuration: 2 * time.Second,
+		Results: []BenchResult{
+			{Duration: 2 * time.Second, Tokens: 40, TokensPerSec: 20},
+			{Error: errors.New("timeout")},
+		},
+	}}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeJSON(&buf, stats))
+
+	var report jsonReport
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+	require.Len(t, report.Models, 1)
+	assert.Equal(t, 2000.0, report.Models[0].DurationMs.Avg)
+	assert.Nil(t, report.Models[0].Stream)
+	assert.Equal(t, []jsonResult{{DurationMs: 2000, Tokens: 40, TokensPerSec: 20}, {Error: "timeout"}}, report.Models[0].Results)
+}
+
+func TestSortStats(t *testing.T) {
+	stats := []ModelStats{
+		{Model: "b", Runs: 1, AvgTPS: 10, P50Duration: 3 * time.Second},
+		{Model: "c", Runs: 1, Errors: 1},
+		{Model: "a", Runs: 1, AvgTPS: 30, P50Duration: 2 * time.Second},
+	}
+	names := func() []string {
+		var out []string
+		for _, s := range stats {
+			out = append(out, s.Model)
+		}
+		return out
+	}
+
+	sortStats(stats, "tps")
+	assert.Equal(t, []string{"a", "b", "c"}, names())
+	sortStats(stats, "name")
+	assert.Equal(t, []string{"a", "b", "c"}, names())
+	sortStats(stats, "latency")
+	assert.Equal(t, []string{"a", "b", "c"}, names(), "failed models have no latency and go last")
+
+	stats[0].P50Duration = 4 * time.Second
+	sortStats(stats, "latency")
+	assert.Equal(t, []string{"b", "a", "c"}, names())
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/jwt"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/server"
+	"github.com/zarazaex69/mo/pkg/client"
+)
+
+const chatUsage = `usage: mo chat [flags]
+
+talks to a running mo at -url, or with -token to z.ai directly through an
+in-process server. a line of """ (-sentinel) starts multi-line input, the
+next one sends it. ctrl-c stops a reply, ctrl-d quits
+
+`
+
+const chatCommands = `commands:
+  /model [name]   show or switch the model, "-" for the server default
+  /system [text]  set the system prompt, without text clear it
+  /clear          forget the conversation, the system prompt stays
+  /save <file>    write the conversation as json
+  /help           this text
+  /quit           leave, as does /exit
+
+a line starting with // is sent as is, less the first slash`
+
+// runChat is an interactive chat against mo, for quick sanity checks
+func runChat(configPath string, args []string) int {
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	url := fs.String("url", "http://localhost:8804", "mo base url")
+	key := fs.String("key", os.Getenv("OPENAI_API_KEY"), "api key sent as a bearer token, defaults to $OPENAI_API_KEY")
+	token := fs.String("token", "", "z.ai token, talk to the provider directly instead of -url")
+	model := fs.String("model", "", "model, the server default when empty")
+	system := fs.String("system", "", "system prompt")
+	sentinel := fs.String("sentinel", `"""`, "line that opens and closes multi-line input")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), chatUsage, chatCommands, "\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	base := strings.TrimRight(*url, "/")
+	if *token != "" {
+		addr, stop, err := serveDirect(configPath, *token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "start server:", err)
+			return 1
+		}
+		defer stop()
+		base = "http://" + addr
+	}
+
+	tty := isTerminal(os.Stdout)
+	r := &repl{
+		sess:      &session{model: *model, system: *system},
+		client:    &apiClient{base: base, key: *key, http: &http.Client{}},
+		in:        bufio.NewReader(os.Stdin),
+		out:       os.Stdout,
+		errOut:    os.Stderr,
+		pal:       newPalette(tty && os.Getenv("NO_COLOR") == ""),
+		prompt:    isTerminal(os.Stdin),
+		reasoning: tty,
+		sentinel:  *sentinel,
+	}
+	if err := r.run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// serveDirect runs mo with token on a loopback port, for chatting without
+// a server of its own. logs below error stay out of the conversation
+func serveDirect(configPath, token string) (string, func(), error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg.Upstream.Token = jwt.Normalize(token)
+	if _, err := jwt.Expiry(cfg.Upstream.Token); err != nil {
+		return "", nil, fmt.Errorf("-token: %w", err)
+	}
+
+	if err := logger.Init(logger.Options{Level: "error", Format: cfg.Log.Format}); err != nil {
+		return "", nil, err
+	}
+	srv, err := server.New(cfg, utils.NewTokenizer(cfg.Tokenizer.CacheDir, cfg.Tokenizer.Download))
+	if err != nil {
+		return "", nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		srv.Close()
+		return "", nil, err
+	}
+	hs := &http.Server{Handler: srv.Handler()}
+	go hs.Serve(ln)
+
+	return ln.Addr().String(), func() {
+		hs.Close()
+		srv.Close()
+	}, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// session is the conversation so far. the system prompt is kept apart so
+// /clear and /system do not step on each other
+type session struct {
+	model   string
+	system  string
+	history []chatMessage
+}
+
+// messages is what the next request sends, system prompt first
+func (s *session) messages() []chatMessage {
+	msgs := make([]chatMessage, 0, len(s.history)+1)
+	if s.system != "" {
+		msgs = append(msgs, chatMessage{Role: "system", Content: s.system})
+	}
+	return append(msgs, s.history...)
+}
+
+func (s *session) add(role, content string) {
+	s.history = append(s.history, chatMessage{Role: role, Content: content})
+}
+
+// dropLast forgets the last message, a question that got no answer
+func (s *session) dropLast() {
+	if len(s.history) > 0 {
+		s.history = s.history[:len(s.history)-1]
+	}
+}
+
+func (s *session) clear() {
+	s.history = nil
+}
+
+// save writes the conversation in the shape of a chat request, so the
+// file can be replayed with curl
+func (s *session) save(path string) error {
+	data, err := json.MarshalIndent(struct {
+		Model    string        `json:"model,omitempty"`
+		Messages []chatMessage `json:"messages"`
+	}{s.model, s.messages()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+type command struct {
+	name string
+	arg  string
+}
+
+// parseCommand splits a "/name arg" line. ok is false for chat text,
+// including lines escaped with a second slash
+func parseCommand(line string) (command, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		return command{}, false
+	}
+	name, arg, _ := strings.Cut(line[1:], " ")
+	return command{name: strings.ToLower(name), arg: strings.TrimSpace(arg)}, true
+}
+
+// readInput reads one turn: a line, or the lines between two sentinels.
+// block is set for the latter, which is never a command. io.EOF once the
+// input is done and nothing was read
+func readInput(in *bufio.Reader, sentinel string) (text string, block bool, err error) {
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line != sentinel {
+		return line, false, nil
+	}
+
+	var lines []string
+	for {
+		next, err := in.ReadString('\n')
+		next = strings.TrimRight(next, "\r\n")
+		if next == sentinel {
+			break
+		}
+		if err != nil {
+			// an unclosed block still goes out when the input ends
+			if next != "" {
+				lines = append(lines, next)
+			}
+			if len(lines) == 0 {
+				return "", false, err
+			}
+			break
+		}
+		lines = append(lines, next)
+	}
+	return strings.Join(lines, "\n"), true, nil
+}
+
+// completer sends the conversation and streams the reply to out
+type completer interface {
+	complete(ctx context.Context, model string, msgs []chatMessage, out func(reasoning, content string)) error
+}
+
+type apiClient struct {
+	base string
+	key  string
+	http *http.Client
+}
+
+func (c *apiClient) complete(ctx context.Context, model string, msgs []chatMessage, out func(reasoning, content string)) error {
+	body, _ := json.Marshal(map[string]any{"model": model, "messages": msgs, "stream": true})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, errorMessage(resp.Body))
+	}
+
+	stream := client.NewStream(ctx, resp)
+	defer stream.Close()
+	for stream.Next() {
+		for _, ch := range stream.Chunk().Choices {
+			if ch.Delta != nil {
+				out(ch.Delta.ReasoningContent, ch.Delta.Content)
+			}
+		}
+	}
+	return stream.Err()
+}
+
+// errorMessage is the message of an openai style error body, or the body
+func errorMessage(r io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(r, 4096))
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		return body.Error.Message
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// palette is ansi styling, empty strings when colors are off
+type palette struct {
+	dim, bold, red, reset string
+}
+
+func newPalette(color bool) palette {
+	if !color {
+		return palette{}
+	}
+	return palette{dim: "\033[2m", bold: "\033[1m", red: "\033[31m", reset: "\033[0m"}
+}
+
+type repl struct {
+	sess   *session
+	client completer
+	in     *bufio.Reader
+	// replies go to out, prompts, notes and errors to errOut
+	out    io.Writer
+	errOut io.Writer
+	pal    palette
+	// prompt for input, off when it is piped in
+	prompt bool
+	// print reasoning, off when the output is piped so it holds replies only
+	reasoning bool
+	sentinel  string
+}
+
+func (r *repl) run() error {
+	if r.prompt {
+		fmt.Fprintf(r.errOut, "%smo chat, /help for commands%s\n", r.pal.dim, r.pal.reset)
+	}
+	for {
+		if r.prompt {
+			fmt.Fprintf(r.errOut, "%s> %s", r.pal.bold, r.pal.reset)
+		}
+		text, block, err := readInput(r.in, r.sentinel)
+		if err == io.EOF {
+			if r.prompt {
+				fmt.Fprintln(r.errOut)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !block {
+			if cmd, ok := parseCommand(text); ok {
+				if r.command(cmd) {
+					return nil
+				}
+				continue
+			}
+			text = strings.TrimPrefix(text, "/")
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		r.turn(ctx, text)
+		stop()
+	}
+}
+
+// command runs a slash command, true to quit
+func (r *repl) command(cmd command) bool {
+	switch cmd.name {
+	case "quit", "exit":
+		return true
+	case "help":
+		fmt.Fprintln(r.errOut, chatCommands)
+	case "model":
+		switch cmd.arg {
+		case "":
+		case "-":
+			r.sess.model = ""
+		default:
+			r.sess.model = cmd.arg
+		}
+		model := r.sess.model
+		if model == "" {
+			model = "server default"
+		}
+		r.note("model: %s", model)
+	case "system":
+		r.sess.system = cmd.arg
+		if cmd.arg == "" {
+			r.note("system prompt cleared")
+		} else {
+			r.note("system prompt set")
+		}
+	case "clear":
+		r.sess.clear()
+		r.note("conversation cleared")
+	case "save":
+		if cmd.arg == "" {
+			r.fail("usage: /save <file>")
+			break
+		}
+		if err := r.sess.save(cmd.arg); err != nil {
+			r.fail("save: %v", err)
+			break
+		}
+		r.note("saved %d messages to %s", len(r.sess.messages()), cmd.arg)
+	default:
+		r.fail("unknown command /%s, /help lists them", cmd.name)
+	}
+	return false
+}
+
+// turn sends text with the history and streams the answer. a failed or
+// interrupted turn is dropped, the next question goes out without it
+func (r *repl) turn(ctx context.Context, text string) {
+	r.sess.add("user", text)
+
+	var answer strings.Builder
+	thinking := false
+	err := r.client.complete(ctx, r.sess.model, r.sess.messages(), func(reasoning, content string) {
+		if reasoning != "" && r.reasoning {
+			if !thinking {
+				fmt.Fprint(r.out, r.pal.dim)
+				thinking = true
+			}
+			fmt.Fprint(r.out, reasoning)
+		}
+		if content != "" {
+			if thinking {
+				fmt.Fprint(r.out, r.pal.reset+"\n\n")
+				thinking = false
+			}
+			answer.WriteString(content)
+			fmt.Fprint(r.out, content)
+		}
+	})
+	if thinking {
+		fmt.Fprint(r.out, r.pal.reset)
+	}
+	if answer.Len() > 0 || thinking {
+		fmt.Fprintln(r.out)
+	}
+
+	if err != nil {
+		r.sess.dropLast()
+		if ctx.Err() != nil {
+			r.note("interrupted")
+		} else {
+			r.fail("%v", err)
+		}
+		return
+	}
+	r.sess.add("assistant", answer.String())
+}
+
+func (r *repl) note(format string, args ...any) {
+	fmt.Fprintf(r.errOut, "%s%s%s\n", r.pal.dim, fmt.Sprintf(format, args...), r.pal.reset)
+}
+
+func (r *repl) fail(format string, args ...any) {
+	fmt.Fprintf(r.errOut, "%serror:%s %s\n", r.pal.red, r.pal.reset, fmt.Sprintf(format, args...))
+}
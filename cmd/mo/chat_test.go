@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommand(t *testing.T) {
+	for line, want := range map[string]command{
+		"/model glm-4.6":             {name: "model", arg: "glm-4.6"},
+		"/model":                     {name: "model"},
+		"  /SYSTEM  be terse, ok?  ": {name: "system", arg: "be terse, ok?"},
+		"/save /tmp/out.json":        {name: "save", arg: "/tmp/out.json"},
+	} {
+		cmd, ok := parseCommand(line)
+		assert.True(t, ok, line)
+		assert.Equal(t, want, cmd, line)
+	}
+
+	for _, line := range []string{"hello", "what does /model do?", "//model is a path", ""} {
+		_, ok := parseCommand(line)
+		assert.False(t, ok, line)
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	in := bufio.NewReader(strings.NewReader("hi\n\"\"\"\nfirst\n\n/not a command\n\"\"\"\r\nlast"))
+
+	text, block, err := readInput(in, `"""`)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", text)
+	assert.False(t, block)
+
+	text, block, err = readInput(in, `"""`)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n\n/not a command", text)
+	assert.True(t, block)
+
+	text, _, err = readInput(in, `"""`)
+	require.NoError(t, err)
+	assert.Equal(t, "last", text, "a line without a newline at the end still counts")
+
+	_, _, err = readInput(in, `"""`)
+	assert.Equal(t, io.EOF, err)
+
+	text, block, err = readInput(bufio.NewReader(strings.NewReader("EOF\nnever closed")), "EOF")
+	require.NoError(t, err)
+	assert.Equal(t, "never closed", text)
+	assert.True(t, block)
+}
+
+func TestSessionHistory(t *testing.T) {
+	s := &session{system: "be terse"}
+	s.add("user", "hi")
+	s.add("assistant", "hello")
+	assert.Equal(t, []chatMessage{
+		{Role: "system", Content: "be terse"},
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hello"},
+	}, s.messages())
+
+	s.dropLast()
+	assert.Equal(t, []chatMessage{{Role: "user", Content: "hi"}}, s.history)
+
+	s.clear()
+	assert.Equal(t, []chatMessage{{Role: "system", Content: "be terse"}}, s.messages(), "clear keeps the system prompt")
+
+	s.system = ""
+	s.dropLast()
+	assert.Empty(t, s.messages())
+}
+
+func TestSessionSave(t *testing.T) {
+	s := &session{model: "glm-4.6", system: "sys"}
+	s.add("user", "q")
+	s.add("assistant", "a")
+	path := filepath.Join(t.TempDir(), "chat.json")
+	require.NoError(t, s.save(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var saved struct {
+		Model    string        `json:"model"`
+		Messages []chatMessage `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, "glm-4.6", saved.Model)
+	assert.Equal(t, s.messages(), saved.Messages)
+}
+
+// fakeCompleter answers from replies in order and records what it was sent
+type fakeCompleter struct {
+	replies []fakeReply
+	models  []string
+	sent    [][]chatMessage
+}
+
+type fakeReply struct {
+	reasoning string
+	content   string
+	err       error
+}
+
+func (f *fakeCompleter) complete(_ context.Context, model string, msgs []chatMessage, out func(reasoning, content string)) error {
+	f.models = append(f.models, model)
+	f.sent = append(f.sent, append([]chatMessage(nil), msgs...))
+
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+	if reply.reasoning != "" {
+		out(reply.reasoning, "")
+	}
+	for _, word := range strings.SplitAfter(reply.content, " ") {
+		if word != "" {
+			out("", word)
+		}
+	}
+	return reply.err
+}
+
+func newTestRepl(input string, client completer, color bool) (*repl, *bytes.Buffer, *bytes.Buffer) {
+	var out, errOut bytes.Buffer
+	return &repl{
+		sess:      &session{},
+		client:    client,
+		in:        bufio.NewReader(strings.NewReader(input)),
+		out:       &out,
+		errOut:    &errOut,
+		pal:       newPalette(color),
+		reasoning: color,
+		sentinel:  `"""`,
+	}, &out, &errOut
+}
+
+func TestReplConversation(t *testing.T) {
+	client := &fakeCompleter{replies: []fakeReply{
+		{content: "Paris."},
+		{content: "about 2 million", err: errors.New("status 502: bad gateway")},
+		{content: "Berlin."},
+	}}
+	input := strings.Join([]string{
+		"/model glm-4.6",
+		"/system answer briefly",
+		"capital of France?",
+		"population?",
+		"/model -",
+		"capital of Germany?",
+		"/quit",
+		"never read",
+	}, "\n")
+	r, out, errOut := newTestRepl(input, client, false)
+	require.NoError(t, r.run())
+
+	assert.Equal(t, []string{"glm-4.6", "glm-4.6", ""}, client.models)
+	assert.Equal(t, []chatMessage{
+		{Role: "system", Content: "answer briefly"},
+		{Role: "user", Content: "capital of France?"},
+		{Role: "assistant", Content: "Paris."},
+		{Role: "user", Content: "capital of Germany?"},
+	}, client.sent[2], "the failed turn is left out of the history")
+	assert.Len(t, r.sess.history, 4)
+
+	assert.Equal(t, "Paris.\nabout 2 million\nBerlin.\n", out.String(), "replies alone go to out")
+	assert.Contains(t, errOut.String(), "status 502: bad gateway")
+	assert.Contains(t, errOut.String(), "model: server default")
+	assert.NotContains(t, errOut.String()+out.String(), "\033[", "no colors when they are off")
+}
+
+func TestReplCommands(t *testing.T) {
+	client := &fakeCompleter{replies: []fakeReply{{content: "ok"}}}
+	input := "/clear\n/bogus\n/save\n//etc/hosts is a file\n\n/system\n"
+	r, _, errOut := newTestRepl(input, client, false)
+	r.sess.system = "old"
+	require.NoError(t, r.run())
+
+	require.Len(t, client.sent, 1, "blank lines send nothing")
+	assert.Equal(t, "/etc/hosts is a file", client.sent[0][1].Content)
+	assert.Empty(t, r.sess.system)
+	assert.Contains(t, errOut.String(), "unknown command /bogus")
+	assert.Contains(t, errOut.String(), "usage: /save <file>")
+}
+
+func TestReplReasoning(t *testing.T) {
+	client := &fakeCompleter{replies: []fakeReply{
+		{reasoning: "thinking it over", content: "42"},
+		{reasoning: "again", content: "43"},
+	}}
+
+	r, out, _ := newTestRepl("q\n", client, true)
+	require.NoError(t, r.run())
+	assert.Equal(t, "\033[2mthinking it over\033[0m\n\n42\n", out.String(), "reasoning is dim and set apart")
+	assert.Equal(t, "42", r.sess.history[1].Content, "reasoning is not kept")
+
+	r, out, _ = newTestRepl("q\n", client, false)
+	require.NoError(t, r.run())
+	assert.Equal(t, "43\n", out.String(), "piped output holds the reply only")
+}
+
+func TestAPIClientStream(t *testing.T) {
+	var got struct {
+		Model    string        `json:"model"`
+		Messages []chatMessage `json:"messages"`
+		Stream   bool          `json:"stream"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer sk-test", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"reasoning_content\":\"hmm\"}}]}\n\n")
+		fmt.Fprint(w, ": ping\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	c := &apiClient{base: srv.URL, key: "sk-test", http: srv.Client()}
+	var reasoning, content string
+	err := c.complete(context.Background(), "glm", []chatMessage{{Role: "user", Content: "q"}}, func(r, c string) {
+		reasoning += r
+		content += c
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hmm", reasoning)
+	assert.Equal(t, "hi", content)
+	assert.Equal(t, "glm", got.Model)
+	assert.True(t, got.Stream)
+}
+
+func TestAPIClientErrors(t *testing.T) {
+	for want, reply := range map[string]http.HandlerFunc{
+		"status 503: server overloaded": func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"message": "server overloaded", "code": "server_overloaded"}}`)
+		},
+		"upstream went away": func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, "data: {\"error\":{\"message\":\"upstream went away\"}}\n\n")
+		},
+		io.ErrUnexpectedEOF.Error(): func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"cut\"}}]}\n\n")
+		},
+	} {
+		srv := httptest.NewServer(reply)
+		c := &apiClient{base: srv.URL, http: srv.Client()}
+		err := c.complete(context.Background(), "", nil, func(string, string) {})
+		srv.Close()
+
+		require.Error(t, err, want)
+		assert.Equal(t, want, err.Error())
+	}
+}
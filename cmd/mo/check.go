@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/server"
+)
+
+// checkSteps run in this order, a failed step exits with its position so
+// scripts can tell a bad config (1) from an upstream that is down (5)
+var checkSteps = []string{"config", "tokenizer", "init", "token", "models", "chat"}
+
+// checkTimeout bounds the whole check, a hung upstream still gets a report
+const checkTimeout = 2 * time.Minute
+
+// runCheck tests what serving depends on without listening: config,
+// tokenizer, the active token, the upstream model list and one chat request.
+// it stops at the first failure and returns its exit code, 0 when all passed
+func runCheck(configPath string, out io.Writer) int {
+	var steps []server.CheckStep
+	defer func() { writeCheck(out, steps) }()
+
+	step := func(name string, run func() (string, error)) bool {
+		start := time.Now()
+		detail, err := run()
+		steps = append(steps, server.CheckStep{Name: name, Err: err, Detail: detail, Elapsed: time.Since(start)})
+		return err == nil
+	}
+
+	var cfg *config.Config
+	if !step("config", func() (string, error) {
+		// nothing reads the installed config, Reload loads it fresh each run
+		var err error
+		if cfg, err = config.Reload(configPath); err != nil {
+			return "", err
+		}
+		if configPath == "" {
+			return "defaults and environment", nil
+		}
+		return configPath, nil
+	}) {
+		return checkCode(steps)
+	}
+
+	if err := logger.Init(logger.Options{Level: "error", Format: cfg.Log.Format}); err != nil {
+		steps = append(steps, server.CheckStep{Name: "init", Err: err})
+		return checkCode(steps)
+	}
+
+	tokenizer := utils.NewTokenizer(cfg.Tokenizer.CacheDir, cfg.Tokenizer.Download)
+	if !step("tokenizer", func() (string, error) {
+		return "cl100k_base", tokenizer.Init()
+	}) {
+		return checkCode(steps)
+	}
+
+	var srv *server.Server
+	if !step("init", func() (string, error) {
+		var err error
+		srv, err = server.NewCheck(cfg, tokenizer)
+		return "", err
+	}) {
+		return checkCode(steps)
+	}
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	steps = append(steps, srv.Check(ctx)...)
+	return checkCode(steps)
+}
+
+// checkCode is the exit code for steps, the position of a failed one
+func checkCode(steps []server.CheckStep) int {
+	for _, st := range steps {
+		if st.Err != nil {
+			return slices.Index(checkSteps, st.Name) + 1
+		}
+	}
+	return 0
+}
+
+func writeCheck(w io.Writer, steps []server.CheckStep) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tRESULT\tTIME\tDETAIL")
+	for _, st := range steps {
+		result, detail := "pass", st.Detail
+		if st.Err != nil {
+			result, detail = "FAIL", st.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", st.Name, result, st.Elapsed.Round(time.Millisecond), detail)
+	}
+	tw.Flush()
+
+	if code := checkCode(steps); code != 0 {
+		fmt.Fprintf(w, "check failed at %s, exit %d\n", checkSteps[code-1], code)
+		return
+	}
+	fmt.Fprintln(w, "all checks passed")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+// fakeZai serves the z.ai endpoints --check touches, a status other than
+// 200 makes that endpoint fail
+func fakeZai(t *testing.T, auths, models, chat int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/auths/":
+			w.WriteHeader(auths)
+			io.WriteString(w, `{"id":"u-1","name":"check"}`)
+		case "/api/models":
+			w.WriteHeader(models)
+			io.WriteString(w, `{"data":[{"id":"GLM-4-6-API-V1"},{"id":"glm-4.5v"}]}`)
+		case "/api/v2/chat/completions":
+			if chat != http.StatusOK {
+				http.Error(w, `{"detail":"bad request"}`, chat)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, `data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}`+"\n\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRunCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		auths  int
+		models int
+		chat   int
+		// a serving mo holds the token store
+		held   bool
+		want   int
+		report []string
+	}{
+		{name: "all pass", want: 0, report: []string{"token      pass", "user u-1", "2 upstream models", `"ok"`, "all checks passed"}},
+		{name: "beside a serving mo", held: true, want: 0, report: []string{"init       pass", "all checks passed"}},
+		{name: "bad config", config: "server: [", want: 1, report: []string{"config  FAIL", "check failed at config, exit 1"}},
+		{name: "token rejected", auths: http.StatusUnauthorized, want: 4, report: []string{"token      FAIL", "check failed at token, exit 4"}},
+		{name: "models down", models: http.StatusBadGateway, want: 5, report: []string{"models     FAIL", "check failed at models, exit 5"}},
+		{name: "chat refused", chat: http.StatusBadRequest, want: 6, report: []string{"models     pass", "chat       FAIL", "check failed at chat, exit 6"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := func(s int) int { return max(s, http.StatusOK) }
+			zai := fakeZai(t, status(tt.auths), status(tt.models), status(tt.chat))
+
+			dir := t.TempDir()
+			t.Setenv("MO_DATA_PATH", filepath.Join(dir, "data"))
+			t.Setenv("ZAI_TOKEN", "")
+			if tt.held {
+				store, err := tokenstore.New(filepath.Join(dir, "data", "tokens"))
+				require.NoError(t, err)
+				t.Cleanup(func() { store.Close() })
+			}
+
+			config := tt.config
+			if config == "" {
+				// each case has a token of its own, users are cached by token
+				config = fmt.Sprintf("upstream:\n  protocol: \"http:\"\n  host: %s\n  token: eyJhbGciOiJIUzI1NiJ9.eyJpZCI6InUtMSJ9.Y2FzZS0%d\nhttp:\n  retry:\n    max_attempts: 1\n",
+					strings.TrimPrefix(zai.URL, "http://"), i)
+			}
+			path := filepath.Join(dir, "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(config), 0o600))
+
+			var out bytes.Buffer
+			code := runCheck(path, &out)
+			assert.Equal(t, tt.want, code, out.String())
+			for _, line := range tt.report {
+				assert.Contains(t, out.String(), line)
+			}
+		})
+	}
+}
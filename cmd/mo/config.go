@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+const configUsage = `usage: mo config check [-json]
+
+loads the config like the server would, prints every effective setting with
+where it came from (default, file with its line, or env), secrets masked, and
+lists all problems. exits 1 when there are any`
+
+// runConfig checks the configuration without starting the server
+func runConfig(configPath string, args []string) int {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 || (len(args) == 2 && args[1] != "-json") {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+
+	cfg, err := config.Inspect(configPath)
+	var verr *config.ValidationError
+	if err != nil && !errors.As(err, &verr) {
+		fmt.Fprintln(os.Stderr, "config error:", err)
+		return 1
+	}
+
+	var problems []config.Problem
+	if verr != nil {
+		problems = verr.Problems
+	}
+	if len(args) == 2 {
+		json.NewEncoder(os.Stdout).Encode(map[string]any{
+			"file":     configPath,
+			"settings": cfg.Resolved(),
+			"problems": problems,
+		})
+	} else {
+		writeSettings(os.Stdout, configPath, cfg.Resolved())
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "error:", p)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems in the config\n", len(problems))
+		return 1
+	}
+	return 0
+}
+
+func writeSettings(w io.Writer, file string, settings []config.Setting) {
+	if file == "" {
+		file = "none"
+	}
+	fmt.Fprintln(w, "config file:", file)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	for _, s := range settings {
+		source := s.Source
+		if s.Line > 0 {
+			source += ":" + strconv.Itoa(s.Line)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Path, strconv.Quote(s.Value), source)
+	}
+	tw.Flush()
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"cmp"
 	"flag"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 
 	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
@@ -11,33 +13,49 @@ import (
 	"github.com/zarazaex69/mo/internal/server"
 )
 
+const configHint = "hint: use --config or MO_CONFIG, or place config.yaml in ./configs, ~/.config/mo or /etc/mo"
+
 func main() {
 	var configPath string
 	var port int
+	var check bool
 
-	flag.StringVar(&configPath, "config", "", "path to config file")
+	flag.StringVar(&configPath, "config", "", "path to config file, or MO_CONFIG")
 	flag.StringVar(&configPath, "c", "", "path to config file (shorthand)")
 	flag.IntVar(&port, "port", 0, "server port (overrides config)")
 	flag.IntVar(&port, "p", 0, "server port (shorthand)")
+	flag.BoolVar(&check, "check", false, "test config, token, upstream models and one chat request, then exit")
 	flag.Parse()
 
-	if configPath == "" {
-		candidates := []string{
-			"configs/config.yaml",
-			filepath.Join(os.Getenv("HOME"), ".config", "traw", "configs", "config.yaml"),
-		}
-		for _, p := range candidates {
-			if _, err := os.Stat(p); err == nil {
-				configPath = p
-				break
-			}
-		}
+	if flag.Arg(0) == "tokens" {
+		os.Exit(runTokens(flag.Args()[1:]))
+	}
+
+	asked := cmp.Or(configPath, os.Getenv("MO_CONFIG"))
+	configPath, err := config.Find(configPath)
+	if err != nil {
+		println("config error:", err.Error())
+		println(configHint)
+		os.Exit(1)
+	}
+	if configPath == "" && asked != "" {
+		println("config file", asked, "not found, running on defaults and the environment")
+	}
+
+	if check {
+		os.Exit(runCheck(configPath, os.Stdout))
+	}
+	if flag.Arg(0) == "chat" {
+		os.Exit(runChat(configPath, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "config" {
+		os.Exit(runConfig(configPath, flag.Args()[1:]))
 	}
 
 	cfg, err := config.Load(configPath)
 	if err != nil {
 		println("config error:", err.Error())
-		println("hint: use --config flag or place config in ~/.config/traw/configs/config.yaml")
+		println(configHint)
 		os.Exit(1)
 	}
 
@@ -45,9 +63,17 @@ func main() {
 		cfg.Server.Port = port
 	}
 
-	logger.Init(cfg.Server.Debug)
+	if err := logger.Init(logger.Options{
+		Level:   cfg.Log.Level,
+		Modules: cfg.Log.Modules,
+		Format:  cfg.Log.Format,
+		RawFile: cfg.Log.RawFile,
+	}); err != nil {
+		println("log error:", err.Error())
+		os.Exit(1)
+	}
 
-	tokenizer := utils.NewTokenizer()
+	tokenizer := utils.NewTokenizer(cfg.Tokenizer.CacheDir, cfg.Tokenizer.Download)
 
 	srv, err := server.New(cfg, tokenizer)
 	if err != nil {
@@ -56,6 +82,21 @@ func main() {
 	}
 	defer srv.Close()
 
+	// SIGHUP rereads the config, e.g. after z.ai rotated the signature secret
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next, err := config.Reload(configPath)
+			if err == nil {
+				err = srv.Reload(next)
+			}
+			if err != nil {
+				logger.Error().Err(err).Msg("reload failed, keeping the running config")
+			}
+		}
+	}()
+
 	if err := srv.Start(); err != nil {
 		logger.Fatal().Err(err).Msg("server failed")
 		os.Exit(1)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+const tokensUsage = `usage:
+  mo tokens export [file]   write an encrypted bundle of all tokens, stdout without a file
+  mo tokens import <file>   merge a bundle into the store, - reads stdin
+
+the passphrase comes from MO_BACKUP_PASSPHRASE or is asked for. the store is
+opened directly, stop the server first. importing from stdin needs the
+environment variable`
+
+// runTokens moves tokens in and out of the store without a running server
+func runTokens(args []string) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") || (args[0] == "import" && len(args) < 2) {
+		fmt.Fprintln(os.Stderr, tokensUsage)
+		return 2
+	}
+
+	store, err := tokenstore.New(filepath.Join(config.DataPath(), "tokens"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open token store:", err)
+		return 1
+	}
+	defer store.Close()
+
+	passphrase, err := readPassphrase()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args[0] == "export" {
+		err = exportTokens(store, passphrase, args[1:])
+	} else {
+		err = importTokens(store, passphrase, args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func exportTokens(store *tokenstore.Store, passphrase string, args []string) error {
+	tokens, err := store.List()
+	if err != nil {
+		return fmt.Errorf("list tokens: %w", err)
+	}
+	bundle, err := tokenstore.Seal(tokens, passphrase)
+	if err != nil {
+		return fmt.Errorf("seal tokens: %w", err)
+	}
+	data, _ := json.MarshalIndent(bundle, "", "  ")
+
+	if len(args) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	if err := os.WriteFile(args[0], data, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d tokens to %s\n", len(tokens), args[0])
+	return nil
+}
+
+func importTokens(store *tokenstore.Store, passphrase, path string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	var bundle tokenstore.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("read bundle: %w", err)
+	}
+	tokens, err := bundle.Open(passphrase)
+	if err != nil {
+		return err
+	}
+	res, err := store.Import(tokens)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "added %d, updated %d, skipped %d\n", res.Added, res.Updated, res.Skipped)
+	return nil
+}
+
+func readPassphrase() (string, error) {
+	if p := os.Getenv("MO_BACKUP_PASSPHRASE"); p != "" {
+		return p, nil
+	}
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if p := strings.TrimRight(line, "\r\n"); p != "" {
+		return p, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read passphrase: %w", err)
+	}
+	return "", fmt.Errorf("empty passphrase")
+}
@@ -1,41 +1,542 @@
 package config
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/zarazaex69/mo/internal/pkg/jwt"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Upstream UpstreamConfig `yaml:"upstream"`
-	Model    ModelConfig    `yaml:"model"`
-	Headers  HeadersConfig  `yaml:"headers"`
+	Server   ServerConfig     `yaml:"server"`
+	Log      LogConfig        `yaml:"log"`
+	Upstream UpstreamConfig   `yaml:"upstream"`
+	Qwen     QwenConfig       `yaml:"qwen"`
+	OpenAI   []OpenAIUpstream `yaml:"openai_upstreams"`
+	Model    ModelConfig      `yaml:"model"`
+	// upstream model id or glob -> defaults for its requests
+	Models    map[string]ModelProfile `yaml:"models"`
+	Headers   HeadersConfig           `yaml:"headers"`
+	Limits    LimitsConfig            `yaml:"limits"`
+	Compat    CompatConfig            `yaml:"compat"`
+	RateLimit RateLimitConfig         `yaml:"rate_limit"`
+	Hooks     HooksConfig             `yaml:"hooks"`
+	Filters   FiltersConfig           `yaml:"filters"`
+	Caps      CapsConfig              `yaml:"caps"`
+	Pricing   PricingConfig           `yaml:"pricing"`
+	Bench     BenchConfig             `yaml:"bench"`
+	Batch     BatchConfig             `yaml:"batch"`
+	Files     FilesConfig             `yaml:"files"`
+	Audio     AudioConfig             `yaml:"audio"`
+	HTTP      HTTPConfig              `yaml:"http"`
+	Tokenizer TokenizerConfig         `yaml:"tokenizer"`
+	Browser   BrowserConfig           `yaml:"browser"`
+	TempMail  TempMailConfig          `yaml:"tempmail"`
+
+	// where settings came from and their line in the file, see Resolved
+	sources map[string]string
+	lines   map[string]int
 }
 
 type ServerConfig struct {
-	Port    int    `yaml:"port"`
-	Host    string `yaml:"host"`
-	Debug   bool   `yaml:"debug"`
-	Version string `yaml:"version"`
+	Port           int       `yaml:"port"`
+	Host           string    `yaml:"host"`
+	Debug          bool      `yaml:"debug"`
+	Version        string    `yaml:"version"`
+	ExposeRootInfo bool      `yaml:"expose_root_info"`
+	TLS            TLSConfig `yaml:"tls"`
+	// ": ping" comment on a stream quiet this long, 0 disables
+	StreamHeartbeat time.Duration `yaml:"stream_heartbeat"`
+	// gzip or deflate json replies this large for clients that accept it,
+	// event streams never. 0 disables
+	CompressMinBytes int `yaml:"compress_min_bytes"`
+	// stream bytes held for a client slower than upstream before it is
+	// dropped, 0 holds any amount
+	StreamBufferBytes int `yaml:"stream_buffer_bytes"`
+	// a client that takes no stream data this long is dropped, 0 waits forever
+	StreamStallTimeout time.Duration `yaml:"stream_stall_timeout"`
+	// keep reading upstream after dropping a client, the reply still reaches
+	// log.raw_file and the usage
+	StreamDrainDropped bool `yaml:"stream_drain_dropped"`
+	// before listening, init the tokenizer and look up the users of the
+	// active and the next stored tokens, so the first request pays for neither
+	Warmup bool `yaml:"warmup"`
+	// longest the listener waits for warmup, which then goes on behind it.
+	// 0 does not wait
+	WarmupTimeout time.Duration `yaml:"warmup_timeout"`
+	// browser origins besides the server's own that may open /v1/chat/ws,
+	// e.g. https://chat.example.org
+	WSOrigins []string `yaml:"ws_origins"`
+}
+
+type LogConfig struct {
+	// trace, debug, info, warn or error. server.debug raises it to debug
+	Level string `yaml:"level"`
+	// console for people, json for log shippers such as loki
+	Format string `yaml:"format"`
+	// module -> level, e.g. zlm: debug. LOG_LEVEL_ZLM sets the same
+	Modules map[string]string `yaml:"modules"`
+	// raw upstream chunks go to this file only, empty logs them at trace
+	RawFile string `yaml:"raw_file"`
+	// dump every z.ai chat request and the headers of its reply with
+	// credentials masked: "log" at debug level, "files" one per request
+	// under MO_DATA_PATH/debug/requests, empty dumps nothing
+	Dump string `yaml:"dump"`
+	// dump files kept, the oldest go first. 0 keeps all
+	DumpKeep int `yaml:"dump_keep"`
+}
+
+var logLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
 }
 
 type UpstreamConfig struct {
 	Protocol string `yaml:"protocol"`
 	Host     string `yaml:"host"`
-	Token    string `yaml:"token"`
+	// mirrors in order of preference, replaces host when set
+	Hosts    []string       `yaml:"hosts"`
+	Failover FailoverConfig `yaml:"failover"`
+	Token    string         `yaml:"token"`
+	// guest fetches z.ai's anonymous token when neither config nor the store
+	// has one, and a new one once it expires. "" uses only given tokens
+	TokenMode string `yaml:"token_mode"`
+	// wait for the response headers of a chat request, 0 waits forever
+	HeaderTimeout time.Duration `yaml:"header_timeout"`
+	// longest silence between stream chunks before the reply is abandoned,
+	// the stream as a whole is never timed out. 0 disables
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// how long /health/ready trusts its last probe of /api/models, 0 never probes
+	ProbeTTL time.Duration `yaml:"probe_ttl"`
+	// how chat requests are signed, reloaded on SIGHUP
+	Signature SignatureConfig `yaml:"signature"`
+	// endpoints, changed for mirrors and gateways that remap them
+	Paths UpstreamPaths `yaml:"paths"`
+	// conversation ids pinned to their upstream chat, the least recently
+	// used go first. 0 starts a chat per request
+	Conversations int `yaml:"conversations"`
+}
+
+// TokenModeGuest runs on z.ai's anonymous guest token
+const TokenModeGuest = "guest"
+
+type FailoverConfig struct {
+	// failures in a row, errors or 5xx, before a host is skipped
+	MaxFailures int `yaml:"max_failures"`
+	// how often skipped hosts are probed to bring them back, 0 never
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+}
+
+// AllHosts is hosts, or host alone
+func (u UpstreamConfig) AllHosts() []string {
+	if len(u.Hosts) > 0 {
+		return u.Hosts
+	}
+	return []string{u.Host}
+}
+
+// QwenConfig covers requests to portal.qwen.ai
+type QwenConfig struct {
+	// base64 images larger than this are scaled down and sent as jpeg to
+	// vision-model, whose payload limit the originals may exceed. 0 sends
+	// them as they are
+	ImageMaxBytes int `yaml:"image_max_bytes"`
+	// longest side in pixels an image is scaled down to
+	ImageMaxSide int `yaml:"image_max_side"`
+	// tokens are refreshed in the background this long before they expire,
+	// 0 leaves it to the request that finds one expired
+	RefreshMargin time.Duration `yaml:"refresh_margin"`
+	// up to this much earlier still, so tokens issued together do not all
+	// refresh in the same second
+	RefreshJitter time.Duration `yaml:"refresh_jitter"`
+}
+
+// OpenAIUpstream is one openai compatible server mo fronts, llama.cpp and
+// the like. requests for its models are forwarded close to verbatim
+type OpenAIUpstream struct {
+	// provider name in logs, metrics and usage, unique across upstreams
+	Name string `yaml:"name"`
+	// api root, /chat/completions is appended
+	BaseURL string `yaml:"base_url"`
+	// sent as a bearer token, empty sends none
+	APIKey string `yaml:"api_key"`
+	// model ids served as they are
+	Models []string `yaml:"models"`
+	// models starting with it are served too, without it upstream
+	ModelPrefix string            `yaml:"model_prefix"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+// UpstreamPaths are the z.ai endpoints, empty ones use DefaultUpstreamPaths
+type UpstreamPaths struct {
+	// prefix of every path, for a gateway mounted under /something
+	Base   string `yaml:"base"`
+	Chat   string `yaml:"chat"`
+	Auth   string `yaml:"auth"`
+	Models string `yaml:"models"`
+	Files  string `yaml:"files"`
+}
+
+var DefaultUpstreamPaths = UpstreamPaths{
+	Chat:   "/api/v2/chat/completions",
+	Auth:   "/api/v1/auths/",
+	Models: "/api/models",
+	Files:  "/api/v1/files/",
+}
+
+type SignatureConfig struct {
+	// hmac secret of the z.ai web client, empty uses the built-in one
+	Secret string `yaml:"secret"`
+	// algorithm, v1 is the only one so far
+	Version string `yaml:"version"`
 }
 
 type ModelConfig struct {
-	Default   string `yaml:"default"`
+	Default       string `yaml:"default"`
+	ThinkMode     string `yaml:"think_mode"`
+	ReasoningOnly string `yaml:"reasoning_only"`
+	// one corrective retry when a json mode reply fails validation
+	JSONRetry bool `yaml:"json_retry"`
+	// continue a non-stream reply the upstream cut short instead of starting over
+	ResumePartial bool `yaml:"resume_partial"`
+	// alias -> upstream model id, pinned and checked for drift on refresh
+	Aliases       map[string]string `yaml:"aliases"`
+	OnDrift       string            `yaml:"on_drift"`
+	DriftWebhook  string            `yaml:"drift_webhook"`
+	ModelsRefresh time.Duration     `yaml:"models_refresh"`
+	// age past which /v1/models refreshes the cached list on request
+	ModelsTTL time.Duration `yaml:"models_ttl"`
+	// model -> system prompt every request for it gets, the requested name
+	// is looked up before the one an alias resolves to
+	SystemPrompts map[string]SystemPrompt `yaml:"system_prompts"`
+	// z.ai answer cleaners by name, false turns one off, unlisted ones run
+	AnswerCleaners map[string]bool `yaml:"answer_cleaners"`
+}
+
+var thinkModes = []string{"reasoning", "think", "strip", "details"}
+
+// ModelProfile holds defaults for the requests of a model, what a request
+// sets itself wins. matched against the model an alias resolves to
+type ModelProfile struct {
+	Temperature *float64 `yaml:"temperature"`
+	TopP        *float64 `yaml:"top_p"`
+	MaxTokens   *int     `yaml:"max_tokens"`
+	// only for requests without thinking and reasoning_effort
+	Thinking *bool `yaml:"thinking"`
+	// replaces model.think_mode, reasoning_format of a request still wins
 	ThinkMode string `yaml:"think_mode"`
 }
 
+// Profile is the models entry for model, its own or else the longest glob
+// matching it
+func (c *Config) Profile(model string) (ModelProfile, bool) {
+	if p, ok := c.Models[model]; ok {
+		return p, true
+	}
+	best := ""
+	for pattern := range c.Models {
+		if ok, _ := path.Match(pattern, model); !ok {
+			continue
+		}
+		if len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return ModelProfile{}, false
+	}
+	return c.Models[best], true
+}
+
+// answer cleaners of the zlm formatter, keep in sync
+var answerCleaners = []string{"box_tokens", "stray_fence", "duplicate_sentence"}
+
+// SystemPrompt is added to the requests for a model. prepend puts it before
+// the system messages a request brings, replace drops those, and
+// append_if_absent adds it only to requests that bring none
+type SystemPrompt struct {
+	Text string `yaml:"text"`
+	// prepend when empty
+	Mode string `yaml:"mode"`
+}
+
+// LimitsConfig bounds what a single chat request may carry, 0 disables a limit
+type LimitsConfig struct {
+	MaxBodyBytes        int `yaml:"max_body_bytes"`
+	MaxMessages         int `yaml:"max_messages"`
+	MaxPromptChars      int `yaml:"max_prompt_chars"`
+	MaxImagesPerMessage int `yaml:"max_images_per_message"`
+	MaxImageBytes       int `yaml:"max_image_bytes"`
+	// model -> context window in tokens, prompt plus max_tokens must fit
+	ContextTokens map[string]int `yaml:"context_tokens"`
+	// chat requests handled at once across all clients, a stream counts
+	// until upstream answers. more wait in a queue of QueueSize for up to
+	// QueueTimeout, the rest get 503
+	MaxInFlight  int           `yaml:"max_in_flight"`
+	QueueSize    int           `yaml:"queue_size"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// an identical non-stream request at temperature 0 waits this long for
+	// the one in flight and gets a copy of its response. 0 disables
+	CoalesceWait time.Duration `yaml:"coalesce_wait"`
+}
+
+// CompatConfig selects how closely responses follow the openai api:
+// strict drops every extension, extended keeps them
+type CompatConfig struct {
+	Profile string `yaml:"profile"`
+	// api key -> profile, overrides Profile for that client
+	Keys map[string]string `yaml:"keys"`
+}
+
+// RateLimitConfig gives every client a token bucket of a minute's budget, by api key or by ip
+type RateLimitConfig struct {
+	RateBudget `yaml:",inline"`
+	// api key -> budget replacing the one above for that client
+	Keys map[string]RateBudget `yaml:"keys"`
+}
+
+// RateBudget is what a client may spend per minute, 0 disables a budget
+type RateBudget struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	// prompt and completion tokens together, streamed ones count as they flow
+	TokensPerMinute int `yaml:"tokens_per_minute"`
+}
+
+// HooksConfig transforms requests before dispatch and reply content after,
+// hook types are the built-ins of package hooks plus compiled-in ones
+type HooksConfig struct {
+	HookChains `yaml:",inline"`
+	// api key -> hooks run after the ones above for that client
+	Keys map[string]HookChains `yaml:"keys"`
+}
+
+// HookChains are hooks run in order
+type HookChains struct {
+	Request  []HookConfig `yaml:"request"`
+	Response []HookConfig `yaml:"response"`
+}
+
+// HookConfig is one hook, which fields matter depends on the type
+type HookConfig struct {
+	Type string `yaml:"type"`
+	// prepend_system
+	Text string `yaml:"text"`
+	// regex_redact and regex_replace
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	// max_messages
+	Max int `yaml:"max"`
+	// free form settings of compiled-in hooks
+	Options map[string]string `yaml:"options"`
+}
+
+// FiltersConfig keeps patterns out of reply content and reasoning, streams
+// included. redact matches are replaced by Mask, an abort match ends the
+// reply right before it with finish_reason content_filter
+type FiltersConfig struct {
+	Redact []string `yaml:"redact"`
+	Abort  []string `yaml:"abort"`
+	Mask   string   `yaml:"mask"`
+	// longest match assumed of a pattern with * or +. streams hold back the
+	// latest text about as long as the longest pattern can match
+	MaxMatch int `yaml:"max_match"`
+}
+
+// CapsConfig ends a runaway reply: upstream is no longer read and the reply
+// finishes with finish_reason length, or timeout past MaxDuration
+type CapsConfig struct {
+	ReplyCaps `yaml:",inline"`
+	// api key -> caps replacing the ones above for that client
+	Keys map[string]ReplyCaps `yaml:"keys"`
+}
+
+// ReplyCaps bound one reply, content and reasoning together. 0 disables a cap
+type ReplyCaps struct {
+	MaxChars  int `yaml:"max_chars"`
+	MaxTokens int `yaml:"max_tokens"`
+	// from the request arriving, checked as the reply streams in. a silent
+	// upstream is left to upstream.idle_timeout, a reply an openai upstream
+	// sends whole is only cut to size
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+func (c ReplyCaps) negative() bool {
+	return c.MaxChars < 0 || c.MaxTokens < 0 || c.MaxDuration < 0
+}
+
+// PricingConfig turns token usage into a dollar-equivalent estimate for
+// chargeback. prices are per 1k tokens, models without one cost null
+type PricingConfig struct {
+	Currency string `yaml:"currency"`
+	// return the estimate in the mo object of extended responses
+	InResponse bool                  `yaml:"in_response"`
+	Models     map[string]ModelPrice `yaml:"models"`
+}
+
+type ModelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// BenchConfig points cmd/bench at prompts that exercise this deployment
+type BenchConfig struct {
+	// jsonl of {"messages": [...]}, read on every request so it can be swapped live
+	SampleFile string `yaml:"sample_file"`
+}
+
+// BatchConfig covers /v1/batches
+type BatchConfig struct {
+	// requests of all batches run at once, rate limits of the batch's api
+	// key still apply
+	Concurrency int `yaml:"concurrency"`
+	// requests one batch may hold
+	MaxRequests int `yaml:"max_requests"`
+}
+
+// FilesConfig covers GET /v1/files/{id}/content, the proxy to z.ai's files
+type FilesConfig struct {
+	// point upstream file and cdn links in replies at the proxy, for
+	// clients that cannot reach z.ai
+	RewriteURLs bool `yaml:"rewrite_file_urls"`
+	// base of rewritten links, empty takes scheme and host from the request
+	PublicURL string `yaml:"public_url"`
+	// hosts besides upstream's whose files may be proxied. they get no token
+	CDNHosts []string `yaml:"cdn_hosts"`
+	// how long a proxied file is kept on disk, 0 disables the cache
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// larger files are streamed through and never cached
+	CacheMaxBytes int64 `yaml:"cache_max_bytes"`
+	// empty means <data path>/files
+	CacheDir string `yaml:"cache_dir"`
+}
+
+// AudioConfig covers input_audio content parts, which z.ai cannot hear
+type AudioConfig struct {
+	// an openai compatible /v1/audio/transcriptions url. audio is sent as
+	// its transcription, empty refuses it with 400
+	TranscriptionURL string `yaml:"transcription_url"`
+	APIKey           string `yaml:"api_key"`
+	Model            string `yaml:"model"`
+	// per transcription, 0 waits as long as the request does
+	Timeout time.Duration `yaml:"timeout"`
+	// decoded size of one audio part, 0 disables the limit
+	MaxBytes int `yaml:"max_bytes"`
+}
+
+// HTTPConfig tunes the connection pool shared by every outbound request
+type HTTPConfig struct {
+	ConnectTimeout      time.Duration `yaml:"connect_timeout"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+	HTTP2               bool          `yaml:"http2"`
+	Retry               RetryConfig   `yaml:"retry"`
+}
+
+// RetryConfig covers upstream calls that fail before any response arrives
+type RetryConfig struct {
+	// tries in total, 1 disables retries
+	MaxAttempts int `yaml:"max_attempts"`
+	// time all tries of one call may take together, 0 for no limit
+	Budget time.Duration `yaml:"budget"`
+}
+
+// TokenizerConfig says where the bpe ranks come from when they are not
+// built into the binary
+type TokenizerConfig struct {
+	// ranks cache, empty means <data path>/tiktoken
+	CacheDir string `yaml:"cache_dir"`
+	// fetch missing ranks from openai once, off on air-gapped hosts
+	Download bool `yaml:"download"`
+	// prompt tokens billed per attached image, openai charges 765 for a
+	// high detail 1024x1024 one
+	ImageTokens int `yaml:"image_tokens"`
+}
+
+// BrowserConfig covers the window account registration drives
+type BrowserConfig struct {
+	// run without a window, needs a captcha solver other than manual
+	Headless bool          `yaml:"headless"`
+	Captcha  CaptchaConfig `yaml:"captcha"`
+	// how long the verification email may take to arrive
+	VerifyEmailTimeout time.Duration `yaml:"verify_email_timeout"`
+	// how long a page may take to load or move on after a submit
+	RedirectTimeout time.Duration `yaml:"redirect_timeout"`
+	// how long the session cookie may take to show up after verification
+	TokenTimeout time.Duration `yaml:"token_timeout"`
+	// how long a button or field the flow needs may take to show up
+	ElementTimeout time.Duration `yaml:"element_timeout"`
+	// how long to look for an element only some page versions have
+	OptionalElementTimeout time.Duration `yaml:"optional_element_timeout"`
+	// how often page waits check the page
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// how often the temp mailbox is checked
+	EmailPollInterval time.Duration `yaml:"email_poll_interval"`
+	// tries of the email and token waits, 1 fails the run on the first error
+	StepAttempts int `yaml:"step_attempts"`
+	// pause between tries of a step
+	StepRetryDelay time.Duration `yaml:"step_retry_delay"`
+	// screenshots and html of failed steps, empty means <data path>/debug
+	DebugDir string `yaml:"debug_dir"`
+	// how long the window of a failed registration stays open, 0 closes it
+	KeepOpen time.Duration `yaml:"keep_open"`
+}
+
+// TempMailConfig lists the temp mail backends registration uses, in order
+type TempMailConfig struct {
+	// temp-mail.io, mail.tm and imap, when one can not create a mailbox the
+	// next is tried
+	Providers []string   `yaml:"providers"`
+	IMAP      IMAPConfig `yaml:"imap"`
+}
+
+// IMAPConfig reaches a catch-all mailbox, registration makes up addresses
+// on Domain and reads their mail here
+type IMAPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Domain   string `yaml:"domain"`
+	// folder the mail lands in
+	Mailbox string `yaml:"mailbox"`
+	// plain tcp instead of tls, for a server on localhost
+	Insecure bool `yaml:"insecure"`
+}
+
+// CaptchaConfig picks who solves the signup captcha
+type CaptchaConfig struct {
+	// manual waits for a human, external posts it to a 2captcha compatible api
+	Solver   string `yaml:"solver"`
+	Endpoint string `yaml:"endpoint"`
+	APIKey   string `yaml:"api_key"`
+	// captcha type the api expects: turnstile, hcaptcha, userrecaptcha
+	Method string `yaml:"method"`
+	// time the solver gets per captcha, 0 keeps each site's default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
 type HeadersConfig struct {
 	Accept          string `yaml:"accept"`
 	AcceptLanguage  string `yaml:"accept_language"`
@@ -43,7 +544,12 @@ type HeadersConfig struct {
 	SecChUa         string `yaml:"sec_ch_ua"`
 	SecChUaMobile   string `yaml:"sec_ch_ua_mobile"`
 	SecChUaPlatform string `yaml:"sec_ch_ua_platform"`
-	XFEVersion      string `yaml:"x_fe_version"`
+	// z.ai bumps it with every frontend release, requests carrying a stale
+	// one fail the signature check. the fallback until discovery finds one
+	XFEVersion string `yaml:"x_fe_version"`
+	// how often the current version is read off the chat.z.ai frontend,
+	// 0 leaves it to POST /admin/refresh-fe-version
+	XFEVersionRefresh time.Duration `yaml:"x_fe_version_refresh"`
 }
 
 var (
@@ -59,6 +565,12 @@ func Load(path string) (*Config, error) {
 	return cfg, err
 }
 
+// Reload reads path and the environment again. the result is not installed,
+// the caller applies the settings that can change at runtime
+func Reload(path string) (*Config, error) {
+	return load(path)
+}
+
 func Get() *Config {
 	if cfg == nil {
 		cfg, _ = load("")
@@ -67,55 +579,189 @@ func Get() *Config {
 }
 
 func load(path string) (*Config, error) {
+	c, err := Inspect(path)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Inspect reads path and the environment like Load, but hands back the
+// configuration even when it does not validate. the error is then a
+// *ValidationError listing every problem, for mo config check
+func Inspect(path string) (*Config, error) {
 	_ = godotenv.Load()
 
 	c := defaults()
 
 	// load from file if path provided and exists
+	var file yaml.Node
 	if path != "" {
 		data, err := os.ReadFile(path)
 		if err != nil {
 			return nil, fmt.Errorf("read config: %w", err)
 		}
-		if err := yaml.Unmarshal(data, c); err != nil {
+		if err := yaml.Unmarshal(data, &file); err != nil {
 			return nil, fmt.Errorf("parse config: %w", err)
 		}
+		if file.Kind != 0 {
+			if err := file.Decode(c); err != nil {
+				return nil, fmt.Errorf("parse config: %w", err)
+			}
+		}
 	}
 
+	fromFile := flatten(c)
 	c.applyEnv()
+	c.attribute(fromFile, &file)
+	c.derive()
 
 	if err := c.validate(); err != nil {
-		return nil, err
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			for i := range verr.Problems {
+				verr.Problems[i].Line = c.line(verr.Problems[i].Path)
+				verr.Problems[i].Path = maskPath(verr.Problems[i].Path)
+			}
+		}
+		return c, err
 	}
 
 	return c, nil
 }
 
+// Defaults returns what a config holds before any file or env var
+func Defaults() *Config {
+	return defaults()
+}
+
 func defaults() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Port:    8080,
-			Host:    "0.0.0.0",
-			Debug:   false,
-			Version: "0.1.0",
+			Port:           8080,
+			Host:           "0.0.0.0",
+			Debug:          false,
+			Version:        "0.1.0",
+			ExposeRootInfo: true,
+
+			StreamHeartbeat:    15 * time.Second,
+			CompressMinBytes:   1024,
+			StreamBufferBytes:  4 << 20,
+			StreamStallTimeout: 30 * time.Second,
+			StreamDrainDropped: true,
+			WarmupTimeout:      10 * time.Second,
+		},
+		Log: LogConfig{
+			Level:    "info",
+			Format:   "console",
+			DumpKeep: 200,
 		},
 		Upstream: UpstreamConfig{
 			Protocol: "https:",
 			Host:     "chat.z.ai",
 			Token:    "",
+
+			HeaderTimeout: time.Minute,
+			IdleTimeout:   2 * time.Minute,
+			ProbeTTL:      time.Minute,
+			Failover:      FailoverConfig{MaxFailures: 3, ProbeInterval: 30 * time.Second},
+			Signature:     SignatureConfig{Version: "v1"},
+			Paths:         DefaultUpstreamPaths,
+			Conversations: 10000,
+		},
+		Qwen: QwenConfig{
+			ImageMaxBytes: 2 << 20,
+			ImageMaxSide:  2048,
+			RefreshMargin: 5 * time.Minute,
+			RefreshJitter: time.Minute,
 		},
 		Model: ModelConfig{
-			Default:   "GLM-4-6-API-V1",
-			ThinkMode: "reasoning",
+			Default:       "GLM-4-6-API-V1",
+			ThinkMode:     "reasoning",
+			ReasoningOnly: "promote",
+			OnDrift:       "broken",
+			ModelsRefresh: 10 * time.Minute,
+			ModelsTTL:     15 * time.Minute,
 		},
 		Headers: HeadersConfig{
-			Accept:          "*/*",
-			AcceptLanguage:  "en-US",
-			UserAgent:       "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36",
-			SecChUa:         `"Chromium";v="141", "Not?A_Brand";v="8"`,
-			SecChUaMobile:   "?0",
-			SecChUaPlatform: "Linux",
-			XFEVersion:      "prod-fe-1.0.117",
+			Accept:            "*/*",
+			AcceptLanguage:    "en-US",
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36",
+			SecChUa:           `"Chromium";v="141", "Not?A_Brand";v="8"`,
+			SecChUaMobile:     "?0",
+			SecChUaPlatform:   "Linux",
+			XFEVersion:        "prod-fe-1.0.117",
+			XFEVersionRefresh: 6 * time.Hour,
+		},
+		Limits: LimitsConfig{
+			MaxBodyBytes:        32 << 20,
+			MaxMessages:         1000,
+			MaxPromptChars:      2_000_000,
+			MaxImagesPerMessage: 10,
+			MaxImageBytes:       10 << 20,
+			QueueTimeout:        5 * time.Second,
+		},
+		Compat: CompatConfig{
+			Profile: "extended",
+		},
+		Filters: FiltersConfig{
+			Mask:     "[REDACTED]",
+			MaxMatch: 64,
+		},
+		Pricing: PricingConfig{
+			Currency: "USD",
+		},
+		Batch: BatchConfig{
+			Concurrency: 4,
+			MaxRequests: 50_000,
+		},
+		Files: FilesConfig{
+			CDNHosts:      []string{"z-cdn-media.chatglm.cn", "z-cdn.chatglm.cn"},
+			CacheTTL:      24 * time.Hour,
+			CacheMaxBytes: 32 << 20,
+		},
+		Audio: AudioConfig{
+			Model:    "whisper-1",
+			Timeout:  2 * time.Minute,
+			MaxBytes: 25 << 20,
+		},
+		HTTP: HTTPConfig{
+			ConnectTimeout:      10 * time.Second,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			HTTP2:               true,
+			Retry: RetryConfig{
+				MaxAttempts: 3,
+				Budget:      10 * time.Second,
+			},
+		},
+		Tokenizer: TokenizerConfig{
+			Download:    true,
+			ImageTokens: 765,
+		},
+		TempMail: TempMailConfig{
+			Providers: []string{"temp-mail.io", "mail.tm"},
+			IMAP: IMAPConfig{
+				Port:    993,
+				Mailbox: "INBOX",
+			},
+		},
+		Browser: BrowserConfig{
+			VerifyEmailTimeout:     2 * time.Minute,
+			RedirectTimeout:        30 * time.Second,
+			TokenTimeout:           30 * time.Second,
+			ElementTimeout:         10 * time.Second,
+			OptionalElementTimeout: 5 * time.Second,
+			PollInterval:           500 * time.Millisecond,
+			EmailPollInterval:      3 * time.Second,
+			StepAttempts:           3,
+			StepRetryDelay:         5 * time.Second,
+			Captcha: CaptchaConfig{
+				Solver:   "manual",
+				Endpoint: "https://2captcha.com",
+				Method:   "turnstile",
+			},
 		},
 	}
 }
@@ -127,13 +773,76 @@ func (c *Config) applyEnv() {
 	if host := env("HOST", ""); host != "" {
 		c.Server.Host = host
 	}
+	if cert := env("TLS_CERT_FILE", ""); cert != "" {
+		c.Server.TLS.CertFile = cert
+	}
+	if key := env("TLS_KEY_FILE", ""); key != "" {
+		c.Server.TLS.KeyFile = key
+	}
+	if ca := env("TLS_CLIENT_CA", ""); ca != "" {
+		c.Server.TLS.ClientCA = ca
+	}
 	if debug := envBool("DEBUG", false); debug {
 		c.Server.Debug = debug
 	}
+	if c.Server.Debug {
+		c.Log.Level = "debug"
+	}
+	c.Log.Level = env("LOG_LEVEL", c.Log.Level)
+	c.Log.Format = env("LOG_FORMAT", c.Log.Format)
+	c.Log.RawFile = env("LOG_RAW_FILE", c.Log.RawFile)
+	c.Log.Dump = env("LOG_DUMP", c.Log.Dump)
+	c.Log.DumpKeep = envInt("LOG_DUMP_KEEP", c.Log.DumpKeep)
+	for _, kv := range os.Environ() {
+		name, level, _ := strings.Cut(kv, "=")
+		if module, ok := strings.CutPrefix(name, "LOG_LEVEL_"); ok && module != "" {
+			if c.Log.Modules == nil {
+				c.Log.Modules = map[string]string{}
+			}
+			c.Log.Modules[strings.ToLower(module)] = level
+		}
+	}
+	if v := env("EXPOSE_ROOT_INFO", ""); v != "" {
+		c.Server.ExposeRootInfo = envBool("EXPOSE_ROOT_INFO", true)
+	}
+	c.Server.StreamHeartbeat = envDuration("STREAM_HEARTBEAT", c.Server.StreamHeartbeat)
+	c.Server.CompressMinBytes = envInt("COMPRESS_MIN_BYTES", c.Server.CompressMinBytes)
+	c.Server.StreamBufferBytes = envInt("STREAM_BUFFER_BYTES", c.Server.StreamBufferBytes)
+	c.Server.StreamStallTimeout = envDuration("STREAM_STALL_TIMEOUT", c.Server.StreamStallTimeout)
+	c.Server.StreamDrainDropped = envBool("STREAM_DRAIN_DROPPED", c.Server.StreamDrainDropped)
+	c.Server.Warmup = envBool("WARMUP", c.Server.Warmup)
+	c.Server.WarmupTimeout = envDuration("WARMUP_TIMEOUT", c.Server.WarmupTimeout)
+	if origins := env("WS_ORIGINS", ""); origins != "" {
+		c.Server.WSOrigins = nil
+		for _, o := range strings.Split(origins, ",") {
+			c.Server.WSOrigins = append(c.Server.WSOrigins, strings.TrimSpace(o))
+		}
+	}
 
 	if token := env("ZAI_TOKEN", ""); token != "" {
-		c.Upstream.Token = strings.TrimSpace(token)
+		c.Upstream.Token = token
 	}
+	// pasted from a browser or a shell file, often with quotes or Bearer
+	c.Upstream.Token = jwt.Normalize(c.Upstream.Token)
+	c.Upstream.TokenMode = env("ZAI_TOKEN_MODE", c.Upstream.TokenMode)
+	c.Upstream.HeaderTimeout = envDuration("UPSTREAM_HEADER_TIMEOUT", c.Upstream.HeaderTimeout)
+	c.Upstream.IdleTimeout = envDuration("UPSTREAM_IDLE_TIMEOUT", c.Upstream.IdleTimeout)
+	c.Upstream.ProbeTTL = envDuration("UPSTREAM_PROBE_TTL", c.Upstream.ProbeTTL)
+	if hosts := env("UPSTREAM_HOSTS", ""); hosts != "" {
+		c.Upstream.Hosts = nil
+		for _, h := range strings.Split(hosts, ",") {
+			c.Upstream.Hosts = append(c.Upstream.Hosts, strings.TrimSpace(h))
+		}
+	}
+	c.Upstream.Signature.Secret = env("ZAI_SECRET_KEY", c.Upstream.Signature.Secret)
+	c.Upstream.Signature.Version = env("ZAI_SIGNATURE_VERSION", c.Upstream.Signature.Version)
+	c.Upstream.Paths.Base = env("UPSTREAM_BASE_PATH", c.Upstream.Paths.Base)
+
+	c.Upstream.Conversations = envInt("UPSTREAM_CONVERSATIONS", c.Upstream.Conversations)
+	c.Qwen.ImageMaxBytes = envInt("QWEN_IMAGE_MAX_BYTES", c.Qwen.ImageMaxBytes)
+	c.Qwen.ImageMaxSide = envInt("QWEN_IMAGE_MAX_SIDE", c.Qwen.ImageMaxSide)
+	c.Qwen.RefreshMargin = envDuration("QWEN_REFRESH_MARGIN", c.Qwen.RefreshMargin)
+	c.Qwen.RefreshJitter = envDuration("QWEN_REFRESH_JITTER", c.Qwen.RefreshJitter)
 
 	if model := env("MODEL", ""); model != "" {
 		c.Model.Default = model
@@ -141,27 +850,434 @@ func (c *Config) applyEnv() {
 	if mode := env("THINK_MODE", ""); mode != "" {
 		c.Model.ThinkMode = mode
 	}
+	if policy := env("REASONING_ONLY", ""); policy != "" {
+		c.Model.ReasoningOnly = policy
+	}
+	if v := env("JSON_RETRY", ""); v != "" {
+		c.Model.JSONRetry = envBool("JSON_RETRY", false)
+	}
+	if v := env("RESUME_PARTIAL", ""); v != "" {
+		c.Model.ResumePartial = envBool("RESUME_PARTIAL", false)
+	}
+	if policy := env("MODEL_ON_DRIFT", ""); policy != "" {
+		c.Model.OnDrift = policy
+	}
+	if hook := env("MODEL_DRIFT_WEBHOOK", ""); hook != "" {
+		c.Model.DriftWebhook = hook
+	}
+
+	if profile := env("COMPAT_PROFILE", ""); profile != "" {
+		c.Compat.Profile = profile
+	}
+
+	c.RateLimit.RequestsPerMinute = envInt("RATE_LIMIT_RPM", c.RateLimit.RequestsPerMinute)
+	c.RateLimit.TokensPerMinute = envInt("RATE_LIMIT_TPM", c.RateLimit.TokensPerMinute)
+
+	if currency := env("PRICING_CURRENCY", ""); currency != "" {
+		c.Pricing.Currency = currency
+	}
+	if v := env("PRICING_IN_RESPONSE", ""); v != "" {
+		c.Pricing.InResponse = envBool("PRICING_IN_RESPONSE", false)
+	}
+
+	if file := env("BENCH_SAMPLE_FILE", ""); file != "" {
+		c.Bench.SampleFile = file
+	}
+
+	if v := env("REWRITE_FILE_URLS", ""); v != "" {
+		c.Files.RewriteURLs = envBool("REWRITE_FILE_URLS", false)
+	}
+	if u := env("FILES_PUBLIC_URL", ""); u != "" {
+		c.Files.PublicURL = u
+	}
+	c.Audio.TranscriptionURL = env("AUDIO_TRANSCRIPTION_URL", c.Audio.TranscriptionURL)
+	c.Audio.APIKey = env("AUDIO_API_KEY", c.Audio.APIKey)
+
+	c.HTTP.ConnectTimeout = envDuration("HTTP_CONNECT_TIMEOUT", c.HTTP.ConnectTimeout)
+	c.HTTP.MaxIdleConnsPerHost = envInt("HTTP_MAX_IDLE_CONNS_PER_HOST", c.HTTP.MaxIdleConnsPerHost)
+	c.HTTP.IdleConnTimeout = envDuration("HTTP_IDLE_CONN_TIMEOUT", c.HTTP.IdleConnTimeout)
+	c.HTTP.TLSHandshakeTimeout = envDuration("HTTP_TLS_HANDSHAKE_TIMEOUT", c.HTTP.TLSHandshakeTimeout)
+	if v := env("HTTP2", ""); v != "" {
+		c.HTTP.HTTP2 = envBool("HTTP2", true)
+	}
+	c.HTTP.Retry.MaxAttempts = envInt("HTTP_RETRY_MAX_ATTEMPTS", c.HTTP.Retry.MaxAttempts)
+	c.HTTP.Retry.Budget = envDuration("HTTP_RETRY_BUDGET", c.HTTP.Retry.Budget)
+
+	c.Tokenizer.CacheDir = env("TIKTOKEN_CACHE_DIR", c.Tokenizer.CacheDir)
+	if v := env("TOKENIZER_DOWNLOAD", ""); v != "" {
+		c.Tokenizer.Download = envBool("TOKENIZER_DOWNLOAD", true)
+	}
+	c.Tokenizer.ImageTokens = envInt("TOKENIZER_IMAGE_TOKENS", c.Tokenizer.ImageTokens)
+	c.Browser.DebugDir = env("BROWSER_DEBUG_DIR", c.Browser.DebugDir)
+	c.Browser.KeepOpen = envDuration("BROWSER_KEEP_OPEN", c.Browser.KeepOpen)
+	if v := env("BROWSER_HEADLESS", ""); v != "" {
+		c.Browser.Headless = envBool("BROWSER_HEADLESS", false)
+	}
+	c.Browser.VerifyEmailTimeout = envDuration("BROWSER_VERIFY_EMAIL_TIMEOUT", c.Browser.VerifyEmailTimeout)
+	c.Browser.RedirectTimeout = envDuration("BROWSER_REDIRECT_TIMEOUT", c.Browser.RedirectTimeout)
+	c.Browser.TokenTimeout = envDuration("BROWSER_TOKEN_TIMEOUT", c.Browser.TokenTimeout)
+	c.Browser.ElementTimeout = envDuration("BROWSER_ELEMENT_TIMEOUT", c.Browser.ElementTimeout)
+	c.Browser.OptionalElementTimeout = envDuration("BROWSER_OPTIONAL_ELEMENT_TIMEOUT", c.Browser.OptionalElementTimeout)
+	c.Browser.PollInterval = envDuration("BROWSER_POLL_INTERVAL", c.Browser.PollInterval)
+	c.Browser.EmailPollInterval = envDuration("BROWSER_EMAIL_POLL_INTERVAL", c.Browser.EmailPollInterval)
+	c.Browser.StepAttempts = envInt("BROWSER_STEP_ATTEMPTS", c.Browser.StepAttempts)
+	c.Browser.StepRetryDelay = envDuration("BROWSER_STEP_RETRY_DELAY", c.Browser.StepRetryDelay)
+	if v := env("TEMPMAIL_PROVIDERS", ""); v != "" {
+		c.TempMail.Providers = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.TempMail.Providers = append(c.TempMail.Providers, name)
+			}
+		}
+	}
+	c.TempMail.IMAP.Host = env("IMAP_HOST", c.TempMail.IMAP.Host)
+	c.TempMail.IMAP.Port = envInt("IMAP_PORT", c.TempMail.IMAP.Port)
+	c.TempMail.IMAP.User = env("IMAP_USER", c.TempMail.IMAP.User)
+	c.TempMail.IMAP.Password = env("IMAP_PASSWORD", c.TempMail.IMAP.Password)
+	c.TempMail.IMAP.Domain = env("IMAP_DOMAIN", c.TempMail.IMAP.Domain)
+	c.TempMail.IMAP.Mailbox = env("IMAP_MAILBOX", c.TempMail.IMAP.Mailbox)
+	c.Browser.Captcha.Solver = env("CAPTCHA_SOLVER", c.Browser.Captcha.Solver)
+	c.Browser.Captcha.Endpoint = env("CAPTCHA_ENDPOINT", c.Browser.Captcha.Endpoint)
+	c.Browser.Captcha.APIKey = env("CAPTCHA_API_KEY", c.Browser.Captcha.APIKey)
+	c.Browser.Captcha.Method = env("CAPTCHA_METHOD", c.Browser.Captcha.Method)
+	c.Browser.Captcha.Timeout = envDuration("CAPTCHA_TIMEOUT", c.Browser.Captcha.Timeout)
+
+	c.Limits.MaxBodyBytes = envInt("MAX_BODY_BYTES", c.Limits.MaxBodyBytes)
+	c.Limits.MaxMessages = envInt("MAX_MESSAGES", c.Limits.MaxMessages)
+	c.Limits.MaxPromptChars = envInt("MAX_PROMPT_CHARS", c.Limits.MaxPromptChars)
+	c.Limits.MaxImagesPerMessage = envInt("MAX_IMAGES_PER_MESSAGE", c.Limits.MaxImagesPerMessage)
+	c.Limits.MaxImageBytes = envInt("MAX_IMAGE_BYTES", c.Limits.MaxImageBytes)
+	c.Limits.MaxInFlight = envInt("MAX_IN_FLIGHT", c.Limits.MaxInFlight)
+	c.Limits.QueueSize = envInt("QUEUE_SIZE", c.Limits.QueueSize)
+	c.Limits.QueueTimeout = envDuration("QUEUE_TIMEOUT", c.Limits.QueueTimeout)
+	c.Limits.CoalesceWait = envDuration("COALESCE_WAIT", c.Limits.CoalesceWait)
+}
+
+// derive fills in defaults that depend on other settings
+func (c *Config) derive() {
+	if c.Tokenizer.CacheDir == "" {
+		c.Tokenizer.CacheDir = filepath.Join(DataPath(), "tiktoken")
+	}
+	if c.Browser.DebugDir == "" {
+		c.Browser.DebugDir = filepath.Join(DataPath(), "debug")
+	}
+	if c.Files.CacheDir == "" {
+		c.Files.CacheDir = filepath.Join(DataPath(), "files")
+	}
 }
 
 func (c *Config) validate() error {
+	var p problems
+
 	if c.Server.Port < 1 || c.Server.Port > 65535 {
-		return fmt.Errorf("invalid port: %d", c.Server.Port)
+		p.add("server.port", "invalid port: %d", c.Server.Port)
+	}
+
+	if c.Server.StreamHeartbeat < 0 {
+		p.add("server.stream_heartbeat", "must not be negative: %s", c.Server.StreamHeartbeat)
+	}
+	if c.Server.CompressMinBytes < 0 {
+		p.add("server.compress_min_bytes", "must not be negative: %d", c.Server.CompressMinBytes)
+	}
+	if c.Server.StreamBufferBytes < 0 {
+		p.add("server.stream_buffer_bytes", "must not be negative: %d", c.Server.StreamBufferBytes)
+	}
+	if c.Server.StreamStallTimeout < 0 {
+		p.add("server.stream_stall_timeout", "must not be negative: %s", c.Server.StreamStallTimeout)
+	}
+	if c.Server.WarmupTimeout < 0 {
+		p.add("server.warmup_timeout", "must not be negative: %s", c.Server.WarmupTimeout)
+	}
+
+	if !slices.Contains(logLevels, strings.ToLower(c.Log.Level)) {
+		p.add("log.level", "invalid log level: %s", c.Log.Level)
+	}
+	for module, level := range c.Log.Modules {
+		if !slices.Contains(logLevels, strings.ToLower(level)) {
+			p.add("log.modules."+module, "invalid log level: %s", level)
+		}
+	}
+	if c.Log.Format != "console" && c.Log.Format != "json" {
+		p.add("log.format", "invalid log format: %s", c.Log.Format)
+	}
+	if c.Log.Dump != "" && c.Log.Dump != "log" && c.Log.Dump != "files" {
+		p.add("log.dump", "invalid dump target: %s, expected log or files", c.Log.Dump)
+	}
+	if c.Log.DumpKeep < 0 {
+		p.add("log.dump_keep", "must not be negative: %d", c.Log.DumpKeep)
+	}
+
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		p.add("server.tls", "cert_file and key_file must be set together")
+	}
+	if tls.ClientCA != "" && !tls.Enabled() {
+		p.add("server.tls.client_ca", "requires cert_file and key_file")
+	}
+
+	if !slices.Contains(thinkModes, c.Model.ThinkMode) {
+		p.add("model.think_mode", "invalid think_mode: %s", c.Model.ThinkMode)
+	}
+
+	for pattern, mp := range c.Models {
+		if _, err := path.Match(pattern, ""); err != nil {
+			p.add("models."+pattern, "invalid glob: %v", err)
+		}
+		if t := mp.Temperature; t != nil && (*t < 0 || *t > 2) {
+			p.add("models."+pattern+".temperature", "must be within 0..2: %g", *t)
+		}
+		if t := mp.TopP; t != nil && (*t < 0 || *t > 1) {
+			p.add("models."+pattern+".top_p", "must be within 0..1: %g", *t)
+		}
+		if n := mp.MaxTokens; n != nil && *n <= 0 {
+			p.add("models."+pattern+".max_tokens", "must be positive: %d", *n)
+		}
+		if mp.ThinkMode != "" && !slices.Contains(thinkModes, mp.ThinkMode) {
+			p.add("models."+pattern+".think_mode", "invalid think_mode: %s", mp.ThinkMode)
+		}
+	}
+
+	for name := range c.Model.AnswerCleaners {
+		if !slices.Contains(answerCleaners, name) {
+			p.add("model.answer_cleaners."+name, "unknown answer cleaner: %s", name)
+		}
+	}
+
+	for model, sp := range c.Model.SystemPrompts {
+		switch sp.Mode {
+		case "", "prepend", "replace", "append_if_absent":
+		default:
+			p.add("model.system_prompts."+model+".mode", "invalid mode: %s", sp.Mode)
+		}
+		if sp.Text == "" {
+			p.add("model.system_prompts."+model+".text", "text is required")
+		}
+	}
+
+	switch c.Model.ReasoningOnly {
+	case "promote", "retry", "passthrough":
+	default:
+		p.add("model.reasoning_only", "invalid reasoning_only: %s", c.Model.ReasoningOnly)
+	}
+
+	switch c.Model.OnDrift {
+	case "repin", "broken":
+	default:
+		p.add("model.on_drift", "invalid on_drift: %s", c.Model.OnDrift)
+	}
+	if c.Model.ModelsRefresh <= 0 {
+		p.add("model.models_refresh", "invalid models_refresh: %s", c.Model.ModelsRefresh)
+	}
+	if c.Model.ModelsTTL <= 0 {
+		p.add("model.models_ttl", "invalid models_ttl: %s", c.Model.ModelsTTL)
+	}
+
+	l := c.Limits
+	if l.MaxBodyBytes < 0 || l.MaxMessages < 0 || l.MaxPromptChars < 0 || l.MaxImagesPerMessage < 0 || l.MaxImageBytes < 0 ||
+		l.MaxInFlight < 0 || l.QueueSize < 0 || l.QueueTimeout < 0 || l.CoalesceWait < 0 {
+		p.add("limits", "limits must not be negative")
+	}
+	for model, n := range l.ContextTokens {
+		if n <= 0 {
+			p.add("limits.context_tokens."+model, "context_tokens for %s must be positive", model)
+		}
+	}
+
+	validProfile := func(p string) bool { return p == "strict" || p == "extended" }
+	if !validProfile(c.Compat.Profile) {
+		p.add("compat.profile", "invalid compat profile: %s", c.Compat.Profile)
+	}
+	for key, profile := range c.Compat.Keys {
+		if !validProfile(profile) {
+			p.add("compat.keys."+key, "invalid compat profile for %s: %s", keyRef(key), profile)
+		}
+	}
+
+	if b := c.RateLimit.RateBudget; b.RequestsPerMinute < 0 || b.TokensPerMinute < 0 {
+		p.add("rate_limit", "budgets must not be negative")
+	}
+	for key, b := range c.RateLimit.Keys {
+		if b.RequestsPerMinute < 0 || b.TokensPerMinute < 0 {
+			p.add("rate_limit.keys."+key, "negative budget for %s", keyRef(key))
+		}
+	}
+
+	for i, pattern := range c.Filters.Redact {
+		if _, err := regexp.Compile(pattern); err != nil {
+			p.add(fmt.Sprintf("filters.redact[%d]", i), "%v", err)
+		}
+	}
+	for i, pattern := range c.Filters.Abort {
+		if _, err := regexp.Compile(pattern); err != nil {
+			p.add(fmt.Sprintf("filters.abort[%d]", i), "%v", err)
+		}
+	}
+	if c.Filters.MaxMatch < 1 {
+		p.add("filters.max_match", "must be at least 1")
+	}
+
+	if c.Batch.Concurrency < 1 || c.Batch.MaxRequests < 1 {
+		p.add("batch", "concurrency and max_requests must be at least 1")
+	}
+	if c.Files.CacheTTL < 0 || c.Files.CacheMaxBytes < 0 {
+		p.add("files", "cache_ttl and cache_max_bytes must not be negative")
+	}
+	if c.Files.PublicURL != "" {
+		if u, err := url.Parse(c.Files.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			p.add("files.public_url", "must be an absolute url: %q", c.Files.PublicURL)
+		}
+	}
+	if c.Audio.TranscriptionURL != "" {
+		if u, err := url.Parse(c.Audio.TranscriptionURL); err != nil || u.Scheme == "" || u.Host == "" {
+			p.add("audio.transcription_url", "must be an absolute url: %q", c.Audio.TranscriptionURL)
+		}
+	}
+	if c.Audio.Timeout < 0 || c.Audio.MaxBytes < 0 {
+		p.add("audio", "timeout and max_bytes must not be negative")
+	}
+	if c.Headers.XFEVersionRefresh < 0 {
+		p.add("headers.x_fe_version_refresh", "must not be negative: %s", c.Headers.XFEVersionRefresh)
+	}
+
+	if c.Caps.negative() {
+		p.add("caps", "caps must not be negative")
+	}
+	for key, caps := range c.Caps.Keys {
+		if caps.negative() {
+			p.add("caps.keys."+key, "negative caps for %s", keyRef(key))
+		}
+	}
+
+	if c.Pricing.Currency == "" {
+		p.add("pricing.currency", "currency must not be empty")
+	}
+	for model, price := range c.Pricing.Models {
+		if price.Input < 0 || price.Output < 0 {
+			p.add("pricing.models."+model, "negative price for %s", model)
+		}
 	}
 
-	validModes := []string{"reasoning", "think", "strip", "details"}
-	valid := false
-	for _, m := range validModes {
-		if c.Model.ThinkMode == m {
-			valid = true
-			break
+	if c.Upstream.HeaderTimeout < 0 || c.Upstream.IdleTimeout < 0 || c.Upstream.ProbeTTL < 0 {
+		p.add("upstream", "timeouts and probe_ttl must not be negative")
+	}
+	for i, h := range c.Upstream.Hosts {
+		if h == "" || strings.ContainsAny(h, "/ ") {
+			p.add(fmt.Sprintf("upstream.hosts[%d]", i), "hosts takes host[:port] entries, got %q", h)
 		}
 	}
-	if !valid {
-		return fmt.Errorf("invalid think_mode: %s", c.Model.ThinkMode)
+	if c.Upstream.Failover.MaxFailures < 1 || c.Upstream.Failover.ProbeInterval < 0 {
+		p.add("upstream.failover", "failover needs max_failures >= 1 and a non-negative probe_interval")
+	}
+	for _, h := range c.Upstream.AllHosts() {
+		if _, err := url.Parse(c.Upstream.Protocol + "//" + h); err != nil {
+			p.add("upstream.protocol", "invalid protocol or host: %v", err)
+		}
+	}
+	paths := c.Upstream.Paths
+	for _, ep := range []struct{ name, path string }{
+		{"base", paths.Base}, {"chat", paths.Chat}, {"auth", paths.Auth}, {"models", paths.Models}, {"files", paths.Files},
+	} {
+		if ep.path != "" && !strings.HasPrefix(ep.path, "/") {
+			p.add("upstream.paths."+ep.name, "must start with /: %q", ep.path)
+		}
+	}
+
+	if c.Upstream.Token != "" {
+		if _, err := jwt.Expiry(c.Upstream.Token); err != nil {
+			p.add("upstream.token", "%v, expected the token value alone", err)
+		}
+	}
+	if m := c.Upstream.TokenMode; m != "" && m != TokenModeGuest {
+		p.add("upstream.token_mode", "must be empty or %q, got %q", TokenModeGuest, m)
+	}
+	if c.Upstream.Conversations < 0 {
+		p.add("upstream.conversations", "conversations must not be negative")
+	}
+
+	if q := c.Qwen; q.ImageMaxBytes < 0 || (q.ImageMaxBytes > 0 && q.ImageMaxSide < 1) {
+		p.add("qwen.image_max_bytes", "image_max_bytes must not be negative, with it image_max_side must be positive")
+	}
+	if c.Qwen.RefreshMargin < 0 || c.Qwen.RefreshJitter < 0 {
+		p.add("qwen", "refresh_margin and refresh_jitter must not be negative")
+	}
+	validateOpenAI(&p, c.OpenAI)
+
+	h := c.HTTP
+	if h.ConnectTimeout < 0 || h.MaxIdleConnsPerHost < 0 || h.IdleConnTimeout < 0 || h.TLSHandshakeTimeout < 0 {
+		p.add("http", "pool settings must not be negative")
+	}
+	if h.Retry.MaxAttempts < 1 || h.Retry.Budget < 0 {
+		p.add("http.retry", "retry needs max_attempts >= 1 and a non-negative budget")
+	}
+
+	if c.Tokenizer.ImageTokens < 0 {
+		p.add("tokenizer.image_tokens", "image_tokens must not be negative")
+	}
+	b := c.Browser
+	if b.KeepOpen < 0 || b.VerifyEmailTimeout < 0 || b.RedirectTimeout < 0 || b.TokenTimeout < 0 ||
+		b.ElementTimeout < 0 || b.OptionalElementTimeout < 0 || b.PollInterval < 0 || b.EmailPollInterval < 0 || b.StepRetryDelay < 0 {
+		p.add("browser", "timeouts and intervals must not be negative")
+	}
+	if b.StepAttempts < 1 {
+		p.add("browser.step_attempts", "step_attempts must be at least 1")
+	}
+	if len(c.TempMail.Providers) == 0 {
+		p.add("tempmail.providers", "at least one provider is needed")
+	}
+	for i, name := range c.TempMail.Providers {
+		switch name {
+		case "temp-mail.io", "mail.tm":
+		case "imap":
+			if m := c.TempMail.IMAP; m.Host == "" || m.Port <= 0 || m.Domain == "" {
+				p.add("tempmail.imap", "imap needs host, port and domain")
+			}
+		default:
+			p.add(fmt.Sprintf("tempmail.providers[%d]", i), "unknown provider %q", name)
+		}
+	}
+	switch cp := c.Browser.Captcha; cp.Solver {
+	case "manual":
+		if c.Browser.Headless {
+			p.add("browser.headless", "a headless browser needs a captcha solver other than manual")
+		}
+	case "external":
+		if cp.APIKey == "" {
+			p.add("browser.captcha.api_key", "the external captcha solver needs an api_key")
+		}
+	default:
+		p.add("browser.captcha.solver", "unknown captcha solver %q", cp.Solver)
+	}
+	if c.Browser.Captcha.Timeout < 0 {
+		p.add("browser.captcha.timeout", "captcha timeout must not be negative")
 	}
 
 	// token is now optional - loaded from token store
-	return nil
+	return p.err()
+}
+
+// UpstreamURL joins elem onto the first upstream host and base path, a trailing
+// slash of the last element is kept
+func (c *Config) UpstreamURL(elem ...string) string {
+	base := c.Upstream.Protocol + "//" + c.Upstream.AllHosts()[0]
+	// validate has parsed the base already
+	u, _ := url.JoinPath(base, append([]string{c.Upstream.Paths.Base}, elem...)...)
+	return u
+}
+
+func (c *Config) ChatURL() string {
+	return c.UpstreamURL(cmp.Or(c.Upstream.Paths.Chat, DefaultUpstreamPaths.Chat))
+}
+
+func (c *Config) AuthURL() string {
+	return c.UpstreamURL(cmp.Or(c.Upstream.Paths.Auth, DefaultUpstreamPaths.Auth))
+}
+
+func (c *Config) ModelsURL() string {
+	return c.UpstreamURL(cmp.Or(c.Upstream.Paths.Models, DefaultUpstreamPaths.Models))
+}
+
+func (c *Config) FilesURL() string {
+	return c.UpstreamURL(cmp.Or(c.Upstream.Paths.Files, DefaultUpstreamPaths.Files))
 }
 
 func (c *Config) GetUpstreamHeaders() map[string]string {
@@ -179,11 +1295,62 @@ func (c *Config) GetUpstreamHeaders() map[string]string {
 		"Sec-Fetch-Site":     "same-origin",
 		"User-Agent":         c.Headers.UserAgent,
 		"X-FE-Version":       c.Headers.XFEVersion,
-		"Origin":             c.Upstream.Protocol + "//" + c.Upstream.Host,
-		"Referer":            c.Upstream.Protocol + "//" + c.Upstream.Host + "/",
+		"Origin":             c.Upstream.Protocol + "//" + c.Upstream.AllHosts()[0],
+		"Referer":            c.Upstream.Protocol + "//" + c.Upstream.AllHosts()[0] + "/",
 	}
 }
 
+// Find picks the config file: path from the command line, MO_CONFIG, then
+// the first of searchPaths that exists. "" means none, mo then runs on
+// defaults and the environment. a file that was asked for must exist,
+// unless ZAI_TOKEN is set and the environment is enough to run
+func Find(path string) (string, error) {
+	_ = godotenv.Load()
+
+	if path == "" {
+		path = os.Getenv("MO_CONFIG")
+	}
+	if path != "" {
+		_, err := os.Stat(path)
+		switch {
+		case err == nil:
+			return path, nil
+		case errors.Is(err, fs.ErrNotExist) && os.Getenv("ZAI_TOKEN") != "":
+			return "", nil
+		default:
+			return "", fmt.Errorf("read config: %w", err)
+		}
+	}
+
+	for _, p := range searchPaths() {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+// searchPaths are where Find looks without a path, in order
+func searchPaths() []string {
+	paths := []string{filepath.Join("configs", "config.yaml")}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths,
+			filepath.Join(home, ".config", "mo", "config.yaml"),
+			// where older releases looked
+			filepath.Join(home, ".config", "traw", "configs", "config.yaml"))
+	}
+	return append(paths, filepath.Join("/etc", "mo", "config.yaml"))
+}
+
+// DataPath is where mo keeps its state, MO_DATA_PATH or ~/.config/traw/data
+func DataPath() string {
+	if p := os.Getenv("MO_DATA_PATH"); p != "" {
+		return p
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "traw", "data")
+}
+
 func env(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -200,6 +1367,37 @@ func envInt(key string, def int) int {
 	return def
 }
 
+// builtin provider names an upstream cannot take
+var reservedProviders = []string{"zlm", "glm", "qwen"}
+
+func validateOpenAI(p *problems, upstreams []OpenAIUpstream) {
+	seen := make(map[string]bool, len(upstreams))
+	for i, u := range upstreams {
+		path := fmt.Sprintf("openai_upstreams[%d]", i)
+		if u.Name == "" {
+			p.add(path+".name", "name is required")
+		} else if seen[u.Name] || slices.Contains(reservedProviders, u.Name) {
+			p.add(path+".name", "name %q is taken", u.Name)
+		}
+		seen[u.Name] = true
+		if b, err := url.Parse(u.BaseURL); err != nil || (b.Scheme != "http" && b.Scheme != "https") || b.Host == "" {
+			p.add(path+".base_url", "base_url must be an http(s) url: %q", u.BaseURL)
+		}
+		if len(u.Models) == 0 && u.ModelPrefix == "" {
+			p.add(path+".models", "models or model_prefix is required")
+		}
+	}
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
 func envBool(key string, def bool) bool {
 	if v := os.Getenv(key); v != "" {
 		return strings.ToLower(v) == "true" || v == "1"
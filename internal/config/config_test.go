@@ -0,0 +1,219 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(yaml), 0o600))
+	return path
+}
+
+func TestInspectListsEveryProblem(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("THINK_MODE", "")
+	t.Setenv("ZAI_TOKEN", "")
+	path := writeConfig(t, `server:
+  port: 0
+model:
+  think_mode: resoning
+  on_drift: ignore
+openai_upstreams:
+  - name: qwen
+    base_url: ftp://example.com
+    models: [a]
+upstream:
+  token: "Bearer cookie.value"
+`)
+
+	cfg, err := Inspect(path)
+	require.NotNil(t, cfg, "the config comes back for inspection")
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr), "got %v", err)
+
+	assert.Equal(t, []Problem{
+		{Path: "server.port", Line: 2, Message: "invalid port: 0"},
+		{Path: "model.think_mode", Line: 4, Message: "invalid think_mode: resoning"},
+		{Path: "model.on_drift", Line: 5, Message: "invalid on_drift: ignore"},
+		{Path: "upstream.token", Line: 11, Message: "not a jwt: 2 dot separated segments, want 3, expected the token value alone"},
+		{Path: "openai_upstreams[0].name", Line: 7, Message: `name "qwen" is taken`},
+		{Path: "openai_upstreams[0].base_url", Line: 8, Message: `base_url must be an http(s) url: "ftp://example.com"`},
+	}, verr.Problems)
+
+	_, err = Reload(path)
+	assert.ErrorAs(t, err, &verr)
+}
+
+func TestKeyProblemsHideTheKey(t *testing.T) {
+	path := writeConfig(t, `caps:
+  keys:
+    sk-client-key:
+      max_chars: -1
+`)
+
+	_, err := Inspect(path)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr), "got %v", err)
+	require.Len(t, verr.Problems, 1)
+	assert.Equal(t, "caps.keys."+keyRef("sk-client-key"), verr.Problems[0].Path)
+	assert.Equal(t, 4, verr.Problems[0].Line)
+	assert.NotContains(t, verr.Error(), "sk-cli")
+
+	path = writeConfig(t, `compat:
+  keys:
+    sk-client-key: loose
+`)
+	_, err = Inspect(path)
+	require.True(t, errors.As(err, &verr), "got %v", err)
+	require.Len(t, verr.Problems, 1)
+	assert.Equal(t, Problem{
+		Path:    "compat.keys." + keyRef("sk-client-key"),
+		Line:    3,
+		Message: "invalid compat profile for " + keyRef("sk-client-key") + ": loose",
+	}, verr.Problems[0])
+	assert.NotContains(t, verr.Error(), "sk-")
+}
+
+func TestResolvedSources(t *testing.T) {
+	t.Setenv("PORT", "9000")
+	t.Setenv("THINK_MODE", "")
+	t.Setenv("LOG_FORMAT", "")
+	t.Setenv("ZAI_TOKEN", "")
+	path := writeConfig(t, `server:
+  port: 8804
+model:
+  think_mode: strip
+upstream:
+  token: eyJhbGciOiJIUzI1NiJ9.eyJpZCI6InUifQ.c2ln
+compat:
+  keys:
+    sk-client-key: strict
+`)
+
+	cfg, err := Inspect(path)
+	require.NoError(t, err)
+
+	settings := map[string]Setting{}
+	for _, s := range cfg.Resolved() {
+		settings[s.Path] = s
+	}
+	assert.Equal(t, Setting{Path: "server.port", Value: "9000", Source: SourceEnv}, settings["server.port"])
+	assert.Equal(t, Setting{Path: "model.think_mode", Value: "strip", Source: SourceFile, Line: 4}, settings["model.think_mode"])
+	assert.Equal(t, Setting{Path: "log.format", Value: "console", Source: SourceDefault}, settings["log.format"])
+	assert.Equal(t, "***", settings["upstream.token"].Value)
+	assert.Equal(t, SourceFile, settings["upstream.token"].Source)
+	assert.Equal(t, "strict", settings["compat.keys."+keyRef("sk-client-key")].Value)
+	for path := range settings {
+		assert.NotContains(t, path, "sk-cli", "no character of a client key shows")
+	}
+}
+
+func TestFind(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Chdir(t.TempDir())
+	t.Setenv("MO_CONFIG", "")
+	t.Setenv("ZAI_TOKEN", "")
+
+	found, err := Find("")
+	require.NoError(t, err)
+	assert.Empty(t, found, "no file anywhere runs on defaults")
+
+	homeConfig := filepath.Join(home, ".config", "mo", "config.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(homeConfig), 0o755))
+	require.NoError(t, os.WriteFile(homeConfig, nil, 0o600))
+	found, err = Find("")
+	require.NoError(t, err)
+	assert.Equal(t, homeConfig, found)
+
+	require.NoError(t, os.MkdirAll("configs", 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join("configs", "config.yaml"), nil, 0o600))
+	found, err = Find("")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("configs", "config.yaml"), found, "./configs goes before the home directory")
+
+	fromEnv := writeConfig(t, "")
+	t.Setenv("MO_CONFIG", fromEnv)
+	found, err = Find("")
+	require.NoError(t, err)
+	assert.Equal(t, fromEnv, found)
+
+	fromFlag := writeConfig(t, "")
+	found, err = Find(fromFlag)
+	require.NoError(t, err)
+	assert.Equal(t, fromFlag, found, "the flag wins over MO_CONFIG")
+}
+
+func TestFindMissingFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("MO_CONFIG", "")
+	missing := filepath.Join(t.TempDir(), "nope.yaml")
+
+	t.Setenv("ZAI_TOKEN", "")
+	_, err := Find(missing)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	t.Setenv("MO_CONFIG", missing)
+	_, err = Find("")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	t.Setenv("ZAI_TOKEN", "\"Bearer eyJhbGciOiJIUzI1NiJ9.eyJpZCI6InUifQ.c2ln\"\n")
+	found, err := Find(missing)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+
+	cfg, err := Reload(found)
+	require.NoError(t, err)
+	assert.Equal(t, "eyJhbGciOiJIUzI1NiJ9.eyJpZCI6InUifQ.c2ln", cfg.Upstream.Token, "pasted quotes and Bearer are dropped")
+}
+
+func TestProfile(t *testing.T) {
+	cfg := &Config{Models: map[string]ModelProfile{
+		"GLM-*":          {ThinkMode: "think"},
+		"GLM-4-*":        {ThinkMode: "strip"},
+		"GLM-4-6-API-V1": {ThinkMode: "details"},
+		"*-model":        {ThinkMode: "reasoning"},
+	}}
+
+	for model, want := range map[string]string{
+		"GLM-4-6-API-V1": "details",
+		"GLM-4-5":        "strip",
+		"GLM-Z1":         "think",
+		"vision-model":   "reasoning",
+	} {
+		p, ok := cfg.Profile(model)
+		assert.True(t, ok, model)
+		assert.Equal(t, want, p.ThinkMode, model)
+	}
+
+	_, ok := cfg.Profile("qwen3-max")
+	assert.False(t, ok)
+}
+
+func TestModelsValidation(t *testing.T) {
+	t.Setenv("THINK_MODE", "")
+	path := writeConfig(t, `models:
+  "[glm":
+    top_p: 0.5
+  coder-model:
+    temperature: 3
+    think_mode: loud
+`)
+
+	_, err := Inspect(path)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr), "got %v", err)
+	var paths []string
+	for _, p := range verr.Problems {
+		paths = append(paths, p.Path)
+	}
+	assert.ElementsMatch(t, []string{"models.[glm", "models.coder-model.temperature", "models.coder-model.think_mode"}, paths)
+}
@@ -0,0 +1,75 @@
+package config
+
+import "slices"
+
+// Provider hands out the configuration a request runs with. handlers ask
+// for it on every request instead of closing over a *Config, so a reload
+// or a per-key override applies without rebuilding the router.
+//
+// the effective configuration is merged in this order, later wins:
+//
+//  1. the base configuration (file, then environment)
+//  2. overrides for the client api key (compat.keys, rate_limit.keys),
+//     hooks.keys adds to the global hooks instead of replacing them
+//  3. request-level extensions (thinking, response_format, ...), applied
+//     by the handler on the request itself, never on the config
+type Provider interface {
+	// Config returns the base configuration
+	Config() *Config
+	// ForKey returns the configuration for a client api key, "" for none
+	ForKey(apiKey string) *Config
+}
+
+type static struct {
+	cfg *Config
+}
+
+// Static serves one fixed configuration
+func Static(cfg *Config) Provider {
+	return static{cfg: cfg}
+}
+
+func (s static) Config() *Config {
+	return s.cfg
+}
+
+func (s static) ForKey(apiKey string) *Config {
+	return s.cfg.ForKey(apiKey)
+}
+
+// ForKey applies the overrides of an api key. without any it returns c
+// itself, otherwise a copy, c is never modified
+func (c *Config) ForKey(apiKey string) *Config {
+	if apiKey == "" {
+		return c
+	}
+
+	profile, hasProfile := c.Compat.Keys[apiKey]
+	hasProfile = hasProfile && profile != c.Compat.Profile
+	budget, hasBudget := c.RateLimit.Keys[apiKey]
+	hasBudget = hasBudget && budget != c.RateLimit.RateBudget
+	hooks, hasHooks := c.Hooks.Keys[apiKey]
+	caps, hasCaps := c.Caps.Keys[apiKey]
+	hasCaps = hasCaps && caps != c.Caps.ReplyCaps
+	if !hasProfile && !hasBudget && !hasHooks && !hasCaps {
+		return c
+	}
+
+	eff := *c
+	if hasProfile {
+		eff.Compat.Profile = profile
+	}
+	if hasBudget {
+		eff.RateLimit.RateBudget = budget
+	}
+	if hasHooks {
+		eff.Hooks.HookChains = HookChains{
+			Request:  append(slices.Clip(c.Hooks.Request), hooks.Request...),
+			Response: append(slices.Clip(c.Hooks.Response), hooks.Response...),
+		}
+	}
+	if hasCaps {
+		eff.Caps.ReplyCaps = caps
+	}
+	return &eff
+}
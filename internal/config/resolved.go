@@ -0,0 +1,218 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// where a setting came from, later ones override earlier ones
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+)
+
+// Setting is one value of the effective configuration, secrets masked
+type Setting struct {
+	// yaml path, e.g. model.think_mode or upstream.hosts[0]
+	Path   string `json:"path"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	// line in the config file, set for settings from the file
+	Line int `json:"line,omitempty"`
+}
+
+// Problem is one thing wrong with a configuration
+type Problem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	// line in the config file of the setting or its closest parent, 0 when
+	// the file does not set it
+	Line int `json:"line,omitempty"`
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s (line %d): %s", p.Path, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError lists every problem of a configuration, not just the first
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type problems []Problem
+
+func (p *problems) add(path, format string, args ...any) {
+	*p = append(*p, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: p}
+}
+
+// Resolved lists every setting in the order of Config with its source. a config that
+// was not loaded from a file and the environment reports all as defaults
+func (c *Config) Resolved() []Setting {
+	var out []Setting
+	for _, kv := range flatten(c) {
+		s := Setting{Path: maskPath(kv.path), Value: maskValue(kv.path, kv.value), Source: SourceDefault}
+		if src, ok := c.sources[kv.path]; ok {
+			s.Source = src
+		}
+		if s.Source == SourceFile {
+			s.Line = c.lines[kv.path]
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// attribute records which settings the environment and the file changed,
+// fromFile is c before the environment was applied
+func (c *Config) attribute(fromFile []pathValue, file *yaml.Node) {
+	c.lines = map[string]int{}
+	walk(file, "", func(path string, n *yaml.Node) {
+		c.lines[path] = n.Line
+	})
+
+	before := make(map[string]string, len(fromFile))
+	for _, kv := range fromFile {
+		before[kv.path] = kv.value
+	}
+
+	c.sources = map[string]string{}
+	for _, kv := range flatten(c) {
+		if v, ok := before[kv.path]; !ok || v != kv.value {
+			c.sources[kv.path] = SourceEnv
+		} else if _, ok := c.lines[kv.path]; ok {
+			c.sources[kv.path] = SourceFile
+		}
+	}
+}
+
+// line is where the file sets path or its closest parent, 0 for neither
+func (c *Config) line(path string) int {
+	for path != "" {
+		if l, ok := c.lines[path]; ok {
+			return l
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+type pathValue struct {
+	path, value string
+}
+
+// flatten lists the leaves of c as yaml would write them
+func flatten(c *Config) []pathValue {
+	var doc yaml.Node
+	data, _ := yaml.Marshal(c)
+	_ = yaml.Unmarshal(data, &doc)
+
+	var out []pathValue
+	walk(&doc, "", func(path string, n *yaml.Node) {
+		switch {
+		case n.Kind == yaml.ScalarNode:
+			out = append(out, pathValue{path, n.Value})
+		case n.Kind == yaml.MappingNode && len(n.Content) == 0:
+			out = append(out, pathValue{path, "{}"})
+		case n.Kind == yaml.SequenceNode && len(n.Content) == 0:
+			out = append(out, pathValue{path, "[]"})
+		}
+	})
+	return out
+}
+
+// walk calls fn for every node under n with its path, mapping keys join
+// with a dot and sequence items get [i]
+func walk(n *yaml.Node, path string, fn func(path string, n *yaml.Node)) {
+	if path != "" {
+		fn(path, n)
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, child := range n.Content {
+			walk(child, path, fn)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			walk(n.Content[i+1], key, fn)
+		}
+	case yaml.SequenceNode:
+		for i, child := range n.Content {
+			walk(child, fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	}
+}
+
+// settings holding credentials, by the last element of their path
+var secretKeys = []string{"token", "secret", "password", "api_key"}
+
+// maps keyed by client api key
+var apiKeyMaps = []string{"compat.keys", "rate_limit.keys", "hooks.keys", "caps.keys"}
+
+func maskValue(path, value string) string {
+	if value == "" {
+		return value
+	}
+	if slices.Contains(secretKeys, path[strings.LastIndex(path, ".")+1:]) {
+		return "***"
+	}
+	// upstream headers tend to carry credentials
+	if strings.HasPrefix(path, "openai_upstreams[") && strings.Contains(path, "].headers.") {
+		return "***"
+	}
+	return value
+}
+
+// maskPath names the api key in a path by keyRef
+func maskPath(path string) string {
+	for _, m := range apiKeyMaps {
+		rest, ok := strings.CutPrefix(path, m+".")
+		if !ok {
+			continue
+		}
+		key, tail, _ := strings.Cut(rest, ".")
+		masked := m + "." + keyRef(key)
+		if tail != "" {
+			masked += "." + tail
+		}
+		return masked
+	}
+	return path
+}
+
+// keyRef names an api key by a hash prefix, none of its characters show
+func keyRef(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
@@ -8,8 +8,104 @@ type ChatRequest struct {
 	MaxTokens   *int           `json:"max_tokens,omitempty" validate:"omitempty,gt=0"`
 	TopP        *float64       `json:"top_p,omitempty" validate:"omitempty,gte=0,lte=1"`
 	StreamOpts  *StreamOptions `json:"stream_options,omitempty"`
-	Tools       []Tool         `json:"tools,omitempty"`
-	Thinking    *bool          `json:"thinking,omitempty"`
+	// framing of a stream: sse (the default) or ndjson, one chunk per line
+	StreamFormat string `json:"stream_format,omitempty" validate:"omitempty,oneof=sse ndjson"`
+	Tools        []Tool `json:"tools,omitempty"`
+	Thinking     *bool  `json:"thinking,omitempty"`
+	// the titles z.ai gives its reasoning steps, as reasoning_summary
+	// deltas and reasoning_summaries on the final message
+	ReasoningSummaries bool `json:"reasoning_summaries,omitempty"`
+	// z.ai phases that are not the reply (search, code execution,
+	// previews) as upstream_events on chunks and the final message
+	IncludeUpstreamEvents bool `json:"include_upstream_events,omitempty"`
+	// openai's knob, mapped onto thinking and its budget for z.ai
+	ReasoningEffort string `json:"reasoning_effort,omitempty" validate:"omitempty,oneof=none minimal low medium high"`
+	// where the reasoning goes: deepseek (reasoning_content), openai (reasoning
+	// on the final message), tags (<think> in content) or none. unset leaves
+	// it to model.think_mode
+	ReasoningFormat string `json:"reasoning_format,omitempty" validate:"omitempty,oneof=deepseek openai tags none"`
+	Seed            *int   `json:"seed,omitempty"`
+	// openai's -2..2 range. qwen takes them as sent, z.ai in its params
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty" validate:"omitempty,gte=-2,lte=2"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty" validate:"omitempty,gte=-2,lte=2"`
+	// logprobs are not available upstream, a request gets an empty list
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty" validate:"omitempty,gte=0,lte=20"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	// false asks for one tool call per reply, calls past the first are dropped
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// the trailing assistant message is a prefix the reply continues. one
+	// with text is taken as such without it, see Prefill
+	ContinueFinalMessage bool `json:"continue_final_message,omitempty"`
+	// "auto" drops the oldest messages when the prompt overflows the context
+	Truncate string `json:"truncate,omitempty" validate:"omitempty,oneof=auto"`
+	// requests with the same id continue one upstream chat, user stands in
+	// when it is not set
+	ConversationID string `json:"conversation_id,omitempty" validate:"max=256"`
+	User           string `json:"user,omitempty" validate:"max=256"`
+}
+
+// Conversation is the id requests of one conversation share, "" for none
+func (r *ChatRequest) Conversation() string {
+	if r.ConversationID != "" {
+		return r.ConversationID
+	}
+	return r.User
+}
+
+// ThinkingEnabled is whether the model should reason. thinking: false
+// always wins, so a retry without thinking stays without it. medium and
+// high effort think, lower effort does not, and without an effort the
+// boolean decides, thinking stays off when it is unset too
+func (r *ChatRequest) ThinkingEnabled() bool {
+	if r.Thinking != nil && !*r.Thinking {
+		return false
+	}
+	switch r.ReasoningEffort {
+	case "":
+		return r.Thinking != nil && *r.Thinking
+	case "medium", "high":
+		return true
+	}
+	return false
+}
+
+// SingleToolCall reports parallel_tool_calls: false, unset allows several
+func (r *ChatRequest) SingleToolCall() bool {
+	return r.ParallelToolCalls != nil && !*r.ParallelToolCalls
+}
+
+// Prefill is the text of a trailing assistant message, a prefix the reply
+// continues rather than a finished turn. "" when the conversation does not
+// end in one, or it ends in tool calls
+func (r *ChatRequest) Prefill() string {
+	if len(r.Messages) == 0 {
+		return ""
+	}
+	last := r.Messages[len(r.Messages)-1]
+	if last.Role != "assistant" || len(last.ToolCalls) > 0 {
+		return ""
+	}
+	text, _ := last.Content.(string)
+	return text
+}
+
+type ResponseFormat struct {
+	Type       string      `json:"type" validate:"oneof=text json_object json_schema"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// WantsJSON reports whether the reply must be a json document
+func (f *ResponseFormat) WantsJSON() bool {
+	return f != nil && (f.Type == "json_object" || f.Type == "json_schema")
+}
+
+type JSONSchema struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
 }
 
 type Tool struct {
@@ -26,6 +122,7 @@ type ToolFunction struct {
 type Message struct {
 	Role       string      `json:"role" validate:"required,oneof=system user assistant tool"`
 	Content    interface{} `json:"content"`
+	Name       string      `json:"name,omitempty"`
 	ToolCallID string      `json:"tool_call_id,omitempty"`
 	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
 }
@@ -41,6 +138,31 @@ type ChatResponse struct {
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
 	Usage   *Usage   `json:"usage,omitempty"`
+
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+	// mo extensions, dropped by the strict profile
+	Mo *MoMeta `json:"mo,omitempty"`
+	// mo extension, explains a non-standard finish_reason
+	Warning string `json:"warning,omitempty"`
+	// mo extension, latency breakdown when requested with ?debug=true
+	Timings *Timings `json:"timings,omitempty"`
+}
+
+// Timings splits a completion into upstream queueing and generation
+type Timings struct {
+	// until upstream answered with headers
+	UpstreamTTFBMs int64 `json:"upstream_ttfb_ms"`
+	// until the first generated delta, reasoning included
+	TTFTMs  int64 `json:"ttft_ms"`
+	TotalMs int64 `json:"total_ms"`
+	// completion tokens over the time after the first delta
+	TokensPerSec float64 `json:"tokens_per_sec"`
+}
+
+type MoMeta struct {
+	// estimated cost, null when the model has no configured price
+	Cost     *float64 `json:"cost"`
+	Currency string   `json:"currency"`
 }
 
 type Choice struct {
@@ -48,6 +170,25 @@ type Choice struct {
 	Message      *ResponseMessage `json:"message,omitempty"`
 	Delta        *ResponseMessage `json:"delta,omitempty"`
 	FinishReason *string          `json:"finish_reason"`
+	Logprobs     *Logprobs        `json:"logprobs,omitempty"`
+}
+
+// Logprobs is the openai logprobs shape, mo never fills Content
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
 }
 
 type ResponseMessage struct {
@@ -55,9 +196,24 @@ type ResponseMessage struct {
 	Content          string     `json:"content,omitempty"`
 	ReasoningContent string     `json:"reasoning_content,omitempty"`
 	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	// with reasoning_summaries, the step titles finished in a chunk and
+	// all of them on a complete message
+	ReasoningSummary   string   `json:"reasoning_summary,omitempty"`
+	ReasoningSummaries []string `json:"reasoning_summaries,omitempty"`
+	// with include_upstream_events, what z.ai sent outside the reply
+	UpstreamEvents []UpstreamEvent `json:"upstream_events,omitempty"`
+}
+
+// UpstreamEvent is content of a z.ai phase that is not part of the reply.
+// streams carry fragments, complete messages one event per run of a phase
+type UpstreamEvent struct {
+	Phase   string `json:"phase"`
+	Content string `json:"content"`
 }
 
 type ToolCall struct {
+	// position of the call in a stream delta, unset elsewhere
+	Index    *int         `json:"index,omitempty"`
 	ID       string       `json:"id"`
 	Type     string       `json:"type"`
 	Function FunctionCall `json:"function"`
@@ -72,6 +228,20 @@ type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// openai's breakdown, reasoning_tokens are part of completion_tokens
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+	// upstream calls the completion took when a cut reply was resumed
+	Attempts int `json:"attempts,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	// prompt tokens served without an upstream call of their own
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 type User struct {
@@ -133,6 +303,10 @@ type Model struct {
 
 type ZaiResponse struct {
 	Data *ZaiResponseData `json:"data"`
+	// the sse event name, "" for plain data events
+	Event string `json:"-"`
+	// set on the last event when the stream broke off
+	Err error `json:"-"`
 }
 
 type ZaiResponseData struct {
@@ -143,6 +317,7 @@ type ZaiResponseData struct {
 	Done         bool   `json:"done"`
 }
 
+// UpstreamError is returned by providers when upstream answers non-200
 type UpstreamError struct {
 	StatusCode int
 	Message    string
@@ -155,3 +330,58 @@ func (e *UpstreamError) Error() string {
 func NewUpstreamError(code int, msg string) *UpstreamError {
 	return &UpstreamError{StatusCode: code, Message: msg}
 }
+
+const (
+	ErrInvalidRequest = "invalid_request_error"
+	ErrAuthentication = "authentication_error"
+	ErrRateLimit      = "rate_limit_exceeded"
+	ErrUpstream       = "upstream_error"
+	ErrServer         = "server_error"
+)
+
+// APIError is the openai error object, sent as {"error": {...}}
+type APIError struct {
+	Status  int     `json:"-"`
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func NewAPIError(status int, msg string) *APIError {
+	return &APIError{Status: status, Message: msg, Type: ErrorType(status)}
+}
+
+func (e *APIError) WithParam(param string) *APIError {
+	e.Param = &param
+	return e
+}
+
+func (e *APIError) WithCode(code string) *APIError {
+	e.Code = &code
+	return e
+}
+
+// ErrorType maps an http status to the openai error type
+func ErrorType(status int) string {
+	switch {
+	case status == 401 || status == 403:
+		return ErrAuthentication
+	case status == 429:
+		return ErrRateLimit
+	case status == 502 || status == 503 || status == 504:
+		return ErrUpstream
+	case status >= 400 && status < 500:
+		return ErrInvalidRequest
+	default:
+		return ErrServer
+	}
+}
@@ -0,0 +1,83 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when every slot and queue place is taken
+	ErrQueueFull = errors.New("admission queue is full")
+	// ErrQueueTimeout is returned when no slot freed up in time
+	ErrQueueTimeout = errors.New("no slot freed up in time")
+)
+
+// Gate caps the requests served at once. past the cap a request waits in a
+// bounded queue, past the queue it is shed right away
+type Gate struct {
+	slots   chan struct{}
+	queue   int64
+	timeout time.Duration
+	queued  atomic.Int64
+}
+
+// New admits limit requests at once and lets queue more wait up to timeout
+func New(limit, queue int, timeout time.Duration) *Gate {
+	return &Gate{
+		slots:   make(chan struct{}, max(limit, 1)),
+		queue:   int64(queue),
+		timeout: timeout,
+	}
+}
+
+// Acquire takes a slot, waiting for one if the queue has room. release
+// gives it back and may be called any number of times, so a slot can be
+// freed early and again on the way out
+func (g *Gate) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case g.slots <- struct{}{}:
+		return g.releaser(), nil
+	default:
+	}
+
+	if g.queued.Add(1) > g.queue {
+		g.queued.Add(-1)
+		return nil, ErrQueueFull
+	}
+	defer g.queued.Add(-1)
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return g.releaser(), nil
+	case <-timer.C:
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *Gate) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-g.slots })
+	}
+}
+
+// InFlight is the number of slots taken
+func (g *Gate) InFlight() int {
+	return len(g.slots)
+}
+
+// Queued is the number of requests waiting for a slot
+func (g *Gate) Queued() int {
+	return int(g.queued.Load())
+}
+
+func (g *Gate) Limit() int {
+	return cap(g.slots)
+}
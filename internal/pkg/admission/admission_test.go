@@ -0,0 +1,55 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGate(t *testing.T) {
+	g := New(1, 1, time.Second)
+
+	release, err := g.Acquire(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, g.InFlight())
+
+	// the second waits in the queue, the third finds it full
+	admitted := make(chan func())
+	go func() {
+		r, err := g.Acquire(context.Background())
+		assert.NoError(t, err)
+		admitted <- r
+	}()
+	require.Eventually(t, func() bool { return g.Queued() == 1 }, time.Second, time.Millisecond)
+
+	_, err = g.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrQueueFull)
+
+	release()
+	release()
+	second := <-admitted
+	assert.Equal(t, 1, g.InFlight(), "releasing twice frees one slot")
+	assert.Equal(t, 0, g.Queued())
+
+	second()
+	assert.Equal(t, 0, g.InFlight())
+}
+
+func TestGateTimeout(t *testing.T) {
+	g := New(1, 5, 20*time.Millisecond)
+	release, err := g.Acquire(context.Background())
+	require.NoError(t, err)
+	defer release()
+
+	_, err = g.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrQueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = g.Acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, g.Queued())
+}
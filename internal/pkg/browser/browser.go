@@ -1,8 +1,11 @@
 package browser
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -10,11 +13,44 @@ import (
 	"github.com/go-rod/rod/lib/launcher"
 	"github.com/go-rod/rod/lib/proto"
 	"github.com/go-rod/stealth"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
 )
 
+// signup pages, tests point them at hand-written stand-ins
+var (
+	zaiAuthURL  = "https://chat.z.ai/auth"
+	qwenAuthURL = "https://chat.qwen.ai/auth"
+)
+
+// Registrar drives the signup pages of the providers, Browser is the rod
+// implementation
+type Registrar interface {
+	RegisterZAI(creds Credentials) (string, error)
+	VerifyEmail(verifyURL, password string) (string, error)
+	RegisterQwen(email, password, name string) error
+	ActivateQwen(activationURL string) error
+	ConfirmQwenAuth(verificationURL string) error
+	// Reset signs out so the next account starts fresh in the same window
+	Reset() error
+	Close()
+}
+
 type Browser struct {
 	browser *rod.Browser
 	page    *rod.Page
+	failed  bool
+
+	// OnCaptcha runs once a form is filled, before the captcha is solved
+	OnCaptcha func()
+	// Solver gets past the captcha, nil waits for a human
+	Solver CaptchaSolver
+	Waits  Waits
+	// Retry repeats the token wait, reloading the page in between
+	Retry RetryPolicy
+	// a failed step leaves a screenshot and the page html here, empty skips it
+	DebugDir string
+	// Close leaves the window of a failed run open this long for inspection
+	KeepOpen time.Duration
 }
 
 type Credentials struct {
@@ -23,6 +59,41 @@ type Credentials struct {
 	Name     string
 }
 
+// Waits bounds the waits of the flows, zero fields keep the defaults
+type Waits struct {
+	// time the captcha solver gets, by default 2m on z.ai and 3m on qwen
+	Captcha time.Duration
+	// a page loading or moving on after a submit, 30s
+	Redirect time.Duration
+	// the session cookie showing up after verification, 30s
+	Token time.Duration
+	// a button or field the flow needs showing up, 10s
+	Element time.Duration
+	// an element only some page versions have, 5s
+	OptionalElement time.Duration
+	// how often a wait checks the page, 500ms
+	Poll time.Duration
+}
+
+func (w Waits) withDefaults() Waits {
+	if w.Redirect == 0 {
+		w.Redirect = 30 * time.Second
+	}
+	if w.Token == 0 {
+		w.Token = 30 * time.Second
+	}
+	if w.Element == 0 {
+		w.Element = 10 * time.Second
+	}
+	if w.OptionalElement == 0 {
+		w.OptionalElement = 5 * time.Second
+	}
+	if w.Poll == 0 {
+		w.Poll = 500 * time.Millisecond
+	}
+	return w
+}
+
 func New(headless bool) (*Browser, error) {
 	url := launcher.New().
 		Headless(headless).
@@ -34,13 +105,34 @@ func New(headless bool) (*Browser, error) {
 	return &Browser{browser: browser}, nil
 }
 
-func (b *Browser) Close() {
-	if b.browser != nil {
-		b.browser.MustClose()
+// Reset closes the page of the last account and clears the cookies it
+// signed in with
+func (b *Browser) Reset() error {
+	if b.page != nil {
+		b.page.Close()
+		b.page = nil
 	}
+	return b.browser.SetCookies(nil)
 }
 
-func (b *Browser) RegisterZAI(creds Credentials) (string, error) {
+func (b *Browser) Close() {
+	if b.browser == nil {
+		return
+	}
+	if b.failed && b.KeepOpen > 0 {
+		logger.Warn().Dur("for", b.KeepOpen).Msg("keeping the browser of a failed registration open")
+		go func() {
+			time.Sleep(b.KeepOpen)
+			b.browser.Close()
+		}()
+		return
+	}
+	b.browser.MustClose()
+}
+
+func (b *Browser) RegisterZAI(creds Credentials) (_ string, err error) {
+	defer b.fail("register_zai", &err)
+
 	page, err := stealth.Page(b.browser)
 	if err != nil {
 		return "", fmt.Errorf("create stealth page: %w", err)
@@ -48,11 +140,11 @@ func (b *Browser) RegisterZAI(creds Credentials) (string, error) {
 	b.page = page
 
 	page.MustSetViewport(1853, 943, 1, false)
-	page.MustNavigate("https://chat.z.ai/auth")
+	page.MustNavigate(zaiAuthURL)
 	page.MustWaitLoad()
-	time.Sleep(2 * time.Second)
 
-	emailBtn, err := page.Timeout(30*time.Second).ElementR("button", "[Ee]mail")
+	// the auth page may still be loading its sign in form
+	emailBtn, err := page.Timeout(b.Waits.withDefaults().Redirect).ElementR("button", "[Ee]mail")
 	if err != nil {
 		return "", fmt.Errorf("find email button: %w", err)
 	}
@@ -62,7 +154,7 @@ func (b *Browser) RegisterZAI(creds Credentials) (string, error) {
 
 	page.MustWaitStable()
 
-	signUpLink, err := page.Timeout(10*time.Second).ElementR("button", "Sign up")
+	signUpLink, err := page.Timeout(b.Waits.withDefaults().Element).ElementR("button", "Sign up")
 	if err != nil {
 		return "", fmt.Errorf("find sign up link: %w", err)
 	}
@@ -84,10 +176,8 @@ func (b *Browser) RegisterZAI(creds Credentials) (string, error) {
 		return "", fmt.Errorf("fill password: %w", err)
 	}
 
-	log.Println("waiting for captcha to be solved...")
-
-	if err := b.waitForCaptcha(); err != nil {
-		return "", fmt.Errorf("captcha timeout: %w", err)
+	if err := b.solveCaptcha(b.zaiCaptchaPassed, 2*time.Minute); err != nil {
+		return "", fmt.Errorf("captcha: %w", err)
 	}
 
 	log.Println("captcha solved")
@@ -99,7 +189,9 @@ func (b *Browser) RegisterZAI(creds Credentials) (string, error) {
 	return "", nil
 }
 
-func (b *Browser) VerifyEmail(verifyURL, password string) (string, error) {
+func (b *Browser) VerifyEmail(verifyURL, password string) (_ string, err error) {
+	defer b.fail("verify_email", &err)
+
 	page, err := stealth.Page(b.browser)
 	if err != nil {
 		return "", fmt.Errorf("create stealth page: %w", err)
@@ -129,7 +221,16 @@ func (b *Browser) VerifyEmail(verifyURL, password string) (string, error) {
 
 	log.Println("redirected, extracting token...")
 
-	token, err := b.waitForToken()
+	var token string
+	reload := false
+	err = b.Retry.Do("token", func() error {
+		if reload {
+			b.page.MustReload().MustWaitLoad()
+		}
+		reload = true
+		token, err = b.waitForToken()
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("get token: %w", err)
 	}
@@ -137,8 +238,56 @@ func (b *Browser) VerifyEmail(verifyURL, password string) (string, error) {
 	return token, nil
 }
 
+// fail runs deferred in every step: a panic of a rod Must call becomes the
+// step's error, and a failed step is snapshotted for later diagnosis
+func (b *Browser) fail(step string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%s: %v", step, r)
+	}
+	if *err == nil {
+		return
+	}
+	b.failed = true
+	b.snapshot(step)
+}
+
+// snapshot writes a full page screenshot and the html, prefixed with the
+// url, into DebugDir
+func (b *Browser) snapshot(step string) {
+	if b.DebugDir == "" || b.page == nil {
+		return
+	}
+	if err := os.MkdirAll(b.DebugDir, 0755); err != nil {
+		logger.Warn().Err(err).Msg("failed to create browser debug dir")
+		return
+	}
+
+	base := filepath.Join(b.DebugDir, time.Now().UTC().Format("20060102-150405")+"-"+step)
+	page := b.page.Timeout(10 * time.Second)
+
+	url := ""
+	if info, err := page.Info(); err == nil {
+		url = info.URL
+	}
+	if png, err := page.Screenshot(true, nil); err == nil {
+		os.WriteFile(base+".png", png, 0644)
+	}
+	html, _ := page.HTML()
+	os.WriteFile(base+".html", []byte("<!-- "+url+" -->\n"+html), 0644)
+
+	logger.Warn().Str("step", step).Str("url", url).Str("snapshot", base+".png").Msg("browser step failed")
+}
+
+// settle waits for the page to stop changing after a navigation or submit,
+// a page that keeps animating is given up on after the redirect timeout
+func (b *Browser) settle() {
+	if err := b.page.Timeout(b.Waits.withDefaults().Redirect).WaitStable(time.Second); err != nil {
+		log.Printf("page did not settle: %v", err)
+	}
+}
+
 func (b *Browser) click(selector string) error {
-	el, err := b.page.Timeout(10 * time.Second).Element(selector)
+	el, err := b.page.Timeout(b.Waits.withDefaults().Element).Element(selector)
 	if err != nil {
 		return err
 	}
@@ -146,44 +295,50 @@ func (b *Browser) click(selector string) error {
 }
 
 func (b *Browser) fill(selector, value string) error {
-	el, err := b.page.Timeout(10 * time.Second).Element(selector)
+	el, err := b.page.Timeout(b.Waits.withDefaults().Element).Element(selector)
 	if err != nil {
 		return err
 	}
 	return el.Input(value)
 }
 
-func (b *Browser) waitForCaptcha() error {
-	timeout := time.After(2 * time.Minute)
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-timeout:
-			return fmt.Errorf("captcha timeout after 2 minutes")
-		case <-ticker.C:
-			el, err := b.page.Timeout(100*time.Millisecond).ElementR("span", "Verification Passed")
-			if err == nil && el != nil {
-				return nil
-			}
-		}
+// solveCaptcha runs the solver on the current page, timeout applies unless
+// CaptchaTimeout overrides it
+func (b *Browser) solveCaptcha(passed func() bool, timeout time.Duration) error {
+	if b.OnCaptcha != nil {
+		b.OnCaptcha()
+	}
+	if b.Waits.Captcha > 0 {
+		timeout = b.Waits.Captcha
 	}
+	solver := b.Solver
+	if solver == nil {
+		solver = ManualSolver{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return solver.Solve(ctx, &CaptchaPage{Page: b.page, Passed: passed, Poll: b.Waits.withDefaults().Poll})
+}
+
+func (b *Browser) zaiCaptchaPassed() bool {
+	el, err := b.page.Timeout(100*time.Millisecond).ElementR("span", "Verification Passed")
+	return err == nil && el != nil
 }
 
 func (b *Browser) waitForRedirect(urlPrefix string) error {
-	timeout := time.After(30 * time.Second)
-	ticker := time.NewTicker(500 * time.Millisecond)
+	w := b.Waits.withDefaults()
+	timeout := time.After(w.Redirect)
+	ticker := time.NewTicker(w.Poll)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-timeout:
-			return fmt.Errorf("redirect timeout")
+			return fmt.Errorf("redirect timeout after %s", w.Redirect)
 		case <-ticker.C:
 			info := b.page.MustInfo()
 			if strings.HasPrefix(info.URL, urlPrefix) {
-				time.Sleep(2 * time.Second)
 				return nil
 			}
 		}
@@ -191,14 +346,15 @@ func (b *Browser) waitForRedirect(urlPrefix string) error {
 }
 
 func (b *Browser) waitForToken() (string, error) {
-	timeout := time.After(30 * time.Second)
-	ticker := time.NewTicker(500 * time.Millisecond)
+	w := b.Waits.withDefaults()
+	timeout := time.After(w.Token)
+	ticker := time.NewTicker(w.Poll)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-timeout:
-			return "", fmt.Errorf("token timeout")
+			return "", fmt.Errorf("token timeout after %s", w.Token)
 		case <-ticker.C:
 			cookies, err := b.page.Cookies([]string{"https://chat.z.ai"})
 			if err != nil {
@@ -214,7 +370,9 @@ func (b *Browser) waitForToken() (string, error) {
 	}
 }
 
-func (b *Browser) RegisterQwen(email, password, name string) error {
+func (b *Browser) RegisterQwen(email, password, name string) (err error) {
+	defer b.fail("register_qwen", &err)
+
 	page, err := stealth.Page(b.browser)
 	if err != nil {
 		return fmt.Errorf("create stealth page: %w", err)
@@ -222,16 +380,15 @@ func (b *Browser) RegisterQwen(email, password, name string) error {
 	b.page = page
 
 	page.MustSetViewport(2069, 1053, 1, false)
-	page.MustNavigate("https://chat.qwen.ai/auth")
+	page.MustNavigate(qwenAuthURL)
 	page.MustWaitLoad()
-	time.Sleep(2 * time.Second)
 
-	signUpBtn, err := page.Timeout(10 * time.Second).Element(".qwenchat-auth-pc-switch-button")
+	signUpBtn, err := page.Timeout(b.Waits.withDefaults().Element).Element(".qwenchat-auth-pc-switch-button")
 	if err != nil {
 		return fmt.Errorf("find sign up button: %w", err)
 	}
 	signUpBtn.MustClick()
-	time.Sleep(1 * time.Second)
+	page.MustWaitStable()
 
 	if err := b.fill(`[placeholder="Enter Your Full Name"]`, name); err != nil {
 		return fmt.Errorf("fill name: %w", err)
@@ -249,52 +406,39 @@ func (b *Browser) RegisterQwen(email, password, name string) error {
 		return fmt.Errorf("fill confirm password: %w", err)
 	}
 
-	checkbox, err := page.Timeout(5 * time.Second).Element(".ant-checkbox-input")
+	checkbox, err := page.Timeout(b.Waits.withDefaults().OptionalElement).Element(".ant-checkbox-input")
 	if err == nil {
 		checkbox.MustClick()
 	}
 
-	log.Println("waiting for captcha to be solved...")
-
-	if err := b.waitForQwenCaptcha(); err != nil {
-		return fmt.Errorf("captcha timeout: %w", err)
+	if err := b.solveCaptcha(b.qwenCaptchaPassed, 3*time.Minute); err != nil {
+		return fmt.Errorf("captcha: %w", err)
 	}
 
 	log.Println("captcha solved, clicking create account...")
 
-	submitBtn, err := page.Timeout(10 * time.Second).Element(".qwenchat-auth-pc-submit-button")
+	submitBtn, err := page.Timeout(b.Waits.withDefaults().Element).Element(".qwenchat-auth-pc-submit-button")
 	if err != nil {
 		return fmt.Errorf("find submit button: %w", err)
 	}
 	submitBtn.MustClick()
-
-	time.Sleep(3 * time.Second)
+	b.settle()
 	return nil
 }
 
-func (b *Browser) waitForQwenCaptcha() error {
-	timeout := time.After(3 * time.Minute)
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-timeout:
-			return fmt.Errorf("captcha timeout after 3 minutes")
-		case <-ticker.C:
-			el, err := b.page.Timeout(100 * time.Millisecond).Element(".qwenchat-auth-pc-submit-button")
-			if err != nil {
-				continue
-			}
-			disabled, _ := el.Attribute("disabled")
-			if disabled == nil {
-				return nil
-			}
-		}
+// the submit button stays disabled until the captcha passed
+func (b *Browser) qwenCaptchaPassed() bool {
+	el, err := b.page.Timeout(100 * time.Millisecond).Element(".qwenchat-auth-pc-submit-button")
+	if err != nil {
+		return false
 	}
+	disabled, _ := el.Attribute("disabled")
+	return disabled == nil
 }
 
-func (b *Browser) ActivateQwen(activationURL string) error {
+func (b *Browser) ActivateQwen(activationURL string) (err error) {
+	defer b.fail("activate_qwen", &err)
+
 	if b.page == nil {
 		page, err := stealth.Page(b.browser)
 		if err != nil {
@@ -306,12 +450,14 @@ func (b *Browser) ActivateQwen(activationURL string) error {
 
 	b.page.MustNavigate(activationURL)
 	b.page.MustWaitLoad()
-	time.Sleep(3 * time.Second)
+	b.settle()
 
 	return nil
 }
 
-func (b *Browser) ConfirmQwenAuth(verificationURL string) error {
+func (b *Browser) ConfirmQwenAuth(verificationURL string) (err error) {
+	defer b.fail("confirm_qwen_auth", &err)
+
 	if b.page == nil {
 		page, err := stealth.Page(b.browser)
 		if err != nil {
@@ -323,7 +469,7 @@ func (b *Browser) ConfirmQwenAuth(verificationURL string) error {
 
 	b.page.MustNavigate(verificationURL)
 	b.page.MustWaitLoad()
-	time.Sleep(3 * time.Second)
+	b.settle()
 
 	selectors := []string{
 		".qwen-chat-btn",
@@ -333,22 +479,21 @@ func (b *Browser) ConfirmQwenAuth(verificationURL string) error {
 	}
 
 	var confirmBtn *rod.Element
-	var err error
 	for _, sel := range selectors {
-		confirmBtn, err = b.page.Timeout(5 * time.Second).Element(sel)
+		confirmBtn, err = b.page.Timeout(b.Waits.withDefaults().OptionalElement).Element(sel)
 		if err == nil && confirmBtn != nil {
 			break
 		}
 	}
 
 	if confirmBtn == nil {
-		confirmBtn, err = b.page.Timeout(10*time.Second).ElementR("button", "Confirm|确认|Allow")
+		confirmBtn, err = b.page.Timeout(b.Waits.withDefaults().Element).ElementR("button", "Confirm|确认|Allow")
 		if err != nil {
 			return fmt.Errorf("find confirm button: %w", err)
 		}
 	}
 
 	confirmBtn.MustClick()
-	time.Sleep(3 * time.Second)
+	b.settle()
 	return nil
 }
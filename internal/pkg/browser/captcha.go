@@ -0,0 +1,211 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+)
+
+// CaptchaPage is the page a solver works on
+type CaptchaPage struct {
+	Page *rod.Page
+	// Passed reports whether the site accepted the captcha
+	Passed func() bool
+	// how often Passed is checked, 500ms when zero
+	Poll time.Duration
+}
+
+// CaptchaSolver gets a captcha past, ctx carries its timeout
+type CaptchaSolver interface {
+	Solve(ctx context.Context, c *CaptchaPage) error
+}
+
+// ManualSolver waits for a human to solve the captcha in the visible window
+type ManualSolver struct{}
+
+func (ManualSolver) Solve(ctx context.Context, c *CaptchaPage) error {
+	log.Println("waiting for captcha to be solved...")
+	return waitPassed(ctx, c)
+}
+
+// ExternalSolver hands the captcha to a 2captcha compatible service and
+// injects the token it answers with
+type ExternalSolver struct {
+	// service root, https://2captcha.com when empty
+	Endpoint string
+	APIKey   string
+	// captcha type as the service names it: turnstile, hcaptcha, userrecaptcha
+	Method string
+	// how often the answer is polled, 5s when zero
+	Poll time.Duration
+}
+
+// the sitekey and the callback the widget would call with its token
+const captchaWidgetJS = `() => {
+	const el = document.querySelector('[data-sitekey]');
+	if (el) return {sitekey: el.dataset.sitekey, callback: el.dataset.callback || ''};
+	for (const f of document.querySelectorAll('iframe[src]')) {
+		const u = new URL(f.src, location.href);
+		const key = u.searchParams.get('sitekey') || u.searchParams.get('k');
+		if (key) return {sitekey: key, callback: ''};
+	}
+	return {sitekey: '', callback: ''};
+}`
+
+// puts the token where the widgets keep theirs and fires the callback
+const captchaInjectJS = `(token, callback) => {
+	for (const name of ['cf-turnstile-response', 'g-recaptcha-response', 'h-captcha-response']) {
+		document.querySelectorAll('[name="' + name + '"]').forEach(el => { el.value = token; });
+	}
+	if (callback && typeof window[callback] === 'function') window[callback](token);
+}`
+
+func (s *ExternalSolver) Solve(ctx context.Context, c *CaptchaPage) error {
+	page := c.Page.Context(ctx)
+
+	widget, err := page.Eval(captchaWidgetJS)
+	if err != nil {
+		return fmt.Errorf("find captcha: %w", err)
+	}
+	sitekey := widget.Value.Get("sitekey").Str()
+	if sitekey == "" {
+		return errors.New("captcha sitekey not found on the page")
+	}
+	info, err := page.Info()
+	if err != nil {
+		return fmt.Errorf("page info: %w", err)
+	}
+
+	log.Println("sending captcha to the solver...")
+	token, err := s.token(ctx, sitekey, info.URL)
+	if err != nil {
+		return err
+	}
+	if _, err := page.Eval(captchaInjectJS, token, widget.Value.Get("callback").Str()); err != nil {
+		return fmt.Errorf("inject captcha token: %w", err)
+	}
+	return waitPassed(ctx, c)
+}
+
+// solverAnswer is how in.php and res.php answer with json=1
+type solverAnswer struct {
+	Status  int    `json:"status"`
+	Request string `json:"request"`
+}
+
+// siteKeyField names the sitekey as in.php expects it for a method,
+// recaptcha still takes it as googlekey
+func siteKeyField(method string) string {
+	if method == "userrecaptcha" {
+		return "googlekey"
+	}
+	return "sitekey"
+}
+
+// token submits the captcha and polls until a worker solved it
+func (s *ExternalSolver) token(ctx context.Context, sitekey, pageURL string) (string, error) {
+	endpoint := strings.TrimSuffix(s.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://2captcha.com"
+	}
+	poll := s.Poll
+	if poll == 0 {
+		poll = 5 * time.Second
+	}
+
+	form := url.Values{
+		"key":     {s.APIKey},
+		"method":  {s.Method},
+		"pageurl": {pageURL},
+		"json":    {"1"},
+	}
+	form.Set(siteKeyField(s.Method), sitekey)
+	id, err := s.call(ctx, http.MethodPost, endpoint+"/in.php", form)
+	if err != nil {
+		return "", fmt.Errorf("submit captcha: %w", err)
+	}
+
+	query := url.Values{"key": {s.APIKey}, "action": {"get"}, "id": {id}, "json": {"1"}}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("captcha solver: %w", ctx.Err())
+		case <-ticker.C:
+		}
+
+		token, err := s.call(ctx, http.MethodGet, endpoint+"/res.php?"+query.Encode(), nil)
+		if errors.Is(err, errNotReady) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("captcha result: %w", err)
+		}
+		return token, nil
+	}
+}
+
+var errNotReady = errors.New("CAPCHA_NOT_READY")
+
+func (s *ExternalSolver) call(ctx context.Context, method, target string, form url.Values) (string, error) {
+	body := ""
+	if form != nil {
+		body = form.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := httpclient.New(30 * time.Second).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var answer solverAnswer
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", fmt.Errorf("decode answer: %w", err)
+	}
+	if answer.Status != 1 {
+		if answer.Request == errNotReady.Error() {
+			return "", errNotReady
+		}
+		return "", errors.New(answer.Request)
+	}
+	return answer.Request, nil
+}
+
+// waitPassed polls until the site accepted the captcha or ctx ends
+func waitPassed(ctx context.Context, c *CaptchaPage) error {
+	poll := c.Poll
+	if poll == 0 {
+		poll = 500 * time.Millisecond
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		if c.Passed() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("captcha not passed: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
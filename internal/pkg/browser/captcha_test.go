@@ -0,0 +1,89 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fake2captcha answers in.php with an id and res.php with the token once
+// it was asked notReady times
+func fake2captcha(t *testing.T, notReady int32) *httptest.Server {
+	var polls atomic.Int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/in.php":
+			require.NoError(t, r.ParseForm())
+			if r.PostForm.Get("key") != "secret" {
+				fmt.Fprint(w, `{"status":0,"request":"ERROR_WRONG_USER_KEY"}`)
+				return
+			}
+			field := "sitekey"
+			if r.PostForm.Get("method") == "userrecaptcha" {
+				field = "googlekey"
+			}
+			assert.Equal(t, "0x4AAA", r.PostForm.Get(field), "the sitekey goes as %s", field)
+			assert.NotEmpty(t, r.PostForm.Get("pageurl"))
+			fmt.Fprint(w, `{"status":1,"request":"42"}`)
+		case "/res.php":
+			assert.Equal(t, "42", r.URL.Query().Get("id"))
+			if polls.Add(1) <= notReady {
+				fmt.Fprint(w, `{"status":0,"request":"CAPCHA_NOT_READY"}`)
+				return
+			}
+			fmt.Fprint(w, `{"status":1,"request":"solved-token"}`)
+		}
+	}))
+}
+
+func TestExternalSolverToken(t *testing.T) {
+	for _, method := range []string{"turnstile", "hcaptcha", "userrecaptcha"} {
+		t.Run(method, func(t *testing.T) {
+			srv := fake2captcha(t, 2)
+			defer srv.Close()
+
+			s := &ExternalSolver{Endpoint: srv.URL, APIKey: "secret", Method: method, Poll: time.Millisecond}
+			token, err := s.token(context.Background(), "0x4AAA", "https://chat.z.ai/auth")
+			require.NoError(t, err)
+			assert.Equal(t, "solved-token", token)
+		})
+	}
+}
+
+func TestExternalSolverRejected(t *testing.T) {
+	srv := fake2captcha(t, 0)
+	defer srv.Close()
+
+	s := &ExternalSolver{Endpoint: srv.URL, APIKey: "wrong", Method: "turnstile", Poll: time.Millisecond}
+	_, err := s.token(context.Background(), "0x4AAA", "https://chat.z.ai/auth")
+	require.ErrorContains(t, err, "ERROR_WRONG_USER_KEY")
+}
+
+func TestExternalSolverTimeout(t *testing.T) {
+	srv := fake2captcha(t, 1<<30)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s := &ExternalSolver{Endpoint: srv.URL, APIKey: "secret", Method: "turnstile", Poll: time.Millisecond}
+	_, err := s.token(ctx, "0x4AAA", "https://chat.z.ai/auth")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestManualSolver(t *testing.T) {
+	var checks atomic.Int32
+	page := &CaptchaPage{Passed: func() bool { return checks.Add(1) > 2 }}
+	require.NoError(t, ManualSolver{}.Solve(context.Background(), page))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ManualSolver{}.Solve(ctx, &CaptchaPage{Passed: func() bool { return false }})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,29 @@
+package browser
+
+import (
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// RetryPolicy repeats a step of a registration that failed for a reason a
+// second try may not hit, a slow mailbox or a page that never set its cookie
+type RetryPolicy struct {
+	// tries in total, <= 1 disables retries
+	MaxAttempts int
+	// pause between tries
+	Delay time.Duration
+}
+
+// Do runs fn until it succeeds or the attempts are used up, the last error
+// is returned
+func (p RetryPolicy) Do(step string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts {
+			return err
+		}
+		logger.Warn().Err(err).Str("step", step).Int("attempt", attempt).Dur("delay", p.Delay).Msg("registration step failed, retrying")
+		time.Sleep(p.Delay)
+	}
+}
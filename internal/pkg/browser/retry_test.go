@@ -0,0 +1,33 @@
+package browser
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	flaky := func(fails int) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= fails {
+				return errors.New("mailbox unreachable")
+			}
+			return nil
+		}, &calls
+	}
+
+	fn, calls := flaky(1)
+	assert.NoError(t, RetryPolicy{MaxAttempts: 3}.Do("email", fn))
+	assert.Equal(t, 2, *calls)
+
+	fn, calls = flaky(5)
+	assert.EqualError(t, RetryPolicy{MaxAttempts: 3}.Do("email", fn), "mailbox unreachable")
+	assert.Equal(t, 3, *calls)
+
+	fn, calls = flaky(1)
+	assert.Error(t, RetryPolicy{}.Do("email", fn))
+	assert.Equal(t, 1, *calls)
+}
@@ -0,0 +1,37 @@
+//go:build browser
+
+package browser
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// needs chromium, rod downloads one on first use:
+// go test -tags browser -run TestFailedStepSnapshot ./internal/pkg/browser
+func TestFailedStepSnapshot(t *testing.T) {
+	br, err := New(true)
+	require.NoError(t, err)
+	defer br.Close()
+	br.DebugDir = t.TempDir()
+
+	// the page has no password field, filling it fails
+	_, err = br.VerifyEmail("data:text/html,<h1>expired link</h1>", "secret")
+	require.Error(t, err)
+
+	pngs, _ := filepath.Glob(filepath.Join(br.DebugDir, "*-verify_email.png"))
+	require.Len(t, pngs, 1)
+	png, err := os.ReadFile(pngs[0])
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(png), "\x89PNG"))
+
+	html, err := os.ReadFile(strings.TrimSuffix(pngs[0], ".png") + ".html")
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "<!-- data:text/html")
+	assert.Contains(t, string(html), "expired link")
+}
@@ -0,0 +1,60 @@
+//go:build browser
+
+package browser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drives the signup flows headless against hand-written stand-ins for the
+// signup pages, not captured copies, so they check the flow and not the real
+// markup. the captcha goes to a fake 2captcha:
+// go test -tags browser -run TestSynthetic ./internal/pkg/browser
+func synthetic(t *testing.T) (*Browser, *httptest.Server) {
+	pages := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(pages.Close)
+	solver := fake2captcha(t, 1)
+	t.Cleanup(solver.Close)
+
+	br, err := New(true)
+	require.NoError(t, err)
+	t.Cleanup(br.Close)
+	br.Solver = &ExternalSolver{Endpoint: solver.URL, APIKey: "secret", Method: "turnstile", Poll: 10 * time.Millisecond}
+	br.Waits.Captcha = 10 * time.Second
+	return br, pages
+}
+
+func submitted(t *testing.T, br *Browser) string {
+	res, err := br.page.Eval(`() => window.submitted || ''`)
+	require.NoError(t, err)
+	return res.Value.Str()
+}
+
+func TestSyntheticZAI(t *testing.T) {
+	br, pages := synthetic(t)
+	defer func(u string) { zaiAuthURL = u }(zaiAuthURL)
+	zaiAuthURL = pages.URL + "/zai_auth.html"
+
+	captcha := false
+	br.OnCaptcha = func() { captcha = true }
+	_, err := br.RegisterZAI(Credentials{Email: "a@b.c", Password: "pw", Name: "a"})
+	require.NoError(t, err)
+
+	assert.True(t, captcha)
+	assert.Equal(t, "a|a@b.c|pw|solved-token", submitted(t, br))
+}
+
+func TestSyntheticQwen(t *testing.T) {
+	br, pages := synthetic(t)
+	defer func(u string) { qwenAuthURL = u }(qwenAuthURL)
+	qwenAuthURL = pages.URL + "/qwen_auth.html"
+
+	require.NoError(t, br.RegisterQwen("a@b.c", "pw", "a"))
+	assert.Equal(t, "a|a@b.c|pw|pw|true|solved-token", submitted(t, br))
+}
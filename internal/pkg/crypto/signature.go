@@ -8,28 +8,73 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
-	"os"
 	"strconv"
+	"sync/atomic"
 )
 
 const defaultSecret = "key-@@@@)))()((9))-xxxx&&&%%%%%"
 
+// DefaultSignatureVersion is the algorithm of the current z.ai web client
+const DefaultSignatureVersion = "v1"
+
+// signers by version, a new algorithm is added next to the old one and
+// picked in config until z.ai stops accepting the old
+var signers = map[string]func(secret []byte, canonical, prompt, ts string, tsMillis int64) ([]byte, error){
+	"v1": signV1,
+}
+
 type SignatureResult struct {
 	Signature string
 	Timestamp int64
+	Version   string
 }
 
 type SignatureGenerator interface {
 	GenerateSignature(params map[string]string, lastUserMsg string) (*SignatureResult, error)
 }
 
-type sigGen struct{}
+type signerKey struct {
+	secret  []byte
+	version string
+}
+
+// Signer signs with a secret and version resolved at construction, Reload
+// swaps both while requests are being signed
+type Signer struct {
+	key atomic.Pointer[signerKey]
+}
+
+// NewSignatureGenerator signs with secret, the built-in one when empty, and
+// the algorithm of version, DefaultSignatureVersion when empty
+func NewSignatureGenerator(secret, version string) (*Signer, error) {
+	s := &Signer{}
+	if err := s.Reload(secret, version); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload switches to a new secret or version, e.g. after z.ai rotated it
+func (s *Signer) Reload(secret, version string) error {
+	if secret == "" {
+		secret = defaultSecret
+	}
+	if version == "" {
+		version = DefaultSignatureVersion
+	}
+	if _, ok := signers[version]; !ok {
+		return fmt.Errorf("unknown signature version %q", version)
+	}
+	s.key.Store(&signerKey{secret: []byte(secret), version: version})
+	return nil
+}
 
-func NewSignatureGenerator() SignatureGenerator {
-	return &sigGen{}
+// Version is the algorithm requests are signed with
+func (s *Signer) Version() string {
+	return s.key.Load().version
 }
 
-func (s *sigGen) GenerateSignature(params map[string]string, lastUserMsg string) (*SignatureResult, error) {
+func (s *Signer) GenerateSignature(params map[string]string, lastUserMsg string) (*SignatureResult, error) {
 	reqID := params["requestId"]
 	tsStr := params["timestamp"]
 	userID := params["user_id"]
@@ -45,20 +90,30 @@ func (s *sigGen) GenerateSignature(params map[string]string, lastUserMsg string)
 
 	canonical := fmt.Sprintf("requestId,%s,timestamp,%d,user_id,%s", reqID, ts, userID)
 
-	w := base64.StdEncoding.EncodeToString([]byte(lastUserMsg))
+	key := s.key.Load()
+	sig, err := signers[key.version](key.secret, canonical, lastUserMsg, tsStr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignatureResult{
+		Signature: hex.EncodeToString(sig),
+		Timestamp: ts,
+		Version:   key.version,
+	}, nil
+}
+
+// signV1 keys an hmac of the request with an hmac of the 5 minute window
+func signV1(secret []byte, canonical, prompt, ts string, tsMillis int64) ([]byte, error) {
+	w := base64.StdEncoding.EncodeToString([]byte(prompt))
 
-	c := fmt.Sprintf("%s|%s|%s", canonical, w, tsStr)
+	c := fmt.Sprintf("%s|%s|%s", canonical, w, ts)
 
 	// 5 min window
-	window := ts / (5 * 60 * 1000)
+	window := tsMillis / (5 * 60 * 1000)
 	windowStr := strconv.FormatInt(window, 10)
 
-	secret := os.Getenv("ZAI_SECRET_KEY")
-	if secret == "" {
-		secret = defaultSecret
-	}
-
-	h1, err := hmacSha256([]byte(secret), []byte(windowStr))
+	h1, err := hmacSha256(secret, []byte(windowStr))
 	if err != nil {
 		return nil, fmt.Errorf("hmac step1: %w", err)
 	}
@@ -68,11 +123,7 @@ func (s *sigGen) GenerateSignature(params map[string]string, lastUserMsg string)
 	if err != nil {
 		return nil, fmt.Errorf("hmac step2: %w", err)
 	}
-
-	return &SignatureResult{
-		Signature: hex.EncodeToString(h2),
-		Timestamp: ts,
-	}, nil
+	return h2, nil
 }
 
 func hmacSha256(key, data []byte) ([]byte, error) {
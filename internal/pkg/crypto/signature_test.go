@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixed request, the signature depends on nothing else
+var sigParams = map[string]string{
+	"requestId": "4f1c2e9a-0b7d-4c55-9a61-2f0e8d3b7c10",
+	"timestamp": "1772366400000",
+	"user_id":   "user-7b3e",
+}
+
+func TestGenerateSignatureStable(t *testing.T) {
+	gen, err := NewSignatureGenerator("", "")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		prompt string
+		want   string
+	}{
+		{"text", "hello", "b7c9cd5c81396f0c81808252fe184aba7795005b4c61a02f9b5d8c60e4a6187e"},
+		{"image only", "[image]", "cf0383c16af6e8850899a5b88277bb90c9f8ed5a96e332a1b5fbe1de08d0ca6f"},
+		{"text and image", "what is this [image]", "dca2585b5d4b689313cfd7f0822165389ac3ee753f024195ac92acaefcbf6ae0"},
+		{"tool result", "<tool_result tool_call_id=\"call_1\" name=\"get_weather\">\n{\"temp\": 21}\n</tool_result>", "44cc6868b3b6e155b870fcfa0f93fa44769e4c7370aacb00c2b76fd0a6a9b240"},
+		{"empty", "", "fdc51537c5bac229ea7787e2932241ef85e617379fa6657f5a02aea33417dc64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := gen.GenerateSignature(sigParams, tt.prompt)
+			require.NoError(t, err)
+			assert.Equal(t, int64(1772366400000), sig.Timestamp)
+			assert.Equal(t, tt.want, sig.Signature)
+			assert.Equal(t, "v1", sig.Version)
+
+			again, err := gen.GenerateSignature(sigParams, tt.prompt)
+			require.NoError(t, err)
+			assert.Equal(t, sig.Signature, again.Signature)
+		})
+	}
+}
+
+func TestSignatureSecret(t *testing.T) {
+	builtin, err := NewSignatureGenerator("", "v1")
+	require.NoError(t, err)
+	rotated, err := NewSignatureGenerator("rotated-secret", "")
+	require.NoError(t, err)
+
+	want, err := rotated.GenerateSignature(sigParams, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "e5bf83e1f0c044c040a8dac6b8d270d24b21634e4ab4c3c70f32f5517a9cc759", want.Signature)
+
+	// a reload applies to the next request
+	got, err := builtin.GenerateSignature(sigParams, "hello")
+	require.NoError(t, err)
+	assert.NotEqual(t, want.Signature, got.Signature)
+	require.NoError(t, builtin.Reload("rotated-secret", "v1"))
+	got, err = builtin.GenerateSignature(sigParams, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, want.Signature, got.Signature)
+
+	assert.Error(t, builtin.Reload("x", "v9"))
+	assert.Equal(t, "v1", builtin.Version(), "a failed reload keeps the running key")
+	_, err = NewSignatureGenerator("", "v9")
+	assert.Error(t, err)
+}
+
+func TestGenerateSignatureParams(t *testing.T) {
+	gen, err := NewSignatureGenerator("", "")
+	require.NoError(t, err)
+
+	_, err = gen.GenerateSignature(map[string]string{"requestId": "r", "timestamp": "1"}, "hi")
+	assert.Error(t, err, "user_id missing")
+
+	_, err = gen.GenerateSignature(map[string]string{"requestId": "r", "timestamp": "soon", "user_id": "u"}, "hi")
+	assert.Error(t, err)
+}
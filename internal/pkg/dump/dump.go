@@ -0,0 +1,223 @@
+// Package dump writes upstream requests and the headers of their replies,
+// for when upstream rejects a payload. credentials are masked
+package dump
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+const (
+	// ModeLog writes dumps to the log at debug level
+	ModeLog = "log"
+	// ModeFiles writes one file per request
+	ModeFiles = "files"
+)
+
+const masked = "***"
+
+// headers whose value is a credential, cookies keep their names
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "X-Signature", "X-Api-Key"}
+
+// query parameters and json keys whose value is a credential
+var secretParams = []string{"token", "access_token", "refresh_token", "signature", "api_key", "password", "secret"}
+
+type Dumper struct {
+	mode string
+	dir  string
+	keep int
+	log  logger.Module
+
+	mu  sync.Mutex
+	seq int
+}
+
+// New returns a dumper for mode, nil when mode is empty. files go to dir and
+// only the newest keep of them stay, 0 keeps all
+func New(mode, dir string, keep int, log logger.Module) *Dumper {
+	if mode == "" {
+		return nil
+	}
+	return &Dumper{mode: mode, dir: dir, keep: keep, log: log}
+}
+
+// Write dumps req, sent with body, and what came back: the status and
+// headers of resp, or err. a nil Dumper writes nothing
+func (d *Dumper) Write(ctx context.Context, req *http.Request, body []byte, resp *http.Response, err error) {
+	if d == nil {
+		return
+	}
+
+	text := Format(req, body, resp, err)
+	if d.mode == ModeLog {
+		d.log.Ctx(ctx).Debug().Str("dump", text).Msg("upstream request")
+		return
+	}
+
+	path, werr := d.save(text)
+	if werr != nil {
+		d.log.Ctx(ctx).Warn().Err(werr).Msg("request dump failed")
+		return
+	}
+	d.log.Ctx(ctx).Debug().Str("file", path).Msg("upstream request dumped")
+}
+
+// save writes text to a new file and drops the oldest beyond keep
+func (d *Dumper) save(text string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.MkdirAll(d.dir, 0o700); err != nil {
+		return "", err
+	}
+	// names sort by time, the sequence keeps requests of one instant apart
+	d.seq++
+	name := fmt.Sprintf("%s-%06d.txt", time.Now().UTC().Format("20060102T150405.000000000"), d.seq%1000000)
+	path := filepath.Join(d.dir, name)
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		return "", err
+	}
+
+	if d.keep > 0 {
+		names, err := filepath.Glob(filepath.Join(d.dir, "*.txt"))
+		if err != nil {
+			return path, err
+		}
+		sort.Strings(names)
+		for _, old := range names[:max(len(names)-d.keep, 0)] {
+			os.Remove(old)
+		}
+	}
+	return path, nil
+}
+
+// Format renders req with body and the status and headers of resp, or err,
+// like a wire dump with every credential masked
+func Format(req *http.Request, body []byte, resp *http.Response, err error) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", req.Method, scrubURL(req.URL))
+	writeHeader(&b, req.Header)
+	b.WriteString("\n")
+	b.Write(scrubBody(body))
+	b.WriteString("\n\n")
+
+	switch {
+	case err != nil:
+		fmt.Fprintf(&b, "error: %v\n", err)
+	case resp != nil:
+		fmt.Fprintf(&b, "%s %s\n", resp.Proto, resp.Status)
+		writeHeader(&b, resp.Header)
+	}
+	return b.String()
+}
+
+func writeHeader(b *strings.Builder, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(b, "%s: %s\n", k, scrubHeader(k, v))
+		}
+	}
+}
+
+func scrubHeader(key, value string) string {
+	key = http.CanonicalHeaderKey(key)
+	switch {
+	case slices.Contains(secretHeaders, key):
+		// the scheme says which kind of credential it was
+		if scheme, _, ok := strings.Cut(value, " "); ok && key != "X-Signature" {
+			return scheme + " " + masked
+		}
+		return masked
+	case key == "Cookie" || key == "Set-Cookie":
+		return scrubCookies(value)
+	}
+	return value
+}
+
+// scrubCookies masks every cookie value, attributes of Set-Cookie such as
+// Path stay
+func scrubCookies(value string) string {
+	parts := strings.Split(value, ";")
+	for i, p := range parts {
+		name, _, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		attr := strings.ToLower(strings.TrimSpace(name))
+		if i > 0 && slices.Contains([]string{"path", "domain", "expires", "max-age", "samesite"}, attr) {
+			continue
+		}
+		parts[i] = name + "=" + masked
+	}
+	return strings.Join(parts, ";")
+}
+
+func scrubURL(u *url.URL) string {
+	c := *u
+	// pair by pair, so the order stays and the mask is not escaped
+	pairs := strings.Split(c.RawQuery, "&")
+	for i, p := range pairs {
+		key, _, ok := strings.Cut(p, "=")
+		name, _ := url.QueryUnescape(key)
+		if ok && slices.Contains(secretParams, strings.ToLower(name)) {
+			pairs[i] = key + "=" + masked
+		}
+	}
+	c.RawQuery = strings.Join(pairs, "&")
+	if c.User != nil {
+		c.User = url.User(masked)
+	}
+	return c.String()
+}
+
+// scrubBody masks credential keys of a json body, anything else is kept as
+// it is
+func scrubBody(body []byte) []byte {
+	var v any
+	if json.Unmarshal(body, &v) != nil {
+		return body
+	}
+	scrubValue(v)
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+	return bytes.TrimRight(out.Bytes(), "\n")
+}
+
+func scrubValue(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if _, ok := item.(string); ok && slices.Contains(secretParams, strings.ToLower(k)) {
+				v[k] = masked
+				continue
+			}
+			scrubValue(item)
+		}
+	case []any:
+		for _, item := range v {
+			scrubValue(item)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// secrets every part of the request carries somewhere
+var secrets = []string{"SECRET-TOKEN", "SECRET-SIG", "SECRET-COOKIE", "SECRET-SET", "SECRET-BODY"}
+
+func upstreamRequest(t *testing.T) (*http.Request, []byte, *http.Response) {
+	t.Helper()
+	body := []byte(`{"chat_id":"c-1","messages":[{"role":"user","content":"hi"}],"variables":{"token":"SECRET-BODY"},"signature_prompt":"hi"}`)
+	req, err := http.NewRequest("POST", "https://chat.z.ai/api/v2/chat/completions?timestamp=1&token=SECRET-TOKEN&signature_timestamp=2&user_id=u-1", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer SECRET-TOKEN")
+	req.Header.Set("x-signature", "SECRET-SIG")
+	req.Header.Set("Cookie", "token=SECRET-COOKIE; lang=en")
+	req.Header.Set("X-FE-Version", "prod-fe-1.0.70")
+
+	resp := &http.Response{Proto: "HTTP/1.1", Status: "400 Bad Request", StatusCode: 400, Header: http.Header{}}
+	resp.Header.Set("Set-Cookie", "acw_tc=SECRET-SET; Path=/; HttpOnly")
+	resp.Header.Set("Content-Type", "application/json")
+	return req, body, resp
+}
+
+func assertMasked(t *testing.T, text string) {
+	t.Helper()
+	for _, s := range secrets {
+		assert.NotContains(t, text, s)
+	}
+}
+
+func TestFormatMasksSecrets(t *testing.T) {
+	req, body, resp := upstreamRequest(t)
+	text := Format(req, body, resp, nil)
+
+	assertMasked(t, text)
+	for _, want := range []string{
+		"POST https://chat.z.ai/api/v2/chat/completions?timestamp=1&token=***&signature_timestamp=2&user_id=u-1",
+		"Authorization: Bearer ***",
+		"X-Signature: ***",
+		"Cookie: token=***; lang=***",
+		"X-Fe-Version: prod-fe-1.0.70",
+		`"token": "***"`,
+		`"signature_prompt": "hi"`,
+		"HTTP/1.1 400 Bad Request",
+		"Set-Cookie: acw_tc=***; Path=/; HttpOnly",
+	} {
+		assert.Contains(t, text, want)
+	}
+
+	text = Format(req, []byte("not json, kept"), nil, errors.New("connection refused"))
+	assert.Contains(t, text, "not json, kept")
+	assert.Contains(t, text, "error: connection refused")
+}
+
+func TestDumperFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "debug")
+	d := New(ModeFiles, dir, 2, logger.Module("test"))
+	req, body, resp := upstreamRequest(t)
+	for range 3 {
+		d.Write(context.Background(), req, body, resp, nil)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	require.NoError(t, err)
+	require.Len(t, names, 2, "the oldest beyond dump_keep are removed")
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assertMasked(t, string(data))
+		assert.True(t, strings.HasPrefix(string(data), "POST https://chat.z.ai/"))
+	}
+
+	var nothing *Dumper
+	nothing.Write(context.Background(), req, body, resp, nil)
+	assert.Nil(t, New("", dir, 2, logger.Module("test")), "no mode, no dumper")
+}
+
+func TestDumperLog(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, logger.Init(logger.Options{Level: "debug", Format: "json", Out: &out}))
+	t.Cleanup(func() { logger.Init(logger.Options{}) })
+
+	req, body, resp := upstreamRequest(t)
+	New(ModeLog, "", 0, logger.Module("test")).Write(context.Background(), req, body, resp, nil)
+
+	assert.Contains(t, out.String(), "upstream request")
+	assert.Contains(t, out.String(), "Bearer ***")
+	assertMasked(t, out.String())
+}
@@ -1,34 +1,171 @@
 package httpclient
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
 )
 
-type Client struct {
-	http *http.Client
+// Options tunes the transport every Client shares
+type Options struct {
+	ConnectTimeout      time.Duration
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+	HTTP2               bool
 }
 
-func New(timeout time.Duration) *Client {
-	transport := &http.Transport{}
+// OptionsFrom takes the transport settings of an http config
+func OptionsFrom(c config.HTTPConfig) Options {
+	return Options{
+		ConnectTimeout:      c.ConnectTimeout,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		IdleConnTimeout:     c.IdleConnTimeout,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+		HTTP2:               c.HTTP2,
+	}
+}
+
+// DefaultOptions are those of the default config
+func DefaultOptions() Options {
+	return OptionsFrom(config.Defaults().HTTP)
+}
+
+var (
+	mu     sync.RWMutex
+	shared = newTransport(DefaultOptions(), nil)
+	public = newPublicTransport(DefaultOptions())
+)
+
+// Configure replaces the shared transport, clients already handed out
+// switch to it on their next request
+func Configure(opts Options) {
+	t, p := newTransport(opts, nil), newPublicTransport(opts)
+
+	mu.Lock()
+	old, oldPublic := shared, public
+	shared, public = t, p
+	mu.Unlock()
+
+	old.CloseIdleConnections()
+	oldPublic.CloseIdleConnections()
+}
+
+// newTransport dials through control when it is not nil
+func newTransport(opts Options, control func(network, address string, c syscall.RawConn) error) *http.Transport {
+	t := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   opts.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+			Control:   control,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     opts.HTTP2,
+	}
+	if !opts.HTTP2 {
+		// a non-nil empty map is how net/http turns h2 off
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
 
 	// support ALL_PROXY env
 	if proxy := os.Getenv("ALL_PROXY"); proxy != "" {
 		if proxyURL, err := url.Parse(proxy); err == nil {
-			transport.Proxy = http.ProxyURL(proxyURL)
+			t.Proxy = http.ProxyURL(proxyURL)
 		}
 	}
+	return t
+}
+
+// sharedTransport resolves the shared transport per request so Configure
+// reaches clients created before it
+type sharedTransport struct{}
+
+func (sharedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	mu.RLock()
+	t := shared
+	mu.RUnlock()
+	return t.RoundTrip(req)
+}
 
+type Client struct {
+	http  *http.Client
+	retry RetryPolicy
+}
+
+// New returns a client with its own timeout, 0 for none, on the shared
+// connection pool. it is cheap, keep-alive survives across clients
+func New(timeout time.Duration) *Client {
 	return &Client{
 		http: &http.Client{
 			Timeout:   timeout,
-			Transport: transport,
+			Transport: sharedTransport{},
 		},
 	}
 }
 
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	return c.http.Do(req)
+	return c.withRetry(req, c.http.Do)
+}
+
+// ErrHeaderTimeout is returned when the response headers do not arrive in time
+var ErrHeaderTimeout = errors.New("timed out waiting for response headers")
+
+// DoWithHeaderTimeout bounds the wait for response headers only, the body
+// can stream for as long as it takes. d <= 0 waits forever
+func (c *Client) DoWithHeaderTimeout(req *http.Request, d time.Duration) (*http.Response, error) {
+	if d <= 0 {
+		return c.Do(req)
+	}
+	return c.withRetry(req, func(req *http.Request) (*http.Response, error) {
+		return c.doHeaderTimeout(req, d)
+	})
+}
+
+func (c *Client) doHeaderTimeout(req *http.Request, d time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(d, cancel)
+
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		// fired, possibly right after the headers made it
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("%w after %s", ErrHeaderTimeout, d)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the request context once the body is done
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
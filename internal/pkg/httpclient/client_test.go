@@ -0,0 +1,79 @@
+package httpclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, c *Client, url string) bool {
+	t.Helper()
+
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return reused
+}
+
+func TestConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name string
+		srv  func(http.Handler) *httptest.Server
+	}{
+		{"http", httptest.NewServer},
+		{"tls", httptest.NewTLSServer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := tt.srv(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			defer ts.Close()
+
+			opts := DefaultOptions()
+			Configure(opts)
+			// trust the test certificate on the shared transport, under the lock requests read it with
+			mu.Lock()
+			shared.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+			mu.Unlock()
+
+			assert.False(t, get(t, New(0), ts.URL), "first request dials")
+			assert.True(t, get(t, New(0), ts.URL), "second request reuses the connection")
+			// per-call timeouts do not split the pool
+			assert.True(t, get(t, New(5*time.Second), ts.URL))
+		})
+	}
+}
+
+func TestConfigureReachesExistingClients(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	c := New(0)
+	Configure(DefaultOptions())
+	get(t, c, ts.URL)
+	assert.True(t, get(t, c, ts.URL))
+
+	// a new transport starts a new pool, the old idle connections are closed
+	Configure(Options{MaxIdleConnsPerHost: 1, IdleConnTimeout: time.Minute, TLSHandshakeTimeout: time.Second})
+	assert.False(t, get(t, c, ts.URL))
+	assert.True(t, get(t, c, ts.URL))
+}
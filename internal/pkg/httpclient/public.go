@@ -0,0 +1,85 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrNotPublic refuses a connection to an address off the public internet
+var ErrNotPublic = errors.New("address is not public")
+
+// ranges that are not reachable on the internet but that netip does not
+// flag as private
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// NewPublic returns a client for urls that come from a client of mo. it only
+// connects to public addresses: the check runs on every dial, so a redirect
+// or a name that resolves to another address the second time is caught too.
+// it has a pool of its own and no proxy, a proxy would resolve the name out
+// of reach of the check
+func NewPublic(timeout time.Duration) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout:   timeout,
+			Transport: publicTransport{},
+		},
+	}
+}
+
+func newPublicTransport(opts Options) *http.Transport {
+	t := newTransport(opts, publicOnly)
+	t.Proxy = nil
+	return t
+}
+
+type publicTransport struct{}
+
+func (publicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	mu.RLock()
+	t := public
+	mu.RUnlock()
+	return t.RoundTrip(req)
+}
+
+// publicOnly runs before a dial, on the address the name resolved to
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublic(ip) {
+		return fmt.Errorf("%w: %s", ErrNotPublic, ip)
+	}
+	return nil
+}
+
+// isPublic says whether ip is a unicast address on the internet, not
+// loopback, link-local, private or reserved
+func isPublic(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range reserved {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+const (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// RetryPolicy retries requests that fail before a response body is read:
+// connection errors and 502/503/504. a returned response is never retried,
+// so a stream that has begun is left alone
+type RetryPolicy struct {
+	// tries in total, <= 1 disables retries
+	MaxAttempts int
+	// time all tries together may take, 0 for no limit
+	Budget time.Duration
+}
+
+// WithRetry returns a copy of c that retries under p
+func (c *Client) WithRetry(p RetryPolicy) *Client {
+	cp := *c
+	cp.retry = p
+	return &cp
+}
+
+func (c *Client) withRetry(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	p := c.retry
+	if p.MaxAttempts <= 1 {
+		return send(req)
+	}
+
+	// every try needs the body again
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("buffer body: %w", err)
+		}
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		resp, err := send(req)
+		if attempt >= p.MaxAttempts || !retryable(resp, err) {
+			return resp, err
+		}
+
+		delay := backoff(attempt)
+		if p.Budget > 0 && time.Since(start)+delay > p.Budget {
+			return resp, err
+		}
+
+		l := logger.Warn().Str("url", req.URL.Redacted()).Int("attempt", attempt).Dur("backoff", delay)
+		if resp != nil {
+			l = l.Int("status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		} else {
+			l = l.Err(err)
+		}
+		l.Msg("upstream request failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("rewind body: %w", err)
+			}
+			next.Body = body
+		}
+		req = next
+	}
+}
+
+// retryable is true for failures that say nothing about the request itself
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// timeouts already waited long enough, cancellation is the caller's
+		if errors.Is(err, ErrHeaderTimeout) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		var timeout interface{ Timeout() bool }
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			return false
+		}
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff is exponential with full jitter, attempt counts from 1
+func backoff(attempt int) time.Duration {
+	d := min(retryBaseDelay<<min(attempt-1, 8), retryMaxDelay)
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
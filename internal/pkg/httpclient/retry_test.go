@@ -0,0 +1,126 @@
+package httpclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flaky fails the first n requests the way fail says, then echoes the body
+func flaky(t *testing.T, n int32, fail func(w http.ResponseWriter)) (*httptest.Server, *atomic.Int32, *[]string) {
+	t.Helper()
+
+	var hits atomic.Int32
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if hits.Add(1) <= n {
+			fail(w)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &hits, &bodies
+}
+
+func status(code int) func(http.ResponseWriter) {
+	return func(w http.ResponseWriter) { w.WriteHeader(code) }
+}
+
+// dropConn closes the connection without an answer, like a reset
+func dropConn(w http.ResponseWriter) {
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	conn.Close()
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Budget: 10 * time.Second}
+
+	tests := []struct {
+		name       string
+		failures   int32
+		fail       func(http.ResponseWriter)
+		policy     RetryPolicy
+		wantStatus int
+		wantHits   int32
+	}{
+		{"502 then ok", 2, status(http.StatusBadGateway), policy, http.StatusOK, 3},
+		{"503 then ok", 1, status(http.StatusServiceUnavailable), policy, http.StatusOK, 2},
+		{"dropped connection then ok", 1, dropConn, policy, http.StatusOK, 2},
+		{"attempts exhausted", 5, status(http.StatusGatewayTimeout), policy, http.StatusGatewayTimeout, 3},
+		{"500 is not retried", 1, status(http.StatusInternalServerError), policy, http.StatusInternalServerError, 1},
+		{"429 is not retried", 1, status(http.StatusTooManyRequests), policy, http.StatusTooManyRequests, 1},
+		{"disabled", 1, status(http.StatusBadGateway), RetryPolicy{MaxAttempts: 1}, http.StatusBadGateway, 1},
+		{"budget spent", 5, status(http.StatusBadGateway), RetryPolicy{MaxAttempts: 5, Budget: time.Nanosecond}, http.StatusBadGateway, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, hits, bodies := flaky(t, tt.failures, tt.fail)
+
+			// a plain reader has no GetBody, the body is buffered for the retries
+			req, err := http.NewRequest("POST", ts.URL, io.NopCloser(strings.NewReader(`{"q":"hi"}`)))
+			require.NoError(t, err)
+			require.Nil(t, req.GetBody)
+
+			resp, err := New(5 * time.Second).WithRetry(tt.policy).Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantHits, hits.Load())
+			for _, b := range *bodies {
+				assert.Equal(t, `{"q":"hi"}`, b, "every attempt carries the full body")
+			}
+			if tt.wantStatus == http.StatusOK {
+				got, _ := io.ReadAll(resp.Body)
+				assert.Equal(t, `{"q":"hi"}`, string(got))
+			}
+		})
+	}
+}
+
+func TestRetryHeaderTimeoutIsFinal(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err := New(0).WithRetry(RetryPolicy{MaxAttempts: 3}).DoWithHeaderTimeout(req, 20*time.Millisecond)
+	assert.ErrorIs(t, err, ErrHeaderTimeout)
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestRetryNeverAfterStreamStarted(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		// the connection dies mid-stream
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := New(0).WithRetry(RetryPolicy{MaxAttempts: 3}).Do(req)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), hits.Load())
+}
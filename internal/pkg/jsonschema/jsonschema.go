@@ -0,0 +1,290 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validate checks v (as decoded by encoding/json) against the json schema
+// subset openai structured outputs use and returns the first violation
+func Validate(schema map[string]any, v any) error {
+	return validate(schema, schema, v, "$")
+}
+
+func validate(root, schema map[string]any, v any, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := resolveRef(root, ref)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return validate(root, target, v, path)
+	}
+
+	if t, ok := schema["type"]; ok {
+		if !matchesType(t, v) {
+			return fmt.Errorf("%s: expected %v, got %s", path, t, typeName(v))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !contains(enum, v) {
+		return fmt.Errorf("%s: value not in enum", path)
+	}
+	if c, ok := schema["const"]; ok && !equal(c, v) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		if err := validateObject(root, schema, val, path); err != nil {
+			return err
+		}
+	case []any:
+		if err := validateArray(root, schema, val, path); err != nil {
+			return err
+		}
+	case string:
+		if err := validateString(schema, val, path); err != nil {
+			return err
+		}
+	case float64:
+		if err := validateNumber(schema, val, path); err != nil {
+			return err
+		}
+	}
+
+	return validateCombinators(root, schema, v, path)
+}
+
+func validateObject(root, schema map[string]any, obj map[string]any, path string) error {
+	props, _ := schema["properties"].(map[string]any)
+
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		child := path + "." + k
+		if ps, ok := props[k].(map[string]any); ok {
+			if err := validate(root, ps, obj[k], child); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return fmt.Errorf("%s: additional property not allowed", child)
+			}
+		case map[string]any:
+			if err := validate(root, extra, obj[k], child); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateArray(root, schema map[string]any, arr []any, path string) error {
+	if n, ok := number(schema["minItems"]); ok && float64(len(arr)) < n {
+		return fmt.Errorf("%s: expected at least %v items", path, n)
+	}
+	if n, ok := number(schema["maxItems"]); ok && float64(len(arr)) > n {
+		return fmt.Errorf("%s: expected at most %v items", path, n)
+	}
+
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range arr {
+			if err := validate(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]any, s string, path string) error {
+	length := float64(len([]rune(s)))
+	if n, ok := number(schema["minLength"]); ok && length < n {
+		return fmt.Errorf("%s: shorter than %v characters", path, n)
+	}
+	if n, ok := number(schema["maxLength"]); ok && length > n {
+		return fmt.Errorf("%s: longer than %v characters", path, n)
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern in schema: %w", path, err)
+		}
+		if !re.MatchString(s) {
+			return fmt.Errorf("%s: does not match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]any, f float64, path string) error {
+	if n, ok := number(schema["minimum"]); ok && f < n {
+		return fmt.Errorf("%s: less than minimum %v", path, n)
+	}
+	if n, ok := number(schema["maximum"]); ok && f > n {
+		return fmt.Errorf("%s: greater than maximum %v", path, n)
+	}
+	if n, ok := number(schema["exclusiveMinimum"]); ok && f <= n {
+		return fmt.Errorf("%s: not greater than %v", path, n)
+	}
+	if n, ok := number(schema["exclusiveMaximum"]); ok && f >= n {
+		return fmt.Errorf("%s: not less than %v", path, n)
+	}
+	return nil
+}
+
+func validateCombinators(root, schema map[string]any, v any, path string) error {
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, s := range all {
+			sub, _ := s.(map[string]any)
+			if err := validate(root, sub, v, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		if matching(root, anyOf, v, path) == 0 {
+			return fmt.Errorf("%s: matches none of anyOf", path)
+		}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		if n := matching(root, oneOf, v, path); n != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf, expected exactly 1", path, n)
+		}
+	}
+	return nil
+}
+
+func matching(root map[string]any, schemas []any, v any, path string) int {
+	n := 0
+	for _, s := range schemas {
+		sub, _ := s.(map[string]any)
+		if validate(root, sub, v, path) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// resolveRef supports local refs such as #/$defs/item
+func resolveRef(root map[string]any, ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+
+	node := root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		next, ok := node[part].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = next
+	}
+	return node, nil
+}
+
+func matchesType(t any, v any) bool {
+	switch tt := t.(type) {
+	case string:
+		return isType(tt, v)
+	case []any:
+		for _, x := range tt {
+			if s, ok := x.(string); ok && isType(s, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isType(t string, v any) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func contains(list []any, v any) bool {
+	for _, x := range list {
+		if equal(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b any) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,82 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const personSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+		"address": {"$ref": "#/$defs/address"},
+		"nickname": {"type": ["string", "null"]}
+	},
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"$defs": {
+		"address": {
+			"type": "object",
+			"properties": {"zip": {"type": "string", "pattern": "^[0-9]{5}$"}},
+			"required": ["zip"]
+		}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal([]byte(personSchema), &schema))
+
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{"valid", `{"name":"ann","age":30,"role":"admin","tags":["a"],"address":{"zip":"12345"},"nickname":null}`, ""},
+		{"missing required", `{"name":"ann"}`, `$: missing required property "age"`},
+		{"wrong type", `{"name":"ann","age":"30"}`, "$.age: expected integer, got string"},
+		{"not an integer", `{"name":"ann","age":1.5}`, "$.age: expected integer, got number"},
+		{"below minimum", `{"name":"ann","age":-1}`, "$.age: less than minimum 0"},
+		{"empty string", `{"name":"","age":1}`, "$.name: shorter than 1 characters"},
+		{"enum", `{"name":"ann","age":1,"role":"root"}`, "$.role: value not in enum"},
+		{"too many items", `{"name":"ann","age":1,"tags":["a","b","c"]}`, "$.tags: expected at most 2 items"},
+		{"item type", `{"name":"ann","age":1,"tags":[1]}`, "$.tags[0]: expected string, got number"},
+		{"additional property", `{"name":"ann","age":1,"extra":true}`, "$.extra: additional property not allowed"},
+		{"ref pattern", `{"name":"ann","age":1,"address":{"zip":"abc"}}`, `$.address.zip: does not match pattern "^[0-9]{5}$"`},
+		{"type union", `{"name":"ann","age":1,"nickname":5}`, "$.nickname: expected [string null], got number"},
+		{"root type", `[1]`, "$: expected object, got array"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc any
+			require.NoError(t, json.Unmarshal([]byte(tt.doc), &doc))
+
+			err := Validate(schema, doc)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tt.wantErr, err.Error())
+		})
+	}
+}
+
+func TestValidateCombinators(t *testing.T) {
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"anyOf": [{"type": "string"}, {"type": "number"}],
+		"oneOf": [{"type": "number"}, {"type": "integer"}]
+	}`), &schema))
+
+	assert.NoError(t, Validate(schema, 1.5))
+	assert.EqualError(t, Validate(schema, 2.0), "$: matches 2 of oneOf, expected exactly 1")
+	assert.EqualError(t, Validate(schema, true), "$: matches none of anyOf")
+}
@@ -0,0 +1,76 @@
+// Package jwt reads the claims of z.ai tokens, signatures are left to z.ai
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Normalize strips what copying a token tends to bring along: surrounding
+// whitespace and newlines, quotes and a Bearer prefix, in any nesting
+func Normalize(raw string) string {
+	token := raw
+	for {
+		prev := token
+		token = strings.TrimSpace(token)
+		for _, q := range []string{`"`, `'`, "`"} {
+			if len(token) >= 2 && strings.HasPrefix(token, q) && strings.HasSuffix(token, q) {
+				token = token[1 : len(token)-1]
+			}
+		}
+		if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+			token = token[7:]
+		}
+		if token == prev {
+			return token
+		}
+	}
+}
+
+// Expiry checks that token is a jwt, three base64url segments of which the
+// first two are json, and returns its exp claim. a token without one
+// returns the zero time
+func Expiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("not a jwt: %d dot separated segments, want 3", len(parts))
+	}
+
+	var header map[string]any
+	if err := decode(parts[0], &header); err != nil {
+		return time.Time{}, fmt.Errorf("not a jwt: header %w", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := decode(parts[1], &claims); err != nil {
+		return time.Time{}, fmt.Errorf("not a jwt: payload %w", err)
+	}
+	if parts[2] == "" {
+		return time.Time{}, errors.New("not a jwt: empty signature")
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "=")); err != nil {
+		return time.Time{}, errors.New("not a jwt: signature is not base64url")
+	}
+
+	if claims.Exp == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// decode reads a base64url json segment, padded or not
+func decode(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return errors.New("is not base64url")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("is not a json object")
+	}
+	return nil
+}
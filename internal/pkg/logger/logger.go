@@ -1,24 +1,101 @@
 package logger
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func Init(debug bool) {
+// Options configures the loggers, the zero value logs info and up to the
+// console
+type Options struct {
+	// trace, debug, info, warn or error, info when empty
+	Level string
+	// module -> level, overrides Level for the module, e.g. zlm: debug
+	Modules map[string]string
+	// console for people, json for log shippers
+	Format string
+	// raw upstream chunks go to this file only. without one they are logged
+	// by their module at trace level
+	RawFile string
+	// stderr when nil
+	Out io.Writer
+}
+
+var (
+	mu      sync.RWMutex
+	base    = log.Logger
+	level   = zerolog.InfoLevel
+	modules = map[string]zerolog.Level{}
+	rawOut  io.WriteCloser
+)
+
+// Init sets up every logger. it may run again, e.g. in tests
+func Init(opts Options) error {
+	lvl, err := parseLevel(opts.Level, zerolog.InfoLevel)
+	if err != nil {
+		return err
+	}
+	mods := make(map[string]zerolog.Level, len(opts.Modules))
+	for name, l := range opts.Modules {
+		if mods[strings.ToLower(name)], err = parseLevel(l, lvl); err != nil {
+			return fmt.Errorf("module %s: %w", name, err)
+		}
+	}
+
+	out := opts.Out
+	if out == nil {
+		out = os.Stderr
+	}
+	switch opts.Format {
+	case "", "console":
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339, NoColor: opts.Out != nil}
+	case "json":
+	default:
+		return fmt.Errorf("unknown log format %q, want console or json", opts.Format)
+	}
+
+	var rawFile io.WriteCloser
+	if opts.RawFile != "" {
+		if rawFile, err = os.OpenFile(opts.RawFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return fmt.Errorf("open raw log: %w", err)
+		}
+	}
+
 	zerolog.TimeFieldFormat = time.RFC3339
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	// loggers filter on their own level, the global one must let all through
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 
-	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	mu.Lock()
+	defer mu.Unlock()
+	if rawOut != nil {
+		rawOut.Close()
 	}
+	base = zerolog.New(out).With().Timestamp().Logger()
+	level, modules, rawOut = lvl, mods, rawFile
+	log.Logger = base.Level(level)
+	return nil
 }
 
+func parseLevel(s string, def zerolog.Level) (zerolog.Level, error) {
+	if s == "" {
+		return def, nil
+	}
+	l, err := zerolog.ParseLevel(strings.ToLower(s))
+	if err != nil || l == zerolog.NoLevel {
+		return def, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
+// these log without request context at the default level
 var (
 	Info  = log.Info
 	Debug = log.Debug
@@ -26,3 +103,74 @@ var (
 	Error = log.Error
 	Fatal = log.Fatal
 )
+
+type ctxKey struct{}
+
+// WithContext returns ctx carrying a request logger with fields, later
+// calls add to the fields already there
+func WithContext(ctx context.Context, fields map[string]string) context.Context {
+	c := loggerFrom(ctx).With()
+	for k, v := range fields {
+		c = c.Str(k, v)
+	}
+	l := c.Logger()
+	return context.WithValue(ctx, ctxKey{}, &l)
+}
+
+// FromContext is the request logger of ctx at the default level, a plain
+// one outside a request
+func FromContext(ctx context.Context) *zerolog.Logger {
+	mu.RLock()
+	lvl := level
+	mu.RUnlock()
+
+	l := loggerFrom(ctx).Level(lvl)
+	return &l
+}
+
+func loggerFrom(ctx context.Context) zerolog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*zerolog.Logger); ok {
+		return *l
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	return base
+}
+
+// Module logs for one package at the level set for it
+type Module string
+
+func (m Module) level() zerolog.Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l, ok := modules[string(m)]; ok {
+		return l
+	}
+	return level
+}
+
+// Ctx is the request logger of ctx tagged with the module
+func (m Module) Ctx(ctx context.Context) *zerolog.Logger {
+	l := loggerFrom(ctx).Level(m.level()).With().Str("module", string(m)).Logger()
+	return &l
+}
+
+func (m Module) Trace() *zerolog.Event { return m.Ctx(context.Background()).Trace() }
+func (m Module) Debug() *zerolog.Event { return m.Ctx(context.Background()).Debug() }
+func (m Module) Info() *zerolog.Event  { return m.Ctx(context.Background()).Info() }
+func (m Module) Warn() *zerolog.Event  { return m.Ctx(context.Background()).Warn() }
+func (m Module) Error() *zerolog.Event { return m.Ctx(context.Background()).Error() }
+
+// Raw logs an upstream payload, to the raw file when there is one and
+// otherwise at trace level of the module
+func (m Module) Raw(ctx context.Context) *zerolog.Event {
+	mu.RLock()
+	out := rawOut
+	mu.RUnlock()
+
+	if out == nil {
+		return m.Ctx(ctx).Trace()
+	}
+	l := loggerFrom(ctx).Output(out).Level(zerolog.TraceLevel).With().Str("module", string(m)).Logger()
+	return l.Trace()
+}
@@ -0,0 +1,114 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capture sends json logs to a buffer until the test ends
+func capture(t *testing.T, opts Options) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	opts.Out, opts.Format = &buf, "json"
+	require.NoError(t, Init(opts))
+	t.Cleanup(func() { Init(Options{}) })
+	return &buf
+}
+
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &m), line)
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestContextFields(t *testing.T) {
+	buf := capture(t, Options{})
+
+	ctx := WithContext(context.Background(), map[string]string{"request_id": "host/abc-000001"})
+	ctx = WithContext(ctx, map[string]string{"model": "glm-4.6", "provider": "zlm"})
+	FromContext(ctx).Info().Msg("chat request")
+	Module("zlm").Ctx(ctx).Warn().Msg("stalled")
+	Info().Msg("no request")
+
+	logged := lines(t, buf)
+	require.Len(t, logged, 3)
+	assert.Equal(t, "host/abc-000001", logged[0]["request_id"])
+	assert.Equal(t, "glm-4.6", logged[0]["model"])
+	assert.Equal(t, "zlm", logged[0]["provider"])
+	assert.NotContains(t, logged[0], "module")
+
+	assert.Equal(t, "zlm", logged[1]["module"])
+	assert.Equal(t, "host/abc-000001", logged[1]["request_id"], "modules keep the request fields")
+
+	assert.NotContains(t, logged[2], "request_id")
+	assert.Equal(t, "no request", logged[2]["message"])
+}
+
+func TestModuleLevels(t *testing.T) {
+	buf := capture(t, Options{Level: "info", Modules: map[string]string{"ZLM": "debug"}})
+
+	Module("zlm").Debug().Msg("zlm detail")
+	Module("qwen").Debug().Msg("qwen detail")
+	Debug().Msg("plain detail")
+	FromContext(context.Background()).Debug().Msg("request detail")
+	Module("qwen").Info().Msg("qwen info")
+
+	logged := lines(t, buf)
+	require.Len(t, logged, 2)
+	assert.Equal(t, "zlm detail", logged[0]["message"])
+	assert.Equal(t, "qwen info", logged[1]["message"])
+}
+
+func TestRawFile(t *testing.T) {
+	// without a file raw chunks are trace lines of the module
+	buf := capture(t, Options{Modules: map[string]string{"zlm": "trace"}})
+	ctx := WithContext(context.Background(), map[string]string{"request_id": "r1"})
+	Module("zlm").Raw(ctx).Str("data", "chunk-1").Msg("z.ai sse")
+	Module("qwen").Raw(ctx).Str("data", "chunk-2").Msg("qwen sse")
+	logged := lines(t, buf)
+	require.Len(t, logged, 1)
+	assert.Equal(t, "chunk-1", logged[0]["data"])
+
+	path := filepath.Join(t.TempDir(), "raw.log")
+	buf = capture(t, Options{RawFile: path})
+	ctx = WithContext(context.Background(), map[string]string{"request_id": "r1"})
+	Module("zlm").Raw(ctx).Str("data", "chunk-3").Msg("z.ai sse")
+	assert.Empty(t, buf.String(), "raw chunks stay out of the main log")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(data, &m))
+	assert.Equal(t, "chunk-3", m["data"])
+	assert.Equal(t, "zlm", m["module"])
+	assert.Equal(t, "r1", m["request_id"])
+}
+
+func TestInitErrors(t *testing.T) {
+	assert.Error(t, Init(Options{Level: "loud"}))
+	assert.Error(t, Init(Options{Modules: map[string]string{"zlm": "loud"}}))
+	assert.Error(t, Init(Options{Format: "xml"}))
+
+	var buf bytes.Buffer
+	require.NoError(t, Init(Options{Out: &buf}))
+	t.Cleanup(func() { Init(Options{}) })
+	Info().Str("model", "glm").Msg("hello")
+	assert.Contains(t, buf.String(), "hello")
+	assert.Contains(t, buf.String(), "model=glm", "console output by default")
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import "sync"
+
+// Registry holds labeled counters, e.g. counters["reasoning_only_completions"]["GLM-4-6-API-V1"],
+// and gauges, which are read when asked for
+type Registry struct {
+	mu       sync.RWMutex
+	counters map[string]map[string]int64
+	gauges   map[string]func() int64
+}
+
+var defaultRegistry = New()
+
+func New() *Registry {
+	return &Registry{counters: make(map[string]map[string]int64), gauges: make(map[string]func() int64)}
+}
+
+func (r *Registry) Add(name, label string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byLabel, ok := r.counters[name]
+	if !ok {
+		byLabel = make(map[string]int64)
+		r.counters[name] = byLabel
+	}
+	byLabel[label] += delta
+}
+
+func (r *Registry) Get(name, label string) int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.counters[name][label]
+}
+
+// Snapshot returns a copy safe to serialize
+func (r *Registry) Snapshot() map[string]map[string]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make(map[string]map[string]int64, len(r.counters))
+	for name, byLabel := range r.counters {
+		cp := make(map[string]int64, len(byLabel))
+		for label, v := range byLabel {
+			cp[label] = v
+		}
+		out[name] = cp
+	}
+	return out
+}
+
+// Gauge registers read as the current value of name, replacing an earlier one
+func (r *Registry) Gauge(name string, read func() int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = read
+}
+
+// Gauges reads every gauge
+func (r *Registry) Gauges() map[string]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := make(map[string]int64, len(r.gauges))
+	for name, read := range r.gauges {
+		out[name] = read()
+	}
+	return out
+}
+
+func Inc(name, label string) {
+	defaultRegistry.Add(name, label, 1)
+}
+
+func Add(name, label string, delta int64) {
+	defaultRegistry.Add(name, label, delta)
+}
+
+func Get(name, label string) int64 {
+	return defaultRegistry.Get(name, label)
+}
+
+func Snapshot() map[string]map[string]int64 {
+	return defaultRegistry.Snapshot()
+}
+
+func Gauge(name string, read func() int64) {
+	defaultRegistry.Gauge(name, read)
+}
+
+func Gauges() map[string]int64 {
+	return defaultRegistry.Gauges()
+}
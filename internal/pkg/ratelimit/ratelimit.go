@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket holds up to a minute of budget and refills continuously. charges
+// made after the fact may take it below zero, the debt is paid off by the
+// refill before anything is allowed again
+type Bucket struct {
+	mu       sync.Mutex
+	limit    int
+	capacity float64
+	// refill per second
+	rate  float64
+	level float64
+	last  time.Time
+	now   func() time.Time
+}
+
+func newBucket(perMinute int, now func() time.Time) *Bucket {
+	return &Bucket{
+		capacity: float64(perMinute),
+		rate:     float64(perMinute) / 60,
+		level:    float64(perMinute),
+		last:     now(),
+		now:      now,
+		limit:    perMinute,
+	}
+}
+
+func (b *Bucket) refill() {
+	now := b.now()
+	b.level = math.Min(b.capacity, b.level+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Take spends n if the bucket holds it, otherwise it returns how long
+// until it will
+func (b *Bucket) Take(n int) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.level >= float64(n) {
+		b.level -= float64(n)
+		return true, 0
+	}
+	return false, b.wait(float64(n))
+}
+
+// Ready reports whether the bucket is out of debt, n is not spent
+func (b *Bucket) Ready(n int) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.level >= float64(n) {
+		return true, 0
+	}
+	return false, b.wait(float64(n))
+}
+
+// Charge spends n whether the bucket holds it or not
+func (b *Bucket) Charge(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.level -= float64(n)
+}
+
+// Remaining is what could be spent right now, 0 while in debt
+func (b *Bucket) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return max(0, int(b.level))
+}
+
+// Limit is the budget per minute the bucket was made with
+func (b *Bucket) Limit() int {
+	return b.limit
+}
+
+func (b *Bucket) wait(n float64) time.Duration {
+	return time.Duration(math.Ceil((n - b.level) / b.rate * float64(time.Second)))
+}
+
+// Client is the pair of buckets of one client, a nil bucket is unlimited
+type Client struct {
+	Requests *Bucket
+	Tokens   *Bucket
+
+	rpm, tpm int
+	seen     time.Time
+}
+
+// Limiter keeps the buckets of every client it has seen recently
+type Limiter struct {
+	mu      sync.Mutex
+	clients map[string]*Client
+	now     func() time.Time
+	pruned  time.Time
+}
+
+func New() *Limiter {
+	return NewWithClock(time.Now)
+}
+
+// NewWithClock takes the time from now, for tests
+func NewWithClock(now func() time.Time) *Limiter {
+	return &Limiter{clients: make(map[string]*Client), now: now, pruned: now()}
+}
+
+// Client returns the buckets of key, made afresh when the budgets changed
+// since the last call
+func (l *Limiter) Client(key string, rpm, tpm int) *Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	c, ok := l.clients[key]
+	if !ok || c.rpm != rpm || c.tpm != tpm {
+		c = &Client{rpm: rpm, tpm: tpm}
+		if rpm > 0 {
+			c.Requests = newBucket(rpm, l.now)
+		}
+		if tpm > 0 {
+			c.Tokens = newBucket(tpm, l.now)
+		}
+		l.clients[key] = c
+	}
+	c.seen = now
+	return c
+}
+
+// prune forgets clients quiet for long enough that their buckets are full
+// again, at most once a minute
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, c := range l.clients {
+		if now.Sub(c.seen) > 2*time.Minute && c.full() {
+			delete(l.clients, key)
+		}
+	}
+}
+
+func (c *Client) full() bool {
+	for _, b := range []*Bucket{c.Requests, c.Tokens} {
+		if b != nil && b.Remaining() < b.Limit() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a time that only moves when told to
+type clock struct{ t time.Time }
+
+func newClock() *clock {
+	return &clock{t: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) now() time.Time      { return c.t }
+func (c *clock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestBucketBurst(t *testing.T) {
+	c := newClock()
+	b := newBucket(60, c.now)
+
+	for i := range 60 {
+		ok, _ := b.Take(1)
+		assert.True(t, ok, "request of the burst", i)
+	}
+	ok, wait := b.Take(1)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait, "one request a second refills")
+	assert.Equal(t, 0, b.Remaining())
+}
+
+func TestBucketRefill(t *testing.T) {
+	c := newClock()
+	b := newBucket(120, c.now)
+	b.Take(120)
+
+	c.add(250 * time.Millisecond)
+	assert.Equal(t, 0, b.Remaining(), "half a request is not one")
+	c.add(250 * time.Millisecond)
+	assert.Equal(t, 1, b.Remaining())
+
+	ok, wait := b.Take(3)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	c.add(time.Hour)
+	assert.Equal(t, 120, b.Remaining(), "never more than a minute of budget")
+}
+
+func TestBucketDebt(t *testing.T) {
+	c := newClock()
+	b := newBucket(600, c.now)
+
+	b.Charge(900)
+	ok, wait := b.Ready(1)
+	assert.False(t, ok)
+	assert.Equal(t, 30100*time.Millisecond, wait, "300 tokens of debt plus one at 10 a second")
+	assert.Equal(t, 0, b.Remaining())
+
+	c.add(wait)
+	ok, _ = b.Ready(1)
+	assert.True(t, ok)
+	assert.Equal(t, 1, b.Remaining(), "ready does not spend")
+
+	var unlimited *Bucket
+	ok, _ = unlimited.Take(1000)
+	assert.True(t, ok)
+	unlimited.Charge(1000)
+}
+
+func TestLimiterClients(t *testing.T) {
+	c := newClock()
+	l := NewWithClock(c.now)
+
+	a := l.Client("key:a", 1, 0)
+	assert.Nil(t, a.Tokens)
+	ok, _ := a.Requests.Take(1)
+	assert.True(t, ok)
+
+	ok, _ = l.Client("key:a", 1, 0).Requests.Take(1)
+	assert.False(t, ok, "same client, same bucket")
+	ok, _ = l.Client("key:b", 1, 0).Requests.Take(1)
+	assert.True(t, ok, "clients do not share budgets")
+
+	ok, _ = l.Client("key:a", 2, 0).Requests.Take(1)
+	assert.True(t, ok, "a changed budget starts a fresh bucket")
+
+	c.add(3 * time.Minute)
+	l.Client("key:c", 1, 0)
+	l.mu.Lock()
+	assert.Len(t, l.clients, 1, "idle clients with full buckets are forgotten")
+	l.mu.Unlock()
+}
@@ -0,0 +1,135 @@
+// Package sse reads server-sent event streams as the html spec frames them:
+// lines end in CR, LF or CRLF, data lines up to a blank line make one event
+// and are joined with LF, lines starting with a colon are comments
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// MaxLine bounds one line, a giant delta is fine, an endless line is not
+const MaxLine = 64 << 20
+
+// ErrLineTooLong ends a stream with a line longer than MaxLine
+var ErrLineTooLong = errors.New("sse: line too long")
+
+// Event is one dispatched event
+type Event struct {
+	// Name is the event field, "" for the default message
+	Name string
+	Data string
+	// ID is the last id field seen, it carries over to later events
+	ID string
+}
+
+type Reader struct {
+	r *bufio.Reader
+	// the last line ended in CR, a LF right after it belongs to it
+	skipLF  bool
+	started bool
+	lastID  string
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next event with data, io.EOF after the last. events
+// without data, such as a lone event or id line, are not dispatched. unlike
+// the spec an event cut off by the end of the stream is still returned, an
+// upstream that closes without the final blank line loses nothing
+func (r *Reader) Next() (Event, error) {
+	var (
+		name    string
+		data    strings.Builder
+		hasData bool
+	)
+	for {
+		line, err := r.line()
+		if err != nil && err != io.EOF {
+			return Event{}, err
+		}
+		eof := err == io.EOF
+
+		if line == "" && !eof {
+			if hasData {
+				return Event{Name: name, Data: data.String(), ID: r.lastID}, nil
+			}
+			name = ""
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch {
+		case line == "" || strings.HasPrefix(line, ":"):
+			// blank at the end or a comment such as ": ping"
+		case field == "event":
+			name = value
+		case field == "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case field == "id":
+			if !strings.ContainsRune(value, 0) {
+				r.lastID = value
+			}
+		}
+		// retry and unknown fields mean nothing to a reader that never
+		// reconnects
+
+		if eof {
+			if hasData {
+				return Event{Name: name, Data: data.String(), ID: r.lastID}, nil
+			}
+			return Event{}, io.EOF
+		}
+	}
+}
+
+// line reads up to the next CR, LF or CRLF. the last line of a stream may
+// come without one, it is returned along with io.EOF
+func (r *Reader) line() (string, error) {
+	if r.skipLF {
+		r.skipLF = false
+		if next, err := r.r.Peek(1); err == nil && next[0] == '\n' {
+			r.r.Discard(1)
+		}
+	}
+
+	var line []byte
+	for {
+		if r.r.Buffered() == 0 {
+			if _, err := r.r.Peek(1); err != nil {
+				return r.text(line), err
+			}
+		}
+		buf, _ := r.r.Peek(r.r.Buffered())
+		if i := bytes.IndexAny(buf, "\r\n"); i >= 0 {
+			line = append(line, buf[:i]...)
+			r.skipLF = buf[i] == '\r'
+			r.r.Discard(i + 1)
+			return r.text(line), nil
+		}
+		if len(line)+len(buf) > MaxLine {
+			return "", ErrLineTooLong
+		}
+		line = append(line, buf...)
+		r.r.Discard(len(buf))
+	}
+}
+
+// text drops the byte order mark a stream may start with
+func (r *Reader) text(line []byte) string {
+	if !r.started {
+		r.started = true
+		line = bytes.TrimPrefix(line, []byte("\ufeff"))
+	}
+	return string(line)
+}
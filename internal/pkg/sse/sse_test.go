@@ -0,0 +1,156 @@
+package sse
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(r io.Reader) ([]Event, error) {
+	sr := NewReader(r)
+	var evs []Event
+	for {
+		ev, err := sr.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return evs, err
+		}
+		evs = append(evs, ev)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []Event
+	}{
+		{
+			name:   "lf",
+			stream: "data: a\n\ndata: b\n\n",
+			want:   []Event{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "crlf",
+			stream: "data: a\r\n\r\ndata: b\r\n\r\n",
+			want:   []Event{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "cr alone",
+			stream: "data: a\r\rdata: b\r\r",
+			want:   []Event{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "mixed line endings",
+			stream: "data: a\r\n\ndata: b\r\r\ndata: c\n\r\n",
+			want:   []Event{{Data: "a"}, {Data: "b"}, {Data: "c"}},
+		},
+		{
+			name:   "multi-line data joins with lf",
+			stream: "data: {\"a\":\ndata:  1}\r\ndata\n\n",
+			want:   []Event{{Data: "{\"a\":\n 1}\n"}},
+		},
+		{
+			name:   "no space after the colon",
+			stream: "data:a\n\n",
+			want:   []Event{{Data: "a"}},
+		},
+		{
+			name:   "comments and unknown fields",
+			stream: ": ping\n\nretry: 3000\nfoo: bar\ndata: a\n: in between\n\n",
+			want:   []Event{{Data: "a"}},
+		},
+		{
+			name:   "event name",
+			stream: "event: error\ndata: {\"detail\":\"quota\"}\n\ndata: next\n\n",
+			want:   []Event{{Name: "error", Data: `{"detail":"quota"}`}, {Data: "next"}},
+		},
+		{
+			name:   "event without data is not dispatched",
+			stream: "event: ping\n\ndata: a\n\n",
+			want:   []Event{{Data: "a"}},
+		},
+		{
+			name:   "id carries over",
+			stream: "id: 7\ndata: a\n\ndata: b\n\nid\ndata: c\n\n",
+			want:   []Event{{ID: "7", Data: "a"}, {ID: "7", Data: "b"}, {Data: "c"}},
+		},
+		{
+			name:   "byte order mark",
+			stream: "\ufeffdata: a\n\n",
+			want:   []Event{{Data: "a"}},
+		},
+		{
+			name:   "cut off without blank line",
+			stream: "data: a\n\ndata: b",
+			want:   []Event{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "cut off after the data line",
+			stream: "data: a\n",
+			want:   []Event{{Data: "a"}},
+		},
+		{
+			name:   "empty",
+			stream: "",
+		},
+		{
+			name:   "only blank lines",
+			stream: "\n\r\n\r",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evs, err := readAll(strings.NewReader(tt.stream))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, evs)
+
+			// a CR and its LF may arrive in different reads
+			evs, err = readAll(iotest.OneByteReader(strings.NewReader(tt.stream)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, evs, "read a byte at a time")
+		})
+	}
+}
+
+func TestReaderLongLines(t *testing.T) {
+	// well past bufio.Scanner's usual 1 MB token limit
+	delta := strings.Repeat("x", 3<<20)
+	evs, err := readAll(strings.NewReader("data: " + delta + "\n\ndata: after\n\n"))
+	require.NoError(t, err)
+	require.Len(t, evs, 2)
+	assert.Equal(t, delta, evs[0].Data)
+	assert.Equal(t, "after", evs[1].Data)
+
+	_, err = readAll(io.MultiReader(strings.NewReader("data: "), &endless{}))
+	assert.ErrorIs(t, err, ErrLineTooLong)
+}
+
+func TestReaderReadError(t *testing.T) {
+	broken := errors.New("connection reset")
+	r := NewReader(io.MultiReader(strings.NewReader("data: a\n\ndata: b"), iotest.ErrReader(broken)))
+
+	ev, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "a", ev.Data)
+
+	_, err = r.Next()
+	assert.ErrorIs(t, err, broken, "a broken stream is not an event cut short")
+}
+
+// endless is a line that never ends
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
@@ -0,0 +1,304 @@
+package tempmail
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IMAPConfig reaches a catch-all mailbox on a domain of one's own
+type IMAPConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// addresses are made up on this domain, all of them land in the mailbox
+	Domain string
+	// folder searched for mail, INBOX when empty
+	Mailbox string
+	// plain tcp, only for servers on localhost
+	Insecure bool
+}
+
+// IMAP is the backend for a catch-all domain. it speaks just enough imap4rev1
+// to log in, search a folder and fetch whole messages
+type IMAP struct {
+	cfg IMAPConfig
+}
+
+func NewIMAP(cfg IMAPConfig) *IMAP {
+	if cfg.Mailbox == "" {
+		cfg.Mailbox = "INBOX"
+	}
+	return &IMAP{cfg: cfg}
+}
+
+func (c *IMAP) Name() string { return "imap" }
+
+// CreateEmail makes up an address on the domain, logging in first so an
+// unreachable server fails over to the next provider
+func (c *IMAP) CreateEmail() (*Email, error) {
+	if c.cfg.Domain == "" {
+		return nil, errors.New("imap: no domain configured")
+	}
+	s, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	s.close()
+
+	local := strings.ReplaceAll(uuid.New().String(), "-", "")[:10]
+	return &Email{Address: local + "@" + c.cfg.Domain, Provider: c.Name()}, nil
+}
+
+func (c *IMAP) GetMessages(email string) ([]Message, error) {
+	s, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	if _, err := s.cmd("SELECT " + quote(c.cfg.Mailbox)); err != nil {
+		return nil, fmt.Errorf("select: %w", err)
+	}
+	found, err := s.cmd("UID SEARCH TO " + quote(email))
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+
+	var messages []Message
+	for _, r := range found {
+		uids, ok := strings.CutPrefix(r.line, "* SEARCH")
+		if !ok {
+			continue
+		}
+		for _, uid := range strings.Fields(uids) {
+			fetched, err := s.cmd("UID FETCH " + uid + " BODY.PEEK[]")
+			if err != nil {
+				return nil, fmt.Errorf("fetch %s: %w", uid, err)
+			}
+			for _, f := range fetched {
+				if len(f.literals) == 0 {
+					continue
+				}
+				m, err := parseMessage(f.literals[0])
+				if err != nil {
+					return nil, fmt.Errorf("parse %s: %w", uid, err)
+				}
+				m.ID = uid
+				m.To = email
+				messages = append(messages, *m)
+			}
+		}
+	}
+	return messages, nil
+}
+
+// WaitForMessage polls until a matching message arrives
+func (c *IMAP) WaitForMessage(email, fromMatch, subjectMatch string, timeout, interval time.Duration) (*Message, error) {
+	return waitForMessage(func() ([]Message, error) { return c.GetMessages(email) }, fromMatch, subjectMatch, timeout, interval)
+}
+
+// imapSession is one logged in connection
+type imapSession struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is an untagged response line with the literals it carried
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+func (c *IMAP) open() (*imapSession, error) {
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if c.cfg.Insecure {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: c.cfg.Host})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("imap dial: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	s := &imapSession{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := s.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("imap greeting: %q %v", strings.TrimSpace(greeting), err)
+	}
+	if _, err := s.cmd("LOGIN " + quote(c.cfg.User) + " " + quote(c.cfg.Password)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("imap login: %w", err)
+	}
+	return s, nil
+}
+
+func (s *imapSession) close() {
+	s.cmd("LOGOUT")
+	s.conn.Close()
+}
+
+// cmd sends a command and reads up to its tagged completion
+func (s *imapSession) cmd(command string) ([]imapResponse, error) {
+	s.tag++
+	tag := "a" + strconv.Itoa(s.tag)
+	if _, err := fmt.Fprintf(s.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, err
+	}
+
+	var out []imapResponse
+	for {
+		r, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		if status, ok := strings.CutPrefix(r.line, tag+" "); ok {
+			if !strings.HasPrefix(status, "OK") {
+				return nil, errors.New(status)
+			}
+			return out, nil
+		}
+		out = append(out, r)
+	}
+}
+
+// read takes one response, a line ending in {n} is followed by n bytes of
+// literal and then the rest of the line
+func (s *imapSession) read() (imapResponse, error) {
+	var r imapResponse
+	var line strings.Builder
+	for {
+		part, err := s.r.ReadString('\n')
+		if err != nil {
+			return r, err
+		}
+		part = strings.TrimRight(part, "\r\n")
+		line.WriteString(part)
+
+		open := strings.LastIndexByte(part, '{')
+		if open < 0 || !strings.HasSuffix(part, "}") {
+			r.line = line.String()
+			return r, nil
+		}
+		n, err := strconv.Atoi(part[open+1 : len(part)-1])
+		if err != nil {
+			r.line = line.String()
+			return r, nil
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(s.r, literal); err != nil {
+			return r, err
+		}
+		r.literals = append(r.literals, literal)
+	}
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// parseMessage reads a raw rfc 5322 message into its text and html bodies
+func parseMessage(raw []byte) (*Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{From: msg.Header.Get("From")}
+	if addr, err := mail.ParseAddress(m.From); err == nil {
+		m.From = addr.Address
+	}
+	dec := new(mime.WordDecoder)
+	if m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	m.CreatedAt, _ = msg.Header.Date()
+
+	err = readPart(m, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	return m, err
+}
+
+// readPart decodes a body into m, walking into multipart ones. the first
+// text/plain and text/html parts win
+func readPart(m *Message, contentType, encoding string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := parts.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := readPart(m, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, newlineStripper{body})
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case mediaType == "text/plain" && m.BodyText == "":
+		m.BodyText = string(data)
+	case mediaType == "text/html" && m.BodyHTML == "":
+		m.BodyHTML = string(data)
+	}
+	return nil
+}
+
+// newlineStripper drops the line breaks base64 bodies are wrapped with
+type newlineStripper struct{ r io.Reader }
+
+func (n newlineStripper) Read(p []byte) (int, error) {
+	for {
+		k, err := n.r.Read(p)
+		j := 0
+		for _, b := range p[:k] {
+			if b != '\r' && b != '\n' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package tempmail
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memIMAP serves a single folder from memory, enough imap for the client
+type memIMAP struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []string
+	logins   int
+}
+
+func newMemIMAP(t *testing.T) *memIMAP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &memIMAP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *memIMAP) config() IMAPConfig {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return IMAPConfig{Host: "127.0.0.1", Port: addr.Port, User: "me", Password: `p"w`, Domain: "example.org", Insecure: true}
+}
+
+func (s *memIMAP) deliver(raw string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, strings.ReplaceAll(raw, "\n", "\r\n"))
+}
+
+func (s *memIMAP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK memimap ready\r\n")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, cmd, _ := strings.Cut(strings.TrimSpace(line), " ")
+
+		s.mu.Lock()
+		switch {
+		case strings.HasPrefix(cmd, "LOGIN "):
+			if cmd != `LOGIN "me" "p\"w"` {
+				fmt.Fprintf(conn, "%s NO bad credentials\r\n", tag)
+				break
+			}
+			s.logins++
+			fmt.Fprintf(conn, "%s OK logged in\r\n", tag)
+		case strings.HasPrefix(cmd, "SELECT "):
+			fmt.Fprintf(conn, "* %d EXISTS\r\n%s OK [READ-WRITE] selected\r\n", len(s.messages), tag)
+		case strings.HasPrefix(cmd, "UID SEARCH TO "):
+			to := strings.Trim(strings.TrimPrefix(cmd, "UID SEARCH TO "), `"`)
+			var uids []string
+			for i, m := range s.messages {
+				if strings.Contains(m, "To: "+to) {
+					uids = append(uids, fmt.Sprint(i+1))
+				}
+			}
+			fmt.Fprintf(conn, "* SEARCH %s\r\n%s OK search done\r\n", strings.Join(uids, " "), tag)
+		case strings.HasPrefix(cmd, "UID FETCH "):
+			var uid int
+			fmt.Sscanf(cmd, "UID FETCH %d", &uid)
+			m := s.messages[uid-1]
+			fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n%s OK fetch done\r\n", uid, uid, len(m), m, tag)
+		case cmd == "LOGOUT":
+			fmt.Fprintf(conn, "* BYE\r\n%s OK bye\r\n", tag)
+			s.mu.Unlock()
+			return
+		default:
+			fmt.Fprintf(conn, "%s BAD unknown command\r\n", tag)
+		}
+		s.mu.Unlock()
+	}
+}
+
+const verifyMail = `From: "Z.ai" <noreply@z.ai>
+To: %s
+Subject: =?UTF-8?Q?Verify_your_email?=
+Date: Mon, 02 Mar 2026 10:00:00 +0000
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Please verify:
+
+https://chat.z.ai/auth/verify_email?token=3Dabc-123&email=3D%s&username=3D=
+x&language=3Den
+
+--b1
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PGEgaHJlZj0iaHR0cHM6Ly9jaGF0LnouYWkvIj52ZXJpZnk8L2E+
+--b1--
+`
+
+func TestIMAP(t *testing.T) {
+	srv := newMemIMAP(t)
+	c := NewIMAP(srv.config())
+
+	email, err := c.CreateEmail()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{10}@example\.org$`, email.Address)
+	assert.Equal(t, "imap", email.Provider)
+
+	srv.deliver(fmt.Sprintf(verifyMail, "someone-else@example.org", "someone-else@example.org"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		srv.deliver(fmt.Sprintf(verifyMail, email.Address, email.Address))
+	}()
+
+	msg, err := c.WaitForMessage(email.Address, "z.ai", "verify", time.Second, 5*time.Millisecond)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, "2", msg.ID)
+	assert.Equal(t, "noreply@z.ai", msg.From)
+	assert.Equal(t, "Verify your email", msg.Subject)
+	assert.Equal(t, 2026, msg.CreatedAt.Year())
+	assert.Equal(t, `<a href="https://chat.z.ai/">verify</a>`, msg.BodyHTML)
+	assert.Equal(t,
+		"https://chat.z.ai/auth/verify_email?token=abc-123&email="+email.Address+"&username=x&language=en",
+		ExtractVerifyLink(msg.BodyText))
+}
+
+func TestIMAPLoginFailsOver(t *testing.T) {
+	srv := newMemIMAP(t)
+	cfg := srv.config()
+	cfg.Password = "wrong"
+
+	var calls []string
+	f := NewFailover(NewIMAP(cfg), &fakeProvider{name: "mail.tm", calls: &calls})
+	email, err := f.CreateEmail()
+	require.NoError(t, err)
+	assert.Equal(t, "mail.tm", email.Provider)
+
+	_, err = NewIMAP(IMAPConfig{Host: "127.0.0.1", Port: cfg.Port, Insecure: true}).CreateEmail()
+	assert.ErrorContains(t, err, "no domain")
+}
@@ -0,0 +1,177 @@
+package tempmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zarazaex69/mo/internal/pkg/crypto"
+)
+
+const mailTMURL = "https://api.mail.tm"
+
+// MailTM is the mail.tm backend, each mailbox is an account whose bearer
+// token is kept to read it back
+type MailTM struct {
+	base string
+	http *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func NewMailTM() *MailTM {
+	return &MailTM{
+		base:   mailTMURL,
+		http:   &http.Client{Timeout: 30 * time.Second},
+		tokens: make(map[string]string),
+	}
+}
+
+func (c *MailTM) Name() string { return "mail.tm" }
+
+func (c *MailTM) CreateEmail() (*Email, error) {
+	var domains struct {
+		Members []struct {
+			Domain   string `json:"domain"`
+			IsActive bool   `json:"isActive"`
+		} `json:"hydra:member"`
+	}
+	if err := c.do("GET", "/domains", "", nil, &domains); err != nil {
+		return nil, fmt.Errorf("list domains: %w", err)
+	}
+	domain := ""
+	for _, d := range domains.Members {
+		if d.IsActive {
+			domain = d.Domain
+			break
+		}
+	}
+	if domain == "" {
+		return nil, errors.New("no active domain")
+	}
+
+	account := map[string]string{
+		"address":  strings.ReplaceAll(uuid.New().String(), "-", "")[:12] + "@" + domain,
+		"password": crypto.GeneratePassword(16),
+	}
+	if err := c.do("POST", "/accounts", "", account, nil); err != nil {
+		return nil, fmt.Errorf("create account: %w", err)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	if err := c.do("POST", "/token", "", account, &session); err != nil {
+		return nil, fmt.Errorf("get token: %w", err)
+	}
+
+	c.mu.Lock()
+	c.tokens[account["address"]] = session.Token
+	c.mu.Unlock()
+
+	return &Email{Address: account["address"], Token: session.Token, Provider: c.Name()}, nil
+}
+
+// mailTMMessage is a message as mail.tm lists it, the bodies only come
+// with the single message
+type mailTMMessage struct {
+	ID   string `json:"id"`
+	From struct {
+		Address string `json:"address"`
+	} `json:"from"`
+	To []struct {
+		Address string `json:"address"`
+	} `json:"to"`
+	Subject   string    `json:"subject"`
+	Text      string    `json:"text"`
+	HTML      []string  `json:"html"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (c *MailTM) GetMessages(email string) ([]Message, error) {
+	c.mu.Lock()
+	token, ok := c.tokens[email]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no mail.tm session for %s", email)
+	}
+
+	var list struct {
+		Members []mailTMMessage `json:"hydra:member"`
+	}
+	if err := c.do("GET", "/messages", token, nil, &list); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(list.Members))
+	for _, m := range list.Members {
+		var full mailTMMessage
+		if err := c.do("GET", "/messages/"+m.ID, token, nil, &full); err != nil {
+			return nil, err
+		}
+		messages = append(messages, Message{
+			ID:        full.ID,
+			From:      full.From.Address,
+			To:        email,
+			Subject:   full.Subject,
+			BodyText:  full.Text,
+			BodyHTML:  strings.Join(full.HTML, ""),
+			CreatedAt: full.CreatedAt,
+		})
+	}
+	return messages, nil
+}
+
+// WaitForMessage polls until a matching message arrives
+func (c *MailTM) WaitForMessage(email, fromMatch, subjectMatch string, timeout, interval time.Duration) (*Message, error) {
+	return waitForMessage(func() ([]Message, error) { return c.GetMessages(email) }, fromMatch, subjectMatch, timeout, interval)
+}
+
+func (c *MailTM) do(method, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/ld+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bad status: %d, body: %s", resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package tempmail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// Provider is a temp mail backend
+type Provider interface {
+	Name() string
+	CreateEmail() (*Email, error)
+	GetMessages(email string) ([]Message, error)
+	WaitForMessage(email, fromMatch, subjectMatch string, timeout, interval time.Duration) (*Message, error)
+}
+
+// backends by the name config selects them with
+var backends = map[string]func(IMAPConfig) Provider{
+	"temp-mail.io": func(IMAPConfig) Provider { return New() },
+	"mail.tm":      func(IMAPConfig) Provider { return NewMailTM() },
+	"imap":         func(cfg IMAPConfig) Provider { return NewIMAP(cfg) },
+}
+
+// Failover creates each mailbox on the first provider that manages to, and
+// reads it back from the same one
+type Failover struct {
+	providers []Provider
+
+	mu    sync.Mutex
+	owner map[string]Provider
+}
+
+// NewFailover tries providers in the order given
+func NewFailover(providers ...Provider) *Failover {
+	return &Failover{providers: providers, owner: make(map[string]Provider)}
+}
+
+// Open builds a failover over the named backends, unknown names are skipped.
+// imap is only used by the imap backend
+func Open(names []string, imap IMAPConfig) *Failover {
+	var providers []Provider
+	for _, name := range names {
+		if open, ok := backends[name]; ok {
+			providers = append(providers, open(imap))
+		}
+	}
+	return NewFailover(providers...)
+}
+
+func (f *Failover) Name() string {
+	names := make([]string, len(f.providers))
+	for i, p := range f.providers {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *Failover) CreateEmail() (*Email, error) {
+	var errs []error
+	for _, p := range f.providers {
+		email, err := p.CreateEmail()
+		if err != nil {
+			logger.Warn().Err(err).Str("provider", p.Name()).Msg("temp mail provider failed, trying the next")
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		if email.Provider == "" {
+			email.Provider = p.Name()
+		}
+
+		f.mu.Lock()
+		f.owner[email.Address] = p
+		f.mu.Unlock()
+		return email, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no temp mail provider configured")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (f *Failover) GetMessages(email string) ([]Message, error) {
+	p, err := f.provider(email)
+	if err != nil {
+		return nil, err
+	}
+	return p.GetMessages(email)
+}
+
+func (f *Failover) WaitForMessage(email, fromMatch, subjectMatch string, timeout, interval time.Duration) (*Message, error) {
+	p, err := f.provider(email)
+	if err != nil {
+		return nil, err
+	}
+	return p.WaitForMessage(email, fromMatch, subjectMatch, timeout, interval)
+}
+
+func (f *Failover) provider(email string) (Provider, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.owner[email]
+	if !ok {
+		return nil, fmt.Errorf("mailbox %s was not created here", email)
+	}
+	return p, nil
+}
+
+// waitForMessage polls get until a message from fromMatch with subjectMatch
+// in its subject arrives, both match case insensitively and empty matches all
+func waitForMessage(get func() ([]Message, error), fromMatch, subjectMatch string, timeout, interval time.Duration) (*Message, error) {
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+	if interval == 0 {
+		interval = 3 * time.Second
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		messages, err := get()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range messages {
+			if fromMatch != "" && !strings.Contains(strings.ToLower(m.From), strings.ToLower(fromMatch)) {
+				continue
+			}
+			if subjectMatch != "" && !strings.Contains(strings.ToLower(m.Subject), strings.ToLower(subjectMatch)) {
+				continue
+			}
+			return &m, nil
+		}
+
+		time.Sleep(interval)
+	}
+
+	return nil, nil
+}
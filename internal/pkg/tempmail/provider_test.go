@@ -0,0 +1,122 @@
+package tempmail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeProvider struct {
+	name    string
+	err     error
+	calls   *[]string
+	inboxes map[string][]Message
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func (p *fakeProvider) CreateEmail() (*Email, error) {
+	*p.calls = append(*p.calls, p.name+" create")
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Email{Address: "box@" + p.name}, nil
+}
+
+func (p *fakeProvider) GetMessages(email string) ([]Message, error) {
+	*p.calls = append(*p.calls, p.name+" read "+email)
+	return p.inboxes[email], nil
+}
+
+func (p *fakeProvider) WaitForMessage(email, from, subject string, timeout, interval time.Duration) (*Message, error) {
+	return waitForMessage(func() ([]Message, error) { return p.GetMessages(email) }, from, subject, timeout, interval)
+}
+
+func TestFailover(t *testing.T) {
+	var calls []string
+	primary := &fakeProvider{name: "primary", err: errors.New("403 datacenter ip"), calls: &calls}
+	secondary := &fakeProvider{name: "secondary", calls: &calls, inboxes: map[string][]Message{
+		"box@secondary": {{From: "noreply@z.ai", Subject: "Verify your email"}},
+	}}
+	third := &fakeProvider{name: "third", calls: &calls}
+	f := NewFailover(primary, secondary, third)
+
+	email, err := f.CreateEmail()
+	require.NoError(t, err)
+	assert.Equal(t, "box@secondary", email.Address)
+	assert.Equal(t, "secondary", email.Provider)
+
+	// the mailbox is read where it was created
+	msg, err := f.WaitForMessage(email.Address, "z.ai", "verify", time.Second, time.Millisecond)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, []string{"primary create", "secondary create", "secondary read box@secondary"}, calls)
+
+	_, err = f.GetMessages("box@elsewhere")
+	assert.Error(t, err)
+}
+
+func TestFailoverAllFail(t *testing.T) {
+	var calls []string
+	f := NewFailover(
+		&fakeProvider{name: "a", err: errors.New("rate limited"), calls: &calls},
+		&fakeProvider{name: "b", err: errors.New("timeout"), calls: &calls},
+	)
+	_, err := f.CreateEmail()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a: rate limited")
+	assert.Contains(t, err.Error(), "b: timeout")
+	assert.Equal(t, []string{"a create", "b create"}, calls)
+
+	_, err = NewFailover().CreateEmail()
+	assert.Error(t, err)
+}
+
+func TestOpen(t *testing.T) {
+	f := Open([]string{"mail.tm", "nope", "temp-mail.io", "imap"}, IMAPConfig{})
+	assert.Equal(t, "mail.tm,temp-mail.io,imap", f.Name())
+}
+
+func TestMailTM(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /domains":
+			fmt.Fprint(w, `{"hydra:member":[{"domain":"old.tm","isActive":false},{"domain":"mail.tm","isActive":true}]}`)
+		case "POST /accounts":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id":"acc"}`)
+		case "POST /token":
+			fmt.Fprint(w, `{"token":"jwt"}`)
+		case "GET /messages":
+			assert.Equal(t, "Bearer jwt", r.Header.Get("Authorization"))
+			fmt.Fprint(w, `{"hydra:member":[{"id":"m1","subject":"Verify"}]}`)
+		case "GET /messages/m1":
+			fmt.Fprint(w, `{"id":"m1","from":{"address":"noreply@z.ai"},"subject":"Verify","text":"click https://chat.z.ai/auth/verify_email?token=x","html":["<p>","hi</p>"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewMailTM()
+	c.base = srv.URL
+	email, err := c.CreateEmail()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{12}@mail\.tm$`, email.Address)
+	assert.Equal(t, "mail.tm", email.Provider)
+
+	msg, err := c.WaitForMessage(email.Address, "z.ai", "verify", time.Second, time.Millisecond)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, "https://chat.z.ai/auth/verify_email?token=x", ExtractVerifyLink(msg.BodyText))
+	assert.Equal(t, "<p>hi</p>", msg.BodyHTML)
+
+	_, err = c.GetMessages("stranger@mail.tm")
+	assert.Error(t, err)
+}
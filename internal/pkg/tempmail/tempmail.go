@@ -18,6 +18,8 @@ const (
 type Email struct {
 	Address string
 	Token   string
+	// name of the backend that created the mailbox
+	Provider string
 }
 
 type Message struct {
@@ -30,6 +32,7 @@ type Message struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Client is the temp-mail.io backend
 type Client struct {
 	http *http.Client
 }
@@ -40,6 +43,8 @@ func New() *Client {
 	}
 }
 
+func (c *Client) Name() string { return "temp-mail.io" }
+
 func (c *Client) headers() http.Header {
 	h := http.Header{}
 	h.Set("User-Agent", ua)
@@ -81,7 +86,7 @@ func (c *Client) CreateEmail() (*Email, error) {
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	return &Email{Address: result.Email, Token: result.Token}, nil
+	return &Email{Address: result.Email, Token: result.Token, Provider: c.Name()}, nil
 }
 
 func (c *Client) GetMessages(email string) ([]Message, error) {
@@ -114,35 +119,7 @@ func (c *Client) GetMessages(email string) ([]Message, error) {
 
 // WaitForMessage polls until a matching message arrives
 func (c *Client) WaitForMessage(email, fromMatch, subjectMatch string, timeout, interval time.Duration) (*Message, error) {
-	if timeout == 0 {
-		timeout = 60 * time.Second
-	}
-	if interval == 0 {
-		interval = 3 * time.Second
-	}
-
-	deadline := time.Now().Add(timeout)
-
-	for time.Now().Before(deadline) {
-		messages, err := c.GetMessages(email)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, m := range messages {
-			if fromMatch != "" && !strings.Contains(strings.ToLower(m.From), strings.ToLower(fromMatch)) {
-				continue
-			}
-			if subjectMatch != "" && !strings.Contains(strings.ToLower(m.Subject), strings.ToLower(subjectMatch)) {
-				continue
-			}
-			return &m, nil
-		}
-
-		time.Sleep(interval)
-	}
-
-	return nil, nil
+	return waitForMessage(func() ([]Message, error) { return c.GetMessages(email) }, fromMatch, subjectMatch, timeout, interval)
 }
 
 // ExtractVerifyLink finds Z.ai verification link in message body
@@ -0,0 +1,184 @@
+package tokenstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrBadPassphrase is returned for a bundle that does not decrypt, a wrong
+// passphrase and a corrupted file look the same
+var ErrBadPassphrase = errors.New("wrong passphrase or corrupted bundle")
+
+// scrypt cost of every bundle. the parameters travel in the bundle but are
+// not taken from it, an upload could ask for gigabytes of memory
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Bundle is an export of tokens sealed with AES-256-GCM under a key derived
+// from a passphrase with scrypt
+type Bundle struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Seal encrypts tokens, refresh tokens and expiry included
+func Seal(tokens []*Token, passphrase string) (*Bundle, error) {
+	plain, err := json.Marshal(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{Version: 1, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(b.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := b.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	b.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(b.Nonce); err != nil {
+		return nil, err
+	}
+	b.Data = gcm.Seal(nil, b.Nonce, plain, nil)
+	return b, nil
+}
+
+// Open decrypts the tokens of a bundle
+func (b *Bundle) Open(passphrase string) ([]*Token, error) {
+	if b.Version != 1 || b.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported bundle version %d (%s)", b.Version, b.KDF)
+	}
+	if b.N != scryptN || b.R != scryptR || b.P != scryptP {
+		return nil, fmt.Errorf("unsupported scrypt parameters n=%d r=%d p=%d", b.N, b.R, b.P)
+	}
+	gcm, err := b.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Nonce) != gcm.NonceSize() {
+		return nil, ErrBadPassphrase
+	}
+	plain, err := gcm.Open(nil, b.Nonce, b.Data, nil)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	var tokens []*Token
+	if err := json.Unmarshal(plain, &tokens); err != nil {
+		return nil, fmt.Errorf("decode tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+func (b *Bundle) cipher(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), b.Salt, b.N, b.R, b.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ImportResult counts what an import did with each token
+type ImportResult struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// Import merges tokens into the store. a token whose email and provider are
+// already stored only replaces the stored credentials when it is newer, new
+// ones keep their id unless it is taken. a provider without an active
+// token takes the one active in the bundle, or else the first imported
+func (s *Store) Import(tokens []*Token) (ImportResult, error) {
+	var res ImportResult
+
+	existing, err := s.List()
+	if err != nil {
+		return res, err
+	}
+	byAccount := make(map[string]*Token, len(existing))
+	ids := make(map[string]bool, len(existing))
+	active := make(map[string]bool)
+	for _, t := range existing {
+		byAccount[t.Provider+"\x00"+t.Email] = t
+		ids[t.ID] = true
+		active[t.Provider] = active[t.Provider] || t.IsActive
+	}
+
+	bundleActive := make(map[string]bool)
+	for _, in := range tokens {
+		if in.Provider == "" {
+			in.Provider = "glm"
+		}
+		bundleActive[in.Provider] = bundleActive[in.Provider] || in.IsActive
+	}
+
+	for _, in := range tokens {
+		key := in.Provider + "\x00" + in.Email
+
+		if cur, ok := byAccount[key]; ok {
+			if !newer(in, cur) {
+				res.Skipped++
+				continue
+			}
+			cur.Token, cur.RefreshToken, cur.ExpiryDate = in.Token, in.RefreshToken, in.ExpiryDate
+			if in.CreatedAt.After(cur.CreatedAt) {
+				cur.CreatedAt = in.CreatedAt
+			}
+			if err := s.save(cur); err != nil {
+				return res, err
+			}
+			res.Updated++
+			continue
+		}
+
+		t := *in
+		if t.ID == "" || ids[t.ID] {
+			t.ID = uuid.New().String()[:8]
+		}
+		t.IsActive = !active[t.Provider] && (in.IsActive || !bundleActive[t.Provider])
+		active[t.Provider] = active[t.Provider] || t.IsActive
+		if err := s.save(&t); err != nil {
+			return res, err
+		}
+		byAccount[key] = &t
+		ids[t.ID] = true
+		res.Added++
+	}
+
+	if res.Added+res.Updated > 0 {
+		s.notify()
+	}
+	return res, nil
+}
+
+// newer says whether in holds later credentials than cur. an expiry of 0 is
+// unknown, glm tokens carry none, so without two expiries the one created
+// later wins
+func newer(in, cur *Token) bool {
+	if in.ExpiryDate != 0 && cur.ExpiryDate != 0 {
+		return in.ExpiryDate > cur.ExpiryDate
+	}
+	return in.CreatedAt.After(cur.CreatedAt)
+}
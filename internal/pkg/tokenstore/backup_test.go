@@ -0,0 +1,147 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T) *Store {
+	s, err := New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	tokens := []*Token{
+		{ID: "a1", Provider: "glm", Email: "a@x.io", Token: "jwt-a", CreatedAt: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), IsActive: true},
+		{ID: "q1", Provider: "qwen", Email: "q@x.io", Token: "at", RefreshToken: "rt", ExpiryDate: 1767225600000, CreatedAt: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	bundle, err := Seal(tokens, "correct horse")
+	require.NoError(t, err)
+
+	// through json as it is stored on disk
+	data, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "jwt-a")
+	var read Bundle
+	require.NoError(t, json.Unmarshal(data, &read))
+
+	opened, err := read.Open("correct horse")
+	require.NoError(t, err)
+	assert.Equal(t, tokens, opened)
+
+	_, err = read.Open("wrong horse")
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+
+	read.Data[0] ^= 1
+	_, err = read.Open("correct horse")
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+}
+
+func TestBundleRejectsScryptCost(t *testing.T) {
+	bundle, err := Seal([]*Token{{ID: "a1", Token: "jwt-a"}}, "correct horse")
+	require.NoError(t, err)
+
+	for _, tt := range []struct{ n, r, p int }{
+		{1 << 30, scryptR, scryptP},
+		{scryptN, 1 << 20, scryptP},
+		{scryptN, scryptR, 64},
+		{1 << 10, scryptR, scryptP},
+	} {
+		b := *bundle
+		b.N, b.R, b.P = tt.n, tt.r, tt.p
+		// refused before deriving a key, or this would take gigabytes
+		_, err := b.Open("correct horse")
+		assert.ErrorContains(t, err, "unsupported scrypt parameters")
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := newStore(t)
+	kept, err := s.AddWithProvider("qwen", "q@x.io", "old", "old-rt", 100)
+	require.NoError(t, err)
+	taken, err := s.Add("b@x.io", "jwt-b")
+	require.NoError(t, err)
+
+	res, err := s.Import([]*Token{
+		// newer credentials for a stored account
+		{ID: "zz", Provider: "qwen", Email: "q@x.io", Token: "new", RefreshToken: "new-rt", ExpiryDate: 200},
+		// same account, nothing newer
+		{Provider: "glm", Email: "b@x.io", Token: "stale"},
+		// new accounts, one with an id already in use
+		{ID: taken.ID, Provider: "glm", Email: "c@x.io", Token: "jwt-c"},
+		{ID: "n1", Provider: "glm", Email: "d@x.io", Token: "jwt-d", IsActive: true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Added: 2, Updated: 1, Skipped: 1}, res)
+
+	q, err := s.GetByID(kept.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "new", q.Token)
+	assert.Equal(t, "new-rt", q.RefreshToken)
+	assert.Equal(t, int64(200), q.ExpiryDate)
+	assert.True(t, q.IsActive)
+
+	glm, err := s.ListByProvider("glm")
+	require.NoError(t, err)
+	require.Len(t, glm, 3)
+	byEmail := map[string]*Token{}
+	for _, tok := range glm {
+		byEmail[tok.Email] = tok
+	}
+	assert.Equal(t, "jwt-b", byEmail["b@x.io"].Token)
+	assert.NotEqual(t, taken.ID, byEmail["c@x.io"].ID)
+	assert.Equal(t, "n1", byEmail["d@x.io"].ID)
+
+	// the store already had an active glm token
+	active, err := s.GetActive()
+	require.NoError(t, err)
+	assert.Equal(t, taken.ID, active.ID)
+}
+
+func TestImportUnknownExpiry(t *testing.T) {
+	s := newStore(t)
+	stored, err := s.Add("a@x.io", "jwt-old")
+	require.NoError(t, err)
+
+	// glm tokens have no expiry, the later one wins
+	res, err := s.Import([]*Token{
+		{Provider: "glm", Email: "a@x.io", Token: "jwt-new", CreatedAt: stored.CreatedAt.Add(time.Hour)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Updated: 1}, res)
+
+	res, err = s.Import([]*Token{
+		{Provider: "glm", Email: "a@x.io", Token: "jwt-older", CreatedAt: stored.CreatedAt.Add(-time.Hour)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{Skipped: 1}, res)
+
+	got, err := s.GetByID(stored.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "jwt-new", got.Token)
+}
+
+func TestImportIntoEmptyStore(t *testing.T) {
+	s := newStore(t)
+	res, err := s.Import([]*Token{
+		{ID: "a", Email: "a@x.io", Token: "1"},
+		{ID: "b", Email: "b@x.io", Token: "2", IsActive: true},
+		{ID: "c", Provider: "qwen", Email: "c@x.io", Token: "3"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Added)
+
+	active, err := s.GetActiveByProvider("glm")
+	require.NoError(t, err)
+	assert.Equal(t, "b", active.ID)
+	active, err = s.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	assert.Equal(t, "c", active.ID)
+}
@@ -0,0 +1,101 @@
+package tokenstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// batch records, the result of each request and the files they read and
+// write live next to the tokens so a batch resumes after a restart. the
+// store keeps them opaque, the batch package owns the format
+
+func (s *Store) SaveBatch(id string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("batch:"+id), data)
+	})
+}
+
+func (s *Store) Batches() ([][]byte, error) {
+	return s.values("batch:")
+}
+
+// SaveBatchResult keeps the outcome of request index of a batch
+func (s *Store) SaveBatchResult(batch string, index int, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(batchResultKey(batch, index), data)
+	})
+}
+
+// BatchResults are the outcomes kept for a batch, in request order
+func (s *Store) BatchResults(batch string) ([][]byte, error) {
+	return s.values("batchresult:" + batch + ":")
+}
+
+func batchResultKey(batch string, index int) []byte {
+	// zero padded so the keys sort in request order
+	return fmt.Appendf(nil, "batchresult:%s:%010d", batch, index)
+}
+
+func (s *Store) SaveFile(id string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("file:"+id), data)
+	})
+}
+
+// File returns nil for an id that was never saved
+func (s *Store) File(id string) ([]byte, error) {
+	return s.value("file:" + id)
+}
+
+// SaveFileOwner keeps who may read file id
+func (s *Store) SaveFileOwner(id string, owner []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("fileowner:"+id), owner)
+	})
+}
+
+// FileOwner returns nil for a file saved without one
+func (s *Store) FileOwner(id string) ([]byte, error) {
+	return s.value("fileowner:" + id)
+}
+
+// value returns nil for a key that was never set
+func (s *Store) value(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	return data, err
+}
+
+func (s *Store) values(prefix string) ([][]byte, error) {
+	var values [][]byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			data, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			values = append(values, data)
+		}
+		return nil
+	})
+
+	return values, err
+}
@@ -0,0 +1,43 @@
+package tokenstore
+
+import (
+	"github.com/dgraph-io/badger/v4"
+)
+
+// conversation records live next to the tokens so sticky chats survive a
+// restart. the store keeps them opaque, the conversation package owns the
+// format
+
+func (s *Store) SaveConversation(id string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("conversation:"+id), data)
+	})
+}
+
+func (s *Store) RemoveConversation(id string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("conversation:" + id))
+	})
+}
+
+func (s *Store) Conversations() ([][]byte, error) {
+	var conversations [][]byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("conversation:")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			data, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			conversations = append(conversations, data)
+		}
+		return nil
+	})
+
+	return conversations, err
+}
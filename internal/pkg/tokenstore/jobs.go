@@ -0,0 +1,43 @@
+package tokenstore
+
+import (
+	"github.com/dgraph-io/badger/v4"
+)
+
+// job records live next to the tokens so registration history survives a
+// restart. the store keeps them opaque, the registration package owns the
+// format
+
+func (s *Store) SaveJob(id string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("job:"+id), data)
+	})
+}
+
+func (s *Store) RemoveJob(id string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("job:" + id))
+	})
+}
+
+func (s *Store) Jobs() ([][]byte, error) {
+	var jobs [][]byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("job:")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			data, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, data)
+		}
+		return nil
+	})
+
+	return jobs, err
+}
@@ -0,0 +1,33 @@
+package tokenstore
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// settings are values mo learns at runtime and keeps across restarts,
+// such as the upstream frontend version
+
+func (s *Store) SaveSetting(key string, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("setting:"+key), value)
+	})
+}
+
+// Setting returns nil for a key that was never saved
+func (s *Store) Setting(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("setting:" + key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
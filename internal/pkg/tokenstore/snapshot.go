@@ -0,0 +1,72 @@
+package tokenstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is a store another process, a serving mo, has open
+var ErrLocked = errors.New("token store is in use by another process")
+
+// Snapshot opens a copy of the store at path, for reading it while another
+// process holds it. writes stay in the copy, Close removes it
+func Snapshot(path string) (*Store, error) {
+	tmp, err := os.MkdirTemp("", "mo-tokens-")
+	if err != nil {
+		return nil, err
+	}
+	if err := copyDir(path, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("copy token store: %w", err)
+	}
+
+	s, err := New(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	s.tmp = tmp
+	return s, nil
+}
+
+// copyDir copies the files of a badger directory, not its lock
+func copyDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == "LOCK" {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			// the owner compacted it away meanwhile
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,37 @@
+package tokenstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotOfHeldStore(t *testing.T) {
+	dir := t.TempDir()
+	held, err := New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { held.Close() })
+	tok, err := held.Add("a@x.io", "jwt-a")
+	require.NoError(t, err)
+
+	_, err = New(dir)
+	require.ErrorIs(t, err, ErrLocked)
+
+	snap, err := Snapshot(dir)
+	require.NoError(t, err)
+	got, err := snap.GetByID(tok.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "jwt-a", got.Token)
+
+	_, err = snap.Add("b@x.io", "jwt-b")
+	require.NoError(t, err)
+	tmp := snap.tmp
+	require.NoError(t, snap.Close())
+	assert.NoDirExists(t, tmp, "the copy is removed")
+
+	all, err := held.List()
+	require.NoError(t, err)
+	assert.Len(t, all, 1, "writes to the snapshot stay in the copy")
+}
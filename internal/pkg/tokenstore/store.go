@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -11,18 +14,35 @@ import (
 )
 
 type Token struct {
-	ID           string    `json:"id"`
-	Provider     string    `json:"provider"`
-	Email        string    `json:"email"`
-	Token        string    `json:"token"`
-	RefreshToken string    `json:"refresh_token,omitempty"`
-	ExpiryDate   int64     `json:"expiry_date,omitempty"`
-	CreatedAt    time.Time `json:"created_at"`
-	IsActive     bool      `json:"is_active"`
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	Email    string `json:"email"`
+	// account name upstream reports, set for pasted tokens
+	Name         string `json:"name,omitempty"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiryDate   int64  `json:"expiry_date,omitempty"`
+	// api host oauth assigned the account, qwen only
+	ResourceURL string    `json:"resource_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	IsActive    bool      `json:"is_active"`
+	// outcome of the last validation, nil until the token is validated
+	LastCheck *Check `json:"last_check,omitempty"`
+}
+
+// Check is the outcome of validating a token against upstream
+type Check struct {
+	Valid bool      `json:"valid"`
+	At    time.Time `json:"at"`
 }
 
 type Store struct {
 	db *badger.DB
+	// a snapshot's copy, removed on Close
+	tmp string
+
+	mu        sync.RWMutex
+	listeners []func()
 }
 
 func New(path string) (*Store, error) {
@@ -31,6 +51,9 @@ func New(path string) (*Store, error) {
 
 	db, err := badger.Open(opts)
 	if err != nil {
+		if strings.Contains(err.Error(), "Cannot acquire directory lock") {
+			return nil, fmt.Errorf("%w: %w", ErrLocked, err)
+		}
 		return nil, fmt.Errorf("open badger: %w", err)
 	}
 
@@ -38,7 +61,33 @@ func New(path string) (*Store, error) {
 }
 
 func (s *Store) Close() error {
-	return s.db.Close()
+	err := s.db.Close()
+	if s.tmp != "" {
+		os.RemoveAll(s.tmp)
+	}
+	return err
+}
+
+// Ping fails once the store can no longer be read
+func (s *Store) Ping() error {
+	return s.db.View(func(*badger.Txn) error { return nil })
+}
+
+// OnChange registers fn to run after every successful mutation
+func (s *Store) OnChange(fn func()) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.mu.Unlock()
+}
+
+func (s *Store) notify() {
+	s.mu.RLock()
+	listeners := s.listeners
+	s.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
 }
 
 func (s *Store) Add(email, token string) (*Token, error) {
@@ -65,18 +114,42 @@ func (s *Store) AddWithProvider(provider, email, token, refreshToken string, exp
 	if err := s.save(t); err != nil {
 		return nil, err
 	}
+	s.notify()
 
 	return t, nil
 }
 
 func (s *Store) Update(t *Token) error {
+	if err := s.save(t); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// RecordCheck keeps the outcome of validating the token. credentials do not
+// change, listeners are not told
+func (s *Store) RecordCheck(id string, valid bool) error {
+	t, err := s.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("token not found")
+	}
+	t.LastCheck = &Check{Valid: valid, At: time.Now().UTC()}
 	return s.save(t)
 }
 
 func (s *Store) Remove(id string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete([]byte("token:" + id))
 	})
+	if err != nil {
+		return err
+	}
+	s.notify()
+	return nil
 }
 
 func (s *Store) SetActive(id string) error {
@@ -96,6 +169,7 @@ func (s *Store) SetActive(id string) error {
 			return err
 		}
 	}
+	s.notify()
 
 	return nil
 }
@@ -209,7 +283,13 @@ func (s *Store) save(t *Token) error {
 }
 
 func ValidateToken(token string) bool {
-	req, err := http.NewRequest("GET", "https://chat.z.ai/api/v1/folders/", nil)
+	return ValidateTokenAt("https://chat.z.ai/api/v1/folders/", token)
+}
+
+// ValidateTokenAt checks token against an authenticated endpoint of a z.ai
+// compatible host
+func ValidateTokenAt(url, token string) bool {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,76 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// usage counters live next to the tokens so they survive a restart. keys
+// are opaque to the store, the usage package owns their layout
+
+// Counts is one usage counter
+type Counts struct {
+	Requests         int64 `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+func (c *Counts) Add(o Counts) {
+	c.Requests += o.Requests
+	c.PromptTokens += o.PromptTokens
+	c.CompletionTokens += o.CompletionTokens
+}
+
+// AddUsage adds deltas to their counters in a single transaction
+func (s *Store) AddUsage(deltas map[string]Counts) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for key, d := range deltas {
+			var c Counts
+			item, err := txn.Get([]byte("usage:" + key))
+			switch err {
+			case nil:
+				if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &c) }); err != nil {
+					return err
+				}
+			case badger.ErrKeyNotFound:
+			default:
+				return err
+			}
+
+			c.Add(d)
+			data, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte("usage:"+key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Usage returns the counters whose key starts with prefix
+func (s *Store) Usage(prefix string) (map[string]Counts, error) {
+	out := make(map[string]Counts)
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("usage:" + prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var c Counts
+			if err := it.Item().Value(func(val []byte) error { return json.Unmarshal(val, &c) }); err != nil {
+				return err
+			}
+			out[strings.TrimPrefix(string(it.Item().Key()), "usage:")] = c
+		}
+		return nil
+	})
+
+	return out, err
+}
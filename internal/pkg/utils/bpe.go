@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+)
+
+// ranks files in bpe/, cl100k_base ships with the repo
+//
+//go:embed bpe
+var embeddedBPE embed.FS
+
+// bpeLoader finds ranks in the binary first, then in cacheDir, and only
+// goes to the network when download is on
+type bpeLoader struct {
+	cacheDir string
+	download bool
+}
+
+func (l *bpeLoader) LoadTiktokenBpe(url string) (map[string]int, error) {
+	name := path.Base(url)
+
+	if data, err := embeddedBPE.ReadFile("bpe/" + name); err == nil {
+		return parseRanks(data)
+	}
+
+	cached := filepath.Join(l.cacheDir, name)
+	if data, err := os.ReadFile(cached); err == nil {
+		return parseRanks(data)
+	}
+
+	if !l.download {
+		return nil, fmt.Errorf("%s is neither embedded nor in %s and download is off", name, l.cacheDir)
+	}
+
+	data, err := fetchRanks(url)
+	if err != nil {
+		return nil, err
+	}
+	ranks, err := parseRanks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(l.cacheDir, 0755); err == nil {
+		tmp := cached + ".tmp"
+		if os.WriteFile(tmp, data, 0644) == nil {
+			os.Rename(tmp, cached)
+		}
+	}
+	return ranks, nil
+}
+
+func fetchRanks(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpclient.New(time.Minute).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseRanks reads the tiktoken format, "<base64 token> <rank>" per line
+func parseRanks(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		token, rank, ok := bytes.Cut(line, []byte(" "))
+		if !ok {
+			return nil, fmt.Errorf("ranks line %d: missing rank", i+1)
+		}
+		raw, err := base64.StdEncoding.DecodeString(string(token))
+		if err != nil {
+			return nil, fmt.Errorf("ranks line %d: %w", i+1, err)
+		}
+		n, err := strconv.Atoi(string(rank))
+		if err != nil {
+			return nil, fmt.Errorf("ranks line %d: %w", i+1, err)
+		}
+		ranks[string(raw)] = n
+	}
+	return ranks, nil
+}
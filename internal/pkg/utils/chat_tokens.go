@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"encoding/json"
+
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// framing openai adds around chat input, from the tiktoken cookbook for
+// the cl100k_base chat models
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	// <|start|>assistant<|message|> priming the reply
+	tokensReplyPriming = 3
+	tokensPerToolCall  = 3
+	tokensPerTool      = 7
+	tokensToolsEnd     = 12
+)
+
+// CountChatTokens counts a request the way the upstream bills its prompt:
+// message framing, roles and names, text parts, assistant tool calls, the
+// tool schemas, and imageTokens for each attached image
+func CountChatTokens(t Tokener, req *domain.ChatRequest, imageTokens int) int {
+	n := tokensReplyPriming
+	for _, msg := range req.Messages {
+		n += CountMessageTokens(t, msg, imageTokens)
+	}
+
+	if len(req.Tools) > 0 {
+		for _, tool := range req.Tools {
+			schema, _ := json.Marshal(tool.Function)
+			n += tokensPerTool + t.Count(string(schema))
+		}
+		n += tokensToolsEnd
+	}
+	return n
+}
+
+// CountMessageTokens is what one message adds to CountChatTokens
+func CountMessageTokens(t Tokener, msg domain.Message, imageTokens int) int {
+	n := tokensPerMessage + t.Count(msg.Role)
+	if msg.Name != "" {
+		n += tokensPerName + t.Count(msg.Name)
+	}
+	if msg.ToolCallID != "" {
+		n += t.Count(msg.ToolCallID)
+	}
+	n += countContent(t, msg.Content, imageTokens)
+
+	for _, call := range msg.ToolCalls {
+		n += tokensPerToolCall + t.Count(call.Function.Name) + t.Count(call.Function.Arguments)
+	}
+	return n
+}
+
+func countContent(t Tokener, content any, imageTokens int) int {
+	switch c := content.(type) {
+	case string:
+		return t.Count(c)
+	case []any:
+		n := 0
+		for _, item := range c {
+			part, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "text":
+				if text, ok := part["text"].(string); ok {
+					n += t.Count(text)
+				}
+			case "image_url":
+				n += imageTokens
+			}
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// words counts one token per word so the framing is easy to follow
+type words struct{}
+
+func (words) Init() error           { return nil }
+func (words) Count(text string) int { return len(strings.Fields(text)) }
+
+func TestCountChatTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		req  domain.ChatRequest
+		want int
+	}{
+		{
+			name: "single message",
+			req:  domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hello there"}}},
+			// priming 3, framing 3, role 1, content 2
+			want: 9,
+		},
+		{
+			name: "name",
+			req:  domain.ChatRequest{Messages: []domain.Message{{Role: "system", Name: "example_user", Content: "hi"}}},
+			want: 3 + 3 + 1 + 1 + 1 + 1,
+		},
+		{
+			name: "parts and images",
+			req: domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []any{
+				map[string]any{"type": "text", "text": "what is this"},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,AAAA"}},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/a.png"}},
+			}}}},
+			want: 3 + 3 + 1 + 3 + 2*100,
+		},
+		{
+			name: "assistant tool calls and result",
+			req: domain.ChatRequest{Messages: []domain.Message{
+				{Role: "assistant", ToolCalls: []domain.ToolCall{{ID: "call_1", Type: "function", Function: domain.FunctionCall{Name: "search", Arguments: `{"q": "go"}`}}}},
+				{Role: "tool", ToolCallID: "call_1", Content: "three results"},
+			}},
+			want: 3 + (3 + 1 + 3 + 1 + 2) + (3 + 1 + 1 + 2),
+		},
+		{
+			name: "tool schemas",
+			req: domain.ChatRequest{
+				Messages: []domain.Message{{Role: "user", Content: "hi"}},
+				Tools: []domain.Tool{{Type: "function", Function: domain.ToolFunction{
+					Name: "search", Description: "find pages", Parameters: map[string]any{"type": "object"},
+				}}},
+			},
+			// the schema serializes as one word plus one per space in the description
+			want: 3 + 3 + 1 + 1 + 7 + 2 + 12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CountChatTokens(words{}, &tt.req, 100))
+		})
+	}
+}
+
+// the example conversation of the openai cookbook "how to count tokens
+// with tiktoken", 129 prompt tokens on every cl100k_base chat model
+func TestCountChatTokensCookbook(t *testing.T) {
+	tok := NewTokenizer(t.TempDir(), false)
+	require.NoError(t, tok.Init())
+
+	req := domain.ChatRequest{Messages: []domain.Message{
+		{Role: "system", Content: "You are a helpful, pattern-following assistant that translates corporate jargon into plain English."},
+		{Role: "system", Name: "example_user", Content: "New synergies will help drive top-line growth."},
+		{Role: "system", Name: "example_assistant", Content: "Things working well together will increase revenue."},
+		{Role: "system", Name: "example_user", Content: "Let's circle back when we have more bandwidth to touch base on opportunities for increased leverage."},
+		{Role: "system", Name: "example_assistant", Content: "Let's talk later when we're less busy about how to do better."},
+		{Role: "user", Content: "This late pivot means we don't have time to boil the ocean for the client deliverable."},
+	}}
+	assert.Equal(t, 129, CountChatTokens(tok, &req, 0))
+}
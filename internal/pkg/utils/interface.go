@@ -4,3 +4,9 @@ type Tokener interface {
 	Init() error
 	Count(text string) int
 }
+
+// Encoder is a Tokener that can show the tokens it counted, the estimate
+// used without ranks can not
+type Encoder interface {
+	Encode(text string) (ids []int, pieces []string, err error)
+}
@@ -1,40 +1,35 @@
 package utils
 
 import (
-	"os"
-	"path/filepath"
 	"sync"
+	"unicode"
 
 	"github.com/pkoukk/tiktoken-go"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
 )
 
 type Tokenizer struct {
+	loader  *bpeLoader
 	encoder *tiktoken.Tiktoken
 	initErr error
 	once    sync.Once
 }
 
-func NewTokenizer() *Tokenizer {
-	return &Tokenizer{}
+// NewTokenizer loads cl100k_base from the binary or cacheDir, download
+// allows fetching it into cacheDir once when neither has it
+func NewTokenizer(cacheDir string, download bool) *Tokenizer {
+	return &Tokenizer{loader: &bpeLoader{cacheDir: cacheDir, download: download}}
 }
 
 func (t *Tokenizer) Init() error {
 	t.once.Do(func() {
-		cacheDir := filepath.Join(".", "tiktoken")
-		os.Setenv("TIKTOKEN_CACHE_DIR", cacheDir)
-
-		if err := os.MkdirAll(cacheDir, 0755); err != nil {
-			t.initErr = err
-			logger.Warn().Err(err).Msg("failed to create tiktoken cache dir")
-			return
-		}
+		tiktoken.SetBpeLoader(t.loader)
 
 		var err error
 		t.encoder, err = tiktoken.GetEncoding("cl100k_base")
 		if err != nil {
 			t.initErr = err
-			logger.Warn().Err(err).Msg("failed to init tiktoken")
+			logger.Warn().Err(err).Msg("tiktoken unavailable, token counts are estimated")
 			return
 		}
 
@@ -44,16 +39,40 @@ func (t *Tokenizer) Init() error {
 	return t.initErr
 }
 
+// Count is exact with the encoder and an estimate without it, never 0 for
+// text that is not empty
 func (t *Tokenizer) Count(text string) int {
-	if t.encoder == nil {
-		if err := t.Init(); err != nil {
-			return 0
+	if t.Init() != nil {
+		return EstimateTokens(text)
+	}
+	return len(t.encoder.Encode(text, nil, nil))
+}
+
+// EstimateTokens approximates cl100k_base: about four characters per token,
+// one per han, kana or hangul character since those rarely merge
+func EstimateTokens(text string) int {
+	var cjk, other int
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			cjk++
+		} else {
+			other++
 		}
 	}
+	return cjk + (other+3)/4
+}
 
-	if t.encoder == nil {
-		return 0
+// Encode returns the token ids of text and the bytes each one stands for,
+// pieces that split a utf-8 sequence are not valid strings on their own
+func (t *Tokenizer) Encode(text string) ([]int, []string, error) {
+	if err := t.Init(); err != nil {
+		return nil, nil, err
 	}
 
-	return len(t.encoder.Encode(text, nil, nil))
+	ids := t.encoder.Encode(text, nil, nil)
+	pieces := make([]string, len(ids))
+	for i, id := range ids {
+		pieces[i] = t.encoder.Decode([]int{id})
+	}
+	return ids, pieces, nil
 }
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	assert.Equal(t, 0, EstimateTokens(""))
+	assert.Equal(t, 1, EstimateTokens("hi"))
+	assert.Equal(t, 3, EstimateTokens("hello world"))
+	assert.Equal(t, 4, EstimateTokens("你好世界"))
+	assert.Equal(t, 3, EstimateTokens("こんにちは"[:6]+"ok"))
+	assert.Equal(t, EstimateTokens("same text"), EstimateTokens("same text"))
+}
+
+func TestBpeLoaderReadsCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	// "a", "b" and "ab" in the tiktoken ranks format
+	ranks := "YQ== 0\nYg== 1\nYWI= 2\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tiny.tiktoken"), []byte(ranks), 0644))
+
+	l := &bpeLoader{cacheDir: dir}
+	got, err := l.LoadTiktokenBpe("https://example.invalid/encodings/tiny.tiktoken")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 0, "b": 1, "ab": 2}, got)
+}
+
+func TestBpeLoaderNoDownload(t *testing.T) {
+	l := &bpeLoader{cacheDir: t.TempDir()}
+	_, err := l.LoadTiktokenBpe("https://example.invalid/encodings/missing.tiktoken")
+	assert.ErrorContains(t, err, "download is off")
+}
+
+func TestParseRanksRejectsGarbage(t *testing.T) {
+	_, err := parseRanks([]byte("YQ== zero\n"))
+	assert.Error(t, err)
+	_, err = parseRanks([]byte("no-rank\n"))
+	assert.Error(t, err)
+}
+
+func TestBpeLoaderEmbedded(t *testing.T) {
+	// an empty cache dir and no download, the binary has to carry the ranks
+	l := &bpeLoader{cacheDir: t.TempDir()}
+	ranks, err := l.LoadTiktokenBpe("https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken")
+	require.NoError(t, err)
+	assert.Len(t, ranks, 100256)
+	assert.Equal(t, 0, ranks["!"])
+
+	tok := NewTokenizer(t.TempDir(), false)
+	require.NoError(t, tok.Init())
+	assert.Equal(t, 2, tok.Count("hello world"))
+}
+
+func TestCountWithoutEncoder(t *testing.T) {
+	tok := &Tokenizer{}
+	// as if the ranks could not be loaded
+	tok.once.Do(func() { tok.initErr = errors.New("no ranks") })
+
+	assert.Error(t, tok.Init())
+	assert.Equal(t, EstimateTokens("hello world"), tok.Count("hello world"))
+	assert.Equal(t, 0, tok.Count(""))
+}
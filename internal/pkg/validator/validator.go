@@ -2,15 +2,78 @@ package validator
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/zarazaex69/mo/internal/domain"
 )
 
 var v *validator.Validate
 
 func init() {
 	v = validator.New()
+
+	// report json names so messages match what clients sent
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterStructValidation(messageContent, domain.Message{})
+}
+
+// content part types a message may carry, anything else would be dropped
+// by the formatters and leave the model with an empty prompt
+var partTypes = map[string]bool{"text": true, "image_url": true, "file": true, "input_audio": true}
+
+// messageContent checks content is a string or a list of known parts, and
+// that user messages say something
+func messageContent(sl validator.StructLevel) {
+	m := sl.Current().Interface().(domain.Message)
+
+	switch c := m.Content.(type) {
+	case nil:
+		if m.Role == "user" {
+			sl.ReportError(m.Content, "content", "Content", "content", "must not be empty")
+		}
+	case string:
+		if c == "" && m.Role == "user" {
+			sl.ReportError(m.Content, "content", "Content", "content", "must not be empty")
+		}
+	case []interface{}:
+		if len(c) == 0 && m.Role == "user" {
+			sl.ReportError(m.Content, "content", "Content", "content", "must not be empty")
+		}
+		for i, item := range c {
+			name := fmt.Sprintf("content[%d]", i)
+			part, ok := item.(map[string]interface{})
+			if !ok {
+				sl.ReportError(item, name, name, "content", "must be an object")
+				continue
+			}
+			typ, _ := part["type"].(string)
+			if !partTypes[typ] {
+				sl.ReportError(item, name, name, "content",
+					fmt.Sprintf("has unknown part type %q, expected text, image_url, file or input_audio", typ))
+			}
+		}
+	default:
+		sl.ReportError(m.Content, "content", "Content", "content", "must be a string or an array of content parts")
+	}
+}
+
+// Error carries the first offending field path, e.g. messages[0].role
+type Error struct {
+	Param string
+	msg   string
+}
+
+func (e *Error) Error() string {
+	return e.msg
 }
 
 func Validate(s interface{}) error {
@@ -30,7 +93,13 @@ func formatErrs(errs validator.ValidationErrors) error {
 	for _, e := range errs {
 		msgs = append(msgs, formatField(e))
 	}
-	return fmt.Errorf("validation failed: %s", strings.Join(msgs, "; "))
+
+	// drop the struct name prefix from the namespace
+	_, param, _ := strings.Cut(errs[0].Namespace(), ".")
+	return &Error{
+		Param: param,
+		msg:   fmt.Sprintf("validation failed: %s", strings.Join(msgs, "; ")),
+	}
 }
 
 func formatField(e validator.FieldError) string {
@@ -39,6 +108,10 @@ func formatField(e validator.FieldError) string {
 	param := e.Param()
 
 	switch tag {
+	case "content":
+		// the full path, content alone does not say which message
+		_, path, _ := strings.Cut(e.Namespace(), ".")
+		return fmt.Sprintf("field '%s' %s", path, param)
 	case "required":
 		return fmt.Sprintf("field '%s' is required", field)
 	case "min":
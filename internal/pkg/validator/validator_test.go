@@ -0,0 +1,60 @@
+package validator
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestMessageContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+		param    string
+		msg      string
+	}{
+		{"string", `[{"role":"user","content":"hi"}]`, "", ""},
+		{"known parts", `[{"role":"user","content":[
+			{"type":"text","text":"look"},
+			{"type":"image_url","image_url":{"url":"https://x/y.png"}},
+			{"type":"file","file":{"file_data":"data:application/pdf;base64,AA=="}},
+			{"type":"input_audio","input_audio":{"data":"AA==","format":"wav"}}]}]`, "", ""},
+		{"assistant tool calls without content", `[{"role":"user","content":"hi"},
+			{"role":"assistant","content":null,"tool_calls":[{"id":"c1","type":"function","function":{"name":"f","arguments":"{}"}}]},
+			{"role":"tool","tool_call_id":"c1","content":"42"}]`, "", ""},
+		{"object content", `[{"role":"user","content":{"foo":"bar"}}]`,
+			"messages[0].content", "must be a string or an array of content parts"},
+		{"unknown part", `[{"role":"system","content":"be brief"},{"role":"user","content":[{"type":"text","text":"a"},{"type":"video","video":"x"}]}]`,
+			"messages[1].content[1]", `unknown part type "video"`},
+		{"part not an object", `[{"role":"user","content":["hi"]}]`,
+			"messages[0].content[0]", "must be an object"},
+		{"empty user string", `[{"role":"user","content":""}]`,
+			"messages[0].content", "must not be empty"},
+		{"missing user content", `[{"role":"user"}]`,
+			"messages[0].content", "must not be empty"},
+		{"empty user parts", `[{"role":"user","content":[]}]`,
+			"messages[0].content", "must not be empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req domain.ChatRequest
+			require.NoError(t, json.Unmarshal([]byte(`{"messages":`+tt.messages+`}`), &req))
+
+			err := Validate(&req)
+			if tt.param == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var verr *Error
+			require.True(t, errors.As(err, &verr), "got %v", err)
+			assert.Equal(t, tt.param, verr.Param)
+			assert.Contains(t, verr.Error(), tt.param)
+			assert.Contains(t, verr.Error(), tt.msg)
+		})
+	}
+}
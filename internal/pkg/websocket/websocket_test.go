@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo serves a websocket that sends every message back
+func echo(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteText(msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestEcho(t *testing.T) {
+	ws, err := Dial(echo(t), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// one of each length encoding
+	for _, n := range []int{0, 5, 125, 126, 70000} {
+		msg := bytes.Repeat([]byte("x"), n)
+		require.NoError(t, ws.WriteText(msg))
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, string(msg), string(got), "length %d", n)
+	}
+}
+
+func TestFragmentsAndPing(t *testing.T) {
+	ws, err := Dial(echo(t), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// a ping between the fragments of a message is answered in place
+	ws.conn.Write(unfinished(opText, "hel"))
+	require.NoError(t, ws.writeFrame(opPing, []byte("p")))
+	require.NoError(t, ws.writeFrame(opContinuation, []byte("lo")))
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ws.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got), "the pong before it is skipped")
+}
+
+// unfinished is a frame without the fin bit, masked with a zero key
+func unfinished(op byte, text string) []byte {
+	frame := []byte{op, 0x80 | byte(len(text)), 0, 0, 0, 0}
+	return append(frame, text...)
+}
+
+func TestUnmaskedClientFrame(t *testing.T) {
+	closed := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := Upgrade(w, r)
+		require.NoError(t, err)
+		_, err = ws.ReadMessage()
+		closed <- err
+	}))
+	defer srv.Close()
+
+	ws, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.conn.Write([]byte{0x80 | opText, 2, 'h', 'i'})
+
+	assert.ErrorIs(t, <-closed, ErrProtocol)
+	// the server says why, close 1002
+	_, op, payload, err := ws.readFrame()
+	require.NoError(t, err)
+	assert.Equal(t, byte(opClose), op)
+	assert.Equal(t, uint16(closeProtocol), binary.BigEndian.Uint16(payload))
+}
+
+func TestCloseEndsRead(t *testing.T) {
+	ws, err := Dial(echo(t), nil)
+	require.NoError(t, err)
+	require.NoError(t, ws.writeClose(closeNormal))
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ws.ReadMessage()
+	assert.Equal(t, io.EOF, err, "the echoed close")
+}
+
+func TestUpgradeRefusesPlainRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upgrade(w, r)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: a2V5\r\nSec-WebSocket-Version: 8\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	status, _ := io.ReadAll(io.LimitReader(conn, 12))
+	assert.Equal(t, "HTTP/1.1 426", string(status))
+}
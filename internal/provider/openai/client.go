@@ -0,0 +1,182 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+var log = logger.Module("openai")
+
+// moFields are request fields only mo reads, an openai server would
+// reject or misread them
+var moFields = []string{
+	"thinking",
+	"reasoning_summaries",
+	"include_upstream_events",
+	"reasoning_format",
+	"continue_final_message",
+	"truncate",
+	"conversation_id",
+	"stream_format",
+}
+
+// Client fronts one openai compatible server, requests and replies pass
+// through mostly untouched
+type Client struct {
+	cfg  *config.Config
+	up   config.OpenAIUpstream
+	http *httpclient.Client
+}
+
+func NewClient(cfg *config.Config, up config.OpenAIUpstream) *Client {
+	return &Client{cfg: cfg, up: up, http: httpclient.New(0)}
+}
+
+// NewClients builds a client for every configured upstream, in order
+func NewClients(cfg *config.Config) []*Client {
+	clients := make([]*Client, 0, len(cfg.OpenAI))
+	for _, up := range cfg.OpenAI {
+		clients = append(clients, NewClient(cfg, up))
+	}
+	return clients
+}
+
+func (c *Client) Name() string {
+	return c.up.Name
+}
+
+// Models are the model ids listed for the upstream, ones matching its
+// prefix are served too but cannot be listed
+func (c *Client) Models() []string {
+	return append([]string(nil), c.up.Models...)
+}
+
+func (c *Client) SupportsModel(model string) bool {
+	if slices.Contains(c.up.Models, model) {
+		return true
+	}
+	return c.up.ModelPrefix != "" && strings.HasPrefix(model, c.up.ModelPrefix) && model != c.up.ModelPrefix
+}
+
+// RepliesOpenAI marks the replies as openai chat completions already
+func (c *Client) RepliesOpenAI() {}
+
+// AcceptsAudio passes input_audio parts on, whether the model hears them is
+// the upstream's to say
+func (c *Client) AcceptsAudio(string) bool { return true }
+
+func (c *Client) CredentialStatus() provider.CredentialStatus {
+	st := provider.CredentialStatus{Provider: c.Name(), Present: true, Valid: true, Source: "config"}
+	if c.up.APIKey == "" {
+		// local servers often take none
+		st.Source = ""
+		st.Detail = "no api key, requests go out without one"
+	}
+	return st
+}
+
+func (c *Client) SendChatRequest(ctx context.Context, req *domain.ChatRequest, chatID string) (*http.Response, error) {
+	body, err := c.formatRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL := strings.TrimRight(c.up.BaseURL, "/") + "/chat/completions"
+	log.Ctx(ctx).Debug().Str("upstream", c.Name()).Str("url", apiURL).Msg("openai request")
+	log.Raw(ctx).RawJSON("body", body).Msg("request body")
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	for k, v := range c.up.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.up.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.up.APIKey)
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		log.Ctx(ctx).Error().
+			Int("status", resp.StatusCode).
+			Str("body", string(body)).
+			Msg("openai upstream error")
+
+		return nil, c.upstreamError(resp.StatusCode, body)
+	}
+
+	filterThink(resp, c.cfg.Model.ThinkMode)
+	return resp, nil
+}
+
+// formatRequest is req as the client sent it, less what only mo reads.
+// the model loses the upstream's prefix
+func (c *Client) formatRequest(req *domain.ChatRequest) ([]byte, error) {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal body: %w", err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("marshal body: %w", err)
+	}
+
+	for _, f := range moFields {
+		delete(body, f)
+	}
+	if !slices.Contains(c.up.Models, req.Model) {
+		body["model"] = strings.TrimPrefix(req.Model, c.up.ModelPrefix)
+	}
+	if req.Stream {
+		// the usage chunk spares counting tokens locally
+		body["stream_options"] = map[string]any{"include_usage": true}
+	}
+
+	return json.Marshal(body)
+}
+
+// upstreamError keeps what the client can act on, a 4xx about the request
+// or a rate limit, and turns the rest into a 502
+func (c *Client) upstreamError(status int, body []byte) error {
+	var reply struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &reply) != nil || reply.Error.Message == "" {
+		return domain.NewUpstreamError(status, c.Name()+" error")
+	}
+
+	code, _ := reply.Error.Code.(string)
+	if code == "" {
+		code = fmt.Sprintf("upstream_%d", status)
+	}
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+	default:
+		status = http.StatusBadGateway
+	}
+	return domain.NewAPIError(status, c.Name()+": "+reply.Error.Message).WithCode(code)
+}
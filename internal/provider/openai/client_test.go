@@ -0,0 +1,84 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestSupportsModel(t *testing.T) {
+	c := NewClient(&config.Config{}, config.OpenAIUpstream{Name: "local", Models: []string{"llama-3"}, ModelPrefix: "local/"})
+	assert.True(t, c.SupportsModel("llama-3"))
+	assert.True(t, c.SupportsModel("local/qwen2.5"))
+	assert.False(t, c.SupportsModel("local/"))
+	assert.False(t, c.SupportsModel("GLM-4-6-API-V1"))
+}
+
+func TestSendChatRequest(t *testing.T) {
+	var got map[string]any
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		header = r.Header
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}]}`)
+	}))
+	defer srv.Close()
+
+	c := NewClient(&config.Config{Model: config.ModelConfig{ThinkMode: "reasoning"}}, config.OpenAIUpstream{
+		Name:        "local",
+		BaseURL:     srv.URL + "/v1/",
+		APIKey:      "sk-local",
+		ModelPrefix: "local/",
+		Headers:     map[string]string{"X-Tenant": "mo"},
+	})
+	yes := true
+	resp, err := c.SendChatRequest(context.Background(), &domain.ChatRequest{
+		Model:    "local/qwen2.5",
+		Stream:   true,
+		Thinking: &yes,
+		Truncate: "auto",
+		// mo's own framing, upstream always streams sse
+		StreamFormat: "ndjson",
+		Messages:     []domain.Message{{Role: "user", Content: "hi"}},
+		MaxTokens:    new(int),
+	}, "chat-1")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "Bearer sk-local", header.Get("Authorization"))
+	assert.Equal(t, "mo", header.Get("X-Tenant"))
+	assert.Equal(t, "qwen2.5", got["model"], "the prefix only routes")
+	assert.Equal(t, float64(0), got["max_tokens"])
+	assert.Equal(t, map[string]any{"include_usage": true}, got["stream_options"])
+	assert.NotContains(t, got, "thinking")
+	assert.NotContains(t, got, "truncate")
+	assert.NotContains(t, got, "stream_format")
+}
+
+func TestUpstreamError(t *testing.T) {
+	c := NewClient(&config.Config{}, config.OpenAIUpstream{Name: "local"})
+
+	var apiErr *domain.APIError
+	require.True(t, errors.As(c.upstreamError(400, []byte(`{"error":{"message":"context too long","code":"context_length_exceeded"}}`)), &apiErr))
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, "local: context too long", apiErr.Message)
+	assert.Equal(t, "context_length_exceeded", *apiErr.Code)
+
+	require.True(t, errors.As(c.upstreamError(500, []byte(`{"error":{"message":"model crashed"}}`)), &apiErr))
+	assert.Equal(t, http.StatusBadGateway, apiErr.Status)
+	assert.Equal(t, "upstream_500", *apiErr.Code)
+
+	var upErr *domain.UpstreamError
+	assert.True(t, errors.As(c.upstreamError(503, []byte("loading model")), &upErr))
+}
@@ -0,0 +1,284 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	thinkOpen  = "<think>"
+	thinkClose = "</think>"
+)
+
+// thinkSplitter takes the <think> blocks reasoning models write into their
+// content out of it as it streams. a tag cut at the end of one delta is
+// held back until the next
+type thinkSplitter struct {
+	mode    string
+	inside  bool
+	pending string
+}
+
+// feed splits content into answer and reasoning. think_mode reasoning moves
+// the blocks to reasoning, the other modes leave them in the answer marked
+// up as they would be for z.ai
+func (s *thinkSplitter) feed(content string) (answer, reasoning string) {
+	content = s.pending + content
+	s.pending = ""
+
+	var a, r strings.Builder
+	for {
+		tag := thinkOpen
+		if s.inside {
+			tag = thinkClose
+		}
+		i := strings.Index(content, tag)
+		if i < 0 {
+			n := partialPrefix(content, tag)
+			s.pending = content[len(content)-n:]
+			s.emit(&a, &r, content[:len(content)-n])
+			break
+		}
+		s.emit(&a, &r, content[:i])
+		s.inside = !s.inside
+		a.WriteString(s.marker())
+		content = content[i+len(tag):]
+	}
+	return a.String(), r.String()
+}
+
+// flush gives up what feed held back, the stream ended
+func (s *thinkSplitter) flush() (answer, reasoning string) {
+	var a, r strings.Builder
+	s.emit(&a, &r, s.pending)
+	s.pending = ""
+	return a.String(), r.String()
+}
+
+func (s *thinkSplitter) emit(a, r *strings.Builder, text string) {
+	if s.inside && s.mode == "reasoning" {
+		r.WriteString(text)
+		return
+	}
+	a.WriteString(text)
+}
+
+// marker is what stands in for the tag just crossed
+func (s *thinkSplitter) marker() string {
+	switch s.mode {
+	case "reasoning", "strip":
+		return ""
+	case "think":
+		if s.inside {
+			return thinkOpen
+		}
+		return thinkClose
+	default:
+		if s.inside {
+			return "<reasoning>\n\n"
+		}
+		return "</reasoning>\n\n"
+	}
+}
+
+// partialPrefix is the length of the longest proper prefix of tag that s
+// ends with
+func partialPrefix(s, tag string) int {
+	for n := min(len(tag)-1, len(s)); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// filterThink rewrites the <think> blocks of resp's body for mode. think
+// is what upstream sends already, the body is left alone then
+func filterThink(resp *http.Response, mode string) {
+	if mode == "think" {
+		return
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = thinkStream(resp.Body, mode)
+	} else {
+		resp.Body = thinkMessage(resp.Body, mode)
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+}
+
+// splitters keeps a thinkSplitter per choice index
+type splitters struct {
+	mode string
+	byID map[float64]*thinkSplitter
+}
+
+func (s *splitters) get(choice map[string]any) *thinkSplitter {
+	i, _ := choice["index"].(float64)
+	sp, ok := s.byID[i]
+	if !ok {
+		sp = &thinkSplitter{mode: s.mode}
+		s.byID[i] = sp
+	}
+	return sp
+}
+
+// rewrite sets the answer of msg, a delta or a message, and adds the
+// reasoning to what upstream already sent of it
+func rewrite(msg map[string]any, answer, reasoning string) {
+	msg["content"] = answer
+	if reasoning != "" {
+		prev, _ := msg["reasoning_content"].(string)
+		msg["reasoning_content"] = prev + reasoning
+	}
+}
+
+// thinkStream rewrites the content of every event of an openai stream
+func thinkStream(body io.ReadCloser, mode string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	sp := &splitters{mode: mode, byID: make(map[float64]*thinkSplitter)}
+
+	go func() {
+		defer body.Close()
+		r := bufio.NewReaderSize(body, 64*1024)
+		for {
+			line, err := r.ReadString('\n')
+			if line != "" {
+				if _, werr := io.WriteString(pw, sp.event(line)); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					io.WriteString(pw, sp.tail())
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pipeBody{pr, body}
+}
+
+// pipeBody closes upstream along with the rewritten stream
+type pipeBody struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (b pipeBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
+
+// event rewrites one line of the stream, what is not a json event passes
+func (s *splitters) event(line string) string {
+	data, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "data:")
+	if !ok {
+		return line
+	}
+	if data = strings.TrimSpace(data); data == "[DONE]" {
+		return s.tail() + line
+	}
+
+	var ev map[string]any
+	if json.Unmarshal([]byte(data), &ev) != nil {
+		return line
+	}
+	choices, _ := ev["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		delta, _ := choice["delta"].(map[string]any)
+		if delta == nil {
+			continue
+		}
+		split := s.get(choice)
+		content, _ := delta["content"].(string)
+		answer, reasoning := split.feed(content)
+		if choice["finish_reason"] != nil {
+			a, r := split.flush()
+			answer, reasoning = answer+a, reasoning+r
+		}
+		if content != "" || answer != "" || reasoning != "" {
+			rewrite(delta, answer, reasoning)
+		}
+	}
+
+	out, err := marshal(ev)
+	if err != nil {
+		return line
+	}
+	return "data: " + string(out) + "\n"
+}
+
+// tail is an event with what the splitters still hold, "" when nothing
+func (s *splitters) tail() string {
+	var choices []map[string]any
+	for i, split := range s.byID {
+		answer, reasoning := split.flush()
+		if answer == "" && reasoning == "" {
+			continue
+		}
+		delta := map[string]any{}
+		rewrite(delta, answer, reasoning)
+		choices = append(choices, map[string]any{"index": i, "delta": delta})
+	}
+	if len(choices) == 0 {
+		return ""
+	}
+	out, _ := marshal(map[string]any{"object": "chat.completion.chunk", "choices": choices})
+	return "data: " + string(out) + "\n\n"
+}
+
+// thinkMessage rewrites the content of a whole reply
+func thinkMessage(body io.ReadCloser, mode string) io.ReadCloser {
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return io.NopCloser(io.MultiReader(bytes.NewReader(data), errReader{err}))
+	}
+
+	var reply map[string]any
+	if json.Unmarshal(data, &reply) != nil {
+		return io.NopCloser(bytes.NewReader(data))
+	}
+	choices, _ := reply["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		msg, _ := choice["message"].(map[string]any)
+		content, ok := msg["content"].(string)
+		if !ok {
+			continue
+		}
+		split := &thinkSplitter{mode: mode}
+		answer, reasoning := split.feed(content)
+		a, r := split.flush()
+		rewrite(msg, answer+a, reasoning+r)
+	}
+
+	out, err := marshal(reply)
+	if err != nil {
+		return io.NopCloser(bytes.NewReader(data))
+	}
+	return io.NopCloser(bytes.NewReader(out))
+}
+
+// marshal leaves html alone, content passes as upstream wrote it
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,84 @@
+package openai
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThinkSplitter(t *testing.T) {
+	// tags cut across deltas the way llama.cpp streams them
+	deltas := []string{"<th", "ink>pon", "der</thi", "nk>", "Answer <", "b>"}
+
+	tests := []struct {
+		mode      string
+		answer    string
+		reasoning string
+	}{
+		{"reasoning", "Answer <b>", "ponder"},
+		{"strip", "ponderAnswer <b>", ""},
+		{"think", "<think>ponder</think>Answer <b>", ""},
+		{"details", "<reasoning>\n\nponder</reasoning>\n\nAnswer <b>", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			s := &thinkSplitter{mode: tt.mode}
+			var answer, reasoning strings.Builder
+			for _, d := range deltas {
+				a, r := s.feed(d)
+				answer.WriteString(a)
+				reasoning.WriteString(r)
+			}
+			a, r := s.flush()
+			answer.WriteString(a)
+			reasoning.WriteString(r)
+
+			assert.Equal(t, tt.answer, answer.String())
+			assert.Equal(t, tt.reasoning, reasoning.String())
+		})
+	}
+}
+
+func TestFilterThinkStream(t *testing.T) {
+	upstream := `data: {"id":"c1","choices":[{"index":0,"delta":{"role":"assistant","content":"<think>mull"}}]}` + "\n\n" +
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":"ing</think>Hi"}}]}` + "\n\n" +
+		`: keepalive` + "\n\n" +
+		`data: {"id":"c1","choices":[{"index":0,"delta":{"content":" <"},"finish_reason":"stop"}]}` + "\n\n" +
+		`data: [DONE]` + "\n\n"
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"text/event-stream"}},
+		Body:   io.NopCloser(strings.NewReader(upstream)),
+	}
+	filterThink(resp, "reasoning")
+	out, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	want := `data: {"choices":[{"delta":{"content":"","reasoning_content":"mull","role":"assistant"},"index":0}],"id":"c1"}` + "\n\n" +
+		`data: {"choices":[{"delta":{"content":"Hi","reasoning_content":"ing"},"index":0}],"id":"c1"}` + "\n\n" +
+		`: keepalive` + "\n\n" +
+		`data: {"choices":[{"delta":{"content":" <"},"finish_reason":"stop","index":0}],"id":"c1"}` + "\n\n" +
+		`data: [DONE]` + "\n\n"
+	assert.Equal(t, want, string(out))
+}
+
+func TestFilterThinkMessage(t *testing.T) {
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   io.NopCloser(strings.NewReader(`{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"<think>\nhm\n</think>\n\n42"}}]}`)),
+	}
+	filterThink(resp, "reasoning")
+	out, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"c1","choices":[{"index":0,"message":{"role":"assistant","content":"\n\n42","reasoning_content":"\nhm\n"}}]}`, string(out))
+
+	// think mode is what upstream sends
+	resp.Body = io.NopCloser(strings.NewReader("<think>"))
+	filterThink(resp, "think")
+	out, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "<think>", string(out))
+}
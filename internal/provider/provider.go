@@ -1,13 +1,154 @@
 package provider
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/service/failover"
 )
 
+// ExpiringSoon is how close to expiry a credential gets flagged
+const ExpiringSoon = 10 * time.Minute
+
 type Provider interface {
 	Name() string
-	SendChatRequest(req *domain.ChatRequest, chatID string) (*http.Response, error)
+	// ctx carries the request logger
+	SendChatRequest(ctx context.Context, req *domain.ChatRequest, chatID string) (*http.Response, error)
 	SupportsModel(model string) bool
+	CredentialStatus() CredentialStatus
+}
+
+type CredentialStatus struct {
+	Provider     string    `json:"provider"`
+	Present      bool      `json:"present"`
+	Valid        bool      `json:"valid"`
+	ExpiringSoon bool      `json:"expiring_soon"`
+	Source       string    `json:"source,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	Detail       string    `json:"detail,omitempty"`
+	// the credential outlives ExpiresAt, it is refreshed on first use
+	Refreshable bool `json:"-"`
+}
+
+// Usable reports whether requests can be routed to the provider
+func (s CredentialStatus) Usable() bool {
+	return s.Present && s.Valid
+}
+
+// at re-checks the expiry of a status evaluated earlier against now
+func (s CredentialStatus) at(now time.Time) CredentialStatus {
+	if !s.Valid || s.ExpiresAt.IsZero() {
+		return s
+	}
+	if !now.Before(s.ExpiresAt) {
+		s.ExpiringSoon = false
+		if s.Refreshable {
+			s.Detail = "access token expired, will refresh"
+		} else {
+			s.Valid = false
+			s.Detail = "token expired"
+		}
+		return s
+	}
+	s.ExpiringSoon = s.ExpiresAt.Sub(now) < ExpiringSoon
+	return s
+}
+
+// TokenUser is a provider serving requests from a stored token
+type TokenUser interface {
+	// TokenID names the token requests currently go out with
+	TokenID() string
+}
+
+// TokenID is the token p currently uses, "" when it does not tell
+func TokenID(p Provider) string {
+	if u, ok := p.(TokenUser); ok {
+		return u.TokenID()
+	}
+	return ""
+}
+
+// ImageReader is implemented by providers where only some models read
+// images, the others take images on every model they support
+type ImageReader interface {
+	AcceptsImages(model string) bool
+	// VisionModel stands in for model on requests with images, "" when
+	// nothing does
+	VisionModel(model string) string
+}
+
+// ImageModel is the model p serves a request with images for model with:
+// model itself when it reads them, its vision stand-in, or "" for none
+func ImageModel(p Provider, model string) string {
+	r, ok := p.(ImageReader)
+	if !ok || r.AcceptsImages(model) {
+		return model
+	}
+	return r.VisionModel(model)
+}
+
+// ToolRunner is implemented by providers where only some models take
+// tools, the others take them on every model they support
+type ToolRunner interface {
+	AcceptsTools(model string) bool
+}
+
+// AcceptsTools reports whether p runs tool calls on model
+func AcceptsTools(p Provider, model string) bool {
+	if r, ok := p.(ToolRunner); ok {
+		return r.AcceptsTools(model)
+	}
+	return true
+}
+
+// AudioListener is implemented by providers that take input_audio parts as
+// they are, the others get them transcribed or refused
+type AudioListener interface {
+	AcceptsAudio(model string) bool
+}
+
+// AcceptsAudio reports whether p takes input_audio parts on model
+func AcceptsAudio(p Provider, model string) bool {
+	l, ok := p.(AudioListener)
+	return ok && l.AcceptsAudio(model)
+}
+
+// Thinker is implemented by providers whose models may reason before they
+// answer, the others are not known to
+type Thinker interface {
+	Thinks(model string) bool
+}
+
+// Thinks reports whether model of p reasons before answering
+func Thinks(p Provider, model string) bool {
+	t, ok := p.(Thinker)
+	return ok && t.Thinks(model)
+}
+
+// HostFailover is implemented by providers that spread requests over
+// several upstream hosts
+type HostFailover interface {
+	Hosts() []failover.HostStatus
+}
+
+// Hosts is the host state of p, nil when it has a single fixed upstream
+func Hosts(p Provider) []failover.HostStatus {
+	if f, ok := p.(HostFailover); ok {
+		return f.Hosts()
+	}
+	return nil
+}
+
+// OpenAIReplier is implemented by providers whose upstream answers in the
+// openai chat completion shape, the others need their replies translated
+type OpenAIReplier interface {
+	RepliesOpenAI()
+}
+
+// RepliesOpenAI reports whether p's replies are openai chat completions
+func RepliesOpenAI(p Provider) bool {
+	_, ok := p.(OpenAIReplier)
+	return ok
 }
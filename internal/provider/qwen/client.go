@@ -2,39 +2,76 @@ package qwen
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/domain"
 	"github.com/zarazaex69/mo/internal/pkg/httpclient"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
 	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/provider"
 )
 
 const (
 	BaseURL = "https://portal.qwen.ai/v1"
 )
 
+var log = logger.Module("qwen")
+
 var supportedModels = []string{
-	"coder-model",
-	"vision-model",
+	generalModel,
+	visionModel,
 }
 
 type Client struct {
+	cfg   *config.Config
 	store *tokenstore.Store
+	// api root for tokens without a resource url
+	baseURL  string
+	tokenURL string
+	refresh  refresher
+
+	// background refresh, only RunRefresh touches plans
+	plans    map[string]*refreshPlan
+	now      func() time.Time
+	jitter   func() float64
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-func NewClient(store *tokenstore.Store) *Client {
-	return &Client{store: store}
+func NewClient(cfg *config.Config, store *tokenstore.Store) *Client {
+	return &Client{
+		cfg:      cfg,
+		store:    store,
+		baseURL:  BaseURL,
+		tokenURL: OAuthTokenURL,
+		plans:    make(map[string]*refreshPlan),
+		now:      time.Now,
+		jitter:   rand.Float64,
+		stop:     make(chan struct{}),
+	}
 }
 
 func (c *Client) Name() string {
 	return "qwen"
 }
 
+// RepliesOpenAI marks qwen replies as openai chat completions
+func (c *Client) RepliesOpenAI() {}
+
+// SupportedModels lists the models qwen serves
+func SupportedModels() []string {
+	return append([]string(nil), supportedModels...)
+}
+
 func (c *Client) SupportsModel(model string) bool {
 	for _, m := range supportedModels {
 		if m == model {
@@ -44,24 +81,76 @@ func (c *Client) SupportsModel(model string) bool {
 	return false
 }
 
-func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.Response, error) {
+func (c *Client) CredentialStatus() provider.CredentialStatus {
+	st := provider.CredentialStatus{Provider: c.Name(), Source: "store"}
+
+	active, err := c.store.GetActiveByProvider("qwen")
+	if err != nil {
+		st.Detail = "token store: " + err.Error()
+		return st
+	}
+	if active == nil {
+		st.Source = ""
+		st.Detail = "no active qwen token"
+		return st
+	}
+
+	st.Present = true
+	st.ExpiresAt = time.UnixMilli(active.ExpiryDate)
+	st.Refreshable = active.RefreshToken != ""
+
+	if !IsTokenExpired(active.ExpiryDate) {
+		st.Valid = true
+		st.ExpiringSoon = time.Until(st.ExpiresAt) < provider.ExpiringSoon
+		return st
+	}
+
+	// expired access tokens are refreshed on first use
+	st.Valid = st.Refreshable
+	if st.Valid {
+		st.Detail = "access token expired, will refresh"
+	} else {
+		st.Detail = "access token expired, no refresh token"
+	}
+	return st
+}
+
+// TokenID is the id of the active qwen token
+func (c *Client) TokenID() string {
+	if active, _ := c.store.GetActiveByProvider("qwen"); active != nil {
+		return active.ID
+	}
+	return ""
+}
+
+func (c *Client) SendChatRequest(ctx context.Context, req *domain.ChatRequest, chatID string) (*http.Response, error) {
+	return c.send(ctx, req, true)
+}
+
+// send posts req once, retry allows one more attempt after refreshing a
+// token upstream turned down
+func (c *Client) send(ctx context.Context, req *domain.ChatRequest, retry bool) (*http.Response, error) {
 	token, err := c.getValidToken()
 	if err != nil {
 		return nil, fmt.Errorf("get token: %w", err)
 	}
 
-	body := c.formatRequest(req)
+	body, err := c.formatRequest(req)
+	if err != nil {
+		return nil, err
+	}
 	bodyBytes, err := json.Marshal(body)
 	if err != nil {
 		return nil, fmt.Errorf("marshal body: %w", err)
 	}
 
-	apiURL := BaseURL + "/chat/completions"
+	apiURL := c.apiBase(token) + "/chat/completions"
 
-	logger.Debug().
+	log.Ctx(ctx).Debug().
 		Str("url", apiURL).
-		Str("model", req.Model).
+		Str("reasoning_effort", req.ReasoningEffort).
 		Msg("qwen request")
+	log.Raw(ctx).RawJSON("body", bodyBytes).Msg("request body")
 
 	httpReq, err := http.NewRequest("POST", apiURL, bytes.NewReader(bodyBytes))
 	if err != nil {
@@ -69,7 +158,7 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+token)
+	httpReq.Header.Set("Authorization", "Bearer "+token.Token)
 
 	client := httpclient.New(0)
 	resp, err := client.Do(httpReq)
@@ -77,86 +166,86 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 		return nil, fmt.Errorf("send request: %w", err)
 	}
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		resp.Body.Close()
-		logger.Info().Msg("token expired, refreshing...")
-
-		if err := c.refreshActiveToken(); err != nil {
-			return nil, fmt.Errorf("refresh token: %w", err)
-		}
-
-		return c.SendChatRequest(req, chatID)
-	}
-
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 
-		if strings.Contains(string(body), "invalid access token") || strings.Contains(string(body), "token expired") {
-			logger.Info().Msg("token invalid, refreshing...")
+		rejected := resp.StatusCode == http.StatusUnauthorized ||
+			strings.Contains(string(body), "invalid access token") || strings.Contains(string(body), "token expired")
+		if rejected && retry {
+			log.Ctx(ctx).Info().Int("status", resp.StatusCode).Msg("token rejected, refreshing...")
 
-			if err := c.refreshActiveToken(); err != nil {
+			if err := c.refreshActiveToken(token.Token); err != nil {
 				return nil, fmt.Errorf("refresh token: %w", err)
 			}
 
-			return c.SendChatRequest(req, chatID)
+			return c.send(ctx, req, false)
 		}
 
-		logger.Error().
+		log.Ctx(ctx).Error().
 			Int("status", resp.StatusCode).
 			Str("body", string(body)).
 			Msg("qwen error")
 
-		return nil, domain.NewUpstreamError(resp.StatusCode, "qwen error")
+		return nil, upstreamError(resp.StatusCode, body)
 	}
 
 	return resp, nil
 }
 
-func (c *Client) getValidToken() (string, error) {
+func (c *Client) getValidToken() (*tokenstore.Token, error) {
 	active, err := c.store.GetActiveByProvider("qwen")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if active == nil {
-		return "", fmt.Errorf("no active qwen token")
+		return nil, fmt.Errorf("no active qwen token")
 	}
 
 	if IsTokenExpired(active.ExpiryDate) {
-		logger.Info().Msg("token expired, refreshing...")
-		if err := c.refreshActiveToken(); err != nil {
-			return "", err
+		log.Info().Msg("token expired, refreshing...")
+		if err := c.refreshActiveToken(active.Token); err != nil {
+			return nil, err
+		}
+		active, err = c.store.GetByID(active.ID)
+		if err != nil {
+			return nil, err
 		}
-		active, _ = c.store.GetActiveByProvider("qwen")
 	}
 
-	return active.Token, nil
+	return active, nil
 }
 
-func (c *Client) refreshActiveToken() error {
-	active, err := c.store.GetActiveByProvider("qwen")
-	if err != nil || active == nil {
-		return fmt.Errorf("no active qwen token")
+// apiBase is the api root of the host oauth assigned the account of
+// token, qwen hands it out as a bare host or a url, with or without /v1
+func (c *Client) apiBase(token *tokenstore.Token) string {
+	base := strings.TrimRight(token.ResourceURL, "/")
+	if base == "" {
+		return c.baseURL
 	}
-
-	newToken, err := RefreshToken(active.RefreshToken)
-	if err != nil {
-		return err
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		base = "https://" + base
 	}
-
-	active.Token = newToken.AccessToken
-	active.RefreshToken = newToken.RefreshToken
-	active.ExpiryDate = newToken.ExpiryDate
-
-	return c.store.Update(active)
+	if !strings.HasSuffix(base, "/v1") {
+		base += "/v1"
+	}
+	return base
 }
 
-func (c *Client) formatRequest(req *domain.ChatRequest) map[string]any {
+func (c *Client) formatRequest(req *domain.ChatRequest) (map[string]any, error) {
+	messages, err := c.formatMessages(req.Model, req.Messages)
+	if err != nil {
+		return nil, err
+	}
 	result := map[string]any{
 		"model":    req.Model,
-		"messages": c.formatMessages(req.Messages),
+		"messages": messages,
 		"stream":   req.Stream,
 	}
+	if req.Stream {
+		// the usage chunk spares counting tokens locally
+		result["stream_options"] = map[string]any{"include_usage": true}
+	}
 
 	if req.Temperature != nil {
 		result["temperature"] = *req.Temperature
@@ -167,26 +256,51 @@ func (c *Client) formatRequest(req *domain.ChatRequest) map[string]any {
 	if req.TopP != nil {
 		result["top_p"] = *req.TopP
 	}
+	if req.Seed != nil {
+		result["seed"] = *req.Seed
+	}
+	if req.FrequencyPenalty != nil {
+		result["frequency_penalty"] = *req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		result["presence_penalty"] = *req.PresencePenalty
+	}
+	if req.ReasoningEffort != "" {
+		result["reasoning_effort"] = req.ReasoningEffort
+	}
 
 	if len(req.Tools) > 0 && isToolsSupported(req.Model) {
 		result["tools"] = req.Tools
+		if req.ParallelToolCalls != nil {
+			result["parallel_tool_calls"] = *req.ParallelToolCalls
+		}
+	}
+	if req.ResponseFormat != nil {
+		result["response_format"] = req.ResponseFormat
 	}
 
-	return result
+	return result, nil
 }
 
-func (c *Client) formatMessages(msgs []domain.Message) []map[string]any {
+func (c *Client) formatMessages(model string, msgs []domain.Message) ([]map[string]any, error) {
 	var result []map[string]any
 
-	for _, msg := range msgs {
+	for i, msg := range msgs {
 		m := map[string]any{"role": msg.Role}
 
 		if s, ok := msg.Content.(string); ok {
 			m["content"] = s
 		} else if arr, ok := msg.Content.([]any); ok {
-			m["content"] = arr
+			parts, err := c.formatParts(model, i, arr)
+			if err != nil {
+				return nil, err
+			}
+			m["content"] = parts
 		}
 
+		if msg.Name != "" {
+			m["name"] = msg.Name
+		}
 		if msg.ToolCallID != "" {
 			m["tool_call_id"] = msg.ToolCallID
 		}
@@ -197,9 +311,14 @@ func (c *Client) formatMessages(msgs []domain.Message) []map[string]any {
 		result = append(result, m)
 	}
 
-	return result
+	return result, nil
+}
+
+// AcceptsTools is true on the models tools are sent upstream for
+func (c *Client) AcceptsTools(model string) bool {
+	return isToolsSupported(model)
 }
 
 func isToolsSupported(model string) bool {
-	return model == "coder-model" || model == "vision-model"
+	return model == generalModel || model == visionModel
 }
@@ -0,0 +1,179 @@
+package qwen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+func format(t *testing.T, c *Client, req *domain.ChatRequest) map[string]any {
+	t.Helper()
+	body, err := c.formatRequest(req)
+	require.NoError(t, err)
+	return body
+}
+
+func TestFormatRequestReasoningEffort(t *testing.T) {
+	c := &Client{}
+	off := false
+
+	body := format(t, c, &domain.ChatRequest{
+		Model:           "coder-model",
+		Messages:        []domain.Message{{Role: "user", Content: "hi"}},
+		ReasoningEffort: "low",
+		Thinking:        &off,
+	})
+	// qwen speaks openai, the effort goes out as the client sent it
+	assert.Equal(t, "low", body["reasoning_effort"])
+	assert.NotContains(t, body, "thinking")
+
+	body = format(t, c, &domain.ChatRequest{Model: "coder-model", Messages: []domain.Message{{Role: "user", Content: "hi"}}})
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "reasoning_effort")
+}
+
+func TestFormatRequestPenalties(t *testing.T) {
+	c := &Client{}
+	frequency, presence := 1.2, -0.4
+
+	body := format(t, c, &domain.ChatRequest{
+		Model:            "coder-model",
+		Messages:         []domain.Message{{Role: "user", Content: "hi"}},
+		FrequencyPenalty: &frequency,
+		PresencePenalty:  &presence,
+	})
+	assert.Equal(t, 1.2, body["frequency_penalty"])
+	assert.Equal(t, -0.4, body["presence_penalty"])
+
+	body = format(t, c, &domain.ChatRequest{Model: "coder-model", Messages: []domain.Message{{Role: "user", Content: "hi"}}})
+	assert.NotContains(t, body, "frequency_penalty")
+	assert.NotContains(t, body, "presence_penalty")
+}
+
+func TestFormatRequestParallelToolCalls(t *testing.T) {
+	c := &Client{}
+	off := false
+	tools := []domain.Tool{{Type: "function", Function: domain.ToolFunction{Name: "get_weather"}}}
+
+	body := format(t, c, &domain.ChatRequest{Model: "coder-model", Messages: []domain.Message{{Role: "user", Content: "hi"}}, Tools: tools, ParallelToolCalls: &off})
+	assert.Equal(t, false, body["parallel_tool_calls"])
+
+	body = format(t, c, &domain.ChatRequest{Model: "coder-model", Messages: []domain.Message{{Role: "user", Content: "hi"}}, Tools: tools})
+	assert.NotContains(t, body, "parallel_tool_calls")
+}
+
+func TestAPIBase(t *testing.T) {
+	c := &Client{baseURL: BaseURL}
+	for resource, want := range map[string]string{
+		"":                             BaseURL,
+		"portal.qwen.ai":               "https://portal.qwen.ai/v1",
+		"dashscope.example/":           "https://dashscope.example/v1",
+		"https://dashscope.example/v1": "https://dashscope.example/v1",
+		"http://127.0.0.1:8080":        "http://127.0.0.1:8080/v1",
+	} {
+		assert.Equal(t, want, c.apiBase(&tokenstore.Token{ResourceURL: resource}), resource)
+	}
+}
+
+// chatServer answers chat completions with status and counts the calls
+func chatServer(t *testing.T, status int, calls *atomic.Int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"choices": []}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSendChatRequestResourceURL(t *testing.T) {
+	var assigned, fallback atomic.Int32
+	assignedSrv := chatServer(t, http.StatusOK, &assigned)
+	fallbackSrv := chatServer(t, http.StatusOK, &fallback)
+
+	c := clientExpiringAt(t, "", time.Now().Add(time.Hour))
+	c.baseURL = fallbackSrv.URL + "/v1"
+	req := &domain.ChatRequest{Model: generalModel, Messages: []domain.Message{{Role: "user", Content: "hi"}}}
+
+	resp, err := c.SendChatRequest(context.Background(), req, "")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(1), fallback.Load(), "without a resource url the default host")
+
+	active, err := c.store.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	active.ResourceURL = assignedSrv.URL + "/"
+	require.NoError(t, c.store.Update(active))
+
+	resp, err = c.SendChatRequest(context.Background(), req, "")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(1), assigned.Load(), "the host assigned to the account")
+	assert.Equal(t, int32(1), fallback.Load())
+}
+
+func TestSendChatRequestRetriesOnce(t *testing.T) {
+	var chats, refreshes atomic.Int32
+	srv := chatServer(t, http.StatusUnauthorized, &chats)
+
+	c := clientExpiringAt(t, fakeOAuth(t, &refreshes, srv.URL).URL, time.Now().Add(time.Hour))
+	c.baseURL = srv.URL + "/v1"
+
+	_, err := c.SendChatRequest(context.Background(), &domain.ChatRequest{Model: generalModel, Messages: []domain.Message{{Role: "user", Content: "hi"}}}, "")
+	require.Error(t, err)
+	assert.Equal(t, int32(2), chats.Load(), "one retry after the refresh, not a loop")
+	assert.Equal(t, int32(1), refreshes.Load())
+}
+
+func TestUpstreamError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"openai shape", 400, `{"error": {"message": "max_tokens is too large", "type": "invalid_request_error", "code": "invalid_parameter"}}`, 400, "invalid_parameter"},
+		{"dashscope shape", 400, `{"code": "DataInspectionFailed", "message": "Input data may contain inappropriate content."}`, 400, "DataInspectionFailed"},
+		{"throttled", 429, `{"error": {"message": "Requests rate limit exceeded", "code": "Throttling.RateQuota"}}`, 429, "Throttling.RateQuota"},
+		{"quota on a 403", 403, `{"error": {"message": "free quota used up", "code": "insufficient_quota"}}`, 429, "insufficient_quota"},
+		{"unknown model", 404, `{"error": {"message": "model not found", "type": "invalid_request_error", "code": null}}`, 404, "invalid_request_error"},
+		{"qwen down", 500, `{"code": "InternalError", "message": "internal error"}`, 502, "InternalError"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var apiErr *domain.APIError
+			require.ErrorAs(t, upstreamError(tt.status, []byte(tt.body)), &apiErr)
+			assert.Equal(t, tt.wantStatus, apiErr.Status)
+			assert.Equal(t, tt.wantCode, *apiErr.Code)
+			assert.True(t, strings.HasPrefix(apiErr.Message, "qwen: "))
+		})
+	}
+
+	var ue *domain.UpstreamError
+	require.ErrorAs(t, upstreamError(502, []byte("<html>bad gateway</html>")), &ue, "bodies that are not json stay opaque")
+	assert.Equal(t, 502, ue.StatusCode)
+}
+
+func TestFormatRequestStreamUsage(t *testing.T) {
+	c := &Client{}
+	body := format(t, c, &domain.ChatRequest{Model: generalModel, Stream: true, Messages: []domain.Message{{Role: "user", Content: "hi"}}})
+	assert.Equal(t, map[string]any{"include_usage": true}, body["stream_options"])
+
+	body = format(t, c, &domain.ChatRequest{Model: generalModel, Messages: []domain.Message{{Role: "user", Content: "hi"}}})
+	assert.NotContains(t, body, "stream_options")
+}
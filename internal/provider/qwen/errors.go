@@ -0,0 +1,72 @@
+package qwen
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// upstreamError turns a qwen error reply into the openai error it means for
+// the client. qwen answers in the openai shape, {"error": {...}}, or the
+// dashscope one, {"code": ..., "message": ...}. bodies that are neither
+// stay an opaque upstream error
+func upstreamError(status int, body []byte) error {
+	var reply struct {
+		Error *struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &reply) != nil {
+		return domain.NewUpstreamError(status, "qwen error")
+	}
+
+	code, message := reply.Code, reply.Message
+	if e := reply.Error; e != nil {
+		message = e.Message
+		switch c := e.Code.(type) {
+		case string:
+			code = c
+		case float64:
+			code = fmt.Sprint(c)
+		default:
+			code = e.Type
+		}
+	}
+	if message == "" {
+		return domain.NewUpstreamError(status, "qwen error")
+	}
+
+	apiErr := domain.NewAPIError(errorStatus(status, code), "qwen: "+message)
+	if code != "" {
+		apiErr.WithCode(code)
+	} else {
+		apiErr.WithCode(fmt.Sprintf("upstream_%d", status))
+	}
+	return apiErr
+}
+
+// errorStatus is the status the client gets: what is wrong with the
+// request stays a 4xx, trouble with our credentials or qwen itself is a 502
+func errorStatus(status int, code string) int {
+	lower := strings.ToLower(code)
+	switch {
+	case status == http.StatusTooManyRequests, strings.HasPrefix(lower, "throttling"),
+		lower == "rate_limit_exceeded", lower == "insufficient_quota":
+		return http.StatusTooManyRequests
+	case lower == "data_inspection_failed", lower == "datainspectionfailed":
+		return http.StatusBadRequest
+	case status == http.StatusNotFound, lower == "model_not_found":
+		return http.StatusNotFound
+	case status == http.StatusBadRequest, status == http.StatusRequestEntityTooLarge:
+		return status
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -1,13 +1,15 @@
 package qwen
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
 	"github.com/zarazaex69/mo/internal/domain"
-	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/sse"
 )
 
 type QwenResponse struct {
@@ -17,6 +19,8 @@ type QwenResponse struct {
 	Model   string        `json:"model"`
 	Choices []QwenChoice  `json:"choices"`
 	Usage   *domain.Usage `json:"usage,omitempty"`
+	// the sse event name, "" for plain data events
+	Event string `json:"-"`
 }
 
 type QwenChoice struct {
@@ -27,53 +31,186 @@ type QwenChoice struct {
 }
 
 type QwenMessage struct {
-	Role      string            `json:"role,omitempty"`
-	Content   string            `json:"content,omitempty"`
-	ToolCalls []domain.ToolCall `json:"tool_calls,omitempty"`
+	Role             string            `json:"role,omitempty"`
+	Content          string            `json:"content,omitempty"`
+	ReasoningContent string            `json:"reasoning_content,omitempty"`
+	ToolCalls        []domain.ToolCall `json:"tool_calls,omitempty"`
 }
 
-func ParseSSEStream(resp *http.Response) <-chan *QwenResponse {
+// ParseSSEStream decodes qwen events, ctx carries the request logger
+func ParseSSEStream(ctx context.Context, resp *http.Response) <-chan *QwenResponse {
 	ch := make(chan *QwenResponse)
 
 	go func() {
 		defer close(ch)
 
-		scanner := bufio.NewScanner(resp.Body)
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
-
-		for scanner.Scan() {
-			line := scanner.Text()
-			if len(line) == 0 || !strings.HasPrefix(line, "data: ") {
-				continue
+		events := sse.NewReader(resp.Body)
+		for {
+			ev, err := events.Next()
+			if err != nil {
+				if err != io.EOF {
+					log.Ctx(ctx).Error().Err(err).Msg("qwen sse read error")
+				}
+				return
 			}
 
-			data := line[6:]
+			data := ev.Data
 			if strings.TrimSpace(data) == "[DONE]" {
 				continue
 			}
 
+			log.Raw(ctx).Str("event", ev.Name).Str("data", data).Msg("qwen sse")
+			if ev.Name == "error" {
+				log.Ctx(ctx).Warn().Str("data", data).Msg("qwen sent an error event")
+			}
 			var qwenResp QwenResponse
 			if err := json.Unmarshal([]byte(data), &qwenResp); err != nil {
-				logger.Debug().Err(err).Str("data", data).Msg("parse qwen sse failed")
+				log.Ctx(ctx).Debug().Err(err).Str("data", data).Msg("parse qwen sse failed")
 				continue
 			}
+			qwenResp.Event = ev.Name
 
 			ch <- &qwenResp
 		}
-
-		if err := scanner.Err(); err != nil {
-			logger.Error().Err(err).Msg("qwen sse read error")
-		}
 	}()
 
 	return ch
 }
 
-func ParseNonStreamResponse(resp *http.Response) (*QwenResponse, error) {
+// ParseNonStreamResponse decodes a whole reply. qwen sometimes streams
+// one anyway, its events are folded into a single message then
+func ParseNonStreamResponse(ctx context.Context, resp *http.Response) (*QwenResponse, error) {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return collectStream(ctx, resp)
+	}
+
 	var qwenResp QwenResponse
 	if err := json.NewDecoder(resp.Body).Decode(&qwenResp); err != nil {
 		return nil, err
 	}
 	return &qwenResp, nil
 }
+
+func collectStream(ctx context.Context, resp *http.Response) (*QwenResponse, error) {
+	var (
+		merged    *QwenResponse
+		content   strings.Builder
+		reasoning strings.Builder
+		calls     ToolCallDeltas
+		finish    *string
+	)
+	for ev := range ParseSSEStream(ctx, resp) {
+		if merged == nil {
+			merged = &QwenResponse{ID: ev.ID, Object: "chat.completion", Created: ev.Created, Model: ev.Model}
+		}
+		if ev.Usage != nil {
+			merged.Usage = ev.Usage
+		}
+		for _, choice := range ev.Choices {
+			if choice.Delta != nil {
+				content.WriteString(choice.Delta.Content)
+				reasoning.WriteString(choice.Delta.ReasoningContent)
+				calls.Add(choice.Delta.ToolCalls)
+			}
+			if choice.FinishReason != nil {
+				finish = choice.FinishReason
+			}
+		}
+	}
+	if merged == nil {
+		return nil, fmt.Errorf("empty event stream")
+	}
+
+	merged.Choices = []QwenChoice{{
+		Message: &QwenMessage{
+			Role:             "assistant",
+			Content:          content.String(),
+			ReasoningContent: reasoning.String(),
+			ToolCalls:        calls.Calls(),
+		},
+		FinishReason: finish,
+	}}
+	return merged, nil
+}
+
+// finishReasons maps how qwen and dashscope end a choice onto openai
+var finishReasons = map[string]string{
+	"stop":                   "stop",
+	"length":                 "length",
+	"tool_calls":             "tool_calls",
+	"content_filter":         "content_filter",
+	"function_call":          "tool_calls",
+	"max_tokens":             "length",
+	"sensitive":              "content_filter",
+	"data_inspection_failed": "content_filter",
+}
+
+// FinishReason is the openai finish reason for reason, "stop" for ones
+// openai has no counterpart of
+func FinishReason(reason string) string {
+	if r, ok := finishReasons[reason]; ok {
+		return r
+	}
+	return "stop"
+}
+
+// ToolCallDeltas merges streamed tool call fragments into whole calls. the
+// first fragment of a call carries its id and name, later ones with the
+// same index add to its arguments
+type ToolCallDeltas struct {
+	calls   []domain.ToolCall
+	byIndex map[int]int
+}
+
+func (d *ToolCallDeltas) Add(deltas []domain.ToolCall) {
+	for _, delta := range deltas {
+		i, ok := d.position(delta)
+		if !ok {
+			call := delta
+			call.Index = nil
+			d.calls = append(d.calls, call)
+			if delta.Index != nil {
+				if d.byIndex == nil {
+					d.byIndex = make(map[int]int)
+				}
+				d.byIndex[*delta.Index] = len(d.calls) - 1
+			}
+			continue
+		}
+
+		call := &d.calls[i]
+		if call.ID == "" {
+			call.ID = delta.ID
+		}
+		if call.Type == "" {
+			call.Type = delta.Type
+		}
+		if call.Function.Name == "" {
+			call.Function.Name = delta.Function.Name
+		}
+		call.Function.Arguments += delta.Function.Arguments
+	}
+}
+
+// position finds the call a fragment continues. without an index a
+// fragment with an id starts a call and one without continues the last
+func (d *ToolCallDeltas) position(delta domain.ToolCall) (int, bool) {
+	if delta.Index != nil {
+		i, ok := d.byIndex[*delta.Index]
+		return i, ok
+	}
+	if delta.ID != "" || len(d.calls) == 0 {
+		return 0, false
+	}
+	return len(d.calls) - 1, true
+}
+
+// Calls are the calls merged so far, in the order they started
+func (d *ToolCallDeltas) Calls() []domain.ToolCall {
+	for i := range d.calls {
+		if d.calls[i].Type == "" {
+			d.calls[i].Type = "function"
+		}
+	}
+	return d.calls
+}
@@ -0,0 +1,87 @@
+package qwen
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func index(i int) *int { return &i }
+
+func TestToolCallDeltas(t *testing.T) {
+	var d ToolCallDeltas
+	d.Add([]domain.ToolCall{{Index: index(0), ID: "call_a", Type: "function", Function: domain.FunctionCall{Name: "search", Arguments: `{"q":`}}})
+	d.Add([]domain.ToolCall{{Index: index(1), ID: "call_b", Function: domain.FunctionCall{Name: "fetch"}}})
+	d.Add([]domain.ToolCall{{Index: index(0), Function: domain.FunctionCall{Arguments: `"go"}`}}})
+	d.Add([]domain.ToolCall{{Index: index(1), Function: domain.FunctionCall{Arguments: `{}`}}})
+
+	assert.Equal(t, []domain.ToolCall{
+		{ID: "call_a", Type: "function", Function: domain.FunctionCall{Name: "search", Arguments: `{"q":"go"}`}},
+		{ID: "call_b", Type: "function", Function: domain.FunctionCall{Name: "fetch", Arguments: `{}`}},
+	}, d.Calls())
+
+	// fragments without an index continue the call they follow
+	var plain ToolCallDeltas
+	plain.Add([]domain.ToolCall{{ID: "call_c", Function: domain.FunctionCall{Name: "run", Arguments: `{"cmd"`}}})
+	plain.Add([]domain.ToolCall{{Function: domain.FunctionCall{Arguments: `:"ls"}`}}})
+	assert.Equal(t, `{"cmd":"ls"}`, plain.Calls()[0].Function.Arguments)
+}
+
+func TestFinishReason(t *testing.T) {
+	for reason, want := range map[string]string{
+		"stop":                   "stop",
+		"length":                 "length",
+		"tool_calls":             "tool_calls",
+		"function_call":          "tool_calls",
+		"max_tokens":             "length",
+		"data_inspection_failed": "content_filter",
+		"null":                   "stop",
+		"":                       "stop",
+	} {
+		assert.Equal(t, want, FinishReason(reason), reason)
+	}
+}
+
+func TestParseNonStreamResponseFoldsEvents(t *testing.T) {
+	sse := `data: {"id":"q1","created":7,"model":"coder-model","choices":[{"delta":{"role":"assistant","content":"Hel"}}]}` + "\n\n" +
+		`data: {"id":"q1","created":7,"model":"coder-model","choices":[{"delta":{"content":"lo"},"finish_reason":"length"}]}` + "\n\n" +
+		`data: {"id":"q1","created":7,"model":"coder-model","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}` + "\n\n" +
+		"data: [DONE]\n\n"
+	resp := &http.Response{
+		Header: http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}},
+		Body:   io.NopCloser(strings.NewReader(sse)),
+	}
+
+	got, err := ParseNonStreamResponse(context.Background(), resp)
+	require.NoError(t, err)
+	assert.Equal(t, "q1", got.ID)
+	assert.Equal(t, int64(7), got.Created)
+	require.Len(t, got.Choices, 1)
+	assert.Equal(t, "Hello", got.Choices[0].Message.Content)
+	assert.Equal(t, "length", *got.Choices[0].FinishReason)
+	assert.Equal(t, &domain.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}, got.Usage)
+}
+
+func TestParseSSEStreamFraming(t *testing.T) {
+	sse := ": keep-alive\r\n\r\n" +
+		`data: {"id":"q1","choices":[{"delta":{"content":"Hel"}}]}` + "\r\n\r\n" +
+		"event: result\r\n" +
+		`data: {"id":"q1","choices":[{"delta":` + "\r\n" +
+		`data: {"content":"lo"}}]}` + "\r\n\r\n" +
+		"data: [DONE]\r\n\r\n"
+
+	var content []string
+	var names []string
+	for ev := range ParseSSEStream(context.Background(), &http.Response{Body: io.NopCloser(strings.NewReader(sse))}) {
+		content = append(content, ev.Choices[0].Delta.Content)
+		names = append(names, ev.Event)
+	}
+	assert.Equal(t, []string{"Hel", "lo"}, content)
+	assert.Equal(t, []string{"", "result"}, names)
+}
@@ -0,0 +1,171 @@
+package qwen
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+const (
+	visionModel = "vision-model"
+	// the general model, image requests to it go to visionModel
+	generalModel = "coder-model"
+
+	// images are not scaled below this while chasing image_max_bytes
+	minImageSide = 256
+	jpegQuality  = 85
+	// largest image decoded for scaling, a few kilobytes of png can declare
+	// gigabytes of pixels
+	maxImagePixels = 50 << 20
+)
+
+var errImagePixels = errors.New("image has too many pixels")
+
+// AcceptsImages reports whether model reads image_url parts
+func (c *Client) AcceptsImages(model string) bool {
+	return model == visionModel
+}
+
+// VisionModel is vision-model for the general model, the one a client
+// that did not pick a model ends up on
+func (c *Client) VisionModel(model string) string {
+	if model == generalModel || model == visionModel {
+		return visionModel
+	}
+	return ""
+}
+
+// formatParts checks the content parts of message i against model and
+// scales down images that are too large. the request keeps its parts,
+// changed ones are copies
+func (c *Client) formatParts(model string, i int, parts []any) ([]any, error) {
+	out := make([]any, len(parts))
+	for j, item := range parts {
+		out[j] = item
+		part, _ := item.(map[string]any)
+		param := fmt.Sprintf("messages[%d].content[%d]", i, j)
+
+		switch typ, _ := part["type"].(string); typ {
+		case "text":
+		case "image_url":
+			if !c.AcceptsImages(model) {
+				return nil, domain.NewAPIError(http.StatusBadRequest, fmt.Sprintf("model %s does not accept images, use %s", model, visionModel)).
+					WithParam(param).WithCode("model_not_vision")
+			}
+			img, _ := part["image_url"].(map[string]any)
+			url, _ := img["url"].(string)
+			if url == "" {
+				return nil, domain.NewAPIError(http.StatusBadRequest, "image_url part without a url").
+					WithParam(param).WithCode("invalid_image_url")
+			}
+
+			small, ok, err := shrinkImage(url, c.cfg.Qwen.ImageMaxBytes, c.cfg.Qwen.ImageMaxSide)
+			if err != nil {
+				return nil, domain.NewAPIError(http.StatusRequestEntityTooLarge, fmt.Sprintf("image is over %d pixels", maxImagePixels)).
+					WithParam(param).WithCode("image_too_large")
+			}
+			if !ok {
+				continue
+			}
+			log.Debug().Int("from", len(url)).Int("to", len(small)).Msg("image scaled down")
+			scaled := map[string]any{"url": small}
+			if detail, ok := img["detail"]; ok {
+				scaled["detail"] = detail
+			}
+			out[j] = map[string]any{"type": "image_url", "image_url": scaled}
+		default:
+			return nil, domain.NewAPIError(http.StatusBadRequest, fmt.Sprintf("content part type %q is not supported by %s, expected text or image_url", typ, model)).
+				WithParam(param).WithCode("unsupported_content_part")
+		}
+	}
+	return out, nil
+}
+
+// shrinkImage re-encodes a base64 data url longer than maxBytes as a jpeg
+// of at most maxSide pixels, halving the size until it fits. remote urls
+// are fetched by qwen itself, images go as they are when maxBytes is 0 or
+// they cannot be decoded. ok reports a changed url, errImagePixels an image
+// too large to decode
+func shrinkImage(url string, maxBytes, maxSide int) (string, bool, error) {
+	if maxBytes <= 0 || len(url) <= maxBytes {
+		return url, false, nil
+	}
+	header, data, found := strings.Cut(url, ",")
+	if !found || !strings.HasPrefix(header, "data:image/") || !strings.HasSuffix(header, ";base64") {
+		return url, false, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return url, false, nil
+	}
+	// the header says how much Decode would allocate
+	conf, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return url, false, nil
+	}
+	if int64(conf.Width)*int64(conf.Height) > maxImagePixels {
+		return url, false, errImagePixels
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return url, false, nil
+	}
+
+	b := img.Bounds()
+	side := min(maxSide, max(b.Dx(), b.Dy()))
+	for {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, downscale(img, side), &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return url, false, nil
+		}
+		small := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		if len(small) <= maxBytes || side/2 < minImageSide {
+			return small, true, nil
+		}
+		side /= 2
+	}
+}
+
+// downscale fits img into side x side, each target pixel averaging the
+// source pixels it covers. jpeg has no alpha, transparency turns white
+func downscale(img image.Image, side int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if long := max(w, h); long > side {
+		w = max(1, w*side/long)
+		h = max(1, h*side/long)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					// premultiplied, so white shows through what is transparent
+					r += uint64(cr + 0xffff - ca)
+					g += uint64(cg + 0xffff - ca)
+					bl += uint64(cb + 0xffff - ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: 0xff})
+		}
+	}
+	return dst
+}
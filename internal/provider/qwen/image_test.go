@@ -0,0 +1,176 @@
+package qwen
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+//go:embed testdata/noise.png
+var noisePNG []byte
+
+//go:embed testdata/half_transparent.png
+var halfTransparentPNG []byte
+
+func pngURL(data []byte) string {
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+func decodeURL(t *testing.T, url string) image.Image {
+	t.Helper()
+	data, ok := strings.CutPrefix(url, "data:image/jpeg;base64,")
+	require.True(t, ok, "a jpeg data url")
+	raw, err := base64.StdEncoding.DecodeString(data)
+	require.NoError(t, err)
+	img, err := jpeg.Decode(bytes.NewReader(raw))
+	require.NoError(t, err)
+	return img
+}
+
+func TestShrinkImage(t *testing.T) {
+	noise := pngURL(noisePNG)
+
+	small, ok, err := shrinkImage(noise, 20000, 64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.LessOrEqual(t, len(small), 20000)
+	assert.Equal(t, image.Rect(0, 0, 64, 48), decodeURL(t, small).Bounds(), "the aspect ratio is kept")
+
+	small, ok, _ = shrinkImage(noise, 100, 2048)
+	require.True(t, ok, "an image that cannot get small enough is still recompressed")
+	assert.Equal(t, image.Rect(0, 0, 160, 120), decodeURL(t, small).Bounds(), "never scaled up")
+
+	for name, url := range map[string]string{
+		"under the limit": pngURL(halfTransparentPNG),
+		"remote":          "https://example.com/" + strings.Repeat("a", 200) + ".png",
+		"not an image":    "data:image/png;base64," + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 200)),
+		"not base64":      "data:image/png;base64,%%%" + strings.Repeat("a", 200),
+	} {
+		got, ok, err := shrinkImage(url, 180, 64)
+		assert.NoError(t, err, name)
+		assert.False(t, ok, name)
+		assert.Equal(t, url, got, name)
+	}
+
+	got, ok, _ := shrinkImage(noise, 0, 64)
+	assert.False(t, ok, "0 disables scaling")
+	assert.Equal(t, noise, got)
+}
+
+// pngHeader is a png that declares w x h pixels and holds none of them
+func pngHeader(w, h uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	// 8 bit rgba, no interlace
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestShrinkImageRefusesBombs(t *testing.T) {
+	bomb := pngURL(append(pngHeader(50000, 50000), make([]byte, 256)...))
+	_, _, err := shrinkImage(bomb, 100, 64)
+	assert.ErrorIs(t, err, errImagePixels)
+
+	c := &Client{cfg: &config.Config{Qwen: config.QwenConfig{ImageMaxBytes: 100, ImageMaxSide: 64}}}
+	_, err = c.formatRequest(&domain.ChatRequest{Model: visionModel, Messages: []domain.Message{{Role: "user", Content: []any{
+		map[string]any{"type": "image_url", "image_url": map[string]any{"url": bomb}},
+	}}}})
+	var apiErr *domain.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 413, apiErr.Status)
+	assert.Equal(t, "image_too_large", *apiErr.Code)
+}
+
+func TestDownscaleFlattensAlpha(t *testing.T) {
+	img, err := decodePNG(halfTransparentPNG)
+	require.NoError(t, err)
+
+	dst := downscale(img, 2)
+	require.Equal(t, image.Rect(0, 0, 2, 1), dst.Bounds())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, dst.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, dst.RGBAAt(1, 0), "transparency turns white")
+}
+
+func decodePNG(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+func TestFormatPartsVision(t *testing.T) {
+	cfg := &config.Config{Qwen: config.QwenConfig{ImageMaxBytes: 20000, ImageMaxSide: 64}}
+	c := &Client{cfg: cfg}
+
+	noise := pngURL(noisePNG)
+	parts := []any{
+		map[string]any{"type": "text", "text": "what is this?"},
+		map[string]any{"type": "image_url", "image_url": map[string]any{"url": noise, "detail": "low"}},
+		map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/cat.png"}},
+	}
+	body := format(t, c, &domain.ChatRequest{Model: visionModel, Messages: []domain.Message{{Role: "user", Content: parts}}})
+
+	sent := body["messages"].([]map[string]any)[0]["content"].([]any)
+	require.Len(t, sent, 3)
+	assert.Equal(t, parts[0], sent[0])
+	scaled := sent[1].(map[string]any)["image_url"].(map[string]any)
+	assert.Equal(t, "low", scaled["detail"])
+	assert.Equal(t, image.Rect(0, 0, 64, 48), decodeURL(t, scaled["url"].(string)).Bounds())
+	assert.Equal(t, parts[2], sent[2], "remote images are left to qwen")
+	assert.Equal(t, noise, parts[1].(map[string]any)["image_url"].(map[string]any)["url"], "the request keeps its image")
+}
+
+func TestFormatPartsRejects(t *testing.T) {
+	c := &Client{cfg: &config.Config{}}
+	image := map[string]any{"type": "image_url", "image_url": map[string]any{"url": pngURL(halfTransparentPNG)}}
+	audio := map[string]any{"type": "input_audio", "input_audio": map[string]any{"data": "", "format": "wav"}}
+
+	tests := []struct {
+		name      string
+		model     string
+		parts     []any
+		wantCode  string
+		wantParam string
+	}{
+		{"image on the coder model", generalModel, []any{image}, "model_not_vision", "messages[1].content[0]"},
+		{"audio", visionModel, []any{map[string]any{"type": "text", "text": "hear this"}, audio}, "unsupported_content_part", "messages[1].content[1]"},
+		{"image without url", visionModel, []any{map[string]any{"type": "image_url", "image_url": map[string]any{}}}, "invalid_image_url", "messages[1].content[0]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.formatRequest(&domain.ChatRequest{Model: tt.model, Messages: []domain.Message{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: tt.parts},
+			}})
+			var apiErr *domain.APIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, 400, apiErr.Status)
+			assert.Equal(t, tt.wantCode, *apiErr.Code)
+			assert.Equal(t, tt.wantParam, *apiErr.Param)
+		})
+	}
+}
+
+func TestVisionModel(t *testing.T) {
+	c := &Client{}
+	assert.True(t, c.AcceptsImages(visionModel))
+	assert.False(t, c.AcceptsImages(generalModel))
+	assert.Equal(t, visionModel, c.VisionModel(generalModel))
+	assert.Equal(t, "", c.VisionModel("qwen-max"))
+}
@@ -142,12 +142,18 @@ func PollForToken(deviceCode, codeVerifier string) (*OAuthToken, error) {
 }
 
 func RefreshToken(refreshToken string) (*OAuthToken, error) {
+	return refreshTokenAt(OAuthTokenURL, refreshToken)
+}
+
+// refreshTokenAt trades refreshToken at tokenURL. qwen rotates the refresh
+// token, the old one is dead once this returns
+func refreshTokenAt(tokenURL, refreshToken string) (*OAuthToken, error) {
 	data := url.Values{}
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", refreshToken)
 	data.Set("client_id", ClientID)
 
-	req, err := http.NewRequest("POST", OAuthTokenURL, strings.NewReader(data.Encode()))
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
@@ -0,0 +1,208 @@
+package qwen
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// refresher makes sure a token is refreshed by one caller at a time. qwen
+// invalidates a refresh token on first use, a second concurrent refresh
+// with the same one fails and leaves the account without a usable pair
+type refresher struct {
+	mu       sync.Mutex
+	inFlight map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs fn for the token id unless a refresh of it is already running,
+// then it waits for that one and shares its outcome
+func (r *refresher) do(id string, fn func() error) error {
+	r.mu.Lock()
+	if call, ok := r.inFlight[id]; ok {
+		r.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	if r.inFlight == nil {
+		r.inFlight = make(map[string]*refreshCall)
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	r.inFlight[id] = call
+	r.mu.Unlock()
+
+	call.err = fn()
+
+	r.mu.Lock()
+	delete(r.inFlight, id)
+	r.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// refreshActiveToken replaces stale, the access token a request failed
+// with, by a fresh pair. a caller that lost the race finds the pair
+// already replaced in the store and uses it as is
+func (c *Client) refreshActiveToken(stale string) error {
+	active, err := c.store.GetActiveByProvider("qwen")
+	if err != nil || active == nil {
+		return fmt.Errorf("no active qwen token")
+	}
+
+	return c.refreshToken(active.ID, stale)
+}
+
+// refreshToken refreshes the stored token id unless its access token is no
+// longer stale
+func (c *Client) refreshToken(id, stale string) error {
+	return c.refresh.do(id, func() error {
+		current, err := c.store.GetByID(id)
+		if err != nil {
+			return err
+		}
+		if current.Token != stale {
+			return nil
+		}
+
+		newToken, err := refreshTokenAt(c.tokenURL, current.RefreshToken)
+		if err != nil {
+			return err
+		}
+
+		current.Token = newToken.AccessToken
+		current.RefreshToken = newToken.RefreshToken
+		current.ExpiryDate = newToken.ExpiryDate
+		if newToken.ResourceURL != "" {
+			current.ResourceURL = newToken.ResourceURL
+		}
+		// stored before waiters are let go, they read the new pair from it
+		return c.store.Update(current)
+	})
+}
+
+const (
+	// the scheduler looks at the store at least this often, for tokens
+	// added since
+	maxRefreshWait = time.Minute
+	// first retry after a failed background refresh, doubled per failure
+	refreshBackoff    = 30 * time.Second
+	maxRefreshBackoff = 10 * time.Minute
+	// failures in a row before they are logged as errors
+	refreshAlertAfter = 3
+)
+
+// refreshPlan is when a token is refreshed ahead of its expiry
+type refreshPlan struct {
+	expiry   int64
+	at       time.Time
+	failures int
+}
+
+// refreshAt is margin plus up to jitter before expiry, r in [0, 1) picks
+// where in the jitter
+func refreshAt(expiry time.Time, margin, jitter time.Duration, r float64) time.Time {
+	return expiry.Add(-margin - time.Duration(float64(jitter)*r))
+}
+
+// retryAfter is the backoff after failures failed refreshes in a row
+func retryAfter(failures int) time.Duration {
+	d := refreshBackoff
+	for i := 1; i < failures && d < maxRefreshBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRefreshBackoff)
+}
+
+// RunRefresh refreshes qwen tokens ahead of their expiry until Close. the
+// request that finds a token expired still refreshes it, this only spares
+// it the wait
+func (c *Client) RunRefresh() {
+	margin := c.cfg.Qwen.RefreshMargin
+	if margin <= 0 {
+		return
+	}
+	log.Info().Dur("margin", margin).Msg("background token refresh started")
+
+	for {
+		wait := min(c.refreshDue().Sub(c.now()), maxRefreshWait)
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// refreshDue refreshes the tokens whose plan has come and returns when the
+// next one is due
+func (c *Client) refreshDue() time.Time {
+	now := c.now()
+	next := now.Add(maxRefreshWait)
+
+	tokens, err := c.store.ListByProvider("qwen")
+	if err != nil {
+		log.Warn().Err(err).Msg("background refresh: list tokens")
+		return next
+	}
+
+	seen := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		seen[t.ID] = true
+		if t.RefreshToken == "" || t.ExpiryDate == 0 {
+			continue
+		}
+
+		plan, ok := c.plans[t.ID]
+		if !ok || plan.expiry != t.ExpiryDate {
+			// a new token, or one refreshed since on demand
+			plan = &refreshPlan{
+				expiry: t.ExpiryDate,
+				at:     refreshAt(time.UnixMilli(t.ExpiryDate), c.cfg.Qwen.RefreshMargin, c.cfg.Qwen.RefreshJitter, c.jitter()),
+			}
+			c.plans[t.ID] = plan
+		}
+
+		if plan.at.After(now) {
+			if plan.at.Before(next) {
+				next = plan.at
+			}
+			continue
+		}
+
+		if err := c.refreshToken(t.ID, t.Token); err != nil {
+			plan.failures++
+			plan.at = now.Add(retryAfter(plan.failures))
+			ev := log.Warn()
+			if plan.failures >= refreshAlertAfter {
+				ev = log.Error()
+			}
+			ev.Err(err).Str("token", t.ID).Int("failures", plan.failures).Time("retry_at", plan.at).
+				Msg("background token refresh failed")
+			if plan.at.Before(next) {
+				next = plan.at
+			}
+			continue
+		}
+		log.Debug().Str("token", t.ID).Msg("token refreshed ahead of expiry")
+		// planned again from the new expiry on the next pass
+		delete(c.plans, t.ID)
+		next = now
+	}
+
+	for id := range c.plans {
+		if !seen[id] {
+			delete(c.plans, id)
+		}
+	}
+	return next
+}
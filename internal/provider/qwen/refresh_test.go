@@ -0,0 +1,188 @@
+package qwen
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+// fakeOAuth hands out access-N/refresh-N on resource and, like qwen,
+// accepts every refresh token only once
+func fakeOAuth(t *testing.T, calls *atomic.Int32, resource string) *httptest.Server {
+	var mu sync.Mutex
+	valid := map[string]bool{"refresh-0": true}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		// slow enough for every caller to pile up behind the first
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !valid[r.FormValue("refresh_token")] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(valid, r.FormValue("refresh_token"))
+		valid[fmt.Sprintf("refresh-%d", n)] = true
+		fmt.Fprintf(w, `{"status": "success", "access_token": "access-%d", "refresh_token": "refresh-%d", "expires_in": 3600, "resource_url": %q}`, n, n, resource)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func expiredClient(t *testing.T, tokenURL string) *Client {
+	return clientExpiringAt(t, tokenURL, time.Now().Add(-time.Minute))
+}
+
+func clientExpiringAt(t *testing.T, tokenURL string, expiry time.Time) *Client {
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	_, err = store.AddWithProvider("qwen", "a@example.com", "access-0", "refresh-0", expiry.UnixMilli())
+	require.NoError(t, err)
+
+	cfg := &config.Config{Qwen: config.QwenConfig{RefreshMargin: 5 * time.Minute, RefreshJitter: time.Minute}}
+	c := NewClient(cfg, store)
+	c.tokenURL = tokenURL
+	return c
+}
+
+func TestRefreshSingleFlight(t *testing.T) {
+	var calls atomic.Int32
+	c := expiredClient(t, fakeOAuth(t, &calls, "").URL)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	errs := make([]error, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var token *tokenstore.Token
+			token, errs[i] = c.getValidToken()
+			if token != nil {
+				tokens[i] = token.Token
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load(), "one refresh for every waiting request")
+	for i := range tokens {
+		require.NoError(t, errs[i])
+		assert.Equal(t, "access-1", tokens[i])
+	}
+
+	active, err := c.store.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-1", active.RefreshToken)
+	assert.False(t, IsTokenExpired(active.ExpiryDate))
+}
+
+func TestRefreshAfterAnotherRefreshed(t *testing.T) {
+	var calls atomic.Int32
+	c := expiredClient(t, fakeOAuth(t, &calls, "").URL)
+
+	require.NoError(t, c.refreshActiveToken("access-0"))
+	// a request that failed with the old access token arrives late
+	require.NoError(t, c.refreshActiveToken("access-0"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	token, err := c.getValidToken()
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", token.Token)
+}
+
+func TestRefreshAt(t *testing.T) {
+	expiry := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, expiry.Add(-5*time.Minute), refreshAt(expiry, 5*time.Minute, time.Minute, 0))
+	assert.Equal(t, expiry.Add(-5*time.Minute-30*time.Second), refreshAt(expiry, 5*time.Minute, time.Minute, 0.5))
+	assert.Equal(t, expiry.Add(-5*time.Minute), refreshAt(expiry, 5*time.Minute, 0, 0.9))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, retryAfter(1))
+	assert.Equal(t, time.Minute, retryAfter(2))
+	assert.Equal(t, 8*time.Minute, retryAfter(5))
+	assert.Equal(t, 10*time.Minute, retryAfter(20))
+}
+
+func TestRefreshDue(t *testing.T) {
+	var calls atomic.Int32
+	now := time.Now()
+	c := clientExpiringAt(t, fakeOAuth(t, &calls, "portal-2.qwen.example").URL, now.Add(10*time.Minute))
+	c.now = func() time.Time { return now }
+	c.jitter = func() float64 { return 0.5 }
+
+	// the store is looked at again within a minute
+	assert.Equal(t, now.Add(time.Minute), c.refreshDue())
+	// the refresh itself is margin and half the jitter before expiry
+	active, err := c.store.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	due := now.Add(4*time.Minute + 30*time.Second)
+	assert.Equal(t, due.UnixMilli(), c.plans[active.ID].at.UnixMilli())
+
+	now = due.Add(-time.Second)
+	assert.Equal(t, c.plans[active.ID].at, c.refreshDue())
+	assert.Zero(t, calls.Load())
+
+	now = due
+	assert.Equal(t, now, c.refreshDue(), "a refresh looks again right away")
+	assert.Equal(t, int32(1), calls.Load())
+
+	stored, err := c.store.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	assert.Equal(t, "access-1", stored.Token)
+	assert.Equal(t, "refresh-1", stored.RefreshToken)
+	assert.Equal(t, "portal-2.qwen.example", stored.ResourceURL)
+
+	// planned from the new expiry, an hour out
+	assert.True(t, c.refreshDue().After(now.Add(time.Minute-time.Second)))
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestRefreshDueBacksOff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	c := clientExpiringAt(t, srv.URL, now.Add(time.Minute))
+	c.now = func() time.Time { return now }
+
+	assert.Equal(t, now.Add(30*time.Second), c.refreshDue())
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, now.Add(time.Minute), c.refreshDue())
+
+	stored, err := c.store.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-0", stored.RefreshToken, "the pair stays until a refresh succeeds")
+}
+
+func TestRunRefreshStops(t *testing.T) {
+	c := clientExpiringAt(t, "http://127.0.0.1:0", time.Now().Add(time.Hour))
+	done := make(chan struct{})
+	go func() {
+		c.RunRefresh()
+		close(done)
+	}()
+
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunRefresh did not return after Close")
+	}
+}
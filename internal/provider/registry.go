@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"sync"
+	"time"
+)
+
+// Registry tracks registered providers and which of them currently have
+// usable credentials. Refresh re-evaluates, typically on token store changes,
+// expiry is checked again on every read.
+type Registry struct {
+	mu        sync.RWMutex
+	providers []Provider
+	status    map[string]CredentialStatus
+	now       func() time.Time
+}
+
+func NewRegistry(providers ...Provider) *Registry {
+	r := &Registry{providers: providers, now: time.Now}
+	r.Refresh()
+	return r
+}
+
+func (r *Registry) Refresh() []CredentialStatus {
+	statuses := make([]CredentialStatus, 0, len(r.providers))
+	byName := make(map[string]CredentialStatus, len(r.providers))
+
+	for _, p := range r.providers {
+		st := p.CredentialStatus()
+		st.Provider = p.Name()
+		statuses = append(statuses, st)
+		byName[p.Name()] = st
+	}
+
+	r.mu.Lock()
+	r.status = byName
+	r.mu.Unlock()
+
+	return statuses
+}
+
+func (r *Registry) All() []Provider {
+	return r.providers
+}
+
+// Statuses returns the last evaluated credential status per provider, with
+// expiry as of now
+func (r *Registry) Statuses() []CredentialStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := r.now()
+	out := make([]CredentialStatus, 0, len(r.providers))
+	for _, p := range r.providers {
+		out = append(out, r.status[p.Name()].at(now))
+	}
+	return out
+}
+
+func (r *Registry) Available(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.status[name].at(r.now()).Usable()
+}
+
+// Find returns the first provider supporting model and whether it is usable
+func (r *Registry) Find(model string) (Provider, bool) {
+	for _, p := range r.providers {
+		if p.SupportsModel(model) {
+			return p, r.Available(p.Name())
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// staticProvider reports the same credential status every time
+type staticProvider struct {
+	name   string
+	status CredentialStatus
+}
+
+func (p staticProvider) Name() string                       { return p.name }
+func (p staticProvider) SupportsModel(string) bool          { return true }
+func (p staticProvider) CredentialStatus() CredentialStatus { return p.status }
+func (p staticProvider) SendChatRequest(context.Context, *domain.ChatRequest, string) (*http.Response, error) {
+	return nil, nil
+}
+
+func TestRegistryExpiresOnRead(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	expires := start.Add(time.Hour)
+	r := NewRegistry(
+		staticProvider{"jwt", CredentialStatus{Present: true, Valid: true, ExpiresAt: expires}},
+		staticProvider{"refresh", CredentialStatus{Present: true, Valid: true, ExpiresAt: expires, Refreshable: true}},
+		staticProvider{"opaque", CredentialStatus{Present: true, Valid: true}},
+	)
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		valid  []bool
+		soon   []bool
+		detail []string
+	}{
+		{"fresh", start, []bool{true, true, true}, []bool{false, false, false}, []string{"", "", ""}},
+		{"expiring", expires.Add(-time.Minute), []bool{true, true, true}, []bool{true, true, false}, []string{"", "", ""}},
+		{"expired", expires, []bool{false, true, true}, []bool{false, false, false},
+			[]string{"token expired", "access token expired, will refresh", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// nothing refreshes the registry, only the clock moves
+			r.now = func() time.Time { return tt.at }
+			for i, st := range r.Statuses() {
+				assert.Equal(t, tt.valid[i], st.Valid, st.Provider)
+				assert.Equal(t, tt.soon[i], st.ExpiringSoon, st.Provider)
+				assert.Equal(t, tt.detail[i], st.Detail, st.Provider)
+				assert.Equal(t, tt.valid[i], r.Available(st.Provider), st.Provider)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package zlm
+
+import (
+	"strings"
+)
+
+// cleaners remove what the z.ai web ui leaves in answers, by name so
+// model.answer_cleaners can turn each off. config validates the names,
+// keep in sync
+var cleaners = []cleaner{
+	// glm vision models wrap their final answer in box tokens
+	{name: "box_tokens", tokens: []string{"<|begin_of_box|>", "<|end_of_box|>"}},
+	// a fence left over from the details block, opened and never used
+	{name: "stray_fence", head: strayFence},
+	// an edit_content patch that repeats the start of the answer
+	{name: "duplicate_sentence", edit: duplicateSentence},
+}
+
+type cleaner struct {
+	name string
+	// removed wherever they appear
+	tokens []string
+	// rewrites the start of the answer, false while it needs more text to
+	// decide and final is not set
+	head func(s string, final bool) (string, bool)
+	// rewrites an edit_content patch given the answer sent before it
+	edit func(sent, s string) string
+}
+
+// headLookahead bounds how much of an answer is held back for the head
+// cleaners and kept for the edit ones
+const headLookahead = 1024
+
+// answerCleaner runs the enabled cleaners over the answer as it streams.
+// the start is held back only while a head cleaner cannot tell yet, later
+// only a token cut at the end of a delta waits for the next one
+type answerCleaner struct {
+	tokens []string
+	heads  []func(string, bool) (string, bool)
+	edits  []func(string, string) string
+	// the head cleaners are done
+	started bool
+	held    string
+	// the start of the answer sent so far
+	sent string
+}
+
+// newAnswerCleaner enables the cleaners not turned off in enabled
+func newAnswerCleaner(enabled map[string]bool) *answerCleaner {
+	a := &answerCleaner{}
+	for _, c := range cleaners {
+		if on, ok := enabled[c.name]; ok && !on {
+			continue
+		}
+		a.tokens = append(a.tokens, c.tokens...)
+		if c.head != nil {
+			a.heads = append(a.heads, c.head)
+		}
+		if c.edit != nil {
+			a.edits = append(a.edits, c.edit)
+		}
+	}
+	a.started = len(a.heads) == 0
+	return a
+}
+
+// feed cleans the next piece of the answer, edit when it came as
+// edit_content. what it returns can be sent
+func (a *answerCleaner) feed(s string, edit bool) string {
+	s = a.strip(s)
+	if edit {
+		for _, e := range a.edits {
+			s = e(a.sent+a.held, s)
+		}
+	}
+	// a token cut at the end of the last piece completes here
+	s = a.strip(a.held + s)
+	a.held = ""
+
+	cut := 0
+	for _, tok := range a.tokens {
+		cut = max(cut, partialPrefix(s, tok))
+	}
+	a.held = s[len(s)-cut:]
+	s = s[:len(s)-cut]
+
+	if !a.started {
+		out, ok := a.head(s, len(s) >= headLookahead)
+		if !ok {
+			a.held = s + a.held
+			return ""
+		}
+		a.started = true
+		s = out
+	}
+	a.record(s)
+	return s
+}
+
+// flush is the answer still held back once the stream ended
+func (a *answerCleaner) flush() string {
+	s := a.strip(a.held)
+	a.held = ""
+	if !a.started {
+		a.started = true
+		s, _ = a.head(s, true)
+	}
+	a.record(s)
+	return s
+}
+
+func (a *answerCleaner) record(s string) {
+	if room := headLookahead - len(a.sent); room > 0 {
+		a.sent += s[:min(room, len(s))]
+	}
+}
+
+func (a *answerCleaner) strip(s string) string {
+	for _, tok := range a.tokens {
+		s = strings.ReplaceAll(s, tok, "")
+	}
+	return s
+}
+
+// head runs the head cleaners in order, all of them or none
+func (a *answerCleaner) head(s string, final bool) (string, bool) {
+	out := s
+	for _, h := range a.heads {
+		var ok bool
+		if out, ok = h(out, final); !ok {
+			return s, false
+		}
+	}
+	return out, true
+}
+
+// stray fences an answer may start with, a lone one before a blank line
+// or an empty block
+var strayFences = []string{"```\n```\n", "```\n\n"}
+
+func strayFence(s string, final bool) (string, bool) {
+	body := strings.TrimLeft(s, "\n")
+	for _, fence := range strayFences {
+		if strings.HasPrefix(body, fence) {
+			return strings.TrimLeft(body[len(fence):], "\n"), true
+		}
+	}
+	for _, fence := range strayFences {
+		if !final && strings.HasPrefix(fence, body) {
+			return s, false
+		}
+	}
+	return s, true
+}
+
+// duplicateSentence drops what a patch repeats of the answer sent before
+// it: all of it, or else its first sentence
+func duplicateSentence(sent, s string) string {
+	sent = strings.TrimSpace(sent)
+	if sent == "" {
+		return s
+	}
+	body := strings.TrimLeft(s, " \n")
+	if strings.HasPrefix(body, sent) {
+		return body[len(sent):]
+	}
+	if end := sentenceEnd(sent); end > 0 && strings.HasPrefix(body, sent[:end]) {
+		return body[end:]
+	}
+	return s
+}
+
+// sentenceEnd is the length of the first sentence of s, -1 when no other
+// text follows it. a terminator counts once a space or newline follows it
+func sentenceEnd(s string) int {
+	for i := 0; i+1 < len(s); i++ {
+		if s[i] == '\n' {
+			return i
+		}
+		if strings.IndexByte(".!?", s[i]) >= 0 && (s[i+1] == ' ' || s[i+1] == '\n') {
+			return i + 1
+		}
+	}
+	return -1
+}
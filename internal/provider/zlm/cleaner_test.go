@@ -0,0 +1,79 @@
+package zlm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+// answer is the content a formatter produced for a fixture stream, what
+// it held back included
+func answer(t *testing.T, name string, cleaners map[string]bool) string {
+	t.Helper()
+	fmtr := NewFormatter(&config.Config{Model: config.ModelConfig{ThinkMode: "reasoning", AnswerCleaners: cleaners}})
+	var text strings.Builder
+	for _, d := range format(fmtr, events(t, name)) {
+		if s, ok := d["content"].(string); ok {
+			text.WriteString(s)
+		}
+	}
+	text.WriteString(fmtr.Flush())
+	return text.String()
+}
+
+func TestAnswerCleaners(t *testing.T) {
+	for _, tt := range []struct {
+		fixture, cleaner, clean, raw string
+	}{
+		{"box_tokens.sse", "box_tokens",
+			"A red bicycle leaning on a wall.",
+			"<|begin_of_box|>A red bicycle leaning on a wall.<|end_of_box|>"},
+		{"stray_fence.sse", "stray_fence",
+			"2 + 2 = 4.",
+			"\n```\n\n2 + 2 = 4."},
+		{"duplicate_sentence.sse", "duplicate_sentence",
+			"The capital of France is Paris. It sits on the Seine. It is also the largest city.",
+			"The capital of France is Paris.The capital of France is Paris. It sits on the Seine. It is also the largest city."},
+	} {
+		t.Run(tt.cleaner, func(t *testing.T) {
+			assert.Equal(t, tt.clean, answer(t, tt.fixture, nil))
+			assert.Equal(t, tt.raw, answer(t, tt.fixture, map[string]bool{tt.cleaner: false}))
+		})
+	}
+}
+
+func TestAnswerCleanerSplit(t *testing.T) {
+	raw := "```\n\n<|begin_of_box|>Paris.<|end_of_box|>"
+	// any split of the stream gives the same answer
+	for size := 1; size <= len(raw); size++ {
+		a := newAnswerCleaner(nil)
+		var out strings.Builder
+		for i := 0; i < len(raw); i += size {
+			out.WriteString(a.feed(raw[i:min(i+size, len(raw))], false))
+		}
+		out.WriteString(a.flush())
+		assert.Equal(t, "Paris.", out.String(), "chunks of %d", size)
+	}
+}
+
+func TestAnswerCleanerStreamsAtOnce(t *testing.T) {
+	a := newAnswerCleaner(nil)
+	assert.Equal(t, "Hello", a.feed("Hello", false), "plain text is not held back")
+	assert.Equal(t, " ", a.feed(" <", false), "a possible token is held")
+	assert.Equal(t, "<b>", a.feed("b>", false))
+
+	// a code block that does start the answer stays
+	a = newAnswerCleaner(nil)
+	assert.Empty(t, a.feed("```", false))
+	assert.Equal(t, "```go\nfmt.Println()", a.feed("go\nfmt.Println()", false))
+}
+
+func TestDuplicateSentence(t *testing.T) {
+	assert.Equal(t, " It sits on the Seine.", duplicateSentence("Paris is the capital.", "Paris is the capital. It sits on the Seine."))
+	assert.Equal(t, " sits", duplicateSentence("Paris is the capital. It", "Paris is the capital. It sits"))
+	assert.Equal(t, " Really.", duplicateSentence("Paris is the capital. It is", "Paris is the capital. Really."))
+	assert.Equal(t, "Lyon is not.", duplicateSentence("Paris is the capital.", "Lyon is not."))
+	assert.Equal(t, "anything", duplicateSentence("", "anything"))
+}
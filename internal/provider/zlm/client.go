@@ -2,23 +2,33 @@ package zlm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/domain"
 	"github.com/zarazaex69/mo/internal/pkg/crypto"
+	"github.com/zarazaex69/mo/internal/pkg/dump"
 	"github.com/zarazaex69/mo/internal/pkg/httpclient"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
 	"github.com/zarazaex69/mo/internal/pkg/utils"
 	"github.com/zarazaex69/mo/internal/service/auth"
+	"github.com/zarazaex69/mo/internal/service/drift"
+	"github.com/zarazaex69/mo/internal/service/failover"
 )
 
+var log = logger.Module("zlm")
+
 var supportedModels = []string{
 	"GLM-4-6-API-V1",
 	"GLM-4-Flash",
@@ -30,14 +40,49 @@ type Client struct {
 	cfg    *config.Config
 	auth   auth.AuthServicer
 	sigGen crypto.SignatureGenerator
+	store  *tokenstore.Store
+
+	// shared so keep-alive connections survive between requests
+	http  *httpclient.Client
+	files *httpclient.Client
+	// image urls from clients, public addresses only
+	fetch *httpclient.Client
+
+	hosts *failover.Pool
+	// chat requests as sent, nil unless log.dump is set
+	dump *dump.Dumper
+	// X-FE-Version found at run time, nil keeps headers.x_fe_version
+	feVersion func() string
 }
 
-func NewClient(cfg *config.Config, authSvc auth.AuthServicer, sigGen crypto.SignatureGenerator) *Client {
-	return &Client{
+func NewClient(cfg *config.Config, authSvc auth.AuthServicer, sigGen crypto.SignatureGenerator, store *tokenstore.Store) *Client {
+	c := &Client{
 		cfg:    cfg,
 		auth:   authSvc,
 		sigGen: sigGen,
+		store:  store,
+		http:   httpclient.New(0),
+		files:  httpclient.New(30 * time.Second),
+		fetch:  httpclient.NewPublic(15 * time.Second),
+		dump:   dump.New(cfg.Log.Dump, filepath.Join(config.DataPath(), "debug", "requests"), cfg.Log.DumpKeep, log),
+	}
+	c.hosts = failover.NewPool(cfg.Upstream.AllHosts(), cfg.Upstream.Failover.MaxFailures, c.probeHost)
+	return c
+}
+
+// SetFEVersion makes upstream requests carry what version returns as
+// X-FE-Version, set before the client serves
+func (c *Client) SetFEVersion(version func() string) {
+	c.feVersion = version
+}
+
+// upstreamHeaders are the browser headers every upstream request carries
+func (c *Client) upstreamHeaders() map[string]string {
+	headers := c.cfg.GetUpstreamHeaders()
+	if c.feVersion != nil {
+		headers["X-FE-Version"] = c.feVersion()
 	}
+	return headers
 }
 
 func (c *Client) Name() string {
@@ -53,11 +98,16 @@ func (c *Client) SupportsModel(model string) bool {
 	return !strings.HasPrefix(model, "coder-") && !strings.HasPrefix(model, "vision-")
 }
 
-func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.Response, error) {
+// Thinks is true on every model, the request turns thinking on or off
+func (c *Client) Thinks(model string) bool {
+	return true
+}
+
+func (c *Client) SendChatRequest(ctx context.Context, req *domain.ChatRequest, chatID string) (*http.Response, error) {
 	ts := time.Now().UnixMilli()
 	reqID := utils.GenerateRequestID()
 
-	user, err := c.auth.GetUser(c.cfg)
+	user, err := c.auth.GetUser(c.hostConfig())
 	if err != nil {
 		return nil, fmt.Errorf("get user: %w", err)
 	}
@@ -69,12 +119,12 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 	params.Set("platform", "web")
 	params.Set("token", user.Token)
 
-	headers := c.cfg.GetUpstreamHeaders()
+	headers := c.upstreamHeaders()
 	headers["Authorization"] = "Bearer " + user.Token
 	headers["Content-Type"] = "application/json"
-	headers["Referer"] = fmt.Sprintf("%s//%s/c/%s", c.cfg.Upstream.Protocol, c.cfg.Upstream.Host, chatID)
+	headers["Referer"] = c.cfg.UpstreamURL("c", chatID)
 
-	body, err := FormatRequest(req, c.cfg)
+	body, err := c.FormatRequest(req, user, chatID)
 	if err != nil {
 		return nil, fmt.Errorf("format request: %w", err)
 	}
@@ -84,7 +134,7 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 
 	params.Set("user_id", user.ID)
 
-	lastMsg := extractLastUserMessage(req.Messages)
+	lastMsg := signaturePrompt(req.Messages)
 
 	sigParams := map[string]string{
 		"requestId": reqID,
@@ -93,27 +143,27 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 	}
 	sig, err := c.sigGen.GenerateSignature(sigParams, lastMsg)
 	if err != nil {
-		logger.Warn().Err(err).Msg("signature failed, continuing without it")
+		log.Ctx(ctx).Warn().Err(err).Msg("signature failed, continuing without it")
 	} else {
 		headers["x-signature"] = sig.Signature
 		params.Set("signature_timestamp", fmt.Sprintf("%d", sig.Timestamp))
 		body["signature_prompt"] = lastMsg
 	}
 
-	apiURL := fmt.Sprintf("%s//%s/api/v2/chat/completions?%s",
-		c.cfg.Upstream.Protocol, c.cfg.Upstream.Host, params.Encode())
+	apiURL := c.cfg.ChatURL() + "?" + params.Encode()
 
 	bodyBytes, err := json.Marshal(body)
 	if err != nil {
 		return nil, fmt.Errorf("marshal body: %w", err)
 	}
 
-	logger.Debug().
+	log.Ctx(ctx).Debug().
 		Str("url", apiURL).
 		Str("chat_id", chatID).
-		Str("model", req.Model).
-		RawJSON("body", bodyBytes).
+		Str("reasoning_effort", req.ReasoningEffort).
+		Interface("features", body["features"]).
 		Msg("sending request")
+	log.Raw(ctx).Str("chat_id", chatID).RawJSON("body", bodyBytes).Msg("request body")
 
 	httpReq, err := http.NewRequest("POST", apiURL, bytes.NewReader(bodyBytes))
 	if err != nil {
@@ -124,8 +174,15 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 		httpReq.Header.Set(k, v)
 	}
 
-	client := httpclient.New(0)
-	resp, err := client.Do(httpReq)
+	client := c.http.WithRetry(retryPolicy(c.cfg))
+	resp, err := c.send(httpReq, func(r *http.Request) (*http.Response, error) {
+		return client.DoWithHeaderTimeout(r, c.cfg.Upstream.HeaderTimeout)
+	})
+	c.dump.Write(ctx, httpReq, bodyBytes, resp, err)
+	if errors.Is(err, httpclient.ErrHeaderTimeout) {
+		return nil, domain.NewAPIError(http.StatusGatewayTimeout, fmt.Sprintf("upstream did not respond within %s", c.cfg.Upstream.HeaderTimeout)).
+			WithCode("upstream_timeout")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("send request: %w", err)
 	}
@@ -134,40 +191,94 @@ func (c *Client) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
 
-		logger.Error().
+		log.Ctx(ctx).Error().
 			Int("status", resp.StatusCode).
 			Str("body", string(body)).
 			Msg("upstream returned error")
 
+		// a stale secret or fe version shows up as a rejected signature
+		if strings.Contains(strings.ToLower(string(body)), "signature") {
+			drift.Record(drift.SignatureRejected, strconv.Itoa(resp.StatusCode), string(body))
+		}
+		// a revoked token would otherwise stay cached as valid for the ttl
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.auth.Invalidate(user.Token)
+		}
+
 		return nil, domain.NewUpstreamError(resp.StatusCode, "upstream error")
 	}
 
 	return resp, nil
 }
 
-func extractLastUserMessage(msgs []domain.Message) string {
+func retryPolicy(cfg *config.Config) httpclient.RetryPolicy {
+	return httpclient.RetryPolicy{MaxAttempts: cfg.HTTP.Retry.MaxAttempts, Budget: cfg.HTTP.Retry.Budget}
+}
+
+// imagePlaceholder stands in for each image of a signed prompt
+const imagePlaceholder = "[image]"
+
+// signaturePrompt is what a request is signed over: the last user turn as
+// z.ai receives it. tool results are user turns there, a run of them is
+// rendered and merged as FormatRequest does. without any user turn the last
+// message of any role is signed, an empty prompt is rejected intermittently
+func signaturePrompt(msgs []domain.Message) string {
+	last := -1
 	for i := len(msgs) - 1; i >= 0; i-- {
-		if msgs[i].Role != "user" {
-			continue
+		if msgs[i].Role == "user" || msgs[i].Role == "tool" {
+			last = i
+			break
 		}
+	}
+	if last < 0 {
+		if len(msgs) == 0 {
+			return ""
+		}
+		return signedText(msgs[len(msgs)-1].Content)
+	}
+	if msgs[last].Role == "user" {
+		return signedText(msgs[last].Content)
+	}
 
-		if s, ok := msgs[i].Content.(string); ok {
-			return s
+	callNames := make(map[string]string)
+	for _, msg := range msgs {
+		for _, tc := range msg.ToolCalls {
+			callNames[tc.ID] = tc.Function.Name
 		}
+	}
+	first := last
+	for first > 0 && msgs[first-1].Role == "tool" {
+		first--
+	}
+	results := make([]string, 0, last-first+1)
+	for _, msg := range msgs[first : last+1] {
+		results = append(results, renderToolResult(msg, callNames))
+	}
+	return strings.Join(results, "\n")
+}
 
-		if arr, ok := msgs[i].Content.([]interface{}); ok {
-			var texts []string
-			for _, item := range arr {
-				if m, ok := item.(map[string]interface{}); ok {
-					if m["type"] == "text" {
-						if t, ok := m["text"].(string); ok {
-							texts = append(texts, t)
-						}
-					}
-				}
+// signedText joins the text parts of content in order with a placeholder
+// for every image, so the same message always signs the same
+func signedText(content interface{}) string {
+	if s, ok := content.(string); ok {
+		return s
+	}
+
+	var parts []string
+	arr, _ := content.([]interface{})
+	for _, item := range arr {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch m["type"] {
+		case "text":
+			if t, ok := m["text"].(string); ok {
+				parts = append(parts, t)
 			}
-			return strings.Join(texts, " ")
+		case "image_url":
+			parts = append(parts, imagePlaceholder)
 		}
 	}
-	return ""
+	return strings.Join(parts, " ")
 }
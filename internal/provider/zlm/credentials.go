@@ -0,0 +1,81 @@
+package zlm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/service/auth"
+)
+
+// CredentialStatus mirrors the token lookup order of auth.Service.GetUser:
+// config/env token first, then the active glm token in the store, then the
+// guest token in guest mode
+func (c *Client) CredentialStatus() provider.CredentialStatus {
+	st := provider.CredentialStatus{Provider: c.Name()}
+
+	token, source, err := c.token()
+	if err != nil {
+		st.Detail = err.Error()
+		return st
+	}
+	st.Present = true
+	st.Source = source
+
+	exp, ok := auth.TokenExpiry(token)
+	if !ok {
+		// opaque token, can only be verified by calling upstream
+		st.Valid = true
+		return st
+	}
+
+	st.ExpiresAt = exp
+	st.Valid = time.Now().Before(exp)
+	st.ExpiringSoon = st.Valid && time.Until(exp) < provider.ExpiringSoon
+	if !st.Valid {
+		st.Detail = "token expired"
+	}
+	return st
+}
+
+// TokenID is the id of the active stored token, "config" while the token
+// comes from config or env
+func (c *Client) TokenID() string {
+	if c.cfg.Upstream.Token != "" {
+		return "config"
+	}
+	if c.store == nil {
+		return ""
+	}
+	if active, _ := c.store.GetActiveByProvider("glm"); active != nil {
+		return active.ID
+	}
+	return ""
+}
+
+func (c *Client) token() (token, source string, err error) {
+	if c.cfg.Upstream.Token != "" {
+		return c.cfg.Upstream.Token, "config", nil
+	}
+
+	if c.store != nil {
+		active, err := c.store.GetActiveByProvider("glm")
+		if err != nil {
+			return "", "", fmt.Errorf("token store: %w", err)
+		}
+		if active != nil {
+			return active.Token, "store", nil
+		}
+	}
+
+	if c.cfg.Upstream.TokenMode == config.TokenModeGuest {
+		token, err := auth.GetService().GuestToken(c.cfg)
+		if err != nil {
+			return "", "", err
+		}
+		return token, "guest", nil
+	}
+
+	return "", "", fmt.Errorf("no z.ai token in config, env or store")
+}
@@ -0,0 +1,41 @@
+package zlm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// FetchFile gets a file for the /v1/files proxy. files on upstream's hosts
+// are fetched with the token and fail over like chat requests, cdn links are
+// signed already and never see it. header carries the client's Range and
+// validators
+func (c *Client) FetchFile(ctx context.Context, rawURL string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse file url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	for k, v := range c.upstreamHeaders() {
+		req.Header.Set(k, v)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "*/*")
+
+	if !slices.Contains(c.cfg.Upstream.AllHosts(), u.Host) {
+		return c.http.Do(req)
+	}
+	user, err := c.auth.GetUser(c.hostConfig())
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+user.Token)
+	return c.send(req, c.http.Do)
+}
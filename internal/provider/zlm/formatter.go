@@ -1,25 +1,25 @@
 package zlm
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/domain"
-	"github.com/zarazaex69/mo/internal/pkg/logger"
-	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/pkg/sse"
+	"github.com/zarazaex69/mo/internal/service/drift"
 )
 
-var glmBlockRegex = regexp.MustCompile(`<glm_block[^>]*tool_call_name="([^"]+)"[^>]*>(.+?)</glm_block>`)
-
 // pre-compiled regexes
 var (
-	reGlmBlockStart  = regexp.MustCompile(`\n*<glm_block[^>]*>\{"type": "mcp", "data": \{"metadata": \{`)
-	reGlmBlockEnd    = regexp.MustCompile(`[}"], "result": "".*</glm_block>`)
-	reGlmBlockClose  = regexp.MustCompile(`null, "display_result": "".*</glm_block>`)
 	reSummary        = regexp.MustCompile(`\n*<summary>.*?</summary>\n*`)
 	reDetailsOpen    = regexp.MustCompile(`<details[^>]*>\n*`)
 	reDetailsClose   = regexp.MustCompile(`\n*</details>`)
@@ -28,16 +28,49 @@ var (
 	reReasoningClose = regexp.MustCompile(`\n*</reasoning>`)
 )
 
+// phases the formatter knows, "" is sent on bookkeeping events
+var knownPhases = map[string]bool{
+	"":          true,
+	"thinking":  true,
+	"answer":    true,
+	"tool_call": true,
+	"other":     true,
+	// web search progress and the result list
+	"search": true,
+	// code the model ran and its output
+	"code_execution": true,
+	// rendered artifacts, html and the like
+	"preview": true,
+}
+
+// phases whose text belongs to the reply, the rest never reaches content
+var replyPhases = map[string]bool{
+	"answer":    true,
+	"tool_call": true,
+	"other":     true,
+}
+
+// fields of domain.ZaiResponseData, keep in sync
+var knownDataFields = map[string]bool{
+	"phase":         true,
+	"delta_content": true,
+	"edit_content":  true,
+	"edit_index":    true,
+	"done":          true,
+}
+
 type Formatter struct {
-	cfg       *config.Config
-	prevPhase string
+	cfg *config.Config
+	// thinking held back: a summary still open or a tag cut in half
+	pending string
+	blocks  blockParser
+	// a complete block that could not be read
+	badBlock bool
+	answer   *answerCleaner
 }
 
 func NewFormatter(cfg *config.Config) *Formatter {
-	return &Formatter{
-		cfg:       cfg,
-		prevPhase: "thinking",
-	}
+	return &Formatter{cfg: cfg, answer: newAnswerCleaner(cfg.Model.AnswerCleaners)}
 }
 
 func (f *Formatter) Format(data *domain.ZaiResponse) map[string]any {
@@ -58,36 +91,113 @@ func (f *Formatter) Format(data *domain.ZaiResponse) map[string]any {
 		return nil
 	}
 
-	logger.Debug().
+	log.Trace().
 		Str("phase", phase).
 		Int("len", len(content)).
 		Msg("z.ai chunk")
 
-	// tool_call handling
-	if phase == "tool_call" {
-		content = reGlmBlockStart.ReplaceAllString(content, "{")
-		content = reGlmBlockEnd.ReplaceAllString(content, "")
-	} else if phase == "other" && f.prevPhase == "tool_call" && strings.Contains(content, "glm_block") {
-		phase = "tool_call"
-		content = reGlmBlockClose.ReplaceAllString(content, "\"}")
+	// search results and the like, phases drift has not seen yet included
+	if phase != "thinking" && !replyPhases[phase] {
+		log.Debug().Str("phase", phase).Int("len", len(content)).Msg("upstream event")
+		return map[string]any{"upstream_event": domain.UpstreamEvent{Phase: phase, Content: content}}
+	}
+
+	var summaries []string
+	var calls []domain.ToolCall
+	if phase == "thinking" {
+		content, summaries = f.cutSummaries(content)
+	} else {
+		f.pending = ""
+		var blocks []string
+		content, blocks = f.blocks.feed(content)
+		content = f.answer.feed(content, data.Data.DeltaContent == "")
+		for _, b := range blocks {
+			if tc := parseBlock(b); tc != nil {
+				calls = append(calls, *tc)
+			} else {
+				f.badBlock = true
+			}
+		}
 	}
 
 	content = f.formatThinking(phase, content)
-	f.prevPhase = phase
 
-	if phase == "thinking" && f.cfg.Model.ThinkMode == "reasoning" {
-		return map[string]any{"role": "assistant", "reasoning_content": content}
+	var delta map[string]any
+	switch {
+	case phase == "thinking" && f.cfg.Model.ThinkMode == "reasoning":
+		delta = map[string]any{"role": "assistant", "reasoning_content": content}
+	case content != "":
+		delta = map[string]any{"role": "assistant", "content": content}
+	case len(summaries) > 0:
+		delta = map[string]any{"role": "assistant"}
+	case len(calls) > 0:
+		delta = map[string]any{}
+	default:
+		return nil
+	}
+
+	if len(calls) > 0 {
+		delta["tool_calls"] = calls
 	}
 
-	if phase == "tool_call" {
-		return map[string]any{"tool_call": content}
+	// titles of the reasoning steps, the caller decides whether to show them
+	if len(summaries) > 0 {
+		delta["reasoning_summaries"] = summaries
 	}
+	return delta
+}
+
+// Flush is the answer text the cleaners still held back, sent once the
+// stream ended
+func (f *Formatter) Flush() string {
+	return f.answer.flush()
+}
+
+// PartialToolCall reports a block that never closed or could not be read
+func (f *Formatter) PartialToolCall() bool {
+	return f.blocks.open() || f.badBlock
+}
+
+const (
+	summaryOpen  = "<summary>"
+	summaryClose = "</summary>"
+)
 
-	if content != "" {
-		return map[string]any{"role": "assistant", "content": content}
+// cutSummaries takes the <summary> titles out of thinking, a blank line
+// stays where they were. a summary split over deltas or a tag cut at the
+// end of one is held back until the rest arrives
+func (f *Formatter) cutSummaries(content string) (string, []string) {
+	content = f.pending + content
+	f.pending = ""
+
+	var out strings.Builder
+	var summaries []string
+	for {
+		start := strings.Index(content, summaryOpen)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(content[start:], summaryClose)
+		if end < 0 {
+			f.pending = content[start:]
+			content = content[:start]
+			break
+		}
+		if title := strings.TrimSpace(content[start+len(summaryOpen) : start+end]); title != "" {
+			summaries = append(summaries, title)
+		}
+		out.WriteString(strings.TrimRight(content[:start], "\n"))
+		out.WriteString("\n\n")
+		content = strings.TrimLeft(content[start+end+len(summaryClose):], "\n")
 	}
 
-	return nil
+	if f.pending == "" {
+		n := partialPrefix(content, summaryOpen)
+		f.pending = content[len(content)-n:]
+		content = content[:len(content)-n]
+	}
+	out.WriteString(content)
+	return out.String(), summaries
 }
 
 func (f *Formatter) formatThinking(phase, content string) string {
@@ -133,118 +243,123 @@ func (f *Formatter) formatThinking(phase, content string) string {
 	return content
 }
 
-func ParseSSEStream(resp *http.Response) <-chan *domain.ZaiResponse {
+// ErrStreamStalled ends a stream that went silent for longer than the idle timeout
+var ErrStreamStalled = errors.New("upstream stream stalled")
+
+// ErrUpstreamEvent ends a stream on an "event: error" from z.ai
+var ErrUpstreamEvent = errors.New("upstream error event")
+
+// ParseSSEStream decodes z.ai events. a stream silent for idle is closed
+// and its last event carries ErrStreamStalled, idle <= 0 waits forever.
+// only time spent reading counts, not time the consumer takes. an error
+// event ends the stream with ErrUpstreamEvent. ctx carries the request logger
+func ParseSSEStream(ctx context.Context, resp *http.Response, idle time.Duration) <-chan *domain.ZaiResponse {
 	ch := make(chan *domain.ZaiResponse)
 
 	go func() {
 		defer close(ch)
 
-		scanner := bufio.NewScanner(resp.Body)
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
-
-		for scanner.Scan() {
-			line := scanner.Text()
-			if len(line) == 0 || !strings.HasPrefix(line, "data: ") {
-				continue
+		var stalled atomic.Bool
+		timer := time.AfterFunc(time.Hour, func() {
+			stalled.Store(true)
+			resp.Body.Close()
+		})
+		timer.Stop()
+
+		events := sse.NewReader(resp.Body)
+		var err error
+		for {
+			if idle > 0 {
+				timer.Reset(idle)
+			}
+			var ev sse.Event
+			ev, err = events.Next()
+			timer.Stop()
+			if err != nil {
+				break
 			}
 
-			data := line[6:]
+			data := ev.Data
 			if strings.TrimSpace(data) == "[DONE]" {
 				continue
 			}
 
+			log.Raw(ctx).Str("event", ev.Name).Str("data", data).Msg("z.ai sse")
+			drift.Event()
+			if ev.Name == "error" {
+				log.Ctx(ctx).Warn().Str("data", data).Msg("upstream sent an error event")
+				ch <- &domain.ZaiResponse{Event: ev.Name, Err: fmt.Errorf("%w: %s", ErrUpstreamEvent, eventMessage(data))}
+				return
+			}
+
 			var zaiResp domain.ZaiResponse
 			if err := json.Unmarshal([]byte(data), &zaiResp); err != nil {
-				logger.Debug().Err(err).Str("data", data).Msg("parse sse failed")
+				log.Ctx(ctx).Debug().Err(err).Str("data", data).Msg("parse sse failed")
+				drift.Record(drift.ParseFailure, "sse", data)
 				continue
 			}
+			zaiResp.Event = ev.Name
+			checkDrift(data, &zaiResp)
 
 			ch <- &zaiResp
 		}
 
-		if err := scanner.Err(); err != nil {
-			logger.Error().Err(err).Msg("sse read error")
+		if stalled.Load() {
+			log.Ctx(ctx).Warn().Dur("idle", idle).Msg("upstream stream stalled, aborting")
+			ch <- &domain.ZaiResponse{Err: fmt.Errorf("%w: no data for %s", ErrStreamStalled, idle)}
+			return
+		}
+		if err != io.EOF {
+			log.Ctx(ctx).Error().Err(err).Msg("sse read error")
 		}
 	}()
 
 	return ch
 }
 
-func ExtractTextFromMessages(msgs []domain.Message) string {
-	var texts []string
-
-	for _, msg := range msgs {
-		if s, ok := msg.Content.(string); ok {
-			texts = append(texts, s)
-			continue
-		}
-
-		if arr, ok := msg.Content.([]any); ok {
-			for _, item := range arr {
-				if m, ok := item.(map[string]any); ok {
-					if m["type"] == "text" {
-						if t, ok := m["text"].(string); ok {
-							texts = append(texts, t)
-						}
-					}
-				}
+// eventMessage is what an error event says, its message or detail when it
+// is json, else its text cut short
+func eventMessage(data string) string {
+	var body struct {
+		Detail string `json:"detail"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal([]byte(data), &body) == nil {
+		for _, msg := range []string{body.Error.Message, body.Message, body.Detail} {
+			if msg != "" {
+				return msg
 			}
 		}
 	}
-
-	return strings.Join(texts, " ")
-}
-
-func CountTokens(msgs []domain.Message, tokenizer utils.Tokener) int {
-	return tokenizer.Count(ExtractTextFromMessages(msgs))
-}
-
-func ParseToolCall(content string) *domain.ToolCall {
-	matches := glmBlockRegex.FindStringSubmatch(content)
-	if len(matches) < 3 {
-		return nil
-	}
-
-	var wrapper struct {
-		Type string `json:"type"`
-		Data struct {
-			Metadata struct {
-				ID        string `json:"id"`
-				Name      string `json:"name"`
-				Arguments string `json:"arguments"`
-			} `json:"metadata"`
-		} `json:"data"`
+	if len(data) > 200 {
+		return data[:200] + "..."
 	}
+	return data
+}
 
-	if err := json.Unmarshal([]byte(matches[2]), &wrapper); err != nil {
-		logger.Debug().Err(err).Msg("failed to parse tool call json")
-		return nil
+// checkDrift reports phases and data fields mo does not know, the first
+// sign that z.ai changed its stream format
+func checkDrift(data string, resp *domain.ZaiResponse) {
+	if resp.Data == nil {
+		return
 	}
-
-	callID := wrapper.Data.Metadata.ID
-	if callID == "" {
-		callID = "call_" + utils.GenerateID()[:10]
+	if !knownPhases[resp.Data.Phase] {
+		drift.Record(drift.UnknownPhase, resp.Data.Phase, data)
 	}
 
-	args := wrapper.Data.Metadata.Arguments
-	if args == "" {
-		args = "{}"
+	// the typed decode drops unknown fields, read the keys on the side
+	var raw struct {
+		Data map[string]json.RawMessage `json:"data"`
 	}
-
-	return &domain.ToolCall{
-		ID:   callID,
-		Type: "function",
-		Function: domain.FunctionCall{
-			Name:      matches[1],
-			Arguments: args,
-		},
+	if json.Unmarshal([]byte(data), &raw) != nil {
+		return
 	}
-}
-
-func StripToolCallBlock(content string) string {
-	if !strings.Contains(content, "glm_block") {
-		return content
+	for field := range raw.Data {
+		if !knownDataFields[field] {
+			drift.Record(drift.UnexpectedField, field, data)
+		}
 	}
-	return glmBlockRegex.ReplaceAllString(content, "")
 }
@@ -0,0 +1,259 @@
+package zlm
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestParseSSEStreamIdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	go func() {
+		pw.Write([]byte(`data: {"data": {"phase": "answer", "delta_content": "hel"}}` + "\n\n"))
+		time.Sleep(30 * time.Millisecond)
+		pw.Write([]byte(`data: {"data": {"phase": "answer", "delta_content": "lo"}}` + "\n\n"))
+		// then upstream hangs without closing
+	}()
+
+	ch := ParseSSEStream(context.Background(), &http.Response{Body: pr}, 100*time.Millisecond)
+
+	var got []string
+	var err error
+	for ev := range ch {
+		if ev.Err != nil {
+			err = ev.Err
+			continue
+		}
+		got = append(got, ev.Data.DeltaContent)
+		// a slow consumer is not a stalled upstream
+		time.Sleep(150 * time.Millisecond)
+	}
+
+	assert.Equal(t, []string{"hel", "lo"}, got)
+	require.ErrorIs(t, err, ErrStreamStalled)
+}
+
+func TestParseSSEStreamNoIdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte(`data: {"data": {"phase": "answer", "delta_content": "hi", "done": true}}` + "\n\n"))
+		time.Sleep(50 * time.Millisecond)
+		pw.Close()
+	}()
+
+	var n int
+	for ev := range ParseSSEStream(context.Background(), &http.Response{Body: pr}, 0) {
+		assert.NoError(t, ev.Err)
+		n++
+	}
+	assert.Equal(t, 1, n)
+}
+
+// events reads a z.ai stream fixture, a leading comment marks the
+// hand-written ones
+func events(t *testing.T, name string) []*domain.ZaiResponse {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	defer f.Close()
+
+	var evs []*domain.ZaiResponse
+	for ev := range ParseSSEStream(context.Background(), &http.Response{Body: f}, 0) {
+		require.NoError(t, ev.Err)
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+func format(fmtr *Formatter, evs []*domain.ZaiResponse) []map[string]any {
+	var deltas []map[string]any
+	for _, ev := range evs {
+		if d := fmtr.Format(ev); d != nil {
+			deltas = append(deltas, d)
+		}
+	}
+	return deltas
+}
+
+// replay runs a z.ai stream fixture through a formatter
+func replay(t *testing.T, name string, cfg *config.Config) []map[string]any {
+	t.Helper()
+	return format(NewFormatter(cfg), events(t, name))
+}
+
+func TestFormatterSummaries(t *testing.T) {
+	for _, mode := range []string{"reasoning", "think", "strip", "details"} {
+		t.Run(mode, func(t *testing.T) {
+			deltas := replay(t, "thinking_summaries.sse", &config.Config{Model: config.ModelConfig{ThinkMode: mode}})
+
+			var text strings.Builder
+			var summaries []string
+			for _, d := range deltas {
+				if s, ok := d["content"].(string); ok {
+					text.WriteString(s)
+				}
+				if s, ok := d["reasoning_content"].(string); ok {
+					text.WriteString(s)
+				}
+				if s, ok := d["reasoning_summaries"].([]string); ok {
+					summaries = append(summaries, s...)
+				}
+			}
+
+			assert.Equal(t, []string{"Recalling the capital", "Checking the answer"}, summaries)
+			assert.NotContains(t, text.String(), "summary>")
+			assert.NotContains(t, text.String(), "<sum")
+			assert.NotContains(t, text.String(), "Recalling")
+			assert.Contains(t, text.String(), "The capital of France is Paris.")
+		})
+	}
+}
+
+func TestCutSummariesPartialTag(t *testing.T) {
+	f := NewFormatter(&config.Config{})
+
+	got, s := f.cutSummaries("step one <")
+	assert.Equal(t, "step one ", got)
+	assert.Empty(t, s)
+
+	got, s = f.cutSummaries("b>bold</b>")
+	assert.Equal(t, "<b>bold</b>", got, "a tag that is not a summary is let through")
+	assert.Empty(t, s)
+
+	got, s = f.cutSummaries("<summary>Half")
+	assert.Empty(t, got)
+	assert.Empty(t, s)
+
+	got, s = f.cutSummaries(" done</summ")
+	assert.Empty(t, got)
+	assert.Empty(t, s)
+
+	got, s = f.cutSummaries("ary>\nnext")
+	assert.Equal(t, "\n\nnext", got)
+	assert.Equal(t, []string{"Half done"}, s)
+}
+
+func TestFormatterUpstreamEvents(t *testing.T) {
+	tests := []struct {
+		fixture string
+		content string
+		phase   string
+		event   string
+	}{
+		{
+			fixture: "web_search.sse",
+			content: "Go 1.25 was released in August 2025.",
+			phase:   "search",
+			event: "Searching: go 1.25 release date\n" +
+				"1. [Go 1.25 is released](https://go.dev/blog/go1.25)\n" +
+				"2. [Release History](https://go.dev/doc/devel/release)\n",
+		},
+		{
+			fixture: "code_execution.sse",
+			content: "Let me compute it. The sum is 5050.",
+			phase:   "code_execution",
+			event:   "```python\nprint(sum(range(101)))\n```\nOutput:\n5050\n",
+		},
+		{
+			fixture: "preview.sse",
+			content: "Here is the page.",
+			phase:   "preview",
+			event:   "<!doctype html><html><body><h1>Hi</h1></body></html>",
+		},
+		{
+			// a phase drift has not seen yet is kept out of the reply as well
+			fixture: "unknown_phase.sse",
+			content: "ok",
+			phase:   "mind_map",
+			event:   "- root\n  - leaf\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			deltas := replay(t, tt.fixture, &config.Config{Model: config.ModelConfig{ThinkMode: "reasoning"}})
+
+			var content, event strings.Builder
+			for _, d := range deltas {
+				if c, ok := d["content"].(string); ok {
+					content.WriteString(c)
+				}
+				if ev, ok := d["upstream_event"].(domain.UpstreamEvent); ok {
+					assert.Equal(t, tt.phase, ev.Phase)
+					assert.Len(t, d, 1, "events travel alone")
+					event.WriteString(ev.Content)
+				}
+			}
+			assert.Equal(t, tt.content, content.String())
+			assert.Equal(t, tt.event, event.String())
+		})
+	}
+}
+
+func TestParseSSEStreamFraming(t *testing.T) {
+	answer := func(delta string) string {
+		return `{"data": {"phase": "answer", "delta_content": "` + delta + `"}}`
+	}
+	giant := strings.Repeat("x", 2<<20)
+
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+		err    error
+		errMsg string
+	}{
+		{name: "lf", stream: "data: " + answer("a") + "\n\ndata: " + answer("b") + "\n\n", want: []string{"a", "b"}},
+		{name: "crlf", stream: "data: " + answer("a") + "\r\n\r\ndata: [DONE]\r\n\r\n", want: []string{"a"}},
+		{name: "cr", stream: "data: " + answer("a") + "\r\rdata: " + answer("b") + "\r\r", want: []string{"a", "b"}},
+		{name: "multi-line data", stream: "data: {\"data\": {\"phase\": \"answer\",\ndata: \"delta_content\": \"a\"}}\n\n", want: []string{"a"}},
+		{name: "comments and ids", stream: ": ping\n\nid: 1\ndata: " + answer("a") + "\n\n", want: []string{"a"}},
+		{name: "giant delta", stream: "data: " + answer(giant) + "\n\n", want: []string{giant}},
+		{
+			name:   "error event",
+			stream: "data: " + answer("a") + "\n\nevent: error\ndata: {\"error\": {\"message\": \"model overloaded\"}}\n\ndata: " + answer("never") + "\n\n",
+			want:   []string{"a"},
+			err:    ErrUpstreamEvent,
+			errMsg: "model overloaded",
+		},
+		{
+			name:   "error event with text",
+			stream: "event: error\ndata: rate limited\n\n",
+			err:    ErrUpstreamEvent,
+			errMsg: "rate limited",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(tt.stream))}
+			var got []string
+			var err error
+			for ev := range ParseSSEStream(context.Background(), resp, 0) {
+				if ev.Err != nil {
+					err = ev.Err
+					continue
+				}
+				got = append(got, ev.Data.DeltaContent)
+			}
+			assert.Equal(t, tt.want, got)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
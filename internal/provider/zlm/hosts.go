@@ -0,0 +1,105 @@
+package zlm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+	"github.com/zarazaex69/mo/internal/service/failover"
+)
+
+// Hosts reports the upstream hosts and their failover state
+func (c *Client) Hosts() []failover.HostStatus {
+	return c.hosts.Status()
+}
+
+// HostPool is the failover pool, the server runs its probes
+func (c *Client) HostPool() *failover.Pool {
+	return c.hosts
+}
+
+// hostConfig is cfg pointed at the preferred host with the current
+// X-FE-Version, for callers that build their own requests
+func (c *Client) hostConfig() *config.Config {
+	cfg := *c.cfg
+	cfg.Upstream.Host = c.hosts.Preferred()
+	cfg.Upstream.Hosts = nil
+	if c.feVersion != nil {
+		cfg.Headers.XFEVersion = c.feVersion()
+	}
+	return &cfg
+}
+
+// send tries req on every host in failover order. the response handed back
+// is unread, so moving on is only ever done before a byte has streamed.
+// a host fails on errors and 5xx, other statuses are the request's fault
+func (c *Client) send(req *http.Request, do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	hosts := c.hosts.Order()
+	for i, host := range hosts {
+		try := req.Clone(req.Context())
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("rewind body: %w", err)
+			}
+			try.Body = body
+		}
+		try.URL.Host = host
+		try.Host = ""
+
+		resp, err := do(try)
+		failure := hostFailure(resp, err)
+		if failure == nil {
+			c.hosts.Succeeded(host)
+			return resp, nil
+		}
+		// the caller went away, that says nothing about the host
+		if errors.Is(err, context.Canceled) {
+			return resp, err
+		}
+		c.hosts.Failed(host, failure)
+
+		if i == len(hosts)-1 || !replayable {
+			return resp, err
+		}
+		log.Ctx(req.Context()).Warn().Str("host", host).Str("next", hosts[i+1]).Err(failure).Msg("upstream host failed, trying the next")
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+	}
+	return nil, errors.New("no upstream host configured")
+}
+
+func hostFailure(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeHost asks one host for its models, any answer below 500 means the
+// host is serving again
+func (c *Client) probeHost(host string) error {
+	req, err := c.modelsRequest()
+	if err != nil {
+		return err
+	}
+	req.URL.Host = host
+
+	resp, err := httpclient.New(10 * time.Second).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return hostFailure(resp, nil)
+}
@@ -0,0 +1,85 @@
+package zlm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+)
+
+// ErrImageFetch marks a remote image that could not be downloaded or is
+// not an image, the client sent a bad url
+var ErrImageFetch = errors.New("image fetch failed")
+
+// cap for remote images when max_image_bytes is disabled
+const maxRemoteImageBytes = 32 << 20
+
+var imageExts = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+func isRemoteURL(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// UploadRemoteImage downloads an http(s) image and uploads it like a data url
+func (c *Client) UploadRemoteImage(url, chatID string, user *domain.User) (*domain.UploadedFile, error) {
+	data, contentType, err := c.fetchImage(url, c.cfg.Limits.MaxImageBytes)
+	if errors.Is(err, ErrImageTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrImageFetch, err)
+	}
+
+	filename := fmt.Sprintf("%s.%s", utils.GenerateID(), imageExts[contentType])
+	return c.uploadFile(data, filename, contentType, chatID, user)
+}
+
+// fetchImage downloads at most limit bytes and trusts the bytes over the
+// content-type header, only the four image types z.ai renders are accepted
+func (c *Client) fetchImage(url string, limit int) ([]byte, string, error) {
+	if limit <= 0 {
+		limit = maxRemoteImageBytes
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid url: %w", err)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := c.fetch.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("download: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download returned %d", resp.StatusCode)
+	}
+	if resp.ContentLength > int64(limit) {
+		return nil, "", ErrImageTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("download: %w", err)
+	}
+	if len(data) > limit {
+		return nil, "", ErrImageTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	if _, ok := imageExts[contentType]; !ok {
+		return nil, "", fmt.Errorf("not a supported image (%s)", contentType)
+	}
+	return data, contentType, nil
+}
@@ -0,0 +1,61 @@
+package zlm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+)
+
+// ListModels fetches the model ids currently served by z.ai
+func (c *Client) ListModels() ([]string, error) {
+	req, err := c.modelsRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(req, httpclient.New(10*time.Second).WithRetry(retryPolicy(c.cfg)).Do)
+	if err != nil {
+		return nil, fmt.Errorf("fetch models: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("models api returned %d", resp.StatusCode)
+	}
+
+	var upstream struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&upstream); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	ids := make([]string, 0, len(upstream.Data))
+	for _, m := range upstream.Data {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+func (c *Client) modelsRequest() (*http.Request, error) {
+	token, _, err := c.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", c.cfg.ModelsURL(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	for k, v := range c.upstreamHeaders() {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, nil
+}
@@ -4,22 +4,23 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"strings"
-	"time"
 
-	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/domain"
-	"github.com/zarazaex69/mo/internal/pkg/logger"
 	"github.com/zarazaex69/mo/internal/pkg/utils"
-	"github.com/zarazaex69/mo/internal/service/auth"
 )
 
-func FormatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]interface{}, error) {
+// FormatRequest builds the upstream body. attachments are uploaded as user,
+// the account the chat itself is sent from
+func (c *Client) FormatRequest(req *domain.ChatRequest, user *domain.User, chatID string) (map[string]interface{}, error) {
+	cfg := c.cfg
 	result := make(map[string]interface{})
 
 	model := req.Model
@@ -29,28 +30,55 @@ func FormatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]inte
 
 	var msgs []map[string]interface{}
 	var files []domain.FileAttachment
-	chatID := utils.GenerateRequestID()
 	userMsgID := utils.GenerateRequestID()
 
+	// call id -> function name, so every result names the call it answers
+	callNames := make(map[string]string)
 	for _, msg := range req.Messages {
+		for _, tc := range msg.ToolCalls {
+			callNames[tc.ID] = tc.Function.Name
+		}
+	}
+
+	// url -> upload, the same image in several messages is uploaded once
+	uploads := make(map[string]*domain.UploadedFile)
+
+	prevTool := false
+	for i, msg := range req.Messages {
 		newMsg := map[string]interface{}{"role": msg.Role}
+		if msg.Name != "" {
+			newMsg["name"] = msg.Name
+		}
 
-		// handle tool role - convert to format z.ai understands
+		// z.ai has no tool role, results go back as a user turn and
+		// consecutive results of one parallel call share that turn
 		if msg.Role == "tool" {
-			content := ""
-			if s, ok := msg.Content.(string); ok {
-				content = s
+			result := renderToolResult(msg, callNames)
+			if prevTool {
+				last := msgs[len(msgs)-1]
+				last["content"] = last["content"].(string) + "\n" + result
+				continue
 			}
-			// z.ai expects tool results as user message with special format
+
 			newMsg["role"] = "user"
-			newMsg["content"] = fmt.Sprintf("[Tool Result]\n%s", content)
+			delete(newMsg, "name")
+			newMsg["content"] = result
 			msgs = append(msgs, newMsg)
+			prevTool = true
 			continue
 		}
+		prevTool = false
 
-		// handle assistant with tool_calls
+		// assistant tool calls are replayed as the glm_block markup z.ai emits
 		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
-			// skip assistant tool call messages, z.ai handles this differently
+			var b strings.Builder
+			b.WriteString(messageText(msg.Content))
+			for _, tc := range msg.ToolCalls {
+				b.WriteString("\n\n")
+				b.WriteString(renderToolCall(tc))
+			}
+			newMsg["content"] = strings.TrimLeft(b.String(), "\n")
+			msgs = append(msgs, newMsg)
 			continue
 		}
 
@@ -62,7 +90,8 @@ func FormatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]inte
 
 		// multimodal array
 		if arr, ok := msg.Content.([]interface{}); ok {
-			var textContent string
+			// text parts in order, a transcription stands among them
+			var texts []string
 
 			for _, item := range arr {
 				m, ok := item.(map[string]interface{})
@@ -74,11 +103,18 @@ func FormatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]inte
 
 				if itemType == "text" {
 					if t, ok := m["text"].(string); ok {
-						textContent = t
+						texts = append(texts, t)
 					}
 					continue
 				}
 
+				// the server transcribes audio first, one left over would
+				// vanish from the prompt unheard
+				if itemType == "input_audio" {
+					return nil, domain.NewAPIError(http.StatusBadRequest, "z.ai does not accept audio, configure audio.transcription_url").
+						WithParam(fmt.Sprintf("messages[%d].content", i)).WithCode("unsupported_content_part")
+				}
+
 				if itemType == "image_url" {
 					mediaURL := ""
 					if imgURL, ok := m["image_url"].(map[string]interface{}); ok {
@@ -91,41 +127,107 @@ func FormatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]inte
 						continue
 					}
 
-					// upload if base64 and get full metadata
-					uploaded, err := UploadImageFull(mediaURL, chatID, cfg)
+					// documents sent as image_url data urls are still documents
+					if mime := DataURLMIME(mediaURL); mime != "" && !strings.HasPrefix(mime, "image/") {
+						uploaded, err := c.UploadFileFull(mediaURL, "", chatID, user)
+						if err != nil {
+							return nil, err
+						}
+						files = append(files, fileAttachment(uploaded, "file"))
+						continue
+					}
+
+					if _, ok := uploads[mediaURL]; ok {
+						continue
+					}
+
+					// remote images are downloaded first, a bad url is the client's fault
+					var uploaded *domain.UploadedFile
+					var err error
+					if isRemoteURL(mediaURL) {
+						uploaded, err = c.UploadRemoteImage(mediaURL, chatID, user)
+						param := fmt.Sprintf("messages[%d].content", i)
+						switch {
+						case errors.Is(err, ErrImageTooLarge):
+							return nil, domain.NewAPIError(http.StatusRequestEntityTooLarge,
+								fmt.Sprintf("image %s exceeds max_image_bytes", mediaURL)).
+								WithParam(param).WithCode("image_too_large")
+						case errors.Is(err, ErrImageFetch):
+							return nil, domain.NewAPIError(http.StatusBadRequest,
+								fmt.Sprintf("image %s: %v", mediaURL, err)).
+								WithParam(param).WithCode("invalid_image_url")
+						}
+					} else {
+						// upload if base64 and get full metadata
+						uploaded, err = c.UploadImageFull(mediaURL, chatID, user)
+					}
+					if errors.Is(err, ErrImageTooLarge) {
+						return nil, err
+					}
 					if err != nil {
-						logger.Warn().Err(err).Msg("image upload failed")
+						log.Warn().Err(err).Msg("image upload failed")
 						continue
 					}
 
 					if uploaded != nil {
-						// build file attachment in z.ai format
-						attachment := domain.FileAttachment{
-							Type:   "image",
-							File:   uploaded,
-							ID:     uploaded.ID,
-							URL:    fmt.Sprintf("/api/v1/files/%s/content", uploaded.ID),
-							Name:   uploaded.Filename,
-							Status: "uploaded",
-							Size:   uploaded.Meta.Size,
-							Error:  "",
-							ItemID: utils.GenerateRequestID(),
-							Media:  "image",
-						}
-						files = append(files, attachment)
+						uploads[mediaURL] = uploaded
+						files = append(files, fileAttachment(uploaded, "image"))
 					}
+					continue
+				}
+
+				if itemType == "file" {
+					f, _ := m["file"].(map[string]interface{})
+					data, _ := f["file_data"].(string)
+					name, _ := f["filename"].(string)
+					if data == "" {
+						// file_id points into openai's file store, which mo has no access to
+						return nil, fmt.Errorf("%w: file parts need file_data", ErrUnsupportedFile)
+					}
+
+					uploaded, err := c.UploadFileFull(data, name, chatID, user)
+					if err != nil {
+						return nil, err
+					}
+					files = append(files, fileAttachment(uploaded, "file"))
 				}
 			}
 
-			newMsg["content"] = textContent
+			newMsg["content"] = strings.Join(texts, "\n")
 			msgs = append(msgs, newMsg)
 		}
 	}
 
+	// z.ai has no json mode, the schema goes into the system prompt
+	if req.ResponseFormat.WantsJSON() {
+		msgs = withSystemInstruction(msgs, jsonInstruction(req.ResponseFormat))
+	}
+
+	if len(req.Tools) > 0 && req.SingleToolCall() {
+		msgs = withSystemInstruction(msgs, singleToolInstruction)
+	}
+
+	// a trailing assistant message is a prefill whether or not the client
+	// said so, z.ai would otherwise take it as a finished turn
+	if (req.ContinueFinalMessage || req.Prefill() != "") && len(msgs) > 0 && msgs[len(msgs)-1]["role"] == "assistant" {
+		msgs = withSystemInstruction(msgs, continueInstruction)
+	}
+
 	result["model"] = model
 	result["messages"] = msgs
 	result["stream"] = true
-	result["params"] = map[string]interface{}{}
+	params := map[string]interface{}{}
+	if req.Seed != nil {
+		params["seed"] = *req.Seed
+	}
+	// sampling knobs ride along in params, z.ai drops what it does not know
+	if req.FrequencyPenalty != nil {
+		params["frequency_penalty"] = *req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		params["presence_penalty"] = *req.PresencePenalty
+	}
+	result["params"] = params
 
 	// add files if any
 	if len(files) > 0 {
@@ -163,23 +265,170 @@ func FormatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]inte
 		result["tools"] = tools
 	}
 
-	features := map[string]interface{}{
+	result["features"] = map[string]interface{}{
 		"image_generation": false,
 		"web_search":       false,
 		"auto_web_search":  false,
+		"thinking":         req.ThinkingEnabled(),
 	}
 
-	if req.Thinking != nil {
-		features["thinking"] = *req.Thinking
+	return result, nil
+}
+
+func jsonInstruction(rf *domain.ResponseFormat) string {
+	text := "Respond with a single valid JSON object only. Do not wrap it in markdown code fences and do not add any text before or after it."
+	if rf.Type == "json_schema" && rf.JSONSchema != nil && rf.JSONSchema.Schema != nil {
+		schema, _ := json.Marshal(rf.JSONSchema.Schema)
+		text += fmt.Sprintf("\nThe JSON must conform to this JSON Schema (%s):\n%s", rf.JSONSchema.Name, schema)
 	}
+	return text
+}
 
-	result["features"] = features
+// z.ai has no assistant prefill, the model is told to pick up the last turn
+const continueInstruction = "Your last message was cut off. Continue it exactly where it stops, without repeating any of it and without any preamble."
 
-	return result, nil
+// parallel_tool_calls: false, the handler still drops any extra call
+const singleToolInstruction = "Call at most one tool per reply. If several calls are needed, make the first one and wait for its result before the next."
+
+// withSystemInstruction appends to the leading system message or adds one
+func withSystemInstruction(msgs []map[string]interface{}, text string) []map[string]interface{} {
+	if len(msgs) > 0 && msgs[0]["role"] == "system" {
+		if s, ok := msgs[0]["content"].(string); ok {
+			msgs[0]["content"] = s + "\n\n" + text
+			return msgs
+		}
+	}
+	return append([]map[string]interface{}{{"role": "system", "content": text}}, msgs...)
+}
+
+// renderToolCall encodes a call the way upstream streams it, ParseToolCall
+// reads it back
+func renderToolCall(tc domain.ToolCall) string {
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	args := tc.Function.Arguments
+	if args == "" {
+		args = "{}"
+	}
+
+	return fmt.Sprintf(`<glm_block view="" tool_call_name="%s">{"type": "mcp", "data": {"metadata": {"id": %s, "name": %s, "arguments": %s}, "result": ""}}</glm_block>`,
+		html.EscapeString(tc.Function.Name), quote(tc.ID), quote(tc.Function.Name), quote(args))
+}
+
+func renderToolResult(msg domain.Message, callNames map[string]string) string {
+	name := msg.Name
+	if name == "" {
+		name = callNames[msg.ToolCallID]
+	}
+
+	return fmt.Sprintf("<tool_result tool_call_id=\"%s\" name=\"%s\">\n%s\n</tool_result>",
+		html.EscapeString(msg.ToolCallID), html.EscapeString(name), messageText(msg.Content))
+}
+
+// messageText returns string content or the joined text parts of an array
+func messageText(content interface{}) string {
+	if s, ok := content.(string); ok {
+		return s
+	}
+
+	var texts []string
+	if arr, ok := content.([]interface{}); ok {
+		for _, item := range arr {
+			if m, ok := item.(map[string]interface{}); ok && m["type"] == "text" {
+				if t, ok := m["text"].(string); ok {
+					texts = append(texts, t)
+				}
+			}
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+var (
+	ErrImageTooLarge   = errors.New("image exceeds max_image_bytes")
+	ErrUnsupportedFile = errors.New("unsupported file type")
+)
+
+// document types z.ai reads, with the extension the upload is named with.
+// any other text/* type is sent as plain text
+var fileExts = map[string]string{
+	"application/pdf": "pdf",
+	"text/plain":      "txt",
+	"text/markdown":   "md",
+	"text/csv":        "csv",
+	"text/html":       "html",
+}
+
+// SupportedFileType reports whether a document of this mime type can be uploaded
+func SupportedFileType(mime string) bool {
+	_, ok := fileExts[mime]
+	return ok || strings.HasPrefix(mime, "text/")
+}
+
+// DataURLMIME returns the mime type of a data url, "" for anything else
+func DataURLMIME(dataURL string) string {
+	header, _, ok := strings.Cut(dataURL, ",")
+	if !ok {
+		return ""
+	}
+	header, ok = strings.CutPrefix(header, "data:")
+	if !ok {
+		return ""
+	}
+	mime, _, _ := strings.Cut(header, ";")
+	return strings.ToLower(strings.TrimSpace(mime))
+}
+
+// fileAttachment builds the z.ai attachment of an uploaded file, media is
+// "image" or "file"
+func fileAttachment(uploaded *domain.UploadedFile, media string) domain.FileAttachment {
+	return domain.FileAttachment{
+		Type:   media,
+		File:   uploaded,
+		ID:     uploaded.ID,
+		URL:    fmt.Sprintf("/api/v1/files/%s/content", uploaded.ID),
+		Name:   uploaded.Filename,
+		Status: "uploaded",
+		Size:   uploaded.Meta.Size,
+		Error:  "",
+		ItemID: utils.GenerateRequestID(),
+		Media:  media,
+	}
+}
+
+// UploadFileFull uploads a base64 document (pdf or text) and returns its
+// metadata. filename may be empty, one is generated from the mime type
+func (c *Client) UploadFileFull(dataURL, filename, chatID string, user *domain.User) (*domain.UploadedFile, error) {
+	mime := DataURLMIME(dataURL)
+	if mime == "" {
+		return nil, fmt.Errorf("%w: file_data must be a base64 data url", ErrUnsupportedFile)
+	}
+	if !SupportedFileType(mime) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFile, mime)
+	}
+
+	_, encoded, _ := strings.Cut(dataURL, ",")
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode base64: %w", err)
+	}
+
+	if filename == "" {
+		ext, ok := fileExts[mime]
+		if !ok {
+			ext = "txt"
+		}
+		filename = fmt.Sprintf("%s.%s", utils.GenerateID(), ext)
+	}
+
+	return c.uploadFile(data, filename, mime, chatID, user)
 }
 
 // UploadImageFull uploads image and returns full file metadata
-func UploadImageFull(dataURL, chatID string, cfg *config.Config) (*domain.UploadedFile, error) {
+func (c *Client) UploadImageFull(dataURL, chatID string, user *domain.User) (*domain.UploadedFile, error) {
 	if !strings.HasPrefix(dataURL, "data:") {
 		return nil, nil
 	}
@@ -203,51 +452,60 @@ func UploadImageFull(dataURL, chatID string, cfg *config.Config) (*domain.Upload
 		ext = "webp"
 	}
 
+	// reject before decoding, DecodedLen overcounts padding by at most 2
+	limit := c.cfg.Limits.MaxImageBytes
+	if limit > 0 && base64.StdEncoding.DecodedLen(len(parts[1])) > limit+2 {
+		return nil, ErrImageTooLarge
+	}
+
 	imgData, err := base64.StdEncoding.DecodeString(parts[1])
 	if err != nil {
 		return nil, fmt.Errorf("decode base64: %w", err)
 	}
+	if limit > 0 && len(imgData) > limit {
+		return nil, ErrImageTooLarge
+	}
 
 	filename := fmt.Sprintf("%s.%s", utils.GenerateID(), ext)
+	return c.uploadFile(imgData, filename, contentType, chatID, user)
+}
 
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// uploadFile posts one file to z.ai's file api
+func (c *Client) uploadFile(data []byte, filename, contentType, chatID string, user *domain.User) (*domain.UploadedFile, error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
 	// create form file with proper content type
 	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(filename)))
 	h.Set("Content-Type", contentType)
 
 	part, err := writer.CreatePart(h)
 	if err != nil {
 		return nil, fmt.Errorf("create form: %w", err)
 	}
-	if _, err := io.Copy(part, bytes.NewReader(imgData)); err != nil {
+	if _, err := io.Copy(part, bytes.NewReader(data)); err != nil {
 		return nil, fmt.Errorf("write file: %w", err)
 	}
 	writer.Close()
 
-	authSvc := auth.NewService()
-	user, err := authSvc.GetUser(cfg)
-	if err != nil {
-		return nil, fmt.Errorf("get user: %w", err)
-	}
-
-	uploadURL := fmt.Sprintf("%s//%s/api/v1/files/", cfg.Upstream.Protocol, cfg.Upstream.Host)
+	cfg := c.cfg
+	uploadURL := cfg.FilesURL()
 	req, err := http.NewRequest("POST", uploadURL, body)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
 
-	for k, v := range cfg.GetUpstreamHeaders() {
+	for k, v := range c.upstreamHeaders() {
 		req.Header.Set(k, v)
 	}
 	req.Header.Set("Authorization", "Bearer "+user.Token)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Referer", fmt.Sprintf("%s//%s/c/%s", cfg.Upstream.Protocol, cfg.Upstream.Host, chatID))
+	req.Header.Set("Referer", cfg.UpstreamURL("c", chatID))
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := c.send(req, c.files.Do)
 	if err != nil {
 		return nil, fmt.Errorf("upload: %w", err)
 	}
@@ -263,23 +521,12 @@ func UploadImageFull(dataURL, chatID string, cfg *config.Config) (*domain.Upload
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	logger.Debug().
+	log.Debug().
 		Str("id", result.ID).
 		Str("filename", result.Filename).
 		Str("cdn_url", result.Meta.CdnURL).
-		Msg("image uploaded")
+		Str("content_type", contentType).
+		Msg("file uploaded")
 
 	return &result, nil
 }
-
-// UploadImage legacy wrapper for backward compat
-func UploadImage(dataURL, chatID string, cfg *config.Config) (string, error) {
-	file, err := UploadImageFull(dataURL, chatID, cfg)
-	if err != nil {
-		return "", err
-	}
-	if file == nil {
-		return "", nil
-	}
-	return fmt.Sprintf("%s_%s", file.ID, file.Filename), nil
-}
@@ -0,0 +1,946 @@
+package zlm
+
+import (
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/crypto"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+	"github.com/zarazaex69/mo/internal/service/auth"
+)
+
+// newSigner signs with the built-in secret
+func newSigner(t *testing.T) *crypto.Signer {
+	t.Helper()
+	s, err := crypto.NewSignatureGenerator("", "")
+	require.NoError(t, err)
+	return s
+}
+
+// formatRequest runs FormatRequest as the user the chat is sent from
+func formatRequest(req *domain.ChatRequest, cfg *config.Config) (map[string]interface{}, error) {
+	c := NewClient(cfg, nil, nil, nil)
+	return c.FormatRequest(req, &domain.User{ID: "user-1", Token: cfg.Upstream.Token}, "chat-1")
+}
+
+func TestFormatRequestToolRoundTrip(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+
+	weather := domain.ToolCall{ID: "call_w1", Type: "function", Function: domain.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}}
+	clock := domain.ToolCall{ID: "call_c1", Type: "function", Function: domain.FunctionCall{Name: "get_time", Arguments: `{"tz":"CET"}`}}
+
+	req := &domain.ChatRequest{Messages: []domain.Message{
+		{Role: "system", Content: "be brief", Name: "ops"},
+		{Role: "user", Content: "weather and time in Paris?", Name: "alice"},
+		{Role: "assistant", Content: "", ToolCalls: []domain.ToolCall{weather, clock}},
+		{Role: "tool", ToolCallID: "call_w1", Content: "18C sunny"},
+		{Role: "tool", ToolCallID: "call_c1", Name: "get_time", Content: []interface{}{
+			map[string]interface{}{"type": "text", "text": "14:05"},
+		}},
+		{Role: "assistant", Content: "18C and 14:05."},
+		{Role: "user", Content: "and tomorrow?"},
+	}}
+
+	body, err := formatRequest(req, cfg)
+	require.NoError(t, err)
+
+	msgs := body["messages"].([]map[string]interface{})
+	require.Len(t, msgs, 6, "parallel results share one user turn")
+
+	assert.Equal(t, "ops", msgs[0]["name"])
+	assert.Equal(t, "alice", msgs[1]["name"])
+
+	// the assistant turn keeps its calls, ids included
+	assert.Equal(t, "assistant", msgs[2]["role"])
+	call := msgs[2]["content"].(string)
+	parsed := ParseToolCall(call)
+	require.NotNil(t, parsed)
+	assert.Equal(t, weather, *parsed)
+	assert.Contains(t, call, `tool_call_name="get_time"`)
+	assert.Contains(t, call, `"id": "call_c1"`)
+
+	// every result names the call it answers
+	assert.Equal(t, "user", msgs[3]["role"])
+	results := msgs[3]["content"].(string)
+	assert.Contains(t, results, "<tool_result tool_call_id=\"call_w1\" name=\"get_weather\">\n18C sunny\n</tool_result>")
+	assert.Contains(t, results, "<tool_result tool_call_id=\"call_c1\" name=\"get_time\">\n14:05\n</tool_result>")
+
+	assert.Equal(t, "assistant", msgs[4]["role"])
+	assert.Equal(t, "and tomorrow?", msgs[5]["content"])
+}
+
+//go:embed testdata/agent_turns.json
+var agentTurns []byte
+
+// an agent loop sends back every call it made with its result, the model
+// only knows what it already did from the replayed pairs
+func TestFormatRequestAgentHistory(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+
+	req := &domain.ChatRequest{}
+	require.NoError(t, json.Unmarshal(agentTurns, &req.Messages))
+
+	body, err := formatRequest(req, cfg)
+	require.NoError(t, err)
+	msgs := body["messages"].([]map[string]interface{})
+	require.Len(t, msgs, len(req.Messages))
+
+	calls := []struct{ id, name string }{{"call_read", "read_file"}, {"call_edit", "edit_file"}, {"call_test", "run"}}
+	for i, call := range calls {
+		turn, result := msgs[2+2*i], msgs[3+2*i]
+
+		assert.Equal(t, "assistant", turn["role"])
+		parsed := ParseToolCall(turn["content"].(string))
+		require.NotNil(t, parsed, "turn %d", i)
+		assert.Equal(t, req.Messages[2+2*i].ToolCalls[0], *parsed)
+
+		assert.Equal(t, "user", result["role"])
+		assert.Contains(t, result["content"], fmt.Sprintf("<tool_result tool_call_id=\"%s\" name=\"%s\">\n%s\n</tool_result>",
+			call.id, call.name, req.Messages[3+2*i].Content))
+	}
+	assert.True(t, strings.HasPrefix(msgs[4]["content"].(string), "The sign is wrong.\n\n<glm_block"), "text before the call stays")
+}
+
+func TestSignaturePrompt(t *testing.T) {
+	weather := domain.ToolCall{ID: "call_w1", Type: "function", Function: domain.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}}
+	image := map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "https://example.com/cat.png"}}
+	text := func(s string) map[string]interface{} { return map[string]interface{}{"type": "text", "text": s} }
+
+	tests := []struct {
+		name string
+		msgs []domain.Message
+		want string
+	}{
+		{"text", []domain.Message{{Role: "user", Content: "hello"}}, "hello"},
+		{"image only", []domain.Message{{Role: "user", Content: []interface{}{image}}}, "[image]"},
+		{"text and images in order", []domain.Message{{Role: "user", Content: []interface{}{text("compare"), image, text("with"), image}}},
+			"compare [image] with [image]"},
+		{"tool results", []domain.Message{
+			{Role: "user", Content: "weather?"},
+			{Role: "assistant", ToolCalls: []domain.ToolCall{weather}},
+			{Role: "tool", ToolCallID: "call_w1", Content: "18C"},
+			{Role: "tool", ToolCallID: "call_w2", Name: "get_time", Content: "14:05"},
+		}, "<tool_result tool_call_id=\"call_w1\" name=\"get_weather\">\n18C\n</tool_result>\n" +
+			"<tool_result tool_call_id=\"call_w2\" name=\"get_time\">\n14:05\n</tool_result>"},
+		{"assistant prefill after user", []domain.Message{
+			{Role: "user", Content: "write a haiku"},
+			{Role: "assistant", Content: "Autumn"},
+		}, "write a haiku"},
+		{"no user turn", []domain.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "assistant", Content: "hi there"},
+		}, "hi there"},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, signaturePrompt(tt.msgs))
+		})
+	}
+}
+
+func TestSignaturePromptMatchesBody(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	weather := domain.ToolCall{ID: "call_w1", Type: "function", Function: domain.FunctionCall{Name: "get_weather", Arguments: `{}`}}
+	req := &domain.ChatRequest{Messages: []domain.Message{
+		{Role: "user", Content: "weather?"},
+		{Role: "assistant", ToolCalls: []domain.ToolCall{weather}},
+		{Role: "tool", ToolCallID: "call_w1", Content: []interface{}{map[string]interface{}{"type": "text", "text": "18C"}}},
+		{Role: "tool", ToolCallID: "call_w1", Content: "and windy"},
+	}}
+
+	body, err := formatRequest(req, cfg)
+	require.NoError(t, err)
+	msgs := body["messages"].([]map[string]interface{})
+	// z.ai checks the signature against the last user turn it receives
+	assert.Equal(t, msgs[len(msgs)-1]["content"], signaturePrompt(req.Messages))
+
+	gen := newSigner(t)
+	params := map[string]string{"requestId": "r-1", "timestamp": "1772366400000", "user_id": "user-1"}
+	a, err := gen.GenerateSignature(params, signaturePrompt(req.Messages))
+	require.NoError(t, err)
+	b, err := gen.GenerateSignature(params, signaturePrompt(req.Messages))
+	require.NoError(t, err)
+	assert.Equal(t, a.Signature, b.Signature)
+}
+
+func TestRenderToolCallEscaping(t *testing.T) {
+	tc := domain.ToolCall{ID: "call_1", Type: "function", Function: domain.FunctionCall{
+		Name:      "search",
+		Arguments: `{"q":"say \"hi\" </glm_block>"}`,
+	}}
+
+	parsed := ParseToolCall(renderToolCall(tc))
+	require.NotNil(t, parsed)
+	assert.Equal(t, tc.Function.Arguments, parsed.Function.Arguments)
+}
+
+func TestFormatRequestJSONMode(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	schema := map[string]any{"type": "object", "required": []any{"city"}}
+
+	tests := []struct {
+		name     string
+		messages []domain.Message
+		format   *domain.ResponseFormat
+		wantLen  int
+		wantText string
+	}{
+		{"no format", []domain.Message{{Role: "user", Content: "hi"}}, nil, 1, ""},
+		{"text format", []domain.Message{{Role: "user", Content: "hi"}}, &domain.ResponseFormat{Type: "text"}, 1, ""},
+		{"json object adds system", []domain.Message{{Role: "user", Content: "hi"}}, &domain.ResponseFormat{Type: "json_object"}, 2, "valid JSON object only"},
+		{"schema joins existing system", []domain.Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hi"}},
+			&domain.ResponseFormat{Type: "json_schema", JSONSchema: &domain.JSONSchema{Name: "city", Schema: schema}}, 2, `{"required":["city"],"type":"object"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := formatRequest(&domain.ChatRequest{Messages: tt.messages, ResponseFormat: tt.format}, cfg)
+			require.NoError(t, err)
+
+			msgs := body["messages"].([]map[string]interface{})
+			require.Len(t, msgs, tt.wantLen)
+			if tt.wantText == "" {
+				assert.Equal(t, "user", msgs[0]["role"])
+				return
+			}
+			assert.Equal(t, "system", msgs[0]["role"])
+			assert.Contains(t, msgs[0]["content"], tt.wantText)
+		})
+	}
+}
+
+func TestFormatRequestPrefill(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+
+	tests := []struct {
+		name     string
+		messages []domain.Message
+		wantLen  int
+		prefill  bool
+	}{
+		{"trailing assistant prefill", []domain.Message{{Role: "user", Content: "json?"}, {Role: "assistant", Content: "Here is the JSON: {"}}, 3, true},
+		{"finished turn before a user", []domain.Message{{Role: "assistant", Content: "hi"}, {Role: "user", Content: "json?"}}, 2, false},
+		{"trailing tool call", []domain.Message{{Role: "user", Content: "weather?"}, {Role: "assistant", ToolCalls: []domain.ToolCall{{ID: "c1", Function: domain.FunctionCall{Name: "get_weather"}}}}}, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := formatRequest(&domain.ChatRequest{Messages: tt.messages}, cfg)
+			require.NoError(t, err)
+
+			msgs := body["messages"].([]map[string]interface{})
+			require.Len(t, msgs, tt.wantLen)
+			if !tt.prefill {
+				assert.NotEqual(t, "system", msgs[0]["role"])
+				return
+			}
+			assert.Equal(t, "system", msgs[0]["role"])
+			assert.Equal(t, continueInstruction, msgs[0]["content"])
+			assert.Equal(t, map[string]interface{}{"role": "assistant", "content": "Here is the JSON: {"}, msgs[2], "the prefix goes up as it came")
+		})
+	}
+}
+
+func TestFormatRequestSingleToolCall(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	tools := []domain.Tool{{Type: "function", Function: domain.ToolFunction{Name: "get_weather"}}}
+	off, on := false, true
+
+	tests := []struct {
+		name     string
+		tools    []domain.Tool
+		parallel *bool
+		want     bool
+	}{
+		{"parallel off", tools, &off, true},
+		{"parallel on", tools, &on, false},
+		{"unset", tools, nil, false},
+		{"no tools", nil, &off, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := formatRequest(&domain.ChatRequest{
+				Messages:          []domain.Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "weather?"}},
+				Tools:             tt.tools,
+				ParallelToolCalls: tt.parallel,
+			}, cfg)
+			require.NoError(t, err)
+
+			msgs := body["messages"].([]map[string]interface{})
+			require.Len(t, msgs, 2)
+			if tt.want {
+				assert.Equal(t, "be brief\n\n"+singleToolInstruction, msgs[0]["content"])
+			} else {
+				assert.Equal(t, "be brief", msgs[0]["content"])
+			}
+		})
+	}
+}
+
+func TestFormatRequestSeed(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	seed := 7
+
+	body, err := formatRequest(&domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}, Seed: &seed}, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"seed": 7}, body["params"])
+
+	body, err = formatRequest(&domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}}, cfg)
+	require.NoError(t, err)
+	assert.Empty(t, body["params"])
+}
+
+func TestFormatRequestPenalties(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	frequency, presence := 0.5, -1.0
+
+	body, err := formatRequest(&domain.ChatRequest{
+		Messages:         []domain.Message{{Role: "user", Content: "hi"}},
+		FrequencyPenalty: &frequency,
+		PresencePenalty:  &presence,
+	}, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"frequency_penalty": 0.5, "presence_penalty": -1.0}, body["params"])
+	assert.NotContains(t, body, "frequency_penalty", "only in params")
+
+	zero := 0.0
+	body, err = formatRequest(&domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}, PresencePenalty: &zero}, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"presence_penalty": 0.0}, body["params"], "an explicit zero is sent")
+}
+
+//go:embed testdata/hello.pdf
+var helloPDF []byte
+
+type capturedUpload struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// fakeFileAPI stands in for z.ai's file endpoint and records uploads
+func fakeFileAPI(t *testing.T) (*config.Config, *[]capturedUpload) {
+	t.Helper()
+
+	var uploads []capturedUpload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/":
+			file, header, err := r.FormFile("file")
+			require.NoError(t, err)
+			data, _ := io.ReadAll(file)
+
+			up := capturedUpload{filename: header.Filename, contentType: header.Header.Get("Content-Type"), data: data}
+			uploads = append(uploads, up)
+
+			json.NewEncoder(w).Encode(domain.UploadedFile{
+				ID:       fmt.Sprintf("file-%d", len(uploads)),
+				Filename: up.filename,
+				Meta:     domain.UploadedFileMeta{Name: up.filename, ContentType: up.contentType, Size: int64(len(data))},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	cfg := &config.Config{
+		Model:    config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(ts.URL, "http://"), Token: "test-token"},
+	}
+	return cfg, &uploads
+}
+
+func TestFormatRequestReasoningEffort(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	off, on := false, true
+
+	tests := []struct {
+		name     string
+		effort   string
+		thinking *bool
+		want     bool
+	}{
+		{"omitted does not think", "", nil, false},
+		{"bool only", "", &on, true},
+		{"bool off", "", &off, false},
+		{"none", "none", nil, false},
+		{"minimal", "minimal", nil, false},
+		{"low", "low", &on, false},
+		{"medium", "medium", nil, true},
+		{"high", "high", nil, true},
+		{"thinking false wins", "high", &off, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &domain.ChatRequest{
+				Messages:        []domain.Message{{Role: "user", Content: "hi"}},
+				ReasoningEffort: tt.effort,
+				Thinking:        tt.thinking,
+			}
+			body, err := formatRequest(req, cfg)
+			require.NoError(t, err)
+
+			want := map[string]interface{}{"image_generation": false, "web_search": false, "auto_web_search": false, "thinking": tt.want}
+			assert.Equal(t, want, body["features"])
+		})
+	}
+}
+
+func TestFormatRequestFiles(t *testing.T) {
+	cfg, uploads := fakeFileAPI(t)
+	pdfURL := "data:application/pdf;base64," + base64.StdEncoding.EncodeToString(helloPDF)
+	notes := "data:text/markdown;base64," + base64.StdEncoding.EncodeToString([]byte("# notes"))
+
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "summarize these"},
+		map[string]interface{}{"type": "file", "file": map[string]interface{}{"filename": "report.pdf", "file_data": pdfURL}},
+		map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": notes}},
+	}}}}
+
+	body, err := formatRequest(req, cfg)
+	require.NoError(t, err)
+
+	// the multipart body carries the document bytes with their own type
+	require.Len(t, *uploads, 2)
+	pdf := (*uploads)[0]
+	assert.Equal(t, "report.pdf", pdf.filename)
+	assert.Equal(t, "application/pdf", pdf.contentType)
+	assert.Equal(t, helloPDF, pdf.data)
+
+	md := (*uploads)[1]
+	assert.True(t, strings.HasSuffix(md.filename, ".md"), md.filename)
+	assert.Equal(t, "text/markdown", md.contentType)
+	assert.Equal(t, "# notes", string(md.data))
+
+	// both are attached as files, not images
+	raw, err := json.Marshal(body["files"])
+	require.NoError(t, err)
+	var files []map[string]any
+	require.NoError(t, json.Unmarshal(raw, &files))
+	require.Len(t, files, 2)
+
+	assert.Equal(t, "file", files[0]["type"])
+	assert.Equal(t, "file", files[0]["media"])
+	assert.Equal(t, "file-1", files[0]["id"])
+	assert.Equal(t, "report.pdf", files[0]["name"])
+	assert.Equal(t, "/api/v1/files/file-1/content", files[0]["url"])
+	assert.Equal(t, float64(len(helloPDF)), files[0]["size"])
+	assert.Equal(t, body["current_user_message_id"], files[0]["ref_user_msg_id"])
+	assert.Equal(t, "file", files[1]["media"])
+
+	msgs := body["messages"].([]map[string]interface{})
+	assert.Equal(t, "summarize these", msgs[0]["content"])
+}
+
+func TestFormatRequestUnsupportedFile(t *testing.T) {
+	cfg, uploads := fakeFileAPI(t)
+
+	tests := []struct {
+		name string
+		part map[string]interface{}
+	}{
+		{"binary mime", map[string]interface{}{"type": "file", "file": map[string]interface{}{
+			"file_data": "data:application/zip;base64,UEsDBA==",
+		}}},
+		{"file id only", map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_id": "file-abc"}}},
+		{"binary as image_url", map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{
+			"url": "data:application/octet-stream;base64,AAAA",
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []interface{}{tt.part}}}}
+			_, err := formatRequest(req, cfg)
+			assert.ErrorIs(t, err, ErrUnsupportedFile)
+		})
+	}
+	assert.Empty(t, *uploads)
+}
+
+func TestFormatRequestContentParts(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "answer the voice note"},
+		map[string]interface{}{"type": "text", "text": "[audio transcription] what time is it"},
+	}}}}
+	body, err := formatRequest(req, cfg)
+	require.NoError(t, err)
+	msgs := body["messages"].([]map[string]interface{})
+	assert.Equal(t, "answer the voice note\n[audio transcription] what time is it", msgs[0]["content"], "every text part is kept")
+
+	req.Messages[0].Content = []interface{}{
+		map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"data": "UklGRg==", "format": "wav"}},
+	}
+	_, err = formatRequest(req, cfg)
+	var apiErr *domain.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, "unsupported_content_part", *apiErr.Code)
+}
+
+func TestFormatRequestRemoteImages(t *testing.T) {
+	cfg, uploads := fakeFileAPI(t)
+	cfg.Limits.MaxImageBytes = 64
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 24)...)
+	hits := map[string]int{}
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/cat.png":
+			// a wrong header does not matter, the bytes are sniffed
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(png)
+		case "/page.html":
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		case "/huge.png":
+			w.Write(append(png, make([]byte, 64)...))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer images.Close()
+
+	imagePart := func(u string) map[string]interface{} {
+		return map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": u}}
+	}
+	cat := images.URL + "/cat.png"
+
+	// the image server is on loopback, which the client refuses
+	c := NewClient(cfg, nil, nil, nil)
+	c.fetch = httpclient.New(15 * time.Second)
+	local := func(req *domain.ChatRequest) (map[string]interface{}, error) {
+		return c.FormatRequest(req, &domain.User{ID: "user-1", Token: cfg.Upstream.Token}, "chat-1")
+	}
+
+	req := &domain.ChatRequest{Messages: []domain.Message{
+		{Role: "user", Content: []interface{}{map[string]interface{}{"type": "text", "text": "what is this"}, imagePart(cat)}},
+		{Role: "assistant", Content: "a cat"},
+		{Role: "user", Content: []interface{}{map[string]interface{}{"type": "text", "text": "and again?"}, imagePart(cat)}},
+	}}
+
+	body, err := local(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, hits["/cat.png"], "the same url is downloaded once")
+	require.Len(t, *uploads, 1)
+	assert.Equal(t, "image/png", (*uploads)[0].contentType)
+	assert.True(t, strings.HasSuffix((*uploads)[0].filename, ".png"))
+	assert.Equal(t, png, (*uploads)[0].data)
+
+	files := body["files"].([]map[string]interface{})
+	require.Len(t, files, 1)
+	assert.Equal(t, "image", files[0]["media"])
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantCode   string
+	}{
+		{"missing", images.URL + "/gone.png", http.StatusBadRequest, "invalid_image_url"},
+		{"not an image", images.URL + "/page.html", http.StatusBadRequest, "invalid_image_url"},
+		{"too large", images.URL + "/huge.png", http.StatusRequestEntityTooLarge, "image_too_large"},
+		{"unreachable", "http://127.0.0.1:1/x.png", http.StatusBadRequest, "invalid_image_url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &domain.ChatRequest{Messages: []domain.Message{
+				{Role: "user", Content: "hi"},
+				{Role: "user", Content: []interface{}{imagePart(tt.url)}},
+			}}
+
+			_, err := local(req)
+			var apiErr *domain.APIError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, tt.wantStatus, apiErr.Status)
+			assert.Equal(t, tt.wantCode, *apiErr.Code)
+			assert.Equal(t, "messages[1].content", *apiErr.Param)
+			assert.Contains(t, apiErr.Message, tt.url)
+		})
+	}
+	assert.Len(t, *uploads, 1)
+}
+
+func TestFormatRequestRefusesLocalImages(t *testing.T) {
+	cfg, uploads := fakeFileAPI(t)
+
+	var hits int
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write(append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 24)...))
+	}))
+	defer images.Close()
+
+	for _, u := range []string{images.URL + "/cat.png", "http://169.254.169.254/latest/meta-data/"} {
+		req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []interface{}{
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": u}},
+		}}}}
+		_, err := formatRequest(req, cfg)
+		var apiErr *domain.APIError
+		require.ErrorAs(t, err, &apiErr, u)
+		assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+		assert.Equal(t, "invalid_image_url", *apiErr.Code)
+	}
+	assert.Zero(t, hits)
+	assert.Empty(t, *uploads)
+}
+
+type countingAuth struct {
+	calls       int
+	invalidated []string
+}
+
+func (a *countingAuth) Invalidate(token string) { a.invalidated = append(a.invalidated, token) }
+
+func (a *countingAuth) GetUser(cfg *config.Config) (*domain.User, error) {
+	a.calls++
+	return &domain.User{ID: "user-1", Token: cfg.Upstream.Token}, nil
+}
+
+func TestSendChatRequestSharesAuthAndConnections(t *testing.T) {
+	var uploads, conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test-token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v1/files/":
+			n := uploads.Add(1)
+			json.NewEncoder(w).Encode(domain.UploadedFile{ID: fmt.Sprintf("file-%d", n), Filename: "img.png"})
+		case "/api/v2/chat/completions":
+			w.Write([]byte("data: {}\n\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Model:    config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(ts.URL, "http://"), Token: "test-token"},
+	}
+	authSvc := &countingAuth{}
+	c := NewClient(cfg, authSvc, newSigner(t), nil)
+
+	parts := []interface{}{map[string]interface{}{"type": "text", "text": "compare these"}}
+	for i := 0; i < 5; i++ {
+		img := append([]byte("\x89PNG\r\n\x1a\n"), byte(i))
+		parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{
+			"url": "data:image/png;base64," + base64.StdEncoding.EncodeToString(img),
+		}})
+	}
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: parts}}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.SendChatRequest(context.Background(), req, "chat-1")
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// one lookup per chat request, not one per image
+	assert.Equal(t, 2, authSvc.calls)
+	assert.EqualValues(t, 10, uploads.Load())
+	// uploads and chat share the pool, one kept-alive connection serves all
+	assert.EqualValues(t, 1, conns.Load())
+}
+
+func TestUpstreamGatewayPrefix(t *testing.T) {
+	var hits sync.Map
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /gateway/api/v1/auths/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"id": "user-gw", "name": "gw"})
+	})
+	mux.HandleFunc("POST /gateway/api/v1/files/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(domain.UploadedFile{ID: "file-1", Filename: "img.png"})
+	})
+	mux.HandleFunc("POST /gateway/api/v2/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEmpty(t, r.URL.Query().Get("signature_timestamp"))
+		assert.Equal(t, "user-gw", r.URL.Query().Get("user_id"))
+		w.Write([]byte(`data: {"data": {"phase": "answer", "delta_content": "hi", "done": true}}` + "\n\n"))
+	})
+	mux.HandleFunc("GET /gateway/api/models", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": [{"id": "glm"}]}`))
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Store(r.Method+" "+r.URL.Path, true)
+		assert.Equal(t, "Bearer gateway-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "prod-fe-1.0.999", r.Header.Get("X-FE-Version"), r.URL.Path)
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{
+			Protocol: "http:",
+			Host:     strings.TrimPrefix(ts.URL, "http://"),
+			Token:    "gateway-token",
+			Paths:    config.UpstreamPaths{Base: "/gateway"},
+		},
+	}
+	// the user lookup has to reach the gateway, not a user cached by an earlier run
+	authSvc := auth.GetService()
+	authSvc.ClearCache()
+	t.Cleanup(authSvc.ClearCache)
+	c := NewClient(cfg, authSvc, newSigner(t), nil)
+	// every request carries the version found at run time, none is configured
+	c.SetFEVersion(func() string { return "prod-fe-1.0.999" })
+
+	img := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n"))
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "what is this"},
+		map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png;base64," + img}},
+	}}}}
+
+	resp, err := c.SendChatRequest(context.Background(), req, "chat-gw")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var got []string
+	for ev := range ParseSSEStream(context.Background(), resp, 0) {
+		require.NoError(t, ev.Err)
+		got = append(got, ev.Data.DeltaContent)
+	}
+	assert.Equal(t, []string{"hi"}, got)
+
+	models, err := c.ListModels()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"glm"}, models)
+
+	for _, want := range []string{
+		"GET /gateway/api/v1/auths/",
+		"POST /gateway/api/v1/files/",
+		"POST /gateway/api/v2/chat/completions",
+		"GET /gateway/api/models",
+	} {
+		_, ok := hits.Load(want)
+		assert.True(t, ok, want)
+	}
+	hits.Range(func(k, _ any) bool {
+		assert.True(t, strings.HasPrefix(k.(string), "GET /gateway/") || strings.HasPrefix(k.(string), "POST /gateway/"), k)
+		return true
+	})
+}
+
+func TestHostFailover(t *testing.T) {
+	var primaryDown atomic.Bool
+	var primaryHits, backupHits atomic.Int32
+	serve := func(hits *atomic.Int32, down *atomic.Bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			if down != nil && down.Load() {
+				http.Error(w, "bad gateway", http.StatusBadGateway)
+				return
+			}
+			switch r.URL.Path {
+			case "/api/models":
+				w.Write([]byte(`{"data": []}`))
+			case "/api/v2/chat/completions":
+				w.Write([]byte(`data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}` + "\n\n"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	}
+	primary := serve(&primaryHits, &primaryDown)
+	defer primary.Close()
+	backup := serve(&backupHits, nil)
+	defer backup.Close()
+
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{
+			Protocol: "http:",
+			Hosts:    []string{strings.TrimPrefix(primary.URL, "http://"), strings.TrimPrefix(backup.URL, "http://")},
+			Token:    "test-token",
+			Failover: config.FailoverConfig{MaxFailures: 2},
+		},
+	}
+	c := NewClient(cfg, &countingAuth{}, newSigner(t), nil)
+	chat := func() {
+		t.Helper()
+		resp, err := c.SendChatRequest(context.Background(), &domain.ChatRequest{
+			Messages: []domain.Message{{Role: "user", Content: "hi"}},
+		}, "chat-1")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Contains(t, string(body), `"ok"`)
+	}
+
+	chat()
+	assert.EqualValues(t, 1, primaryHits.Load())
+	assert.Zero(t, backupHits.Load())
+
+	// the primary breaks, requests move on without the caller noticing
+	primaryDown.Store(true)
+	chat()
+	chat()
+	assert.EqualValues(t, 3, primaryHits.Load())
+	assert.EqualValues(t, 2, backupHits.Load())
+
+	hosts := c.Hosts()
+	assert.False(t, hosts[0].Healthy, "two failures take the primary out")
+	assert.Equal(t, "upstream returned 502", hosts[0].LastError)
+	assert.True(t, hosts[1].Healthy)
+
+	// skipped now, not even tried
+	chat()
+	assert.EqualValues(t, 3, primaryHits.Load())
+	assert.EqualValues(t, 3, backupHits.Load())
+
+	// still down on the probe, then back
+	c.HostPool().Probe()
+	assert.False(t, c.Hosts()[0].Healthy)
+	primaryDown.Store(false)
+	c.HostPool().Probe()
+	assert.True(t, c.Hosts()[0].Healthy)
+
+	chat()
+	assert.EqualValues(t, 6, primaryHits.Load())
+	assert.EqualValues(t, 3, backupHits.Load())
+}
+
+func TestHostFailoverClientErrors(t *testing.T) {
+	var backupHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupHits.Add(1)
+	}))
+	defer backup.Close()
+
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{
+			Protocol: "http:",
+			Hosts:    []string{strings.TrimPrefix(primary.URL, "http://"), strings.TrimPrefix(backup.URL, "http://")},
+			Token:    "test-token",
+		},
+	}
+	c := NewClient(cfg, &countingAuth{}, newSigner(t), nil)
+
+	_, err := c.SendChatRequest(context.Background(), &domain.ChatRequest{
+		Messages: []domain.Message{{Role: "user", Content: "hi"}},
+	}, "chat-1")
+	var upstream *domain.UpstreamError
+	require.ErrorAs(t, err, &upstream)
+	assert.Equal(t, http.StatusUnauthorized, upstream.StatusCode)
+	assert.Zero(t, backupHits.Load(), "a rejected request is not the host's fault")
+	assert.True(t, c.Hosts()[0].Healthy)
+}
+
+func TestSendChatRequestHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{
+			Protocol:      "http:",
+			Host:          strings.TrimPrefix(ts.URL, "http://"),
+			Token:         "test-token",
+			HeaderTimeout: 50 * time.Millisecond,
+		},
+	}
+	c := NewClient(cfg, &countingAuth{}, newSigner(t), nil)
+
+	start := time.Now()
+	_, err := c.SendChatRequest(context.Background(), &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}}, "chat-1")
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	var apiErr *domain.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusGatewayTimeout, apiErr.Status)
+	assert.Equal(t, "upstream_timeout", *apiErr.Code)
+}
+
+func TestSendChatRequestRetriesBeforeStreaming(t *testing.T) {
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("data: {}\n\n"))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Model:    config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(ts.URL, "http://"), Token: "test-token"},
+		HTTP:     config.HTTPConfig{Retry: config.RetryConfig{MaxAttempts: 3, Budget: 10 * time.Second}},
+	}
+	c := NewClient(cfg, &countingAuth{}, newSigner(t), nil)
+
+	resp, err := c.SendChatRequest(context.Background(), &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}}, "chat-1")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Len(t, bodies, 2)
+	assert.Equal(t, bodies[0], bodies[1], "the retry sends the same body")
+	assert.Contains(t, bodies[1], `"chat_id":"chat-1"`)
+}
+
+func TestSendChatRequestInvalidatesRefusedToken(t *testing.T) {
+	status := http.StatusUnauthorized
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"detail":"token revoked"}`, status)
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Model:    config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(ts.URL, "http://"), Token: "test-token"},
+	}
+	authSvc := &countingAuth{}
+	c := NewClient(cfg, authSvc, newSigner(t), nil)
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}}
+
+	_, err := c.SendChatRequest(context.Background(), req, "chat-1")
+	require.Error(t, err)
+	assert.Equal(t, []string{"test-token"}, authSvc.invalidated)
+
+	status = http.StatusBadRequest
+	_, err = c.SendChatRequest(context.Background(), req, "chat-1")
+	require.Error(t, err)
+	assert.Len(t, authSvc.invalidated, 1, "only a 401 says the token is bad")
+}
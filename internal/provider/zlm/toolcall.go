@@ -0,0 +1,155 @@
+package zlm
+
+import (
+	"encoding/json"
+	"html"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/service/drift"
+)
+
+const (
+	blockOpen  = "<glm_block"
+	blockClose = "</glm_block>"
+)
+
+// blockParser follows <glm_block> markup across deltas. upstream opens a
+// block in the tool_call phase and closes it in whatever phase comes next,
+// a tag may be cut anywhere, so nothing is decided until it is complete
+type blockParser struct {
+	// unresolved tail: a block being received or a tag cut in half
+	pending string
+	inside  bool
+}
+
+// feed returns the text outside blocks and the blocks completed by s, raw
+func (p *blockParser) feed(s string) (string, []string) {
+	s = p.pending + s
+	p.pending = ""
+
+	var text strings.Builder
+	var blocks []string
+	for s != "" {
+		if p.inside {
+			end := strings.Index(s, blockClose)
+			if end < 0 {
+				p.pending = s
+				return text.String(), blocks
+			}
+			end += len(blockClose)
+			blocks = append(blocks, s[:end])
+			s = s[end:]
+			p.inside = false
+			continue
+		}
+
+		start := strings.Index(s, blockOpen)
+		if start < 0 {
+			n := partialPrefix(s, blockOpen)
+			text.WriteString(s[:len(s)-n])
+			p.pending = s[len(s)-n:]
+			break
+		}
+		text.WriteString(s[:start])
+		s = s[start:]
+		p.inside = true
+	}
+	return text.String(), blocks
+}
+
+// open reports a block that was started and never closed
+func (p *blockParser) open() bool {
+	return p.inside
+}
+
+// partialPrefix is the length of the longest suffix of s that starts tag
+func partialPrefix(s, tag string) int {
+	for n := min(len(tag)-1, len(s)); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// ParseToolCall reads the first complete glm_block in content
+func ParseToolCall(content string) *domain.ToolCall {
+	var p blockParser
+	_, blocks := p.feed(content)
+	if len(blocks) == 0 {
+		return nil
+	}
+	return parseBlock(blocks[0])
+}
+
+// parseBlock decodes a raw block. only the metadata object is read, what
+// upstream appends after it (result, display_result, status) varies
+func parseBlock(block string) *domain.ToolCall {
+	tagEnd := strings.IndexByte(block, '>')
+	if tagEnd < 0 {
+		return nil
+	}
+	name := attr(block[:tagEnd], "tool_call_name")
+	body := strings.TrimSuffix(block[tagEnd+1:], blockClose)
+
+	var meta struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	}
+	key := strings.Index(body, `"metadata"`)
+	if key < 0 {
+		drift.Record(drift.ParseFailure, "glm_block", body)
+		return nil
+	}
+	rest := strings.TrimLeft(body[key+len(`"metadata"`):], " \t\r\n")
+	rest = strings.TrimPrefix(rest, ":")
+	if err := json.NewDecoder(strings.NewReader(rest)).Decode(&meta); err != nil {
+		log.Debug().Err(err).Msg("failed to parse tool call json")
+		drift.Record(drift.ParseFailure, "glm_block", body)
+		return nil
+	}
+
+	if name == "" {
+		name = meta.Name
+	}
+	if name == "" {
+		drift.Record(drift.ParseFailure, "glm_block", body)
+		return nil
+	}
+
+	callID := meta.ID
+	if callID == "" {
+		callID = "call_" + utils.GenerateID()[:10]
+	}
+
+	args := meta.Arguments
+	if args == "" {
+		args = "{}"
+	}
+
+	return &domain.ToolCall{
+		ID:   callID,
+		Type: "function",
+		Function: domain.FunctionCall{
+			Name:      name,
+			Arguments: args,
+		},
+	}
+}
+
+// attr reads a double quoted attribute of an opening tag
+func attr(tag, name string) string {
+	i := strings.Index(tag, " "+name+`="`)
+	if i < 0 {
+		return ""
+	}
+	v := tag[i+len(name)+3:]
+	end := strings.IndexByte(v, '"')
+	if end < 0 {
+		return ""
+	}
+	return html.UnescapeString(v[:end])
+}
@@ -0,0 +1,122 @@
+package zlm
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// splitAt cuts the event holding byte k of the whole stream in two, same phase
+func splitAt(evs []*domain.ZaiResponse, k int) []*domain.ZaiResponse {
+	var out []*domain.ZaiResponse
+	for _, ev := range evs {
+		c := ev.Data.DeltaContent
+		if k > 0 && k < len(c) {
+			head, tail := *ev.Data, *ev.Data
+			head.DeltaContent, head.Done = c[:k], false
+			tail.DeltaContent = c[k:]
+			out = append(out, &domain.ZaiResponse{Data: &head}, &domain.ZaiResponse{Data: &tail})
+		} else {
+			out = append(out, ev)
+		}
+		k -= len(c)
+	}
+	return out
+}
+
+// bytewise sends every byte as its own event
+func bytewise(evs []*domain.ZaiResponse) []*domain.ZaiResponse {
+	var out []*domain.ZaiResponse
+	for _, ev := range evs {
+		for i := range len(ev.Data.DeltaContent) {
+			d := *ev.Data
+			d.DeltaContent = ev.Data.DeltaContent[i : i+1]
+			out = append(out, &domain.ZaiResponse{Data: &d})
+		}
+	}
+	return out
+}
+
+type formatted struct {
+	content string
+	calls   []domain.ToolCall
+	partial bool
+}
+
+func run(evs []*domain.ZaiResponse) formatted {
+	fmtr := NewFormatter(&config.Config{Model: config.ModelConfig{ThinkMode: "reasoning"}})
+	var out formatted
+	var content strings.Builder
+	for _, d := range format(fmtr, evs) {
+		if c, ok := d["content"].(string); ok {
+			content.WriteString(c)
+		}
+		if calls, ok := d["tool_calls"].([]domain.ToolCall); ok {
+			out.calls = append(out.calls, calls...)
+		}
+	}
+	out.content = content.String()
+	out.partial = fmtr.PartialToolCall()
+	return out
+}
+
+func TestToolCallStream(t *testing.T) {
+	evs := events(t, "tool_call.sse")
+
+	want := run(evs)
+	assert.Equal(t, "Checking the weather in Paris.\n\n\n", want.content)
+	assert.False(t, want.partial)
+	require.Len(t, want.calls, 2)
+	assert.Equal(t, domain.ToolCall{ID: "call_w1", Type: "function", Function: domain.FunctionCall{
+		Name: "get_weather", Arguments: `{"city":"Paris"}`,
+	}}, want.calls[0])
+	assert.Equal(t, "get_time", want.calls[1].Function.Name)
+	assert.Equal(t, "{}", want.calls[1].Function.Arguments)
+
+	total := 0
+	for _, ev := range evs {
+		total += len(ev.Data.DeltaContent)
+	}
+	for k := 1; k < total; k++ {
+		if !assert.Equal(t, want, run(splitAt(evs, k)), "split at byte "+strconv.Itoa(k)) {
+			return
+		}
+	}
+	assert.Equal(t, want, run(bytewise(evs)), "one byte per event")
+}
+
+func TestToolCallCutOff(t *testing.T) {
+	evs := events(t, "tool_call.sse")[:3]
+
+	got := run(evs)
+	assert.Equal(t, "Checking the weather in Paris.\n\n", got.content, "the open block never leaks")
+	assert.Empty(t, got.calls)
+	assert.True(t, got.partial)
+}
+
+func TestToolCallUnreadable(t *testing.T) {
+	got := run([]*domain.ZaiResponse{{Data: &domain.ZaiResponseData{
+		Phase:        "tool_call",
+		DeltaContent: `<glm_block view="" tool_call_name="x">not json</glm_block>done`,
+	}}})
+	assert.Equal(t, "done", got.content)
+	assert.Empty(t, got.calls)
+	assert.True(t, got.partial)
+}
+
+func TestBlockParserText(t *testing.T) {
+	var p blockParser
+	text, blocks := p.feed("a <b>c</b> <glm")
+	assert.Equal(t, "a <b>c</b> ", text)
+	assert.Empty(t, blocks)
+
+	text, blocks = p.feed("ossary")
+	assert.Equal(t, "<glmossary", text, "a tag that is not a block is let through")
+	assert.Empty(t, blocks)
+	assert.False(t, p.open())
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/admission"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+)
+
+type slotKey struct{}
+
+// admit holds a chat request until the gate has a slot for it and sheds it
+// with 503 when the queue is full or the wait runs out. nil admits everything
+func admit(gate *admission.Gate) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if gate == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			release, err := gate.Acquire(r.Context())
+			if err != nil {
+				// the client gave up while queued, nobody is left to answer
+				if !errors.Is(err, admission.ErrQueueFull) && !errors.Is(err, admission.ErrQueueTimeout) {
+					return
+				}
+				shed(w, r, gate, err)
+				return
+			}
+			defer release()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), slotKey{}, release)))
+		})
+	}
+}
+
+// releaseSlot gives the request's slot back early. a stream holds it only
+// until upstream answers, a long generation must not starve admission
+func releaseSlot(ctx context.Context) {
+	if release, ok := ctx.Value(slotKey{}).(func()); ok {
+		release()
+	}
+}
+
+func shed(w http.ResponseWriter, r *http.Request, gate *admission.Gate, err error) {
+	reason := "queue_full"
+	if errors.Is(err, admission.ErrQueueTimeout) {
+		reason = "queue_timeout"
+	}
+	metrics.Inc("shed_requests", reason)
+
+	depth := gate.Queued()
+	// a second per round of slots the backlog fills
+	secs := 1 + depth/gate.Limit()
+	logger.FromContext(r.Context()).Warn().Str("reason", reason).Int("queued", depth).Msg("request shed")
+
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.Header().Set("X-Mo-Queue-Depth", strconv.Itoa(depth))
+	writeAPIErr(w, domain.NewAPIError(http.StatusServiceUnavailable,
+		fmt.Sprintf("server is at capacity with %d requests queued, try again in %ds", depth, secs)).
+		WithCode("server_overloaded"))
+}
+
+// gateMetrics reports the gate on /metrics
+func gateMetrics(gate *admission.Gate) {
+	metrics.Gauge("in_flight_requests", func() int64 { return int64(gate.InFlight()) })
+	metrics.Gauge("queued_requests", func() int64 { return int64(gate.Queued()) })
+	metrics.Gauge("max_in_flight_requests", func() int64 { return int64(gate.Limit()) })
+}
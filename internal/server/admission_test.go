@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/admission"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+const admissionSSE = `data: {"data": {"phase": "answer", "delta_content": "done", "done": true}}` + "\n\n"
+
+// slowProvider holds every request until the test lets it through
+type slowProvider struct {
+	bodyProvider
+	sent    chan struct{}
+	proceed chan struct{}
+}
+
+func (p *slowProvider) SendChatRequest(ctx context.Context, req *domain.ChatRequest, id string) (*http.Response, error) {
+	p.sent <- struct{}{}
+	<-p.proceed
+	return p.bodyProvider.SendChatRequest(ctx, req, id)
+}
+
+func newAdmittedChat(gate *admission.Gate, body func() io.ReadCloser) (http.Handler, *slowProvider) {
+	p := &slowProvider{bodyProvider: bodyProvider{body}, sent: make(chan struct{}, 8), proceed: make(chan struct{}, 8)}
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	chat := ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)
+	return admit(gate)(chat), p
+}
+
+func admitChat(h http.Handler, stream bool) *httptest.ResponseRecorder {
+	body := `{"model":"m","stream":false,"messages":[{"role":"user","content":"hi"}]}`
+	if stream {
+		body = strings.Replace(body, `"stream":false`, `"stream":true`, 1)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	return w
+}
+
+func TestAdmissionSheds(t *testing.T) {
+	gate := admission.New(1, 1, 5*time.Second)
+	h, p := newAdmittedChat(gate, func() io.ReadCloser { return io.NopCloser(strings.NewReader(admissionSSE)) })
+
+	// the first holds the only slot, the second waits in the queue
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = admitChat(h, false).Code
+		}()
+		if i == 0 {
+			<-p.sent
+		}
+	}
+	require.Eventually(t, func() bool { return gate.Queued() == 1 }, time.Second, time.Millisecond)
+
+	w := admitChat(h, false)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "1", w.Header().Get("X-Mo-Queue-Depth"))
+	assert.Contains(t, w.Body.String(), `"code":"server_overloaded"`)
+	assert.Contains(t, w.Body.String(), "1 requests queued")
+
+	metricsOut := httptest.NewRecorder()
+	gateMetrics(gate)
+	Metrics()(metricsOut, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, metricsOut.Body.String(), "mo_in_flight_requests 1\n")
+	assert.Contains(t, metricsOut.Body.String(), "mo_queued_requests 1\n")
+	assert.Contains(t, metricsOut.Body.String(), `mo_shed_requests{label="queue_full"}`)
+
+	// both queued requests get through once upstream answers
+	p.proceed <- struct{}{}
+	<-p.sent
+	p.proceed <- struct{}{}
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+	assert.Equal(t, 0, gate.InFlight())
+
+	p.proceed <- struct{}{}
+	assert.Equal(t, http.StatusOK, admitChat(h, false).Code, "admission recovers once the load is gone")
+}
+
+func TestAdmissionTimeout(t *testing.T) {
+	gate := admission.New(1, 1, 20*time.Millisecond)
+	h, p := newAdmittedChat(gate, func() io.ReadCloser { return io.NopCloser(strings.NewReader(admissionSSE)) })
+
+	done := make(chan int)
+	go func() { done <- admitChat(h, false).Code }()
+	<-p.sent
+
+	w := admitChat(h, false)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "no slot freed up while queued")
+
+	p.proceed <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestAdmissionStreamReleasesEarly(t *testing.T) {
+	gate := admission.New(1, 0, time.Second)
+	pr, pw := io.Pipe()
+	bodies := make(chan io.ReadCloser, 2)
+	bodies <- pr
+	bodies <- io.NopCloser(strings.NewReader(admissionSSE))
+	h, p := newAdmittedChat(gate, func() io.ReadCloser { return <-bodies })
+
+	// the stream keeps generating after upstream answered
+	streamed := make(chan *httptest.ResponseRecorder)
+	go func() { streamed <- admitChat(h, true) }()
+	<-p.sent
+	p.proceed <- struct{}{}
+	require.Eventually(t, func() bool { return gate.InFlight() == 0 }, time.Second, time.Millisecond)
+
+	p.proceed <- struct{}{}
+	assert.Equal(t, http.StatusOK, admitChat(h, false).Code, "a running stream does not hold its slot")
+
+	io.WriteString(pw, admissionSSE)
+	pw.Close()
+	w := <-streamed
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "done")
+}
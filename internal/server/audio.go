@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/service/transcribe"
+)
+
+// marks text that was heard rather than typed
+const transcriptionMarker = "[audio transcription] "
+
+// transcribeAudio turns the input_audio parts of req into text parts for a
+// provider that cannot hear them. without audio.transcription_url they are
+// refused, dropping them would leave the model answering half a prompt
+func transcribeAudio(ctx context.Context, req *domain.ChatRequest, p provider.Provider, cfg config.AudioConfig) *domain.APIError {
+	if provider.AcceptsAudio(p, req.Model) {
+		return nil
+	}
+	for i, msg := range req.Messages {
+		parts, ok := msg.Content.([]interface{})
+		if !ok {
+			continue
+		}
+		param := fmt.Sprintf("messages[%d].content", i)
+
+		for j, item := range parts {
+			m, ok := item.(map[string]interface{})
+			if !ok || m["type"] != "input_audio" {
+				continue
+			}
+			if cfg.TranscriptionURL == "" {
+				return domain.NewAPIError(http.StatusBadRequest,
+					fmt.Sprintf("model %s does not accept audio and no audio.transcription_url is configured", req.Model)).
+					WithParam(param).WithCode("unsupported_content_part")
+			}
+
+			audio, _ := m["input_audio"].(map[string]interface{})
+			data, _ := audio["data"].(string)
+			format, _ := audio["format"].(string)
+			raw, err := base64.StdEncoding.DecodeString(data)
+			if err != nil || len(raw) == 0 || format == "" {
+				return domain.NewAPIError(http.StatusBadRequest, "input_audio needs base64 data and a format").
+					WithParam(param).WithCode("invalid_audio")
+			}
+			if cfg.MaxBytes > 0 && len(raw) > cfg.MaxBytes {
+				return domain.NewAPIError(http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("audio exceeds %d bytes", cfg.MaxBytes)).
+					WithParam(param).WithCode("audio_too_large")
+			}
+
+			text, err := transcribe.Transcribe(ctx, cfg, raw, format)
+			if err != nil {
+				logger.FromContext(ctx).Warn().Err(err).Msg("audio transcription failed")
+				return domain.NewAPIError(http.StatusBadGateway, "audio transcription failed").
+					WithParam(param).WithCode("transcription_failed")
+			}
+			logger.FromContext(ctx).Debug().Int("bytes", len(raw)).Int("chars", len(text)).Msg("audio transcribed")
+			parts[j] = map[string]interface{}{"type": "text", "text": transcriptionMarker + text}
+		}
+	}
+	return nil
+}
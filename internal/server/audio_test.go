@@ -0,0 +1,80 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+func TestChatInputAudio(t *testing.T) {
+	transcriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		if data, _ := io.ReadAll(f); string(data) == "silence" {
+			http.Error(w, "no speech", http.StatusUnprocessableEntity)
+			return
+		}
+		w.Write([]byte(`{"text":"what is the weather"}`))
+	}))
+	defer transcriber.Close()
+
+	audioReq := func(data string) string {
+		return `{"messages":[{"role":"user","content":[
+			{"type":"text","text":"reply to this"},
+			{"type":"input_audio","input_audio":{"data":"` + data + `","format":"wav"}}
+		]}]}`
+	}
+	sse := `data: {"data": {"phase": "answer", "delta_content": "Sunny", "done": true}}` + "\n\n"
+
+	tests := []struct {
+		name       string
+		url        string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantText   string
+	}{
+		{name: "refused without a transcriber", body: audioReq("c3BlZWNo"), wantStatus: http.StatusBadRequest, wantCode: "unsupported_content_part"},
+		{name: "transcribed", url: transcriber.URL, body: audioReq("c3BlZWNo"), wantStatus: http.StatusOK, wantText: "[audio transcription] what is the weather"},
+		{name: "not base64", url: transcriber.URL, body: audioReq("%%%"), wantStatus: http.StatusBadRequest, wantCode: "invalid_audio"},
+		{name: "transcriber fails", url: transcriber.URL, body: audioReq("c2lsZW5jZQ=="), wantStatus: http.StatusBadGateway, wantCode: "transcription_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent *domain.ChatRequest
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				sent = args.Get(0).(*domain.ChatRequest)
+			}).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}, nil).Maybe()
+
+			cfg := &config.Config{
+				Model: config.ModelConfig{Default: "glm"},
+				Audio: config.AudioConfig{TranscriptionURL: tt.url, Model: "whisper-1"},
+			}
+			h := ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body)))
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+
+			if tt.wantCode != "" {
+				e := decodeAPIError(t, w)
+				require.NotNil(t, e.Code)
+				assert.Equal(t, tt.wantCode, *e.Code)
+				assert.Nil(t, sent, "nothing goes upstream")
+				return
+			}
+			require.NotNil(t, sent)
+			parts := sent.Messages[0].Content.([]interface{})
+			assert.Equal(t, map[string]interface{}{"type": "text", "text": tt.wantText}, parts[1])
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+// the passphrase travels in a header so it stays out of access logs
+const passphraseHeader = "X-Backup-Passphrase"
+
+// ExportTokens answers with every stored token sealed under the passphrase
+func ExportTokens(store *tokenstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		passphrase := r.Header.Get(passphraseHeader)
+		if passphrase == "" {
+			writeErr(w, http.StatusBadRequest, "missing "+passphraseHeader+" header")
+			return
+		}
+
+		tokens, err := store.List()
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to list tokens")
+			return
+		}
+		bundle, err := tokenstore.Seal(tokens, passphrase)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to seal tokens")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="mo-tokens.json"`)
+		json.NewEncoder(w).Encode(bundle)
+	}
+}
+
+// ImportTokens merges an exported bundle into the store
+func ImportTokens(store *tokenstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		passphrase := r.Header.Get(passphraseHeader)
+		if passphrase == "" {
+			writeErr(w, http.StatusBadRequest, "missing "+passphraseHeader+" header")
+			return
+		}
+
+		var bundle tokenstore.Bundle
+		if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		tokens, err := bundle.Open(passphrase)
+		if errors.Is(err, tokenstore.ErrBadPassphrase) {
+			writeErr(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		res, err := store.Import(tokens)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to import tokens")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+func TestTokenBackup(t *testing.T) {
+	src, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer src.Close()
+	_, err = src.Add("a@x.io", "jwt-a")
+	require.NoError(t, err)
+	_, err = src.AddWithProvider("qwen", "q@x.io", "at", "rt", 1767225600000)
+	require.NoError(t, err)
+
+	dst, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer dst.Close()
+
+	router := chi.NewRouter()
+	router.Get("/export", ExportTokens(src))
+	router.Post("/import", ImportTokens(dst))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req := httptest.NewRequest("GET", "/export", nil)
+	req.Header.Set(passphraseHeader, "s3cret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	bundle := w.Body.String()
+	assert.NotContains(t, bundle, "jwt-a")
+
+	importBundle := func(passphrase string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/import", strings.NewReader(bundle))
+		req.Header.Set(passphraseHeader, passphrase)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = importBundle("guess")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "wrong passphrase")
+	tokens, err := dst.List()
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+
+	w = importBundle("s3cret")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"added":2,"updated":0,"skipped":0}`, w.Body.String())
+
+	// a second import finds every account already there
+	w = importBundle("s3cret")
+	assert.JSONEq(t, `{"added":0,"updated":0,"skipped":2}`, w.Body.String())
+
+	want, err := src.List()
+	require.NoError(t, err)
+	got, err := dst.List()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/service/batch"
+)
+
+// CreateBatch starts a batch, POST /v1/batches. the body is openai's
+// {"input_file_id": ...}, the requests inline as {"requests": [...]} or a
+// json array, or the jsonl itself
+func CreateBatch(configs config.Provider, batches *batch.Batches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if max := configs.Config().Limits.MaxBodyBytes; max > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(max))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErr(w, http.StatusRequestEntityTooLarge, "failed to read body")
+			return
+		}
+
+		var req struct {
+			InputFileID      string            `json:"input_file_id"`
+			Endpoint         string            `json:"endpoint"`
+			CompletionWindow string            `json:"completion_window"`
+			Metadata         map[string]string `json:"metadata"`
+			Requests         []json.RawMessage `json:"requests"`
+		}
+		// a jsonl body is the input file itself
+		input := body
+		if !isJSONL(r.Header.Get("Content-Type")) {
+			trimmed := bytes.TrimSpace(body)
+			if len(trimmed) > 0 && trimmed[0] == '[' {
+				if err := json.Unmarshal(trimmed, &req.Requests); err != nil {
+					writeErr(w, http.StatusBadRequest, "invalid json")
+					return
+				}
+				input = jsonLines(req.Requests)
+			} else if json.Unmarshal(trimmed, &req) == nil && (req.InputFileID != "" || req.Requests != nil) {
+				input = jsonLines(req.Requests)
+			}
+		}
+
+		if req.Endpoint != "" && req.Endpoint != batch.Endpoint {
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "only "+batch.Endpoint+" can be batched").WithParam("endpoint"))
+			return
+		}
+		if req.CompletionWindow != "" && req.CompletionWindow != batch.CompletionWindow {
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "completion_window must be "+batch.CompletionWindow).WithParam("completion_window"))
+			return
+		}
+
+		fileID := req.InputFileID
+		if fileID == "" {
+			if len(bytes.TrimSpace(input)) == 0 {
+				writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "input_file_id or requests is required").WithParam("input_file_id"))
+				return
+			}
+			f, err := batches.AddFile(input, "batch.jsonl", "batch", bearerKey(r))
+			if err != nil {
+				writeErr(w, http.StatusInternalServerError, "failed to save batch input")
+				return
+			}
+			fileID = f.ID
+		}
+
+		b, err := batches.Create(fileID, batch.Client{APIKey: bearerKey(r), RemoteAddr: r.RemoteAddr}, req.Metadata)
+		if errors.Is(err, batch.ErrNoFile) {
+			writeAPIErr(w, domain.NewAPIError(http.StatusNotFound, "no file "+fileID).WithParam("input_file_id"))
+			return
+		}
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to create batch")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	}
+}
+
+// jsonLines joins inline batch requests into the jsonl a file would hold
+func jsonLines(lines []json.RawMessage) []byte {
+	var out []byte
+	for _, line := range lines {
+		var compact bytes.Buffer
+		if json.Compact(&compact, line) != nil {
+			// left as is, validation reports the line
+			compact.Reset()
+			compact.Write(bytes.ReplaceAll(line, []byte("\n"), []byte(" ")))
+		}
+		out = append(append(out, compact.Bytes()...), '\n')
+	}
+	return out
+}
+
+func ListBatches(batches *batch.Batches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := batches.List(bearerKey(r))
+		resp := map[string]any{"object": "list", "data": list, "has_more": false}
+		if len(list) > 0 {
+			resp["first_id"], resp["last_id"] = list[0].ID, list[len(list)-1].ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func GetBatch(batches *batch.Batches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := batches.Get(chi.URLParam(r, "id"), bearerKey(r))
+		if err != nil {
+			writeErr(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	}
+}
+
+func CancelBatch(batches *batch.Batches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := batches.Cancel(chi.URLParam(r, "id"), bearerKey(r))
+		switch {
+		case errors.Is(err, batch.ErrNotFound):
+			writeErr(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, batch.ErrFinished):
+			writeErr(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeErr(w, http.StatusInternalServerError, err.Error())
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(b)
+		}
+	}
+}
+
+// UploadFile keeps a batch input, POST /v1/files as openai's multipart form
+// with file and purpose
+func UploadFile(configs config.Provider, batches *batch.Batches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if max := configs.Config().Limits.MaxBodyBytes; max > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(max))
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "a multipart file is required").WithParam("file"))
+			return
+		}
+		defer file.Close()
+
+		purpose := r.FormValue("purpose")
+		if purpose != "batch" {
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "only batch files can be uploaded").WithParam("purpose"))
+			return
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			writeErr(w, http.StatusRequestEntityTooLarge, "failed to read file")
+			return
+		}
+
+		f, err := batches.AddFile(data, header.Filename, purpose, bearerKey(r))
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to save file")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	}
+}
+
+// batchRunner sends batch requests through the chat handler, limits and
+// profiles included. streaming is turned off, each reply is kept whole
+func batchRunner(chat http.Handler) batch.Runner {
+	return func(ctx context.Context, client batch.Client, body []byte) (batch.Reply, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return batch.Reply{}, err
+		}
+		delete(fields, "stream")
+		delete(fields, "stream_options")
+		body, _ = json.Marshal(fields)
+
+		r, err := http.NewRequestWithContext(ctx, "POST", batch.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return batch.Reply{}, err
+		}
+		r.RemoteAddr = client.RemoteAddr
+		r.Header.Set("Content-Type", "application/json")
+		if client.APIKey != "" {
+			r.Header.Set("Authorization", "Bearer "+client.APIKey)
+		}
+
+		rec := &batchRecorder{header: http.Header{}}
+		chat.ServeHTTP(rec, r)
+
+		reply := batch.Reply{Status: replyStatus(rec.status), Body: rec.body.Bytes()}
+		if reply.Status == http.StatusTooManyRequests || reply.Status == http.StatusServiceUnavailable {
+			if secs, err := strconv.Atoi(rec.header.Get("Retry-After")); err == nil {
+				reply.RetryAfter = time.Duration(max(secs, 1)) * time.Second
+			}
+		}
+		return reply, nil
+	}
+}
+
+func replyStatus(status int) int {
+	if status == 0 {
+		return http.StatusOK
+	}
+	return status
+}
+
+// batchRecorder keeps the reply of one batch request
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *batchRecorder) Header() http.Header { return b.header }
+
+func (b *batchRecorder) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *batchRecorder) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// isJSONL reports whether a content type names json lines
+func isJSONL(contentType string) bool {
+	return strings.Contains(contentType, "jsonl") || strings.Contains(contentType, "ndjson")
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/service/batch"
+)
+
+// batchRouter serves the batch and file routes over a chat handler
+func batchRouter(t *testing.T, chat http.Handler) http.Handler {
+	t.Helper()
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	batches := batch.New(store, batchRunner(chat), 2, 100)
+	t.Cleanup(func() {
+		batches.Close()
+		store.Close()
+	})
+
+	configs := config.Static(&config.Config{})
+	r := chi.NewRouter()
+	r.Post("/v1/batches", CreateBatch(configs, batches))
+	r.Get("/v1/batches", ListBatches(batches))
+	r.Get("/v1/batches/{id}", GetBatch(batches))
+	r.Post("/v1/batches/{id}/cancel", CancelBatch(batches))
+	r.Post("/v1/files", UploadFile(configs, batches))
+	r.Get("/v1/files/{id}/content", FileContent(configs, batches, nil))
+	return r
+}
+
+func serveBatch(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestBatchThroughChat(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "Hello", "done": true}}` + "\n\n"
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", forModel("glm"), mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(sse)),
+	}, nil)
+	mockAI.On("SendChatRequest", forModel("broken"), mock.Anything).
+		Return(nil, domain.NewUpstreamError(http.StatusInternalServerError, "upstream error"))
+
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	h := batchRouter(t, ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil))
+
+	body := `{"endpoint":"/v1/chat/completions","completion_window":"24h","metadata":{"job":"nightly"},"requests":[
+		{"custom_id":"ok","body":{"model":"glm","stream":true,"messages":[{"role":"user","content":"hi"}]}},
+		{"custom_id":"invalid","body":{"model":"glm","messages":[]}},
+		{"custom_id":"upstream","body":{"model":"broken","messages":[{"role":"user","content":"hi"}]}}
+	]}`
+	w := serveBatch(h, httptest.NewRequest("POST", "/v1/batches", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var created batch.Batch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "nightly", created.Metadata["job"])
+	assert.Equal(t, 3, created.RequestCounts.Total)
+
+	var done batch.Batch
+	require.Eventually(t, func() bool {
+		w := serveBatch(h, httptest.NewRequest("GET", "/v1/batches/"+created.ID, nil))
+		json.Unmarshal(w.Body.Bytes(), &done)
+		return done.Status == batch.Completed
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, batch.Counts{Total: 3, Completed: 1, Failed: 2}, done.RequestCounts)
+
+	w = serveBatch(h, httptest.NewRequest("GET", "/v1/files/"+*done.OutputFileID+"/content", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/jsonl", w.Header().Get("Content-Type"))
+
+	results := map[string]batch.Result{}
+	for _, line := range bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n")) {
+		var res batch.Result
+		require.NoError(t, json.Unmarshal(line, &res))
+		results[res.CustomID] = res
+	}
+	require.Len(t, results, 3)
+
+	var reply domain.ChatResponse
+	require.NoError(t, json.Unmarshal(results["ok"].Response.Body, &reply))
+	assert.Equal(t, "chat.completion", reply.Object, "batched requests are never streamed")
+	assert.Equal(t, "Hello", reply.Choices[0].Message.Content)
+	assert.Equal(t, http.StatusBadRequest, results["invalid"].Response.StatusCode)
+	assert.Equal(t, http.StatusBadGateway, results["upstream"].Response.StatusCode)
+
+	w = serveBatch(h, httptest.NewRequest("POST", "/v1/batches/"+created.ID+"/cancel", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestCreateBatchInputs(t *testing.T) {
+	chat := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	})
+	h := batchRouter(t, chat)
+
+	line := `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"messages":[]}}`
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("purpose", "batch")
+	fw, _ := mw.CreateFormFile("file", "input.jsonl")
+	fw.Write([]byte(line + "\n"))
+	mw.Close()
+	upload := httptest.NewRequest("POST", "/v1/files", &form)
+	upload.Header.Set("Content-Type", mw.FormDataContentType())
+	w := serveBatch(h, upload)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var file batch.File
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, "input.jsonl", file.Filename)
+
+	jsonl := httptest.NewRequest("POST", "/v1/batches", strings.NewReader(line+"\n"))
+	jsonl.Header.Set("Content-Type", "application/jsonl")
+
+	tests := []struct {
+		name  string
+		req   *http.Request
+		want  int
+		param string
+	}{
+		{name: "uploaded file", req: httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`{"input_file_id":"`+file.ID+`","endpoint":"/v1/chat/completions"}`)), want: http.StatusOK},
+		{name: "jsonl body", req: jsonl, want: http.StatusOK},
+		{name: "array", req: httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`[`+line+`]`)), want: http.StatusOK},
+		{name: "missing file", req: httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`{"input_file_id":"file-nope"}`)), want: http.StatusNotFound, param: "input_file_id"},
+		{name: "other endpoint", req: httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`{"input_file_id":"`+file.ID+`","endpoint":"/v1/embeddings"}`)), want: http.StatusBadRequest, param: "endpoint"},
+		{name: "other window", req: httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`{"input_file_id":"`+file.ID+`","completion_window":"1h"}`)), want: http.StatusBadRequest, param: "completion_window"},
+		{name: "nothing", req: httptest.NewRequest("POST", "/v1/batches", strings.NewReader(``)), want: http.StatusBadRequest, param: "input_file_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveBatch(h, tt.req)
+			require.Equal(t, tt.want, w.Code, w.Body.String())
+			if tt.param != "" {
+				e := decodeAPIError(t, w)
+				require.NotNil(t, e.Param)
+				assert.Equal(t, tt.param, *e.Param)
+				return
+			}
+			var created batch.Batch
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+			assert.Equal(t, 1, created.RequestCounts.Total)
+		})
+	}
+
+	w = serveBatch(h, httptest.NewRequest("GET", "/v1/batches", nil))
+	var list struct {
+		Object string        `json:"object"`
+		Data   []batch.Batch `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Equal(t, "list", list.Object)
+	assert.Len(t, list.Data, 3)
+}
+
+func TestBatchesByKey(t *testing.T) {
+	chat := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	})
+	h := batchRouter(t, chat)
+
+	as := func(key string, r *http.Request) *httptest.ResponseRecorder {
+		r.Header.Set("Authorization", "Bearer "+key)
+		return serveBatch(h, r)
+	}
+
+	line := `{"custom_id":"a","body":{"messages":[]}}`
+	w := as("sk-a", httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`[`+line+`]`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created batch.Batch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	var done batch.Batch
+	require.Eventually(t, func() bool {
+		w := as("sk-a", httptest.NewRequest("GET", "/v1/batches/"+created.ID, nil))
+		json.Unmarshal(w.Body.Bytes(), &done)
+		return done.Status == batch.Completed
+	}, 5*time.Second, 5*time.Millisecond)
+	require.NotNil(t, done.OutputFileID)
+
+	// another key sees none of it
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/v1/batches/"+created.ID, nil),
+		httptest.NewRequest("POST", "/v1/batches/"+created.ID+"/cancel", nil),
+		httptest.NewRequest("GET", "/v1/files/"+created.InputFileID+"/content", nil),
+		httptest.NewRequest("GET", "/v1/files/"+*done.OutputFileID+"/content", nil),
+		httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`{"input_file_id":"`+created.InputFileID+`"}`)),
+	} {
+		path := req.Method + " " + req.URL.Path
+		assert.Equal(t, http.StatusNotFound, as("sk-b", req).Code, path)
+	}
+
+	var list struct {
+		Data []batch.Batch `json:"data"`
+	}
+	w = as("sk-b", httptest.NewRequest("GET", "/v1/batches", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Empty(t, list.Data)
+
+	w = as("sk-a", httptest.NewRequest("GET", "/v1/batches", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Data, 1)
+	w = as("sk-a", httptest.NewRequest("GET", "/v1/files/"+*done.OutputFileID+"/content", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
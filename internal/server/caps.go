@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+)
+
+// finish_reason of a reply that ran past caps.max_duration
+const finishTimeout = "timeout"
+
+// replyCap counts a reply as it comes in and ends it at the caps of the
+// request's api key. a nil replyCap lets everything through, for the
+// follow-up calls of retries and resumes
+type replyCap struct {
+	caps      config.ReplyCaps
+	tokenizer utils.Tokener
+	deadline  time.Time
+
+	chars, tokens int
+	// finish_reason once a cap is hit, "" before
+	reason string
+}
+
+func newReplyCap(cfg *config.Config, tokenizer utils.Tokener, start time.Time) *replyCap {
+	c := &replyCap{caps: cfg.Caps.ReplyCaps, tokenizer: tokenizer}
+	if c.caps.MaxDuration > 0 {
+		c.deadline = start.Add(c.caps.MaxDuration)
+	}
+	return c
+}
+
+// take returns what of text fits under the caps. once one is hit it
+// returns nothing more
+func (c *replyCap) take(text string) string {
+	if c == nil {
+		return text
+	}
+	if c.over() || text == "" {
+		return ""
+	}
+
+	if c.caps.MaxChars > 0 {
+		if left := c.caps.MaxChars - c.chars; utf8.RuneCountInString(text) > left {
+			text = cutRunes(text, left)
+			c.reason = "length"
+		}
+	}
+	if c.caps.MaxTokens > 0 {
+		n := c.tokenizer.Count(text)
+		if c.tokens+n > c.caps.MaxTokens {
+			// tokens do not split cleanly, give up whole runes until it fits
+			for n > 0 && c.tokens+n > c.caps.MaxTokens {
+				text = cutRunes(text, utf8.RuneCountInString(text)-1)
+				n = c.tokenizer.Count(text)
+			}
+			c.reason = "length"
+		}
+		c.tokens += n
+	}
+	c.chars += utf8.RuneCountInString(text)
+	return text
+}
+
+// delta caps the text of a formatted upstream delta in place
+func (c *replyCap) delta(delta map[string]interface{}) {
+	// reasoning comes before the answer
+	for _, key := range []string{"reasoning_content", "content"} {
+		if s, ok := delta[key].(string); ok {
+			delta[key] = c.take(s)
+		}
+	}
+}
+
+// over reports whether the reply is over, the deadline included
+func (c *replyCap) over() bool {
+	if c == nil {
+		return false
+	}
+	if c.reason == "" && !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		c.reason = finishTimeout
+	}
+	return c.reason != ""
+}
+
+// hit reports whether a cap ended the reply, unlike over it does not look
+// at the clock, a reply that finished in time stays finished
+func (c *replyCap) hit() bool {
+	return c != nil && c.reason != ""
+}
+
+// log notes the capped reply, the request id comes with ctx
+func (c *replyCap) log(ctx context.Context, model string) {
+	metrics.Inc("capped_replies", model)
+	logger.FromContext(ctx).Warn().
+		Str("finish_reason", c.reason).
+		Int("chars", c.chars).
+		Int("tokens", c.tokens).
+		Msg("reply capped")
+}
+
+// cutRunes keeps the first n runes of s
+func cutRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// endlessBody repeats event until it is closed, a generation that never ends
+type endlessBody struct {
+	event  string
+	pos    int
+	closed atomic.Bool
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	if b.closed.Load() {
+		return 0, errors.New("read on closed body")
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], b.event[b.pos:])
+		n += c
+		b.pos = (b.pos + c) % len(b.event)
+	}
+	return n, nil
+}
+
+func (b *endlessBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+// cappedReply returns the content and finish_reason of a response or stream
+func cappedReply(t *testing.T, w *httptest.ResponseRecorder, stream bool) (string, string) {
+	t.Helper()
+	if !stream {
+		var resp domain.ChatResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+		return resp.Choices[0].Message.Content, *resp.Choices[0].FinishReason
+	}
+
+	var content, finish string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		var chunk domain.ChatResponse
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		if chunk.Choices[0].Delta != nil {
+			content += chunk.Choices[0].Delta.Content
+		}
+		if chunk.Choices[0].FinishReason != nil {
+			finish = *chunk.Choices[0].FinishReason
+		}
+	}
+	return content, finish
+}
+
+func TestReplyCaps(t *testing.T) {
+	zlmEvent := `data: {"data": {"phase": "answer", "delta_content": "ab "}}` + "\n\n"
+	qwenEvent := `data: {"id":"c1","created":1,"choices":[{"index":0,"delta":{"content":"ab "}}]}` + "\n\n"
+
+	tests := []struct {
+		name       string
+		caps       config.ReplyCaps
+		key        string
+		wantFinish string
+		// content length, -1 when only the finish matters
+		wantLen int
+	}{
+		{name: "chars", caps: config.ReplyCaps{MaxChars: 50}, wantFinish: "length", wantLen: 50},
+		// one token per delta, the eleventh does not fit
+		{name: "tokens", caps: config.ReplyCaps{MaxTokens: 10}, wantFinish: "length", wantLen: 30},
+		{name: "duration", caps: config.ReplyCaps{MaxDuration: 50 * time.Millisecond}, wantFinish: "timeout", wantLen: -1},
+		{name: "per key", caps: config.ReplyCaps{MaxChars: 50}, key: "sk-long", wantFinish: "length", wantLen: 100},
+	}
+
+	for _, upstream := range []string{"zlm", "qwen"} {
+		for _, stream := range []bool{false, true} {
+			if upstream == "qwen" && !stream {
+				// an openai upstream sends a non-stream reply whole
+				continue
+			}
+			for _, tt := range tests {
+				t.Run(upstream+"/"+map[bool]string{false: "whole", true: "stream"}[stream]+"/"+tt.name, func(t *testing.T) {
+					cfg := &config.Config{
+						Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+						Caps: config.CapsConfig{
+							ReplyCaps: tt.caps,
+							Keys:      map[string]config.ReplyCaps{"sk-long": {MaxChars: 100}},
+						},
+					}
+
+					body := &endlessBody{event: zlmEvent}
+					mockAI := new(MockAIClient)
+					var p provider.Provider = mockAI
+					model := "glm"
+					if upstream == "qwen" {
+						body.event, model = qwenEvent, "coder-model"
+						p = openaiMock{namedMock{MockAIClient: mockAI, name: "qwen"}}
+					}
+					mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: body}, nil)
+
+					data, _ := json.Marshal(domain.ChatRequest{
+						Model:    model,
+						Stream:   stream,
+						Messages: []domain.Message{{Role: "user", Content: "go on forever"}},
+					})
+					r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+					if tt.key != "" {
+						r.Header.Set("Authorization", "Bearer "+tt.key)
+					}
+					w := httptest.NewRecorder()
+					ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)(w, r)
+					require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+					content, finish := cappedReply(t, w, stream)
+					assert.Equal(t, tt.wantFinish, finish)
+					if tt.wantLen >= 0 {
+						assert.Len(t, content, tt.wantLen)
+					}
+					assert.True(t, strings.HasPrefix(content, "ab ab"), content[:min(len(content), 20)])
+					assert.True(t, body.closed.Load(), "upstream body is closed")
+				})
+			}
+		}
+	}
+}
+
+// thinking counts toward the caps as the answer does, a reply that never
+// leaves it still ends
+func TestReplyCapsReasoningOnly(t *testing.T) {
+	events := map[string]string{
+		"zlm":  `data: {"data": {"phase": "thinking", "delta_content": "ab "}}` + "\n\n",
+		"qwen": `data: {"id":"c1","created":1,"choices":[{"index":0,"delta":{"reasoning_content":"ab "}}]}` + "\n\n",
+	}
+	tests := []struct {
+		name    string
+		caps    config.ReplyCaps
+		wantLen int
+	}{
+		{"chars", config.ReplyCaps{MaxChars: 50}, 50},
+		{"tokens", config.ReplyCaps{MaxTokens: 10}, 30},
+	}
+
+	for upstream, event := range events {
+		for _, tt := range tests {
+			t.Run(upstream+"/"+tt.name, func(t *testing.T) {
+				cfg := &config.Config{
+					Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+					Caps:  config.CapsConfig{ReplyCaps: tt.caps},
+				}
+				body := &endlessBody{event: event}
+				mockAI := new(MockAIClient)
+				var p provider.Provider = mockAI
+				if upstream == "qwen" {
+					p = openaiMock{namedMock{MockAIClient: mockAI, name: "qwen"}}
+				}
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: body}, nil)
+
+				data := `{"model":"glm","stream":true,"messages":[{"role":"user","content":"think forever"}]}`
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(data)))
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+				var reasoning, finish string
+				for _, line := range strings.Split(w.Body.String(), "\n") {
+					var chunk domain.ChatResponse
+					data, ok := strings.CutPrefix(line, "data: ")
+					if !ok || json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+						continue
+					}
+					if chunk.Choices[0].Delta != nil {
+						reasoning += chunk.Choices[0].Delta.ReasoningContent
+					}
+					if chunk.Choices[0].FinishReason != nil {
+						finish = *chunk.Choices[0].FinishReason
+					}
+				}
+				assert.Equal(t, "length", finish)
+				assert.Len(t, reasoning, tt.wantLen)
+				assert.True(t, body.closed.Load(), "upstream body is closed")
+			})
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/jwt"
+	"github.com/zarazaex69/mo/internal/service/auth"
+	"github.com/zarazaex69/mo/internal/service/batch"
+)
+
+// CheckStep is one step of a self-test, Err is nil when it passed
+type CheckStep struct {
+	Name    string
+	Err     error
+	Detail  string
+	Elapsed time.Duration
+}
+
+// checkPrompt asks for the shortest reply that still proves a model answered
+const checkPrompt = "say ok"
+
+// Check validates the active token, lists the upstream models and sends one
+// tiny chat request through the same chain clients use. it stops at the
+// first step that fails, that one is the last returned
+func (s *Server) Check(ctx context.Context) []CheckStep {
+	steps := []struct {
+		name string
+		run  func(context.Context) (string, error)
+	}{
+		{"token", s.checkToken},
+		{"models", s.checkModels},
+		{"chat", s.checkChat},
+	}
+
+	var out []CheckStep
+	for _, st := range steps {
+		start := time.Now()
+		detail, err := st.run(ctx)
+		out = append(out, CheckStep{Name: st.name, Err: err, Detail: detail, Elapsed: time.Since(start)})
+		if err != nil {
+			break
+		}
+	}
+	return out
+}
+
+func (s *Server) checkToken(ctx context.Context) (string, error) {
+	var user *domain.User
+	err := untilDone(ctx, func() (err error) {
+		user, err = auth.GetService().GetUser(s.configs.Config())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if user.ID == "" {
+		return "", errors.New("z.ai returned no user for the token")
+	}
+
+	detail := "user " + user.ID
+	if exp, err := jwt.Expiry(user.Token); err == nil && !exp.IsZero() {
+		detail += ", expires " + exp.UTC().Format(time.RFC3339)
+	}
+	return detail, nil
+}
+
+func (s *Server) checkModels(ctx context.Context) (string, error) {
+	if err := untilDone(ctx, s.catalog.Refresh); err != nil {
+		return "", err
+	}
+
+	n := 0
+	for _, m := range s.catalog.Models() {
+		if m.OwnedBy != "mo" {
+			n++
+		}
+	}
+	if n == 0 {
+		return "", errors.New("upstream listed no models")
+	}
+	return fmt.Sprintf("%d upstream models", n), nil
+}
+
+func (s *Server) checkChat(ctx context.Context) (string, error) {
+	cfg := s.configs.Config()
+	body, _ := json.Marshal(map[string]any{
+		"model":      cfg.Model.Default,
+		"messages":   []map[string]string{{"role": "user", "content": checkPrompt}},
+		"max_tokens": 16,
+	})
+
+	reply, err := batchRunner(s.chat)(ctx, batch.Client{RemoteAddr: "127.0.0.1:0"}, body)
+	if err != nil {
+		return "", err
+	}
+
+	if reply.Status != http.StatusOK {
+		var e domain.ErrorResponse
+		if json.Unmarshal(reply.Body, &e) == nil && e.Error != nil {
+			return "", fmt.Errorf("%d: %s", reply.Status, e.Error.Message)
+		}
+		return "", fmt.Errorf("%d: %s", reply.Status, strings.TrimSpace(string(reply.Body)))
+	}
+
+	var resp domain.ChatResponse
+	if err := json.Unmarshal(reply.Body, &resp); err != nil {
+		return "", fmt.Errorf("decode reply: %w", err)
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message == nil || resp.Choices[0].Message.Content == "" {
+		return "", errors.New("model replied with no text")
+	}
+
+	text := strings.Join(strings.Fields(resp.Choices[0].Message.Content), " ")
+	if len(text) > 40 {
+		text = text[:40] + "..."
+	}
+	return fmt.Sprintf("%s: %q", resp.Model, text), nil
+}
+
+// untilDone runs fn, which takes no context, and gives up on it once ctx
+// ends. fn keeps running in the background and its result is dropped
+func untilDone(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
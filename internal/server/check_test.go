@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUntilDone(t *testing.T) {
+	failed := errors.New("upstream down")
+	assert.ErrorIs(t, untilDone(context.Background(), func() error { return failed }), failed)
+
+	// a call that hangs does not outlast the check
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	hung := make(chan struct{})
+	defer close(hung)
+	start := time.Now()
+	err := untilDone(ctx, func() error {
+		<-hung
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+)
+
+// headerCoalesced marks a response copied from an identical request
+const headerCoalesced = "X-Mo-Coalesced"
+
+// flights are the coalescable requests in flight by key, singleflight
+// style: the first runs, the ones arriving meanwhile wait for its response
+type flights struct {
+	mu       sync.Mutex
+	inFlight map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	resp *recorder
+	// requests that joined after the first
+	waiters int
+}
+
+func newFlights() *flights {
+	return &flights{inFlight: make(map[string]*flight)}
+}
+
+// join is the flight of key and whether the caller starts it
+func (g *flights) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.inFlight[key]; ok {
+		f.waiters++
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	g.inFlight[key] = f
+	return f, true
+}
+
+func (g *flights) land(key string, f *flight, resp *recorder) {
+	g.mu.Lock()
+	delete(g.inFlight, key)
+	waiters := f.waiters
+	g.mu.Unlock()
+	if waiters > 0 {
+		logger.Debug().Int("waiters", waiters).Msg("coalesced response shared")
+	}
+	f.resp = resp
+	close(f.done)
+}
+
+// coalesce lets identical non-stream requests at temperature 0 share one
+// upstream call. the first runs detached from its client, so when that
+// client leaves the requests waiting on it still get the response. a
+// request waits at most limits.coalesce_wait, then goes upstream itself
+func coalesce(configs config.Provider, g *flights) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := configs.ForKey(bearerKey(r))
+			wait := cfg.Limits.CoalesceWait
+			if wait <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, key := coalesceKey(r, cfg.Limits.MaxBodyBytes)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			f, first := g.join(key)
+			if first {
+				detached := r.Clone(context.WithoutCancel(r.Context()))
+				detached.Body = io.NopCloser(bytes.NewReader(body))
+				go func() {
+					rec := newRecorder()
+					defer func() {
+						// no recoverer up the stack of this goroutine
+						if p := recover(); p != nil {
+							logger.FromContext(detached.Context()).Error().Interface("panic", p).Msg("coalesced request panicked")
+							rec = newRecorder()
+							writeErr(rec, http.StatusInternalServerError, "internal error")
+						}
+						g.land(key, f, rec)
+					}()
+					next.ServeHTTP(rec, detached)
+				}()
+			}
+
+			var timeout <-chan time.Time
+			if !first {
+				timer := time.NewTimer(wait)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+
+			select {
+			case <-f.done:
+				if !first {
+					metrics.Inc("coalesced_requests", "shared")
+					w.Header().Set(headerCoalesced, "true")
+				}
+				f.resp.replay(w, !first)
+			case <-r.Context().Done():
+				// the flight goes on for whoever waits on it
+			case <-timeout:
+				metrics.Inc("coalesced_requests", "timeout")
+				logger.FromContext(r.Context()).Info().Dur("wait", wait).Msg("identical request still in flight, sending anyway")
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// coalesceKey reads the body back into r and keys it by api key and the
+// request with its json normalized. "" for requests that must not share a
+// response: streams, sampled ones, bodies too large or unreadable
+func coalesceKey(r *http.Request, maxBytes int) ([]byte, string) {
+	var src io.Reader = r.Body
+	if maxBytes > 0 {
+		src = io.LimitReader(r.Body, int64(maxBytes)+1)
+	}
+	body, err := io.ReadAll(src)
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil || (maxBytes > 0 && len(body) > maxBytes) {
+		return nil, ""
+	}
+
+	var req struct {
+		Stream      bool     `json:"stream"`
+		Temperature *float64 `json:"temperature"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.Stream || req.Temperature == nil || *req.Temperature != 0 {
+		return nil, ""
+	}
+
+	var doc any
+	if json.Unmarshal(body, &doc) != nil {
+		return nil, ""
+	}
+	normalized, err := json.Marshal(doc)
+	if err != nil {
+		return nil, ""
+	}
+
+	h := sha256.New()
+	io.WriteString(h, bearerKey(r))
+	h.Write([]byte{0})
+	h.Write(normalized)
+	return body, hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder keeps a response to hand out to every request of a flight
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header)}
+}
+
+func (rec *recorder) Header() http.Header { return rec.header }
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(p)
+}
+
+// replay writes a copy of the response to w. a cached copy counts its
+// whole prompt as cached_tokens, the request that ran it paid for them
+func (rec *recorder) replay(w http.ResponseWriter, cached bool) {
+	for k, v := range rec.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if cached {
+		w.Write(cachedUsage(rec.body.Bytes()))
+		return
+	}
+	w.Write(rec.body.Bytes())
+}
+
+// cachedUsage marks the prompt of a completion as cached, other bodies
+// stay as they are
+func cachedUsage(body []byte) []byte {
+	var resp domain.ChatResponse
+	if json.Unmarshal(body, &resp) != nil || resp.Usage == nil {
+		return body
+	}
+	resp.Usage.PromptTokensDetails = &domain.PromptTokensDetails{CachedTokens: resp.Usage.PromptTokens}
+
+	var out bytes.Buffer
+	if json.NewEncoder(&out).Encode(resp) != nil {
+		return body
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// heldProvider answers once release is closed and counts the requests
+type heldProvider struct {
+	bodyProvider
+	calls   *atomic.Int32
+	release chan struct{}
+}
+
+func (p heldProvider) SendChatRequest(context.Context, *domain.ChatRequest, string) (*http.Response, error) {
+	n := p.calls.Add(1)
+	<-p.release
+	return zlmAnswer(strings.Repeat("x", int(n))), nil
+}
+
+func coalescedChat(wait time.Duration) (http.Handler, heldProvider, *flights) {
+	cfg := &config.Config{
+		Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		Limits: config.LimitsConfig{CoalesceWait: wait},
+	}
+	p := heldProvider{calls: new(atomic.Int32), release: make(chan struct{})}
+	chat := ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)
+	g := newFlights()
+	return coalesce(config.Static(cfg), g)(chat), p, g
+}
+
+// waiters is how many requests wait on the flights of g
+func (g *flights) waiters() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, f := range g.inFlight {
+		n += f.waiters
+	}
+	return n
+}
+
+const greedy = `{"temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+
+// serve runs a request in the background, its recorder is ready once done closes
+func serve(h http.Handler, r *http.Request) (*httptest.ResponseRecorder, chan struct{}) {
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(w, r)
+	}()
+	return w, done
+}
+
+func TestCoalesceIdentical(t *testing.T) {
+	h, p, g := coalescedChat(time.Second)
+
+	first, firstDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(greedy)))
+	require.Eventually(t, func() bool { return p.calls.Load() == 1 }, time.Second, time.Millisecond)
+	// the same request, its json laid out differently
+	second, secondDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages": [{"content": "hi", "role": "user"}], "temperature": 0.0}`)))
+
+	require.Eventually(t, func() bool { return g.waiters() == 1 }, time.Second, time.Millisecond)
+	close(p.release)
+	<-firstDone
+	<-secondDone
+
+	assert.Equal(t, int32(1), p.calls.Load())
+	require.Equal(t, http.StatusOK, second.Code)
+	var firstResp, secondResp domain.ChatResponse
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &firstResp))
+	require.NoError(t, json.Unmarshal(second.Body.Bytes(), &secondResp))
+	assert.Equal(t, firstResp.Choices, secondResp.Choices)
+	assert.Equal(t, 0, firstResp.Usage.PromptTokensDetails.CachedTokens)
+	assert.Equal(t, secondResp.Usage.PromptTokens, secondResp.Usage.PromptTokensDetails.CachedTokens, "the shared reply is a cache hit")
+	assert.Empty(t, first.Header().Get(headerCoalesced))
+	assert.Equal(t, "true", second.Header().Get(headerCoalesced))
+}
+
+func TestCoalesceSkips(t *testing.T) {
+	for name, body := range map[string]string{
+		"sampled": `{"temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`,
+		"default": `{"messages":[{"role":"user","content":"hi"}]}`,
+		"stream":  `{"temperature":0,"stream":true,"messages":[{"role":"user","content":"hi"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h, p, _ := coalescedChat(time.Second)
+			_, firstDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+			_, secondDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+			require.Eventually(t, func() bool { return p.calls.Load() == 2 }, time.Second, time.Millisecond)
+			close(p.release)
+			<-firstDone
+			<-secondDone
+		})
+	}
+}
+
+func TestCoalesceFirstCancels(t *testing.T) {
+	h, p, g := coalescedChat(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, firstDone := serve(h, httptest.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", strings.NewReader(greedy)))
+	require.Eventually(t, func() bool { return p.calls.Load() == 1 }, time.Second, time.Millisecond)
+	second, secondDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(greedy)))
+	require.Eventually(t, func() bool { return g.waiters() == 1 }, time.Second, time.Millisecond)
+
+	// the first client leaves while upstream is still working
+	cancel()
+	<-firstDone
+	close(p.release)
+	<-secondDone
+
+	assert.Equal(t, int32(1), p.calls.Load(), "the waiter took over the first request")
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Contains(t, second.Body.String(), `"content":"x"`)
+}
+
+func TestCoalesceWaitRunsOut(t *testing.T) {
+	h, p, _ := coalescedChat(20 * time.Millisecond)
+
+	_, firstDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(greedy)))
+	require.Eventually(t, func() bool { return p.calls.Load() == 1 }, time.Second, time.Millisecond)
+	second, secondDone := serve(h, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(greedy)))
+
+	require.Eventually(t, func() bool { return p.calls.Load() == 2 }, time.Second, time.Millisecond, "sent after the wait")
+	close(p.release)
+	<-firstDone
+	<-secondDone
+	assert.Empty(t, second.Header().Get(headerCoalesced))
+}
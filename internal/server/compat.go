@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+const (
+	compatStrict   = "strict"
+	compatExtended = "extended"
+)
+
+type compatKey struct{}
+
+// compatProfile returns the profile chosen by the compat middleware
+func compatProfile(ctx context.Context) string {
+	if p, ok := ctx.Value(compatKey{}).(string); ok {
+		return p
+	}
+	return compatExtended
+}
+
+// compat picks the profile for the request (per api key, else the default)
+// and in strict mode reshapes every response into plain openai objects, so
+// handlers keep producing the extended format and never branch on it
+func compat(configs config.Provider) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			profile := configs.ForKey(bearerKey(r)).Compat.Profile
+
+			r = r.WithContext(context.WithValue(r.Context(), compatKey{}, profile))
+			if profile != compatStrict {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sw := &strictWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			sw.finish()
+		})
+	}
+}
+
+// standard request fields of POST /v1/chat/completions
+var (
+	openaiRequestFields = fieldSet("model", "messages", "stream", "stream_options", "temperature",
+		"top_p", "n", "stop", "max_tokens", "max_completion_tokens", "presence_penalty",
+		"frequency_penalty", "logit_bias", "logprobs", "top_logprobs", "user", "tools",
+		"tool_choice", "parallel_tool_calls", "response_format", "seed", "service_tier",
+		"store", "metadata", "reasoning_effort", "modalities", "audio", "prediction",
+		"functions", "function_call", "web_search_options")
+	openaiMessageFields = fieldSet("role", "content", "name", "tool_calls", "tool_call_id",
+		"refusal", "function_call", "audio")
+)
+
+func fieldSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set
+}
+
+// strictRequest rejects fields openai does not define, e.g. thinking
+func strictRequest(body []byte) *domain.APIError {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return domain.NewAPIError(http.StatusBadRequest, "invalid json")
+	}
+	var messages []map[string]json.RawMessage
+	json.Unmarshal(fields["messages"], &messages)
+
+	if name := unknownField(fields, openaiRequestFields); name != "" {
+		return domain.NewAPIError(http.StatusBadRequest, fmt.Sprintf("unrecognized request argument supplied: %s", name)).
+			WithParam(name).WithCode("unknown_parameter")
+	}
+	for i, msg := range messages {
+		if name := unknownField(msg, openaiMessageFields); name != "" {
+			param := fmt.Sprintf("messages[%d].%s", i, name)
+			return domain.NewAPIError(http.StatusBadRequest, fmt.Sprintf("unrecognized request argument supplied: %s", param)).
+				WithParam(param).WithCode("unknown_parameter")
+		}
+	}
+	return nil
+}
+
+func unknownField(fields map[string]json.RawMessage, known map[string]bool) string {
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return ""
+	}
+	sort.Strings(unknown)
+	return unknown[0]
+}
+
+// strictWriter rewrites chat completion bodies on their way out. streams are
+// reshaped event by event, json bodies once the handler returns
+type strictWriter struct {
+	http.ResponseWriter
+	stream  bool
+	decided bool
+	buf     bytes.Buffer
+	// canonical stream state: role only on the first chunk
+	sentRole bool
+}
+
+func (s *strictWriter) WriteHeader(code int) {
+	s.decide()
+	s.Header().Del("X-Mo-Warning")
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *strictWriter) Write(b []byte) (int, error) {
+	if !s.decided {
+		s.WriteHeader(http.StatusOK)
+	}
+	s.buf.Write(b)
+
+	if s.stream {
+		s.drainEvents()
+	}
+	return len(b), nil
+}
+
+func (s *strictWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *strictWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *strictWriter) decide() {
+	if s.decided {
+		return
+	}
+	s.decided = true
+	s.stream = strings.HasPrefix(s.Header().Get("Content-Type"), "text/event-stream")
+}
+
+func (s *strictWriter) drainEvents() {
+	for {
+		event, ok := nextEvent(&s.buf)
+		if !ok {
+			return
+		}
+		s.writeEvent(event)
+	}
+}
+
+// nextEvent takes the next complete sse event off buf, without its blank line
+func nextEvent(buf *bytes.Buffer) ([]byte, bool) {
+	i := bytes.Index(buf.Bytes(), []byte("\n\n"))
+	if i < 0 {
+		return nil, false
+	}
+	return append([]byte(nil), buf.Next(i + 2)[:i]...), true
+}
+
+func (s *strictWriter) writeEvent(event []byte) {
+	data, ok := bytes.CutPrefix(event, []byte("data: "))
+	if !ok || string(data) == "[DONE]" {
+		s.ResponseWriter.Write(append(event, '\n', '\n'))
+		return
+	}
+
+	var chunk map[string]any
+	if json.Unmarshal(data, &chunk) != nil {
+		s.ResponseWriter.Write(append(event, '\n', '\n'))
+		return
+	}
+
+	if !s.strictChunk(chunk) {
+		return
+	}
+	out, _ := json.Marshal(chunk)
+	fmt.Fprintf(s.ResponseWriter, "data: %s\n\n", out)
+}
+
+// strictChunk reshapes a stream chunk, false drops it entirely
+func (s *strictWriter) strictChunk(chunk map[string]any) bool {
+	// error events are already openai shaped
+	if _, ok := chunk["error"]; ok {
+		return true
+	}
+	// mo.* trailers have no openai counterpart
+	if chunk["object"] != "chat.completion.chunk" {
+		return false
+	}
+	strictObject(chunk)
+
+	choices, _ := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		// usage trailer
+		return true
+	}
+
+	keep := false
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		delta, _ := choice["delta"].(map[string]any)
+		if delta == nil {
+			delta = map[string]any{}
+			choice["delta"] = delta
+		}
+
+		if choice["finish_reason"] != nil {
+			// canonical final chunk has an empty delta
+			delete(delta, "role")
+			keep = true
+			continue
+		}
+
+		// deltas that only carried reasoning are empty now
+		delete(delta, "role")
+		if len(delta) == 0 {
+			continue
+		}
+		if !s.sentRole {
+			delta["role"] = "assistant"
+		}
+		keep = true
+	}
+	if keep {
+		s.sentRole = true
+	}
+	return keep
+}
+
+func (s *strictWriter) finish() {
+	if s.stream || s.buf.Len() == 0 {
+		s.ResponseWriter.Write(s.buf.Bytes())
+		return
+	}
+
+	var obj map[string]any
+	if json.Unmarshal(s.buf.Bytes(), &obj) != nil || obj["choices"] == nil {
+		// errors and non chat bodies are already standard
+		s.ResponseWriter.Write(s.buf.Bytes())
+		return
+	}
+
+	strictObject(obj)
+	json.NewEncoder(s.ResponseWriter).Encode(obj)
+}
+
+var (
+	strictTopFields     = fieldSet("id", "object", "created", "model", "choices", "usage", "system_fingerprint", "service_tier")
+	strictChoiceFields  = fieldSet("index", "message", "delta", "finish_reason", "logprobs")
+	strictMessageFields = fieldSet("role", "content", "tool_calls", "refusal")
+	strictUsageFields   = fieldSet("prompt_tokens", "completion_tokens", "total_tokens", "prompt_tokens_details", "completion_tokens_details")
+	strictFinishReasons = fieldSet("stop", "length", "tool_calls", "content_filter")
+)
+
+// strictObject keeps only openai fields of a completion or chunk. reasoning
+// rendered inline by think_mode is already part of content, the separate
+// reasoning_content field is dropped
+func strictObject(obj map[string]any) {
+	keepFields(obj, strictTopFields)
+	if usage, ok := obj["usage"].(map[string]any); ok {
+		keepFields(usage, strictUsageFields)
+	}
+
+	choices, _ := obj["choices"].([]any)
+	for _, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		keepFields(choice, strictChoiceFields)
+
+		if fr, ok := choice["finish_reason"].(string); ok && !strictFinishReasons[fr] {
+			choice["finish_reason"] = "stop"
+		}
+		if msg, ok := choice["message"].(map[string]any); ok {
+			keepFields(msg, strictMessageFields)
+			// openai always sends content, null when there is none
+			if _, ok := msg["content"]; !ok {
+				msg["content"] = nil
+			}
+		}
+		if delta, ok := choice["delta"].(map[string]any); ok {
+			keepFields(delta, strictMessageFields)
+		}
+	}
+}
+
+func keepFields(obj map[string]any, allowed map[string]bool) {
+	for k := range obj {
+		if !allowed[k] {
+			delete(obj, k)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+func serveCompat(t *testing.T, cfg *config.Config, upstream string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(upstream)),
+	}, nil).Maybe()
+
+	h := compat(config.Static(cfg))(ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil))
+
+	r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCompatProfiles(t *testing.T) {
+	thinking := `data: {"data": {"phase": "thinking", "delta_content": "let me think"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "Hello"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": " World", "done": true}}` + "\n\n"
+	reasoningOnly := `data: {"data": {"phase": "thinking", "delta_content": "only thoughts", "done": true}}` + "\n\n"
+
+	fixtures := []struct {
+		name     string
+		upstream string
+		stream   bool
+		usage    bool
+	}{
+		{"stream", thinking, true, true},
+		{"json", thinking, false, false},
+		{"reasoning_only", reasoningOnly, false, false},
+	}
+
+	for _, profile := range []string{compatExtended, compatStrict} {
+		for _, fx := range fixtures {
+			t.Run(profile+"_"+fx.name, func(t *testing.T) {
+				cfg := &config.Config{
+					Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning", ReasoningOnly: "passthrough"},
+					Compat: config.CompatConfig{Profile: profile},
+				}
+
+				req := domain.ChatRequest{
+					Model:    "glm",
+					Stream:   fx.stream,
+					Messages: []domain.Message{{Role: "user", Content: "hi"}},
+				}
+				if fx.usage {
+					req.StreamOpts = &domain.StreamOptions{IncludeUsage: true}
+				}
+				body, _ := json.Marshal(req)
+
+				w := serveCompat(t, cfg, fx.upstream, body, nil)
+				require.Equal(t, http.StatusOK, w.Code)
+
+				got := assertGolden(t, "compat_"+profile+"_"+fx.name, w.Body.String())
+				if fx.stream {
+					assertTerminalSequence(t, got, fx.usage)
+				}
+
+				if profile == compatStrict {
+					assert.NotContains(t, got, "reasoning_content")
+					assert.NotContains(t, got, "reasoning_only")
+					assert.Empty(t, w.Header().Get("X-Mo-Warning"))
+				}
+			})
+		}
+	}
+}
+
+func TestCompatStrictRequest(t *testing.T) {
+	cfg := &config.Config{
+		Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		Compat: config.CompatConfig{Profile: compatExtended, Keys: map[string]string{"sk-saas": compatStrict}},
+	}
+	sse := `data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}` + "\n\n"
+
+	tests := []struct {
+		name       string
+		body       string
+		key        string
+		wantStatus int
+		wantParam  string
+	}{
+		{"extended accepts extensions", `{"messages":[{"role":"user","content":"hi"}],"thinking":true}`, "", http.StatusOK, ""},
+		{"strict key rejects thinking", `{"messages":[{"role":"user","content":"hi"}],"thinking":true}`, "sk-saas", http.StatusBadRequest, "thinking"},
+		{"strict key rejects message field", `{"messages":[{"role":"user","content":"hi","mo_tag":1}]}`, "sk-saas", http.StatusBadRequest, "messages[0].mo_tag"},
+		{"strict key accepts standard fields", `{"messages":[{"role":"user","content":"hi","name":"bob"}],"user":"u1","seed":1}`, "sk-saas", http.StatusOK, ""},
+		{"other key stays extended", `{"messages":[{"role":"user","content":"hi"}],"thinking":true}`, "sk-other", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.key != "" {
+				header.Set("Authorization", "Bearer "+tt.key)
+			}
+
+			w := serveCompat(t, cfg, sse, []byte(tt.body), header)
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+
+			if tt.wantParam != "" {
+				e := decodeAPIError(t, w)
+				require.NotNil(t, e.Param)
+				assert.Equal(t, tt.wantParam, *e.Param)
+				assert.Equal(t, "invalid_request_error", e.Type)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+// compress gzips or deflates json replies of at least server.compress_min_bytes
+// for clients that accept it. anything else, event streams above all, passes
+// untouched: a compressor holds bytes back and would batch up sse chunks
+func compress(configs config.Provider) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			minBytes := configs.Config().Server.CompressMinBytes
+			encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			// an upgraded connection is no longer http
+			if minBytes <= 0 || encoding == "" || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: minBytes}
+			defer cw.finish()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptedEncoding picks gzip over deflate, "" when the client takes neither
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+	for _, enc := range []string{"gzip", "deflate"} {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+type compressState int
+
+const (
+	// headers not written yet
+	compressPending compressState = iota
+	// json below the threshold so far, held back
+	compressBuffering
+	compressEncoding
+	compressBypass
+)
+
+// compressWriter decides at WriteHeader whether the reply is a candidate
+// and holds it back until it reaches minBytes or ends
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+
+	state  compressState
+	status int
+	buf    bytes.Buffer
+	enc    io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.state != compressPending {
+		return
+	}
+	c.status = status
+
+	h := c.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if mediaType != "application/json" || h.Get("Content-Encoding") != "" ||
+		status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		c.state = compressBypass
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	c.state = compressBuffering
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.state == compressPending {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	switch c.state {
+	case compressBypass:
+		return c.ResponseWriter.Write(p)
+	case compressEncoding:
+		return c.enc.Write(p)
+	}
+
+	c.buf.Write(p)
+	if c.buf.Len() < c.minBytes {
+		return len(p), nil
+	}
+	if err := c.startEncoding(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *compressWriter) startEncoding() error {
+	h := c.Header()
+	h.Set("Content-Encoding", c.encoding)
+	h.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(c.status)
+
+	if c.encoding == "gzip" {
+		c.enc = gzip.NewWriter(c.ResponseWriter)
+	} else {
+		c.enc, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+	}
+	c.state = compressEncoding
+
+	_, err := c.enc.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// Flush sends what is held back as is, a reply that wants flushing is not
+// one to compress
+func (c *compressWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *compressWriter) Flush() {
+	switch c.state {
+	case compressPending:
+		c.state = compressBypass
+		c.ResponseWriter.WriteHeader(http.StatusOK)
+	case compressBuffering:
+		c.state = compressBypass
+		c.Header().Del("Vary")
+		c.ResponseWriter.WriteHeader(c.status)
+		c.ResponseWriter.Write(c.buf.Bytes())
+		c.buf.Reset()
+	case compressEncoding:
+		if f, ok := c.enc.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes a reply that stayed under the threshold, or closes the
+// compressed one
+func (c *compressWriter) finish() {
+	switch c.state {
+	case compressBuffering:
+		c.ResponseWriter.WriteHeader(c.status)
+		c.ResponseWriter.Write(c.buf.Bytes())
+	case compressEncoding:
+		c.enc.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+func TestCompressNonStreamOnly(t *testing.T) {
+	long := strings.Repeat("func main() { fmt.Println(42) } ", 2000)
+	sse := `data: {"data": {"phase": "answer", "delta_content": ` + strconv.Quote(long) + `, "done": true}}` + "\n\n"
+	cfg := &config.Config{
+		Server: config.ServerConfig{CompressMinBytes: 1024},
+		Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+	}
+	configs := config.Static(cfg)
+	h := compress(configs)(ChatCompletions(configs,
+		provider.NewRegistry(bodyProvider{func() io.ReadCloser { return io.NopCloser(strings.NewReader(sse)) }}),
+		nil, &MockTokener{}, nil))
+
+	send := func(stream bool) *httptest.ResponseRecorder {
+		body := `{"model":"m","messages":[{"role":"user","content":"write it"}]}`
+		if stream {
+			body = `{"model":"m","stream":true,"messages":[{"role":"user","content":"write it"}]}`
+		}
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Accept-Encoding", "gzip, deflate, br")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send(false)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Less(t, w.Body.Len(), len(long)/10)
+
+	zr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	var resp domain.ChatResponse
+	require.NoError(t, json.NewDecoder(zr).Decode(&resp))
+	assert.Equal(t, long, resp.Choices[0].Message.Content)
+
+	w = send(true)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"), "event streams are never compressed")
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "data: ")
+	assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+}
+
+func TestCompressThreshold(t *testing.T) {
+	configs := config.Static(&config.Config{Server: config.ServerConfig{CompressMinBytes: 100}})
+	reply := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			// written in pieces, the threshold counts them together
+			for _, part := range strings.SplitAfter(body, ",") {
+				io.WriteString(w, part)
+			}
+		})
+	}
+	get := func(h http.Handler, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	small := `{"a":1,"b":2}`
+	w := get(compress(configs)(reply(small)), "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, small, w.Body.String())
+
+	large := `[` + strings.TrimSuffix(strings.Repeat(`"xxxxxxxxxx",`, 50), ",") + `]`
+	w = get(compress(configs)(reply(large)), "deflate")
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	data, err := io.ReadAll(flate.NewReader(w.Body))
+	require.NoError(t, err)
+	assert.Equal(t, large, string(data))
+
+	w = get(compress(configs)(reply(large)), "gzip;q=0, identity")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, w.Body.String())
+
+	off := compress(config.Static(&config.Config{}))(reply(large))
+	assert.Empty(t, get(off, "gzip").Header().Get("Content-Encoding"), "0 disables")
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	assert.Equal(t, "gzip", acceptedEncoding("deflate, gzip;q=0.5"))
+	assert.Equal(t, "deflate", acceptedEncoding("br, deflate"))
+	assert.Equal(t, "", acceptedEncoding("gzip;q=0"))
+	assert.Equal(t, "", acceptedEncoding(""))
+	assert.Equal(t, "gzip", acceptedEncoding("GZIP"))
+}
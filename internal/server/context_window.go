@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+)
+
+// headerTruncated carries how many messages truncate: auto dropped
+const headerTruncated = "X-Mo-Truncated-Messages"
+
+// fitContext checks the prompt plus max_tokens against the context window
+// of the model. with truncate auto the oldest messages go first, system
+// messages never, and the newest turn always stays. returns how many
+// messages were dropped
+func fitContext(req *domain.ChatRequest, window int, tokenizer utils.Tokener, imageTokens int) (int, *domain.APIError) {
+	if window <= 0 {
+		return 0, nil
+	}
+	reserve := 0
+	if req.MaxTokens != nil {
+		reserve = *req.MaxTokens
+	}
+
+	prompt := utils.CountChatTokens(tokenizer, req, imageTokens)
+	if prompt+reserve <= window {
+		return 0, nil
+	}
+	if req.Truncate != "auto" {
+		return 0, contextError(window, prompt, reserve)
+	}
+
+	groups := dropGroups(req.Messages)
+	drop := make(map[int]bool)
+	left := prompt
+	for _, group := range groups[:max(0, len(groups)-1)] {
+		if left+reserve <= window {
+			break
+		}
+		for _, i := range group {
+			left -= utils.CountMessageTokens(tokenizer, req.Messages[i], imageTokens)
+			drop[i] = true
+		}
+	}
+	if left+reserve > window {
+		return 0, contextError(window, prompt, reserve)
+	}
+
+	kept := make([]domain.Message, 0, len(req.Messages)-len(drop))
+	for i, msg := range req.Messages {
+		if !drop[i] {
+			kept = append(kept, msg)
+		}
+	}
+	req.Messages = kept
+	return len(drop), nil
+}
+
+// dropGroups lists the droppable messages oldest first. an assistant
+// message that called tools shares its group with the results, a result
+// without its call would be rejected upstream
+func dropGroups(msgs []domain.Message) [][]int {
+	var groups [][]int
+	caller := make(map[string]int)
+
+	for i, msg := range msgs {
+		if msg.Role == "system" {
+			continue
+		}
+		if msg.Role == "tool" {
+			if g, ok := caller[msg.ToolCallID]; ok {
+				groups[g] = append(groups[g], i)
+				continue
+			}
+		}
+
+		groups = append(groups, []int{i})
+		for _, call := range msg.ToolCalls {
+			caller[call.ID] = len(groups) - 1
+		}
+	}
+	return groups
+}
+
+func contextError(window, prompt, reserve int) *domain.APIError {
+	return domain.NewAPIError(http.StatusBadRequest, fmt.Sprintf(
+		"This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion, or send truncate: \"auto\".",
+		window, prompt+reserve, prompt, reserve)).
+		WithParam("messages").WithCode("context_length_exceeded")
+}
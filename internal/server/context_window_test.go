@@ -0,0 +1,115 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+func contents(msgs []domain.Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i], _ = m.Content.(string)
+	}
+	return out
+}
+
+func TestDropGroupsKeepsToolPairs(t *testing.T) {
+	msgs := []domain.Message{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Content: "q1"},
+		{Role: "assistant", ToolCalls: []domain.ToolCall{{ID: "a"}, {ID: "b"}}},
+		{Role: "tool", ToolCallID: "a", Content: "ra"},
+		{Role: "system", Content: "note"},
+		{Role: "tool", ToolCallID: "b", Content: "rb"},
+		{Role: "tool", ToolCallID: "orphan", Content: "ro"},
+		{Role: "user", Content: "q2"},
+	}
+
+	assert.Equal(t, [][]int{{1}, {2, 3, 5}, {6}, {7}}, dropGroups(msgs))
+}
+
+func TestFitContext(t *testing.T) {
+	tok := &MockTokener{}
+	msgs := []domain.Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "first question"},
+		{Role: "assistant", ToolCalls: []domain.ToolCall{{ID: "c1", Function: domain.FunctionCall{Name: "search", Arguments: "{}"}}}},
+		{Role: "tool", ToolCallID: "c1", Content: "result"},
+		{Role: "user", Content: "second question"},
+	}
+	full := utils.CountChatTokens(tok, &domain.ChatRequest{Messages: msgs}, 0)
+	// the budget left once the oldest user message is gone
+	withoutFirst := full - utils.CountMessageTokens(tok, msgs[1], 0)
+	maxTokens := 10
+
+	tests := []struct {
+		name        string
+		window      int
+		truncate    string
+		wantDropped int
+		wantErr     bool
+		want        []string
+	}{
+		{"exactly fits", full + maxTokens, "", 0, false, []string{"be brief", "first question", "", "result", "second question"}},
+		{"one token over rejects", full + maxTokens - 1, "", 0, true, nil},
+		{"one token over drops the oldest", full + maxTokens - 1, "auto", 1, false, []string{"be brief", "", "result", "second question"}},
+		{"fits right after the first drop", withoutFirst + maxTokens, "auto", 1, false, []string{"be brief", "", "result", "second question"}},
+		{"tool call goes with its result", withoutFirst + maxTokens - 1, "auto", 3, false, []string{"be brief", "second question"}},
+		{"newest turn and system never go", 10, "auto", 0, true, nil},
+		{"no window", 0, "", 0, false, []string{"be brief", "first question", "", "result", "second question"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := domain.ChatRequest{Messages: append([]domain.Message(nil), msgs...), MaxTokens: &maxTokens, Truncate: tt.truncate}
+
+			dropped, apiErr := fitContext(&req, tt.window, tok, 0)
+			if tt.wantErr {
+				require.NotNil(t, apiErr)
+				assert.Equal(t, "context_length_exceeded", *apiErr.Code)
+				assert.Len(t, req.Messages, len(msgs))
+				return
+			}
+			require.Nil(t, apiErr)
+			assert.Equal(t, tt.wantDropped, dropped)
+			assert.Equal(t, tt.want, contents(req.Messages))
+		})
+	}
+}
+
+func TestContextWindowHandler(t *testing.T) {
+	cfg := &config.Config{
+		Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		Limits: config.LimitsConfig{ContextTokens: map[string]int{"glm": 10}},
+	}
+	history := `[{"role":"user","content":"an old question with plenty of words in it"},{"role":"assistant","content":"an old answer"},{"role":"user","content":"hi"}]`
+
+	w := httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), provider.NewRegistry(new(MockAIClient)), nil, &MockTokener{}, nil)(w,
+		httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":`+history+`}`)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "context_length_exceeded", *decodeAPIError(t, w).Code)
+
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+		return len(r.Messages) == 1 && r.Messages[0].Content == "hi"
+	}), mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(answerStream("hello")))}, nil)
+
+	w = httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w,
+		httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"truncate":"auto","messages":`+history+`}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "2", w.Header().Get(headerTruncated))
+	mockAI.AssertExpectations(t)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/service/batch"
+	"github.com/zarazaex69/mo/internal/service/files"
+)
+
+// FileContent serves GET /v1/files/{id}/content: a batch input or output
+// kept by mo for the same api key, else an upstream file or cdn link
+// fetched with the token
+func FileContent(configs config.Provider, batches *batch.Batches, proxy *files.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		data, err := batches.FileContent(id, bearerKey(r))
+		switch {
+		case err == nil:
+			w.Header().Set("Content-Type", "application/jsonl")
+			w.Write(data)
+			return
+		case !errors.Is(err, batch.ErrNoFile):
+			writeErr(w, http.StatusInternalServerError, "failed to read file")
+			return
+		}
+
+		target, ok := files.Target(configs.ForKey(bearerKey(r)), id)
+		if proxy == nil || !ok {
+			writeErr(w, http.StatusNotFound, "no file "+id)
+			return
+		}
+		err = proxy.Serve(w, r, id, target)
+		var ue *domain.UpstreamError
+		switch {
+		case err == nil:
+		case errors.Is(err, files.ErrNotFound):
+			writeErr(w, http.StatusNotFound, "no file "+id)
+		case errors.As(err, &ue):
+			writeAPIErr(w, upstreamAPIError(err))
+		default:
+			logger.FromContext(r.Context()).Warn().Err(err).Str("file", id).Msg("file fetch failed")
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadGateway, "failed to fetch file").WithCode("upstream_error"))
+		}
+	}
+}
+
+// publicBase is what rewritten file links start with: files.public_url, or
+// the scheme and host the client reached mo at
+func publicBase(cfg *config.Config, r *http.Request) string {
+	if cfg.Files.PublicURL != "" {
+		return strings.TrimSuffix(cfg.Files.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
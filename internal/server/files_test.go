@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/service/batch"
+	"github.com/zarazaex69/mo/internal/service/files"
+)
+
+// serveFile fetches a file's content, with a Range header unless rng is empty
+func serveFile(h http.Handler, id, rng string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/v1/files/"+id+"/content", nil)
+	if rng != "" {
+		r.Header.Set("Range", rng)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestFileContentProxies(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0, 1, 2, 254, 255}, 1000)...)
+	var auth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/files/f-1/content" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(png))
+	}))
+	t.Cleanup(upstream.Close)
+	host, _ := url.Parse(upstream.URL)
+
+	// stands in for zlm's FetchFile
+	fetch := func(ctx context.Context, target string, header http.Header) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, "GET", target, nil)
+		req.Header = header
+		req.Header.Set("Authorization", "Bearer zai-token")
+		return http.DefaultClient.Do(req)
+	}
+	proxy := files.New(fetch, t.TempDir(), time.Hour, 1<<20)
+
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	batches := batch.New(store, nil, 1, 10)
+	t.Cleanup(func() {
+		batches.Close()
+		store.Close()
+	})
+	kept, err := batches.AddFile([]byte(`{"messages":[]}`+"\n"), "in.jsonl", "batch", "")
+	require.NoError(t, err)
+
+	cfg := &config.Config{Upstream: config.UpstreamConfig{Protocol: "http:", Host: host.Host}}
+	r := chi.NewRouter()
+	r.Get("/v1/files/{id}/content", FileContent(config.Static(cfg), batches, proxy))
+
+	w := serveFile(r, "f-1", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, png, w.Body.Bytes())
+	assert.Equal(t, "Bearer zai-token", auth)
+
+	w = serveFile(r, "f-1", "bytes=0-7")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, png[:8], w.Body.Bytes())
+
+	w = serveFile(r, kept.ID, "")
+	assert.Equal(t, "application/jsonl", w.Header().Get("Content-Type"), "mo's own files come first")
+
+	for _, id := range []string{"f-2", "a.b"} {
+		w = serveFile(r, id, "")
+		assert.Equal(t, http.StatusNotFound, w.Code, id)
+	}
+}
+
+func TestChatRewritesFileLinks(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "Done: ![img](https://z-cdn.chatglm"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": ".cn/out/1.png) and /api/v1/files/abc/content"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": " here", "done": true}}` + "\n\n"
+	cfg := &config.Config{
+		Model:    config.ModelConfig{Default: "glm"},
+		Upstream: config.UpstreamConfig{Protocol: "https:", Host: "chat.z.ai"},
+		Files:    config.FilesConfig{RewriteURLs: true, CDNHosts: []string{"z-cdn.chatglm.cn"}},
+	}
+	cdnID, _ := files.ID(cfg, "https://z-cdn.chatglm.cn/out/1.png")
+	want := "Done: ![img](http://mo.local/v1/files/" + cdnID + "/content) and http://mo.local/v1/files/abc/content here"
+
+	for _, stream := range []bool{false, true} {
+		mockAI := new(MockAIClient)
+		mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(strings.NewReader(sse)),
+		}, nil)
+		h := ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)
+
+		body := `{"messages":[{"role":"user","content":"draw"}],"stream":` + strconv.FormatBool(stream) + `}`
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		r.Host = "mo.local"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		if !stream {
+			var resp domain.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, want, resp.Choices[0].Message.Content)
+			continue
+		}
+		var content strings.Builder
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok || data == "[DONE]" {
+				continue
+			}
+			var chunk struct {
+				Choices []struct {
+					Delta struct{ Content string } `json:"delta"`
+				} `json:"choices"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+			if len(chunk.Choices) > 0 {
+				content.WriteString(chunk.Choices[0].Delta.Content)
+			}
+		}
+		assert.Equal(t, want, content.String())
+	}
+}
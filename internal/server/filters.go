@@ -0,0 +1,54 @@
+package server
+
+import (
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/service/filter"
+)
+
+// finish_reason of a reply an abort filter cut short, as openai names it
+const finishContentFilter = "content_filter"
+
+// replyFilter runs the content and reasoning deltas of one streamed reply
+// through the response filters. once either side hits an abort pattern the
+// reply is over and nothing more comes out
+type replyFilter struct {
+	content, reasoning *filter.Stream
+	aborted            bool
+}
+
+func newReplyFilter(cfg *config.Config) *replyFilter {
+	// validate compiled the patterns already
+	f, _ := filter.New(cfg.Filters)
+	return &replyFilter{content: f.Stream(), reasoning: f.Stream()}
+}
+
+// Write returns what of the deltas can be sent now
+func (r *replyFilter) Write(content, reasoning string) (string, string) {
+	if r.aborted {
+		return "", ""
+	}
+	content, cut := r.content.Write(content)
+	reasoning, thoughtCut := r.reasoning.Write(reasoning)
+	r.aborted = cut || thoughtCut
+	return content, reasoning
+}
+
+// Flush returns the held back text once upstream is done
+func (r *replyFilter) Flush() (string, string) {
+	if r.aborted {
+		return "", ""
+	}
+	return r.content.Flush(), r.reasoning.Flush()
+}
+
+// filterReply filters a complete reply, true when an abort pattern cut it
+func filterReply(cfg *config.Config, content, reasoning string) (string, string, bool) {
+	f, _ := filter.New(cfg.Filters)
+	reasoning, cut := f.Apply(reasoning)
+	if cut {
+		// reasoning comes first, a stream would have ended before the answer
+		return "", reasoning, true
+	}
+	content, cut = f.Apply(content)
+	return content, reasoning, cut
+}
@@ -1,37 +1,111 @@
 package server
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/domain"
-	"github.com/zarazaex69/mo/internal/pkg/browser"
-	"github.com/zarazaex69/mo/internal/pkg/crypto"
+	"github.com/zarazaex69/mo/internal/pkg/jwt"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
-	"github.com/zarazaex69/mo/internal/pkg/tempmail"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
 	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
 	"github.com/zarazaex69/mo/internal/pkg/utils"
 	"github.com/zarazaex69/mo/internal/pkg/validator"
 	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/provider/openai"
 	"github.com/zarazaex69/mo/internal/provider/qwen"
 	"github.com/zarazaex69/mo/internal/provider/zlm"
+	"github.com/zarazaex69/mo/internal/service/auth"
+	"github.com/zarazaex69/mo/internal/service/conversation"
+	"github.com/zarazaex69/mo/internal/service/drift"
+	"github.com/zarazaex69/mo/internal/service/feversion"
+	"github.com/zarazaex69/mo/internal/service/files"
+	"github.com/zarazaex69/mo/internal/service/hooks"
+	"github.com/zarazaex69/mo/internal/service/models"
+	"github.com/zarazaex69/mo/internal/service/usage"
 )
 
-func ChatCompletions(cfg *config.Config, providers []provider.Provider, tokenizer utils.Tokener) http.HandlerFunc {
+func ChatCompletions(configs config.Provider, providers *provider.Registry, catalog *models.Catalog, tokenizer utils.Tokener, conversations *conversation.Map) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := configs.ForKey(bearerKey(r))
+		if cfg.Limits.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.Limits.MaxBodyBytes))
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeAPIErr(w, domain.NewAPIError(http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)).WithCode("request_too_large"))
+				return
+			}
+			writeErr(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+
 		var req domain.ChatRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if err := json.Unmarshal(body, &req); err != nil {
 			writeErr(w, http.StatusBadRequest, "invalid json")
 			return
 		}
 
+		if compatProfile(r.Context()) == compatStrict {
+			if apiErr := strictRequest(body); apiErr != nil {
+				writeAPIErr(w, apiErr)
+				return
+			}
+		}
+
 		if err := validator.Validate(&req); err != nil {
-			writeErr(w, http.StatusBadRequest, err.Error())
+			apiErr := domain.NewAPIError(http.StatusBadRequest, err.Error())
+			var verr *validator.Error
+			if errors.As(err, &verr) {
+				apiErr.WithParam(verr.Param)
+			}
+			writeAPIErr(w, apiErr)
+			return
+		}
+
+		if apiErr := checkLimits(&req, cfg.Limits); apiErr != nil {
+			writeAPIErr(w, apiErr)
+			return
+		}
+		if apiErr := checkFiles(&req); apiErr != nil {
+			writeAPIErr(w, apiErr)
+			return
+		}
+		if req.StreamFormat == streamNDJSON {
+			useNDJSON(r.Context())
+		}
+
+		if req.ReasoningFormat != "" {
+			// the formatters keep reasoning apart, reasoningWriter moves it
+			forced := *cfg
+			forced.Model.ThinkMode = "reasoning"
+			cfg = &forced
+		}
+
+		reply, err := runHooks(&req, cfg.Hooks.HookChains)
+		if err != nil {
+			logger.FromContext(r.Context()).Warn().Err(err).Msg("request hook failed")
+			writeAPIErr(w, hookAPIError(err))
 			return
 		}
 
@@ -39,295 +113,706 @@ func ChatCompletions(cfg *config.Config, providers []provider.Provider, tokenize
 			req.Model = cfg.Model.Default
 		}
 
-		var p provider.Provider
-		for _, prov := range providers {
-			if prov.SupportsModel(req.Model) {
-				p = prov
-				break
-			}
+		if catalog.Broken(req.Model) {
+			writeErr(w, http.StatusServiceUnavailable, fmt.Sprintf("model %s is no longer available upstream", req.Model))
+			return
 		}
+		requested := req.Model
+		req.Model = catalog.Resolve(req.Model)
 
+		p, usable := providers.Find(req.Model)
 		if p == nil {
-			writeErr(w, http.StatusBadRequest, "unsupported model")
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "unsupported model").
+				WithParam("model").WithCode("model_not_found"))
+			return
+		}
+		if !usable {
+			writeErr(w, http.StatusServiceUnavailable, fmt.Sprintf("provider %s has no usable credentials", p.Name()))
 			return
 		}
+		if apiErr := routeImages(r.Context(), &req, p); apiErr != nil {
+			writeAPIErr(w, apiErr)
+			return
+		}
+		if apiErr := transcribeAudio(r.Context(), &req, p, cfg.Audio); apiErr != nil {
+			writeAPIErr(w, apiErr)
+			return
+		}
+		// request > models profile > global default
+		cfg = applyProfile(&req, cfg)
 
-		chatID := utils.GenerateRequestID()
+		if mode := injectSystemPrompt(&req, cfg.Model.SystemPrompts, requested); mode != "" {
+			logger.FromContext(r.Context()).Info().Str("model", requested).Str("mode", mode).Msg("system prompt injected")
+		}
 
-		logger.Info().
-			Str("provider", p.Name()).
-			Str("model", req.Model).
+		window, ok := cfg.Limits.ContextTokens[requested]
+		if !ok {
+			window = cfg.Limits.ContextTokens[req.Model]
+		}
+		dropped, apiErr := fitContext(&req, window, tokenizer, cfg.Tokenizer.ImageTokens)
+		if apiErr != nil {
+			writeAPIErr(w, apiErr)
+			return
+		}
+		if dropped > 0 {
+			w.Header().Set(headerTruncated, strconv.Itoa(dropped))
+		}
+
+		chatID := conversations.ChatID(req.Conversation())
+		// one id for the whole reply, every chunk and the logs carry it
+		id := utils.GenerateChatCompletionID()
+
+		ctx := logger.WithContext(r.Context(), map[string]string{"provider": p.Name(), "model": req.Model, "completion_id": id})
+		logger.FromContext(ctx).Info().
+			Str("conversation", req.Conversation()).
 			Bool("stream", req.Stream).
 			Int("messages", len(req.Messages)).
+			Int("truncated", dropped).
 			Msg("chat request")
 
-		resp, err := p.SendChatRequest(&req, chatID)
+		bill := &billing{
+			// taken before sending, a refresh or failover may switch tokens later
+			who:       usage.Entry{Provider: p.Name(), TokenID: provider.TokenID(p), APIKey: bearerKey(r)},
+			budget:    tokenBudget(r.Context()),
+			tokenizer: tokenizer,
+		}
+
+		t := newTiming(r, cfg)
+		resp, err := p.SendChatRequest(ctx, &req, chatID)
 		if err != nil {
-			logger.Error().Err(err).Msg("request failed")
-			writeErr(w, http.StatusInternalServerError, "failed to process request")
+			logger.FromContext(ctx).Error().Err(err).Msg("request failed")
+			writeAPIErr(w, upstreamAPIError(err))
 			return
 		}
+		t.upstream()
+		if req.Stream {
+			releaseSlot(ctx)
+		}
 
-		switch p.Name() {
-		case "qwen":
+		if req.ReasoningFormat != "" && req.ReasoningFormat != reasoningDeepseek {
+			rw := newReasoningWriter(w, req.ReasoningFormat)
+			defer rw.finish()
+			w = rw
+		}
+
+		switch {
+		case provider.RepliesOpenAI(p):
 			if req.Stream {
-				qwenStreamResponse(w, resp, &req, tokenizer)
+				openaiStreamResponse(ctx, w, resp, &req, id, cfg, tokenizer, reply, bill, t)
 			} else {
-				qwenNonStreamResponse(w, resp, &req, tokenizer)
+				openaiNonStreamResponse(ctx, w, resp, &req, id, cfg, tokenizer, reply, bill, t)
 			}
 		default:
+			// z.ai's file links, openai upstreams have none of those
+			links := files.NewLinks(cfg, publicBase(cfg, r))
 			if req.Stream {
-				zlmStreamResponse(w, resp, &req, cfg, tokenizer)
+				zlmStreamResponse(ctx, w, resp, &req, id, cfg, tokenizer, reply, links, bill, t)
 			} else {
-				zlmNonStreamResponse(w, resp, &req, cfg, tokenizer)
+				zlmNonStreamResponse(ctx, w, resp, &req, id, cfg, tokenizer, reply, links, p, bill, t)
 			}
 		}
 	}
 }
 
-func zlmStreamResponse(w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, cfg *config.Config, tokenizer utils.Tokener) {
-	flusher, ok := w.(http.Flusher)
+func zlmStreamResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, id string, cfg *config.Config, tokenizer utils.Tokener, reply hooks.ResponseHook, links *files.Links, bill *billing, t *timing) {
+	t.declareTrailers(w)
+	sse, ok := newSSEWriter(w, cfg.Server)
 	if !ok {
 		writeErr(w, http.StatusInternalServerError, "streaming not supported")
 		return
 	}
+	defer sse.Done()
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	var parts []string
-	var toolCallBuffer string
+	var parts, thoughts []string
 	var pendingToolCall *domain.ToolCall
+	var dropped []domain.ToolCall
+	var answer strings.Builder
 	includeUsage := req.StreamOpts != nil && req.StreamOpts.IncludeUsage
 
-	promptTokens := 0
-	if includeUsage {
-		promptTokens = zlm.CountTokens(req.Messages, tokenizer)
-	}
+	promptTokens := utils.CountChatTokens(tokenizer, req, cfg.Tokenizer.ImageTokens)
 
+	var streamErr error
 	fmtr := zlm.NewFormatter(cfg)
-	for zaiResp := range zlm.ParseSSEStream(resp) {
+	hooked := hooks.NewStream(reply)
+	echo := newEchoTrim(req.Prefill())
+	filtered := newReplyFilter(cfg)
+	capped := newReplyCap(cfg, tokenizer, t.start)
+	events := zlm.ParseSSEStream(ctx, resp, cfg.Upstream.IdleTimeout)
+	for zaiResp := range events {
+		if zaiResp.Err != nil {
+			streamErr = zaiResp.Err
+			break
+		}
+		if capped.over() || abandoned(sse, cfg) {
+			break
+		}
+
 		delta := fmtr.Format(zaiResp)
 		if delta == nil {
 			continue
 		}
+		t.delta()
+		capped.delta(delta)
+
+		if c, ok := delta["content"].(string); ok {
+			parts = append(parts, c)
+			bill.flow(c)
+		}
+		if r, ok := delta["reasoning_content"].(string); ok {
+			thoughts = append(thoughts, r)
+			bill.flow(r)
+		}
 
-		if includeUsage {
-			if c, ok := delta["content"].(string); ok {
-				parts = append(parts, c)
+		calls, _ := delta["tool_calls"].([]domain.ToolCall)
+		if req.SingleToolCall() {
+			// one call was asked for, the rest of the reply is drained unseen
+			if pendingToolCall != nil {
+				dropped = append(dropped, calls...)
+				continue
 			}
-			if r, ok := delta["reasoning_content"].(string); ok {
-				parts = append(parts, r)
+			if len(calls) > 1 {
+				dropped = append(dropped, calls[1:]...)
+				calls = calls[:1]
 			}
 		}
-
-		if tc, ok := delta["tool_call"].(string); ok {
-			toolCallBuffer += tc
-
-			if parsed := zlm.ParseToolCall(toolCallBuffer); parsed != nil {
-				pendingToolCall = parsed
-
-				chunk := domain.ChatResponse{
-					ID:      utils.GenerateChatCompletionID(),
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   req.Model,
-					Choices: []domain.Choice{{
-						Index: 0,
-						Delta: &domain.ResponseMessage{
-							Role:      "assistant",
-							ToolCalls: []domain.ToolCall{*parsed},
-						},
-					}},
-				}
-				data, _ := json.Marshal(chunk)
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				flusher.Flush()
-
-				toolCallBuffer = ""
+		for i := range calls {
+			pendingToolCall = &calls[i]
+
+			chunk := domain.ChatResponse{
+				ID:                id,
+				Object:            "chat.completion.chunk",
+				Created:           time.Now().Unix(),
+				Model:             req.Model,
+				SystemFingerprint: systemFingerprint(req.Model),
+				Choices: []domain.Choice{{
+					Index: 0,
+					Delta: &domain.ResponseMessage{
+						Role:      "assistant",
+						ToolCalls: []domain.ToolCall{calls[i]},
+					},
+				}},
 			}
-			continue
+			sse.Chunk(chunk)
 		}
 
+		// a response hook may hold content back until its line is complete,
+		// the start of a reply until it is clear it does not echo the prefill,
+		// links until they are whole and the filters what could be the start
+		// of a match
 		content := getStr(delta, "content")
-		if content != "" {
-			content = zlm.StripToolCallBlock(content)
-		}
+		held := content != ""
+		content, reasoning := filtered.Write(links.Write(hooked.Write(echo.Write(content))), getStr(delta, "reasoning_content"))
+		held = held && content == ""
 
 		msg := &domain.ResponseMessage{
 			Role:             getStr(delta, "role"),
 			Content:          content,
-			ReasoningContent: getStr(delta, "reasoning_content"),
+			ReasoningContent: reasoning,
+		}
+		if s, ok := delta["reasoning_summaries"].([]string); ok && req.ReasoningSummaries {
+			msg.ReasoningSummary = strings.Join(s, "\n")
+		}
+		if ev, ok := delta["upstream_event"].(domain.UpstreamEvent); ok && req.IncludeUpstreamEvents {
+			msg.UpstreamEvents = []domain.UpstreamEvent{ev}
 		}
 
-		if msg.Content == "" && msg.ReasoningContent == "" && msg.Role == "" {
+		if msg.Content == "" && msg.ReasoningContent == "" && msg.ReasoningSummary == "" && len(msg.UpstreamEvents) == 0 && (msg.Role == "" || held) {
+			if filtered.aborted || capped.hit() {
+				break
+			}
 			continue
 		}
+		answer.WriteString(msg.Content)
 
 		chunk := domain.ChatResponse{
-			ID:      utils.GenerateChatCompletionID(),
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   req.Model,
-			Choices: []domain.Choice{{Index: 0, Delta: msg}},
+			ID:                id,
+			Object:            "chat.completion.chunk",
+			Created:           time.Now().Unix(),
+			Model:             req.Model,
+			SystemFingerprint: systemFingerprint(req.Model),
+			Choices:           []domain.Choice{{Index: 0, Delta: msg, Logprobs: logprobsStub(req)}},
+		}
+		sse.Chunk(chunk)
+		if filtered.aborted || capped.hit() {
+			break
 		}
+	}
 
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+	if filtered.aborted || capped.hit() || abandoned(sse, cfg) {
+		// upstream need not write the rest, the parser ends with the body
+		resp.Body.Close()
+		for range events {
+		}
+	}
+	logDroppedClient(ctx, sse, cfg, req.Model)
+	if !filtered.aborted {
+		held := capped.take(fmtr.Flush())
+		if held != "" {
+			parts = append(parts, held)
+			bill.flow(held)
+		}
+		tail, thought := filtered.Write(links.Write(hooked.Write(echo.Write(held)+echo.Flush())+hooked.Flush())+links.Flush(), "")
+		restTail, restThought := filtered.Flush()
+		tail, thought = tail+restTail, thought+restThought
+		if tail != "" || thought != "" {
+			answer.WriteString(tail)
+			sse.Chunk(domain.ChatResponse{
+				ID:                id,
+				Object:            "chat.completion.chunk",
+				Created:           time.Now().Unix(),
+				Model:             req.Model,
+				SystemFingerprint: systemFingerprint(req.Model),
+				Choices:           []domain.Choice{{Index: 0, Delta: &domain.ResponseMessage{Content: tail, ReasoningContent: thought}, Logprobs: logprobsStub(req)}},
+			})
+		}
+	}
+
+	logDroppedCalls(ctx, dropped)
+
+	used := countUsage(tokenizer, promptTokens, strings.Join(parts, ""), strings.Join(thoughts, ""))
+	completionTokens := used.CompletionTokens
+
+	if streamErr != nil {
+		recordUsage(cfg, bill, req.Model, used)
+		sse.Error(streamError(streamErr))
+		return
 	}
 
 	finishReason := "stop"
 	if pendingToolCall != nil {
 		finishReason = "tool_calls"
 	}
+	if capped.hit() {
+		capped.log(ctx, req.Model)
+		if pendingToolCall == nil {
+			finishReason = capped.reason
+		}
+	}
+	if filtered.aborted {
+		finishReason = finishContentFilter
+	}
+
+	// content is already out, only the verdict can still be delivered
+	var formatDetail string
+	if pendingToolCall == nil && !filtered.aborted && !capped.hit() {
+		if _, formatDetail = checkResponseFormat(req.ResponseFormat, answer.String()); formatDetail != "" {
+			finishReason = finishInvalidJSON
+		}
+	}
 
 	stop := domain.ChatResponse{
-		ID:      utils.GenerateChatCompletionID(),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   req.Model,
+		ID:                id,
+		Object:            "chat.completion.chunk",
+		Created:           time.Now().Unix(),
+		Model:             req.Model,
+		SystemFingerprint: systemFingerprint(req.Model),
 		Choices: []domain.Choice{{
 			Index:        0,
 			Delta:        &domain.ResponseMessage{Role: "assistant"},
 			FinishReason: strPtr(finishReason),
 		}},
 	}
-	data, _ := json.Marshal(stop)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	flusher.Flush()
+	sse.Finish(stop)
 
-	if includeUsage {
-		text := strings.Join(parts, "")
-		completionTokens := tokenizer.Count(text)
+	if formatDetail != "" {
+		sse.Trailer(formatWarning(formatDetail))
+	}
+
+	mo := recordUsage(cfg, bill, req.Model, used)
 
+	if includeUsage {
 		usage := domain.ChatResponse{
-			ID:      utils.GenerateChatCompletionID(),
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   req.Model,
-			Choices: []domain.Choice{},
-			Usage: &domain.Usage{
-				PromptTokens:     promptTokens,
-				CompletionTokens: completionTokens,
-				TotalTokens:      promptTokens + completionTokens,
-			},
-		}
-		data, _ := json.Marshal(usage)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+			ID:                id,
+			Object:            "chat.completion.chunk",
+			Created:           time.Now().Unix(),
+			Model:             req.Model,
+			SystemFingerprint: systemFingerprint(req.Model),
+			Choices:           []domain.Choice{},
+			Usage:             used,
+			Mo:                mo,
+		}
+		sse.Trailer(usage)
 	}
+	t.finishStream(w, sse, id, req.Model, completionTokens)
+}
 
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+type zlmResult struct {
+	content   string
+	reasoning string
+	summaries []string
+	events    []domain.UpstreamEvent
+	toolCalls []domain.ToolCall
+	// upstream signalled done, false when the stream was cut
+	complete bool
+	// set while a tool call block was still being received
+	partialTool bool
+	// finish_reason when the caps cut the reply, "" otherwise
+	capped string
+	// why the stream ended early, nil when it simply closed
+	err error
+	// how much had come when the first tool call did
+	firstCall *zlmMark
+	// what firstCallOnly took off, upstream still generated it
+	drainedContent, drainedReasoning string
 }
 
-func zlmNonStreamResponse(w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, cfg *config.Config, tokenizer utils.Tokener) {
+// zlmMark is how far the content, reasoning, summaries and events of a result had come
+type zlmMark struct {
+	content, reasoning, summaries, events int
+}
+
+// firstCallOnly trims the reply to what came up to its first tool call, as
+// the stream drains the rest when one call was asked for
+func (r *zlmResult) firstCallOnly() (dropped []domain.ToolCall) {
+	if r.firstCall == nil || len(r.toolCalls) < 2 {
+		return nil
+	}
+	m := r.firstCall
+	dropped = r.toolCalls[1:]
+	r.toolCalls = r.toolCalls[:1]
+	r.content, r.drainedContent = r.content[:m.content], r.content[m.content:]
+	r.reasoning, r.drainedReasoning = r.reasoning[:m.reasoning], r.reasoning[m.reasoning:]
+	r.summaries = r.summaries[:m.summaries]
+	r.events = r.events[:m.events]
+	return dropped
+}
+
+// reasoningOnly reports the upstream bug where the model thinks but never answers
+func (r *zlmResult) reasoningOnly() bool {
+	return r.content == "" && r.reasoning != "" && len(r.toolCalls) == 0
+}
+
+func collectZlmResponse(ctx context.Context, resp *http.Response, cfg *config.Config, t *timing, capped *replyCap) *zlmResult {
 	var contentParts []string
 	var reasoningParts []string
-	var toolCallBuffer string
+	var summaries []string
+	var events []domain.UpstreamEvent
 	var toolCalls []domain.ToolCall
+	var firstCall *zlmMark
+	var done bool
+	var streamErr error
 
 	fmtr := zlm.NewFormatter(cfg)
-	for zaiResp := range zlm.ParseSSEStream(resp) {
+	upstream := zlm.ParseSSEStream(ctx, resp, cfg.Upstream.IdleTimeout)
+	for zaiResp := range upstream {
+		if zaiResp.Err != nil {
+			streamErr = zaiResp.Err
+			break
+		}
+		if capped.over() {
+			break
+		}
+		if zaiResp.Data != nil && zaiResp.Data.Done {
+			done = true
+		}
+
 		delta := fmtr.Format(zaiResp)
 		if delta == nil {
 			continue
 		}
+		t.delta()
+		capped.delta(delta)
 
 		if c, ok := delta["content"].(string); ok {
-			c = zlm.StripToolCallBlock(c)
-			if c != "" {
-				contentParts = append(contentParts, c)
-			}
+			contentParts = append(contentParts, c)
 		}
 		if r, ok := delta["reasoning_content"].(string); ok {
 			reasoningParts = append(reasoningParts, r)
 		}
-		if tc, ok := delta["tool_call"].(string); ok {
-			toolCallBuffer += tc
+		if s, ok := delta["reasoning_summaries"].([]string); ok {
+			summaries = append(summaries, s...)
+		}
+		if ev, ok := delta["upstream_event"].(domain.UpstreamEvent); ok {
+			events = appendEvent(events, ev)
+		}
+		if calls, ok := delta["tool_calls"].([]domain.ToolCall); ok {
+			if len(toolCalls) == 0 && len(calls) > 0 {
+				firstCall = &zlmMark{
+					content:   len(strings.Join(contentParts, "")),
+					reasoning: len(strings.Join(reasoningParts, "")),
+					summaries: len(summaries),
+					events:    len(events),
+				}
+			}
+			toolCalls = append(toolCalls, calls...)
 		}
 
-		if zaiResp.Data != nil && zaiResp.Data.Done {
+		if done || capped.hit() {
 			break
 		}
 	}
 
-	if toolCallBuffer != "" {
-		if parsed := zlm.ParseToolCall(toolCallBuffer); parsed != nil {
-			toolCalls = append(toolCalls, *parsed)
+	if capped.hit() {
+		resp.Body.Close()
+		for range upstream {
 		}
 	}
+	contentParts = append(contentParts, capped.take(fmtr.Flush()))
 
-	msg := &domain.ResponseMessage{Role: "assistant"}
+	var cappedReason string
+	if capped.hit() {
+		cappedReason = capped.reason
+	}
+	return &zlmResult{
+		content:     strings.Join(contentParts, ""),
+		reasoning:   strings.Join(reasoningParts, ""),
+		summaries:   summaries,
+		events:      events,
+		toolCalls:   toolCalls,
+		complete:    done,
+		partialTool: fmtr.PartialToolCall(),
+		capped:      cappedReason,
+		err:         streamErr,
+		firstCall:   firstCall,
+	}
+}
 
-	completionText := ""
-	if len(reasoningParts) > 0 {
-		reasoning := strings.Join(reasoningParts, "")
-		msg.ReasoningContent = reasoning
-		completionText += reasoning
+func zlmNonStreamResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, id string, cfg *config.Config, tokenizer utils.Tokener, reply hooks.ResponseHook, links *files.Links, p provider.Provider, bill *billing, t *timing) {
+	capped := newReplyCap(cfg, tokenizer, t.start)
+	result := collectZlmResponse(ctx, resp, cfg, t, capped)
+	if req.SingleToolCall() {
+		logDroppedCalls(ctx, result.firstCallOnly())
 	}
-	if len(contentParts) > 0 {
-		content := strings.Join(contentParts, "")
-		msg.Content = content
-		completionText += content
+
+	// a reply cut mid-way is continued rather than thrown away
+	var resumePrompt int
+	attempts := 1
+	if !result.complete && cfg.Model.ResumePartial && resumable(req, result) {
+		if resumed, prompt := resumePartial(ctx, req, cfg, p, result, tokenizer); resumed != nil {
+			result, resumePrompt, attempts = resumed, prompt, 2
+		}
 	}
-	if len(toolCalls) > 0 {
-		msg.ToolCalls = toolCalls
-		msg.Content = ""
+
+	// a broken off reply is incomplete, passing it off as finished would lie
+	if result.err != nil {
+		writeAPIErr(w, streamError(result.err))
+		return
 	}
 
 	finishReason := "stop"
-	if len(toolCalls) > 0 {
+	if len(result.toolCalls) > 0 {
 		finishReason = "tool_calls"
 	}
+	if result.capped != "" {
+		capped.log(ctx, req.Model)
+		if len(result.toolCalls) == 0 {
+			finishReason = result.capped
+		}
+	}
+
+	// a reply capped while thinking has not failed to answer
+	if result.reasoningOnly() && result.capped == "" {
+		metrics.Inc("reasoning_only_completions", req.Model)
+		logger.FromContext(ctx).Warn().
+			Str("policy", cfg.Model.ReasoningOnly).
+			Msg("completion has reasoning but no content")
+
+		switch cfg.Model.ReasoningOnly {
+		case "retry":
+			if retried := retryWithoutThinking(ctx, req, cfg, p); retried != nil && retried.content != "" {
+				result = retried
+				break
+			}
+			w.Header().Set("X-Mo-Warning", "reasoning-only")
+			finishReason = "reasoning_only"
+		case "promote":
+			result.content = "[from reasoning] " + lastParagraph(result.reasoning)
+		default:
+			w.Header().Set("X-Mo-Warning", "reasoning-only")
+			finishReason = "reasoning_only"
+		}
+	}
+
+	result.content = trimEcho(req.Prefill(), result.content)
+
+	var formatDetail string
+	if req.ResponseFormat.WantsJSON() && len(result.toolCalls) == 0 && result.capped == "" {
+		var content string
+		content, formatDetail = checkResponseFormat(req.ResponseFormat, result.content)
+		if formatDetail != "" && cfg.Model.JSONRetry {
+			if retried := retryForFormat(ctx, req, cfg, p, result.content, formatDetail); retried != nil {
+				if c, d := checkResponseFormat(req.ResponseFormat, retried.content); d == "" {
+					retried.reasoning = result.reasoning + retried.reasoning
+					retried.summaries = append(result.summaries, retried.summaries...)
+					retried.events = append(result.events, retried.events...)
+					result, content, formatDetail = retried, c, ""
+				}
+			}
+		}
+		result.content = content
+
+		if formatDetail != "" {
+			logger.FromContext(ctx).Warn().Str("detail", formatDetail).Msg("reply violates response_format")
+			w.Header().Set("X-Mo-Warning", "invalid-json")
+			finishReason = finishInvalidJSON
+		}
+	}
+
+	if reply != nil {
+		result.content = reply(result.content)
+	}
+	result.content = links.Rewrite(result.content)
+
+	// usage still counts what upstream generated
+	content, reasoning, cut := filterReply(cfg, result.content, result.reasoning)
+	if cut {
+		finishReason = finishContentFilter
+	}
+
+	msg := &domain.ResponseMessage{
+		Role:             "assistant",
+		Content:          content,
+		ReasoningContent: reasoning,
+	}
+	if req.ReasoningSummaries {
+		msg.ReasoningSummaries = result.summaries
+	}
+	if req.IncludeUpstreamEvents {
+		msg.UpstreamEvents = result.events
+	}
+	if len(result.toolCalls) > 0 {
+		msg.ToolCalls = result.toolCalls
+		msg.Content = ""
+	}
 
 	response := domain.ChatResponse{
-		ID:      utils.GenerateChatCompletionID(),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   req.Model,
+		ID:                id,
+		Object:            "chat.completion",
+		Created:           time.Now().Unix(),
+		Model:             req.Model,
+		SystemFingerprint: systemFingerprint(req.Model),
 		Choices: []domain.Choice{{
 			Index:        0,
 			Message:      msg,
 			FinishReason: strPtr(finishReason),
+			Logprobs:     logprobsStub(req),
 		}},
+		Warning: formatDetail,
 	}
 
-	promptTokens := zlm.CountTokens(req.Messages, tokenizer)
-	completionTokens := tokenizer.Count(completionText)
-	response.Usage = &domain.Usage{
-		PromptTokens:     promptTokens,
-		CompletionTokens: completionTokens,
-		TotalTokens:      promptTokens + completionTokens,
+	promptTokens := utils.CountChatTokens(tokenizer, req, cfg.Tokenizer.ImageTokens) + resumePrompt
+	response.Usage = countUsage(tokenizer, promptTokens, result.content+result.drainedContent, result.reasoning+result.drainedReasoning)
+	completionTokens := response.Usage.CompletionTokens
+	if attempts > 1 {
+		response.Usage.Attempts = attempts
+	}
+	response.Mo = recordUsage(cfg, bill, req.Model, response.Usage)
+	if tm := t.done(req.Model, completionTokens); t.expose {
+		setTimingHeaders(w.Header(), tm)
+		response.Timings = tm
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func qwenStreamResponse(w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, tokenizer utils.Tokener) {
-	flusher, ok := w.(http.Flusher)
+// abandoned reports a dropped client whose reply need not be read to the end
+func abandoned(sse *sseWriter, cfg *config.Config) bool {
+	return !cfg.Server.StreamDrainDropped && sse.Dropped() != nil
+}
+
+// logDroppedClient notes a client the stream gave up on, with drain on the
+// whole reply was still read for log.raw_file
+func logDroppedClient(ctx context.Context, sse *sseWriter, cfg *config.Config, model string) {
+	err := sse.Dropped()
+	if err == nil {
+		return
+	}
+	metrics.Inc("dropped_streams", model)
+	logger.FromContext(ctx).Warn().Err(err).
+		Bool("drained", cfg.Server.StreamDrainDropped).
+		Msg("client dropped from the stream")
+}
+
+// logDroppedCalls notes calls cut by parallel_tool_calls: false
+func logDroppedCalls(ctx context.Context, dropped []domain.ToolCall) {
+	if len(dropped) == 0 {
+		return
+	}
+	names := make([]string, len(dropped))
+	for i, c := range dropped {
+		names[i] = c.Function.Name
+	}
+	logger.FromContext(ctx).Debug().Strs("dropped", names).Msg("parallel_tool_calls is false, extra tool calls dropped")
+}
+
+// appendEvent joins fragments of the same phase into one event
+func appendEvent(events []domain.UpstreamEvent, ev domain.UpstreamEvent) []domain.UpstreamEvent {
+	if n := len(events); n > 0 && events[n-1].Phase == ev.Phase {
+		events[n-1].Content += ev.Content
+		return events
+	}
+	return append(events, ev)
+}
+
+func retryWithoutThinking(ctx context.Context, req *domain.ChatRequest, cfg *config.Config, p provider.Provider) *zlmResult {
+	retry := *req
+	retry.Thinking = new(bool)
+
+	resp, err := p.SendChatRequest(ctx, &retry, utils.GenerateRequestID())
+	if err != nil {
+		logger.FromContext(ctx).Warn().Err(err).Msg("reasoning-only retry failed")
+		return nil
+	}
+	defer resp.Body.Close()
+
+	return collectZlmResponse(ctx, resp, cfg, nil, nil)
+}
+
+func lastParagraph(text string) string {
+	paragraphs := strings.Split(strings.TrimSpace(text), "\n\n")
+	for i := len(paragraphs) - 1; i >= 0; i-- {
+		if p := strings.TrimSpace(paragraphs[i]); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// openaiStreamResponse relays a stream of openai chunks, qwen's or those
+// of an openai compatible upstream
+func openaiStreamResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, id string, cfg *config.Config, tokenizer utils.Tokener, reply hooks.ResponseHook, bill *billing, t *timing) {
+	t.declareTrailers(w)
+	sse, ok := newSSEWriter(w, cfg.Server)
 	if !ok {
 		writeErr(w, http.StatusInternalServerError, "streaming not supported")
 		return
 	}
+	defer sse.Done()
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	var parts []string
+	var parts, thoughts []string
 	var lastFinishReason string
+	var answer strings.Builder
+	var calls qwen.ToolCallDeltas
+	// what qwen counted, sent after the last choice
+	var upstreamUsage *domain.Usage
 	includeUsage := req.StreamOpts != nil && req.StreamOpts.IncludeUsage
-
-	for qwenResp := range qwen.ParseSSEStream(resp) {
+	hooked := hooks.NewStream(reply)
+	filtered := newReplyFilter(cfg)
+	capped := newReplyCap(cfg, tokenizer, t.start)
+
+	events := qwen.ParseSSEStream(ctx, resp)
+	for qwenResp := range events {
+		// past the finish only the usage is still to come
+		if (lastFinishReason == "" && capped.over()) || abandoned(sse, cfg) {
+			break
+		}
+		if qwenResp.Usage != nil {
+			upstreamUsage = qwenResp.Usage
+		}
 		if len(qwenResp.Choices) == 0 {
 			continue
 		}
 
 		choice := qwenResp.Choices[0]
+		if choice.FinishReason != nil {
+			reason := qwen.FinishReason(*choice.FinishReason)
+			// qwen may end a turn of tool calls with stop
+			if len(calls.Calls()) > 0 || (choice.Delta != nil && len(choice.Delta.ToolCalls) > 0) {
+				reason = "tool_calls"
+			}
+			choice.FinishReason = &reason
+		}
 		if choice.Delta == nil {
 			if choice.FinishReason != nil {
 				lastFinishReason = *choice.FinishReason
@@ -335,22 +820,64 @@ func qwenStreamResponse(w http.ResponseWriter, resp *http.Response, req *domain.
 			continue
 		}
 
-		if includeUsage && choice.Delta.Content != "" {
+		if choice.Delta.Content != "" || choice.Delta.ReasoningContent != "" || len(choice.Delta.ToolCalls) > 0 {
+			t.delta()
+		}
+		choice.Delta.ReasoningContent = capped.take(choice.Delta.ReasoningContent)
+		choice.Delta.Content = capped.take(choice.Delta.Content)
+		if choice.Delta.Content != "" {
 			parts = append(parts, choice.Delta.Content)
+			bill.flow(choice.Delta.Content)
+		}
+		if choice.Delta.ReasoningContent != "" {
+			thoughts = append(thoughts, choice.Delta.ReasoningContent)
+			bill.flow(choice.Delta.ReasoningContent)
+		}
+		calls.Add(choice.Delta.ToolCalls)
+		content := hooked.Write(choice.Delta.Content)
+		if choice.FinishReason != nil || capped.hit() {
+			content += hooked.Flush()
+		}
+		content, reasoning := filtered.Write(content, choice.Delta.ReasoningContent)
+		if choice.FinishReason != nil || capped.hit() {
+			tail, thought := filtered.Flush()
+			content, reasoning = content+tail, reasoning+thought
+		}
+		answer.WriteString(content)
+
+		// hold back the finish chunk until json mode output is checked
+		if choice.FinishReason != nil && req.ResponseFormat.WantsJSON() {
+			lastFinishReason = *choice.FinishReason
+			choice.FinishReason = nil
+		}
+		if capped.hit() {
+			choice.FinishReason = &capped.reason
+		}
+		if filtered.aborted {
+			reason := finishContentFilter
+			choice.FinishReason = &reason
+		}
+		// a response hook or filter is holding the content back, there is nothing to send
+		if (choice.Delta.Content != "" || choice.Delta.ReasoningContent != "") && content == "" && reasoning == "" &&
+			len(choice.Delta.ToolCalls) == 0 && choice.FinishReason == nil {
+			continue
 		}
 
 		chunk := domain.ChatResponse{
-			ID:      qwenResp.ID,
-			Object:  "chat.completion.chunk",
-			Created: qwenResp.Created,
-			Model:   req.Model,
+			ID:                id,
+			Object:            "chat.completion.chunk",
+			Created:           qwenResp.Created,
+			Model:             req.Model,
+			SystemFingerprint: systemFingerprint(req.Model),
 			Choices: []domain.Choice{{
 				Index: 0,
 				Delta: &domain.ResponseMessage{
-					Role:      choice.Delta.Role,
-					Content:   choice.Delta.Content,
-					ToolCalls: choice.Delta.ToolCalls,
+					Role:             choice.Delta.Role,
+					Content:          content,
+					ReasoningContent: reasoning,
+					ToolCalls:        choice.Delta.ToolCalls,
 				},
+				Logprobs: logprobsStub(req),
 			}},
 		}
 
@@ -358,63 +885,107 @@ func qwenStreamResponse(w http.ResponseWriter, resp *http.Response, req *domain.
 			lastFinishReason = *choice.FinishReason
 			chunk.Choices[0].FinishReason = choice.FinishReason
 		}
+		sse.Chunk(chunk)
+		if filtered.aborted || capped.hit() {
+			break
+		}
+	}
 
-		data, _ := json.Marshal(chunk)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+	if filtered.aborted || capped.hit() || abandoned(sse, cfg) {
+		// upstream need not write the rest, the parser ends with the body
+		resp.Body.Close()
+		for range events {
+		}
+	}
+	logDroppedClient(ctx, sse, cfg, req.Model)
+	if !filtered.aborted {
+		tail, thought := filtered.Write(hooked.Flush(), "")
+		restTail, restThought := filtered.Flush()
+		tail, thought = tail+restTail, thought+restThought
+		if tail != "" || thought != "" {
+			answer.WriteString(tail)
+			sse.Chunk(domain.ChatResponse{
+				ID:                id,
+				Object:            "chat.completion.chunk",
+				Created:           time.Now().Unix(),
+				Model:             req.Model,
+				SystemFingerprint: systemFingerprint(req.Model),
+				Choices:           []domain.Choice{{Index: 0, Delta: &domain.ResponseMessage{Content: tail, ReasoningContent: thought}, Logprobs: logprobsStub(req)}},
+			})
+		}
+		if filtered.aborted {
+			lastFinishReason = finishContentFilter
+		}
+	}
+	if capped.hit() {
+		capped.log(ctx, req.Model)
+		if !filtered.aborted {
+			lastFinishReason = capped.reason
+		}
 	}
 
 	if lastFinishReason == "" {
 		lastFinishReason = "stop"
 	}
 
+	var formatDetail string
+	if lastFinishReason != "tool_calls" && lastFinishReason != finishContentFilter && !capped.hit() {
+		if _, formatDetail = checkResponseFormat(req.ResponseFormat, answer.String()); formatDetail != "" {
+			lastFinishReason = finishInvalidJSON
+		}
+	}
+
 	stop := domain.ChatResponse{
-		ID:      utils.GenerateChatCompletionID(),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   req.Model,
+		ID:                id,
+		Object:            "chat.completion.chunk",
+		Created:           time.Now().Unix(),
+		Model:             req.Model,
+		SystemFingerprint: systemFingerprint(req.Model),
 		Choices: []domain.Choice{{
 			Index:        0,
 			Delta:        &domain.ResponseMessage{},
 			FinishReason: &lastFinishReason,
 		}},
 	}
-	data, _ := json.Marshal(stop)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	flusher.Flush()
+	sse.Finish(stop)
 
-	if includeUsage {
-		text := strings.Join(parts, "")
-		promptTokens := tokenizer.Count(zlm.ExtractTextFromMessages(req.Messages))
-		completionTokens := tokenizer.Count(text)
+	if formatDetail != "" {
+		sse.Trailer(formatWarning(formatDetail))
+	}
 
-		usage := domain.ChatResponse{
-			ID:      utils.GenerateChatCompletionID(),
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   req.Model,
-			Choices: []domain.Choice{},
-			Usage: &domain.Usage{
-				PromptTokens:     promptTokens,
-				CompletionTokens: completionTokens,
-				TotalTokens:      promptTokens + completionTokens,
-			},
-		}
-		data, _ := json.Marshal(usage)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+	used := upstreamUsage
+	if used == nil {
+		used = localUsage(tokenizer, req, cfg, strings.Join(parts, ""), strings.Join(thoughts, ""), calls.Calls())
+	} else {
+		fillDetails(used, tokenizer, strings.Join(thoughts, ""))
 	}
+	completionTokens := used.CompletionTokens
+	mo := recordUsage(cfg, bill, req.Model, used)
 
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	if includeUsage {
+		usage := domain.ChatResponse{
+			ID:                id,
+			Object:            "chat.completion.chunk",
+			Created:           time.Now().Unix(),
+			Model:             req.Model,
+			SystemFingerprint: systemFingerprint(req.Model),
+			Choices:           []domain.Choice{},
+			Usage:             used,
+			Mo:                mo,
+		}
+		sse.Trailer(usage)
+	}
+	t.finishStream(w, sse, id, req.Model, completionTokens)
 }
 
-func qwenNonStreamResponse(w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, tokenizer utils.Tokener) {
-	qwenResp, err := qwen.ParseNonStreamResponse(resp)
+func openaiNonStreamResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, req *domain.ChatRequest, id string, cfg *config.Config, tokenizer utils.Tokener, reply hooks.ResponseHook, bill *billing, t *timing) {
+	qwenResp, err := qwen.ParseNonStreamResponse(ctx, resp)
 	if err != nil {
 		writeErr(w, http.StatusInternalServerError, "failed to parse response")
 		return
 	}
+	// the reply arrives whole, its first token is its last
+	t.delta()
 
 	if len(qwenResp.Choices) == 0 {
 		writeErr(w, http.StatusInternalServerError, "empty response")
@@ -426,215 +997,554 @@ func qwenNonStreamResponse(w http.ResponseWriter, resp *http.Response, req *doma
 
 	if choice.Message != nil {
 		msg.Content = choice.Message.Content
+		msg.ReasoningContent = choice.Message.ReasoningContent
 		msg.ToolCalls = choice.Message.ToolCalls
 	}
+	// the reply is here whole, it is cut to size but not thrown away for being late
+	capped := newReplyCap(cfg, tokenizer, t.start)
+	capped.deadline = time.Time{}
+	msg.ReasoningContent = capped.take(msg.ReasoningContent)
+	msg.Content = capped.take(msg.Content)
+	if reply != nil {
+		msg.Content = reply(msg.Content)
+	}
 
 	finishReason := "stop"
 	if choice.FinishReason != nil {
-		finishReason = *choice.FinishReason
+		finishReason = qwen.FinishReason(*choice.FinishReason)
 	}
 	if len(msg.ToolCalls) > 0 {
 		finishReason = "tool_calls"
 	}
+	if capped.hit() {
+		capped.log(ctx, req.Model)
+		if len(msg.ToolCalls) == 0 {
+			finishReason = capped.reason
+		}
+	}
+
+	var cut bool
+	if msg.Content, msg.ReasoningContent, cut = filterReply(cfg, msg.Content, msg.ReasoningContent); cut {
+		finishReason = finishContentFilter
+	}
+
+	var formatDetail string
+	if len(msg.ToolCalls) == 0 && !cut && !capped.hit() {
+		if msg.Content, formatDetail = checkResponseFormat(req.ResponseFormat, msg.Content); formatDetail != "" {
+			w.Header().Set("X-Mo-Warning", "invalid-json")
+			finishReason = finishInvalidJSON
+		}
+	}
 
 	response := domain.ChatResponse{
-		ID:      qwenResp.ID,
-		Object:  "chat.completion",
-		Created: qwenResp.Created,
-		Model:   req.Model,
+		ID:                id,
+		Object:            "chat.completion",
+		Created:           qwenResp.Created,
+		Model:             req.Model,
+		SystemFingerprint: systemFingerprint(req.Model),
 		Choices: []domain.Choice{{
 			Index:        0,
 			Message:      msg,
 			FinishReason: &finishReason,
+			Logprobs:     logprobsStub(req),
 		}},
+		Warning: formatDetail,
 	}
 
 	if qwenResp.Usage != nil {
 		response.Usage = qwenResp.Usage
+		fillDetails(response.Usage, tokenizer, msg.ReasoningContent)
 	} else {
-		promptTokens := tokenizer.Count(zlm.ExtractTextFromMessages(req.Messages))
-		completionTokens := tokenizer.Count(msg.Content)
-		response.Usage = &domain.Usage{
-			PromptTokens:     promptTokens,
-			CompletionTokens: completionTokens,
-			TotalTokens:      promptTokens + completionTokens,
-		}
+		response.Usage = localUsage(tokenizer, req, cfg, msg.Content, msg.ReasoningContent, msg.ToolCalls)
+	}
+	response.Mo = recordUsage(cfg, bill, req.Model, response.Usage)
+	if tm := t.done(req.Model, response.Usage.CompletionTokens); t.expose {
+		setTimingHeaders(w.Header(), tm)
+		response.Timings = tm
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func ListModels(cfg *config.Config, store *tokenstore.Store) http.HandlerFunc {
+// localUsage counts a completion when upstream did not, tool call
+// arguments are completion tokens too
+func localUsage(tokenizer utils.Tokener, req *domain.ChatRequest, cfg *config.Config, content, reasoning string, calls []domain.ToolCall) *domain.Usage {
+	used := countUsage(tokenizer, utils.CountChatTokens(tokenizer, req, cfg.Tokenizer.ImageTokens), content, reasoning)
+	for _, call := range calls {
+		n := tokenizer.Count(call.Function.Name + call.Function.Arguments)
+		used.CompletionTokens += n
+		used.TotalTokens += n
+	}
+	return used
+}
+
+// countUsage counts the answer and the reasoning apart, so the reasoning
+// adds up with the answer to completion_tokens as openai reports it
+func countUsage(tokenizer utils.Tokener, promptTokens int, answer, reasoning string) *domain.Usage {
+	reasoningTokens := tokenizer.Count(reasoning)
+	completionTokens := tokenizer.Count(answer) + reasoningTokens
+	return &domain.Usage{
+		PromptTokens:            promptTokens,
+		CompletionTokens:        completionTokens,
+		TotalTokens:             promptTokens + completionTokens,
+		PromptTokensDetails:     &domain.PromptTokensDetails{},
+		CompletionTokensDetails: &domain.CompletionTokensDetails{ReasoningTokens: reasoningTokens},
+	}
+}
+
+// fillDetails adds the breakdown an upstream usage lacks, reasoning
+// counted here is capped at the completion tokens upstream counted
+func fillDetails(used *domain.Usage, tokenizer utils.Tokener, reasoning string) {
+	if used.PromptTokensDetails == nil {
+		used.PromptTokensDetails = &domain.PromptTokensDetails{}
+	}
+	if used.CompletionTokensDetails == nil {
+		used.CompletionTokensDetails = &domain.CompletionTokensDetails{
+			ReasoningTokens: min(tokenizer.Count(reasoning), used.CompletionTokens),
+		}
+	}
+}
+
+func Root(configs config.Provider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var models []map[string]any
+		cfg := configs.Config()
+		if !cfg.Server.ExposeRootInfo {
+			writeErr(w, http.StatusNotFound, "not found")
+			return
+		}
 
-		qwenModels := []map[string]any{
-			{"id": "coder-model", "object": "model", "created": time.Now().Unix(), "owned_by": "qwen"},
-			{"id": "vision-model", "object": "model", "created": time.Now().Unix(), "owned_by": "qwen"},
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"service": "mo",
+			"version": cfg.Server.Version,
+		})
+	}
+}
+
+// AdminUsage reports usage and estimated cost per model since start. total
+// cost only sums priced models, unpriced_requests shows what it misses.
+// with group_by it reports the daily counters of the journal instead
+func AdminUsage(configs config.Provider, journal *usage.Journal) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("group_by") {
+			dailyUsage(w, r, journal)
+			return
 		}
-		models = append(models, qwenModels...)
 
-		glmToken, _ := store.GetActiveByProvider("glm")
-		if glmToken != nil {
-			url := fmt.Sprintf("%s//%s/api/models", cfg.Upstream.Protocol, cfg.Upstream.Host)
+		byModel := usage.Snapshot()
 
-			req, err := http.NewRequest("GET", url, nil)
-			if err == nil {
-				for k, v := range cfg.GetUpstreamHeaders() {
-					req.Header.Set(k, v)
-				}
-				req.Header.Set("Authorization", "Bearer "+glmToken.Token)
-
-				client := &http.Client{Timeout: 10 * time.Second}
-				resp, err := client.Do(req)
-				if err == nil && resp.StatusCode == http.StatusOK {
-					defer resp.Body.Close()
-
-					var upstream struct {
-						Data []struct {
-							ID   string `json:"id"`
-							Name string `json:"name"`
-						} `json:"data"`
-					}
-					if json.NewDecoder(resp.Body).Decode(&upstream) == nil {
-						for _, m := range upstream.Data {
-							models = append(models, map[string]any{
-								"id":       m.ID,
-								"object":   "model",
-								"created":  time.Now().Unix(),
-								"owned_by": "zhipu",
-							})
-						}
-					}
-				}
+		var total *float64
+		var unpriced int64
+		for _, m := range byModel {
+			unpriced += m.Unpriced
+			if m.Cost == nil {
+				continue
 			}
+			if total == nil {
+				total = new(float64)
+			}
+			*total += *m.Cost
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{
-			"object": "list",
-			"data":   models,
+			"currency":          configs.Config().Pricing.Currency,
+			"total_cost":        total,
+			"unpriced_requests": unpriced,
+			"models":            byModel,
 		})
 	}
 }
 
-func RegisterAccount(store *tokenstore.Store) http.HandlerFunc {
+// dailyUsage answers group_by=token|key|model&period=day, optionally for the
+// utc days from..to (YYYY-MM-DD), today by default
+func dailyUsage(w http.ResponseWriter, r *http.Request, journal *usage.Journal) {
+	q := r.URL.Query()
+	if journal == nil {
+		writeErr(w, http.StatusServiceUnavailable, "usage journal is not enabled")
+		return
+	}
+	if p := q.Get("period"); p != "" && p != "day" {
+		writeErr(w, http.StatusBadRequest, "period must be day")
+		return
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	from, err := time.Parse(time.DateOnly, cmp.Or(q.Get("from"), today))
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "from must be YYYY-MM-DD")
+		return
+	}
+	to, err := time.Parse(time.DateOnly, cmp.Or(q.Get("to"), q.Get("from"), today))
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "to must be YYYY-MM-DD")
+		return
+	}
+	if to.Before(from) || to.Sub(from) > maxUsageDays*24*time.Hour {
+		writeErr(w, http.StatusBadRequest, fmt.Sprintf("from..to must span 1 to %d days", maxUsageDays+1))
+		return
+	}
+
+	groupBy := q.Get("group_by")
+	rows, err := journal.Report(groupBy, from, to)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"group_by": groupBy,
+		"period":   "day",
+		"from":     from.Format(time.DateOnly),
+		"to":       to.Format(time.DateOnly),
+		"usage":    rows,
+	})
+}
+
+// maxUsageDays bounds how far apart from and to of a usage report can be
+const maxUsageDays = 366
+
+// AdminConfig reports the effective configuration, every setting with its
+// source and secrets masked, as mo config check prints it
+func AdminConfig(configs config.Provider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Info().Msg("starting account registration")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"settings": configs.Config().Resolved(),
+		})
+	}
+}
 
-		mail := tempmail.New()
-		email, err := mail.CreateEmail()
+// RefreshFEVersion looks up the current X-FE-Version now instead of
+// waiting for headers.x_fe_version_refresh
+func RefreshFEVersion(d *feversion.Discoverer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := d.Refresh()
 		if err != nil {
-			logger.Error().Err(err).Msg("failed to create temp email")
-			writeErr(w, http.StatusInternalServerError, "failed to create temp email")
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadGateway,
+				fmt.Sprintf("fe version discovery failed, still using %s: %v", res.Previous, err)).
+				WithCode("fe_version_discovery_failed"))
 			return
 		}
-		logger.Info().Str("email", email.Address).Msg("created temp email")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
 
-		password := crypto.GeneratePassword(16)
-		name := strings.Split(email.Address, "@")[0]
+// AdminDrift reports upstream format anomalies per day with the first
+// redacted sample of each, see the drift package
+func AdminDrift() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drift.Snapshot())
+	}
+}
 
-		creds := browser.Credentials{
-			Email:    email.Address,
-			Password: password,
-			Name:     name,
+// Metrics serves counters and gauges in the prometheus text format, as
+// mo_<name>{label="..."}
+func Metrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		counters := metrics.Snapshot()
+		for _, name := range slices.Sorted(maps.Keys(counters)) {
+			fmt.Fprintf(&b, "# TYPE mo_%s counter\n", name)
+			for _, label := range slices.Sorted(maps.Keys(counters[name])) {
+				fmt.Fprintf(&b, "mo_%s{label=%s} %d\n", name, strconv.Quote(label), counters[name][label])
+			}
+		}
+		gauges := metrics.Gauges()
+		for _, name := range slices.Sorted(maps.Keys(gauges)) {
+			fmt.Fprintf(&b, "# TYPE mo_%s gauge\nmo_%s %d\n", name, name, gauges[name])
 		}
 
-		br, err := browser.New(false)
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to start browser")
-			writeErr(w, http.StatusInternalServerError, "failed to start browser")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, b.String())
+	}
+}
+
+// BenchSample serves the operator's bench prompts as jsonl, one
+// {"messages": [...]} per line, the format mo-bench -prompt-file reads.
+// the file is read per request so it can be replaced while running
+func BenchSample(configs config.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := configs.Config().Bench.SampleFile
+		if path == "" {
+			writeErr(w, http.StatusNotFound, "no bench sample configured")
 			return
 		}
-		defer br.Close()
 
-		if _, err := br.RegisterZAI(creds); err != nil {
-			logger.Error().Err(err).Msg("registration failed")
-			writeErr(w, http.StatusInternalServerError, "registration failed: "+err.Error())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Warn().Err(err).Str("path", path).Msg("read bench sample failed")
+			writeErr(w, http.StatusNotFound, "bench sample unavailable")
 			return
 		}
 
-		logger.Info().Msg("waiting for verification email")
+		var out bytes.Buffer
+		skipped := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
 
-		msg, err := mail.WaitForMessage(email.Address, "z.ai", "verify", 2*time.Minute, 3*time.Second)
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to get verification email")
-			writeErr(w, http.StatusInternalServerError, "failed to get verification email")
-			return
+			var sample struct {
+				Messages []domain.Message `json:"messages"`
+			}
+			if err := json.Unmarshal([]byte(line), &sample); err != nil || len(sample.Messages) == 0 {
+				skipped++
+				continue
+			}
+			b, _ := json.Marshal(sample)
+			out.Write(b)
+			out.WriteByte('\n')
+		}
+
+		if skipped > 0 {
+			logger.Warn().Int("skipped", skipped).Str("path", path).Msg("invalid lines in bench sample")
 		}
-		if msg == nil {
-			logger.Error().Msg("verification email not received")
-			writeErr(w, http.StatusInternalServerError, "verification email not received")
+		if out.Len() == 0 {
+			writeErr(w, http.StatusNotFound, "bench sample has no valid prompts")
 			return
 		}
 
-		logger.Info().Str("subject", msg.Subject).Msg("got verification email")
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(out.Bytes())
+	}
+}
 
-		link := tempmail.ExtractVerifyLink(msg.BodyText)
-		if link == "" {
-			link = tempmail.ExtractVerifyLink(msg.BodyHTML)
+func RobotsTxt() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("User-agent: *\nDisallow: /\n"))
+	}
+}
+
+func Favicon() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListModels serves the cached model list, qwen's models when it has
+// credentials, then z.ai's and the configured aliases
+func ListModels(configs config.Provider, providers *provider.Registry, catalog *models.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"object": "list",
+			"data":   modelList(configs.ForKey(bearerKey(r)), providers, catalog),
+		})
+	}
+}
+
+// GetModel serves one entry of the model list
+func GetModel(configs config.Provider, providers *provider.Registry, catalog *models.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		for _, m := range modelList(configs.ForKey(bearerKey(r)), providers, catalog) {
+			if m.ID == id {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(m)
+				return
+			}
 		}
-		if link == "" {
-			logger.Error().Msg("verify link not found in email")
-			writeErr(w, http.StatusInternalServerError, "verify link not found")
-			return
+		writeAPIErr(w, domain.NewAPIError(http.StatusNotFound, fmt.Sprintf("The model '%s' does not exist", id)).
+			WithParam("model").WithCode("model_not_found"))
+	}
+}
+
+func modelList(cfg *config.Config, providers *provider.Registry, catalog *models.Catalog) []models.Model {
+	var list []models.Model
+	if providers.Available("qwen") {
+		for _, id := range qwen.SupportedModels() {
+			list = append(list, models.Model{ID: id, Object: "model", Created: catalog.Created(id), OwnedBy: "qwen"})
+		}
+	}
+	for _, p := range providers.All() {
+		up, ok := p.(*openai.Client)
+		if !ok || !providers.Available(p.Name()) {
+			continue
 		}
+		for _, id := range up.Models() {
+			list = append(list, models.Model{ID: id, Object: "model", Created: catalog.Created(id), OwnedBy: p.Name()})
+		}
+	}
+	list = append(list, catalog.Models()...)
 
-		logger.Info().Str("link", link).Msg("extracted verify link")
+	if cfg.Compat.Profile != compatStrict {
+		for i := range list {
+			list[i].Mo = capabilities(cfg, providers, catalog, list[i].ID)
+		}
+	}
+	return list
+}
 
-		token, err := br.VerifyEmail(link, password)
-		if err != nil {
-			logger.Error().Err(err).Msg("email verification failed")
-			writeErr(w, http.StatusInternalServerError, "verification failed: "+err.Error())
+// capabilities of model, nil when no provider serves it
+func capabilities(cfg *config.Config, providers *provider.Registry, catalog *models.Catalog, model string) *models.Capabilities {
+	target := catalog.Resolve(model)
+	p, _ := providers.Find(target)
+	if p == nil {
+		return nil
+	}
+	window, ok := cfg.Limits.ContextTokens[model]
+	if !ok {
+		window = cfg.Limits.ContextTokens[target]
+	}
+	return &models.Capabilities{
+		Provider:          p.Name(),
+		SupportsTools:     provider.AcceptsTools(p, target),
+		SupportsVision:    provider.ImageModel(p, target) == target,
+		SupportsReasoning: provider.Thinks(p, target),
+		MaxContextTokens:  window,
+	}
+}
+
+// ForgetConversation unpins a conversation, its next request starts a new
+// upstream chat
+func ForgetConversation(conversations *conversation.Map) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if !conversations.Forget(id) {
+			writeAPIErr(w, domain.NewAPIError(http.StatusNotFound, fmt.Sprintf("No conversation '%s'", id)).
+				WithCode("conversation_not_found"))
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-		saved, err := store.Add(email.Address, token)
+func ListTokens(store *tokenstore.Store, journal *usage.Journal) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens, err := store.List()
 		if err != nil {
-			logger.Error().Err(err).Msg("failed to save token")
-			writeErr(w, http.StatusInternalServerError, "failed to save token")
+			writeErr(w, http.StatusInternalServerError, "failed to list tokens")
 			return
 		}
-
-		logger.Info().Str("id", saved.ID).Msg("token saved to store")
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"success": true,
-			"token":   saved,
-		})
+		writeTokens(w, tokens, journal)
 	}
 }
 
-func ListTokens(store *tokenstore.Store) http.HandlerFunc {
+// AddToken stores a z.ai token pasted from a logged in browser session,
+// {"token": "...", "provider": "zai", "email": "optional"}. the token is
+// checked upstream and stored with the account it belongs to
+func AddToken(configs config.Provider, store *tokenstore.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokens, err := store.List()
+		var req struct {
+			Token    string `json:"token"`
+			Provider string `json:"provider"`
+			Email    string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		req.Token = jwt.Normalize(req.Token)
+		if req.Token == "" {
+			writeErr(w, http.StatusBadRequest, "missing token")
+			return
+		}
+		// a malformed or stale token fails here instead of as a 401 later
+		exp, err := jwt.Expiry(req.Token)
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, err.Error()+", paste the token value alone")
+			return
+		}
+		if !exp.IsZero() && exp.Before(time.Now()) {
+			writeErr(w, http.StatusUnprocessableEntity, "token expired at "+exp.UTC().Format(time.RFC3339))
+			return
+		}
+		switch req.Provider {
+		case "", "zai", "glm":
+		default:
+			writeErr(w, http.StatusBadRequest, "unsupported provider "+req.Provider+", only zai tokens can be pasted")
+			return
+		}
+
+		stored, err := store.ListByProvider("glm")
 		if err != nil {
 			writeErr(w, http.StatusInternalServerError, "failed to list tokens")
 			return
 		}
+		for _, t := range stored {
+			if t.Token == req.Token {
+				writeErr(w, http.StatusConflict, "token already stored as "+t.ID)
+				return
+			}
+		}
+
+		cfg := configs.Config()
+		if !tokenstore.ValidateTokenAt(cfg.UpstreamURL("api/v1/folders/"), req.Token) {
+			writeErr(w, http.StatusUnprocessableEntity, "token rejected by z.ai")
+			return
+		}
+
+		// the account only labels the token, a valid token is stored without it
+		var name string
+		if account, err := auth.FetchAccount(cfg, req.Token); err != nil {
+			logger.Warn().Err(err).Msg("fetch account of pasted token")
+		} else {
+			req.Email = cmp.Or(req.Email, account.Email)
+			name = account.Name
+		}
+
+		t, err := store.AddWithProvider("glm", req.Email, req.Token, "", 0)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to save token")
+			return
+		}
+		if name != "" {
+			t.Name = name
+			if err := store.Update(t); err != nil {
+				logger.Warn().Err(err).Str("id", t.ID).Msg("save account name")
+			}
+		}
+		logger.Info().Str("id", t.ID).Str("email", t.Email).Time("expires", exp).Msg("pasted token stored")
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"tokens": tokens,
-		})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
 	}
 }
 
-func ListTokensByProvider(store *tokenstore.Store, prov string) http.HandlerFunc {
+func ListTokensByProvider(store *tokenstore.Store, journal *usage.Journal, prov string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		tokens, err := store.ListByProvider(prov)
 		if err != nil {
 			writeErr(w, http.StatusInternalServerError, "failed to list tokens")
 			return
 		}
+		writeTokens(w, tokens, journal)
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"tokens": tokens,
-		})
+// listedToken is a stored token with what it consumed since it was added
+type listedToken struct {
+	*tokenstore.Token
+	Usage tokenstore.Counts `json:"usage"`
+}
+
+func writeTokens(w http.ResponseWriter, tokens []*tokenstore.Token, journal *usage.Journal) {
+	var totals map[string]tokenstore.Counts
+	if journal != nil {
+		var err error
+		if totals, err = journal.TokenTotals(); err != nil {
+			writeErr(w, http.StatusInternalServerError, "failed to read token usage")
+			return
+		}
 	}
+
+	listed := make([]listedToken, 0, len(tokens))
+	for _, t := range tokens {
+		listed = append(listed, listedToken{Token: t, Usage: usage.TokenTotal(totals, t.Provider, t.ID)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"tokens": listed,
+	})
 }
 
 func RemoveToken(store *tokenstore.Store) http.HandlerFunc {
@@ -702,6 +1612,10 @@ func ValidateTokenByID(store *tokenstore.Store) http.HandlerFunc {
 		case "qwen":
 			valid = !qwen.IsTokenExpired(token.ExpiryDate)
 		}
+		// /health/ready reports it for the active token
+		if err := store.RecordCheck(token.ID, valid); err != nil {
+			logger.Warn().Err(err).Str("id", token.ID).Msg("record token check failed")
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{
@@ -713,139 +1627,113 @@ func ValidateTokenByID(store *tokenstore.Store) http.HandlerFunc {
 	}
 }
 
-func RegisterQwenAccount(store *tokenstore.Store) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Info().Msg("starting qwen account registration")
-
-		mail := tempmail.New()
-		email, err := mail.CreateEmail()
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to create temp email")
-			writeErr(w, http.StatusInternalServerError, "failed to create temp email")
-			return
-		}
-		logger.Info().Str("email", email.Address).Msg("created temp email")
-
-		password := crypto.GeneratePassword(16)
-		name := strings.Split(email.Address, "@")[0]
-
-		br, err := browser.New(false)
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to start browser")
-			writeErr(w, http.StatusInternalServerError, "failed to start browser")
-			return
-		}
-		defer br.Close()
-
-		if err := br.RegisterQwen(email.Address, password, name); err != nil {
-			logger.Error().Err(err).Msg("qwen registration failed")
-			writeErr(w, http.StatusInternalServerError, "registration failed: "+err.Error())
-			return
-		}
-
-		logger.Info().Msg("waiting for activation email")
-
-		msg, err := mail.WaitForMessage(email.Address, "qwen", "active", 2*time.Minute, 3*time.Second)
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to get activation email")
-			writeErr(w, http.StatusInternalServerError, "failed to get activation email")
-			return
-		}
-		if msg == nil {
-			logger.Error().Msg("activation email not received")
-			writeErr(w, http.StatusInternalServerError, "activation email not received")
-			return
-		}
-
-		logger.Info().Str("subject", msg.Subject).Msg("got activation email")
-
-		link := tempmail.ExtractQwenActivationLink(msg.BodyText)
-		if link == "" {
-			link = tempmail.ExtractQwenActivationLink(msg.BodyHTML)
-		}
-		if link == "" {
-			logger.Error().Msg("activation link not found in email")
-			writeErr(w, http.StatusInternalServerError, "activation link not found")
-			return
-		}
-
-		logger.Info().Str("link", link).Msg("extracted activation link")
-
-		if err := br.ActivateQwen(link); err != nil {
-			logger.Error().Err(err).Msg("activation failed")
-			writeErr(w, http.StatusInternalServerError, "activation failed: "+err.Error())
-			return
+func getStr(m map[string]any, key string) string {
+	if v, ok := m[key]; ok {
+		if s, ok := v.(string); ok {
+			return s
 		}
+	}
+	return ""
+}
 
-		logger.Info().Msg("account activated, starting device flow")
-
-		deviceCode, err := qwen.RequestDeviceCode()
-		if err != nil {
-			logger.Error().Err(err).Msg("device code request failed")
-			writeErr(w, http.StatusInternalServerError, "device code failed: "+err.Error())
-			return
-		}
+func writeErr(w http.ResponseWriter, code int, msg string) {
+	writeAPIErr(w, domain.NewAPIError(code, msg))
+}
 
-		logger.Info().Str("url", deviceCode.VerificationURIComplete).Msg("confirming auth")
+func writeAPIErr(w http.ResponseWriter, e *domain.APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(domain.ErrorResponse{Error: e})
+}
 
-		if err := br.ConfirmQwenAuth(deviceCode.VerificationURIComplete); err != nil {
-			logger.Error().Err(err).Msg("auth confirmation failed")
-			writeErr(w, http.StatusInternalServerError, "auth confirmation failed: "+err.Error())
-			return
-		}
+// upstreamAPIError translates a provider error: upstream rate limits pass
+// through as 429, other upstream failures become 502
+func upstreamAPIError(err error) *domain.APIError {
+	// providers reject what they find wrong with the request while formatting it
+	var apiErr *domain.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
 
-		var token *qwen.OAuthToken
-		for range 20 {
-			time.Sleep(3 * time.Second)
-			token, err = qwen.PollForToken(deviceCode.DeviceCode, deviceCode.CodeVerifier)
-			if err != nil {
-				logger.Error().Err(err).Msg("token poll failed")
-				writeErr(w, http.StatusInternalServerError, "token poll failed: "+err.Error())
-				return
-			}
-			if token != nil {
-				break
-			}
-		}
+	var ue *domain.UpstreamError
+	if !errors.As(err, &ue) {
+		return domain.NewAPIError(http.StatusInternalServerError, "failed to process request")
+	}
 
-		if token == nil {
-			logger.Error().Msg("token poll timeout")
-			writeErr(w, http.StatusInternalServerError, "token poll timeout")
-			return
-		}
+	if ue.StatusCode == http.StatusTooManyRequests {
+		return domain.NewAPIError(http.StatusTooManyRequests, "upstream rate limit exceeded").
+			WithCode("rate_limit_exceeded")
+	}
+	return domain.NewAPIError(http.StatusBadGateway, fmt.Sprintf("%s (status %d)", ue.Message, ue.StatusCode)).
+		WithCode(fmt.Sprintf("upstream_%d", ue.StatusCode))
+}
 
-		saved, err := store.AddWithProvider("qwen", email.Address, token.AccessToken, token.RefreshToken, token.ExpiryDate)
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to save token")
-			writeErr(w, http.StatusInternalServerError, "failed to save token")
-			return
-		}
+// runHooks applies the request hooks to req and builds the response hook
+func runHooks(req *domain.ChatRequest, chains config.HookChains) (hooks.ResponseHook, error) {
+	transform, err := hooks.Request(chains.Request)
+	if err != nil {
+		return nil, err
+	}
+	if err := transform(req); err != nil {
+		return nil, err
+	}
+	return hooks.Response(chains.Response)
+}
 
-		logger.Info().Str("id", saved.ID).Msg("qwen token saved")
+// hookAPIError passes on a hook's own rejection, anything else is ours
+func hookAPIError(err error) *domain.APIError {
+	var apiErr *domain.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return domain.NewAPIError(http.StatusInternalServerError, "request hook failed").WithCode("hook_failed")
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{
-			"success": true,
-			"token":   saved,
-		})
+// streamError reports a reply upstream broke off, by going silent or with
+// an error event
+func streamError(err error) *domain.APIError {
+	if errors.Is(err, zlm.ErrUpstreamEvent) {
+		return domain.NewAPIError(http.StatusBadGateway, err.Error()).WithCode("upstream_error")
 	}
+	return domain.NewAPIError(http.StatusGatewayTimeout, err.Error()).WithCode("upstream_timeout")
 }
 
-func getStr(m map[string]any, key string) string {
-	if v, ok := m[key]; ok {
-		if s, ok := v.(string); ok {
-			return s
-		}
+// recordUsage books a completion in the usage ledger and the journal,
+// charges the client budget and returns the cost estimate for extended
+// responses when pricing.in_response is set
+func recordUsage(cfg *config.Config, bill *billing, model string, u *domain.Usage) *domain.MoMeta {
+	cost := usage.Record(cfg.Pricing, model, u)
+	bill.settle(model, u)
+	if !cfg.Pricing.InResponse || cfg.Compat.Profile == compatStrict {
+		return nil
 	}
-	return ""
+	return &domain.MoMeta{Cost: cost, Currency: cfg.Pricing.Currency}
 }
 
-func writeErr(w http.ResponseWriter, code int, msg string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(domain.NewUpstreamError(code, msg))
+// bearerKey is the client api key of the request, "" without one
+func bearerKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+	return ""
 }
 
 func strPtr(s string) *string {
 	return &s
 }
+
+// systemFingerprint identifies the backend a reply came from. upstream
+// exposes none, so it is derived from the model and stable per model
+func systemFingerprint(model string) string {
+	sum := sha256.Sum256([]byte("mo:" + model))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
+
+// logprobsStub answers a logprobs request with an empty list, upstream
+// does not report token probabilities
+func logprobsStub(req *domain.ChatRequest) *domain.Logprobs {
+	if !req.Logprobs {
+		return nil
+	}
+	return &domain.Logprobs{Content: []domain.TokenLogprob{}}
+}
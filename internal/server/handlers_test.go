@@ -2,26 +2,57 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/zarazaex69/mo/internal/config"
 	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/provider/openai"
+	"github.com/zarazaex69/mo/internal/provider/qwen"
+	"github.com/zarazaex69/mo/internal/provider/zlm"
+	"github.com/zarazaex69/mo/internal/service/conversation"
+	"github.com/zarazaex69/mo/internal/service/drift"
+	"github.com/zarazaex69/mo/internal/service/hooks"
+	"github.com/zarazaex69/mo/internal/service/models"
+	"github.com/zarazaex69/mo/internal/service/usage"
 )
 
 type MockAIClient struct {
 	mock.Mock
+	noCreds bool
 }
 
-func (m *MockAIClient) SendChatRequest(req *domain.ChatRequest, chatID string) (*http.Response, error) {
+func (m *MockAIClient) Name() string { return "mock" }
+
+func (m *MockAIClient) SupportsModel(model string) bool { return true }
+
+func (m *MockAIClient) CredentialStatus() provider.CredentialStatus {
+	if m.noCreds {
+		return provider.CredentialStatus{Detail: "no token"}
+	}
+	return provider.CredentialStatus{Present: true, Valid: true, Source: "test"}
+}
+
+// the context is left out of the expectations, tests match on the request
+func (m *MockAIClient) SendChatRequest(_ context.Context, req *domain.ChatRequest, chatID string) (*http.Response, error) {
 	args := m.Called(req, chatID)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -41,6 +72,17 @@ func (m *MockTokener) Count(text string) int {
 	return len(strings.Fields(text))
 }
 
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) domain.APIError {
+	t.Helper()
+
+	var resp struct {
+		Error *domain.APIError `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	require.NotNil(t, resp.Error, w.Body.String())
+	return *resp.Error
+}
+
 func TestChatCompletions(t *testing.T) {
 	cfg := &config.Config{
 		Model: config.ModelConfig{Default: "gpt-4-turbo"},
@@ -59,7 +101,9 @@ func TestChatCompletions(t *testing.T) {
 			setup:      func(m *MockAIClient) {},
 			wantStatus: http.StatusBadRequest,
 			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
-				assert.Contains(t, w.Body.String(), "Invalid JSON request")
+				e := decodeAPIError(t, w)
+				assert.Equal(t, "invalid json", e.Message)
+				assert.Equal(t, "invalid_request_error", e.Type)
 			},
 		},
 		{
@@ -68,7 +112,11 @@ func TestChatCompletions(t *testing.T) {
 			setup:      func(m *MockAIClient) {},
 			wantStatus: http.StatusBadRequest,
 			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
-				assert.Contains(t, w.Body.String(), "validation failed")
+				e := decodeAPIError(t, w)
+				assert.Contains(t, e.Message, "validation failed")
+				assert.Equal(t, "invalid_request_error", e.Type)
+				require.NotNil(t, e.Param)
+				assert.Equal(t, "messages", *e.Param)
 			},
 		},
 		{
@@ -83,7 +131,61 @@ func TestChatCompletions(t *testing.T) {
 			},
 			wantStatus: http.StatusInternalServerError,
 			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
-				assert.Contains(t, w.Body.String(), "Failed to process request")
+				e := decodeAPIError(t, w)
+				assert.Equal(t, "failed to process request", e.Message)
+				assert.Equal(t, "server_error", e.Type)
+			},
+		},
+		{
+			name: "upstream rate limited",
+			body: domain.ChatRequest{
+				Model:    "gpt-4",
+				Messages: []domain.Message{{Role: "user", Content: "Hello"}},
+			},
+			setup: func(m *MockAIClient) {
+				m.On("SendChatRequest", mock.Anything, mock.Anything).
+					Return(nil, domain.NewUpstreamError(http.StatusTooManyRequests, "upstream error"))
+			},
+			wantStatus: http.StatusTooManyRequests,
+			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
+				assert.Equal(t, "rate_limit_exceeded", decodeAPIError(t, w).Type)
+			},
+		},
+		{
+			name: "provider rejects request content",
+			body: domain.ChatRequest{
+				Model:    "gpt-4",
+				Messages: []domain.Message{{Role: "user", Content: "Hello"}},
+			},
+			setup: func(m *MockAIClient) {
+				m.On("SendChatRequest", mock.Anything, mock.Anything).
+					Return(nil, fmt.Errorf("format request: %w", domain.NewAPIError(http.StatusBadRequest, "image https://x/a.png: gone").
+						WithParam("messages[0].content").WithCode("invalid_image_url")))
+			},
+			wantStatus: http.StatusBadRequest,
+			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
+				e := decodeAPIError(t, w)
+				assert.Equal(t, "invalid_request_error", e.Type)
+				assert.Contains(t, e.Message, "https://x/a.png")
+				assert.Equal(t, "invalid_image_url", *e.Code)
+			},
+		},
+		{
+			name: "upstream failure",
+			body: domain.ChatRequest{
+				Model:    "gpt-4",
+				Messages: []domain.Message{{Role: "user", Content: "Hello"}},
+			},
+			setup: func(m *MockAIClient) {
+				m.On("SendChatRequest", mock.Anything, mock.Anything).
+					Return(nil, domain.NewUpstreamError(http.StatusInternalServerError, "upstream error"))
+			},
+			wantStatus: http.StatusBadGateway,
+			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
+				e := decodeAPIError(t, w)
+				assert.Equal(t, "upstream_error", e.Type)
+				require.NotNil(t, e.Code)
+				assert.Equal(t, "upstream_500", *e.Code)
 			},
 		},
 		{
@@ -186,7 +288,7 @@ func TestChatCompletions(t *testing.T) {
 			req.Header.Set("Content-Type", "application/json")
 			w := httptest.NewRecorder()
 
-			handler := ChatCompletions(cfg, mockAI, mockTokenizer)
+			handler := ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, mockTokenizer, nil)
 			handler(w, req)
 
 			assert.Equal(t, tt.wantStatus, w.Code)
@@ -198,3 +300,1676 @@ func TestChatCompletions(t *testing.T) {
 		})
 	}
 }
+
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		name       string
+		expose     bool
+		wantStatus int
+		verify     func(*testing.T, *httptest.ResponseRecorder)
+	}{
+		{
+			name:       "exposed",
+			expose:     true,
+			wantStatus: http.StatusOK,
+			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
+				assert.JSONEq(t, `{"service":"mo","version":"1.2.3"}`, w.Body.String())
+			},
+		},
+		{
+			name:       "stealth",
+			expose:     false,
+			wantStatus: http.StatusNotFound,
+			verify: func(t *testing.T, w *httptest.ResponseRecorder) {
+				assert.NotContains(t, w.Body.String(), "service")
+				assert.NotContains(t, w.Body.String(), "1.2.3")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Server: config.ServerConfig{Version: "1.2.3", ExposeRootInfo: tt.expose},
+			}
+
+			w := httptest.NewRecorder()
+			Root(config.Static(cfg))(w, httptest.NewRequest("GET", "/", nil))
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+			tt.verify(t, w)
+		})
+	}
+}
+
+func TestRobotsTxt(t *testing.T) {
+	w := httptest.NewRecorder()
+	RobotsTxt()(w, httptest.NewRequest("GET", "/robots.txt", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", w.Body.String())
+}
+
+func TestFavicon(t *testing.T) {
+	w := httptest.NewRecorder()
+	Favicon()(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestReasoningOnlyPolicy(t *testing.T) {
+	thinkingOnly := `data: {"data": {"phase": "thinking", "delta_content": "Let me think.\n\nThe answer is 4."}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "", "done": true}}` + "\n\n"
+	answer := `data: {"data": {"phase": "answer", "delta_content": "4", "done": true}}` + "\n\n"
+
+	sseResp := func(body string) *http.Response {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	tests := []struct {
+		policy     string
+		setup      func(*MockAIClient)
+		wantHeader string
+		wantFinish string
+		wantText   string
+	}{
+		{
+			policy: "promote",
+			setup: func(m *MockAIClient) {
+				m.On("SendChatRequest", mock.Anything, mock.Anything).Return(sseResp(thinkingOnly), nil).Once()
+			},
+			wantFinish: "stop",
+			wantText:   "[from reasoning] The answer is 4.",
+		},
+		{
+			policy: "passthrough",
+			setup: func(m *MockAIClient) {
+				m.On("SendChatRequest", mock.Anything, mock.Anything).Return(sseResp(thinkingOnly), nil).Once()
+			},
+			wantHeader: "reasoning-only",
+			wantFinish: "reasoning_only",
+			wantText:   "",
+		},
+		{
+			policy: "retry",
+			setup: func(m *MockAIClient) {
+				m.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+					return r.Thinking == nil
+				}), mock.Anything).Return(sseResp(thinkingOnly), nil).Once()
+				m.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+					return r.Thinking != nil && !*r.Thinking
+				}), mock.Anything).Return(sseResp(answer), nil).Once()
+			},
+			wantFinish: "stop",
+			wantText:   "4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := &config.Config{
+				Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning", ReasoningOnly: tt.policy},
+			}
+			mockAI := new(MockAIClient)
+			tt.setup(mockAI)
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Model:    "glm-test",
+				Messages: []domain.Message{{Role: "user", Content: "2+2?"}},
+			})
+			w := httptest.NewRecorder()
+			before := metrics.Get("reasoning_only_completions", "glm-test")
+
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+
+			require.Equal(t, http.StatusOK, w.Code)
+			var resp domain.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantHeader, w.Header().Get("X-Mo-Warning"))
+			assert.Equal(t, tt.wantFinish, *resp.Choices[0].FinishReason)
+			assert.Equal(t, tt.wantText, resp.Choices[0].Message.Content)
+			assert.Equal(t, before+1, metrics.Get("reasoning_only_completions", "glm-test"))
+			mockAI.AssertExpectations(t)
+		})
+	}
+}
+
+func TestReasoningSummaries(t *testing.T) {
+	sse := `data: {"data": {"phase": "thinking", "delta_content": "Adding.\n\n<summ"}}` + "\n\n" +
+		`data: {"data": {"phase": "thinking", "delta_content": "ary>Doing the sum</summary>\n\nIt is 4."}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "4", "done": true}}` + "\n\n"
+
+	for _, stream := range []bool{false, true} {
+		for _, want := range []bool{false, true} {
+			t.Run(fmt.Sprintf("stream=%v/summaries=%v", stream, want), func(t *testing.T) {
+				cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+				mockAI := new(MockAIClient)
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+					StatusCode: 200,
+					Body:       io.NopCloser(strings.NewReader(sse)),
+				}, nil)
+
+				body, _ := json.Marshal(domain.ChatRequest{
+					Model:              "glm",
+					Stream:             stream,
+					ReasoningSummaries: want,
+					Messages:           []domain.Message{{Role: "user", Content: "2+2?"}},
+				})
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+				require.Equal(t, http.StatusOK, w.Code)
+
+				got := w.Body.String()
+				assert.NotContains(t, got, "<summary>")
+				assert.NotContains(t, got, "<summ")
+				if !want {
+					assert.NotContains(t, got, "Doing the sum")
+					return
+				}
+				if stream {
+					assert.Contains(t, got, `"reasoning_summary":"Doing the sum"`)
+					return
+				}
+				var resp domain.ChatResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, []string{"Doing the sum"}, resp.Choices[0].Message.ReasoningSummaries)
+				assert.Equal(t, "4", resp.Choices[0].Message.Content)
+			})
+		}
+	}
+}
+
+func TestUpstreamEvents(t *testing.T) {
+	sse := `data: {"data": {"phase": "search", "delta_content": "1. [Go](https://go.dev)\n"}}` + "\n\n" +
+		`data: {"data": {"phase": "search", "delta_content": "2. [Blog](https://go.dev/blog)\n"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "Go it is.", "done": true}}` + "\n\n"
+
+	for _, stream := range []bool{false, true} {
+		for _, want := range []bool{false, true} {
+			t.Run(fmt.Sprintf("stream=%v/events=%v", stream, want), func(t *testing.T) {
+				cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+				mockAI := new(MockAIClient)
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+					StatusCode: 200,
+					Body:       io.NopCloser(strings.NewReader(sse)),
+				}, nil)
+
+				body, _ := json.Marshal(domain.ChatRequest{
+					Model:                 "glm",
+					Stream:                stream,
+					IncludeUpstreamEvents: want,
+					Messages:              []domain.Message{{Role: "user", Content: "which language?"}},
+				})
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+				require.Equal(t, http.StatusOK, w.Code)
+
+				got := w.Body.String()
+				assert.NotContains(t, got, `"role":"assistant","content":"1. [Go]`, "search results are not the reply")
+				if !want {
+					assert.NotContains(t, got, "go.dev")
+					return
+				}
+				if stream {
+					assert.Contains(t, got, `"upstream_events":[{"phase":"search","content":"2. [Blog](https://go.dev/blog)\n"}]`)
+					return
+				}
+				var resp domain.ChatResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "Go it is.", resp.Choices[0].Message.Content)
+				assert.Equal(t, []domain.UpstreamEvent{{
+					Phase:   "search",
+					Content: "1. [Go](https://go.dev)\n2. [Blog](https://go.dev/blog)\n",
+				}}, resp.Choices[0].Message.UpstreamEvents)
+			})
+		}
+	}
+}
+
+func TestToolCallResponse(t *testing.T) {
+	sse := `data: {"data": {"phase": "tool_call", "delta_content": "<glm_block view=\"\" tool_call_name=\"get_time\">{\"type\": \"mcp\", \"data\": {\"metadata\": {\"id\": \"call_1\", "}}` + "\n\n" +
+		`data: {"data": {"phase": "tool_call", "delta_content": "\"name\": \"get_time\", \"arguments\": \"{}\"}, \"result\": \"\"}}</glm_"}}` + "\n\n" +
+		`data: {"data": {"phase": "other", "delta_content": "block>", "done": true}}` + "\n\n"
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(sse)),
+			}, nil)
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Model:    "glm",
+				Stream:   stream,
+				Messages: []domain.Message{{Role: "user", Content: "time?"}},
+			})
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			got := w.Body.String()
+			assert.NotContains(t, got, "glm_block")
+			assert.Contains(t, got, `"finish_reason":"tool_calls"`)
+			if stream {
+				assert.Contains(t, got, `"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_time","arguments":"{}"}}]`)
+				return
+			}
+			var resp domain.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Len(t, resp.Choices[0].Message.ToolCalls, 1)
+			assert.Equal(t, "get_time", resp.Choices[0].Message.ToolCalls[0].Function.Name)
+		})
+	}
+}
+
+func TestParallelToolCalls(t *testing.T) {
+	upstream, err := os.ReadFile(filepath.Join("testdata", "parallel_tool_calls.sse"))
+	require.NoError(t, err)
+	off, on := false, true
+
+	tests := []struct {
+		name      string
+		parallel  *bool
+		wantCalls []string
+	}{
+		{"unset", nil, []string{"get_weather", "get_time"}},
+		{"true", &on, []string{"get_weather", "get_time"}},
+		{"false", &off, []string{"get_weather"}},
+	}
+
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/stream=%v", tt.name, stream), func(t *testing.T) {
+				cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+				mockAI := new(MockAIClient)
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+					StatusCode: 200,
+					Body:       io.NopCloser(bytes.NewReader(upstream)),
+				}, nil)
+
+				body, _ := json.Marshal(domain.ChatRequest{
+					Stream:            stream,
+					Messages:          []domain.Message{{Role: "user", Content: "weather and time in Paris?"}},
+					Tools:             []domain.Tool{{Type: "function", Function: domain.ToolFunction{Name: "get_weather"}}, {Type: "function", Function: domain.ToolFunction{Name: "get_time"}}},
+					ParallelToolCalls: tt.parallel,
+				})
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+				got := w.Body.String()
+				assert.Contains(t, got, `"finish_reason":"tool_calls"`)
+
+				var names []string
+				if !stream {
+					var resp domain.ChatResponse
+					require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+					for _, c := range resp.Choices[0].Message.ToolCalls {
+						names = append(names, c.Function.Name)
+					}
+				} else {
+					for _, line := range strings.Split(got, "\n") {
+						data, ok := strings.CutPrefix(line, "data: ")
+						if !ok || data == "[DONE]" {
+							continue
+						}
+						var chunk domain.ChatResponse
+						require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+						for _, c := range chunk.Choices {
+							if c.Delta != nil {
+								for _, call := range c.Delta.ToolCalls {
+									names = append(names, call.Function.Name)
+								}
+							}
+						}
+					}
+				}
+				assert.Equal(t, tt.wantCalls, names)
+				if tt.parallel != nil && !*tt.parallel {
+					assert.NotContains(t, got, "Now the time", "the reply after the call is drained")
+					assert.NotContains(t, got, "Both are on the way")
+				} else {
+					assert.Contains(t, got, "Now the time")
+					if stream {
+						// a reply with tool calls has no content when not streamed
+						assert.Contains(t, got, "Both are on the way")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCredentialRouting(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+	mockAI := &MockAIClient{noCreds: true}
+	providers := provider.NewRegistry(mockAI)
+
+	body, _ := json.Marshal(domain.ChatRequest{
+		Messages: []domain.Message{{Role: "user", Content: "hi"}},
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), providers, nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	e := decodeAPIError(t, w)
+	assert.Contains(t, e.Message, "no usable credentials")
+	assert.Equal(t, "upstream_error", e.Type)
+
+	w = httptest.NewRecorder()
+	HealthReady(config.Static(cfg), providers, nil, nil, nil, nil)(w, httptest.NewRequest("GET", "/health/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"provider":"mock"`)
+
+	// credentials appear, e.g. after a token store mutation
+	mockAI.noCreds = false
+	providers.Refresh()
+
+	w = httptest.NewRecorder()
+	HealthReady(config.Static(cfg), providers, nil, nil, nil, nil)(w, httptest.NewRequest("GET", "/health/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"valid":true`)
+}
+
+type fakeModelList []string
+
+func (f fakeModelList) ListModels() ([]string, error) { return f, nil }
+
+func (f fakeModelList) SupportsModel(string) bool { return true }
+
+func TestModelDrift(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{
+		Default: "GLM-4-6-API-V1",
+		Aliases: map[string]string{"fast": "GLM-4-5-Air"},
+		OnDrift: "broken",
+	}}
+	providers := provider.NewRegistry(new(MockAIClient))
+
+	// upstream renamed the default model
+	catalog := models.NewCatalog(cfg, fakeModelList{"GLM-4-6-API-V2", "GLM-4-5-Air"})
+	require.NoError(t, catalog.Refresh())
+
+	w := httptest.NewRecorder()
+	HealthReady(config.Static(cfg), providers, catalog, nil, nil, nil)(w, httptest.NewRequest("GET", "/health/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"suggestion":"GLM-4-6-API-V2"`)
+
+	body, _ := json.Marshal(domain.ChatRequest{
+		Messages: []domain.Message{{Role: "user", Content: "hi"}},
+	})
+	w = httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), providers, catalog, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "no longer available upstream")
+}
+
+func TestRequestLimits(t *testing.T) {
+	limits := config.LimitsConfig{
+		MaxBodyBytes:        4096,
+		MaxMessages:         3,
+		MaxPromptChars:      20,
+		MaxImagesPerMessage: 2,
+		MaxImageBytes:       6,
+	}
+
+	msgs := func(n int) []domain.Message {
+		out := make([]domain.Message, n)
+		for i := range out {
+			out[i] = domain.Message{Role: "user", Content: "hi"}
+		}
+		return out
+	}
+	images := func(n int, dataURL string) []domain.Message {
+		parts := []interface{}{map[string]interface{}{"type": "text", "text": "look"}}
+		for range n {
+			parts = append(parts, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": dataURL},
+			})
+		}
+		return []domain.Message{{Role: "user", Content: parts}}
+	}
+	file := func(part map[string]interface{}) []domain.Message {
+		return []domain.Message{{Role: "user", Content: []interface{}{part}}}
+	}
+	filePart := func(data string) map[string]interface{} {
+		return map[string]interface{}{"type": "file", "file": map[string]interface{}{"filename": "a", "file_data": data}}
+	}
+	// decoded sizes: exactly the limit and one byte over
+	sixBytes := "data:image/png;base64,AAAAAAAA"
+	sevenBytes := "data:image/png;base64,AAAAAAAAAA=="
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{"messages at limit", domain.ChatRequest{Messages: msgs(3)}, http.StatusOK, ""},
+		{"messages over limit", domain.ChatRequest{Messages: msgs(4)}, http.StatusBadRequest, "too_many_messages"},
+		{"prompt at limit", domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: strings.Repeat("a", 20)}}}, http.StatusOK, ""},
+		{"prompt over limit", domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: strings.Repeat("a", 21)}}}, http.StatusBadRequest, "prompt_too_long"},
+		{"images at limit", domain.ChatRequest{Messages: images(2, sixBytes)}, http.StatusOK, ""},
+		{"images over limit", domain.ChatRequest{Messages: images(3, sixBytes)}, http.StatusBadRequest, "too_many_images"},
+		{"image over size", domain.ChatRequest{Messages: images(1, sevenBytes)}, http.StatusRequestEntityTooLarge, "image_too_large"},
+		{"pdf file", domain.ChatRequest{Messages: file(filePart("data:application/pdf;base64,JVBERg=="))}, http.StatusOK, ""},
+		{"text file", domain.ChatRequest{Messages: file(filePart("data:text/csv;base64,YSxi"))}, http.StatusOK, ""},
+		{"zip file", domain.ChatRequest{Messages: file(filePart("data:application/zip;base64,UEsDBA=="))}, http.StatusBadRequest, "unsupported_file_type"},
+		{"file id", domain.ChatRequest{Messages: file(map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_id": "file-1"}})}, http.StatusBadRequest, "unsupported_file"},
+		{"binary image_url", domain.ChatRequest{Messages: images(1, "data:application/x-bin;base64,AA==")}, http.StatusBadRequest, "unsupported_file_type"},
+		{"body at limit", `{"messages":[{"role":"user","content":"hi"}]}` + strings.Repeat(" ", 4096-45), http.StatusOK, ""},
+		{"body over limit", `{"messages":[{"role":"user","content":"` + strings.Repeat("a", 4096) + `"}]}`, http.StatusRequestEntityTooLarge, "request_too_large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+				Limits: limits,
+			}
+
+			mockAI := new(MockAIClient)
+			sse := `data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}` + "\n\n"
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(sse)),
+			}, nil).Maybe()
+
+			var body []byte
+			if s, ok := tt.body.(string); ok {
+				body = []byte(s)
+			} else {
+				body, _ = json.Marshal(tt.body)
+			}
+
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+
+			assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantCode == "" {
+				return
+			}
+
+			e := decodeAPIError(t, w)
+			assert.Equal(t, "invalid_request_error", e.Type)
+			require.NotNil(t, e.Code)
+			assert.Equal(t, tt.wantCode, *e.Code)
+			mockAI.AssertNotCalled(t, "SendChatRequest", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func zlmAnswer(text string) *http.Response {
+	data, _ := json.Marshal(text)
+	sse := `data: {"data": {"phase": "answer", "delta_content": ` + string(data) + `, "done": true}}` + "\n\n"
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}
+}
+
+func TestResponseFormat(t *testing.T) {
+	schema := &domain.ResponseFormat{Type: "json_schema", JSONSchema: &domain.JSONSchema{
+		Name: "city",
+		Schema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"city": map[string]any{"type": "string"}},
+			"required":   []any{"city"},
+		},
+	}}
+	object := &domain.ResponseFormat{Type: "json_object"}
+
+	tests := []struct {
+		name        string
+		format      *domain.ResponseFormat
+		retry       bool
+		replies     []string
+		wantContent string
+		wantFinish  string
+	}{
+		{"plain json", object, false, []string{`{"ok":true}`}, `{"ok":true}`, "stop"},
+		{"fenced json", object, false, []string{"```json\n{\"ok\":true}\n```"}, `{"ok":true}`, "stop"},
+		{"not json", object, false, []string{"Sure! Here you go"}, "Sure! Here you go", finishInvalidJSON},
+		{"array is not an object", object, false, []string{`[1,2]`}, `[1,2]`, finishInvalidJSON},
+		{"schema valid", schema, false, []string{`{"city":"Paris"}`}, `{"city":"Paris"}`, "stop"},
+		{"schema violation", schema, false, []string{`{"town":"Paris"}`}, `{"town":"Paris"}`, finishInvalidJSON},
+		{"retry fixes reply", schema, true, []string{`{"town":"Paris"}`, `{"city":"Paris"}`}, `{"city":"Paris"}`, "stop"},
+		{"retry still invalid", schema, true, []string{`nope`, `still nope`}, `nope`, finishInvalidJSON},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning", JSONRetry: tt.retry}}
+
+			mockAI := new(MockAIClient)
+			for _, reply := range tt.replies {
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(zlmAnswer(reply), nil).Once()
+			}
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Messages:       []domain.Message{{Role: "user", Content: "where?"}},
+				ResponseFormat: tt.format,
+			})
+
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var resp domain.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantContent, resp.Choices[0].Message.Content)
+			assert.Equal(t, tt.wantFinish, *resp.Choices[0].FinishReason)
+
+			if tt.wantFinish == finishInvalidJSON {
+				assert.Equal(t, "invalid-json", w.Header().Get("X-Mo-Warning"))
+				assert.NotEmpty(t, resp.Warning)
+			} else {
+				assert.Empty(t, resp.Warning)
+			}
+			mockAI.AssertExpectations(t)
+		})
+	}
+}
+
+func TestResponseFormatStream(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(zlmAnswer("not json"), nil)
+
+	body, _ := json.Marshal(domain.ChatRequest{
+		Stream:         true,
+		StreamOpts:     &domain.StreamOptions{IncludeUsage: true},
+		Messages:       []domain.Message{{Role: "user", Content: "where?"}},
+		ResponseFormat: &domain.ResponseFormat{Type: "json_object"},
+	})
+
+	w := httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	out := w.Body.String()
+	assertTerminalSequence(t, out, true)
+	assert.Contains(t, out, `"finish_reason":"invalid_json"`)
+
+	// the verdict trails the finish chunk, usage stays last before [DONE]
+	warning := strings.Index(out, `"object":"mo.warning"`)
+	usage := strings.Index(out, `"usage"`)
+	require.Positive(t, warning)
+	assert.Less(t, strings.Index(out, "invalid_json"), warning)
+	assert.Less(t, warning, usage)
+}
+
+func TestEvalHarnessFields(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "42", "done": true}}` + "\n\n"
+
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantLogprobs bool
+	}{
+		{"seed only", `{"messages":[{"role":"user","content":"hi"}],"seed":7}`, http.StatusOK, false},
+		{"logprobs requested", `{"messages":[{"role":"user","content":"hi"}],"seed":7,"logprobs":true,"top_logprobs":5}`, http.StatusOK, true},
+		{"logprobs off", `{"messages":[{"role":"user","content":"hi"}],"logprobs":false}`, http.StatusOK, false},
+		{"top_logprobs out of range", `{"messages":[{"role":"user","content":"hi"}],"logprobs":true,"top_logprobs":21}`, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+				return r.Seed == nil || *r.Seed == 7
+			}), mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}, nil).Maybe()
+
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body)))
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantStatus != http.StatusOK {
+				assert.Equal(t, "top_logprobs", *decodeAPIError(t, w).Param)
+				return
+			}
+
+			var resp map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Regexp(t, `^fp_[0-9a-f]{10}$`, resp["system_fingerprint"])
+
+			choice := resp["choices"].([]any)[0].(map[string]any)
+			if !tt.wantLogprobs {
+				assert.NotContains(t, choice, "logprobs")
+				return
+			}
+			assert.Equal(t, map[string]any{"content": []any{}}, choice["logprobs"])
+		})
+	}
+}
+
+func TestPenaltyValidation(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}` + "\n\n"
+
+	tests := []struct {
+		name      string
+		body      string
+		wantParam string
+	}{
+		{"in range", `{"messages":[{"role":"user","content":"hi"}],"frequency_penalty":-2,"presence_penalty":1.5}`, ""},
+		{"frequency too high", `{"messages":[{"role":"user","content":"hi"}],"frequency_penalty":2.5}`, "frequency_penalty"},
+		{"presence too low", `{"messages":[{"role":"user","content":"hi"}],"presence_penalty":-3}`, "presence_penalty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+				return *r.FrequencyPenalty == -2 && *r.PresencePenalty == 1.5
+			}), mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}, nil).Maybe()
+
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body)))
+			if tt.wantParam == "" {
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				mockAI.AssertNumberOfCalls(t, "SendChatRequest", 1)
+				return
+			}
+
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			apiErr := decodeAPIError(t, w)
+			assert.Equal(t, "invalid_request_error", apiErr.Type)
+			assert.Equal(t, tt.wantParam, *apiErr.Param)
+			assert.Contains(t, apiErr.Message, tt.wantParam)
+			mockAI.AssertNotCalled(t, "SendChatRequest", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// swapConfig is a config.Provider whose base can change between requests
+type swapConfig struct {
+	cfg *config.Config
+}
+
+func (s *swapConfig) Config() *config.Config           { return s.cfg }
+func (s *swapConfig) ForKey(key string) *config.Config { return s.cfg.ForKey(key) }
+
+func TestConfigResolvedPerRequest(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}` + "\n\n"
+
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}, nil).Once()
+
+	configs := &swapConfig{cfg: &config.Config{
+		Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		Limits: config.LimitsConfig{MaxMessages: 1},
+		Compat: config.CompatConfig{Profile: compatExtended, Keys: map[string]string{"sk-saas": compatStrict}},
+	}}
+	handler := compat(configs)(ChatCompletions(configs, provider.NewRegistry(mockAI), nil, &MockTokener{}, nil))
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+			`{"messages":[{"role":"user","content":"a"},{"role":"user","content":"b"}],"thinking":true}`))
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, send("").Code, "base limit applies")
+
+	// a reload is picked up without rebuilding the handler
+	reloaded := *configs.cfg
+	reloaded.Limits.MaxMessages = 10
+	configs.cfg = &reloaded
+
+	assert.Equal(t, http.StatusOK, send("").Code)
+
+	// key overrides sit on top of the base, the strict profile rejects the extension
+	w := send("sk-saas")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "thinking", *decodeAPIError(t, w).Param)
+}
+
+func TestPricing(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "one two three", "done": true}}` + "\n\n"
+	pricing := config.PricingConfig{
+		Currency:   "EUR",
+		InResponse: true,
+		Models:     map[string]config.ModelPrice{"priced-model": {Input: 1, Output: 2}},
+	}
+	prev := usage.SetLedger(usage.New())
+	t.Cleanup(func() { usage.SetLedger(prev) })
+
+	tests := []struct {
+		name     string
+		model    string
+		profile  string
+		wantMo   bool
+		wantCost float64
+	}{
+		// 9 prompt tokens, "a b" with message framing
+		{"priced", "priced-model", compatExtended, true, 0.009*1 + 0.003*2},
+		{"unpriced reports null", "unpriced-model", compatExtended, true, -1},
+		{"strict hides the estimate", "priced-model", compatStrict, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Model:   config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+				Compat:  config.CompatConfig{Profile: tt.profile},
+				Pricing: pricing,
+			}
+
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}, nil)
+
+			body := `{"model":"` + tt.model + `","messages":[{"role":"user","content":"a b"}]}`
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var resp map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			if !tt.wantMo {
+				assert.NotContains(t, resp, "mo")
+				return
+			}
+
+			mo := resp["mo"].(map[string]any)
+			assert.Equal(t, "EUR", mo["currency"])
+			require.Contains(t, mo, "cost")
+			if tt.wantCost < 0 {
+				assert.Nil(t, mo["cost"])
+				return
+			}
+			assert.InDelta(t, tt.wantCost, mo["cost"], 1e-9)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	AdminUsage(config.Static(&config.Config{Pricing: pricing}), nil)(w, httptest.NewRequest("GET", "/admin/usage", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var report struct {
+		Currency string             `json:"currency"`
+		Models   []usage.ModelUsage `json:"models"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "EUR", report.Currency)
+
+	byModel := map[string]usage.ModelUsage{}
+	for _, m := range report.Models {
+		byModel[m.Model] = m
+	}
+	require.NotNil(t, byModel["priced-model"].Cost)
+	assert.InDelta(t, 2*(0.009*1+0.003*2), *byModel["priced-model"].Cost, 1e-9)
+	assert.Equal(t, int64(2), byModel["priced-model"].Requests)
+	assert.Nil(t, byModel["unpriced-model"].Cost)
+	assert.Equal(t, int64(1), byModel["unpriced-model"].Unpriced)
+}
+
+func TestPricingPrefersUpstreamUsage(t *testing.T) {
+	cfg := &config.Config{
+		Model:   config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		OpenAI:  []config.OpenAIUpstream{{Name: "llama", BaseURL: fakeOpenAI(t, "llama").URL, Models: []string{"llama-3.1-8b"}}},
+		Pricing: config.PricingConfig{Models: map[string]config.ModelPrice{"llama-3.1-8b": {Input: 1, Output: 2}}},
+	}
+	var registered []provider.Provider
+	for _, c := range openai.NewClients(cfg) {
+		registered = append(registered, c)
+	}
+	providers := provider.NewRegistry(registered...)
+	prev := usage.SetLedger(usage.New())
+	t.Cleanup(func() { usage.SetLedger(prev) })
+
+	for _, stream := range []bool{false, true} {
+		body := fmt.Sprintf(`{"model":"llama-3.1-8b","stream":%v,"messages":[{"role":"user","content":"a b c d e f g"}]}`, stream)
+		w := httptest.NewRecorder()
+		ChatCompletions(config.Static(cfg), providers, nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// fakeOpenAI counts 3 prompt and 2 completion tokens, far from a local count
+	byModel := usage.Snapshot()
+	require.Len(t, byModel, 1)
+	assert.Equal(t, int64(2), byModel[0].Requests)
+	assert.Equal(t, int64(6), byModel[0].PromptTokens)
+	assert.Equal(t, int64(4), byModel[0].CompletionTokens)
+	require.NotNil(t, byModel[0].Cost)
+	assert.InDelta(t, 2*(0.003*1+0.002*2), *byModel[0].Cost, 1e-9)
+}
+
+// tokenMockAI is the mock provider serving from a stored token
+type tokenMockAI struct {
+	*MockAIClient
+	id string
+}
+
+func (m tokenMockAI) TokenID() string { return m.id }
+
+func TestUsageJournal(t *testing.T) {
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	tok, err := store.AddWithProvider("mock", "a@example.org", "secret", "", 0)
+	require.NoError(t, err)
+
+	journal := usage.NewJournal(store)
+	defer journal.Close()
+	usage.SetJournal(journal)
+	defer usage.SetJournal(nil)
+
+	sse := `data: {"data": {"phase": "answer", "delta_content": "one two three", "done": true}}` + "\n\n"
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	for _, key := range []string{"sk-one", "sk-one", "sk-two"} {
+		mockAI := new(MockAIClient)
+		mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(sse))}, nil)
+
+		r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"a b"}]}`))
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		ChatCompletions(config.Static(cfg), provider.NewRegistry(tokenMockAI{mockAI, tok.ID}), nil, &MockTokener{}, nil)(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	var raw string
+	report := func(query string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		AdminUsage(config.Static(cfg), journal)(w, httptest.NewRequest("GET", "/admin/usage?"+query, nil))
+		raw = w.Body.String()
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	code, body := report("group_by=key&period=day")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, raw, `"sk-one"`, "keys are never reported in full")
+	rows := body["usage"].([]any)
+	require.Len(t, rows, 2)
+	first := rows[0].(map[string]any)
+	assert.Equal(t, usage.KeyID("sk-one"), first["id"])
+	assert.Equal(t, float64(2), first["requests"])
+	assert.Equal(t, float64(18), first["prompt_tokens"])
+
+	code, body = report("group_by=token")
+	require.Equal(t, http.StatusOK, code)
+	rows = body["usage"].([]any)
+	require.Len(t, rows, 1)
+	assert.Equal(t, tok.ID, rows[0].(map[string]any)["id"])
+	assert.Equal(t, "mock", rows[0].(map[string]any)["provider"])
+
+	code, _ = report("group_by=ip")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = report("group_by=model&period=week")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = report("group_by=model&from=2026-03-02&to=2026-03-01")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	w := httptest.NewRecorder()
+	ListTokensByProvider(store, journal, "mock")(w, httptest.NewRequest("GET", "/auth/mock/tokens", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Tokens []struct {
+			ID    string            `json:"id"`
+			Usage tokenstore.Counts `json:"usage"`
+		} `json:"tokens"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed.Tokens, 1)
+	assert.Equal(t, tok.ID, listed.Tokens[0].ID)
+	assert.Equal(t, int64(3), listed.Tokens[0].Usage.Requests)
+}
+
+func TestBenchSample(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sample.jsonl")
+	configs := config.Static(&config.Config{Bench: config.BenchConfig{SampleFile: path}})
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		BenchSample(configs)(w, httptest.NewRequest("GET", "/admin/bench/sample", nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, get().Code, "file missing")
+
+	require.NoError(t, os.WriteFile(path, []byte(
+		`{"messages":[{"role":"system","content":"be terse"},{"role":"user","content":"hi"}]}`+"\n"+
+			"not json\n"+
+			`{"messages":[]}`+"\n\n"+
+			`{"messages":[{"role":"user","content":"bye"}],"extra":1}`+"\n"), 0o600))
+
+	w := get()
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Equal(t,
+		`{"messages":[{"role":"system","content":"be terse"},{"role":"user","content":"hi"}]}`+"\n"+
+			`{"messages":[{"role":"user","content":"bye"}]}`+"\n",
+		w.Body.String())
+
+	// swapped on disk, served without a restart
+	require.NoError(t, os.WriteFile(path, []byte(`{"messages":[{"role":"user","content":"new"}]}`), 0o600))
+	assert.Contains(t, get().Body.String(), `"new"`)
+
+	w = httptest.NewRecorder()
+	BenchSample(config.Static(&config.Config{}))(w, httptest.NewRequest("GET", "/admin/bench/sample", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminDrift(t *testing.T) {
+	prev := drift.SetMonitor(drift.New())
+	t.Cleanup(func() { drift.SetMonitor(prev) })
+
+	stream := `data: {"data": {"phase": "probe_phase", "delta_content": "secret thoughts"}}
+
+data: {"data": {"phase": "answer", "delta_content": "hi", "probe_field": {"x": 1}}}
+
+data: {"data": {"phase": "answer", "delta_con
+
+data: {"data": {"phase": "answer", "delta_content": "!", "done": true}}
+
+`
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(stream))}, nil)
+
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	body := `{"messages": [{"role": "user", "content": "hi"}]}`
+	w := httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	AdminDrift()(w, httptest.NewRequest("GET", "/admin/drift", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var sum drift.Summary
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sum))
+	require.NotEmpty(t, sum.Days)
+	today := sum.Days[0]
+	assert.GreaterOrEqual(t, today.Events, int64(4))
+	assert.Positive(t, today.ParseFailureRate)
+	assert.Equal(t, int64(1), today.Anomalies[drift.UnknownPhase]["probe_phase"])
+	assert.Equal(t, int64(1), today.Anomalies[drift.UnexpectedField]["probe_field"])
+
+	samples := map[string]drift.Sample{}
+	for _, s := range sum.Samples {
+		samples[s.Class+"/"+s.Key] = s
+	}
+	phase := samples[drift.UnknownPhase+"/probe_phase"]
+	assert.Contains(t, phase.Sample, `"phase":"probe_phase"`)
+	assert.NotContains(t, phase.Sample, "secret thoughts")
+	assert.Contains(t, samples[drift.UnexpectedField+"/probe_field"].Sample, `"probe_field":{"x":1}`)
+	assert.NotEmpty(t, samples[drift.ParseFailure+"/sse"].Sample)
+}
+
+func TestAdminConfig(t *testing.T) {
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{Token: "eyJhbGciOi.secret"},
+		Model:    config.ModelConfig{ThinkMode: "reasoning"},
+	}
+	w := httptest.NewRecorder()
+	AdminConfig(config.Static(cfg))(w, httptest.NewRequest("GET", "/admin/config", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "eyJhbGciOi")
+
+	var got struct {
+		Settings []config.Setting `json:"settings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Contains(t, got.Settings, config.Setting{Path: "model.think_mode", Value: "reasoning", Source: config.SourceDefault})
+	assert.Contains(t, got.Settings, config.Setting{Path: "upstream.token", Value: "***", Source: config.SourceDefault})
+}
+
+func TestUpstreamStall(t *testing.T) {
+	for _, profile := range []string{"extended", "strict"} {
+		for _, stream := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/stream=%v", profile, stream), func(t *testing.T) {
+				pr, pw := io.Pipe()
+				defer pw.Close()
+				// the first event arrives, then upstream hangs
+				go pw.Write([]byte(strings.SplitAfter(answerStream("partial ", "answer"), "\n\n")[0]))
+
+				mockAI := new(MockAIClient)
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: pr}, nil)
+
+				cfg := &config.Config{
+					Model:    config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+					Upstream: config.UpstreamConfig{IdleTimeout: 50 * time.Millisecond},
+					Compat:   config.CompatConfig{Profile: profile},
+				}
+				configs := config.Static(cfg)
+				body := fmt.Sprintf(`{"messages": [{"role": "user", "content": "hi"}], "stream": %v}`, stream)
+				w := httptest.NewRecorder()
+				compat(configs)(ChatCompletions(configs, provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)).ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+				if !stream {
+					require.Equal(t, http.StatusGatewayTimeout, w.Code, w.Body.String())
+					assert.Contains(t, w.Body.String(), `"code":"upstream_timeout"`)
+					return
+				}
+
+				events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+				require.GreaterOrEqual(t, len(events), 3, w.Body.String())
+				assert.Contains(t, events[0], "partial")
+				assert.Contains(t, events[len(events)-2], `"code":"upstream_timeout"`)
+				assert.NotContains(t, w.Body.String(), "finish_reason\":\"stop")
+				assert.Equal(t, "data: [DONE]", events[len(events)-1])
+			})
+		}
+	}
+}
+
+func TestUpstreamErrorEvent(t *testing.T) {
+	for _, stream := range []bool{true, false} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			body := strings.SplitAfter(answerStream("partial ", "answer"), "\n\n")[0] +
+				"event: error\r\ndata: {\"detail\": \"quota exceeded\"}\r\n\r\n"
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil)
+
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm"}}
+			req := fmt.Sprintf(`{"messages": [{"role": "user", "content": "hi"}], "stream": %v}`, stream)
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil).ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(req)))
+
+			if !stream {
+				require.Equal(t, http.StatusBadGateway, w.Code, w.Body.String())
+				e := decodeAPIError(t, w)
+				assert.Equal(t, "upstream_error", *e.Code)
+				assert.Contains(t, e.Message, "quota exceeded")
+				return
+			}
+
+			events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+			require.GreaterOrEqual(t, len(events), 3, w.Body.String())
+			assert.Contains(t, events[0], "partial")
+			assert.Contains(t, events[len(events)-2], `"code":"upstream_error"`)
+			assert.Contains(t, events[len(events)-2], "quota exceeded")
+			assert.NotContains(t, w.Body.String(), "finish_reason\":\"stop")
+		})
+	}
+}
+
+func TestListModels(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{
+		Default: "GLM-4-6-API-V1",
+		Aliases: map[string]string{"fast": "GLM-4-5-Air"},
+	}}
+	providers := provider.NewRegistry(namedMock{new(MockAIClient), "qwen"})
+	catalog := models.NewCatalog(cfg, fakeModelList{"GLM-4-6-API-V1", "GLM-4-5-Air"})
+
+	w := httptest.NewRecorder()
+	ListModels(config.Static(cfg), providers, catalog)(w, httptest.NewRequest("GET", "/v1/models", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var list struct {
+		Data []models.Model `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID+"/"+m.OwnedBy)
+	}
+	assert.Equal(t, []string{"coder-model/qwen", "vision-model/qwen", "GLM-4-6-API-V1/zhipu", "GLM-4-5-Air/zhipu", "fast/mo"}, ids)
+
+	router := chi.NewRouter()
+	router.Get("/v1/models/{id}", GetModel(config.Static(cfg), providers, catalog))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/fast", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var one models.Model
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &one))
+	assert.Equal(t, list.Data[4], one)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/gpt-4", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "model_not_found", *decodeAPIError(t, w).Code)
+}
+
+func TestModelCapabilities(t *testing.T) {
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{Token: "opaque-token"},
+		Model: config.ModelConfig{
+			Default: "GLM-4-6-API-V1",
+			Aliases: map[string]string{"fast": "GLM-4-5-Air"},
+		},
+		Limits: config.LimitsConfig{ContextTokens: map[string]int{"GLM-4-5-Air": 128000}},
+	}
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	_, err = store.AddWithProvider("qwen", "a@example.com", "access", "refresh", time.Now().Add(time.Hour).UnixMilli())
+	require.NoError(t, err)
+
+	providers := provider.NewRegistry(qwen.NewClient(cfg, store), zlm.NewClient(cfg, nil, nil, store))
+	catalog := models.NewCatalog(cfg, fakeModelList{"GLM-4-6-API-V1", "GLM-4-5-Air"})
+	router := chi.NewRouter()
+	router.Get("/v1/models/{id}", GetModel(config.Static(cfg), providers, catalog))
+
+	get := func(id string) models.Model {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/"+id, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var m models.Model
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &m))
+		require.NotNil(t, m.Mo, id)
+		return m
+	}
+
+	glm := get("GLM-4-5-Air")
+	assert.Equal(t, models.Capabilities{
+		Provider: "zlm", SupportsTools: true, SupportsVision: true, SupportsReasoning: true, MaxContextTokens: 128000,
+	}, *glm.Mo)
+
+	assert.Equal(t, models.Capabilities{Provider: "qwen", SupportsTools: true}, *get("coder-model").Mo,
+		"images go to vision-model instead")
+	assert.True(t, get("vision-model").Mo.SupportsVision)
+
+	fast := get("fast")
+	assert.Equal(t, "mo", fast.OwnedBy)
+	assert.Equal(t, glm.Mo, fast.Mo, "an alias can what its target can")
+
+	// the list carries the same block
+	w := httptest.NewRecorder()
+	ListModels(config.Static(cfg), providers, catalog)(w, httptest.NewRequest("GET", "/v1/models", nil))
+	var list struct {
+		Data []models.Model `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Contains(t, list.Data, fast)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/coder-model-2", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "model_not_found", *decodeAPIError(t, w).Code)
+
+	strict := *cfg
+	strict.Compat.Profile = compatStrict
+	w = httptest.NewRecorder()
+	ListModels(config.Static(&strict), providers, catalog)(w, httptest.NewRequest("GET", "/v1/models", nil))
+	assert.NotContains(t, w.Body.String(), "supports_tools")
+}
+
+func TestHooks(t *testing.T) {
+	// the key is cut across deltas, a replacement on raw deltas would miss it
+	sse := `data: {"data": {"phase": "answer", "delta_content": "your key is sk-ab"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "c123\nkeep it"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": " safe", "done": true}}` + "\n\n"
+
+	for _, stream := range []bool{false, true} {
+		for _, key := range []string{"sk-plain", "sk-team"} {
+			t.Run(fmt.Sprintf("stream=%v/key=%s", stream, key), func(t *testing.T) {
+				cfg := &config.Config{
+					Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+					Hooks: config.HooksConfig{
+						HookChains: config.HookChains{
+							Request:  []config.HookConfig{{Type: "regex_redact", Pattern: `\d{3}-\d{4}`}},
+							Response: []config.HookConfig{{Type: "regex_replace", Pattern: `sk-[a-z0-9]+`, Replacement: "sk-***"}},
+						},
+						Keys: map[string]config.HookChains{
+							"sk-team": {Request: []config.HookConfig{{Type: "prepend_system", Text: "Team rules."}}},
+						},
+					},
+				}
+				mockAI := new(MockAIClient)
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+					StatusCode: 200,
+					Body:       io.NopCloser(strings.NewReader(sse)),
+				}, nil)
+
+				body, _ := json.Marshal(domain.ChatRequest{
+					Model:    "glm",
+					Stream:   stream,
+					Messages: []domain.Message{{Role: "user", Content: "call 555-1234"}},
+				})
+				r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+				r.Header.Set("Authorization", "Bearer "+key)
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, r)
+				require.Equal(t, http.StatusOK, w.Code)
+
+				sent := mockAI.Calls[0].Arguments.Get(0).(*domain.ChatRequest)
+				want := []domain.Message{{Role: "user", Content: "call [REDACTED]"}}
+				if key == "sk-team" {
+					want = append([]domain.Message{{Role: "system", Content: "Team rules."}}, want...)
+				}
+				assert.Equal(t, want, sent.Messages)
+
+				var content string
+				if stream {
+					for _, line := range strings.Split(w.Body.String(), "\n") {
+						var chunk domain.ChatResponse
+						data, ok := strings.CutPrefix(line, "data: ")
+						if !ok || json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 || chunk.Choices[0].Delta == nil {
+							continue
+						}
+						content += chunk.Choices[0].Delta.Content
+					}
+				} else {
+					var resp domain.ChatResponse
+					require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+					content = resp.Choices[0].Message.Content
+				}
+				assert.Equal(t, "your key is sk-***\nkeep it safe", content)
+			})
+		}
+	}
+}
+
+func TestHookRejects(t *testing.T) {
+	hooks.RegisterRequest("test_refuse", func(config.HookConfig) (hooks.RequestHook, error) {
+		return func(*domain.ChatRequest) error {
+			return domain.NewAPIError(http.StatusForbidden, "not on this key").WithCode("hook_refused")
+		}, nil
+	})
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm"},
+		Hooks: config.HooksConfig{HookChains: config.HookChains{Request: []config.HookConfig{{Type: "test_refuse"}}}},
+	}
+	mockAI := new(MockAIClient)
+
+	body, _ := json.Marshal(domain.ChatRequest{Model: "glm", Messages: []domain.Message{{Role: "user", Content: "hi"}}})
+	w := httptest.NewRecorder()
+	ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "hook_refused")
+	mockAI.AssertNotCalled(t, "SendChatRequest", mock.Anything, mock.Anything)
+}
+
+func TestFilters(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "the codename is Proj"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "ect Falcon, marked INTERNAL "}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "USE ONLY and then some", "done": true}}` + "\n\n"
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		Filters: config.FiltersConfig{
+			Redact:   []string{"Project Falcon"},
+			Abort:    []string{`(?i)internal use only`},
+			Mask:     "[REDACTED]",
+			MaxMatch: 64,
+		},
+	}
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(sse)),
+			}, nil)
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Model:    "glm",
+				Stream:   stream,
+				Messages: []domain.Message{{Role: "user", Content: "hi"}},
+			})
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var content, finish string
+			if stream {
+				for _, line := range strings.Split(w.Body.String(), "\n") {
+					var chunk domain.ChatResponse
+					data, ok := strings.CutPrefix(line, "data: ")
+					if !ok || json.Unmarshal([]byte(data), &chunk) != nil || len(chunk.Choices) == 0 {
+						continue
+					}
+					if chunk.Choices[0].Delta != nil {
+						content += chunk.Choices[0].Delta.Content
+					}
+					if chunk.Choices[0].FinishReason != nil {
+						finish = *chunk.Choices[0].FinishReason
+					}
+				}
+			} else {
+				var resp domain.ChatResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				content = resp.Choices[0].Message.Content
+				finish = *resp.Choices[0].FinishReason
+			}
+			assert.Equal(t, "the codename is [REDACTED], marked ", content)
+			assert.Equal(t, "content_filter", finish)
+		})
+	}
+}
+
+func TestQwenToolCallsAndUsage(t *testing.T) {
+	upstream, err := os.ReadFile(filepath.Join("testdata", "qwen_tool_call.sse"))
+	require.NoError(t, err)
+	wantCalls := []domain.ToolCall{
+		{ID: "call_w1", Type: "function", Function: domain.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{ID: "call_t1", Type: "function", Function: domain.FunctionCall{Name: "get_time", Arguments: `{"tz":"CET"}`}},
+	}
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "coder-model", ThinkMode: "reasoning"}}
+			mockAI := openaiMock{namedMock{MockAIClient: new(MockAIClient), name: "qwen"}}
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				// qwen streams even when asked not to
+				Header: http.Header{"Content-Type": {"text/event-stream"}},
+				Body:   io.NopCloser(bytes.NewReader(upstream)),
+			}, nil)
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Model:      "coder-model",
+				Stream:     stream,
+				StreamOpts: &domain.StreamOptions{IncludeUsage: true},
+				Messages:   []domain.Message{{Role: "user", Content: "weather and time in Paris?"}},
+			})
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			wantUsage := &domain.Usage{
+				PromptTokens: 42, CompletionTokens: 17, TotalTokens: 59,
+				// qwen sent no breakdown, mo fills it in
+				PromptTokensDetails:     &domain.PromptTokensDetails{},
+				CompletionTokensDetails: &domain.CompletionTokensDetails{},
+			}
+			if !stream {
+				var resp domain.ChatResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "tool_calls", *resp.Choices[0].FinishReason)
+				assert.Equal(t, "Let me check.", resp.Choices[0].Message.Content)
+				assert.Equal(t, wantCalls, resp.Choices[0].Message.ToolCalls)
+				assert.Equal(t, wantUsage, resp.Usage)
+				return
+			}
+
+			var calls qwen.ToolCallDeltas
+			var finish string
+			var usage *domain.Usage
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				data, ok := strings.CutPrefix(line, "data: ")
+				if !ok || data == "[DONE]" {
+					continue
+				}
+				var chunk domain.ChatResponse
+				require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+				if chunk.Usage != nil {
+					usage = chunk.Usage
+				}
+				for _, c := range chunk.Choices {
+					if c.Delta != nil {
+						for _, tc := range c.Delta.ToolCalls {
+							require.NotNil(t, tc.Index, "stream deltas keep their index")
+						}
+						calls.Add(c.Delta.ToolCalls)
+					}
+					if c.FinishReason != nil {
+						finish = *c.FinishReason
+					}
+				}
+			}
+			assert.Equal(t, "tool_calls", finish, "qwen's stop after tool calls")
+			assert.Equal(t, wantCalls, calls.Calls())
+			assert.Equal(t, wantUsage, usage, "qwen's usage, not a local count")
+		})
+	}
+}
+
+// fakeOpenAI answers every completion with its name and the model it got,
+// streamed with a <think> block when asked to
+func fakeOpenAI(t *testing.T, name string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		answer := name + ":" + req.Model
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id":"c1","created":1,"choices":[{"index":0,"message":{"role":"assistant","content":"<think>hm</think>%s"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`, answer)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"c1","created":1,"choices":[{"index":0,"delta":{"role":"assistant","content":"<thi"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"id":"c1","created":1,"choices":[{"index":0,"delta":{"content":"nk>hm</think>"}}]}`+"\n\n")
+		fmt.Fprintf(w, `data: {"id":"c1","created":1,"choices":[{"index":0,"delta":{"content":"%s"},"finish_reason":"stop"}]}`+"\n\n", answer)
+		fmt.Fprint(w, `data: {"id":"c1","created":1,"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenAIUpstreamRouting(t *testing.T) {
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "GLM-4-6-API-V1", ThinkMode: "reasoning"},
+		OpenAI: []config.OpenAIUpstream{
+			{Name: "llama", BaseURL: fakeOpenAI(t, "llama").URL, Models: []string{"llama-3.1-8b"}},
+			{Name: "vllm", BaseURL: fakeOpenAI(t, "vllm").URL, ModelPrefix: "vllm/"},
+		},
+	}
+	fallback := namedMock{MockAIClient: new(MockAIClient), name: "zlm"}
+	// once per stream mode, a body is read once
+	fallback.On("SendChatRequest", mock.Anything, mock.Anything).Return(zlmAnswer("from zlm"), nil).Once()
+	fallback.On("SendChatRequest", mock.Anything, mock.Anything).Return(zlmAnswer("from zlm"), nil).Once()
+
+	var registered []provider.Provider
+	for _, c := range openai.NewClients(cfg) {
+		registered = append(registered, c)
+	}
+	providers := provider.NewRegistry(append(registered, fallback)...)
+
+	tests := []struct {
+		model  string
+		answer string
+	}{
+		{"llama-3.1-8b", "llama:llama-3.1-8b"},
+		{"vllm/qwen2.5-7b", "vllm:qwen2.5-7b"},
+		{"GLM-4-6-API-V1", "from zlm"},
+	}
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/stream=%v", tt.model, stream), func(t *testing.T) {
+				body, _ := json.Marshal(domain.ChatRequest{
+					Model:    tt.model,
+					Stream:   stream,
+					Messages: []domain.Message{{Role: "user", Content: "hi"}},
+				})
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), providers, nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+				if !stream {
+					var resp domain.ChatResponse
+					require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+					assert.Equal(t, tt.model, resp.Model)
+					assert.Equal(t, tt.answer, resp.Choices[0].Message.Content)
+					return
+				}
+
+				var answer, reasoning strings.Builder
+				for _, line := range strings.Split(w.Body.String(), "\n") {
+					data, ok := strings.CutPrefix(line, "data: ")
+					if !ok || data == "[DONE]" {
+						continue
+					}
+					var chunk domain.ChatResponse
+					require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+					for _, c := range chunk.Choices {
+						if c.Delta != nil {
+							answer.WriteString(c.Delta.Content)
+							reasoning.WriteString(c.Delta.ReasoningContent)
+						}
+					}
+				}
+				assert.Equal(t, tt.answer, answer.String())
+				if tt.model != "GLM-4-6-API-V1" {
+					assert.Equal(t, "hm", reasoning.String(), "think tags become reasoning_content")
+				}
+			})
+		}
+	}
+}
+
+// chatIDRecorder answers every request and keeps the chat id it went out with
+type chatIDRecorder struct {
+	bodyProvider
+	ids *[]string
+}
+
+func (p chatIDRecorder) SendChatRequest(_ context.Context, _ *domain.ChatRequest, chatID string) (*http.Response, error) {
+	*p.ids = append(*p.ids, chatID)
+	return zlmAnswer("ok"), nil
+}
+
+func TestStickyConversation(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	conversations := conversation.New(nil, 100)
+	var ids []string
+	chat := ChatCompletions(config.Static(cfg), provider.NewRegistry(chatIDRecorder{ids: &ids}), nil, &MockTokener{}, conversations)
+
+	send := func(body string) {
+		w := httptest.NewRecorder()
+		chat(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	send(`{"conversation_id":"c1","messages":[{"role":"user","content":"hi"}]}`)
+	send(`{"conversation_id":"c1","messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"ok"},{"role":"user","content":"again"}]}`)
+	send(`{"conversation_id":"c2","messages":[{"role":"user","content":"hi"}]}`)
+	send(`{"user":"u1","messages":[{"role":"user","content":"hi"}]}`)
+	send(`{"user":"u1","messages":[{"role":"user","content":"hi"}]}`)
+	send(`{"messages":[{"role":"user","content":"hi"}]}`)
+	send(`{"messages":[{"role":"user","content":"hi"}]}`)
+
+	require.Len(t, ids, 7)
+	assert.Equal(t, ids[0], ids[1], "one conversation, one upstream chat")
+	assert.NotEqual(t, ids[0], ids[2])
+	assert.Equal(t, ids[3], ids[4], "user stands in for conversation_id")
+	assert.NotEqual(t, ids[5], ids[6], "no conversation, a chat per request")
+
+	r := chi.NewRouter()
+	r.Delete("/v1/conversations/{id}", ForgetConversation(conversations))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/conversations/c1", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/v1/conversations/c1", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "conversation_not_found", *decodeAPIError(t, w).Code)
+
+	send(`{"conversation_id":"c1","messages":[{"role":"user","content":"hi"}]}`)
+	assert.NotEqual(t, ids[0], ids[7], "a forgotten conversation starts a new chat")
+}
+
+func TestUsageBreakdown(t *testing.T) {
+	upstream := `data: {"data": {"phase": "thinking", "delta_content": "let me think hard"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "Hello"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": " big World", "done": true}}` + "\n\n"
+
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+			p := bodyProvider{body: func() io.ReadCloser { return io.NopCloser(strings.NewReader(upstream)) }}
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Model:      "glm",
+				Stream:     stream,
+				StreamOpts: &domain.StreamOptions{IncludeUsage: true},
+				Messages:   []domain.Message{{Role: "user", Content: "hi"}},
+			})
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var usage *domain.Usage
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				data, _ := strings.CutPrefix(line, "data: ")
+				var resp domain.ChatResponse
+				if json.Unmarshal([]byte(data), &resp) == nil && resp.Usage != nil {
+					usage = resp.Usage
+				}
+			}
+			require.NotNil(t, usage)
+			require.NotNil(t, usage.CompletionTokensDetails)
+			require.NotNil(t, usage.PromptTokensDetails)
+
+			assert.Equal(t, 4, usage.CompletionTokensDetails.ReasoningTokens, "let me think hard")
+			assert.Equal(t, 3+4, usage.CompletionTokens, "answer and reasoning add up")
+			assert.Equal(t, usage.PromptTokens+usage.CompletionTokens, usage.TotalTokens)
+			assert.Zero(t, usage.PromptTokensDetails.CachedTokens)
+		})
+	}
+}
+
+// zaiToken is a jwt shaped like z.ai's, the signature is never checked
+func zaiToken(id string, exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, `{"id":%q,"exp":%d}`, id, exp.Unix()))
+	return "eyJhbGciOiJIUzI1NiJ9." + payload + ".c2ln"
+}
+
+func TestAddToken(t *testing.T) {
+	cookie := zaiToken("u1", time.Now().Add(24*time.Hour))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+cookie {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/folders/":
+			w.Write([]byte(`[]`))
+		case "/api/v1/auths/":
+			w.Write([]byte(`{"id":"u1","email":"me@example.org","name":"Me"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+
+	cfg := &config.Config{Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(upstream.URL, "http://")}}
+	add := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		AddToken(config.Static(cfg), store)(w, httptest.NewRequest("POST", "/auth/tokens", strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"no token", `{"provider":"zai"}`, http.StatusBadRequest},
+		{"other provider", `{"token":"` + cookie + `","provider":"qwen"}`, http.StatusBadRequest},
+		{"not a jwt", `{"token":"cookie-token","provider":"zai"}`, http.StatusBadRequest},
+		{"expired", `{"token":"` + zaiToken("u1", time.Now().Add(-time.Hour)) + `"}`, http.StatusUnprocessableEntity},
+		{"rejected upstream", `{"token":"` + zaiToken("u2", time.Now().Add(time.Hour)) + `","provider":"zai"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, add(tt.body).Code)
+		})
+	}
+
+	w := add(`{"token":" \"Bearer ` + cookie + `\"\n","provider":"zai"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var saved tokenstore.Token
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &saved))
+	assert.Equal(t, "glm", saved.Provider)
+	assert.Equal(t, "me@example.org", saved.Email, "email comes from the account")
+	assert.Equal(t, "Me", saved.Name)
+	assert.True(t, saved.IsActive, "the first glm token becomes active")
+
+	stored, err := store.GetByID(saved.ID)
+	require.NoError(t, err)
+	assert.Equal(t, cookie, stored.Token, "stored without what pasting added")
+	assert.Equal(t, "Me", stored.Name)
+
+	assert.Equal(t, http.StatusConflict, add(`{"token":"`+cookie+`","email":"other@example.org"}`).Code)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/service/failover"
+	"github.com/zarazaex69/mo/internal/service/health"
+	"github.com/zarazaex69/mo/internal/service/models"
+)
+
+// HealthLive only tells the process answers, it checks nothing
+func HealthLive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	}
+}
+
+// providerHealth is a provider as /health/ready reports it
+type providerHealth struct {
+	provider.CredentialStatus
+	// credentials are valid and upstream answered the last probe
+	Usable    bool              `json:"usable"`
+	TokenID   string            `json:"token_id,omitempty"`
+	LastCheck *tokenstore.Check `json:"last_check,omitempty"`
+	Upstream  *health.Result    `json:"upstream,omitempty"`
+	// failover state of every upstream host
+	Hosts []failover.HostStatus `json:"hosts,omitempty"`
+}
+
+// HealthReady reports what requests depend on and answers 503 when no
+// provider is usable, so load balancers take the instance out. store,
+// tokenizer and probes are optional, probes are keyed by provider name
+func HealthReady(configs config.Provider, providers *provider.Registry, catalog *models.Catalog,
+	store *tokenstore.Store, tokenizer utils.Tokener, probes map[string]*health.Probe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := configs.Config()
+		body := map[string]any{}
+
+		storeOpen := true
+		if store != nil {
+			err := store.Ping()
+			storeOpen = err == nil
+			st := map[string]any{"open": storeOpen}
+			if err != nil {
+				st["error"] = err.Error()
+			}
+			body["tokenstore"] = st
+		}
+
+		ready := false
+		statuses := providers.Statuses()
+		reports := make([]providerHealth, 0, len(statuses))
+		for i, p := range providers.All() {
+			ph := providerHealth{CredentialStatus: statuses[i], Usable: statuses[i].Usable()}
+			if ph.TokenID = provider.TokenID(p); ph.TokenID != "" && store != nil && storeOpen {
+				if t, _ := store.GetByID(ph.TokenID); t != nil {
+					ph.LastCheck = t.LastCheck
+				}
+			}
+			// probing without credentials would only report them missing again
+			if probe := probes[p.Name()]; probe != nil && ph.Usable {
+				res := probe.Result()
+				ph.Upstream = &res
+				ph.Usable = res.Reachable
+			}
+			ph.Hosts = provider.Hosts(p)
+			ready = ready || ph.Usable
+			reports = append(reports, ph)
+		}
+		body["providers"] = reports
+
+		status := "ready"
+		code := http.StatusOK
+		switch {
+		case !storeOpen:
+			status = "token store unavailable"
+			code = http.StatusServiceUnavailable
+		case !ready:
+			status = "no usable provider"
+			code = http.StatusServiceUnavailable
+		}
+
+		pins := catalog.Pins()
+		if code == http.StatusOK {
+			for _, pin := range pins {
+				if !pin.Broken {
+					continue
+				}
+				// a broken alias only degrades, a broken default fails every bare request
+				status = "degraded"
+				if pin.Alias == cfg.Model.Default {
+					status = "default model unavailable"
+					code = http.StatusServiceUnavailable
+					break
+				}
+			}
+		}
+		if pins != nil {
+			body["models"] = pins
+		}
+
+		if tokenizer != nil {
+			// estimates keep working without the ranks, so this only informs
+			tk := map[string]any{"ready": true}
+			if err := tokenizer.Init(); err != nil {
+				tk["ready"] = false
+				tk["error"] = err.Error()
+			}
+			body["tokenizer"] = tk
+		}
+
+		body["status"] = status
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/provider/zlm"
+	"github.com/zarazaex69/mo/internal/service/failover"
+	"github.com/zarazaex69/mo/internal/service/health"
+)
+
+type readyReport struct {
+	Status    string `json:"status"`
+	Providers []struct {
+		Provider  string                `json:"provider"`
+		Usable    bool                  `json:"usable"`
+		TokenID   string                `json:"token_id"`
+		LastCheck *tokenstore.Check     `json:"last_check"`
+		Upstream  *health.Result        `json:"upstream"`
+		Hosts     []failover.HostStatus `json:"hosts"`
+	} `json:"providers"`
+	Tokenizer  map[string]any `json:"tokenizer"`
+	Tokenstore map[string]any `json:"tokenstore"`
+}
+
+func TestHealthReadyUpstream(t *testing.T) {
+	var down atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/models", r.URL.Path)
+		if down.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"data":[{"id":"GLM-4-6-API-V1"}]}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(upstream.URL, "http://")},
+		Model:    config.ModelConfig{Default: "GLM-4-6-API-V1"},
+	}
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	tok, err := store.Add("a@example.com", "opaque-token")
+	require.NoError(t, err)
+	require.NoError(t, store.RecordCheck(tok.ID, true))
+
+	client := zlm.NewClient(cfg, nil, nil, store)
+	probes := map[string]*health.Probe{
+		// every call probes, caching is the probe's own test
+		client.Name(): health.NewProbe(func() error {
+			_, err := client.ListModels()
+			return err
+		}, time.Nanosecond),
+	}
+	ready := HealthReady(config.Static(cfg), provider.NewRegistry(client), nil, store, &MockTokener{}, probes)
+
+	check := func(wantCode int) readyReport {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ready(w, httptest.NewRequest("GET", "/health/ready", nil))
+		require.Equal(t, wantCode, w.Code, w.Body.String())
+		var rep readyReport
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&rep))
+		require.Len(t, rep.Providers, 1)
+		return rep
+	}
+
+	rep := check(http.StatusOK)
+	assert.Equal(t, "ready", rep.Status)
+	p := rep.Providers[0]
+	assert.True(t, p.Usable)
+	assert.Equal(t, tok.ID, p.TokenID)
+	require.NotNil(t, p.LastCheck)
+	assert.True(t, p.LastCheck.Valid)
+	require.NotNil(t, p.Upstream)
+	assert.True(t, p.Upstream.Reachable)
+	assert.Equal(t, true, rep.Tokenizer["ready"])
+	assert.Equal(t, true, rep.Tokenstore["open"])
+	require.Len(t, p.Hosts, 1)
+	assert.Equal(t, cfg.Upstream.Host, p.Hosts[0].Host)
+	assert.True(t, p.Hosts[0].Healthy)
+
+	// the token still looks fine locally, upstream rejects it
+	down.Store(true)
+	rep = check(http.StatusServiceUnavailable)
+	assert.Equal(t, "no usable provider", rep.Status)
+	p = rep.Providers[0]
+	assert.False(t, p.Usable)
+	assert.False(t, p.Upstream.Reachable)
+	assert.Contains(t, p.Upstream.Error, "401")
+
+	down.Store(false)
+	assert.Equal(t, "ready", check(http.StatusOK).Status)
+}
+
+func TestHealthReadyWithoutToken(t *testing.T) {
+	probed := false
+	mockAI := &MockAIClient{noCreds: true}
+	probes := map[string]*health.Probe{
+		mockAI.Name(): health.NewProbe(func() error { probed = true; return nil }, time.Minute),
+	}
+	cfg := &config.Config{}
+
+	w := httptest.NewRecorder()
+	HealthReady(config.Static(cfg), provider.NewRegistry(mockAI), nil, nil, nil, probes)(w, httptest.NewRequest("GET", "/health/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"detail":"no token"`)
+	assert.False(t, probed, "no probe without credentials")
+
+	w = httptest.NewRecorder()
+	HealthLive()(w, httptest.NewRequest("GET", "/health/live", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider/zlm"
+)
+
+// checkLimits runs before anything is sent upstream
+func checkLimits(req *domain.ChatRequest, l config.LimitsConfig) *domain.APIError {
+	if l.MaxMessages > 0 && len(req.Messages) > l.MaxMessages {
+		return domain.NewAPIError(http.StatusBadRequest,
+			fmt.Sprintf("request has %d messages, limit is %d", len(req.Messages), l.MaxMessages)).
+			WithParam("messages").WithCode("too_many_messages")
+	}
+
+	chars := 0
+	for i, msg := range req.Messages {
+		images := 0
+
+		switch c := msg.Content.(type) {
+		case string:
+			chars += len(c)
+		case []interface{}:
+			for _, item := range c {
+				m, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+
+				switch m["type"] {
+				case "text":
+					t, _ := m["text"].(string)
+					chars += len(t)
+				case "image_url":
+					images++
+					img, _ := m["image_url"].(map[string]interface{})
+					u, _ := img["url"].(string)
+					if l.MaxImageBytes > 0 && imageSize(u) > l.MaxImageBytes {
+						return domain.NewAPIError(http.StatusRequestEntityTooLarge,
+							fmt.Sprintf("image exceeds %d bytes", l.MaxImageBytes)).
+							WithParam(fmt.Sprintf("messages[%d].content", i)).WithCode("image_too_large")
+					}
+				}
+			}
+		}
+
+		if l.MaxImagesPerMessage > 0 && images > l.MaxImagesPerMessage {
+			return domain.NewAPIError(http.StatusBadRequest,
+				fmt.Sprintf("message has %d images, limit is %d", images, l.MaxImagesPerMessage)).
+				WithParam(fmt.Sprintf("messages[%d].content", i)).WithCode("too_many_images")
+		}
+	}
+
+	if l.MaxPromptChars > 0 && chars > l.MaxPromptChars {
+		return domain.NewAPIError(http.StatusBadRequest,
+			fmt.Sprintf("prompt has %d characters, limit is %d", chars, l.MaxPromptChars)).
+			WithParam("messages").WithCode("prompt_too_long")
+	}
+
+	return nil
+}
+
+// checkFiles rejects document parts upstream cannot read: file parts must
+// carry a base64 pdf or text file, image_url data urls an image or one of those
+func checkFiles(req *domain.ChatRequest) *domain.APIError {
+	for i, msg := range req.Messages {
+		parts, ok := msg.Content.([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, item := range parts {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			var mime string
+			switch m["type"] {
+			case "file":
+				f, _ := m["file"].(map[string]interface{})
+				data, _ := f["file_data"].(string)
+				if mime = zlm.DataURLMIME(data); mime == "" {
+					return domain.NewAPIError(http.StatusBadRequest,
+						"file parts must carry file_data as a base64 data url, file_id is not supported").
+						WithParam(fmt.Sprintf("messages[%d].content", i)).WithCode("unsupported_file")
+				}
+			case "image_url":
+				img, _ := m["image_url"].(map[string]interface{})
+				u, _ := img["url"].(string)
+				if mime = zlm.DataURLMIME(u); strings.HasPrefix(mime, "image/") {
+					continue
+				}
+			}
+
+			if mime != "" && !zlm.SupportedFileType(mime) {
+				return domain.NewAPIError(http.StatusBadRequest,
+					fmt.Sprintf("unsupported file type %s, expected application/pdf or text/*", mime)).
+					WithParam(fmt.Sprintf("messages[%d].content", i)).WithCode("unsupported_file_type")
+			}
+		}
+	}
+	return nil
+}
+
+// imageSize is the decoded size of a base64 data url, 0 for remote urls
+func imageSize(url string) int {
+	if !strings.HasPrefix(url, "data:") {
+		return 0
+	}
+	_, data, ok := strings.Cut(url, ",")
+	if !ok {
+		return 0
+	}
+	return base64.StdEncoding.DecodedLen(len(data)) - strings.Count(data[max(0, len(data)-2):], "=")
+}
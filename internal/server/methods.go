@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// methods a route may take, in the order Allow lists them
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// notFound answers unknown paths in the openai error envelope, strict json
+// clients choke on anything else
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIErr(w, domain.NewAPIError(http.StatusNotFound, fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path)).
+		WithCode("unknown_url"))
+}
+
+// methodNotAllowed lists what the path takes in Allow. OPTIONS gets that
+// list and 204 instead of an error, a cors middleware in front of the
+// router answers preflights before they get here
+func methodNotAllowed(routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(routes, r.URL.Path)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeAPIErr(w, domain.NewAPIError(http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed for %s, use %s", r.Method, r.URL.Path, strings.Join(allowed, ", "))).
+			WithCode("method_not_allowed"))
+	}
+}
+
+func allowedMethods(routes chi.Routes, path string) []string {
+	var allowed []string
+	for _, m := range routeMethods {
+		if routes.Match(chi.NewRouteContext(), m, path) {
+			allowed = append(allowed, m)
+		}
+	}
+	return append(allowed, http.MethodOptions)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+func TestMethods(t *testing.T) {
+	s := &Server{
+		configs:   config.Static(&config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}),
+		router:    chi.NewRouter(),
+		providers: provider.NewRegistry(),
+		tokenizer: &MockTokener{},
+	}
+	s.routes()
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	tests := []struct {
+		method, path string
+		status       int
+		allow        string
+		code         string
+	}{
+		{"HEAD", "/v1/models", http.StatusOK, "", ""},
+		{"HEAD", "/health", http.StatusOK, "", ""},
+		{"HEAD", "/health/live", http.StatusOK, "", ""},
+		{"OPTIONS", "/v1/chat/completions", http.StatusNoContent, "POST, OPTIONS", ""},
+		{"OPTIONS", "/v1/models", http.StatusNoContent, "GET, HEAD, OPTIONS", ""},
+		{"OPTIONS", "/auth/glm/tokens/abc", http.StatusNoContent, "DELETE, OPTIONS", ""},
+		{"GET", "/v1/chat/completions", http.StatusMethodNotAllowed, "POST, OPTIONS", "method_not_allowed"},
+		{"HEAD", "/v1/chat/completions", http.StatusMethodNotAllowed, "POST, OPTIONS", ""},
+		{"DELETE", "/v1/models", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", "method_not_allowed"},
+		{"POST", "/auth/glm/tokens", http.StatusMethodNotAllowed, "GET, OPTIONS", "method_not_allowed"},
+		{"GET", "/v1/embeddings", http.StatusNotFound, "", "unknown_url"},
+		{"POST", "/v2/chat/completions", http.StatusNotFound, "", "unknown_url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			require.NoError(t, err)
+			resp, err := srv.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			assert.Equal(t, tt.status, resp.StatusCode, string(body))
+			assert.Equal(t, tt.allow, resp.Header.Get("Allow"))
+			if tt.method == "HEAD" || tt.status == http.StatusNoContent {
+				assert.Empty(t, body)
+				return
+			}
+			if tt.code == "" {
+				return
+			}
+
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			var e struct {
+				Error struct {
+					Message string
+					Type    string
+					Code    *string
+				}
+			}
+			require.NoError(t, json.Unmarshal(body, &e), string(body))
+			assert.NotEmpty(t, e.Error.Message)
+			assert.Equal(t, "invalid_request_error", e.Error.Type)
+			require.NotNil(t, e.Error.Code)
+			assert.Equal(t, tt.code, *e.Error.Code)
+		})
+	}
+}
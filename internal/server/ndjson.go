@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	streamNDJSON      = "ndjson"
+	ndjsonContentType = "application/x-ndjson"
+)
+
+type ndjsonKey struct{}
+
+// streamFormat lets a stream go out as json lines instead of sse, picked by
+// Accept: application/x-ndjson or, once the body is read, stream_format. it
+// sits outside every other writer, so they all keep producing sse
+func streamFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nw := &ndjsonWriter{ResponseWriter: w, on: strings.Contains(r.Header.Get("Accept"), ndjsonContentType)}
+		next.ServeHTTP(nw, r.WithContext(context.WithValue(r.Context(), ndjsonKey{}, nw)))
+	})
+}
+
+// useNDJSON switches the stream of the request to json lines, before the
+// first byte is written
+func useNDJSON(ctx context.Context) {
+	if nw, ok := ctx.Value(ndjsonKey{}).(*ndjsonWriter); ok {
+		nw.on = true
+	}
+}
+
+// ndjsonWriter reframes an sse stream as one json object per line. comments
+// such as the heartbeat ping and the [DONE] sentinel are dropped, the end of
+// the body ends the stream. anything that is not an sse stream passes as is
+type ndjsonWriter struct {
+	http.ResponseWriter
+	on      bool
+	stream  bool
+	decided bool
+	buf     bytes.Buffer
+}
+
+func (nw *ndjsonWriter) WriteHeader(code int) {
+	if !nw.decided {
+		nw.decided = true
+		nw.stream = nw.on && strings.HasPrefix(nw.Header().Get("Content-Type"), "text/event-stream")
+		if nw.stream {
+			nw.Header().Set("Content-Type", ndjsonContentType)
+		}
+	}
+	nw.ResponseWriter.WriteHeader(code)
+}
+
+func (nw *ndjsonWriter) Write(b []byte) (int, error) {
+	if !nw.decided {
+		nw.WriteHeader(http.StatusOK)
+	}
+	if !nw.stream {
+		return nw.ResponseWriter.Write(b)
+	}
+
+	nw.buf.Write(b)
+	for {
+		event, ok := nextEvent(&nw.buf)
+		if !ok {
+			break
+		}
+		data, ok := bytes.CutPrefix(event, []byte("data: "))
+		if !ok || string(data) == "[DONE]" {
+			continue
+		}
+		nw.ResponseWriter.Write(append(data, '\n'))
+	}
+	return len(b), nil
+}
+
+// Unwrap hands http.ResponseController the writer below, the sse writer cuts
+// a client it dropped with a write deadline on the connection
+func (nw *ndjsonWriter) Unwrap() http.ResponseWriter { return nw.ResponseWriter }
+
+func (nw *ndjsonWriter) Flush() {
+	if f, ok := nw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
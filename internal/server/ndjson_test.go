@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// ndjsonOf reframes an sse golden as the json lines the same stream becomes
+func ndjsonOf(t *testing.T, golden string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", golden+".golden"))
+	require.NoError(t, err)
+
+	var out strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if event, ok := strings.CutPrefix(line, "data: "); ok && event != "[DONE]" {
+			out.WriteString(event + "\n")
+		}
+	}
+	return out.String()
+}
+
+func TestStreamFormat(t *testing.T) {
+	upstream := `data: {"data": {"phase": "thinking", "delta_content": "let me think"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "Hello"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": " World", "done": true}}` + "\n\n"
+
+	tests := []struct {
+		name    string
+		profile string
+		accept  string
+		format  string
+		ndjson  bool
+	}{
+		{name: "sse by default", profile: compatExtended},
+		{name: "sse asked for", profile: compatExtended, format: "sse"},
+		{name: "accept header", profile: compatExtended, accept: "application/x-ndjson", ndjson: true},
+		{name: "request field", profile: compatExtended, format: "ndjson", ndjson: true},
+		{name: "strict reshapes first", profile: compatStrict, accept: "application/x-ndjson", ndjson: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning", ReasoningOnly: "passthrough"},
+				Compat: config.CompatConfig{Profile: tt.profile},
+			}
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(upstream)),
+			}, nil)
+			h := streamFormat(compat(config.Static(cfg))(ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)))
+
+			body, _ := json.Marshal(domain.ChatRequest{
+				Model:        "glm",
+				Stream:       true,
+				StreamOpts:   &domain.StreamOptions{IncludeUsage: true},
+				StreamFormat: tt.format,
+				Messages:     []domain.Message{{Role: "user", Content: "hi"}},
+			})
+			r := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			golden := "compat_" + tt.profile + "_stream"
+			if !tt.ndjson {
+				assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+				assertGolden(t, golden, w.Body.String())
+				return
+			}
+
+			assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+			got := idRe.ReplaceAllString(w.Body.String(), `"id":"ID"`)
+			got = createdRe.ReplaceAllString(got, `"created":0`)
+			assert.Equal(t, ndjsonOf(t, golden), got)
+			assert.NotContains(t, got, "data: ")
+			assert.NotContains(t, got, "[DONE]")
+
+			lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+			var last domain.ChatResponse
+			require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &last))
+			assert.NotNil(t, last.Usage, "the usage chunk stays last")
+			assert.Empty(t, last.Choices)
+		})
+	}
+}
+
+func TestStreamFormatLeavesJSON(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(`data: {"data": {"phase": "answer", "delta_content": "ok", "done": true}}` + "\n\n")),
+	}, nil)
+	h := streamFormat(ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil))
+
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+	r.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var resp domain.ChatResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), "a non-stream reply is untouched")
+	assert.Equal(t, "ok", resp.Choices[0].Message.Content)
+}
@@ -0,0 +1,51 @@
+package server
+
+import "strings"
+
+// echoTrim drops a prefill the model repeats before going on with it. z.ai
+// has no real prefill, told to continue the model sometimes restates the
+// prefix first. text is held back while it may still be that echo
+type echoTrim struct {
+	prefix string
+	held   string
+	// set once the echo was dropped or ruled out
+	done bool
+}
+
+// newEchoTrim trims prefix, an empty prefix passes deltas through unchanged
+func newEchoTrim(prefix string) *echoTrim {
+	prefix = strings.TrimSpace(prefix)
+	return &echoTrim{prefix: prefix, done: prefix == ""}
+}
+
+// Write returns what of delta can be sent now
+func (e *echoTrim) Write(delta string) string {
+	if e.done {
+		return delta
+	}
+	e.held += delta
+
+	text := strings.TrimLeft(e.held, " \t\r\n")
+	if rest, ok := strings.CutPrefix(text, e.prefix); ok {
+		e.done, e.held = true, ""
+		return rest
+	}
+	if strings.HasPrefix(e.prefix, text) {
+		return ""
+	}
+	// not an echo, the reply goes out as it came
+	return e.Flush()
+}
+
+// Flush returns the held back text once the stream is over
+func (e *echoTrim) Flush() string {
+	out := e.held
+	e.done, e.held = true, ""
+	return out
+}
+
+// trimEcho is echoTrim over a whole reply
+func trimEcho(prefix, content string) string {
+	e := newEchoTrim(prefix)
+	return e.Write(content) + e.Flush()
+}
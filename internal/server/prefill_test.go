@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+func TestEchoTrim(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		deltas []string
+		want   []string
+	}{
+		{"echo in one delta", "Sure: {", []string{`Sure: {"a": 1}`}, []string{`"a": 1}`}},
+		{"echo split over deltas", "Sure: {", []string{"Su", "re: ", `{"a"`, ": 1}"}, []string{"", "", `"a"`, ": 1}"}},
+		{"no echo", "Sure: {", []string{`"a": 1}`}, []string{`"a": 1}`}},
+		{"false start is released whole", "Sure: {", []string{"Sur", "ely not"}, []string{"", "Surely not"}},
+		{"whitespace around the echo", "Answer: ", []string{"\n", "Answer:", " 42"}, []string{"", "", " 42"}},
+		{"no prefill", "", []string{"hi"}, []string{"hi"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEchoTrim(tt.prefix)
+			var got []string
+			for _, d := range tt.deltas {
+				got = append(got, e.Write(d))
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Empty(t, e.Flush())
+		})
+	}
+
+	assert.Equal(t, "Sur", trimEcho("Sure: {", "Sur"), "a reply cut inside the echo is kept")
+	assert.Equal(t, "", trimEcho("Sure: {", "Sure: {"))
+}
+
+func TestPrefill(t *testing.T) {
+	user := domain.Message{Role: "user", Content: "json please"}
+	tests := []struct {
+		name     string
+		messages []domain.Message
+		want     string
+	}{
+		{"trailing assistant", []domain.Message{user, {Role: "assistant", Content: "Here is the JSON: {"}}, "Here is the JSON: {"},
+		{"ends with user", []domain.Message{{Role: "assistant", Content: "hi"}, user}, ""},
+		{"tool calls", []domain.Message{user, {Role: "assistant", Content: "let me look", ToolCalls: []domain.ToolCall{{ID: "c1"}}}}, ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := domain.ChatRequest{Messages: tt.messages}
+			assert.Equal(t, tt.want, req.Prefill())
+		})
+	}
+}
+
+func TestPrefillContinuation(t *testing.T) {
+	const prefix = "Here is the JSON: {"
+
+	for _, fixture := range []string{"prefill_echo", "prefill_no_echo"} {
+		upstream, err := os.ReadFile(filepath.Join("testdata", fixture+".sse"))
+		require.NoError(t, err)
+
+		for _, stream := range []bool{false, true} {
+			name := fixture
+			if stream {
+				name += "_stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+
+				mockAI := new(MockAIClient)
+				mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+					StatusCode: 200,
+					Body:       io.NopCloser(bytes.NewReader(upstream)),
+				}, nil)
+
+				body, _ := json.Marshal(domain.ChatRequest{
+					Stream: stream,
+					Messages: []domain.Message{
+						{Role: "user", Content: "the city as json"},
+						{Role: "assistant", Content: prefix},
+					},
+				})
+				w := httptest.NewRecorder()
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+				content, reasoning := replyText(t, w.Body.String(), stream)
+				assert.Equal(t, `"city": "Paris"}`, content, "the prefix is not repeated")
+				assert.Equal(t, "The user wants JSON.", reasoning)
+			})
+		}
+	}
+}
+
+// replyText joins the content and reasoning of a reply or of a stream
+func replyText(t *testing.T, body string, stream bool) (string, string) {
+	t.Helper()
+	if !stream {
+		var resp domain.ChatResponse
+		require.NoError(t, json.Unmarshal([]byte(body), &resp))
+		return resp.Choices[0].Message.Content, resp.Choices[0].Message.ReasoningContent
+	}
+
+	var content, reasoning strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk domain.ChatResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		for _, c := range chunk.Choices {
+			if c.Delta != nil {
+				content.WriteString(c.Delta.Content)
+				reasoning.WriteString(c.Delta.ReasoningContent)
+			}
+		}
+	}
+	return content.String(), reasoning.String()
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// applyProfile fills what the request left unset from the models profile of
+// its upstream model. returns cfg, or a copy of it with the profile's
+// think_mode
+func applyProfile(req *domain.ChatRequest, cfg *config.Config) *config.Config {
+	p, ok := cfg.Profile(req.Model)
+	if !ok {
+		return cfg
+	}
+
+	if req.Temperature == nil {
+		req.Temperature = p.Temperature
+	}
+	if req.TopP == nil {
+		req.TopP = p.TopP
+	}
+	if req.MaxTokens == nil {
+		req.MaxTokens = p.MaxTokens
+	}
+	if req.Thinking == nil && req.ReasoningEffort == "" {
+		req.Thinking = p.Thinking
+	}
+
+	if p.ThinkMode == "" || req.ReasoningFormat != "" {
+		return cfg
+	}
+	eff := *cfg
+	eff.Model.ThinkMode = p.ThinkMode
+	return &eff
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestApplyProfile(t *testing.T) {
+	ptr := func(f float64) *float64 { return &f }
+	on, off := true, false
+	cfg := &config.Config{
+		Model: config.ModelConfig{ThinkMode: "reasoning"},
+		Models: map[string]config.ModelProfile{
+			"coder-model": {Temperature: ptr(0.2), Thinking: &off, ThinkMode: "strip"},
+			"GLM-*":       {Thinking: &on},
+		},
+	}
+
+	t.Run("fills what the request left unset", func(t *testing.T) {
+		req := &domain.ChatRequest{Model: "coder-model"}
+		eff := applyProfile(req, cfg)
+		assert.Equal(t, 0.2, *req.Temperature)
+		assert.False(t, *req.Thinking)
+		assert.Equal(t, "strip", eff.Model.ThinkMode)
+		assert.Equal(t, "reasoning", cfg.Model.ThinkMode, "the shared config is not changed")
+	})
+
+	t.Run("request wins", func(t *testing.T) {
+		req := &domain.ChatRequest{Model: "coder-model", Temperature: ptr(1), ReasoningEffort: "high", ReasoningFormat: "tags"}
+		eff := applyProfile(req, cfg)
+		assert.Equal(t, 1.0, *req.Temperature)
+		assert.Nil(t, req.Thinking, "reasoning_effort decides")
+		assert.Equal(t, "reasoning", eff.Model.ThinkMode)
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		req := &domain.ChatRequest{Model: "GLM-4-6-API-V1"}
+		assert.Same(t, cfg, applyProfile(req, cfg))
+		assert.True(t, *req.Thinking)
+		assert.Nil(t, req.Temperature, "the global default stays")
+	})
+
+	t.Run("no profile", func(t *testing.T) {
+		req := &domain.ChatRequest{Model: "qwen3-max"}
+		assert.Same(t, cfg, applyProfile(req, cfg))
+		assert.Nil(t, req.Thinking)
+	})
+}
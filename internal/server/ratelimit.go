@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/ratelimit"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/service/usage"
+)
+
+type budgetKey struct{}
+
+// tokenBudget returns the token bucket the rate limiter gave the request,
+// nil without a tokens budget
+func tokenBudget(ctx context.Context) *ratelimit.Bucket {
+	b, _ := ctx.Value(budgetKey{}).(*ratelimit.Bucket)
+	return b
+}
+
+// rateLimit admits a request while its client has a request left and is not
+// in token debt. tokens are charged once known, so a request may overdraw
+// the bucket and the next ones wait until the refill paid it off
+func rateLimit(configs config.Provider, limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := bearerKey(r)
+			cfg := configs.ForKey(key)
+			b := cfg.RateLimit.RateBudget
+			if b.RequestsPerMinute == 0 && b.TokensPerMinute == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			c := limiter.Client(rateClient(r, key, cfg), b.RequestsPerMinute, b.TokensPerMinute)
+			if ok, wait := c.Tokens.Ready(1); !ok {
+				tooManyRequests(w, c, "tokens", wait)
+				return
+			}
+			if ok, wait := c.Requests.Take(1); !ok {
+				tooManyRequests(w, c, "requests", wait)
+				return
+			}
+
+			setRateHeaders(w.Header(), c)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), budgetKey{}, c.Tokens)))
+		})
+	}
+}
+
+// rateClient is who a budget belongs to, the api key or else the address
+// RealIP settled on. mo does not authenticate keys, so only the ones the
+// config names get a budget of their own, a client making up a new key
+// per request stays on the budget of its address
+func rateClient(r *http.Request, key string, cfg *config.Config) string {
+	_, limited := cfg.RateLimit.Keys[key]
+	_, profiled := cfg.Compat.Keys[key]
+	if key != "" && (limited || profiled) {
+		return "key:" + key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func tooManyRequests(w http.ResponseWriter, c *ratelimit.Client, spent string, wait time.Duration) {
+	setRateHeaders(w.Header(), c)
+	secs := max(1, int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeAPIErr(w, domain.NewAPIError(http.StatusTooManyRequests,
+		fmt.Sprintf("rate limit reached for %s per minute, try again in %ds", spent, secs)).
+		WithCode("rate_limit_exceeded"))
+}
+
+// setRateHeaders reports the budgets the way openai does
+func setRateHeaders(h http.Header, c *ratelimit.Client) {
+	for name, b := range map[string]*ratelimit.Bucket{"requests": c.Requests, "tokens": c.Tokens} {
+		if b == nil {
+			continue
+		}
+		h.Set("X-Ratelimit-Limit-"+name, strconv.Itoa(b.Limit()))
+		h.Set("X-Ratelimit-Remaining-"+name, strconv.Itoa(b.Remaining()))
+	}
+}
+
+// billing is who a completion is charged to: the usage journal entry and
+// the token budget of the client
+type billing struct {
+	who       usage.Entry
+	budget    *ratelimit.Bucket
+	tokenizer utils.Tokener
+	// completion tokens already charged while streaming
+	streamed int
+}
+
+// flow charges streamed text to the budget as it goes out
+func (b *billing) flow(text string) {
+	if b == nil || b.budget == nil || text == "" {
+		return
+	}
+	n := b.tokenizer.Count(text)
+	b.budget.Charge(n)
+	b.streamed += n
+}
+
+// settle books the completion in the journal and charges what flow has not
+func (b *billing) settle(model string, u *domain.Usage) {
+	if b == nil || u == nil {
+		return
+	}
+	b.budget.Charge(u.TotalTokens - b.streamed)
+	b.streamed = u.TotalTokens
+
+	e := b.who
+	e.Time, e.Model = time.Now(), model
+	e.PromptTokens, e.CompletionTokens = u.PromptTokens, u.CompletionTokens
+	usage.Book(e)
+}
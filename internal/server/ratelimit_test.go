@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/ratelimit"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// bodyProvider answers every request with a fresh body
+type bodyProvider struct {
+	body func() io.ReadCloser
+}
+
+func (p bodyProvider) Name() string              { return "mock" }
+func (p bodyProvider) SupportsModel(string) bool { return true }
+func (p bodyProvider) CredentialStatus() provider.CredentialStatus {
+	return provider.CredentialStatus{Present: true, Valid: true}
+}
+func (p bodyProvider) SendChatRequest(context.Context, *domain.ChatRequest, string) (*http.Response, error) {
+	return &http.Response{StatusCode: 200, Body: p.body()}, nil
+}
+
+// openaiBodyProvider is a bodyProvider whose replies are openai chunks
+type openaiBodyProvider struct{ bodyProvider }
+
+func (openaiBodyProvider) RepliesOpenAI() {}
+
+// limitedChat is chat completions behind the rate limiter, on a clock that
+// stands still unless the test moves it
+type limitedChat struct {
+	http.Handler
+	limiter *ratelimit.Limiter
+	now     time.Time
+}
+
+func newLimitedChat(cfg *config.Config, p provider.Provider) *limitedChat {
+	l := &limitedChat{now: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	l.limiter = ratelimit.NewWithClock(func() time.Time { return l.now })
+
+	configs := config.Static(cfg)
+	chat := ChatCompletions(configs, provider.NewRegistry(p), nil, &MockTokener{}, nil)
+	l.Handler = rateLimit(configs, l.limiter)(chat)
+	return l
+}
+
+func (l *limitedChat) send(key, ip string, stream bool) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"model":"m","stream":%v,"messages":[{"role":"user","content":"a b"}]}`, stream)
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	r.RemoteAddr = ip + ":5555"
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "one two three", "done": true}}` + "\n\n"
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		RateLimit: config.RateLimitConfig{
+			RateBudget: config.RateBudget{RequestsPerMinute: 2},
+			Keys: map[string]config.RateBudget{
+				"sk-one":   {RequestsPerMinute: 2},
+				"sk-batch": {RequestsPerMinute: 1},
+			},
+		},
+	}
+	l := newLimitedChat(cfg, bodyProvider{func() io.ReadCloser { return io.NopCloser(strings.NewReader(sse)) }})
+
+	// a burst of the whole budget, then 429
+	for range 2 {
+		require.Equal(t, http.StatusOK, l.send("sk-one", "10.0.0.1", false).Code)
+	}
+	w := l.send("sk-one", "10.0.0.1", false)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "2", w.Header().Get("X-Ratelimit-Limit-Requests"))
+	assert.Equal(t, "0", w.Header().Get("X-Ratelimit-Remaining-Requests"))
+	apiErr := decodeAPIError(t, w)
+	assert.Equal(t, "rate_limit_exceeded", apiErr.Type)
+	assert.Equal(t, "rate_limit_exceeded", *apiErr.Code)
+	assert.Contains(t, apiErr.Message, "requests per minute")
+
+	// the key has a budget of its own
+	assert.Equal(t, http.StatusOK, l.send("sk-batch", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusTooManyRequests, l.send("sk-batch", "10.0.0.1", false).Code)
+
+	// without a key the address is the client
+	assert.Equal(t, http.StatusOK, l.send("", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusOK, l.send("", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusTooManyRequests, l.send("", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusOK, l.send("", "10.0.0.2", false).Code)
+
+	// half a minute refills one request
+	l.now = l.now.Add(30 * time.Second)
+	assert.Equal(t, http.StatusOK, l.send("sk-one", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusTooManyRequests, l.send("sk-one", "10.0.0.1", false).Code)
+}
+
+func TestRateLimitUnknownKeys(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "hi", "done": true}}` + "\n\n"
+	cfg := &config.Config{
+		Model:     config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		RateLimit: config.RateLimitConfig{RateBudget: config.RateBudget{RequestsPerMinute: 2}},
+		Compat:    config.CompatConfig{Profile: "extended", Keys: map[string]string{"sk-strict": "strict"}},
+	}
+	l := newLimitedChat(cfg, bodyProvider{func() io.ReadCloser { return io.NopCloser(strings.NewReader(sse)) }})
+
+	// a new made up key per request does not reset the budget of the address
+	assert.Equal(t, http.StatusOK, l.send("sk-rotate-1", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusOK, l.send("sk-rotate-2", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusTooManyRequests, l.send("sk-rotate-3", "10.0.0.1", false).Code)
+	assert.Equal(t, http.StatusTooManyRequests, l.send("", "10.0.0.1", false).Code)
+
+	// a key the config knows is a client of its own
+	assert.Equal(t, http.StatusOK, l.send("sk-strict", "10.0.0.1", false).Code)
+}
+
+func TestRateLimitStreamingTokens(t *testing.T) {
+	cfg := &config.Config{
+		Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		RateLimit: config.RateLimitConfig{
+			RateBudget: config.RateBudget{TokensPerMinute: 60},
+			Keys:       map[string]config.RateBudget{"sk-stream": {TokensPerMinute: 60}},
+		},
+	}
+	upstream := make(chan *io.PipeWriter, 1)
+	l := newLimitedChat(cfg, bodyProvider{func() io.ReadCloser {
+		pr, pw := io.Pipe()
+		upstream <- pw
+		return pr
+	}})
+	// same budgets, same bucket as the one the middleware hands out
+	tokens := l.limiter.Client("key:sk-stream", 0, 60).Tokens
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- l.send("sk-stream", "10.0.0.1", true) }()
+
+	pw := <-upstream
+	fmt.Fprint(pw, `data: {"data": {"phase": "answer", "delta_content": "one two three four five"}}`+"\n\n")
+	// five completion tokens are charged before the stream ends
+	require.Eventually(t, func() bool { return tokens.Remaining() == 55 }, time.Second, 5*time.Millisecond)
+
+	fmt.Fprint(pw, `data: {"data": {"phase": "answer", "delta_content": " six", "done": true}}`+"\n\n")
+	pw.Close()
+	require.Equal(t, http.StatusOK, (<-done).Code)
+	// the rest, prompt tokens included, is settled at the end
+	used := 60 - tokens.Remaining()
+	assert.Greater(t, used, 6)
+
+	// overdrawn, the client waits for the refill to pay the debt off
+	tokens.Charge(tokens.Remaining() + 30)
+	w := l.send("sk-stream", "10.0.0.1", true)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "31", w.Header().Get("Retry-After"))
+	assert.Contains(t, decodeAPIError(t, w).Message, "tokens per minute")
+	assert.Empty(t, upstream, "a rejected request never reaches upstream")
+
+	l.now = l.now.Add(31 * time.Second)
+	go func() { done <- l.send("sk-stream", "10.0.0.1", true) }()
+	pw = <-upstream
+	pw.Close()
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+}
+
+func TestRateLimitStreamingReasoning(t *testing.T) {
+	cfg := &config.Config{
+		Model:     config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		RateLimit: config.RateLimitConfig{Keys: map[string]config.RateBudget{"sk-think": {TokensPerMinute: 60}}},
+	}
+	events := map[string]string{
+		"zlm":    `data: {"data": {"phase": "thinking", "delta_content": "one two three four five"}}` + "\n\n",
+		"openai": `data: {"id":"c1","created":1,"choices":[{"index":0,"delta":{"reasoning_content":"one two three four five"}}]}` + "\n\n",
+	}
+
+	for name, event := range events {
+		t.Run(name, func(t *testing.T) {
+			upstream := make(chan *io.PipeWriter, 1)
+			var p provider.Provider = bodyProvider{func() io.ReadCloser {
+				pr, pw := io.Pipe()
+				upstream <- pw
+				return pr
+			}}
+			if name == "openai" {
+				p = openaiBodyProvider{p.(bodyProvider)}
+			}
+			l := newLimitedChat(cfg, p)
+			tokens := l.limiter.Client("key:sk-think", 0, 60).Tokens
+
+			done := make(chan *httptest.ResponseRecorder)
+			go func() { done <- l.send("sk-think", "10.0.0.1", true) }()
+
+			pw := <-upstream
+			fmt.Fprint(pw, event)
+			// reasoning is charged as it streams, like content
+			require.Eventually(t, func() bool { return tokens.Remaining() == 55 }, time.Second, 5*time.Millisecond)
+			pw.Close()
+			require.Equal(t, http.StatusOK, (<-done).Code)
+		})
+	}
+}
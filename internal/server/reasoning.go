@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// where reasoning_format puts the reasoning. deepseek is reasoning_content
+// as the formatters produce it, openai a reasoning field on the final
+// message, tags <think> inline in content and none drops it
+const (
+	reasoningDeepseek = "deepseek"
+	reasoningOpenAI   = "openai"
+	reasoningTags     = "tags"
+	reasoningNone     = "none"
+)
+
+// reasoningWriter moves reasoning_content to where reasoning_format wants
+// it. streams are rewritten event by event, json bodies once the handler
+// returns
+type reasoningWriter struct {
+	http.ResponseWriter
+	format  string
+	stream  bool
+	decided bool
+	buf     bytes.Buffer
+	// openai: the reasoning streamed so far
+	reasoning strings.Builder
+	// tags: a <think> was sent and not closed yet
+	open bool
+}
+
+func newReasoningWriter(w http.ResponseWriter, format string) *reasoningWriter {
+	return &reasoningWriter{ResponseWriter: w, format: format}
+}
+
+func (rw *reasoningWriter) WriteHeader(code int) {
+	if !rw.decided {
+		rw.decided = true
+		rw.stream = strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream")
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *reasoningWriter) Write(b []byte) (int, error) {
+	if !rw.decided {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.buf.Write(b)
+
+	if rw.stream {
+		for {
+			event, ok := nextEvent(&rw.buf)
+			if !ok {
+				break
+			}
+			rw.writeEvent(event)
+		}
+	}
+	return len(b), nil
+}
+
+func (rw *reasoningWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+func (rw *reasoningWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *reasoningWriter) writeEvent(event []byte) {
+	var chunk map[string]any
+	data, ok := bytes.CutPrefix(event, []byte("data: "))
+	if !ok || json.Unmarshal(data, &chunk) != nil || chunk["object"] != "chat.completion.chunk" {
+		rw.ResponseWriter.Write(append(event, '\n', '\n'))
+		return
+	}
+
+	if !rw.chunk(chunk) {
+		return
+	}
+	out, _ := json.Marshal(chunk)
+	fmt.Fprintf(rw.ResponseWriter, "data: %s\n\n", out)
+}
+
+// chunk rewrites the deltas of a stream chunk, false drops a chunk that
+// only carried reasoning
+func (rw *reasoningWriter) chunk(chunk map[string]any) bool {
+	choices, _ := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		return true
+	}
+
+	keep := false
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		delta, _ := choice["delta"].(map[string]any)
+		finished := choice["finish_reason"] != nil
+		if delta == nil {
+			keep = keep || finished
+			continue
+		}
+
+		r, had := delta["reasoning_content"].(string)
+		delete(delta, "reasoning_content")
+		r = bareReasoning(r)
+		if !rw.open && rw.reasoning.Len() == 0 {
+			r = strings.TrimLeft(r, "\n")
+		}
+
+		switch rw.format {
+		case reasoningOpenAI:
+			rw.reasoning.WriteString(r)
+			if finished && rw.reasoning.Len() > 0 {
+				delta["reasoning"] = strings.TrimSpace(rw.reasoning.String())
+			}
+		case reasoningTags:
+			var text string
+			if r != "" {
+				if !rw.open {
+					text = "<think>\n"
+					rw.open = true
+				}
+				text += r
+			}
+			content, _ := delta["content"].(string)
+			if rw.open && (content != "" || finished || delta["tool_calls"] != nil) {
+				text = strings.TrimRight(text, "\n") + "\n</think>\n\n"
+				rw.open = false
+			}
+			if text != "" {
+				delta["content"] = text + content
+			}
+		}
+
+		_, role := delta["role"]
+		empty := len(delta) == 0 || (len(delta) == 1 && role)
+		keep = keep || finished || !had || !empty
+	}
+	return keep
+}
+
+// finish rewrites the message of a json completion
+func (rw *reasoningWriter) finish() {
+	if rw.stream || rw.buf.Len() == 0 {
+		rw.ResponseWriter.Write(rw.buf.Bytes())
+		return
+	}
+
+	var obj map[string]any
+	if json.Unmarshal(rw.buf.Bytes(), &obj) != nil || obj["choices"] == nil {
+		rw.ResponseWriter.Write(rw.buf.Bytes())
+		return
+	}
+
+	choices, _ := obj["choices"].([]any)
+	for _, c := range choices {
+		choice, _ := c.(map[string]any)
+		msg, _ := choice["message"].(map[string]any)
+		if msg == nil {
+			continue
+		}
+		r, _ := msg["reasoning_content"].(string)
+		delete(msg, "reasoning_content")
+		r = strings.TrimSpace(bareReasoning(r))
+		if r == "" {
+			continue
+		}
+
+		switch rw.format {
+		case reasoningOpenAI:
+			msg["reasoning"] = r
+		case reasoningTags:
+			content, _ := msg["content"].(string)
+			msg["content"] = "<think>\n" + r + "\n</think>\n\n" + content
+		}
+	}
+	json.NewEncoder(rw.ResponseWriter).Encode(obj)
+}
+
+// bareReasoning drops the <reasoning> wrapper think_mode reasoning leaves
+// around z.ai thinking, reasoning_format places the text itself
+func bareReasoning(s string) string {
+	s = strings.ReplaceAll(s, "<reasoning>", "")
+	return strings.ReplaceAll(s, "</reasoning>", "")
+}
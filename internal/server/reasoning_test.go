@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// openaiBody replies with a fixed openai shaped body
+type openaiBody struct{ bodyProvider }
+
+func (openaiBody) RepliesOpenAI() {}
+
+var blankLines = regexp.MustCompile(`\n+`)
+
+// reply is what a client reads of a completion, streamed or not
+type reply struct {
+	content, reasoningContent, reasoning string
+}
+
+func readReply(t *testing.T, body string, stream bool) reply {
+	t.Helper()
+	var r reply
+	add := func(m map[string]any) {
+		s, _ := m["content"].(string)
+		r.content += s
+		s, _ = m["reasoning_content"].(string)
+		r.reasoningContent += s
+		s, _ = m["reasoning"].(string)
+		r.reasoning += s
+	}
+
+	if !stream {
+		var obj struct {
+			Choices []struct{ Message map[string]any }
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &obj))
+		require.Len(t, obj.Choices, 1)
+		add(obj.Choices[0].Message)
+		return r
+	}
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct{ Delta map[string]any }
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		for _, c := range chunk.Choices {
+			require.NotEmpty(t, c.Delta, "chunks that only carried reasoning are dropped: %s", data)
+			add(c.Delta)
+		}
+	}
+	return r
+}
+
+func TestReasoningFormat(t *testing.T) {
+	upstreams := map[string]func(stream bool) provider.Provider{
+		"zlm": func(bool) provider.Provider {
+			return bodyProvider{body: func() io.ReadCloser {
+				return io.NopCloser(strings.NewReader(
+					`data: {"data": {"phase": "thinking", "delta_content": "<details>\n> let me think\n</details>"}}` + "\n\n" +
+						`data: {"data": {"phase": "answer", "delta_content": "Hello"}}` + "\n\n" +
+						`data: {"data": {"phase": "answer", "delta_content": " World", "done": true}}` + "\n\n"))
+			}}
+		},
+		"openai": func(stream bool) provider.Provider {
+			body := `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello World","reasoning_content":"let me think"},"finish_reason":"stop"}]}`
+			if stream {
+				body = `data: {"choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"let me think"}}]}` + "\n\n" +
+					`data: {"choices":[{"index":0,"delta":{"content":"Hello"}}]}` + "\n\n" +
+					`data: {"choices":[{"index":0,"delta":{"content":" World"},"finish_reason":"stop"}]}` + "\n\n" +
+					"data: [DONE]\n\n"
+			}
+			return openaiBody{bodyProvider{body: func() io.ReadCloser { return io.NopCloser(strings.NewReader(body)) }}}
+		},
+	}
+
+	tests := []struct {
+		format string
+		want   reply
+	}{
+		{"deepseek", reply{content: "Hello World", reasoningContent: "let me think"}},
+		{"openai", reply{content: "Hello World", reasoning: "let me think"}},
+		{"tags", reply{content: "<think>\nlet me think\n</think>\nHello World"}},
+		{"none", reply{content: "Hello World"}},
+	}
+
+	for name, upstream := range upstreams {
+		for _, tt := range tests {
+			for _, stream := range []bool{false, true} {
+				mode := "json"
+				if stream {
+					mode = "stream"
+				}
+				t.Run(name+"_"+tt.format+"_"+mode, func(t *testing.T) {
+					// think_mode details would inline the reasoning, reasoning_format wins
+					cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "details", ReasoningOnly: "passthrough"}}
+					h := ChatCompletions(config.Static(cfg), provider.NewRegistry(upstream(stream)), nil, &MockTokener{}, nil)
+
+					body, _ := json.Marshal(map[string]any{
+						"model":            "glm",
+						"stream":           stream,
+						"reasoning_format": tt.format,
+						"messages":         []map[string]string{{"role": "user", "content": "hi"}},
+					})
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+					require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+					// streams may leave blank lines json bodies trim, deepseek keeps
+					// the <reasoning> wrapper think_mode reasoning gives z.ai thinking
+					got := readReply(t, w.Body.String(), stream)
+					got.content = blankLines.ReplaceAllString(got.content, "\n")
+					got.reasoningContent = strings.TrimSpace(bareReasoning(got.reasoningContent))
+					assert.Equal(t, tt.want, got)
+				})
+			}
+		}
+	}
+}
+
+func TestReasoningFormatInvalid(t *testing.T) {
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	h := ChatCompletions(config.Static(cfg), provider.NewRegistry(bodyProvider{}), nil, &MockTokener{}, nil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"reasoning_format":"xml","messages":[{"role":"user","content":"hi"}]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
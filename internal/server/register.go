@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/browser"
+	"github.com/zarazaex69/mo/internal/pkg/crypto"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/tempmail"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/provider/qwen"
+	"github.com/zarazaex69/mo/internal/service/registration"
+)
+
+type mailbox interface {
+	CreateEmail() (*tempmail.Email, error)
+	WaitForMessage(email, fromMatch, subjectMatch string, timeout, interval time.Duration) (*tempmail.Message, error)
+}
+
+// registrar creates accounts on temp emails. unless a captcha solver is
+// configured the browser is visible and the captcha needs a human,
+// onCaptcha fires when it is their turn
+type registrar struct {
+	store   *tokenstore.Store
+	configs config.Provider
+	browser func(onCaptcha func()) (browser.Registrar, error)
+	mail    func() mailbox
+}
+
+func newRegistrar(store *tokenstore.Store, configs config.Provider) *registrar {
+	return &registrar{
+		store:   store,
+		configs: configs,
+		browser: func(onCaptcha func()) (browser.Registrar, error) {
+			cfg := configs.Config().Browser
+			br, err := browser.New(cfg.Headless)
+			if err != nil {
+				return nil, err
+			}
+			br.OnCaptcha = onCaptcha
+			br.DebugDir = cfg.DebugDir
+			br.KeepOpen = cfg.KeepOpen
+			br.Waits = browser.Waits{
+				Captcha:         cfg.Captcha.Timeout,
+				Redirect:        cfg.RedirectTimeout,
+				Token:           cfg.TokenTimeout,
+				Element:         cfg.ElementTimeout,
+				Poll:            cfg.PollInterval,
+				OptionalElement: cfg.OptionalElementTimeout,
+			}
+			br.Retry = stepRetry(cfg)
+			if cfg.Captcha.Solver == "external" {
+				br.Solver = &browser.ExternalSolver{
+					Endpoint: cfg.Captcha.Endpoint,
+					APIKey:   cfg.Captcha.APIKey,
+					Method:   cfg.Captcha.Method,
+				}
+			}
+			return br, nil
+		},
+		mail: func() mailbox {
+			cfg := configs.Config().TempMail
+			return tempmail.Open(cfg.Providers, tempmail.IMAPConfig(cfg.IMAP))
+		},
+	}
+}
+
+func stepRetry(cfg config.BrowserConfig) browser.RetryPolicy {
+	return browser.RetryPolicy{MaxAttempts: cfg.StepAttempts, Delay: cfg.StepRetryDelay}
+}
+
+// waitForMail waits for the message of a flow, a failing mailbox api is
+// retried rather than failing the run
+func (g *registrar) waitForMail(mail mailbox, email, from, subject string) (*tempmail.Message, error) {
+	cfg := g.configs.Config().Browser
+	var msg *tempmail.Message
+	err := stepRetry(cfg).Do("email", func() error {
+		var err error
+		msg, err = mail.WaitForMessage(email, from, subject, cfg.VerifyEmailTimeout, cfg.EmailPollInterval)
+		if err == nil && msg == nil {
+			// the mailbox timed out, the mail may still come on the next try
+			err = fmt.Errorf("no email from %s within %s", from, cfg.VerifyEmailTimeout)
+		}
+		return err
+	})
+	return msg, err
+}
+
+// signup registers one account with a ready email and browser
+type signup func(br browser.Registrar, mail mailbox, creds browser.Credentials, set func(string)) (*tokenstore.Token, error)
+
+// session runs signups on one browser, opened by the first account and
+// reset between the next ones
+func (g *registrar) session(register signup) (registration.Flow, func()) {
+	var br browser.Registrar
+	var state func(string)
+
+	account := func(set func(string)) (*tokenstore.Token, error) {
+		state = set
+		set(registration.CreatingEmail)
+		mail := g.mail()
+		email, err := mail.CreateEmail()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp email: %w", err)
+		}
+		logger.Info().Str("email", email.Address).Str("mail_provider", email.Provider).Msg("temp mailbox created")
+
+		creds := browser.Credentials{
+			Email:    email.Address,
+			Password: crypto.GeneratePassword(16),
+			Name:     strings.Split(email.Address, "@")[0],
+		}
+
+		set(registration.FillingForm)
+		if br == nil {
+			opened, err := g.browser(func() { state(registration.AwaitingCaptcha) })
+			if err != nil {
+				return nil, fmt.Errorf("failed to start browser: %w", err)
+			}
+			br = opened
+		} else if err := br.Reset(); err != nil {
+			return nil, fmt.Errorf("failed to reset browser: %w", err)
+		}
+		return register(br, mail, creds, set)
+	}
+
+	end := func() {
+		if br != nil {
+			br.Close()
+		}
+	}
+	return account, end
+}
+
+func (g *registrar) glmSession() (registration.Flow, func())  { return g.session(g.signupGLM) }
+func (g *registrar) qwenSession() (registration.Flow, func()) { return g.session(g.signupQwen) }
+
+// glm registers a z.ai account and stores its token
+func (g *registrar) glm(set func(string)) (*tokenstore.Token, error) {
+	account, end := g.glmSession()
+	defer end()
+	return account(set)
+}
+
+// qwen registers a qwen account and stores the oauth token pair of the
+// device flow
+func (g *registrar) qwen(set func(string)) (*tokenstore.Token, error) {
+	account, end := g.qwenSession()
+	defer end()
+	return account(set)
+}
+
+func (g *registrar) signupGLM(br browser.Registrar, mail mailbox, creds browser.Credentials, set func(string)) (*tokenstore.Token, error) {
+	if _, err := br.RegisterZAI(creds); err != nil {
+		return nil, fmt.Errorf("registration failed: %w", err)
+	}
+
+	set(registration.AwaitingVerification)
+	msg, err := g.waitForMail(mail, creds.Email, "z.ai", "verify")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get verification email: %w", err)
+	}
+
+	link := tempmail.ExtractVerifyLink(msg.BodyText)
+	if link == "" {
+		link = tempmail.ExtractVerifyLink(msg.BodyHTML)
+	}
+	if link == "" {
+		return nil, errors.New("verify link not found")
+	}
+
+	token, err := br.VerifyEmail(link, creds.Password)
+	if err != nil {
+		return nil, fmt.Errorf("verification failed: %w", err)
+	}
+
+	set(registration.SavingToken)
+	saved, err := g.store.Add(creds.Email, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save token: %w", err)
+	}
+	return saved, nil
+}
+
+func (g *registrar) signupQwen(br browser.Registrar, mail mailbox, creds browser.Credentials, set func(string)) (*tokenstore.Token, error) {
+	if err := br.RegisterQwen(creds.Email, creds.Password, creds.Name); err != nil {
+		return nil, fmt.Errorf("registration failed: %w", err)
+	}
+
+	set(registration.AwaitingVerification)
+	msg, err := g.waitForMail(mail, creds.Email, "qwen", "active")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activation email: %w", err)
+	}
+
+	link := tempmail.ExtractQwenActivationLink(msg.BodyText)
+	if link == "" {
+		link = tempmail.ExtractQwenActivationLink(msg.BodyHTML)
+	}
+	if link == "" {
+		return nil, errors.New("activation link not found")
+	}
+
+	if err := br.ActivateQwen(link); err != nil {
+		return nil, fmt.Errorf("activation failed: %w", err)
+	}
+
+	set(registration.Authorizing)
+	deviceCode, err := qwen.RequestDeviceCode()
+	if err != nil {
+		return nil, fmt.Errorf("device code failed: %w", err)
+	}
+	if err := br.ConfirmQwenAuth(deviceCode.VerificationURIComplete); err != nil {
+		return nil, fmt.Errorf("auth confirmation failed: %w", err)
+	}
+
+	var token *qwen.OAuthToken
+	for range 20 {
+		time.Sleep(3 * time.Second)
+		token, err = qwen.PollForToken(deviceCode.DeviceCode, deviceCode.CodeVerifier)
+		if err != nil {
+			return nil, fmt.Errorf("token poll failed: %w", err)
+		}
+		if token != nil {
+			break
+		}
+	}
+	if token == nil {
+		return nil, errors.New("token poll timeout")
+	}
+
+	set(registration.SavingToken)
+	saved, err := g.store.AddWithProvider("qwen", creds.Email, token.AccessToken, token.RefreshToken, token.ExpiryDate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save token: %w", err)
+	}
+	if token.ResourceURL != "" {
+		saved.ResourceURL = token.ResourceURL
+		if err := g.store.Update(saved); err != nil {
+			return nil, fmt.Errorf("failed to save token: %w", err)
+		}
+	}
+	return saved, nil
+}
+
+// StartRegistration runs a registration in the background and answers
+// 202 with the job to poll, the flow takes minutes
+func StartRegistration(jobs *registration.Jobs, provider string, flow registration.Flow) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := jobs.Start(provider, flow)
+		if errors.Is(err, registration.ErrBusy) {
+			writeErr(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		writeJob(w, http.StatusAccepted, job)
+	}
+}
+
+// batches larger than this are refused, each account takes minutes
+const maxBatch = 50
+
+// BatchRegistration registers {"count": n, "provider": "glm"} accounts one
+// after another on a shared browser, answering 202 with the job to poll
+func BatchRegistration(jobs *registration.Jobs, sessions map[string]registration.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Count    int    `json:"count"`
+			Provider string `json:"provider"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		if req.Provider == "" || req.Provider == "zai" {
+			req.Provider = "glm"
+		}
+		session, ok := sessions[req.Provider]
+		if !ok {
+			writeErr(w, http.StatusBadRequest, fmt.Sprintf("unknown provider %q", req.Provider))
+			return
+		}
+		if req.Count < 1 || req.Count > maxBatch {
+			writeErr(w, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", maxBatch))
+			return
+		}
+
+		job, err := jobs.StartBatch(req.Provider, req.Count, session)
+		if errors.Is(err, registration.ErrBusy) {
+			writeErr(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJob(w, http.StatusAccepted, job)
+	}
+}
+
+// CancelRegistration stops a batch once the account in progress is through
+func CancelRegistration(jobs *registration.Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := jobs.Cancel(chi.URLParam(r, "job"))
+		switch {
+		case errors.Is(err, registration.ErrNotFound):
+			writeErr(w, http.StatusNotFound, err.Error())
+		case err != nil:
+			writeErr(w, http.StatusConflict, err.Error())
+		default:
+			writeJob(w, http.StatusAccepted, job)
+		}
+	}
+}
+
+// writeJob answers with the job and where to poll it
+func writeJob(w http.ResponseWriter, code int, job registration.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/auth/register/"+job.ID)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(job)
+}
+
+// RegistrationStatus reports the state of a registration and, once done,
+// the stored token. with Accept: text/event-stream every state change is
+// sent as an event until the job finishes
+func RegistrationStatus(jobs *registration.Jobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "job")
+		job, ok := jobs.Get(id)
+		if !ok {
+			writeErr(w, http.StatusNotFound, registration.ErrNotFound.Error())
+			return
+		}
+
+		flusher, canStream := w.(http.Flusher)
+		if !canStream || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(job)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		ticker := time.NewTicker(registrationPoll)
+		defer ticker.Stop()
+
+		sent := 0
+		for {
+			for _, tr := range job.History[sent:] {
+				data, _ := json.Marshal(tr)
+				fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			}
+			sent = len(job.History)
+			if job.Finished() {
+				data, _ := json.Marshal(job)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", job.State, data)
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			job, _ = jobs.Get(id)
+		}
+	}
+}
+
+// how often a streamed status checks the job
+var registrationPoll = 500 * time.Millisecond
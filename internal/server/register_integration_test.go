@@ -0,0 +1,42 @@
+//go:build integration
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/service/registration"
+)
+
+// drives a real qwen registration, a browser window opens for the captcha:
+// go test -tags integration -run TestQwenRegistration -timeout 15m ./internal/server
+func TestQwenRegistration(t *testing.T) {
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+
+	jobs := registration.NewJobs(store)
+	job, err := jobs.Start("qwen", newRegistrar(store, config.Static(config.Get())).qwen)
+	require.NoError(t, err)
+
+	seen := 0
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		for _, tr := range job.History[seen:] {
+			t.Log(tr.State)
+		}
+		seen = len(job.History)
+		return job.Finished()
+	}, 10*time.Minute, time.Second)
+
+	require.Equal(t, registration.Done, job.State, job.Reason)
+	active, err := store.GetActiveByProvider("qwen")
+	require.NoError(t, err)
+	require.NotNil(t, active)
+	require.Equal(t, job.Token.ID, active.ID)
+	require.NotEmpty(t, active.RefreshToken)
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/browser"
+	"github.com/zarazaex69/mo/internal/pkg/tempmail"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+	"github.com/zarazaex69/mo/internal/service/registration"
+)
+
+// fakeBrowser waits in the captcha until solved is closed
+type fakeBrowser struct {
+	onCaptcha func()
+	solved    chan struct{}
+	verifyErr error
+	// verifications that fail, numbered from 1
+	failVerify map[int]bool
+	verified   int
+	resets     int
+	closed     bool
+}
+
+func (b *fakeBrowser) RegisterZAI(browser.Credentials) (string, error) {
+	b.onCaptcha()
+	<-b.solved
+	return "", nil
+}
+
+func (b *fakeBrowser) VerifyEmail(link, password string) (string, error) {
+	b.verified++
+	if b.verifyErr != nil {
+		return "", b.verifyErr
+	}
+	if b.failVerify[b.verified] {
+		return "", errors.New("redirect timeout")
+	}
+	return "glm-token-for-" + link, nil
+}
+
+func (b *fakeBrowser) RegisterQwen(email, password, name string) error { return nil }
+func (b *fakeBrowser) ActivateQwen(string) error                       { return nil }
+func (b *fakeBrowser) ConfirmQwenAuth(string) error                    { return nil }
+func (b *fakeBrowser) Reset() error                                    { b.resets++; return nil }
+func (b *fakeBrowser) Close()                                          { b.closed = true }
+
+// fakeMailbox fails the first fails waits and times out on the silent ones
+// after them, then delivers the verification
+type fakeMailbox struct {
+	fails    int
+	silent   int
+	waits    int
+	timeout  time.Duration
+	interval time.Duration
+}
+
+func (*fakeMailbox) CreateEmail() (*tempmail.Email, error) {
+	return &tempmail.Email{Address: "someone@example.com"}, nil
+}
+
+func (m *fakeMailbox) WaitForMessage(email, from, subject string, timeout, interval time.Duration) (*tempmail.Message, error) {
+	m.waits++
+	m.timeout, m.interval = timeout, interval
+	if m.waits <= m.fails {
+		return nil, errors.New("temp-mail: 502 bad gateway")
+	}
+	if m.waits <= m.fails+m.silent {
+		return nil, nil
+	}
+	return &tempmail.Message{Subject: "Verify", BodyText: "click https://chat.z.ai/auth/verify_email?token=abc&email=someone@example.com"}, nil
+}
+
+func testRegistrar(t *testing.T, br *fakeBrowser) (*registrar, *tokenstore.Store) {
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	return &registrar{
+		store:   store,
+		configs: config.Static(&config.Config{Browser: config.BrowserConfig{StepAttempts: 1}}),
+		browser: func(onCaptcha func()) (browser.Registrar, error) {
+			br.onCaptcha = onCaptcha
+			return br, nil
+		},
+		mail: func() mailbox { return &fakeMailbox{} },
+	}, store
+}
+
+func TestRegisterGLM(t *testing.T) {
+	br := &fakeBrowser{solved: make(chan struct{})}
+	reg, store := testRegistrar(t, br)
+
+	jobs := registration.NewJobs(store)
+	router := chi.NewRouter()
+	router.Post("/auth/register", StartRegistration(jobs, "glm", reg.glm))
+	router.Get("/auth/register/{job}", RegistrationStatus(jobs))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/auth/register", nil))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var started registration.Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+	assert.Equal(t, "/auth/register/"+started.ID, w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/auth/register", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	poll := func() registration.Job {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/auth/register/"+started.ID, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var job registration.Job
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+		return job
+	}
+
+	require.Eventually(t, func() bool { return poll().State == registration.AwaitingCaptcha }, time.Second, time.Millisecond)
+
+	close(br.solved)
+	require.Eventually(t, func() bool { return poll().State == registration.Done }, time.Second, time.Millisecond)
+
+	job := poll()
+	var seen []string
+	for _, tr := range job.History {
+		seen = append(seen, tr.State)
+	}
+	assert.Equal(t, []string{
+		registration.CreatingEmail, registration.FillingForm, registration.AwaitingCaptcha,
+		registration.AwaitingVerification, registration.SavingToken, registration.Done,
+	}, seen)
+	assert.True(t, br.closed)
+
+	active, err := store.GetActive()
+	require.NoError(t, err)
+	require.NotNil(t, active)
+	assert.Equal(t, job.Token.ID, active.ID)
+	assert.Equal(t, "someone@example.com", active.Email)
+	assert.True(t, strings.HasPrefix(active.Token, "glm-token-for-https://chat.z.ai/auth/verify_email"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/auth/register/nope", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRegisterGLMFailure(t *testing.T) {
+	br := &fakeBrowser{solved: make(chan struct{}), verifyErr: errors.New("redirect timeout")}
+	close(br.solved)
+	reg, store := testRegistrar(t, br)
+
+	jobs := registration.NewJobs(store)
+	job, err := jobs.Start("glm", reg.glm)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, registration.Failed, job.State)
+	assert.Equal(t, "verification failed: redirect timeout", job.Reason)
+
+	tokens, err := store.List()
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func TestRegisterRetriesMailbox(t *testing.T) {
+	br := &fakeBrowser{solved: make(chan struct{})}
+	close(br.solved)
+	reg, store := testRegistrar(t, br)
+
+	mail := &fakeMailbox{fails: 1}
+	reg.mail = func() mailbox { return mail }
+	reg.configs = config.Static(&config.Config{Browser: config.BrowserConfig{
+		VerifyEmailTimeout: 7 * time.Minute,
+		EmailPollInterval:  time.Second,
+		StepAttempts:       2,
+	}})
+
+	jobs := registration.NewJobs(store)
+	job, err := jobs.Start("glm", reg.glm)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, registration.Done, job.State, job.Reason)
+	assert.Equal(t, 2, mail.waits)
+	assert.Equal(t, 7*time.Minute, mail.timeout)
+	assert.Equal(t, time.Second, mail.interval)
+
+	// one attempt gives up on the first failure
+	mail.fails, mail.waits = 2, 0
+	reg.configs = config.Static(&config.Config{Browser: config.BrowserConfig{StepAttempts: 1}})
+	job, err = jobs.Start("glm", reg.glm)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, registration.Failed, job.State)
+	assert.Equal(t, "failed to get verification email: temp-mail: 502 bad gateway", job.Reason)
+	assert.Equal(t, 1, mail.waits)
+
+	// a mailbox that timed out without the email is tried again too
+	mail.fails, mail.silent, mail.waits = 0, 1, 0
+	reg.configs = config.Static(&config.Config{Browser: config.BrowserConfig{VerifyEmailTimeout: time.Minute, StepAttempts: 1}})
+	job, err = jobs.Start("glm", reg.glm)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "failed to get verification email: no email from z.ai within 1m0s", job.Reason)
+
+	mail.waits = 0
+	reg.configs = config.Static(&config.Config{Browser: config.BrowserConfig{StepAttempts: 2}})
+	job, err = jobs.Start("glm", reg.glm)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, registration.Done, job.State, job.Reason)
+	assert.Equal(t, 2, mail.waits)
+}
+
+func TestRegisterBatch(t *testing.T) {
+	br := &fakeBrowser{solved: make(chan struct{}), failVerify: map[int]bool{2: true}}
+	close(br.solved)
+	reg, store := testRegistrar(t, br)
+	opened := 0
+	open := reg.browser
+	reg.browser = func(onCaptcha func()) (browser.Registrar, error) {
+		opened++
+		return open(onCaptcha)
+	}
+
+	jobs := registration.NewJobs(store)
+	router := chi.NewRouter()
+	router.Post("/auth/register/batch", BatchRegistration(jobs, map[string]registration.Session{"glm": reg.glmSession}))
+
+	for _, body := range []string{`{"count": 0}`, `{"count": 51}`, `{"count": 2, "provider": "claude"}`, `nope`} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/auth/register/batch", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/auth/register/batch", strings.NewReader(`{"count": 3, "provider": "zai"}`)))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var job registration.Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, "glm", job.Provider)
+	assert.Equal(t, "/auth/register/"+job.ID, w.Header().Get("Location"))
+
+	require.Eventually(t, func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, registration.Done, job.State)
+	require.Len(t, job.Results, 3)
+	assert.NotNil(t, job.Results[0].Token)
+	assert.Equal(t, "verification failed: redirect timeout", job.Results[1].Error)
+	assert.NotNil(t, job.Results[2].Token)
+
+	// one window for the whole batch, signed out between accounts
+	assert.Equal(t, 1, opened)
+	assert.Equal(t, 2, br.resets)
+	assert.True(t, br.closed)
+
+	tokens, err := store.List()
+	require.NoError(t, err)
+	assert.Len(t, tokens, 2)
+}
+
+func TestCancelRegistration(t *testing.T) {
+	jobs := registration.NewJobs(nil)
+	router := chi.NewRouter()
+	router.Post("/auth/register/{job}/cancel", CancelRegistration(jobs))
+
+	release := make(chan struct{})
+	defer close(release)
+	batch, err := jobs.StartBatch("glm", 2, func() (registration.Flow, func()) {
+		return func(func(string)) (*tokenstore.Token, error) {
+			<-release
+			return nil, nil
+		}, func() {}
+	})
+	require.NoError(t, err)
+	single, err := jobs.Start("qwen", func(func(string)) (*tokenstore.Token, error) {
+		<-release
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	cancel := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/auth/register/"+id+"/cancel", nil))
+		return w
+	}
+
+	w := cancel(batch.ID)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var job registration.Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.True(t, job.Cancelling)
+
+	assert.Equal(t, http.StatusConflict, cancel(single.ID).Code)
+	assert.Equal(t, http.StatusNotFound, cancel("nope").Code)
+}
+
+func TestRegistrationEvents(t *testing.T) {
+	registrationPoll = time.Millisecond
+	defer func() { registrationPoll = 500 * time.Millisecond }()
+
+	step := make(chan string)
+	jobs := registration.NewJobs(nil)
+	job, err := jobs.Start("glm", func(set func(string)) (*tokenstore.Token, error) {
+		for state := range step {
+			set(state)
+		}
+		return nil, errors.New("captcha timeout")
+	})
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Get("/auth/register/{job}", RegistrationStatus(jobs))
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/auth/register/"+job.ID, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	go func() {
+		step <- registration.FillingForm
+		step <- registration.AwaitingCaptcha
+		close(step)
+	}()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, name)
+		}
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok && events[len(events)-1] == "state" {
+			var tr registration.Transition
+			require.NoError(t, json.Unmarshal([]byte(data), &tr))
+			events[len(events)-1] = tr.State
+		}
+	}
+	assert.Equal(t, []string{
+		registration.CreatingEmail, registration.FillingForm, registration.AwaitingCaptcha,
+		registration.Failed, registration.Failed,
+	}, events)
+}
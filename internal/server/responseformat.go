@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/jsonschema"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// finish_reason of a json mode reply that failed validation
+const finishInvalidJSON = "invalid_json"
+
+// checkResponseFormat validates the final text of a json mode reply. it
+// returns the text without markdown fences and, when the reply does not
+// satisfy the requested format, a detail for the client
+func checkResponseFormat(rf *domain.ResponseFormat, content string) (string, string) {
+	if !rf.WantsJSON() {
+		return content, ""
+	}
+
+	text := stripFences(content)
+
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return content, "reply is not valid json: " + err.Error()
+	}
+
+	if rf.Type == "json_object" {
+		if _, ok := v.(map[string]any); !ok {
+			return text, "reply is not a json object"
+		}
+	}
+
+	if rf.Type == "json_schema" && rf.JSONSchema != nil && rf.JSONSchema.Schema != nil {
+		if err := jsonschema.Validate(rf.JSONSchema.Schema, v); err != nil {
+			return text, "reply does not match schema: " + err.Error()
+		}
+	}
+
+	return text, ""
+}
+
+// stripFences removes a ```json ... ``` wrapper models like to add
+func stripFences(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	} else {
+		s = strings.TrimPrefix(s, "```")
+	}
+	s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+	return strings.TrimSpace(s)
+}
+
+// formatWarning is the trailing stream event carrying a validation failure
+func formatWarning(detail string) map[string]any {
+	return map[string]any{
+		"object":  "mo.warning",
+		"code":    finishInvalidJSON,
+		"message": detail,
+	}
+}
+
+// retryForFormat asks once more, showing the model its invalid reply
+func retryForFormat(ctx context.Context, req *domain.ChatRequest, cfg *config.Config, p provider.Provider, previous, detail string) *zlmResult {
+	retry := *req
+	retry.Messages = append(append([]domain.Message(nil), req.Messages...),
+		domain.Message{Role: "assistant", Content: previous},
+		domain.Message{Role: "user", Content: "That reply was rejected (" + detail + "). " +
+			"Answer again with only the JSON document, no prose and no code fences."},
+	)
+
+	resp, err := p.SendChatRequest(ctx, &retry, utils.GenerateRequestID())
+	if err != nil {
+		logger.FromContext(ctx).Warn().Err(err).Msg("response_format retry failed")
+		return nil
+	}
+	defer resp.Body.Close()
+
+	return collectZlmResponse(ctx, resp, cfg, nil, nil)
+}
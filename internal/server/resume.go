@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// shortest repeat of the partial text that is trimmed from a continuation
+const minResumeOverlap = 8
+
+// resumable reports whether a cut reply can be continued from its text.
+// tool calls and images cannot be replayed as a plain prefix
+func resumable(req *domain.ChatRequest, partial *zlmResult) bool {
+	if partial.content == "" || len(partial.toolCalls) > 0 || partial.partialTool || partial.capped != "" {
+		return false
+	}
+	if len(req.Tools) > 0 {
+		return false
+	}
+	for _, msg := range req.Messages {
+		if len(msg.ToolCalls) > 0 || msg.Role == "tool" || hasImage(msg.Content) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasImage(content any) bool {
+	arr, ok := content.([]any)
+	if !ok {
+		return false
+	}
+	for _, item := range arr {
+		if m, ok := item.(map[string]any); ok && m["type"] == "image_url" {
+			return true
+		}
+	}
+	return false
+}
+
+// resumePartial asks upstream to continue the partial reply and stitches
+// both parts. it returns the prompt tokens the second call cost
+func resumePartial(ctx context.Context, req *domain.ChatRequest, cfg *config.Config, p provider.Provider, partial *zlmResult, tokenizer utils.Tokener) (*zlmResult, int) {
+	resume := *req
+	resume.ContinueFinalMessage = true
+	resume.Messages = append(append([]domain.Message(nil), req.Messages...),
+		domain.Message{Role: "assistant", Content: partial.content},
+	)
+
+	resp, err := p.SendChatRequest(ctx, &resume, utils.GenerateRequestID())
+	if err != nil {
+		logger.FromContext(ctx).Warn().Err(err).Msg("resume of partial reply failed")
+		return nil, 0
+	}
+	defer resp.Body.Close()
+
+	rest := collectZlmResponse(ctx, resp, cfg, nil, nil)
+	if len(rest.toolCalls) > 0 || rest.partialTool {
+		return nil, 0
+	}
+	metrics.Inc("resumed_completions", req.Model)
+
+	return &zlmResult{
+		content:   stitch(partial.content, rest.content),
+		reasoning: partial.reasoning + rest.reasoning,
+		summaries: append(partial.summaries, rest.summaries...),
+		events:    append(partial.events, rest.events...),
+		complete:  rest.complete,
+		err:       rest.err,
+	}, utils.CountChatTokens(tokenizer, &resume, cfg.Tokenizer.ImageTokens)
+}
+
+// stitch joins a cut reply and its continuation. models often restate the
+// last words of the prefix, or the whole reply, before going on
+func stitch(prefix, rest string) string {
+	if strings.HasPrefix(rest, prefix) {
+		return rest
+	}
+
+	for k := min(len(prefix), len(rest)); k >= minResumeOverlap; k-- {
+		if strings.HasSuffix(prefix, rest[:k]) {
+			return prefix + rest[k:]
+		}
+	}
+	return prefix + rest
+}
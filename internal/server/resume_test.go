@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// faultyBody serves the first n bytes of an upstream stream, then fails
+// the way a dropped connection does
+type faultyBody struct {
+	r io.Reader
+}
+
+func cutBody(stream string, n int) io.ReadCloser {
+	return io.NopCloser(&faultyBody{r: strings.NewReader(stream[:n])})
+}
+
+func (f *faultyBody) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func answerStream(deltas ...string) string {
+	var b strings.Builder
+	for i, d := range deltas {
+		data, _ := json.Marshal(d)
+		done := ""
+		if i == len(deltas)-1 {
+			done = `, "done": true`
+		}
+		b.WriteString(`data: {"data": {"phase": "answer", "delta_content": ` + string(data) + done + "}}\n\n")
+	}
+	return b.String()
+}
+
+func TestStitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		rest   string
+		want   string
+	}{
+		{"clean continuation", "The quick brown ", "fox jumps.", "The quick brown fox jumps."},
+		{"restated tail", "The quick brown fox ", "brown fox jumps.", "The quick brown fox jumps."},
+		{"restarted from scratch", "The quick ", "The quick brown fox jumps.", "The quick brown fox jumps."},
+		{"short overlap is kept", "I said no", "no more.", "I said nono more."},
+		{"empty continuation", "The quick", "", "The quick"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, stitch(tt.prefix, tt.rest))
+		})
+	}
+}
+
+func TestResumePartial(t *testing.T) {
+	full := answerStream("The quick brown fox ", "jumps over ", "the lazy dog.")
+	first := strings.Index(full, "\n\n") + 2
+	second := first + strings.Index(full[first:], "\n\n") + 2
+
+	tests := []struct {
+		name        string
+		resume      bool
+		tools       bool
+		cut         int
+		rest        string
+		wantPrefix  string
+		wantContent string
+		wantCalls   int
+	}{
+		{"cut after first event", true, false, first, answerStream("jumps over the lazy dog."), "The quick brown fox ", "The quick brown fox jumps over the lazy dog.", 2},
+		{"cut after second event", true, false, second, answerStream("the lazy dog."), "The quick brown fox jumps over ", "The quick brown fox jumps over the lazy dog.", 2},
+		{"cut mid event", true, false, second + 20, answerStream("fox jumps over the lazy dog."), "The quick brown fox jumps over ", "The quick brown fox jumps over the lazy dog.", 2},
+		{"complete reply is not resumed", true, false, len(full), "", "", "The quick brown fox jumps over the lazy dog.", 1},
+		{"disabled keeps partial", false, false, first, "", "", "The quick brown fox ", 1},
+		{"tools are never resumed", true, true, first, "", "", "The quick brown fox ", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning", ResumePartial: tt.resume}}
+
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+				return !r.ContinueFinalMessage
+			}), mock.Anything).Return(&http.Response{StatusCode: 200, Body: cutBody(full, tt.cut)}, nil).Once()
+
+			if tt.wantCalls > 1 {
+				mockAI.On("SendChatRequest", mock.MatchedBy(func(r *domain.ChatRequest) bool {
+					last := r.Messages[len(r.Messages)-1]
+					return r.ContinueFinalMessage && last.Role == "assistant" && last.Content == tt.wantPrefix
+				}), mock.Anything).Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(tt.rest))}, nil).Once()
+			}
+
+			req := domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "tell me about the fox"}}}
+			if tt.tools {
+				req.Tools = []domain.Tool{{Type: "function", Function: domain.ToolFunction{Name: "search"}}}
+			}
+			body, _ := json.Marshal(req)
+
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var resp domain.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantContent, resp.Choices[0].Message.Content)
+			mockAI.AssertNumberOfCalls(t, "SendChatRequest", tt.wantCalls)
+
+			// usage covers both calls, the prefix is billed as prompt the second time
+			if tt.wantCalls > 1 {
+				assert.Equal(t, 2, resp.Usage.Attempts)
+				assert.Equal(t, 9, resp.Usage.CompletionTokens)
+				// each call: reply priming 3, the user message 3+1+5, the resume
+				// adds the assistant prefix 3+1+words
+				assert.Equal(t, 2*(3+9)+4+len(strings.Fields(tt.wantPrefix)), resp.Usage.PromptTokens)
+			} else {
+				assert.Zero(t, resp.Usage.Attempts)
+			}
+		})
+	}
+}
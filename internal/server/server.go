@@ -1,104 +1,452 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/admission"
 	"github.com/zarazaex69/mo/internal/pkg/crypto"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/ratelimit"
 	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
 	"github.com/zarazaex69/mo/internal/pkg/utils"
 	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/provider/openai"
 	"github.com/zarazaex69/mo/internal/provider/qwen"
 	"github.com/zarazaex69/mo/internal/provider/zlm"
 	"github.com/zarazaex69/mo/internal/service/auth"
+	"github.com/zarazaex69/mo/internal/service/batch"
+	"github.com/zarazaex69/mo/internal/service/conversation"
+	"github.com/zarazaex69/mo/internal/service/failover"
+	"github.com/zarazaex69/mo/internal/service/feversion"
+	"github.com/zarazaex69/mo/internal/service/files"
+	"github.com/zarazaex69/mo/internal/service/health"
+	"github.com/zarazaex69/mo/internal/service/hooks"
+	"github.com/zarazaex69/mo/internal/service/models"
+	"github.com/zarazaex69/mo/internal/service/registration"
+	"github.com/zarazaex69/mo/internal/service/usage"
 )
 
 type Server struct {
-	cfg        *config.Config
+	configs    config.Provider
 	router     *chi.Mux
-	providers  []provider.Provider
+	providers  *provider.Registry
+	catalog    *models.Catalog
 	tokenizer  utils.Tokener
 	tokenStore *tokenstore.Store
+	users      auth.AuthServicer
+	journal    *usage.Journal
+	limiter    *ratelimit.Limiter
+	// caps chat requests in flight, nil without limits.max_in_flight
+	gate *admission.Gate
+	jobs *registration.Jobs
+	// upstream probes of /health/ready by provider name
+	probes map[string]*health.Probe
+	signer *crypto.Signer
+	hosts  *failover.Pool
+	qwen   *qwen.Client
+	// conversation ids pinned to upstream chats
+	conversations *conversation.Map
+	// coalescable chat requests in flight
+	flights *flights
+	// keeps X-FE-Version current
+	feVersion *feversion.Discoverer
+	// the chat completions chain, shared by http, the socket and batches
+	chat    http.Handler
+	batches *batch.Batches
+	// z.ai files behind /v1/files/{id}/content
+	files *files.Proxy
+
+	// the listener of Start, nil until it runs
+	mu       sync.Mutex
+	listener *http.Server
 }
 
 func New(cfg *config.Config, tokenizer utils.Tokener) (*Server, error) {
-	dataPath := os.Getenv("MO_DATA_PATH")
-	if dataPath == "" {
-		home, _ := os.UserHomeDir()
-		dataPath = filepath.Join(home, ".config", "traw", "data")
+	return newServer(cfg, tokenizer, tokenstore.New)
+}
+
+// NewCheck is New for a self-test, which may run beside a serving mo. the
+// token store is read from a copy while that mo holds it
+func NewCheck(cfg *config.Config, tokenizer utils.Tokener) (*Server, error) {
+	return newServer(cfg, tokenizer, func(path string) (*tokenstore.Store, error) {
+		store, err := tokenstore.New(path)
+		if errors.Is(err, tokenstore.ErrLocked) {
+			return tokenstore.Snapshot(path)
+		}
+		return store, err
+	})
+}
+
+func newServer(cfg *config.Config, tokenizer utils.Tokener, open func(string) (*tokenstore.Store, error)) (*Server, error) {
+	httpclient.Configure(httpclient.OptionsFrom(cfg.HTTP))
+
+	sigGen, err := crypto.NewSignatureGenerator(cfg.Upstream.Signature.Secret, cfg.Upstream.Signature.Version)
+	if err != nil {
+		return nil, fmt.Errorf("init signature: %w", err)
+	}
+
+	if err := hooks.Validate(cfg); err != nil {
+		return nil, fmt.Errorf("init hooks: %w", err)
 	}
 
-	store, err := tokenstore.New(filepath.Join(dataPath, "tokens"))
+	store, err := open(filepath.Join(config.DataPath(), "tokens"))
 	if err != nil {
 		return nil, fmt.Errorf("init token store: %w", err)
 	}
 
 	auth.GetService().SetTokenStore(store)
 
+	journal := usage.NewJournal(store)
+	usage.SetJournal(journal)
+
 	authSvc := auth.NewService()
-	sigGen := crypto.NewSignatureGenerator()
 
-	providers := []provider.Provider{
-		qwen.NewClient(store),
-		zlm.NewClient(cfg, authSvc, sigGen),
+	configs := config.Static(cfg)
+	feVersion := feversion.New(configs, store)
+	zlmClient := zlm.NewClient(cfg, authSvc, sigGen, store)
+	zlmClient.SetFEVersion(feVersion.Version)
+	qwenClient := qwen.NewClient(cfg, store)
+	// zlm takes any model it does not know to be another's, it goes last
+	registered := []provider.Provider{qwenClient}
+	for _, c := range openai.NewClients(cfg) {
+		registered = append(registered, c)
 	}
+	providers := provider.NewRegistry(append(registered, zlmClient)...)
+	logCredentials(providers.Statuses())
+
+	// credentials appear and disappear as tokens are registered or removed
+	store.OnChange(func() {
+		logCredentials(providers.Refresh())
+	})
+
+	catalog := models.NewCatalog(cfg, zlmClient)
+	go catalog.Run(cfg.Model.ModelsRefresh)
 
 	s := &Server{
-		cfg:        cfg,
+		configs:    configs,
 		router:     chi.NewRouter(),
 		providers:  providers,
+		catalog:    catalog,
 		tokenizer:  tokenizer,
 		tokenStore: store,
+		users:      authSvc,
+		journal:    journal,
+		limiter:    ratelimit.New(),
+		jobs:       registration.NewJobs(store),
+		signer:     sigGen,
+		hosts:      zlmClient.HostPool(),
+		qwen:       qwenClient,
+
+		conversations: conversation.New(store, cfg.Upstream.Conversations),
+		flights:       newFlights(),
+		feVersion:     feVersion,
+		files:         files.New(zlmClient.FetchFile, cfg.Files.CacheDir, cfg.Files.CacheTTL, cfg.Files.CacheMaxBytes),
+	}
+	if l := cfg.Limits; l.MaxInFlight > 0 {
+		s.gate = admission.New(l.MaxInFlight, l.QueueSize, l.QueueTimeout)
+		gateMetrics(s.gate)
+	}
+	if cfg.Upstream.Failover.ProbeInterval > 0 {
+		go s.hosts.Run(cfg.Upstream.Failover.ProbeInterval)
+	}
+	go qwenClient.RunRefresh()
+	if cfg.Headers.XFEVersionRefresh > 0 {
+		go s.feVersion.Run(cfg.Headers.XFEVersionRefresh)
+	}
+	if cfg.Upstream.ProbeTTL > 0 {
+		s.probes = map[string]*health.Probe{
+			zlmClient.Name(): health.NewProbe(func() error {
+				_, err := zlmClient.ListModels()
+				return err
+			}, cfg.Upstream.ProbeTTL),
+		}
 	}
 	s.routes()
+	s.batches = batch.New(store, batchRunner(s.chat), cfg.Batch.Concurrency, cfg.Batch.MaxRequests)
+	s.batchRoutes()
 	return s, nil
 }
 
+// Reload applies the settings of cfg that can change without a restart,
+// for now the request signature
+func (s *Server) Reload(cfg *config.Config) error {
+	sig := cfg.Upstream.Signature
+	if err := s.signer.Reload(sig.Secret, sig.Version); err != nil {
+		return fmt.Errorf("signature: %w", err)
+	}
+	logger.Info().Str("version", s.signer.Version()).Msg("signature reloaded")
+	return nil
+}
+
+func logCredentials(statuses []provider.CredentialStatus) {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tPRESENT\tVALID\tEXPIRING\tEXPIRES\tSOURCE\tDETAIL")
+	for _, st := range statuses {
+		expires := "-"
+		if !st.ExpiresAt.IsZero() {
+			expires = st.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%v\t%s\t%s\t%s\n",
+			st.Provider, st.Present, st.Valid, st.ExpiringSoon, expires, st.Source, st.Detail)
+	}
+	tw.Flush()
+
+	logger.Info().Msg("provider credentials\n" + strings.TrimRight(b.String(), "\n"))
+
+	for _, st := range statuses {
+		if st.Present && !st.ExpiresAt.IsZero() && st.ExpiresAt.Before(time.Now()) {
+			logger.Warn().Str("provider", st.Provider).Str("source", st.Source).Time("expired", st.ExpiresAt).
+				Msg("provider token already expired, replace it")
+		}
+		if !st.Usable() {
+			logger.Warn().Str("provider", st.Provider).Msg("provider has no usable credentials, excluded from routing")
+		}
+	}
+}
+
 func (s *Server) Close() {
+	if s.catalog != nil {
+		s.catalog.Close()
+	}
+	if s.hosts != nil {
+		s.hosts.Close()
+	}
+	if s.feVersion != nil {
+		s.feVersion.Close()
+	}
+	if s.qwen != nil {
+		s.qwen.Close()
+	}
+	if s.batches != nil {
+		s.batches.Close()
+	}
+	if s.journal != nil {
+		usage.SetJournal(nil)
+		s.journal.Close()
+	}
 	if s.tokenStore != nil {
 		s.tokenStore.Close()
 	}
 }
 
+// quietPaths are hit constantly by crawlers and browsers and never logged
+var quietPaths = map[string]bool{
+	"/":            true,
+	"/favicon.ico": true,
+	"/robots.txt":  true,
+}
+
+func accessLog(next http.Handler) http.Handler {
+	logged := middleware.Logger(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if quietPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logged.ServeHTTP(w, r)
+	})
+}
+
+// requestLog starts the request logger of the context, later fields such as
+// model and provider are added to it
+func requestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := logger.WithContext(r.Context(), map[string]string{"request_id": middleware.GetReqID(r.Context())})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (s *Server) routes() {
-	s.router.Use(middleware.Logger)
+	s.router.Use(accessLog)
 	s.router.Use(middleware.Recoverer)
 	s.router.Use(middleware.RealIP)
 	s.router.Use(middleware.RequestID)
+	s.router.Use(requestLog)
+	s.router.Use(compress(s.configs))
+	s.router.NotFound(notFound)
+	s.router.MethodNotAllowed(methodNotAllowed(s.router))
 
-	s.router.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status":"ok"}`))
-	})
+	s.router.Get("/", Root(s.configs))
+	s.router.Get("/robots.txt", RobotsTxt())
+	s.router.Get("/favicon.ico", Favicon())
+
+	// sdk health probes send HEAD, net/http drops the body
+	live := HealthLive()
+	ready := HealthReady(s.configs, s.providers, s.catalog, s.tokenStore, s.tokenizer, s.probes)
+	s.router.Get("/health", live)
+	s.router.Head("/health", live)
+	s.router.Get("/health/live", live)
+	s.router.Head("/health/live", live)
+	s.router.Get("/health/ready", ready)
+	s.router.Head("/health/ready", ready)
+
+	s.router.Get("/admin/usage", AdminUsage(s.configs, s.journal))
+	s.router.Get("/admin/drift", AdminDrift())
+	s.router.Get("/admin/config", AdminConfig(s.configs))
+	s.router.Post("/admin/refresh-fe-version", RefreshFEVersion(s.feVersion))
+	s.router.Get("/metrics", Metrics())
+	s.router.Get("/admin/bench/sample", BenchSample(s.configs))
 
-	s.router.Get("/v1/models", ListModels(s.cfg, s.tokenStore))
-	s.router.Post("/v1/chat/completions", ChatCompletions(s.cfg, s.providers, s.tokenizer))
+	models := ListModels(s.configs, s.providers, s.catalog)
+	s.router.Get("/v1/models", models)
+	s.router.Head("/v1/models", models)
+	s.router.Get("/v1/models/{id}", GetModel(s.configs, s.providers, s.catalog))
+	s.chat = chi.Chain(rateLimit(s.configs, s.limiter), admit(s.gate), compat(s.configs), coalesce(s.configs, s.flights)).
+		Handler(ChatCompletions(s.configs, s.providers, s.catalog, s.tokenizer, s.conversations))
+	s.router.With(streamFormat).Post("/v1/chat/completions", s.chat.ServeHTTP)
+	s.router.Get("/v1/chat/ws", ChatSocket(s.configs, s.chat).ServeHTTP)
+	s.router.Delete("/v1/conversations/{id}", ForgetConversation(s.conversations))
+	s.router.Post("/v1/tokenize", Tokenize(s.configs, s.tokenizer))
+
+	reg := newRegistrar(s.tokenStore, s.configs)
+	registerGLM := StartRegistration(s.jobs, "glm", reg.glm)
+	registerQwen := StartRegistration(s.jobs, "qwen", reg.qwen)
 
 	s.router.Route("/auth/glm", func(r chi.Router) {
-		r.Post("/register", RegisterAccount(s.tokenStore))
-		r.Get("/tokens", ListTokensByProvider(s.tokenStore, "glm"))
+		r.Post("/register", registerGLM)
+		r.Get("/tokens", ListTokensByProvider(s.tokenStore, s.journal, "glm"))
 		r.Delete("/tokens/{id}", RemoveToken(s.tokenStore))
 		r.Post("/tokens/{id}/activate", ActivateToken(s.tokenStore))
 		r.Get("/tokens/{id}/validate", ValidateTokenByID(s.tokenStore))
 	})
 
+	s.router.Get("/auth/tokens", ListTokens(s.tokenStore, s.journal))
+	s.router.Post("/auth/tokens", AddToken(s.configs, s.tokenStore))
+	s.router.Get("/auth/tokens/export", ExportTokens(s.tokenStore))
+	s.router.Post("/auth/tokens/import", ImportTokens(s.tokenStore))
+
+	s.router.Post("/auth/register", registerGLM)
+	s.router.Post("/auth/register/qwen", registerQwen)
+	s.router.Post("/auth/register/batch", BatchRegistration(s.jobs, map[string]registration.Session{
+		"glm":  reg.glmSession,
+		"qwen": reg.qwenSession,
+	}))
+	s.router.Get("/auth/register/{job}", RegistrationStatus(s.jobs))
+	s.router.Post("/auth/register/{job}/cancel", CancelRegistration(s.jobs))
+
 	s.router.Route("/auth/qwen", func(r chi.Router) {
-		r.Post("/register", RegisterQwenAccount(s.tokenStore))
-		r.Get("/tokens", ListTokensByProvider(s.tokenStore, "qwen"))
+		r.Post("/register", registerQwen)
+		r.Get("/tokens", ListTokensByProvider(s.tokenStore, s.journal, "qwen"))
 		r.Delete("/tokens/{id}", RemoveToken(s.tokenStore))
 		r.Post("/tokens/{id}/activate", ActivateToken(s.tokenStore))
 		r.Get("/tokens/{id}/validate", ValidateTokenByID(s.tokenStore))
 	})
 }
 
+// batchRoutes serves the batch api and files, batch runs go through the
+// chat chain of routes so they come after it
+func (s *Server) batchRoutes() {
+	s.router.Post("/v1/batches", CreateBatch(s.configs, s.batches))
+	s.router.Get("/v1/batches", ListBatches(s.batches))
+	s.router.Get("/v1/batches/{id}", GetBatch(s.batches))
+	s.router.Post("/v1/batches/{id}/cancel", CancelBatch(s.batches))
+	s.router.Post("/v1/files", UploadFile(s.configs, s.batches))
+	s.router.Get("/v1/files/{id}/content", FileContent(s.configs, s.batches, s.files))
+}
+
+// Handler serves the routes, for running mo inside another listener
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.cfg.Server.Host, s.cfg.Server.Port)
-	logger.Info().Msgf("listening on %s", addr)
-	return http.ListenAndServe(addr, s.router)
+	cfg := s.configs.Config()
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
+
+	tlsCfg, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	if cfg.Server.Warmup {
+		s.warmup(cfg.Server.WarmupTimeout)
+	}
+	if s.batches != nil {
+		s.batches.Resume()
+	}
+
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   s.router,
+		TLSConfig: tlsCfg,
+	}
+	s.mu.Lock()
+	s.listener = srv
+	s.mu.Unlock()
+
+	if tlsCfg == nil {
+		logger.Info().Msgf("listening on %s", addr)
+		return srv.ListenAndServe()
+	}
+
+	logger.Info().
+		Bool("mtls", tlsCfg.ClientAuth == tls.RequireAndVerifyClientCert).
+		Msgf("listening on %s (tls)", addr)
+	// certificates are already loaded into TLSConfig
+	return srv.ListenAndServeTLS("", "")
+}
+
+// Shutdown stops the listener of Start and waits for the requests in
+// flight, Start then returns http.ErrServerClosed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.listener
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
+
+// tlsConfig returns nil when tls is not configured
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tc := s.configs.Config().Server.TLS
+	if !tc.Enabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls keypair: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if tc.ClientCA != "" {
+		pem, err := os.ReadFile(tc.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client ca %s", tc.ClientCA)
+		}
+
+		// handshake fails before any handler runs
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
 }
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// paths of the self-signed pki generated in TestMain
+var testPKI struct {
+	caFile                string
+	serverCert, serverKey string
+	clientCert            tls.Certificate
+	roots                 *x509.CertPool
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mo-tls")
+	if err != nil {
+		panic(err)
+	}
+
+	if err := generatePKI(dir); err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func generatePKI(dir string) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mo test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		return der, key, err
+	}
+
+	writePEM := func(name, typ string, der []byte) (string, error) {
+		path := filepath.Join(dir, name)
+		return path, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	}
+
+	if testPKI.caFile, err = writePEM("ca.pem", "CERTIFICATE", caDER); err != nil {
+		return err
+	}
+
+	srvDER, srvKey, err := issue(2, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return err
+	}
+	srvKeyDER, err := x509.MarshalECPrivateKey(srvKey)
+	if err != nil {
+		return err
+	}
+	if testPKI.serverCert, err = writePEM("server.pem", "CERTIFICATE", srvDER); err != nil {
+		return err
+	}
+	if testPKI.serverKey, err = writePEM("server-key.pem", "EC PRIVATE KEY", srvKeyDER); err != nil {
+		return err
+	}
+
+	cliDER, cliKey, err := issue(3, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return err
+	}
+	testPKI.clientCert = tls.Certificate{Certificate: [][]byte{cliDER}, PrivateKey: cliKey}
+
+	testPKI.roots = x509.NewCertPool()
+	testPKI.roots.AddCert(caCert)
+	return nil
+}
+
+func startTLSServer(t *testing.T, tc config.TLSConfig) *httptest.Server {
+	t.Helper()
+
+	sse := `data: {"data": {"phase": "answer", "delta_content": "secure", "done": true}}` + "\n\n"
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(sse)),
+	}, nil).Maybe()
+
+	s := &Server{
+		configs: config.Static(&config.Config{
+			Server: config.ServerConfig{TLS: tc},
+			Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning", ReasoningOnly: "promote"},
+		}),
+		router:    chi.NewRouter(),
+		providers: provider.NewRegistry(mockAI),
+		tokenizer: &MockTokener{},
+	}
+	s.routes()
+
+	tlsCfg, err := s.tlsConfig()
+	require.NoError(t, err)
+	require.NotNil(t, tlsCfg)
+
+	ts := httptest.NewUnstartedServer(s.router)
+	ts.TLS = tlsCfg
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func tlsClient(certs ...tls.Certificate) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: testPKI.roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		},
+	}
+}
+
+func postChat(client *http.Client, url string) (*http.Response, error) {
+	body, _ := json.Marshal(domain.ChatRequest{
+		Model:    "glm",
+		Messages: []domain.Message{{Role: "user", Content: "hi"}},
+	})
+	return client.Post(url+"/v1/chat/completions", "application/json", bytes.NewReader(body))
+}
+
+func TestTLSChat(t *testing.T) {
+	ts := startTLSServer(t, config.TLSConfig{CertFile: testPKI.serverCert, KeyFile: testPKI.serverKey})
+
+	resp, err := postChat(tlsClient(), ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.GreaterOrEqual(t, resp.TLS.Version, uint16(tls.VersionTLS12))
+
+	var chat domain.ChatResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&chat))
+	assert.Equal(t, "secure", chat.Choices[0].Message.Content)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ts := startTLSServer(t, config.TLSConfig{
+		CertFile: testPKI.serverCert,
+		KeyFile:  testPKI.serverKey,
+		ClientCA: testPKI.caFile,
+	})
+
+	t.Run("with client cert", func(t *testing.T) {
+		resp, err := postChat(tlsClient(testPKI.clientCert), ts.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("without client cert", func(t *testing.T) {
+		resp, err := postChat(tlsClient(), ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.Error(t, err)
+	})
+}
+
+func TestTLSConfigDisabled(t *testing.T) {
+	s := &Server{configs: config.Static(&config.Config{})}
+
+	tlsCfg, err := s.tlsConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsCfg)
+}
+
+func TestRequestLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, logger.Init(logger.Options{Out: &buf, Format: "json"}))
+	t.Cleanup(func() { logger.Init(logger.Options{}) })
+
+	sse := `data: {"data": {"phase": "answer", "delta_content": "hi", "done": true}}` + "\n\n"
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(sse)),
+	}, nil)
+	s := &Server{
+		configs: config.Static(&config.Config{
+			Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+		}),
+		router:    chi.NewRouter(),
+		providers: provider.NewRegistry(mockAI),
+		tokenizer: &MockTokener{},
+	}
+	s.routes()
+
+	r := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"glm-4.6","messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var line map[string]any
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(l), &m), l)
+		if m["message"] == "chat request" {
+			line = m
+		}
+	}
+	require.NotNil(t, line, buf.String())
+	assert.NotEmpty(t, line["request_id"])
+	assert.Equal(t, "glm-4.6", line["model"])
+	assert.Equal(t, "mock", line["provider"])
+}
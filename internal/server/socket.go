@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/websocket"
+)
+
+// frame types of the chat socket
+const (
+	// client: authenticate the connection, before any chat
+	frameAuth = "auth"
+	// client: a ChatRequest, the default type
+	frameChat = "chat"
+	// client: abort the request with the id
+	frameCancel = "cancel"
+
+	// server: one stream chunk
+	frameChunk = "chunk"
+	// server: a whole non-stream reply
+	frameResponse = "response"
+	// server: the request failed before replying, data is the error body
+	frameError = "error"
+	// server: the request with the id has ended
+	frameDone = "done"
+)
+
+// socketFrame is the envelope of a client frame, a chat frame carries the
+// ChatRequest fields alongside
+type socketFrame struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	APIKey string `json:"api_key"`
+}
+
+// socketReply is a server frame, tagged with the id of its request
+type socketReply struct {
+	ID     string          `json:"id,omitempty"`
+	Type   string          `json:"type"`
+	Status int             `json:"status,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	// done: the request was cancelled by the client
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// ChatSocket serves chat completions over a websocket, GET /v1/chat/ws.
+// every chat frame runs through chat as its own POST /v1/chat/completions,
+// so limits, admission and compat apply per request. requests run
+// concurrently, the frames of one id arrive in order. the api key comes
+// from the upgrade's Authorization header or a first auth frame
+func ChatSocket(configs config.Provider, chat http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !socketOrigin(r, configs.Config().Server.WSOrigins) {
+			writeAPIErr(w, domain.NewAPIError(http.StatusForbidden, "origin "+r.Header.Get("Origin")+" may not open the chat socket").
+				WithCode("origin_not_allowed"))
+			return
+		}
+		ws, err := websocket.Upgrade(w, r)
+		if err != nil {
+			logger.FromContext(r.Context()).Debug().Err(err).Msg("chat socket handshake failed")
+			return
+		}
+		defer ws.Close()
+
+		s := &socketSession{
+			ws:       ws,
+			upgrade:  r,
+			chat:     chat,
+			key:      bearerKey(r),
+			inFlight: make(map[string]context.CancelFunc),
+		}
+		s.serve()
+	})
+}
+
+// socketOrigin lets a browser page open the socket only from the server's
+// own origin or one listed in server.ws_origins. api keys do not
+// authenticate anyone, any page the operator visits could otherwise chat on
+// the operator's account. clients outside a browser send no Origin
+func socketOrigin(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if slices.ContainsFunc(allowed, func(a string) bool {
+		return strings.EqualFold(strings.TrimSuffix(a, "/"), origin)
+	}) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+type socketSession struct {
+	ws      *websocket.Conn
+	upgrade *http.Request
+	chat    http.Handler
+	key     string
+	// a chat was started, auth frames are refused from then on
+	started bool
+
+	mu       sync.Mutex
+	inFlight map[string]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (s *socketSession) serve() {
+	ctx, cancel := context.WithCancel(s.upgrade.Context())
+	defer func() {
+		cancel()
+		s.wg.Wait()
+	}()
+	log := logger.FromContext(ctx)
+
+	for {
+		data, err := s.ws.ReadMessage()
+		if err != nil {
+			log.Debug().Err(err).Msg("chat socket closed")
+			return
+		}
+
+		var frame socketFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			s.fail("", http.StatusBadRequest, "invalid json")
+			continue
+		}
+
+		switch frame.Type {
+		case frameAuth:
+			if s.started {
+				s.fail("", http.StatusBadRequest, "auth must come before the first request")
+				continue
+			}
+			s.key = frame.APIKey
+		case frameCancel:
+			s.mu.Lock()
+			if stop, ok := s.inFlight[frame.ID]; ok {
+				stop()
+			}
+			s.mu.Unlock()
+		case "", frameChat:
+			s.start(ctx, frame.ID, data)
+		default:
+			s.fail(frame.ID, http.StatusBadRequest, "unknown frame type "+frame.Type)
+		}
+	}
+}
+
+// start runs the chat request of a frame in the background
+func (s *socketSession) start(ctx context.Context, id string, data []byte) {
+	if id == "" {
+		s.fail("", http.StatusBadRequest, "missing request id")
+		return
+	}
+	body, err := chatBody(data)
+	if err != nil {
+		s.fail(id, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	s.mu.Lock()
+	if _, busy := s.inFlight[id]; busy {
+		s.mu.Unlock()
+		s.fail(id, http.StatusConflict, "request "+id+" is still running")
+		return
+	}
+	ctx, stop := context.WithCancel(ctx)
+	s.inFlight[id] = stop
+	s.started = true
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.inFlight, id)
+			s.mu.Unlock()
+			stop()
+		}()
+
+		r, _ := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewReader(body))
+		r.RemoteAddr = s.upgrade.RemoteAddr
+		r.Header.Set("Content-Type", "application/json")
+		if s.key != "" {
+			r.Header.Set("Authorization", "Bearer "+s.key)
+		}
+
+		sw := &socketWriter{session: s, id: id, header: http.Header{}}
+		s.chat.ServeHTTP(sw, r)
+		sw.finish(ctx.Err() != nil)
+	}()
+}
+
+// chatBody is the frame without its envelope fields, the request as POST
+// /v1/chat/completions takes it
+func chatBody(data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "type")
+	delete(fields, "id")
+	delete(fields, "api_key")
+	return json.Marshal(fields)
+}
+
+func (s *socketSession) send(reply socketReply) {
+	data, _ := json.Marshal(reply)
+	// a dead connection ends serve, the sends in flight just fail
+	s.ws.WriteText(data)
+}
+
+func (s *socketSession) fail(id string, status int, msg string) {
+	data, _ := json.Marshal(domain.ErrorResponse{Error: domain.NewAPIError(status, msg)})
+	s.send(socketReply{ID: id, Type: frameError, Status: status, Data: data})
+}
+
+// socketWriter turns the reply of one request into frames: every sse event
+// a chunk, any other body one response or error frame
+type socketWriter struct {
+	session *socketSession
+	id      string
+	header  http.Header
+	status  int
+	stream  bool
+	buf     bytes.Buffer
+}
+
+func (sw *socketWriter) Header() http.Header { return sw.header }
+
+func (sw *socketWriter) WriteHeader(code int) {
+	if sw.status != 0 {
+		return
+	}
+	sw.status = code
+	sw.stream = strings.HasPrefix(sw.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (sw *socketWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	sw.buf.Write(b)
+	if !sw.stream {
+		return len(b), nil
+	}
+
+	for {
+		event, ok := nextEvent(&sw.buf)
+		if !ok {
+			break
+		}
+		data, ok := bytes.CutPrefix(event, []byte("data: "))
+		if !ok || string(data) == "[DONE]" {
+			continue
+		}
+		sw.session.send(socketReply{ID: sw.id, Type: frameChunk, Data: data})
+	}
+	return len(b), nil
+}
+
+// Flush is a no-op, every chunk goes out as its frame is complete
+func (sw *socketWriter) Flush() {}
+
+// finish sends what a non-stream reply buffered and ends the request
+func (sw *socketWriter) finish(cancelled bool) {
+	if !sw.stream && sw.buf.Len() > 0 {
+		reply := socketReply{ID: sw.id, Type: frameResponse, Data: bytes.TrimSpace(sw.buf.Bytes())}
+		if sw.status >= 400 {
+			reply.Type, reply.Status = frameError, sw.status
+		}
+		if json.Valid(reply.Data) {
+			sw.session.send(reply)
+		}
+	}
+	sw.session.send(socketReply{ID: sw.id, Type: frameDone, Cancelled: cancelled})
+}
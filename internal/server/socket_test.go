@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/websocket"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// abortingMock closes the reply body once the request context ends, as the
+// http transport does for a real upstream call
+type abortingMock struct{ *MockAIClient }
+
+func (m abortingMock) SendChatRequest(ctx context.Context, req *domain.ChatRequest, chatID string) (*http.Response, error) {
+	resp, err := m.MockAIClient.SendChatRequest(ctx, req, chatID)
+	if err == nil {
+		context.AfterFunc(ctx, func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func forModel(model string) any {
+	return mock.MatchedBy(func(req *domain.ChatRequest) bool { return req.Model == model })
+}
+
+// dialSocket serves ChatSocket over chat and connects to it
+func dialSocket(t *testing.T, chat http.Handler, header http.Header) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(ChatSocket(config.Static(&config.Config{}), chat))
+	t.Cleanup(srv.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func sendFrame(t *testing.T, ws *websocket.Conn, frame string) {
+	t.Helper()
+	require.NoError(t, ws.WriteText([]byte(frame)))
+}
+
+func readFrame(t *testing.T, ws *websocket.Conn) socketReply {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ws.ReadMessage()
+	require.NoError(t, err)
+	var reply socketReply
+	require.NoError(t, json.Unmarshal(data, &reply))
+	return reply
+}
+
+// chunkContent is the content delta of a chunk frame
+func chunkContent(t *testing.T, reply socketReply) string {
+	t.Helper()
+	var chunk domain.ChatResponse
+	require.NoError(t, json.Unmarshal(reply.Data, &chunk))
+	if len(chunk.Choices) == 0 || chunk.Choices[0].Delta == nil {
+		return ""
+	}
+	return chunk.Choices[0].Delta.Content
+}
+
+func TestChatSocketInterleaving(t *testing.T) {
+	event := func(text string, done bool) string {
+		data, _ := json.Marshal(map[string]any{"data": map[string]any{"phase": "answer", "delta_content": text, "done": done}})
+		return "data: " + string(data) + "\n\n"
+	}
+
+	slowBody, slowUpstream := io.Pipe()
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", forModel("slow"), mock.Anything).Return(&http.Response{StatusCode: 200, Body: slowBody}, nil)
+	mockAI.On("SendChatRequest", forModel("fast"), mock.Anything).Return(&http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(event("quick", false) + event(" answer", true))),
+	}, nil)
+
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	ws := dialSocket(t, ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil), nil)
+
+	sendFrame(t, ws, `{"id":"a","model":"slow","stream":true,"messages":[{"role":"user","content":"take your time"}]}`)
+	go slowUpstream.Write([]byte(event("first", false)))
+
+	// a's reply is open while b runs start to end on the same connection
+	var content = map[string]string{}
+	for content["a"] != "first" {
+		reply := readFrame(t, ws)
+		require.Equal(t, "a", reply.ID)
+		require.Equal(t, frameChunk, reply.Type)
+		content["a"] += chunkContent(t, reply)
+	}
+
+	sendFrame(t, ws, `{"id":"b","model":"fast","stream":true,"messages":[{"role":"user","content":"hurry"}]}`)
+	var finished []string
+	for len(finished) == 0 {
+		reply := readFrame(t, ws)
+		require.Equal(t, "b", reply.ID)
+		if reply.Type == frameDone {
+			finished = append(finished, reply.ID)
+			continue
+		}
+		content["b"] += chunkContent(t, reply)
+	}
+	assert.Equal(t, "quick answer", content["b"])
+
+	go func() {
+		slowUpstream.Write([]byte(event(" and second", true)))
+		slowUpstream.Close()
+	}()
+	for len(finished) == 1 {
+		reply := readFrame(t, ws)
+		require.Equal(t, "a", reply.ID)
+		if reply.Type == frameDone {
+			assert.False(t, reply.Cancelled)
+			finished = append(finished, reply.ID)
+			continue
+		}
+		content["a"] += chunkContent(t, reply)
+	}
+	assert.Equal(t, "first and second", content["a"])
+	assert.Equal(t, []string{"b", "a"}, finished)
+}
+
+func TestChatSocketCancel(t *testing.T) {
+	body := &endlessBody{event: `data: {"data": {"phase": "answer", "delta_content": "more "}}` + "\n\n"}
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: body}, nil)
+
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm", ThinkMode: "reasoning"}}
+	ws := dialSocket(t, ChatCompletions(config.Static(cfg), provider.NewRegistry(abortingMock{mockAI}), nil, &MockTokener{}, nil), nil)
+
+	sendFrame(t, ws, `{"id":"forever","stream":true,"messages":[{"role":"user","content":"go on"}]}`)
+	reply := readFrame(t, ws)
+	require.Equal(t, frameChunk, reply.Type, string(reply.Data))
+
+	sendFrame(t, ws, `{"type":"cancel","id":"forever"}`)
+	for reply.Type != frameDone {
+		reply = readFrame(t, ws)
+		require.Equal(t, "forever", reply.ID)
+	}
+	assert.True(t, reply.Cancelled)
+	assert.True(t, body.closed.Load(), "the upstream call is aborted")
+
+	// the id is free again and the connection still serves requests
+	sendFrame(t, ws, `{"id":"forever","messages":[]}`)
+	reply = readFrame(t, ws)
+	assert.Equal(t, frameError, reply.Type)
+	assert.Equal(t, http.StatusBadRequest, reply.Status)
+	assert.Equal(t, frameDone, readFrame(t, ws).Type)
+}
+
+func TestChatSocketAuth(t *testing.T) {
+	var seen atomic.Value
+	chat := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen.Store(bearerKey(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":"yes"}`))
+	})
+
+	tests := []struct {
+		name   string
+		header http.Header
+		auth   string
+		want   string
+	}{
+		{name: "upgrade header", header: http.Header{"Authorization": {"Bearer sk-header"}}, want: "sk-header"},
+		{name: "first frame", auth: `{"type":"auth","api_key":"sk-frame"}`, want: "sk-frame"},
+		{name: "none", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := dialSocket(t, chat, tt.header)
+			if tt.auth != "" {
+				sendFrame(t, ws, tt.auth)
+			}
+			sendFrame(t, ws, `{"id":"1","messages":[{"role":"user","content":"hi"}]}`)
+
+			reply := readFrame(t, ws)
+			assert.Equal(t, frameResponse, reply.Type)
+			assert.JSONEq(t, `{"ok":"yes"}`, string(reply.Data))
+			assert.Equal(t, frameDone, readFrame(t, ws).Type)
+			assert.Equal(t, tt.want, seen.Load())
+
+			sendFrame(t, ws, `{"type":"auth","api_key":"sk-late"}`)
+			assert.Equal(t, frameError, readFrame(t, ws).Type, "a key cannot change mid connection")
+		})
+	}
+}
+
+func TestChatSocketOrigin(t *testing.T) {
+	chat := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":"yes"}`))
+	})
+	cfg := &config.Config{Server: config.ServerConfig{WSOrigins: []string{"https://chat.example.org/"}}}
+	srv := httptest.NewServer(ChatSocket(config.Static(cfg), chat))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	tests := []struct {
+		name   string
+		origin string
+		ok     bool
+	}{
+		{"no origin", "", true},
+		{"same host", srv.URL, true},
+		{"allowed", "https://chat.example.org", true},
+		{"other site", "https://evil.example", false},
+		{"same port elsewhere", "http://evil.example" + strings.TrimPrefix(srv.URL, "http://127.0.0.1"), false},
+		{"null", "null", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			ws, err := websocket.Dial(url, header)
+			if !tt.ok {
+				var hs *websocket.HandshakeError
+				require.ErrorAs(t, err, &hs)
+				assert.Equal(t, http.StatusForbidden, hs.Status)
+				return
+			}
+			require.NoError(t, err)
+			defer ws.Close()
+			sendFrame(t, ws, `{"id":"1","messages":[{"role":"user","content":"hi"}]}`)
+			assert.Equal(t, frameResponse, readFrame(t, ws).Type)
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+type sseState int
+
+const (
+	sseStreaming sseState = iota
+	sseFinished
+	sseDone
+)
+
+var errSSEOrder = errors.New("sse: event out of terminal sequence")
+
+// sseWriter owns the terminal sequence of a chat completion stream:
+//
+//	content chunks -> one finish_reason chunk -> trailers -> [DONE]
+//
+// trailers (usage and any later metadata) carry empty choices, so nothing
+// with populated choices can follow the finish chunk. events that would
+// break the order are dropped and logged instead of reaching the client.
+//
+// while upstream is silent, e.g. thinking before the first delta, a
+// ": ping" comment goes out every heartbeat so proxies keep the line open.
+//
+// events are queued and written by a goroutine of their own, a slow client
+// does not hold up reading upstream. one that falls a whole buffer behind or
+// takes nothing for a stall timeout is dropped
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	state   sseState
+
+	heartbeat time.Duration
+	beat      *time.Timer
+
+	limit int
+	stall time.Duration
+	// written by run, queued bytes are unsent and held bytes not yet written
+	queue   [][]byte
+	held    int
+	since   time.Time
+	dropped error
+	closing bool
+	wake    chan struct{}
+	ran     chan struct{}
+}
+
+// a dropped client still reading gets the reason this long, one that is not is cut
+const dropGrace = time.Second
+
+var (
+	errStreamBuffer = errors.New("client fell a whole stream buffer behind")
+	errStreamStall  = errors.New("client took no stream data within the stall timeout")
+)
+
+// newSSEWriter starts the stream right away. a heartbeat <= 0 sends no
+// pings, stream_buffer_bytes and stream_stall_timeout of 0 never drop
+func newSSEWriter(w http.ResponseWriter, cfg config.ServerConfig) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx buffers responses unless told otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s := &sseWriter{
+		w:         w,
+		flusher:   flusher,
+		heartbeat: cfg.StreamHeartbeat,
+		limit:     cfg.StreamBufferBytes,
+		stall:     cfg.StreamStallTimeout,
+		wake:      make(chan struct{}, 1),
+		ran:       make(chan struct{}),
+	}
+	go s.run()
+	if s.heartbeat > 0 {
+		s.mu.Lock()
+		s.beat = time.AfterFunc(s.heartbeat, s.ping)
+		s.mu.Unlock()
+	}
+	return s, true
+}
+
+// ping fires once the stream was quiet for a whole heartbeat
+func (s *sseWriter) ping() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == sseDone || s.dropped != nil {
+		return
+	}
+	if s.stalled() {
+		s.drop(errStreamStall)
+		return
+	}
+	if s.held == 0 {
+		s.enqueue([]byte(": ping\n\n"))
+	}
+	s.beat.Reset(s.heartbeat)
+}
+
+// Dropped returns why the client was dropped, nil while it keeps up
+func (s *sseWriter) Dropped() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Chunk sends a content chunk, one carrying a finish_reason ends the content
+func (s *sseWriter) Chunk(chunk domain.ChatResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != sseStreaming {
+		return s.reject("chunk")
+	}
+
+	for _, c := range chunk.Choices {
+		if c.FinishReason != nil {
+			s.state = sseFinished
+		}
+	}
+	return s.write(chunk)
+}
+
+// Finish sends the finish_reason chunk unless upstream already sent one
+func (s *sseWriter) Finish(chunk domain.ChatResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case sseFinished:
+		return nil
+	case sseDone:
+		return s.reject("finish")
+	}
+
+	s.state = sseFinished
+	return s.write(chunk)
+}
+
+// Trailer sends metadata after the finish chunk, chat chunks must have no choices
+func (s *sseWriter) Trailer(v any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != sseFinished {
+		return s.reject("trailer")
+	}
+
+	switch c := v.(type) {
+	case domain.ChatResponse:
+		if len(c.Choices) > 0 {
+			return s.reject("trailer with choices")
+		}
+	case *domain.ChatResponse:
+		if len(c.Choices) > 0 {
+			return s.reject("trailer with choices")
+		}
+	}
+	return s.write(v)
+}
+
+// Error aborts the content with an openai error event, only the
+// trailers and [DONE] may follow
+func (s *sseWriter) Error(apiErr *domain.APIError) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != sseStreaming {
+		return s.reject("error")
+	}
+
+	s.state = sseFinished
+	return s.write(domain.ErrorResponse{Error: apiErr})
+}
+
+// Done terminates the stream and waits for the client to take what is
+// queued, it is safe to call more than once
+func (s *sseWriter) Done() {
+	s.mu.Lock()
+	if s.state == sseDone {
+		s.mu.Unlock()
+		return
+	}
+	s.state = sseDone
+	if s.beat != nil {
+		s.beat.Stop()
+	}
+	if s.dropped == nil {
+		s.enqueue([]byte("data: [DONE]\n\n"))
+	}
+	s.closing = true
+	s.notify()
+	s.mu.Unlock()
+
+	// the handler must not return while run still writes
+	if s.stall > 0 {
+		select {
+		case <-s.ran:
+			return
+		case <-time.After(s.stall):
+			s.mu.Lock()
+			if s.dropped == nil {
+				s.drop(errStreamStall)
+			}
+			s.mu.Unlock()
+		}
+	}
+	<-s.ran
+}
+
+func (s *sseWriter) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal sse event: %w", err)
+	}
+
+	if s.dropped != nil {
+		return s.dropped
+	}
+	event := fmt.Appendf(nil, "data: %s\n\n", data)
+	if s.limit > 0 && s.held+len(event) > s.limit {
+		s.drop(errStreamBuffer)
+		return s.dropped
+	}
+	if s.stalled() {
+		s.drop(errStreamStall)
+		return s.dropped
+	}
+	s.enqueue(event)
+	if s.beat != nil {
+		s.beat.Reset(s.heartbeat)
+	}
+	return nil
+}
+
+// stalled reports data waiting on the client for longer than the stall timeout
+func (s *sseWriter) stalled() bool {
+	return s.stall > 0 && s.held > 0 && time.Since(s.since) > s.stall
+}
+
+func (s *sseWriter) enqueue(event []byte) {
+	if s.held == 0 {
+		s.since = time.Now()
+	}
+	s.queue = append(s.queue, event)
+	s.held += len(event)
+	s.notify()
+}
+
+func (s *sseWriter) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drop gives up on the client, what it has not taken is discarded for an
+// error event and a write deadline cuts a connection that stopped reading
+func (s *sseWriter) drop(err error) {
+	s.dropped = err
+
+	apiErr := domain.NewAPIError(http.StatusServiceUnavailable, err.Error()).WithCode("slow_client")
+	data, _ := json.Marshal(domain.ErrorResponse{Error: apiErr})
+	s.queue = [][]byte{fmt.Appendf(nil, "data: %s\n\n", data)}
+	s.held = len(s.queue[0])
+	s.notify()
+	if err := http.NewResponseController(s.w).SetWriteDeadline(time.Now().Add(dropGrace)); err != nil {
+		// every writer in between has to unwrap, or a stuck Write holds Done
+		logger.Warn().Err(err).Msg("cannot cut a dropped stream client")
+	}
+}
+
+// run writes the queue to the client, a batch at a time with one flush
+func (s *sseWriter) run() {
+	defer close(s.ran)
+
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closing {
+			s.mu.Unlock()
+			<-s.wake
+			s.mu.Lock()
+		}
+		batch := s.queue
+		s.queue = nil
+		if len(batch) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		n := 0
+		var err error
+		for _, event := range batch {
+			if _, err = s.w.Write(event); err != nil {
+				break
+			}
+			n += len(event)
+		}
+		if err == nil {
+			s.flusher.Flush()
+		}
+
+		s.mu.Lock()
+		if err != nil {
+			// the client is gone, nothing more can reach it
+			if s.dropped == nil {
+				s.dropped = err
+			}
+			s.queue = nil
+			s.held = 0
+		} else {
+			// a drop meanwhile replaced what was counted
+			s.held = max(s.held-n, 0)
+			s.since = time.Now()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *sseWriter) reject(what string) error {
+	logger.Warn().Int("state", int(s.state)).Msg("dropped out of order sse " + what)
+	return errSSEOrder
+}
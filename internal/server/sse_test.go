@@ -0,0 +1,388 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+type namedMock struct {
+	*MockAIClient
+	name string
+}
+
+func (m namedMock) Name() string { return m.name }
+
+// openaiMock replies in the openai shape, as qwen does
+type openaiMock struct{ namedMock }
+
+func (openaiMock) RepliesOpenAI() {}
+
+func TestSSEWriterOrder(t *testing.T) {
+	w := httptest.NewRecorder()
+	sse, ok := newSSEWriter(w, config.ServerConfig{})
+	require.True(t, ok)
+
+	content := domain.ChatResponse{Choices: []domain.Choice{{Delta: &domain.ResponseMessage{Content: "hi"}}}}
+	finish := domain.ChatResponse{Choices: []domain.Choice{{Delta: &domain.ResponseMessage{}, FinishReason: strPtr("stop")}}}
+
+	assert.ErrorIs(t, sse.Trailer(domain.ChatResponse{}), errSSEOrder, "trailer before finish")
+	require.NoError(t, sse.Chunk(content))
+	require.NoError(t, sse.Chunk(finish))
+
+	assert.NoError(t, sse.Finish(finish), "second finish is absorbed")
+	assert.ErrorIs(t, sse.Chunk(content), errSSEOrder, "content after finish")
+	assert.ErrorIs(t, sse.Trailer(content), errSSEOrder, "trailer with choices")
+	require.NoError(t, sse.Trailer(domain.ChatResponse{Choices: []domain.Choice{}, Usage: &domain.Usage{}}))
+
+	sse.Done()
+	sse.Done()
+	assert.ErrorIs(t, sse.Trailer(domain.ChatResponse{}), errSSEOrder, "trailer after done")
+
+	assert.Equal(t, 4, strings.Count(w.Body.String(), "data: "))
+	assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		// thinking silently before the first delta
+		time.Sleep(150 * time.Millisecond)
+		pw.Write([]byte(answerStream("hello")))
+		pw.Close()
+	}()
+
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: pr}, nil)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{StreamHeartbeat: 40 * time.Millisecond},
+		Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+	}
+	w := httptest.NewRecorder()
+	body := `{"messages": [{"role": "user", "content": "hi"}], "stream": true}`
+	ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+	out := w.Body.String()
+	assert.Equal(t, "no", w.Header().Get("X-Accel-Buffering"))
+	first := strings.Index(out, "data: ")
+	require.Positive(t, first, out)
+	assert.GreaterOrEqual(t, strings.Count(out[:first], ": ping\n\n"), 2, "pings while waiting for the first delta")
+	assert.Equal(t, ": ping\n\n", out[:len(": ping\n\n")])
+	assert.True(t, strings.HasSuffix(out, "data: [DONE]\n\n"), "no ping after the stream is done")
+}
+
+func TestSSEHeartbeatDisabled(t *testing.T) {
+	w := httptest.NewRecorder()
+	sse, ok := newSSEWriter(w, config.ServerConfig{})
+	require.True(t, ok)
+	time.Sleep(20 * time.Millisecond)
+	sse.Done()
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.Flushed, "headers go out before the first chunk")
+	assert.Equal(t, "data: [DONE]\n\n", w.Body.String())
+}
+
+var (
+	idRe      = regexp.MustCompile(`"id":"[^"]*"`)
+	createdRe = regexp.MustCompile(`"created":\d+`)
+)
+
+// assertGolden compares output with ids and timestamps masked against
+// testdata/<name>.golden, go test -update rewrites the file
+func assertGolden(t *testing.T, name, output string) string {
+	t.Helper()
+
+	got := idRe.ReplaceAllString(output, `"id":"ID"`)
+	got = createdRe.ReplaceAllString(got, `"created":0`)
+
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, []byte(got), 0644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), got)
+	return got
+}
+
+func TestStreamGolden(t *testing.T) {
+	zlmSSE := `data: {"data": {"phase": "thinking", "delta_content": "hmm"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": "Hello"}}` + "\n\n" +
+		`data: {"data": {"phase": "answer", "delta_content": " World", "done": true}}` + "\n\n"
+	qwenSSE := `data: {"id":"q1","created":1,"choices":[{"delta":{"role":"assistant","content":"Hi"}}]}` + "\n\n" +
+		`data: {"id":"q1","created":1,"choices":[{"delta":{"content":"!"},"finish_reason":"stop"}]}` + "\n\n" +
+		`data: [DONE]` + "\n\n"
+
+	tests := []struct {
+		name     string
+		provider string
+		upstream string
+		usage    bool
+	}{
+		{"zlm", "zlm", zlmSSE, false},
+		{"zlm_usage", "zlm", zlmSSE, true},
+		{"qwen_usage", "qwen", qwenSSE, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "m", ThinkMode: "reasoning"}}
+
+			mockAI := namedMock{MockAIClient: new(MockAIClient), name: tt.provider}
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(tt.upstream)),
+			}, nil)
+			var p provider.Provider = mockAI
+			if tt.provider == "qwen" {
+				p = openaiMock{mockAI}
+			}
+
+			req := domain.ChatRequest{
+				Model:    "m",
+				Stream:   true,
+				Messages: []domain.Message{{Role: "user", Content: "hello there"}},
+			}
+			if tt.usage {
+				req.StreamOpts = &domain.StreamOptions{IncludeUsage: true}
+			}
+			body, _ := json.Marshal(req)
+
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			assertOneCompletion(t, w.Body.String())
+			got := assertGolden(t, "stream_"+tt.name, w.Body.String())
+			assertTerminalSequence(t, got, tt.usage)
+		})
+	}
+}
+
+// assertOneCompletion checks that every chunk of a stream, stop and usage
+// included, carries the same id and fingerprint
+func assertOneCompletion(t *testing.T, stream string) {
+	t.Helper()
+
+	ids := map[string]bool{}
+	fingerprints := map[string]bool{}
+	for _, line := range strings.Split(stream, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk domain.ChatResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		ids[chunk.ID] = true
+		fingerprints[chunk.SystemFingerprint] = true
+	}
+	require.Len(t, ids, 1, "ids: %v", ids)
+	for id := range ids {
+		assert.True(t, strings.HasPrefix(id, "chatcmpl-"), id)
+	}
+	assert.Len(t, fingerprints, 1)
+}
+
+// assertTerminalSequence checks the contract independently of the golden files
+func assertTerminalSequence(t *testing.T, stream string, usage bool) {
+	t.Helper()
+
+	var events []string
+	for _, line := range strings.Split(stream, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	require.NotEmpty(t, events)
+	require.Equal(t, "[DONE]", events[len(events)-1])
+
+	finished := false
+	for _, e := range events[:len(events)-1] {
+		var chunk domain.ChatResponse
+		require.NoError(t, json.Unmarshal([]byte(e), &chunk))
+
+		if finished {
+			assert.Empty(t, chunk.Choices, "populated choices after finish_reason: "+e)
+			continue
+		}
+		for _, c := range chunk.Choices {
+			if c.FinishReason != nil {
+				finished = true
+			}
+		}
+	}
+	assert.True(t, finished, "no finish_reason chunk")
+
+	last := events[len(events)-2]
+	assert.Equal(t, usage, strings.Contains(last, `"usage"`), "usage chunk must directly precede [DONE] only when requested")
+}
+
+// slowClient is a connection that takes nothing until it is released
+type slowClient struct {
+	header  http.Header
+	release chan struct{}
+
+	mu   sync.Mutex
+	body bytes.Buffer
+}
+
+func newSlowClient() *slowClient {
+	return &slowClient{header: http.Header{}, release: make(chan struct{})}
+}
+
+func (c *slowClient) Header() http.Header { return c.header }
+func (c *slowClient) WriteHeader(int)     {}
+func (c *slowClient) Flush()              {}
+
+func (c *slowClient) Write(p []byte) (int, error) {
+	<-c.release
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.body.Write(p)
+}
+
+// eofBody notes when upstream was read to the end
+type eofBody struct {
+	io.Reader
+	eof atomic.Bool
+}
+
+func (b *eofBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.eof.Store(true)
+	}
+	return n, err
+}
+
+func (b *eofBody) Close() error { return nil }
+
+func TestSlowClientDropped(t *testing.T) {
+	deltas := make([]string, 500)
+	for i := range deltas {
+		deltas[i] = "word "
+	}
+
+	tests := []struct {
+		name    string
+		server  config.ServerConfig
+		body    io.ReadCloser
+		drained func(io.ReadCloser) bool
+		reason  error
+	}{
+		{
+			name:    "buffer overflow drains upstream",
+			server:  config.ServerConfig{StreamBufferBytes: 2 << 10, StreamDrainDropped: true},
+			body:    &eofBody{Reader: strings.NewReader(answerStream(deltas...))},
+			drained: func(b io.ReadCloser) bool { return b.(*eofBody).eof.Load() },
+			reason:  errStreamBuffer,
+		},
+		{
+			name:    "stall closes upstream",
+			server:  config.ServerConfig{StreamStallTimeout: 20 * time.Millisecond},
+			body:    &endlessBody{event: `data: {"data": {"phase": "answer", "delta_content": "more "}}` + "\n\n"},
+			drained: func(b io.ReadCloser) bool { return b.(*endlessBody).closed.Load() },
+			reason:  errStreamStall,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: tt.body}, nil)
+			cfg := &config.Config{Server: tt.server, Model: config.ModelConfig{Default: "glm"}}
+
+			client := newSlowClient()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				body := `{"messages": [{"role": "user", "content": "hi"}], "stream": true}`
+				ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(client, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+			}()
+
+			// upstream is read on while the client takes nothing
+			require.Eventually(t, func() bool { return tt.drained(tt.body) }, 5*time.Second, time.Millisecond)
+			close(client.release)
+			<-done
+
+			out := client.body.String()
+			assert.Contains(t, out, `"code":"slow_client"`)
+			assert.Contains(t, out, tt.reason.Error())
+			assert.NotContains(t, out, "[DONE]")
+		})
+	}
+}
+
+// stuckClient is a connection to a client that stopped reading: a write
+// blocks until a write deadline set on it passes
+type stuckClient struct {
+	header http.Header
+	cut    chan struct{}
+	once   sync.Once
+}
+
+func (c *stuckClient) Header() http.Header { return c.header }
+func (c *stuckClient) WriteHeader(int)     {}
+func (c *stuckClient) Flush()              {}
+
+func (c *stuckClient) Write(p []byte) (int, error) {
+	<-c.cut
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (c *stuckClient) SetWriteDeadline(t time.Time) error {
+	time.AfterFunc(time.Until(t), func() { c.once.Do(func() { close(c.cut) }) })
+	return nil
+}
+
+func TestStuckClientCut(t *testing.T) {
+	body := &endlessBody{event: `data: {"data": {"phase": "answer", "delta_content": "more "}}` + "\n\n"}
+	mockAI := new(MockAIClient)
+	mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: body}, nil)
+	cfg := &config.Config{
+		Server: config.ServerConfig{StreamStallTimeout: 20 * time.Millisecond, CompressMinBytes: 1},
+		Model:  config.ModelConfig{Default: "glm"},
+		Compat: config.CompatConfig{Profile: compatStrict},
+	}
+	configs := config.Static(cfg)
+	// every writer the chat route stacks has to let the deadline through
+	h := streamFormat(compress(configs)(compat(configs)(ChatCompletions(configs, provider.NewRegistry(mockAI), nil, &MockTokener{}, nil))))
+
+	client := &stuckClient{header: http.Header{}, cut: make(chan struct{})}
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages": [{"role": "user", "content": "hi"}], "stream": true}`))
+	r.Header.Set("Accept", ndjsonContentType)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(client, r)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler is stuck behind a client that reads nothing")
+	}
+	assert.True(t, body.closed.Load(), "upstream is released")
+}
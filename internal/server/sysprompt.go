@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// injectSystemPrompt applies the system prompt configured for the model,
+// looked up by the requested name before the resolved one. returns the mode
+// applied, "" when the request was left as it is
+func injectSystemPrompt(req *domain.ChatRequest, prompts map[string]config.SystemPrompt, requested string) string {
+	sp, ok := prompts[requested]
+	if !ok {
+		sp, ok = prompts[req.Model]
+	}
+	if !ok || sp.Text == "" {
+		return ""
+	}
+	mode := sp.Mode
+	if mode == "" {
+		mode = "prepend"
+	}
+
+	sys := domain.Message{Role: "system", Content: sp.Text}
+	switch mode {
+	case "replace":
+		msgs := []domain.Message{sys}
+		for _, m := range req.Messages {
+			if m.Role != "system" {
+				msgs = append(msgs, m)
+			}
+		}
+		req.Messages = msgs
+	case "append_if_absent":
+		for _, m := range req.Messages {
+			if m.Role == "system" {
+				return ""
+			}
+		}
+		req.Messages = append([]domain.Message{sys}, req.Messages...)
+	default:
+		req.Messages = append([]domain.Message{sys}, req.Messages...)
+	}
+	return mode
+}
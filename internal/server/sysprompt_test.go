@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestInjectSystemPrompt(t *testing.T) {
+	withSystem := func() []domain.Message {
+		return []domain.Message{
+			{Role: "system", Content: "own"},
+			{Role: "user", Content: "hi"},
+		}
+	}
+	withoutSystem := func() []domain.Message {
+		return []domain.Message{{Role: "user", Content: "hi"}}
+	}
+	lines := func(msgs []domain.Message) []string {
+		var out []string
+		for _, m := range msgs {
+			out = append(out, m.Role+":"+m.Content.(string))
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		name     string
+		mode     string
+		messages []domain.Message
+		want     []string
+		applied  string
+	}{
+		{"prepend", "", withSystem(), []string{"system:cfg", "system:own", "user:hi"}, "prepend"},
+		{"prepend without system", "prepend", withoutSystem(), []string{"system:cfg", "user:hi"}, "prepend"},
+		{"replace", "replace", withSystem(), []string{"system:cfg", "user:hi"}, "replace"},
+		{"append if absent", "append_if_absent", withoutSystem(), []string{"system:cfg", "user:hi"}, "append_if_absent"},
+		{"append if absent keeps own", "append_if_absent", withSystem(), []string{"system:own", "user:hi"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &domain.ChatRequest{Model: "GLM-4-6-API-V1", Messages: tt.messages}
+			prompts := map[string]config.SystemPrompt{"GLM-4-6-API-V1": {Text: "cfg", Mode: tt.mode}}
+
+			assert.Equal(t, tt.applied, injectSystemPrompt(req, prompts, "GLM-4-6-API-V1"))
+			assert.Equal(t, tt.want, lines(req.Messages))
+		})
+	}
+}
+
+func TestInjectSystemPromptAlias(t *testing.T) {
+	prompts := map[string]config.SystemPrompt{
+		"glm":            {Text: "by alias"},
+		"GLM-4-6-API-V1": {Text: "by id"},
+	}
+
+	// the alias the client asked for wins over the id it resolves to
+	req := &domain.ChatRequest{Model: "GLM-4-6-API-V1", Messages: []domain.Message{{Role: "user", Content: "hi"}}}
+	injectSystemPrompt(req, prompts, "glm")
+	assert.Equal(t, "by alias", req.Messages[0].Content)
+
+	// an alias without a prompt of its own falls back to the resolved id
+	req = &domain.ChatRequest{Model: "GLM-4-6-API-V1", Messages: []domain.Message{{Role: "user", Content: "hi"}}}
+	injectSystemPrompt(req, prompts, "glm-latest")
+	assert.Equal(t, "by id", req.Messages[0].Content)
+
+	req = &domain.ChatRequest{Model: "other", Messages: []domain.Message{{Role: "user", Content: "hi"}}}
+	assert.Empty(t, injectSystemPrompt(req, prompts, "other"))
+	assert.Len(t, req.Messages, 1)
+}
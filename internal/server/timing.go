@@ -0,0 +1,110 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+)
+
+const (
+	headerTTFT         = "X-Mo-TTFT-Ms"
+	headerTokensPerSec = "X-Mo-Tokens-Per-Sec"
+)
+
+// timing follows one completion. a slow time to the first upstream byte
+// is queueing at z.ai, a low tokens per second is slow generation
+type timing struct {
+	start      time.Time
+	firstByte  time.Time
+	firstDelta time.Time
+	// hand the numbers to the client, ?debug=true outside the strict profile
+	expose bool
+}
+
+func newTiming(r *http.Request, cfg *config.Config) *timing {
+	debug, _ := strconv.ParseBool(r.URL.Query().Get("debug"))
+	return &timing{start: time.Now(), expose: debug && cfg.Compat.Profile != compatStrict}
+}
+
+// upstream marks the upstream response headers
+func (t *timing) upstream() {
+	t.firstByte = time.Now()
+}
+
+// delta marks generated output, only the first one counts. nil is a no-op
+// for the follow-up calls of retries and resumes
+func (t *timing) delta() {
+	if t != nil && t.firstDelta.IsZero() {
+		t.firstDelta = time.Now()
+	}
+}
+
+// done logs the completion timings and adds them to the metrics
+func (t *timing) done(model string, completionTokens int) *domain.Timings {
+	end := time.Now()
+	tm := &domain.Timings{
+		UpstreamTTFBMs: t.firstByte.Sub(t.start).Milliseconds(),
+		TotalMs:        end.Sub(t.start).Milliseconds(),
+	}
+	if !t.firstDelta.IsZero() {
+		tm.TTFTMs = t.firstDelta.Sub(t.start).Milliseconds()
+		if gen := end.Sub(t.firstDelta).Seconds(); gen > 0 && completionTokens > 0 {
+			tm.TokensPerSec = math.Round(float64(completionTokens)/gen*10) / 10
+		}
+	}
+
+	logger.Info().
+		Str("model", model).
+		Int64("upstream_ttfb_ms", tm.UpstreamTTFBMs).
+		Int64("ttft_ms", tm.TTFTMs).
+		Int64("total_ms", tm.TotalMs).
+		Int("completion_tokens", completionTokens).
+		Float64("tokens_per_sec", tm.TokensPerSec).
+		Msg("completion timing")
+
+	// sums, divide by timed_completions for the mean
+	metrics.Inc("timed_completions", model)
+	metrics.Add("upstream_ttfb_ms", model, tm.UpstreamTTFBMs)
+	metrics.Add("ttft_ms", model, tm.TTFTMs)
+	metrics.Add("completion_ms", model, tm.TotalMs)
+	return tm
+}
+
+// declareTrailers announces the timing headers of a stream, they can only
+// follow the body as http trailers
+func (t *timing) declareTrailers(w http.ResponseWriter) {
+	if t.expose {
+		w.Header().Set("Trailer", headerTTFT+", "+headerTokensPerSec)
+	}
+}
+
+// finishStream reports the timings of a stream, exposed as http trailers
+// and a last chunk with empty choices
+func (t *timing) finishStream(w http.ResponseWriter, sse *sseWriter, id, model string, completionTokens int) {
+	tm := t.done(model, completionTokens)
+	if !t.expose {
+		return
+	}
+
+	setTimingHeaders(w.Header(), tm)
+	sse.Trailer(domain.ChatResponse{
+		ID:                id,
+		Object:            "chat.completion.chunk",
+		Created:           time.Now().Unix(),
+		Model:             model,
+		SystemFingerprint: systemFingerprint(model),
+		Choices:           []domain.Choice{},
+		Timings:           tm,
+	})
+}
+
+func setTimingHeaders(h http.Header, tm *domain.Timings) {
+	h.Set(headerTTFT, strconv.FormatInt(tm.TTFTMs, 10))
+	h.Set(headerTokensPerSec, strconv.FormatFloat(tm.TokensPerSec, 'f', 1, 64))
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// slowStream holds back the first delta like a model thinking before it answers
+func slowStream(delay time.Duration) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		time.Sleep(delay)
+		pw.Write([]byte(answerStream("one two ", "three four five")))
+		pw.Close()
+	}()
+	return pr
+}
+
+func TestTimings(t *testing.T) {
+	const delay = 60 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		stream  bool
+		query   string
+		profile string
+		expose  bool
+	}{
+		{"stream debug", true, "?debug=true", "extended", true},
+		{"json debug", false, "?debug=1", "extended", true},
+		{"stream without debug", true, "", "extended", false},
+		{"json without debug", false, "", "extended", false},
+		{"strict never exposes", false, "?debug=true", "strict", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{StatusCode: 200, Body: slowStream(delay)}, nil)
+
+			cfg := &config.Config{
+				Model:  config.ModelConfig{Default: "glm", ThinkMode: "reasoning"},
+				Compat: config.CompatConfig{Profile: tt.profile},
+			}
+			body := `{"messages": [{"role": "user", "content": "count"}], "stream": ` + strconv.FormatBool(tt.stream) + `}`
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(mockAI), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions"+tt.query, strings.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			res := w.Result()
+			headers := res.Header
+			var timings *domain.Timings
+			if tt.stream {
+				// the numbers are known only after the body, they are trailers
+				headers = res.Trailer
+				events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+				var last domain.ChatResponse
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-2], "data: ")), &last))
+				timings = last.Timings
+			} else {
+				var resp domain.ChatResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				timings = resp.Timings
+			}
+
+			if !tt.expose {
+				assert.Empty(t, headers.Get(headerTTFT))
+				assert.Empty(t, headers.Get(headerTokensPerSec))
+				assert.Nil(t, timings)
+				return
+			}
+
+			ttft, err := strconv.ParseInt(headers.Get(headerTTFT), 10, 64)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, ttft, delay.Milliseconds())
+			assert.Less(t, ttft, int64(5000))
+
+			tps, err := strconv.ParseFloat(headers.Get(headerTokensPerSec), 64)
+			require.NoError(t, err)
+			assert.Positive(t, tps)
+
+			require.NotNil(t, timings)
+			assert.Equal(t, ttft, timings.TTFTMs)
+			assert.GreaterOrEqual(t, timings.TotalMs, timings.TTFTMs)
+			assert.LessOrEqual(t, timings.UpstreamTTFBMs, timings.TTFTMs)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+)
+
+type tokenizeRequest struct {
+	Text     *string          `json:"text"`
+	Messages []domain.Message `json:"messages"`
+	Tools    []domain.Tool    `json:"tools"`
+	// ids and pieces of text, not available for messages
+	IncludeTokens bool `json:"include_tokens"`
+}
+
+type tokenizeResponse struct {
+	Count    int      `json:"count"`
+	TokenIDs []int    `json:"token_ids,omitempty"`
+	Pieces   []string `json:"pieces,omitempty"`
+}
+
+// Tokenize counts a text, or a messages array the way usage bills it, so
+// a prompt can be priced before it is sent
+func Tokenize(configs config.Provider, tokenizer utils.Tokener) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := configs.ForKey(bearerKey(r))
+		if cfg.Limits.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.Limits.MaxBodyBytes))
+		}
+
+		var req tokenizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeAPIErr(w, domain.NewAPIError(http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit)).WithCode("request_too_large"))
+				return
+			}
+			writeErr(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+
+		if (req.Text == nil) == (len(req.Messages) == 0) {
+			writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "send either text or messages").WithParam("text"))
+			return
+		}
+
+		var resp tokenizeResponse
+		if req.Text == nil {
+			if req.IncludeTokens {
+				writeAPIErr(w, domain.NewAPIError(http.StatusBadRequest, "include_tokens needs text").WithParam("include_tokens"))
+				return
+			}
+			chat := domain.ChatRequest{Messages: req.Messages, Tools: req.Tools}
+			resp.Count = utils.CountChatTokens(tokenizer, &chat, cfg.Tokenizer.ImageTokens)
+		} else {
+			resp.Count = tokenizer.Count(*req.Text)
+		}
+
+		if req.IncludeTokens {
+			enc, ok := tokenizer.(utils.Encoder)
+			if !ok {
+				writeAPIErr(w, domain.NewAPIError(http.StatusServiceUnavailable, "tokenizer can not list tokens").WithCode("tokenizer_unavailable"))
+				return
+			}
+			ids, pieces, err := enc.Encode(*req.Text)
+			if err != nil {
+				writeAPIErr(w, domain.NewAPIError(http.StatusServiceUnavailable, "counts are estimated, token ids are unavailable").WithCode("tokenizer_unavailable"))
+				return
+			}
+			resp.TokenIDs, resp.Pieces = ids, pieces
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
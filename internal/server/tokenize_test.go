@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+)
+
+// encodingTokener lists one token per word, ids are word lengths
+type encodingTokener struct{ MockTokener }
+
+func (*encodingTokener) Encode(text string) ([]int, []string, error) {
+	pieces := strings.Fields(text)
+	ids := make([]int, len(pieces))
+	for i, p := range pieces {
+		ids[i] = len(p)
+	}
+	return ids, pieces, nil
+}
+
+func TestTokenize(t *testing.T) {
+	cfg := &config.Config{Tokenizer: config.TokenizerConfig{ImageTokens: 100}}
+
+	messages := `[{"role":"user","content":[{"type":"text","text":"what is this"},{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]`
+	var chat domain.ChatRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"messages":`+messages+`}`), &chat))
+
+	tests := []struct {
+		name       string
+		tokenizer  utils.Tokener
+		body       string
+		wantStatus int
+		want       tokenizeResponse
+		wantParam  string
+		wantCode   string
+	}{
+		{
+			name:       "text",
+			tokenizer:  &MockTokener{},
+			body:       `{"text":"how many tokens is this"}`,
+			wantStatus: http.StatusOK,
+			want:       tokenizeResponse{Count: 5},
+		},
+		{
+			name:       "messages count like usage",
+			tokenizer:  &MockTokener{},
+			body:       `{"messages":` + messages + `}`,
+			wantStatus: http.StatusOK,
+			want:       tokenizeResponse{Count: utils.CountChatTokens(&MockTokener{}, &chat, 100)},
+		},
+		{
+			name:       "include tokens",
+			tokenizer:  &encodingTokener{},
+			body:       `{"text":"hello big world","include_tokens":true}`,
+			wantStatus: http.StatusOK,
+			want:       tokenizeResponse{Count: 3, TokenIDs: []int{5, 3, 5}, Pieces: []string{"hello", "big", "world"}},
+		},
+		{
+			name:       "neither",
+			tokenizer:  &MockTokener{},
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+			wantParam:  "text",
+		},
+		{
+			name:       "both",
+			tokenizer:  &MockTokener{},
+			body:       `{"text":"a","messages":` + messages + `}`,
+			wantStatus: http.StatusBadRequest,
+			wantParam:  "text",
+		},
+		{
+			name:       "tokens of messages",
+			tokenizer:  &encodingTokener{},
+			body:       `{"messages":` + messages + `,"include_tokens":true}`,
+			wantStatus: http.StatusBadRequest,
+			wantParam:  "include_tokens",
+		},
+		{
+			name:       "tokenizer can not list tokens",
+			tokenizer:  &MockTokener{},
+			body:       `{"text":"a","include_tokens":true}`,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   "tokenizer_unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Tokenize(config.Static(cfg), tt.tokenizer)(w, httptest.NewRequest("POST", "/v1/tokenize", strings.NewReader(tt.body)))
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+
+			if tt.wantStatus != http.StatusOK {
+				apiErr := decodeAPIError(t, w)
+				if tt.wantParam != "" {
+					assert.Equal(t, tt.wantParam, *apiErr.Param)
+				}
+				if tt.wantCode != "" {
+					assert.Equal(t, tt.wantCode, *apiErr.Code)
+				}
+				return
+			}
+
+			var got tokenizeResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
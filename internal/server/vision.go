@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// routeImages moves a request with images to a model of p that reads
+// them. a model without a vision stand-in is refused here, upstream would
+// only answer with an opaque error
+func routeImages(ctx context.Context, req *domain.ChatRequest, p provider.Provider) *domain.APIError {
+	if !hasImages(req) {
+		return nil
+	}
+	model := provider.ImageModel(p, req.Model)
+	if model == "" {
+		return domain.NewAPIError(http.StatusBadRequest, fmt.Sprintf("model %s does not accept images", req.Model)).
+			WithParam("messages").WithCode("model_not_vision")
+	}
+	if model != req.Model {
+		logger.FromContext(ctx).Debug().Str("from", req.Model).Str("to", model).Msg("request with images routed to a vision model")
+		req.Model = model
+	}
+	return nil
+}
+
+func hasImages(req *domain.ChatRequest) bool {
+	for _, msg := range req.Messages {
+		if hasImage(msg.Content) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/provider"
+)
+
+// visionMock reads images on "eyes" only and sends "general" there
+type visionMock struct {
+	*MockAIClient
+}
+
+func (visionMock) AcceptsImages(model string) bool { return model == "eyes" }
+
+func (visionMock) VisionModel(model string) string {
+	if model == "general" {
+		return "eyes"
+	}
+	return ""
+}
+
+func TestRouteImages(t *testing.T) {
+	sse := `data: {"data": {"phase": "answer", "delta_content": "a cat", "done": true}}` + "\n\n"
+	image := []any{
+		map[string]any{"type": "text", "text": "what is this?"},
+		map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,iVBORw0KGgo="}},
+	}
+
+	tests := []struct {
+		name     string
+		vision   bool
+		model    string
+		content  any
+		wantSent string
+	}{
+		{"general model with an image", true, "general", image, "eyes"},
+		{"vision model stays", true, "eyes", image, "eyes"},
+		{"text stays on the general model", true, "general", "hi", "general"},
+		{"no stand-in", true, "tiny", image, ""},
+		{"provider reading images everywhere", false, "general", image, "general"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Model: config.ModelConfig{Default: "general", ThinkMode: "reasoning"}}
+			mockAI := new(MockAIClient)
+			mockAI.On("SendChatRequest", mock.Anything, mock.Anything).Return(&http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(sse)),
+			}, nil).Maybe()
+			var p provider.Provider = mockAI
+			if tt.vision {
+				p = visionMock{mockAI}
+			}
+
+			body, _ := json.Marshal(domain.ChatRequest{Model: tt.model, Messages: []domain.Message{{Role: "user", Content: tt.content}}})
+			w := httptest.NewRecorder()
+			ChatCompletions(config.Static(cfg), provider.NewRegistry(p), nil, &MockTokener{}, nil)(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+
+			if tt.wantSent == "" {
+				require.Equal(t, http.StatusBadRequest, w.Code)
+				apiErr := decodeAPIError(t, w)
+				assert.Equal(t, "model_not_vision", *apiErr.Code)
+				assert.Contains(t, apiErr.Message, "tiny")
+				mockAI.AssertNotCalled(t, "SendChatRequest", mock.Anything, mock.Anything)
+				return
+			}
+
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			sent := mockAI.Calls[0].Arguments.Get(0).(*domain.ChatRequest)
+			assert.Equal(t, tt.wantSent, sent.Model)
+
+			var resp domain.ChatResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantSent, resp.Model)
+		})
+	}
+}
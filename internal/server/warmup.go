@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// warmSpares is how many stored tokens besides the active one warmup looks
+// up, the ones an operator switches to first when it fails
+const warmSpares = 3
+
+// warmToken is a token to look up, source names it in the log
+type warmToken struct {
+	source string
+	token  string
+}
+
+// warmup initializes the tokenizer and caches the users of the active token
+// and the next stored ones, all at once. it waits at most timeout, what is
+// not done by then goes on in the background
+func (s *Server) warmup(timeout time.Duration) {
+	cfg := s.configs.Config()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := s.tokenizer.Init(); err != nil {
+			logger.Warn().Err(err).Msg("warmup: tokenizer failed, token counts are estimated")
+			return
+		}
+		logger.Info().Dur("elapsed", time.Since(start)).Msg("warmup: tokenizer ready")
+	}()
+
+	for _, t := range s.warmTokens(cfg) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := *cfg
+			c.Upstream.Token = t.token
+			user, err := s.users.GetUser(&c)
+			if err != nil {
+				logger.Warn().Err(err).Str("token", t.source).Msg("warmup: user lookup failed")
+				return
+			}
+			logger.Info().Str("token", t.source).Str("user_id", user.ID).Dur("elapsed", time.Since(start)).
+				Msg("warmup: user cached")
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info().Dur("elapsed", time.Since(start)).Msg("warmup done")
+	case <-time.After(timeout):
+		logger.Warn().Dur("timeout", timeout).Msg("warmup not done, listening anyway")
+	}
+}
+
+// warmTokens lists what requests will authenticate with. the first is
+// whatever GetUser resolves, a configured, active stored or guest token, and
+// without a configured one the next stored tokens not known to be invalid
+func (s *Server) warmTokens(cfg *config.Config) []warmToken {
+	tokens := []warmToken{{source: "active", token: cfg.Upstream.Token}}
+	if cfg.Upstream.Token != "" || s.tokenStore == nil {
+		return tokens
+	}
+
+	stored, err := s.tokenStore.ListByProvider("glm")
+	if err != nil {
+		logger.Warn().Err(err).Msg("warmup: token store unreadable")
+		return tokens
+	}
+	for _, t := range stored {
+		if len(tokens) > warmSpares {
+			break
+		}
+		if t.IsActive || (t.LastCheck != nil && !t.LastCheck.Valid) {
+			continue
+		}
+		tokens = append(tokens, warmToken{source: t.ID, token: t.Token})
+	}
+	return tokens
+}
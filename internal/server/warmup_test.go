@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+// warmUsers records the tokens looked up, each lookup takes delay or
+// blocks until release is closed
+type warmUsers struct {
+	delay   time.Duration
+	release chan struct{}
+
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (u *warmUsers) GetUser(cfg *config.Config) (*domain.User, error) {
+	if u.release != nil {
+		<-u.release
+	}
+	time.Sleep(u.delay)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.tokens = append(u.tokens, cfg.Upstream.Token)
+	return &domain.User{ID: "u", Token: cfg.Upstream.Token}, nil
+}
+
+func (u *warmUsers) Invalidate(string) {}
+
+func (u *warmUsers) looked() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.tokens...)
+}
+
+type warmTokener struct {
+	MockTokener
+	ready atomic.Bool
+}
+
+func (w *warmTokener) Init() error {
+	time.Sleep(20 * time.Millisecond)
+	w.ready.Store(true)
+	return nil
+}
+
+// startListening runs s.Start on a free port and returns once it accepts,
+// the listener is shut down when the test ends
+func startListening(t *testing.T, s *Server, cfg *config.Config) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+	t.Cleanup(func() {
+		require.NoError(t, s.Shutdown(context.Background()))
+		assert.ErrorIs(t, <-started, http.ErrServerClosed)
+	})
+	addr := net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port))
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestWarmupBeforeListening(t *testing.T) {
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	for _, tok := range []string{"active", "spare-1", "invalid", "spare-2"} {
+		added, err := store.Add(tok+"@example.org", tok)
+		require.NoError(t, err)
+		if tok == "invalid" {
+			require.NoError(t, store.RecordCheck(added.ID, false))
+		}
+	}
+
+	users := &warmUsers{delay: 50 * time.Millisecond}
+	tokenizer := &warmTokener{}
+	cfg := &config.Config{Server: config.ServerConfig{Warmup: true, WarmupTimeout: 5 * time.Second}}
+	s := &Server{configs: config.Static(cfg), router: chi.NewRouter(), tokenizer: tokenizer, tokenStore: store, users: users}
+
+	startListening(t, s, cfg)
+
+	assert.True(t, tokenizer.ready.Load(), "tokenizer is ready before the listener accepts")
+	assert.ElementsMatch(t, []string{"", "spare-1", "spare-2"}, users.looked(),
+		"the active token resolves inside GetUser, the invalid one is skipped")
+}
+
+func TestWarmupTimeout(t *testing.T) {
+	users := &warmUsers{release: make(chan struct{})}
+	defer close(users.release)
+
+	cfg := &config.Config{Server: config.ServerConfig{Warmup: true, WarmupTimeout: 50 * time.Millisecond}}
+	s := &Server{configs: config.Static(cfg), router: chi.NewRouter(), tokenizer: &MockTokener{}, users: users}
+
+	start := time.Now()
+	startListening(t, s, cfg)
+	assert.Less(t, time.Since(start), 2*time.Second, "a dead upstream does not hold up the listener")
+	assert.Empty(t, users.looked())
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/jwt"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// a guest token is replaced this long before it expires
+const guestMargin = time.Minute
+
+// lifetime assumed for a guest token without an exp claim
+const guestTTL = time.Hour
+
+// Account is who a z.ai token belongs to
+type Account struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// FetchAccount asks upstream whose token this is
+func FetchAccount(cfg *config.Config, token string) (*Account, error) {
+	result, _, err := callAuths(cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{
+		ID:    getString(result, "id"),
+		Email: getString(result, "email"),
+		Name:  getString(result, "name"),
+	}, nil
+}
+
+type guestToken struct {
+	token   string
+	expires time.Time
+}
+
+// GuestToken returns z.ai's anonymous token, fetching a new one once the
+// last is about to expire
+func (s *Service) GuestToken(cfg *config.Config) (string, error) {
+	s.guestMu.Lock()
+	defer s.guestMu.Unlock()
+
+	if s.guest.token != "" && time.Until(s.guest.expires) > guestMargin {
+		return s.guest.token, nil
+	}
+
+	// z.ai hands a visitor without a session a guest account
+	result, cookies, err := callAuths(cfg, "")
+	if err != nil {
+		return "", fmt.Errorf("guest token: %w", err)
+	}
+	token := getString(result, "token")
+	for _, c := range cookies {
+		if token == "" && c.Name == "token" {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("guest token: none in auth response")
+	}
+
+	exp, ok := TokenExpiry(token)
+	if !ok {
+		exp = time.Now().Add(guestTTL)
+	}
+	s.guest = guestToken{token: token, expires: exp}
+	logger.Info().Str("user_id", getString(result, "id")).Time("expires", exp).Msg("guest token acquired")
+	return token, nil
+}
+
+// TokenExpiry reads the exp claim of a jwt without verifying the signature
+func TokenExpiry(token string) (time.Time, bool) {
+	exp, err := jwt.Expiry(token)
+	return exp, err == nil && !exp.IsZero()
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+func signedJWT(sub string, exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":%q,"exp":%d}`, sub, exp.Unix())))
+	return "e30." + payload + ".sig"
+}
+
+func TestGuestToken(t *testing.T) {
+	var issued atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.Write([]byte(`{"id":"guest-1","name":"Guest"}`))
+			return
+		}
+		n := issued.Add(1)
+		id := fmt.Sprintf("guest-%d", n)
+		fmt.Fprintf(w, `{"id":%q,"role":"guest","token":%q}`, id, signedJWT(id, time.Now().Add(time.Hour)))
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{Upstream: config.UpstreamConfig{
+		Protocol:  "http:",
+		Host:      strings.TrimPrefix(srv.URL, "http://"),
+		TokenMode: config.TokenModeGuest,
+	}}
+	s := &Service{cache: map[string]*cachedUser{}}
+
+	first, err := s.GuestToken(cfg)
+	require.NoError(t, err)
+	again, err := s.GuestToken(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, first, again, "a live guest token is reused")
+	assert.EqualValues(t, 1, issued.Load())
+
+	user, err := s.GetUser(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, first, user.Token, "without a token guest mode signs in as the guest")
+
+	// about to expire, the next call fetches a fresh one
+	s.guest.expires = time.Now().Add(10 * time.Second)
+	renewed, err := s.GuestToken(cfg)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, issued.Load())
+	assert.NotEqual(t, first, renewed)
+
+	cfg.Upstream.TokenMode = ""
+	s.guest = guestToken{}
+	_, err = s.GetUser(cfg)
+	assert.Error(t, err, "without guest mode a token is required")
+}
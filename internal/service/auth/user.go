@@ -11,22 +11,43 @@ import (
 	"github.com/zarazaex69/mo/internal/domain"
 	"github.com/zarazaex69/mo/internal/pkg/httpclient"
 	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
 	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
 )
 
 type AuthServicer interface {
 	GetUser(cfg *config.Config) (*domain.User, error)
+	// Invalidate is told upstream refused token, its user is looked up again
+	Invalidate(token string)
 }
 
+const (
+	// how long a looked up user is trusted
+	userTTL = 30 * time.Minute
+	// how long after a refusal a token that validated again is trusted
+	suspectTTL = time.Minute
+)
+
 type Service struct {
 	cache      map[string]*cachedUser
 	mu         sync.RWMutex
 	tokenStore *tokenstore.Store
+
+	// one guest token fetch at a time
+	guestMu sync.Mutex
+	guest   guestToken
 }
 
 type cachedUser struct {
 	user     *domain.User
 	cachedAt time.Time
+	ttl      time.Duration
+	// upstream refused the token since, it must validate again
+	suspect bool
+}
+
+func (c *cachedUser) fresh() bool {
+	return !c.suspect && time.Since(c.cachedAt) < c.ttl
 }
 
 var (
@@ -65,6 +86,14 @@ func (s *Service) GetUser(cfg *config.Config) (*domain.User, error) {
 		}
 	}
 
+	if token == "" && cfg.Upstream.TokenMode == config.TokenModeGuest {
+		guest, err := s.GuestToken(cfg)
+		if err != nil {
+			return nil, err
+		}
+		token = guest
+	}
+
 	if token == "" {
 		return nil, fmt.Errorf("token required")
 	}
@@ -73,54 +102,91 @@ func (s *Service) GetUser(cfg *config.Config) (*domain.User, error) {
 	cached, ok := s.cache[token]
 	s.mu.RUnlock()
 
-	if ok && time.Since(cached.cachedAt) < 30*time.Minute {
+	if ok && cached.fresh() {
+		metrics.Inc("auth_user_cache", "hit")
 		return cached.user, nil
 	}
+	metrics.Inc("auth_user_cache", "miss")
+
+	result, _, err := callAuths(cfg, token)
+	if err != nil {
+		return nil, err
+	}
+
+	userID := getString(result, "id")
+	userName := getString(result, "name")
+
+	user := &domain.User{
+		ID:    userID,
+		Token: token,
+	}
+
+	if userID != "" {
+		ttl := userTTL
+		if ok && cached.suspect {
+			ttl = suspectTTL
+		}
+		s.mu.Lock()
+		s.cache[token] = &cachedUser{user: user, cachedAt: time.Now(), ttl: ttl}
+		s.mu.Unlock()
+		logger.Info().Str("user_id", userID).Str("name", userName).Msg("user authenticated")
+	}
+
+	return user, nil
+}
 
-	url := fmt.Sprintf("%s//%s/api/v1/auths/", cfg.Upstream.Protocol, cfg.Upstream.Host)
-	req, err := http.NewRequest("GET", url, nil)
+// callAuths fetches /api/v1/auths/ as token, anonymously for ""
+func callAuths(cfg *config.Config, token string) (map[string]any, []*http.Cookie, error) {
+	req, err := http.NewRequest("GET", cfg.AuthURL(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return nil, nil, fmt.Errorf("create request: %w", err)
 	}
 
 	for k, v := range cfg.GetUpstreamHeaders() {
 		req.Header.Set(k, v)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+token)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	client := httpclient.New(10 * time.Second)
+	client := httpclient.New(10 * time.Second).WithRetry(httpclient.RetryPolicy{
+		MaxAttempts: cfg.HTTP.Retry.MaxAttempts,
+		Budget:      cfg.HTTP.Retry.Budget,
+	})
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("fetch user: %w", err)
+		return nil, nil, fmt.Errorf("fetch user: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("auth api returned %d", resp.StatusCode)
+		return nil, nil, fmt.Errorf("auth api returned %d", resp.StatusCode)
 	}
 
 	var result map[string]any
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+		return nil, nil, fmt.Errorf("decode response: %w", err)
 	}
+	return result, resp.Cookies(), nil
+}
 
-	userID := getString(result, "id")
-	userName := getString(result, "name")
-
-	user := &domain.User{
-		ID:    userID,
-		Token: token,
-	}
+// Invalidate marks the user of token suspect after upstream refused it. the
+// next GetUser validates the token again, and trusts it only for suspectTTL
+// if it passes. a refused guest token is replaced
+func (s *Service) Invalidate(token string) {
+	s.mu.Lock()
+	s.cache[token] = &cachedUser{suspect: true}
+	s.mu.Unlock()
 
-	if userID != "" {
-		s.mu.Lock()
-		s.cache[token] = &cachedUser{user: user, cachedAt: time.Now()}
-		s.mu.Unlock()
-		logger.Info().Str("user_id", userID).Str("name", userName).Msg("user authenticated")
+	s.guestMu.Lock()
+	if s.guest.token == token {
+		s.guest = guestToken{}
 	}
+	s.guestMu.Unlock()
 
-	return user, nil
+	metrics.Inc("auth_user_cache", "invalidated")
+	logger.Warn().Msg("upstream refused the token, its user is looked up again")
 }
 
 func (s *Service) ClearCache() {
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+func TestUserCacheInvalidate(t *testing.T) {
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	revoked := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[token]++
+		if revoked[token] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"user-` + token + `"}`))
+	}))
+	defer srv.Close()
+
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.Add("a@example.org", "a")
+	require.NoError(t, err)
+	spare, err := store.Add("b@example.org", "b")
+	require.NoError(t, err)
+
+	cfg := &config.Config{Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(srv.URL, "http://")}}
+	s := &Service{cache: map[string]*cachedUser{}, tokenStore: store}
+	hits := metrics.Get("auth_user_cache", "hit")
+
+	user, err := s.GetUser(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "user-a", user.ID)
+	_, err = s.GetUser(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups["a"])
+	assert.Equal(t, hits+1, metrics.Get("auth_user_cache", "hit"))
+
+	// revoked upstream mid-run, the cache keeps vouching for it until told
+	mu.Lock()
+	revoked["a"] = true
+	mu.Unlock()
+	_, err = s.GetUser(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookups["a"])
+
+	s.Invalidate("a")
+	_, err = s.GetUser(cfg)
+	assert.ErrorContains(t, err, "401")
+	assert.Equal(t, 2, lookups["a"])
+
+	// rotating to the next stored token recovers
+	require.NoError(t, store.SetActive(spare.ID))
+	user, err = s.GetUser(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "user-b", user.ID)
+
+	// a refused token that validates again is trusted only briefly
+	s.Invalidate("b")
+	_, err = s.GetUser(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 2, lookups["b"])
+	assert.Equal(t, suspectTTL, s.cache["b"].ttl)
+}
@@ -0,0 +1,594 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+var log = logger.Module("batch")
+
+// batch states, openai's names
+const (
+	Validating = "validating"
+	InProgress = "in_progress"
+	// cancel was asked, the requests in flight are being stopped
+	Cancelling = "cancelling"
+	Completed  = "completed"
+	Failed     = "failed"
+	Cancelled  = "cancelled"
+)
+
+// Endpoint is the only url a batch request may target
+const Endpoint = "/v1/chat/completions"
+
+// CompletionWindow is the only window accepted, requests run as soon as a
+// slot is free and a batch is never expired
+const CompletionWindow = "24h"
+
+// longest wait on a rate limited or shed request before asking again
+const maxRetryWait = time.Minute
+
+var (
+	ErrNotFound = errors.New("batch not found")
+	ErrFinished = errors.New("batch already finished")
+	ErrNoFile   = errors.New("file not found")
+)
+
+// Batch is a set of chat requests run in the background, openai shaped
+type Batch struct {
+	ID               string  `json:"id"`
+	Object           string  `json:"object"`
+	Endpoint         string  `json:"endpoint"`
+	Errors           *Errors `json:"errors"`
+	InputFileID      string  `json:"input_file_id"`
+	CompletionWindow string  `json:"completion_window"`
+	Status           string  `json:"status"`
+	// results and errors of every request that ran, in input order
+	OutputFileID *string `json:"output_file_id"`
+	ErrorFileID  *string `json:"error_file_id"`
+
+	CreatedAt    int64  `json:"created_at"`
+	InProgressAt *int64 `json:"in_progress_at"`
+	CompletedAt  *int64 `json:"completed_at"`
+	FailedAt     *int64 `json:"failed_at"`
+	CancellingAt *int64 `json:"cancelling_at"`
+	CancelledAt  *int64 `json:"cancelled_at"`
+
+	RequestCounts Counts            `json:"request_counts"`
+	Metadata      map[string]string `json:"metadata"`
+}
+
+func (b *Batch) Finished() bool {
+	return b.Status == Completed || b.Status == Failed || b.Status == Cancelled
+}
+
+type Counts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Errors are why a batch failed validation
+type Errors struct {
+	Object string      `json:"object"`
+	Data   []LineError `json:"data"`
+}
+
+type LineError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// 1-based line of the input, nil for the batch as a whole
+	Line *int `json:"line"`
+}
+
+// File is an uploaded or generated file, openai shaped
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// Reply is what one request got. RetryAfter is set when it was rate
+// limited or shed and may be sent again
+type Reply struct {
+	Status     int
+	RetryAfter time.Duration
+	Body       []byte
+}
+
+// Client is who created a batch, its requests are sent as that client so
+// the same api key config and rate limits apply
+type Client struct {
+	APIKey     string `json:"api_key,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// Runner sends one chat request as client. an error means no reply came
+// back at all
+type Runner func(ctx context.Context, client Client, body []byte) (Reply, error)
+
+// Store persists batches, results and files, the token store implements it
+type Store interface {
+	SaveBatch(id string, data []byte) error
+	Batches() ([][]byte, error)
+	SaveBatchResult(batch string, index int, data []byte) error
+	BatchResults(batch string) ([][]byte, error)
+	SaveFile(id string, data []byte) error
+	File(id string) ([]byte, error)
+	SaveFileOwner(id string, owner []byte) error
+	FileOwner(id string) ([]byte, error)
+}
+
+// record is a batch as it is kept, the client is never shown
+type record struct {
+	Batch
+	Client Client `json:"client"`
+}
+
+type Batches struct {
+	store       Store
+	run         Runner
+	maxRequests int
+	// one per request in flight across all batches
+	slots chan struct{}
+	now   func() time.Time
+
+	mu      sync.Mutex
+	batches map[string]*record
+	// stops the run of a batch, by id
+	stops map[string]context.CancelFunc
+	// Close stops the runs to resume them on the next start
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// New loads the batches kept in store, those that were still running wait
+// for Resume
+func New(store Store, run Runner, concurrency, maxRequests int) *Batches {
+	b := &Batches{
+		store:       store,
+		run:         run,
+		maxRequests: maxRequests,
+		slots:       make(chan struct{}, max(concurrency, 1)),
+		now:         time.Now,
+		batches:     make(map[string]*record),
+		stops:       make(map[string]context.CancelFunc),
+	}
+
+	records, err := store.Batches()
+	if err != nil {
+		log.Warn().Err(err).Msg("load batches")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, data := range records {
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			continue
+		}
+		b.batches[rec.ID] = &rec
+	}
+	return b
+}
+
+// Resume runs the loaded batches that were not finished, skipping the
+// requests that already have a result. only a serving mo resumes, a self
+// test opens the same store and must not send them
+func (b *Batches) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rec := range b.batches {
+		if !rec.Finished() && b.stops[rec.ID] == nil && !b.closing {
+			log.Info().Str("batch", rec.ID).Str("status", rec.Status).Msg("resuming batch")
+			b.start(rec)
+		}
+	}
+}
+
+// AddFile keeps an uploaded file, the input of a later batch. only apiKey
+// may read it or batch it
+func (b *Batches) AddFile(data []byte, filename, purpose, apiKey string) (File, error) {
+	f := File{
+		ID:        newID("file-"),
+		Object:    "file",
+		Bytes:     len(data),
+		CreatedAt: b.now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+	}
+	if err := b.saveFile(f.ID, data, apiKey); err != nil {
+		return File{}, err
+	}
+	return f, nil
+}
+
+// FileContent is an uploaded file or the output of a batch, ErrNoFile for
+// one another api key owns
+func (b *Batches) FileContent(id, apiKey string) ([]byte, error) {
+	owner, err := b.store.FileOwner(id)
+	if err != nil {
+		return nil, err
+	}
+	// files kept before owners were recorded went to keyless clients only
+	if !bytes.Equal(owner, ownerOf(apiKey)) && (owner != nil || apiKey != "") {
+		return nil, ErrNoFile
+	}
+
+	data, err := b.store.File(id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNoFile
+	}
+	return data, nil
+}
+
+func (b *Batches) saveFile(id string, data []byte, apiKey string) error {
+	if err := b.store.SaveFileOwner(id, ownerOf(apiKey)); err != nil {
+		return err
+	}
+	return b.store.SaveFile(id, data)
+}
+
+// ownerOf is how the api key owning a file is kept, a hash so the store
+// holds no second copy of it
+func ownerOf(apiKey string) []byte {
+	sum := sha256.Sum256([]byte(apiKey))
+	return sum[:]
+}
+
+// Create validates the file and runs its requests in the background. a file
+// that does not parse fails the batch right away
+func (b *Batches) Create(fileID string, client Client, metadata map[string]string) (Batch, error) {
+	input, err := b.FileContent(fileID, client.APIKey)
+	if err != nil {
+		return Batch{}, err
+	}
+
+	rec := &record{
+		Batch: Batch{
+			ID:               newID("batch_"),
+			Object:           "batch",
+			Endpoint:         Endpoint,
+			InputFileID:      fileID,
+			CompletionWindow: CompletionWindow,
+			Status:           Validating,
+			CreatedAt:        b.now().Unix(),
+			Metadata:         metadata,
+		},
+		Client: client,
+	}
+
+	requests, lineErrs := Parse(input)
+	if len(requests) > b.maxRequests {
+		lineErrs = append(lineErrs, LineError{Code: "too_many_requests", Message: "a batch holds at most " + strconv.Itoa(b.maxRequests) + " requests"})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.batches[rec.ID] = rec
+	if len(lineErrs) > 0 {
+		rec.Status = Failed
+		rec.FailedAt = b.stamp()
+		rec.Errors = &Errors{Object: "list", Data: lineErrs}
+		b.save(rec)
+		log.Info().Str("batch", rec.ID).Int("errors", len(lineErrs)).Msg("batch failed validation")
+		return rec.Batch, nil
+	}
+
+	rec.RequestCounts.Total = len(requests)
+	b.save(rec)
+	log.Info().Str("batch", rec.ID).Int("requests", len(requests)).Msg("batch created")
+	created := rec.Batch
+	b.start(rec)
+	return created, nil
+}
+
+// Get is a batch apiKey created, ErrNotFound for those of other keys
+func (b *Batches) Get(id, apiKey string) (Batch, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec, ok := b.batches[id]
+	if !ok || rec.Client.APIKey != apiKey {
+		return Batch{}, ErrNotFound
+	}
+	return rec.Batch, nil
+}
+
+// List is every batch apiKey created, newest first
+func (b *Batches) List(apiKey string) []Batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Batch, 0, len(b.batches))
+	for _, rec := range b.batches {
+		if rec.Client.APIKey == apiKey {
+			out = append(out, rec.Batch)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CreatedAt != out[j].CreatedAt {
+			return out[i].CreatedAt > out[j].CreatedAt
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out
+}
+
+// Cancel stops a batch apiKey created. the requests in flight are
+// abandoned, the results so far still make up its output
+func (b *Batches) Cancel(id, apiKey string) (Batch, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rec, ok := b.batches[id]
+	switch {
+	case !ok || rec.Client.APIKey != apiKey:
+		return Batch{}, ErrNotFound
+	case rec.Finished():
+		return Batch{}, ErrFinished
+	}
+	if rec.Status != Cancelling {
+		rec.Status = Cancelling
+		rec.CancellingAt = b.stamp()
+		b.save(rec)
+		log.Info().Str("batch", id).Msg("batch cancelling")
+	}
+	if stop, ok := b.stops[id]; ok {
+		stop()
+	}
+	return rec.Batch, nil
+}
+
+// Close stops every run without finishing it, Resume picks them up again
+func (b *Batches) Close() {
+	b.mu.Lock()
+	b.closing = true
+	for _, stop := range b.stops {
+		stop()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// start runs rec in the background, callers hold mu
+func (b *Batches) start(rec *record) {
+	ctx, stop := context.WithCancel(context.Background())
+	b.stops[rec.ID] = stop
+	b.wg.Add(1)
+	go b.process(ctx, rec.ID)
+}
+
+func (b *Batches) process(ctx context.Context, id string) {
+	defer b.wg.Done()
+
+	b.mu.Lock()
+	rec := b.batches[id]
+	fileID, client, status := rec.InputFileID, rec.Client, rec.Status
+	b.mu.Unlock()
+
+	if status == Cancelling {
+		b.finish(id)
+		return
+	}
+
+	// the owner was checked by Create
+	input, err := b.store.File(fileID)
+	if err == nil && input == nil {
+		err = ErrNoFile
+	}
+	if err != nil {
+		b.fail(id, "input_unreadable", err.Error())
+		return
+	}
+	requests, _ := Parse(input)
+
+	done, err := b.results(id)
+	if err != nil {
+		b.fail(id, "results_unreadable", err.Error())
+		return
+	}
+
+	b.mu.Lock()
+	rec.RequestCounts = Counts{Total: len(requests)}
+	for _, res := range done {
+		rec.RequestCounts.add(res)
+	}
+	if rec.Status == Validating {
+		rec.Status = InProgress
+		rec.InProgressAt = b.stamp()
+	}
+	b.save(rec)
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+run:
+	for i, req := range requests {
+		if _, ok := done[i]; ok {
+			continue
+		}
+		select {
+		case b.slots <- struct{}{}:
+		case <-ctx.Done():
+			break run
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-b.slots
+				wg.Done()
+			}()
+			res, ok := b.do(ctx, client, req)
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(entry{Index: i, Result: res})
+			if err := b.store.SaveBatchResult(id, i, data); err != nil {
+				log.Warn().Err(err).Str("batch", id).Int("request", i).Msg("save batch result")
+			}
+
+			b.mu.Lock()
+			rec.RequestCounts.add(res)
+			b.save(rec)
+			b.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	b.finish(id)
+}
+
+// do sends one request, waiting out rate limits. false when the batch was
+// stopped before a reply came
+func (b *Batches) do(ctx context.Context, client Client, req Request) (Result, bool) {
+	res := Result{ID: newID("batch_req_"), CustomID: req.CustomID}
+	for {
+		reply, err := b.run(ctx, client, req.Body)
+		if ctx.Err() != nil {
+			return res, false
+		}
+		if err != nil {
+			res.Error = &ResultError{Code: "request_failed", Message: err.Error()}
+			return res, true
+		}
+		if reply.RetryAfter > 0 {
+			select {
+			case <-time.After(min(reply.RetryAfter, maxRetryWait)):
+				continue
+			case <-ctx.Done():
+				return res, false
+			}
+		}
+
+		body := json.RawMessage(reply.Body)
+		if !json.Valid(body) {
+			body, _ = json.Marshal(strings.TrimSpace(string(reply.Body)))
+		}
+		res.Response = &Response{StatusCode: reply.Status, RequestID: res.ID, Body: body}
+		return res, true
+	}
+}
+
+// finish ends a run: completed, or cancelled when that was asked. the
+// results so far are written out as the output file
+func (b *Batches) finish(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.stops, id)
+	if b.closing {
+		return
+	}
+	rec := b.batches[id]
+
+	if output, err := b.output(id, rec.Client.APIKey); err != nil {
+		log.Warn().Err(err).Str("batch", id).Msg("write batch output")
+	} else if output != "" {
+		rec.OutputFileID = &output
+	}
+
+	if rec.Status == Cancelling {
+		rec.Status = Cancelled
+		rec.CancelledAt = b.stamp()
+	} else {
+		rec.Status = Completed
+		rec.CompletedAt = b.stamp()
+	}
+	b.save(rec)
+	log.Info().Str("batch", id).Str("status", rec.Status).
+		Int("completed", rec.RequestCounts.Completed).Int("failed", rec.RequestCounts.Failed).
+		Msg("batch finished")
+}
+
+func (b *Batches) fail(id, code, msg string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.stops, id)
+	rec := b.batches[id]
+	rec.Status = Failed
+	rec.FailedAt = b.stamp()
+	rec.Errors = &Errors{Object: "list", Data: []LineError{{Code: code, Message: msg}}}
+	b.save(rec)
+	log.Warn().Str("batch", id).Str("reason", msg).Msg("batch failed")
+}
+
+// output joins the results of a batch into a jsonl file of apiKey, ""
+// without any
+func (b *Batches) output(id, apiKey string) (string, error) {
+	results, err := b.store.BatchResults(id)
+	if err != nil || len(results) == 0 {
+		return "", err
+	}
+	var out []byte
+	for _, data := range results {
+		var e entry
+		if json.Unmarshal(data, &e) != nil {
+			continue
+		}
+		line, _ := json.Marshal(e.Result)
+		out = append(append(out, line...), '\n')
+	}
+	fileID := newID("file-")
+	return fileID, b.saveFile(fileID, out, apiKey)
+}
+
+// results are the kept outcomes of a batch by request index
+func (b *Batches) results(id string) (map[int]Result, error) {
+	records, err := b.store.BatchResults(id)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]Result, len(records))
+	for _, data := range records {
+		var e entry
+		if json.Unmarshal(data, &e) == nil {
+			done[e.Index] = e.Result
+		}
+	}
+	return done, nil
+}
+
+// save persists rec, callers hold mu
+func (b *Batches) save(rec *record) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if err := b.store.SaveBatch(rec.ID, data); err != nil {
+		log.Warn().Err(err).Str("batch", rec.ID).Msg("save batch")
+	}
+}
+
+func (b *Batches) stamp() *int64 {
+	t := b.now().Unix()
+	return &t
+}
+
+func (c *Counts) add(res Result) {
+	if res.Failed() {
+		c.Failed++
+	} else {
+		c.Completed++
+	}
+}
+
+func newID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
@@ -0,0 +1,272 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+func newStore(t *testing.T) *tokenstore.Store {
+	t.Helper()
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// lines is a batch input of one request per prompt, custom ids as the
+// prompts
+func lines(prompts ...string) []byte {
+	var out []byte
+	for _, p := range prompts {
+		line, _ := json.Marshal(map[string]any{
+			"custom_id": p,
+			"method":    "POST",
+			"url":       Endpoint,
+			"body":      map[string]any{"messages": []map[string]string{{"role": "user", "content": p}}},
+		})
+		out = append(append(out, line...), '\n')
+	}
+	return out
+}
+
+// prompt is the content a runner was asked for
+func prompt(body []byte) string {
+	var req struct {
+		Messages []struct{ Content string } `json:"messages"`
+	}
+	json.Unmarshal(body, &req)
+	if len(req.Messages) == 0 {
+		return ""
+	}
+	return req.Messages[0].Content
+}
+
+// testKey creates the batches of the tests
+const testKey = "sk-test"
+
+func create(t *testing.T, b *Batches, input []byte) Batch {
+	t.Helper()
+	f, err := b.AddFile(input, "input.jsonl", "batch", testKey)
+	require.NoError(t, err)
+	created, err := b.Create(f.ID, Client{APIKey: testKey}, nil)
+	require.NoError(t, err)
+	return created
+}
+
+func waitFinished(t *testing.T, b *Batches, id string) Batch {
+	t.Helper()
+	var got Batch
+	require.Eventually(t, func() bool {
+		got, _ = b.Get(id, testKey)
+		return got.Finished()
+	}, 5*time.Second, time.Millisecond)
+	return got
+}
+
+// output is the results of a finished batch by custom id
+func output(t *testing.T, b *Batches, batch Batch) map[string]Result {
+	t.Helper()
+	require.NotNil(t, batch.OutputFileID)
+	data, err := b.FileContent(*batch.OutputFileID, testKey)
+	require.NoError(t, err)
+
+	out := map[string]Result{}
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var res Result
+		require.NoError(t, json.Unmarshal(line, &res))
+		out[res.CustomID] = res
+	}
+	return out
+}
+
+func TestBatchPartialFailure(t *testing.T) {
+	var clients sync.Map
+	run := func(ctx context.Context, client Client, body []byte) (Reply, error) {
+		clients.Store(client.APIKey, true)
+		switch p := prompt(body); p {
+		case "bad":
+			return Reply{Status: http.StatusBadRequest, Body: []byte(`{"error":{"message":"bad request"}}`)}, nil
+		case "down":
+			return Reply{}, errors.New("connection refused")
+		default:
+			return Reply{Status: http.StatusOK, Body: []byte(`{"answer":"` + p + `"}`)}, nil
+		}
+	}
+	b := New(newStore(t), run, 2, 100)
+	t.Cleanup(b.Close)
+
+	created := create(t, b, lines("one", "bad", "two", "down"))
+	assert.Equal(t, "batch", created.Object)
+	assert.Equal(t, 4, created.RequestCounts.Total)
+
+	done := waitFinished(t, b, created.ID)
+	assert.Equal(t, Completed, done.Status)
+	assert.Equal(t, Counts{Total: 4, Completed: 2, Failed: 2}, done.RequestCounts)
+	assert.NotNil(t, done.CompletedAt)
+
+	results := output(t, b, done)
+	require.Len(t, results, 4)
+	assert.JSONEq(t, `{"answer":"one"}`, string(results["one"].Response.Body))
+	assert.Equal(t, http.StatusBadRequest, results["bad"].Response.StatusCode)
+	assert.Nil(t, results["down"].Response)
+	assert.Equal(t, "request_failed", results["down"].Error.Code)
+
+	_, ok := clients.Load(testKey)
+	assert.True(t, ok, "requests run as the creating client")
+}
+
+func TestBatchRetriesRateLimits(t *testing.T) {
+	var calls atomic.Int32
+	run := func(ctx context.Context, client Client, body []byte) (Reply, error) {
+		if calls.Add(1) == 1 {
+			return Reply{Status: http.StatusTooManyRequests, RetryAfter: time.Millisecond}, nil
+		}
+		return Reply{Status: http.StatusOK, Body: []byte(`{}`)}, nil
+	}
+	b := New(newStore(t), run, 1, 100)
+	t.Cleanup(b.Close)
+
+	done := waitFinished(t, b, create(t, b, lines("once")).ID)
+	assert.Equal(t, Counts{Total: 1, Completed: 1}, done.RequestCounts)
+	assert.EqualValues(t, 2, calls.Load())
+}
+
+func TestBatchCancel(t *testing.T) {
+	started := make(chan struct{}, 10)
+	run := func(ctx context.Context, client Client, body []byte) (Reply, error) {
+		if prompt(body) == "quick" {
+			return Reply{Status: http.StatusOK, Body: []byte(`{}`)}, nil
+		}
+		started <- struct{}{}
+		<-ctx.Done()
+		return Reply{}, ctx.Err()
+	}
+	b := New(newStore(t), run, 1, 100)
+	t.Cleanup(b.Close)
+
+	created := create(t, b, lines("quick", "slow", "never"))
+	<-started
+
+	cancelling, err := b.Cancel(created.ID, testKey)
+	require.NoError(t, err)
+	assert.Equal(t, Cancelling, cancelling.Status)
+
+	done := waitFinished(t, b, created.ID)
+	assert.Equal(t, Cancelled, done.Status)
+	assert.Equal(t, Counts{Total: 3, Completed: 1}, done.RequestCounts)
+	assert.Len(t, output(t, b, done), 1, "the results so far are kept")
+
+	_, err = b.Cancel(created.ID, testKey)
+	assert.ErrorIs(t, err, ErrFinished)
+	_, err = b.Cancel("batch_missing", testKey)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestBatchResumes(t *testing.T) {
+	store := newStore(t)
+
+	var mu sync.Mutex
+	var ran []string
+	release := make(chan struct{})
+	run := func(ctx context.Context, client Client, body []byte) (Reply, error) {
+		p := prompt(body)
+		if p == "third" {
+			// the server goes down while this one is in flight
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return Reply{}, ctx.Err()
+			}
+		}
+		mu.Lock()
+		ran = append(ran, p)
+		mu.Unlock()
+		return Reply{Status: http.StatusOK, Body: []byte(`{"answer":"` + p + `"}`)}, nil
+	}
+
+	first := New(store, run, 1, 100)
+	created := create(t, first, lines("first", "second", "third", "fourth"))
+	require.Eventually(t, func() bool {
+		got, _ := first.Get(created.ID, testKey)
+		return got.RequestCounts.Completed == 2
+	}, 5*time.Second, time.Millisecond)
+	first.Close()
+
+	stopped, _ := first.Get(created.ID, testKey)
+	assert.Equal(t, InProgress, stopped.Status, "a closed run is not finished")
+
+	close(release)
+	second := New(store, run, 1, 100)
+	t.Cleanup(second.Close)
+	got, _ := second.Get(created.ID, testKey)
+	assert.Equal(t, InProgress, got.Status)
+	mu.Lock()
+	assert.Len(t, ran, 2, "nothing runs before Resume")
+	mu.Unlock()
+	second.Resume()
+
+	done := waitFinished(t, second, created.ID)
+	assert.Equal(t, Completed, done.Status)
+	assert.Equal(t, Counts{Total: 4, Completed: 4}, done.RequestCounts)
+	assert.Equal(t, []string{"first", "second", "third", "fourth"}, ran, "requests with a result are not sent again")
+	assert.Len(t, output(t, second, done), 4)
+}
+
+func TestBatchValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		codes []string
+	}{
+		{name: "empty", input: "\n\n", codes: []string{"empty_file"}},
+		{name: "not json", input: "{\"custom_id\":\"a\",\"body\":{}}\nnope\n", codes: []string{"invalid_json_line"}},
+		{
+			name:  "wrong url and method",
+			input: `{"url":"/v1/embeddings","body":{}}` + "\n" + `{"method":"GET","body":{}}`,
+			codes: []string{"invalid_url", "invalid_method"},
+		},
+		{name: "no body", input: `{"custom_id":"a"}`, codes: []string{"missing_body"}},
+		{name: "duplicate id", input: `{"custom_id":"a","body":{}}` + "\n" + `{"custom_id":"a","body":{}}`, codes: []string{"duplicate_custom_id"}},
+		{name: "too many", input: strings.Repeat(`{"messages":[]}`+"\n", 3), codes: []string{"too_many_requests"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New(newStore(t), func(context.Context, Client, []byte) (Reply, error) {
+				t.Fatal("an invalid batch runs nothing")
+				return Reply{}, nil
+			}, 1, 2)
+			t.Cleanup(b.Close)
+
+			created := create(t, b, []byte(tt.input))
+			assert.Equal(t, Failed, created.Status)
+			require.NotNil(t, created.Errors)
+			var codes []string
+			for _, e := range created.Errors.Data {
+				codes = append(codes, e.Code)
+			}
+			assert.Equal(t, tt.codes, codes)
+		})
+	}
+}
+
+func TestParseBareRequests(t *testing.T) {
+	requests, errs := Parse([]byte(`{"model":"glm","messages":[{"role":"user","content":"hi"}]}` + "\n" +
+		`{"custom_id":"mine","body":{"messages":[]}}`))
+	require.Empty(t, errs)
+	require.Len(t, requests, 2)
+	assert.Equal(t, "request-1", requests[0].CustomID)
+	assert.JSONEq(t, `{"model":"glm","messages":[{"role":"user","content":"hi"}]}`, string(requests[0].Body))
+	assert.Equal(t, "mine", requests[1].CustomID)
+}
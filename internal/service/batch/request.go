@@ -0,0 +1,108 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Request is one line of a batch input, openai's format. a line that is a
+// bare chat request, messages at the top, is taken as the body
+type Request struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Result is one line of a batch output
+type Result struct {
+	ID       string       `json:"id"`
+	CustomID string       `json:"custom_id"`
+	Response *Response    `json:"response"`
+	Error    *ResultError `json:"error"`
+}
+
+type Response struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// ResultError is a request that got no reply at all
+type ResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Failed reports whether the request errored or was answered with one
+func (r Result) Failed() bool {
+	return r.Error != nil || r.Response == nil || r.Response.StatusCode >= 400
+}
+
+// entry is a result as it is kept, with the request it answers
+type entry struct {
+	Index int `json:"index"`
+	Result
+}
+
+// Parse reads a jsonl batch input. any bad line fails the whole batch, as
+// openai's validation does
+func Parse(input []byte) ([]Request, []LineError) {
+	var requests []Request
+	var errs []LineError
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	scanner.Buffer(nil, 32<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		lineErr := func(code, format string, args ...any) {
+			errs = append(errs, LineError{Code: code, Message: fmt.Sprintf(format, args...), Line: &n})
+		}
+
+		var req Request
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(line, &fields); err != nil {
+			lineErr("invalid_json_line", "line %d is not a json object", n)
+			continue
+		}
+		json.Unmarshal(line, &req)
+		if _, bare := fields["messages"]; bare && req.Body == nil {
+			req.Body = append(json.RawMessage(nil), line...)
+		}
+
+		switch {
+		case req.Method != "" && req.Method != "POST":
+			lineErr("invalid_method", "line %d: method must be POST, got %s", n, req.Method)
+			continue
+		case req.URL != "" && req.URL != Endpoint:
+			lineErr("invalid_url", "line %d: url must be %s, got %s", n, Endpoint, req.URL)
+			continue
+		case len(req.Body) == 0 || req.Body[0] != '{':
+			lineErr("missing_body", "line %d has no request body", n)
+			continue
+		}
+
+		if req.CustomID == "" {
+			req.CustomID = fmt.Sprintf("request-%d", len(requests)+1)
+		}
+		if seen[req.CustomID] {
+			lineErr("duplicate_custom_id", "line %d: custom_id %s is used twice", n, req.CustomID)
+			continue
+		}
+		seen[req.CustomID] = true
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, LineError{Code: "invalid_file", Message: err.Error()})
+	}
+	if len(requests) == 0 && len(errs) == 0 {
+		errs = append(errs, LineError{Code: "empty_file", Message: "the batch has no requests"})
+	}
+	return requests, errs
+}
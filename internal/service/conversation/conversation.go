@@ -0,0 +1,159 @@
+package conversation
+
+import (
+	"container/list"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+)
+
+// Store persists conversation records, the token store implements it
+type Store interface {
+	SaveConversation(id string, data []byte) error
+	RemoveConversation(id string) error
+	Conversations() ([][]byte, error)
+}
+
+// record is a conversation as the store keeps it
+type record struct {
+	ID     string    `json:"id"`
+	ChatID string    `json:"chat_id"`
+	UsedAt time.Time `json:"used_at"`
+}
+
+// Map pins the conversation ids clients send to the upstream chat the
+// first request of each started, so upstream sees one chat instead of a new
+// one per request. the max most recently used are kept
+type Map struct {
+	store Store
+	max   int
+
+	mu    sync.Mutex
+	now   func() time.Time
+	newID func() string
+	// most recently used first
+	order *list.List
+	byID  map[string]*list.Element
+}
+
+// New loads the conversations kept in store, nil keeps them in memory
+// only. max 0 pins nothing, every request starts a chat of its own
+func New(store Store, max int) *Map {
+	m := &Map{
+		store: store,
+		max:   max,
+		now:   time.Now,
+		newID: utils.GenerateRequestID,
+		order: list.New(),
+		byID:  make(map[string]*list.Element),
+	}
+	if store == nil || max <= 0 {
+		return m
+	}
+
+	data, err := store.Conversations()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to load conversations")
+	}
+	records := make([]*record, 0, len(data))
+	for _, d := range data {
+		var r record
+		if json.Unmarshal(d, &r) == nil && r.ID != "" && r.ChatID != "" {
+			records = append(records, &r)
+		}
+	}
+	slices.SortFunc(records, func(a, b *record) int { return b.UsedAt.Compare(a.UsedAt) })
+	for _, r := range records {
+		m.byID[r.ID] = m.order.PushBack(r)
+	}
+	m.evict()
+	return m
+}
+
+// ChatID is the upstream chat of conversation id, started on its first
+// request. an empty id or a nil map gets a chat of its own
+func (m *Map) ChatID(id string) string {
+	if m == nil || m.max <= 0 || id == "" {
+		return utils.GenerateRequestID()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var r *record
+	if el, ok := m.byID[id]; ok {
+		m.order.MoveToFront(el)
+		r = el.Value.(*record)
+	} else {
+		r = &record{ID: id, ChatID: m.newID()}
+		m.byID[id] = m.order.PushFront(r)
+	}
+	r.UsedAt = m.now()
+	m.save(r)
+	m.evict()
+	return r.ChatID
+}
+
+// Forget drops conversation id, its next request starts a new chat.
+// false when the id is not pinned
+func (m *Map) Forget(id string) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.byID[id]
+	if !ok {
+		return false
+	}
+	m.remove(el)
+	return true
+}
+
+// Len is how many conversations are pinned
+func (m *Map) Len() int {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// evict drops the least recently used past max
+func (m *Map) evict() {
+	for m.order.Len() > m.max {
+		m.remove(m.order.Back())
+	}
+}
+
+func (m *Map) remove(el *list.Element) {
+	r := m.order.Remove(el).(*record)
+	delete(m.byID, r.ID)
+	if m.store == nil {
+		return
+	}
+	if err := m.store.RemoveConversation(r.ID); err != nil {
+		logger.Warn().Err(err).Str("conversation", r.ID).Msg("failed to remove conversation")
+	}
+}
+
+// save keeps r in the store, a failure only costs the pin on a restart
+func (m *Map) save(r *record) {
+	if m.store == nil {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = m.store.SaveConversation(r.ID, data)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Str("conversation", r.ID).Msg("failed to save conversation")
+	}
+}
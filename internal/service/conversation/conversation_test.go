@@ -0,0 +1,118 @@
+package conversation
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memStore struct {
+	mu            sync.Mutex
+	conversations map[string][]byte
+}
+
+func newMemStore() *memStore { return &memStore{conversations: map[string][]byte{}} }
+
+func (m *memStore) SaveConversation(id string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conversations[id] = data
+	return nil
+}
+
+func (m *memStore) RemoveConversation(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conversations, id)
+	return nil
+}
+
+func (m *memStore) Conversations() ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out [][]byte
+	for _, data := range m.conversations {
+		out = append(out, data)
+	}
+	return out, nil
+}
+
+// counting hands out chat-1, chat-2, ... and a clock a second apart per call
+func counting(m *Map) {
+	n := 0
+	m.newID = func() string {
+		n++
+		return fmt.Sprintf("chat-%d", n)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+}
+
+func TestChatID(t *testing.T) {
+	m := New(nil, 10)
+	counting(m)
+
+	assert.Equal(t, "chat-1", m.ChatID("a"))
+	assert.Equal(t, "chat-2", m.ChatID("b"))
+	assert.Equal(t, "chat-1", m.ChatID("a"), "a conversation keeps its chat")
+
+	assert.NotEqual(t, m.ChatID(""), m.ChatID(""), "no id, a chat per request")
+	assert.Equal(t, 2, m.Len())
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	store := newMemStore()
+	m := New(store, 2)
+	counting(m)
+
+	m.ChatID("a")
+	m.ChatID("b")
+	m.ChatID("a")
+	m.ChatID("c")
+
+	assert.Equal(t, 2, m.Len())
+	assert.Len(t, store.conversations, 2)
+	assert.NotContains(t, store.conversations, "b")
+	assert.Equal(t, "chat-4", m.ChatID("b"), "an evicted conversation starts over")
+}
+
+func TestReload(t *testing.T) {
+	store := newMemStore()
+	m := New(store, 3)
+	counting(m)
+	m.ChatID("a")
+	m.ChatID("b")
+	m.ChatID("c")
+	m.ChatID("a")
+
+	// a restart with a smaller bound keeps the most recently used
+	reloaded := New(store, 2)
+	counting(reloaded)
+	assert.Equal(t, 2, reloaded.Len())
+	assert.Equal(t, "chat-1", reloaded.ChatID("a"))
+	assert.Equal(t, "chat-3", reloaded.ChatID("c"))
+	assert.NotContains(t, store.conversations, "b")
+}
+
+func TestForget(t *testing.T) {
+	store := newMemStore()
+	m := New(store, 10)
+	counting(m)
+
+	m.ChatID("a")
+	require.True(t, m.Forget("a"))
+	assert.False(t, m.Forget("a"))
+	assert.Empty(t, store.conversations)
+	assert.Equal(t, "chat-2", m.ChatID("a"))
+
+	var disabled *Map
+	assert.False(t, disabled.Forget("a"))
+	assert.NotEmpty(t, disabled.ChatID("a"))
+}
@@ -0,0 +1,234 @@
+package drift
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/metrics"
+)
+
+// anomaly classes, each one is a part of the upstream format mo depends on
+const (
+	UnknownPhase      = "unknown_phase"
+	ParseFailure      = "parse_failure"
+	UnexpectedField   = "unexpected_field"
+	SignatureRejected = "signature_rejected"
+)
+
+const (
+	// days kept in the summary, today included
+	retainDays = 7
+	// distinct keys per class, the rest is counted under overflowKey so a
+	// flood of garbage can not grow the monitor without bound
+	maxKeys     = 64
+	overflowKey = "(other)"
+)
+
+// Day is what one utc day looked like
+type Day struct {
+	Date string `json:"date"`
+	// upstream events seen, the denominator of the parse failure rate
+	Events           int64                       `json:"events"`
+	ParseFailureRate float64                     `json:"parse_failure_rate"`
+	Anomalies        map[string]map[string]int64 `json:"anomalies"`
+}
+
+// Sample is the first occurrence of an anomaly, redacted
+type Sample struct {
+	Class     string    `json:"class"`
+	Key       string    `json:"key"`
+	FirstSeen time.Time `json:"first_seen"`
+	Sample    string    `json:"sample"`
+}
+
+type Summary struct {
+	Days    []Day    `json:"days"`
+	Samples []Sample `json:"samples"`
+}
+
+// Monitor counts upstream format anomalies per day and keeps the first
+// sample of each, so a z.ai change shows up with the payload that broke
+type Monitor struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	days    map[string]*Day
+	samples map[string]map[string]*Sample
+}
+
+var defaultMonitor atomic.Pointer[Monitor]
+
+func init() {
+	defaultMonitor.Store(New())
+}
+
+// SetMonitor makes m the monitor of Event, Record and Snapshot and returns the one it replaces
+func SetMonitor(m *Monitor) *Monitor {
+	return defaultMonitor.Swap(m)
+}
+
+func New() *Monitor {
+	return &Monitor{
+		now:     time.Now,
+		days:    make(map[string]*Day),
+		samples: make(map[string]map[string]*Sample),
+	}
+}
+
+// Event counts one upstream event, parsed or not
+func (m *Monitor) Event() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.today().Events++
+}
+
+// Record counts an anomaly. key names what was unexpected (the phase, the
+// field), sample is the raw payload and is redacted before it is kept
+func (m *Monitor) Record(class, key, sample string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	day := m.today()
+	byKey, ok := day.Anomalies[class]
+	if !ok {
+		byKey = make(map[string]int64)
+		day.Anomalies[class] = byKey
+	}
+	if _, ok := byKey[key]; !ok && len(byKey) >= maxKeys {
+		key = overflowKey
+	}
+	byKey[key]++
+
+	seen, ok := m.samples[class]
+	if !ok {
+		seen = make(map[string]*Sample)
+		m.samples[class] = seen
+	}
+	if _, ok := seen[key]; !ok && len(seen) < maxKeys {
+		seen[key] = &Sample{Class: class, Key: key, FirstSeen: m.now().UTC(), Sample: Redact(sample)}
+	}
+
+	metrics.Inc("upstream_drift", class)
+}
+
+// Summary returns the retained days, newest first, and every sample
+func (m *Monitor) Summary() Summary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+
+	out := Summary{Days: make([]Day, 0, len(m.days)), Samples: []Sample{}}
+	for _, d := range m.days {
+		cp := Day{Date: d.Date, Events: d.Events, Anomalies: make(map[string]map[string]int64, len(d.Anomalies))}
+		for class, byKey := range d.Anomalies {
+			keys := make(map[string]int64, len(byKey))
+			for k, v := range byKey {
+				keys[k] = v
+			}
+			cp.Anomalies[class] = keys
+		}
+
+		var failures int64
+		for _, n := range d.Anomalies[ParseFailure] {
+			failures += n
+		}
+		if d.Events > 0 {
+			cp.ParseFailureRate = float64(failures) / float64(d.Events)
+		}
+		out.Days = append(out.Days, cp)
+	}
+	sort.Slice(out.Days, func(i, j int) bool { return out.Days[i].Date > out.Days[j].Date })
+
+	for _, seen := range m.samples {
+		for _, s := range seen {
+			out.Samples = append(out.Samples, *s)
+		}
+	}
+	sort.Slice(out.Samples, func(i, j int) bool {
+		if out.Samples[i].Class != out.Samples[j].Class {
+			return out.Samples[i].Class < out.Samples[j].Class
+		}
+		return out.Samples[i].Key < out.Samples[j].Key
+	})
+	return out
+}
+
+// today returns the current utc day, callers hold mu
+func (m *Monitor) today() *Day {
+	date := m.now().UTC().Format(time.DateOnly)
+
+	day, ok := m.days[date]
+	if !ok {
+		day = &Day{Date: date, Anomalies: make(map[string]map[string]int64)}
+		m.days[date] = day
+		m.prune()
+	}
+	return day
+}
+
+// prune drops the days past retention, callers hold mu
+func (m *Monitor) prune() {
+	oldest := m.now().UTC().AddDate(0, 0, -(retainDays - 1)).Format(time.DateOnly)
+	for d := range m.days {
+		if d < oldest {
+			delete(m.days, d)
+		}
+	}
+}
+
+// enum-like strings (phase names, types, ids of the format) are kept,
+// anything that could be user text is not
+var reToken = regexp.MustCompile(`^[A-Za-z0-9_:.\-]{1,32}$`)
+
+// Redact keeps the shape of a json payload, its keys, numbers, booleans
+// and short identifier values, and blanks every other string. anything
+// that is not json is only told apart by its length and a hash prefix
+func Redact(sample string) string {
+	var v any
+	if err := json.Unmarshal([]byte(sample), &v); err != nil {
+		sum := sha256.Sum256([]byte(sample))
+		return fmt.Sprintf("[not json, %d bytes, sha256 %x]", len(sample), sum[:6])
+	}
+
+	out, _ := json.Marshal(redactValue(v))
+	return string(out)
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			v[k] = redactValue(item)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+		return v
+	case string:
+		if reToken.MatchString(v) {
+			return v
+		}
+		return fmt.Sprintf("[redacted %d chars]", len([]rune(v)))
+	default:
+		return v
+	}
+}
+
+func Event() {
+	defaultMonitor.Load().Event()
+}
+
+func Record(class, key, sample string) {
+	defaultMonitor.Load().Record(class, key, sample)
+}
+
+func Snapshot() Summary {
+	return defaultMonitor.Load().Summary()
+}
@@ -0,0 +1,87 @@
+package drift
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitor(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := New()
+	m.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		m.Event()
+	}
+	m.Record(ParseFailure, "sse", "data: {not json")
+	m.Record(UnknownPhase, "search", `{"data":{"phase":"search","delta_content":"private words"}}`)
+	m.Record(UnknownPhase, "search", `{"data":{"phase":"search","delta_content":"later"}}`)
+
+	now = now.Add(24 * time.Hour)
+	m.Event()
+
+	sum := m.Summary()
+	require.Len(t, sum.Days, 2)
+	assert.Equal(t, "2026-03-02", sum.Days[0].Date, "newest first")
+	assert.Equal(t, int64(1), sum.Days[0].Events)
+	assert.Zero(t, sum.Days[0].ParseFailureRate)
+
+	day := sum.Days[1]
+	assert.Equal(t, int64(4), day.Events)
+	assert.InDelta(t, 0.25, day.ParseFailureRate, 1e-9)
+	assert.Equal(t, int64(2), day.Anomalies[UnknownPhase]["search"])
+
+	// one sample per anomaly, the first one seen
+	require.Len(t, sum.Samples, 2)
+	phase := sum.Samples[1]
+	assert.Equal(t, UnknownPhase, phase.Class)
+	assert.Equal(t, "search", phase.Key)
+	assert.Equal(t, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), phase.FirstSeen)
+	assert.JSONEq(t, `{"data":{"phase":"search","delta_content":"[redacted 13 chars]"}}`, phase.Sample)
+
+	// days past retention are dropped
+	now = now.Add(retainDays * 24 * time.Hour)
+	sum = m.Summary()
+	assert.Empty(t, sum.Days)
+	assert.Len(t, sum.Samples, 2)
+}
+
+func TestMonitorKeyLimit(t *testing.T) {
+	m := New()
+	for i := 0; i < maxKeys+10; i++ {
+		m.Record(UnexpectedField, fmt.Sprintf("field_%d", i), "{}")
+	}
+
+	sum := m.Summary()
+	byKey := sum.Days[0].Anomalies[UnexpectedField]
+	assert.Len(t, byKey, maxKeys+1)
+	assert.Equal(t, int64(10), byKey[overflowKey])
+	assert.Len(t, sum.Samples, maxKeys)
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample string
+		want   string
+	}{
+		{"identifiers are kept", `{"type":"chat:completion","data":{"phase":"answer","done":true,"edit_index":3}}`, `{"type":"chat:completion","data":{"phase":"answer","done":true,"edit_index":3}}`},
+		{"text is blanked", `{"data":{"delta_content":"my secret plan"}}`, `{"data":{"delta_content":"[redacted 14 chars]"}}`},
+		{"arrays", `{"items":["ok","two words"]}`, `{"items":["ok","[redacted 9 chars]"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.JSONEq(t, tt.want, Redact(tt.sample))
+		})
+	}
+
+	// not even a prefix of what is not json is kept
+	assert.Regexp(t, `^\[not json, 5 bytes, sha256 [0-9a-f]{12}\]$`, Redact("{oops"))
+	assert.NotContains(t, Redact("my secret plan"), "secret")
+	assert.NotEqual(t, Redact("{oops"), Redact("{oopz"), "different samples stay apart")
+}
@@ -0,0 +1,168 @@
+package failover
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// HostStatus is a host as /health/ready reports it
+type HostStatus struct {
+	Host    string `json:"host"`
+	Healthy bool   `json:"healthy"`
+	// failures in a row, a success resets it
+	Failures  int    `json:"consecutive_failures"`
+	LastError string `json:"last_error,omitempty"`
+	// when the host went healthy or unhealthy
+	Since time.Time `json:"since"`
+}
+
+// Pool orders upstream hosts for failover. a host is taken out after
+// maxFailures failures in a row and comes back when a probe or a request
+// to it succeeds
+type Pool struct {
+	mu          sync.Mutex
+	hosts       []*HostStatus
+	maxFailures int
+	check       func(host string) error
+	now         func() time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewPool keeps hosts in the given order, the first is preferred. check
+// probes an unhealthy host, nil means it is back
+func NewPool(hosts []string, maxFailures int, check func(host string) error) *Pool {
+	p := &Pool{
+		maxFailures: max(maxFailures, 1),
+		check:       check,
+		now:         time.Now,
+		stop:        make(chan struct{}),
+	}
+	for _, h := range hosts {
+		p.hosts = append(p.hosts, &HostStatus{Host: h, Healthy: true, Since: p.now()})
+	}
+	return p
+}
+
+// Order lists the hosts to try: healthy ones first, unhealthy ones after as
+// a last resort, each group in configured order
+func (p *Pool) Order() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	order := make([]string, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		if h.Healthy {
+			order = append(order, h.Host)
+		}
+	}
+	for _, h := range p.hosts {
+		if !h.Healthy {
+			order = append(order, h.Host)
+		}
+	}
+	return order
+}
+
+// Preferred is the host a request goes to first
+func (p *Pool) Preferred() string {
+	if order := p.Order(); len(order) > 0 {
+		return order[0]
+	}
+	return ""
+}
+
+func (p *Pool) Succeeded(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.find(host)
+	if h == nil {
+		return
+	}
+	h.Failures = 0
+	h.LastError = ""
+	if !h.Healthy {
+		h.Healthy = true
+		h.Since = p.now()
+		logger.Info().Str("host", host).Msg("upstream host restored")
+	}
+}
+
+func (p *Pool) Failed(host string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.find(host)
+	if h == nil {
+		return
+	}
+	h.Failures++
+	h.LastError = err.Error()
+	if h.Healthy && h.Failures >= p.maxFailures {
+		h.Healthy = false
+		h.Since = p.now()
+		logger.Warn().Str("host", host).Int("failures", h.Failures).Err(err).Msg("upstream host marked unhealthy")
+	}
+}
+
+func (p *Pool) Status() []HostStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]HostStatus, len(p.hosts))
+	for i, h := range p.hosts {
+		out[i] = *h
+	}
+	return out
+}
+
+// Probe checks every unhealthy host once
+func (p *Pool) Probe() {
+	for _, st := range p.Status() {
+		if st.Healthy {
+			continue
+		}
+		if err := p.check(st.Host); err != nil {
+			logger.Debug().Str("host", st.Host).Err(err).Msg("upstream host still down")
+			p.mu.Lock()
+			if h := p.find(st.Host); h != nil {
+				h.LastError = err.Error()
+			}
+			p.mu.Unlock()
+			continue
+		}
+		p.Succeeded(st.Host)
+	}
+}
+
+// Run probes unhealthy hosts every interval until Close
+func (p *Pool) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.Probe()
+		}
+	}
+}
+
+func (p *Pool) Close() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+func (p *Pool) find(host string) *HostStatus {
+	for _, h := range p.hosts {
+		if h.Host == host {
+			return h
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package failover
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolFailover(t *testing.T) {
+	down := map[string]bool{"b.example": true}
+	p := NewPool([]string{"a.example", "b.example", "c.example"}, 2, func(host string) error {
+		if down[host] {
+			return errors.New("refused")
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"a.example", "b.example", "c.example"}, p.Order())
+
+	p.Failed("b.example", errors.New("502"))
+	assert.Equal(t, "b.example", p.Order()[1], "one failure is not enough")
+
+	p.Failed("b.example", errors.New("502"))
+	p.Failed("a.example", errors.New("timeout"))
+	p.Failed("a.example", errors.New("timeout"))
+	assert.Equal(t, []string{"c.example", "a.example", "b.example"}, p.Order(), "unhealthy hosts stay as a last resort")
+	assert.Equal(t, "c.example", p.Preferred())
+
+	st := p.Status()
+	require.Len(t, st, 3)
+	assert.False(t, st[0].Healthy)
+	assert.Equal(t, 2, st[0].Failures)
+	assert.Equal(t, "timeout", st[0].LastError)
+
+	// a probes fine again, b is still down
+	p.Probe()
+	assert.Equal(t, []string{"a.example", "c.example", "b.example"}, p.Order())
+	st = p.Status()
+	assert.True(t, st[0].Healthy)
+	assert.Zero(t, st[0].Failures)
+	assert.Equal(t, "refused", st[1].LastError)
+
+	// a success between failures resets the count
+	p.Failed("c.example", errors.New("500"))
+	p.Succeeded("c.example")
+	p.Failed("c.example", errors.New("500"))
+	assert.True(t, p.Status()[2].Healthy)
+}
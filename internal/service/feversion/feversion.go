@@ -0,0 +1,267 @@
+package feversion
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+var log = logger.Module("feversion")
+
+// store key of the last version discovery found
+const storeKey = "x_fe_version"
+
+// scripts of a page searched when the html itself does not name the version
+const maxScripts = 8
+
+// largest page or script read
+const maxPage = 4 << 20
+
+// prod-fe-1.0.117 in a meta tag, a js constant or a bundle path. separators
+// and a leading v are tolerated, the version is normalized to that form
+var versionRe = regexp.MustCompile(`(?i)prod[-_]fe[-_/]v?(\d+(?:\.\d+){1,3})`)
+
+var scriptRe = regexp.MustCompile(`(?i)<(?:script[^>]+src|link[^>]+rel=["']?modulepreload["']?[^>]+href)=["']?([^"'\s>]+)`)
+
+// Store keeps the last version found across restarts
+type Store interface {
+	SaveSetting(key string, value []byte) error
+	Setting(key string) ([]byte, error)
+}
+
+// Result is one discovery
+type Result struct {
+	Version  string `json:"version"`
+	Previous string `json:"previous"`
+	Changed  bool   `json:"changed"`
+}
+
+// Discoverer keeps X-FE-Version in step with the chat.z.ai frontend
+type Discoverer struct {
+	configs config.Provider
+	store   Store
+	client  *httpclient.Client
+
+	// the version found, "" until there is one
+	found atomic.Pointer[string]
+
+	// one discovery at a time, the admin endpoint and the ticker may meet
+	mu   sync.Mutex
+	stop chan struct{}
+	once sync.Once
+}
+
+// New restores the version the last run found, unless the config names a
+// newer one. store may be nil
+func New(configs config.Provider, store Store) *Discoverer {
+	d := &Discoverer{
+		configs: configs,
+		store:   store,
+		client:  httpclient.New(15 * time.Second),
+		stop:    make(chan struct{}),
+	}
+
+	if store == nil {
+		return d
+	}
+	saved, err := store.Setting(storeKey)
+	if err != nil {
+		log.Warn().Err(err).Msg("read saved fe version")
+		return d
+	}
+	configured := configs.Config().Headers.XFEVersion
+	if v := string(saved); v != "" && Newer(v, configured) {
+		d.found.Store(&v)
+		log.Info().Str("version", v).Str("configured", configured).Msg("using the fe version found last run")
+	}
+	return d
+}
+
+// Version is the X-FE-Version upstream requests carry, the one found or
+// else headers.x_fe_version
+func (d *Discoverer) Version() string {
+	if v := d.found.Load(); v != nil {
+		return *v
+	}
+	return d.configs.Config().Headers.XFEVersion
+}
+
+// Refresh reads the current version off the frontend and switches to it.
+// on failure the version in use stays
+func (d *Discoverer) Refresh() (Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res := Result{Previous: d.Version()}
+	v, err := d.discover()
+	if err != nil {
+		log.Warn().Err(err).Str("version", res.Previous).Msg("fe version discovery failed, keeping the current one")
+		return res, err
+	}
+	res.Version = v
+	if v == res.Previous {
+		return res, nil
+	}
+
+	res.Changed = true
+	d.found.Store(&v)
+	log.Info().Str("from", res.Previous).Str("to", v).Msg("fe version changed")
+	if d.store != nil {
+		if err := d.store.SaveSetting(storeKey, []byte(v)); err != nil {
+			log.Warn().Err(err).Msg("save fe version")
+		}
+	}
+	return res, nil
+}
+
+func (d *Discoverer) discover() (string, error) {
+	up := d.configs.Config().Upstream
+	base, err := url.Parse(up.Protocol + "//" + up.AllHosts()[0] + "/")
+	if err != nil {
+		return "", fmt.Errorf("frontend url: %w", err)
+	}
+
+	page, err := d.fetch(base.String())
+	if err != nil {
+		return "", err
+	}
+	if v := Extract(page); v != "" {
+		return v, nil
+	}
+
+	// the version may only be compiled into the bundle
+	for i, src := range scripts(page) {
+		if i == maxScripts {
+			break
+		}
+		ref, err := base.Parse(src)
+		if err != nil || ref.Host != base.Host {
+			continue
+		}
+		script, err := d.fetch(ref.String())
+		if err != nil {
+			log.Debug().Err(err).Str("script", ref.String()).Msg("fetch frontend script")
+			continue
+		}
+		if v := Extract(script); v != "" {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("no version in %s or its scripts", base)
+}
+
+func (d *Discoverer) fetch(u string) (string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	headers := d.configs.Config().Headers
+	req.Header.Set("User-Agent", headers.UserAgent)
+	req.Header.Set("Accept-Language", headers.AcceptLanguage)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetch %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %s: status %d", u, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPage))
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", u, err)
+	}
+	return string(body), nil
+}
+
+// Run refreshes every interval until Close
+func (d *Discoverer) Run(interval time.Duration) {
+	d.Refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.Refresh()
+		}
+	}
+}
+
+func (d *Discoverer) Close() {
+	d.once.Do(func() { close(d.stop) })
+}
+
+// Extract finds the newest frontend version named in page, "" for none
+func Extract(page string) string {
+	var best string
+	for _, m := range versionRe.FindAllStringSubmatch(page, -1) {
+		if v := "prod-fe-" + m[1]; best == "" || Newer(v, best) {
+			best = v
+		}
+	}
+	return best
+}
+
+// scripts are the script and module preload urls of an html page
+func scripts(page string) []string {
+	var out []string
+	for _, m := range scriptRe.FindAllStringSubmatch(page, -1) {
+		out = append(out, m[1])
+	}
+	return out
+}
+
+// Newer reports whether version a is past b, comparing the numbers after
+// the last dash. a version that does not parse is never newer
+func Newer(a, b string) bool {
+	pa, okA := parse(a)
+	pb, okB := parse(b)
+	if !okA {
+		return false
+	}
+	if !okB {
+		return true
+	}
+	for i := range max(len(pa), len(pb)) {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func parse(v string) ([]int, bool) {
+	v = v[strings.LastIndex(v, "-")+1:]
+	var out []int
+	for _, part := range strings.Split(strings.TrimPrefix(v, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		out = append(out, n)
+	}
+	return out, true
+}
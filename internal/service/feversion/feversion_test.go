@@ -0,0 +1,116 @@
+package feversion
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+type memStore map[string][]byte
+
+func (m memStore) SaveSetting(key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memStore) Setting(key string) ([]byte, error) {
+	return m[key], nil
+}
+
+func fixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name, page, want string
+	}{
+		{"meta tag", fixture(t, "frontend_old.html"), "prod-fe-1.0.117"},
+		{"bundle constant", fixture(t, "app_new.js"), "prod-fe-1.0.124"},
+		{"newest of several", `a="prod-fe-1.0.99" b="prod-fe-1.0.124" c="prod-fe-1.0.120"`, "prod-fe-1.0.124"},
+		{"loose spelling", `/assets/PROD_FE_v1.1.3/app.js`, "prod-fe-1.1.3"},
+		{"none", fixture(t, "frontend_new.html"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Extract(tt.page))
+		})
+	}
+}
+
+func TestNewer(t *testing.T) {
+	assert.True(t, Newer("prod-fe-1.0.124", "prod-fe-1.0.117"))
+	assert.True(t, Newer("prod-fe-1.1.0", "prod-fe-1.0.999"))
+	assert.True(t, Newer("prod-fe-1.0.117.1", "prod-fe-1.0.117"))
+	assert.False(t, Newer("prod-fe-1.0.117", "prod-fe-1.0.117"))
+	assert.False(t, Newer("prod-fe-1.0.99", "prod-fe-1.0.117"))
+	assert.True(t, Newer("prod-fe-1.0.1", ""), "anything beats no version")
+	assert.False(t, Newer("garbage", "prod-fe-1.0.1"))
+}
+
+func TestRefresh(t *testing.T) {
+	pages := map[string]string{
+		"/":                                    fixture(t, "frontend_old.html"),
+		"/_app/immutable/entry/start.B3kq9.js": "export const start=()=>{}",
+	}
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if down.Load() || !ok {
+			http.Error(w, "nope", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(page))
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{
+		Upstream: config.UpstreamConfig{Protocol: "http:", Host: strings.TrimPrefix(srv.URL, "http://")},
+		Headers:  config.HeadersConfig{XFEVersion: "prod-fe-1.0.100"},
+	}
+	store := memStore{}
+	d := New(config.Static(cfg), store)
+	assert.Equal(t, "prod-fe-1.0.100", d.Version(), "nothing found yet, the configured one")
+
+	res, err := d.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, Result{Version: "prod-fe-1.0.117", Previous: "prod-fe-1.0.100", Changed: true}, res)
+	assert.Equal(t, "prod-fe-1.0.117", d.Version())
+	assert.Equal(t, "prod-fe-1.0.100", cfg.Headers.XFEVersion, "the config is left as it was")
+
+	// the new release only names its version in the bundle
+	pages["/"] = fixture(t, "frontend_new.html")
+	pages["/_app/immutable/entry/app.D9fa2.js"] = fixture(t, "app_new.js")
+	res, err = d.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, "prod-fe-1.0.124", res.Version)
+	assert.Equal(t, "prod-fe-1.0.124", d.Version())
+	assert.Equal(t, "prod-fe-1.0.124", string(store[storeKey]))
+
+	res, err = d.Refresh()
+	require.NoError(t, err)
+	assert.False(t, res.Changed)
+
+	down.Store(true)
+	_, err = d.Refresh()
+	require.Error(t, err)
+	assert.Equal(t, "prod-fe-1.0.124", d.Version(), "a failed discovery keeps the last good version")
+
+	// a restart picks up where it left off
+	assert.Equal(t, "prod-fe-1.0.124", New(config.Static(cfg), store).Version())
+
+	// unless the config was bumped past it by hand
+	bumped := &config.Config{Headers: config.HeadersConfig{XFEVersion: "prod-fe-1.0.130"}}
+	assert.Equal(t, "prod-fe-1.0.130", New(config.Static(bumped), store).Version())
+}
@@ -0,0 +1,2 @@
+/* synthetic, hand-written after the shape of a chat.z.ai bundle, not a captured script */
+import{s as e}from"../chunks/scheduler.js";const t="https://chat.z.ai",n={FE_VERSION:"prod-fe-1.0.124",BUILD:"a81f2"};function o(r){return r.headers.set("X-FE-Version",n.FE_VERSION),r}export{o as withVersion,t as origin};
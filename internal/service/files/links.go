@@ -0,0 +1,169 @@
+package files
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+// cdnPrefix marks an id that carries the cdn url it stands for
+const cdnPrefix = "cdn-"
+
+// ids of upstream files, uuids in practice
+var upstreamID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Target is the url a proxied file id is fetched from, false for ids that
+// name no upstream or cdn file
+func Target(cfg *config.Config, id string) (string, bool) {
+	if enc, ok := strings.CutPrefix(id, cdnPrefix); ok {
+		raw, err := base64.RawURLEncoding.DecodeString(enc)
+		if err != nil {
+			return "", false
+		}
+		u, err := url.Parse(string(raw))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || !slices.Contains(cfg.Files.CDNHosts, u.Host) {
+			// anything else would make mo an open proxy
+			return "", false
+		}
+		return u.String(), true
+	}
+	if !upstreamID.MatchString(id) {
+		return "", false
+	}
+	return strings.TrimSuffix(cfg.FilesURL(), "/") + "/" + id + "/content", true
+}
+
+// ID is the proxy id of a file link, false when the link is not to an
+// upstream file or a cdn host. upstream links may be relative
+func ID(cfg *config.Config, link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	if slices.Contains(cfg.Files.CDNHosts, u.Host) && (u.Scheme == "https" || u.Scheme == "http") {
+		return cdnPrefix + base64.RawURLEncoding.EncodeToString([]byte(link)), true
+	}
+	if u.Host != "" && !slices.Contains(cfg.Upstream.AllHosts(), u.Host) {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(u.Path, filesPath(cfg))
+	if !ok {
+		return "", false
+	}
+	id, ok := strings.CutSuffix(rest, "/content")
+	if !ok || !upstreamID.MatchString(id) {
+		return "", false
+	}
+	return id, true
+}
+
+// filesPath is the path upstream serves files under, with a trailing /
+func filesPath(cfg *config.Config) string {
+	u, _ := url.Parse(cfg.FilesURL())
+	return strings.TrimSuffix(u.Path, "/") + "/"
+}
+
+// longest run held back while it may still grow into a link
+const maxLinkLen = 4096
+
+// Links points the file links of reply text at the proxy, base/v1/files/
+// {id}/content. a nil Links passes text through unchanged
+type Links struct {
+	cfg  *config.Config
+	base string
+	// link starts, a link in text begins with one of them
+	starts []string
+	re     *regexp.Regexp
+	held   string
+}
+
+// NewLinks rewrites to base, nil unless files.rewrite_file_urls is set
+func NewLinks(cfg *config.Config, base string) *Links {
+	if !cfg.Files.RewriteURLs {
+		return nil
+	}
+	starts := []string{"https://", "http://", filesPath(cfg)}
+	quoted := make([]string, len(starts))
+	for i, s := range starts {
+		quoted[i] = regexp.QuoteMeta(s)
+	}
+	return &Links{
+		cfg:    cfg,
+		base:   strings.TrimSuffix(base, "/"),
+		starts: starts,
+		re:     regexp.MustCompile(`(?:` + strings.Join(quoted, "|") + `)[^\s"'<>()\[\]{}]+`),
+	}
+}
+
+// Write returns what of delta can be sent now, a link is held back until
+// it is whole
+func (l *Links) Write(delta string) string {
+	if l == nil {
+		return delta
+	}
+	text := l.held + delta
+	cut := strings.LastIndexFunc(text, endsLink) + 1
+	l.held = ""
+	if tail := text[cut:]; l.pending(tail) {
+		text, l.held = text[:cut], tail
+	}
+	return l.Rewrite(text)
+}
+
+// Flush returns the held back text once the reply is over
+func (l *Links) Flush() string {
+	if l == nil {
+		return ""
+	}
+	out := l.Rewrite(l.held)
+	l.held = ""
+	return out
+}
+
+// Rewrite points the links of a whole text at the proxy
+func (l *Links) Rewrite(text string) string {
+	if l == nil {
+		return text
+	}
+	return l.re.ReplaceAllStringFunc(text, func(link string) string {
+		// sentence punctuation after a link is not part of it
+		trimmed := strings.TrimRight(link, ".,;:!?")
+		id, ok := ID(l.cfg, trimmed)
+		if !ok {
+			return link
+		}
+		return l.base + "/v1/files/" + id + "/content" + link[len(trimmed):]
+	})
+}
+
+// pending reports whether tail, the text after the last character that
+// ends a link, may still grow into one
+func (l *Links) pending(tail string) bool {
+	if tail == "" || len(tail) > maxLinkLen {
+		return false
+	}
+	for _, start := range l.starts {
+		if strings.Contains(tail, start) {
+			return true
+		}
+		// a start cut short at the end of the delta
+		for n := min(len(start)-1, len(tail)); n > 0; n-- {
+			if strings.HasSuffix(tail, start[:n]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func endsLink(r rune) bool {
+	switch r {
+	case ' ', '\t', '\n', '\r', '"', '\'', '<', '>', '(', ')', '[', ']', '{', '}':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package files
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+func linksConfig() *config.Config {
+	return &config.Config{
+		Upstream: config.UpstreamConfig{Protocol: "https:", Host: "chat.z.ai"},
+		Files:    config.FilesConfig{RewriteURLs: true, CDNHosts: []string{"z-cdn.chatglm.cn"}},
+	}
+}
+
+func TestIDAndTarget(t *testing.T) {
+	cfg := linksConfig()
+
+	tests := []struct {
+		name, link string
+		id, target string
+	}{
+		{name: "upstream", link: "https://chat.z.ai/api/v1/files/3f2a-b1/content", id: "3f2a-b1", target: "https://chat.z.ai/api/v1/files/3f2a-b1/content"},
+		{name: "relative", link: "/api/v1/files/3f2a-b1/content", id: "3f2a-b1", target: "https://chat.z.ai/api/v1/files/3f2a-b1/content"},
+		{name: "cdn", link: "https://z-cdn.chatglm.cn/files/a.png?auth_key=1-2", target: "https://z-cdn.chatglm.cn/files/a.png?auth_key=1-2"},
+		{name: "other host", link: "https://example.com/api/v1/files/x/content"},
+		{name: "other path", link: "https://chat.z.ai/api/v1/chats/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := ID(cfg, tt.link)
+			if tt.target == "" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			if tt.id != "" {
+				assert.Equal(t, tt.id, id)
+			}
+			target, ok := Target(cfg, id)
+			require.True(t, ok)
+			assert.Equal(t, tt.target, target)
+		})
+	}
+
+	_, ok := Target(cfg, cdnPrefix+"aHR0cHM6Ly9leGFtcGxlLmNvbS94") // https://example.com/x
+	assert.False(t, ok, "only cdn hosts are proxied")
+	_, ok = Target(cfg, "../etc")
+	assert.False(t, ok)
+}
+
+func TestLinksStream(t *testing.T) {
+	cfg := linksConfig()
+	reply := "Here it is: ![cat](https://z-cdn.chatglm.cn/files/cat.png) and the file " +
+		"/api/v1/files/abc-123/content. Also https://example.com/keep stays."
+
+	whole := NewLinks(cfg, "https://mo.example/").Rewrite(reply)
+	cdnID, _ := ID(cfg, "https://z-cdn.chatglm.cn/files/cat.png")
+	assert.Equal(t, "Here it is: ![cat](https://mo.example/v1/files/"+cdnID+"/content) and the file "+
+		"https://mo.example/v1/files/abc-123/content. Also https://example.com/keep stays.", whole)
+
+	// any split of the reply into deltas gives the same text
+	for _, size := range []int{1, 2, 3, 5, 8, 13} {
+		l := NewLinks(cfg, "https://mo.example")
+		var out strings.Builder
+		for i := 0; i < len(reply); i += size {
+			out.WriteString(l.Write(reply[i:min(i+size, len(reply))]))
+		}
+		out.WriteString(l.Flush())
+		assert.Equal(t, whole, out.String(), "delta size %d", size)
+	}
+
+	l := NewLinks(cfg, "https://mo.example")
+	assert.Equal(t, "plain words ", l.Write("plain words "), "text that cannot be a link is not held")
+
+	cfg.Files.RewriteURLs = false
+	off := NewLinks(cfg, "https://mo.example")
+	assert.Nil(t, off)
+	assert.Equal(t, reply, off.Write(reply)+off.Flush())
+}
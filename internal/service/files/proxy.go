@@ -0,0 +1,239 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+var log = logger.Module("files")
+
+// ErrNotFound is a file upstream does not have
+var ErrNotFound = errors.New("file not found")
+
+// Fetcher gets a file url with the client's range and validator headers
+type Fetcher func(ctx context.Context, url string, header http.Header) (*http.Response, error)
+
+// headers of an upstream file reply passed on to the client
+var passHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Range", "Content-Disposition",
+	"Accept-Ranges", "ETag", "Last-Modified",
+}
+
+// request headers passed upstream
+var askHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+// Proxy serves upstream files, keeping whole ones on disk for ttl
+type Proxy struct {
+	fetch    Fetcher
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+	now      func() time.Time
+
+	// expired entries are swept at most once per ttl
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+}
+
+// meta is kept next to a cached file
+type meta struct {
+	ContentType string    `json:"content_type"`
+	Disposition string    `json:"content_disposition,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// New caches under dir, a ttl of 0 streams every request from upstream
+func New(fetch Fetcher, dir string, ttl time.Duration, maxBytes int64) *Proxy {
+	return &Proxy{fetch: fetch, dir: dir, ttl: ttl, maxBytes: maxBytes, now: time.Now}
+}
+
+// Serve writes the file id, fetched from target. range requests are
+// answered from the cache or passed upstream as they are. an error means
+// nothing was written yet, ErrNotFound or an upstream failure
+func (p *Proxy) Serve(w http.ResponseWriter, r *http.Request, id, target string) error {
+	path := p.path(id)
+	if p.serveCached(w, r, path) {
+		return nil
+	}
+
+	header := http.Header{}
+	for _, k := range askHeaders {
+		if v := r.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	resp, err := p.fetch(r.Context(), target, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 400 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return domain.NewUpstreamError(resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	for _, k := range passHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// only a whole file is kept, partial and not modified replies pass
+	if resp.StatusCode != http.StatusOK || !p.cacheable(resp.ContentLength) {
+		io.Copy(w, resp.Body)
+		return nil
+	}
+	p.copyAndKeep(w, resp, path)
+	return nil
+}
+
+// serveCached answers from a fresh cache entry, with ranges and validators
+// handled by net/http
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, path string) bool {
+	if p.ttl <= 0 {
+		return false
+	}
+	m, ok := p.readMeta(path)
+	if !ok || p.now().Sub(m.FetchedAt) >= p.ttl {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if m.ContentType != "" {
+		w.Header().Set("Content-Type", m.ContentType)
+	}
+	if m.Disposition != "" {
+		w.Header().Set("Content-Disposition", m.Disposition)
+	}
+	http.ServeContent(w, r, "", m.FetchedAt, f)
+	return true
+}
+
+func (p *Proxy) cacheable(size int64) bool {
+	return p.ttl > 0 && size <= p.maxBytes
+}
+
+// copyAndKeep streams resp to w and into the cache. the entry only appears
+// once the whole file made it to disk
+func (p *Proxy) copyAndKeep(w io.Writer, resp *http.Response, path string) {
+	if err := os.MkdirAll(p.dir, 0o700); err != nil {
+		log.Warn().Err(err).Msg("create file cache")
+		io.Copy(w, resp.Body)
+		return
+	}
+	tmp, err := os.CreateTemp(p.dir, "fetch-*")
+	if err != nil {
+		log.Warn().Err(err).Msg("create cache entry")
+		io.Copy(w, resp.Body)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	// the client is served even when the disk is not
+	disk := &cappedWriter{w: tmp, left: p.maxBytes}
+	_, err = io.Copy(w, io.TeeReader(resp.Body, disk))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || disk.err != nil {
+		return
+	}
+
+	m := meta{
+		ContentType: resp.Header.Get("Content-Type"),
+		Disposition: resp.Header.Get("Content-Disposition"),
+		FetchedAt:   p.now(),
+	}
+	data, _ := json.Marshal(m)
+	// without its meta the file is a miss, so the meta goes last
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		log.Warn().Err(err).Msg("write cache entry")
+		return
+	}
+	if err := os.WriteFile(path+".json", data, 0o600); err != nil {
+		log.Warn().Err(err).Msg("write cache entry")
+		return
+	}
+	p.sweep()
+}
+
+func (p *Proxy) readMeta(path string) (meta, bool) {
+	var m meta
+	data, err := os.ReadFile(path + ".json")
+	if err != nil || json.Unmarshal(data, &m) != nil {
+		return m, false
+	}
+	return m, true
+}
+
+// sweep deletes the expired entries, at most once per ttl
+func (p *Proxy) sweep() {
+	p.sweepMu.Lock()
+	defer p.sweepMu.Unlock()
+	now := p.now()
+	if now.Sub(p.lastSweep) < p.ttl {
+		return
+	}
+	p.lastSweep = now
+
+	metas, _ := filepath.Glob(filepath.Join(p.dir, "*.json"))
+	for _, name := range metas {
+		path := strings.TrimSuffix(name, ".json")
+		if m, ok := p.readMeta(path); !ok || now.Sub(m.FetchedAt) >= p.ttl {
+			os.Remove(path)
+			os.Remove(name)
+		}
+	}
+}
+
+// path is where id is cached, ids may carry whole urls
+func (p *Proxy) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(p.dir, hex.EncodeToString(sum[:]))
+}
+
+// cappedWriter takes at most left bytes, then fails
+type cappedWriter struct {
+	w    io.Writer
+	left int64
+	err  error
+}
+
+func (c *cappedWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		// a tee must not fail the copy to the client
+		return len(b), nil
+	}
+	if int64(len(b)) > c.left {
+		c.err = fmt.Errorf("file larger than %d bytes", c.left)
+		return len(b), nil
+	}
+	c.left -= int64(len(b))
+	if _, err := c.w.Write(b); err != nil {
+		c.err = err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,138 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// binaryUpstream serves payload as a png with range support, counting the
+// requests that reach it
+func binaryUpstream(t *testing.T, payload []byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/broken":
+			http.Error(w, "token expired", http.StatusUnauthorized)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(payload))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func fetchDirect(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return http.DefaultClient.Do(req)
+}
+
+func payload(n int) []byte {
+	b := make([]byte, n)
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := range b {
+		b[i] = byte(r.UintN(256))
+	}
+	return b
+}
+
+func get(p *Proxy, id, target string, header http.Header) (*httptest.ResponseRecorder, error) {
+	r := httptest.NewRequest("GET", "/v1/files/"+id+"/content", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	return w, p.Serve(w, r, id, target)
+}
+
+func TestProxyCachesWholeFiles(t *testing.T) {
+	data := payload(64 << 10)
+	srv, hits := binaryUpstream(t, data)
+	p := New(fetchDirect, t.TempDir(), time.Hour, 1<<20)
+
+	w, err := get(p, "img", srv.URL+"/img", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.EqualValues(t, 1, hits.Load())
+
+	w, err = get(p, "img", srv.URL+"/img", nil)
+	require.NoError(t, err)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, 1, hits.Load(), "the second read comes from disk")
+
+	w, err = get(p, "img", srv.URL+"/img", http.Header{"Range": {"bytes=100-199"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, data[100:200], w.Body.Bytes())
+	assert.EqualValues(t, 1, hits.Load(), "cached files answer ranges themselves")
+
+	p.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = get(p, "img", srv.URL+"/img", nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, hits.Load(), "an expired entry is fetched again")
+}
+
+func TestProxyPassesRanges(t *testing.T) {
+	data := payload(1 << 20)
+	srv, hits := binaryUpstream(t, data)
+	p := New(fetchDirect, t.TempDir(), time.Hour, 1<<20)
+
+	w, err := get(p, "big", srv.URL+"/big", http.Header{"Range": {"bytes=1000-1999"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 1000-1999/1048576", w.Header().Get("Content-Range"))
+	assert.Equal(t, data[1000:2000], w.Body.Bytes())
+
+	// a part is never cached as the whole
+	_, err = get(p, "big", srv.URL+"/big", nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, hits.Load())
+}
+
+func TestProxySkipsLargeFiles(t *testing.T) {
+	data := payload(8 << 10)
+	srv, hits := binaryUpstream(t, data)
+	p := New(fetchDirect, t.TempDir(), time.Hour, 4<<10)
+
+	for range 2 {
+		w, err := get(p, "large", srv.URL+"/large", nil)
+		require.NoError(t, err)
+		assert.Equal(t, data, w.Body.Bytes(), "streamed whole even when it cannot be kept")
+	}
+	assert.EqualValues(t, 2, hits.Load())
+}
+
+func TestProxyErrors(t *testing.T) {
+	srv, _ := binaryUpstream(t, nil)
+	p := New(fetchDirect, t.TempDir(), time.Hour, 1<<20)
+
+	w, err := get(p, "missing", srv.URL+"/missing", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Zero(t, w.Body.Len(), "nothing is written on error")
+
+	_, err = get(p, "broken", srv.URL+"/broken", nil)
+	var ue *domain.UpstreamError
+	require.ErrorAs(t, err, &ue)
+	assert.Equal(t, http.StatusUnauthorized, ue.StatusCode)
+}
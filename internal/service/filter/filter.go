@@ -0,0 +1,210 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+// Filter keeps patterns out of reply text. redact matches are replaced by a
+// mask, an abort match ends the text right before it
+type Filter struct {
+	redact *regexp.Regexp
+	abort  *regexp.Regexp
+	mask   string
+	// the longest match of any pattern plus one for a trailing \b or $.
+	// a stream holds back this much less one byte, so a match split across
+	// deltas is only judged once it is whole
+	window int
+}
+
+// filters are built once per configuration, requests share them
+var built sync.Map
+
+// New builds the filter of cfg, nil when it has no patterns. a nil Filter
+// passes text through unchanged
+func New(cfg config.FiltersConfig) (*Filter, error) {
+	if len(cfg.Redact) == 0 && len(cfg.Abort) == 0 {
+		return nil, nil
+	}
+
+	key := fmt.Sprintf("%q %q %q %d", cfg.Redact, cfg.Abort, cfg.Mask, cfg.MaxMatch)
+	if f, ok := built.Load(key); ok {
+		return f.(*Filter), nil
+	}
+
+	f := &Filter{mask: cfg.Mask}
+	var err error
+	if f.redact, err = union(cfg.Redact); err != nil {
+		return nil, fmt.Errorf("redact: %w", err)
+	}
+	if f.abort, err = union(cfg.Abort); err != nil {
+		return nil, fmt.Errorf("abort: %w", err)
+	}
+	for _, pattern := range append(cfg.Redact, cfg.Abort...) {
+		re, _ := syntax.Parse(pattern, syntax.Perl)
+		n, ok := maxLen(re.Simplify())
+		if !ok || n > cfg.MaxMatch {
+			n = cfg.MaxMatch
+		}
+		f.window = max(f.window, n+1)
+	}
+
+	built.Store(key, f)
+	return f, nil
+}
+
+// union is one regexp matching any of patterns, nil for none
+func union(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	groups := make([]string, len(patterns))
+	for i, p := range patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, err
+		}
+		groups[i] = "(?:" + p + ")"
+	}
+	return regexp.Compile(strings.Join(groups, "|"))
+}
+
+// maxLen is the most bytes re can match, false when there is no bound
+func maxLen(re *syntax.Regexp) (int, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			// a folded rune may take more bytes than the one written
+			return len(re.Rune) * utf8.UTFMax, true
+		}
+		n := 0
+		for _, r := range re.Rune {
+			n += utf8.RuneLen(r)
+		}
+		return n, true
+	case syntax.OpCharClass:
+		if n := len(re.Rune); n > 0 && re.Rune[n-1] < utf8.RuneSelf {
+			return 1, true
+		}
+		return utf8.UTFMax, true
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return utf8.UTFMax, true
+	case syntax.OpCapture, syntax.OpQuest:
+		return maxLen(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Max < 0 {
+			return 0, false
+		}
+		n, ok := maxLen(re.Sub[0])
+		return n * re.Max, ok
+	case syntax.OpStar, syntax.OpPlus:
+		return 0, false
+	case syntax.OpConcat, syntax.OpAlternate:
+		total := 0
+		for _, sub := range re.Sub {
+			n, ok := maxLen(sub)
+			if !ok {
+				return 0, false
+			}
+			if re.Op == syntax.OpConcat {
+				total += n
+			} else {
+				total = max(total, n)
+			}
+		}
+		return total, true
+	}
+	// empty matches and assertions
+	return 0, true
+}
+
+// Apply filters a whole text, reporting whether an abort pattern cut it
+func (f *Filter) Apply(text string) (string, bool) {
+	if f == nil {
+		return text, false
+	}
+	aborted := false
+	if f.abort != nil {
+		if loc := f.abort.FindStringIndex(text); loc != nil {
+			text, aborted = text[:loc[0]], true
+		}
+	}
+	if f.redact != nil {
+		text = f.redact.ReplaceAllLiteralString(text, f.mask)
+	}
+	return text, aborted
+}
+
+// Stream filters text that arrives in deltas
+func (f *Filter) Stream() *Stream {
+	return &Stream{f: f}
+}
+
+// Stream holds back the end of the text seen so far until it can not be
+// the start of a match any more
+type Stream struct {
+	f       *Filter
+	pending string
+	aborted bool
+}
+
+// Write returns what of delta can be sent now. once it reports an abort
+// the stream is over, later writes return nothing
+func (s *Stream) Write(delta string) (string, bool) {
+	if s.f == nil {
+		return delta, false
+	}
+	if s.aborted {
+		return "", true
+	}
+	s.pending += delta
+
+	if s.f.abort != nil {
+		if loc := s.f.abort.FindStringIndex(s.pending); loc != nil {
+			out, _ := s.f.Apply(s.pending[:loc[0]])
+			s.pending, s.aborted = "", true
+			return out, true
+		}
+	}
+
+	// text this far from the end has been seen with every byte a match
+	// starting in it could span
+	safe := len(s.pending) - (s.f.window - 1)
+	var out strings.Builder
+	pos := 0
+	if s.f.redact != nil {
+		for _, m := range s.f.redact.FindAllStringIndex(s.pending, -1) {
+			if m[0]+s.f.window > len(s.pending) {
+				// may still grow with the next delta
+				safe = min(safe, m[0])
+				break
+			}
+			out.WriteString(s.pending[pos:m[0]])
+			out.WriteString(s.f.mask)
+			pos = m[1]
+		}
+	}
+
+	end := max(pos, safe)
+	for end > pos && end < len(s.pending) && !utf8.RuneStart(s.pending[end]) {
+		end--
+	}
+	out.WriteString(s.pending[pos:end])
+	s.pending = s.pending[end:]
+	return out.String(), false
+}
+
+// Flush returns the held back text once the stream is over
+func (s *Stream) Flush() string {
+	if s.f == nil || s.aborted {
+		return ""
+	}
+	out, _ := s.f.Apply(s.pending)
+	s.pending = ""
+	return out
+}
@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+func newFilter(t *testing.T, redact, abort []string) *Filter {
+	t.Helper()
+	f, err := New(config.FiltersConfig{Redact: redact, Abort: abort, Mask: "[REDACTED]", MaxMatch: 64})
+	require.NoError(t, err)
+	return f
+}
+
+// stream feeds deltas one by one and returns what went out
+func stream(s *Stream, deltas ...string) (string, bool) {
+	var out strings.Builder
+	for _, d := range deltas {
+		text, aborted := s.Write(d)
+		out.WriteString(text)
+		if aborted {
+			return out.String(), true
+		}
+	}
+	out.WriteString(s.Flush())
+	return out.String(), false
+}
+
+func TestStreamRedactsAcrossDeltas(t *testing.T) {
+	f := newFilter(t, []string{"Project Falcon", `[\w.]+@example\.com`}, nil)
+
+	out, aborted := stream(f.Stream(), "the codename is Proj", "ect Fal", "con, ask bob.s", "mith@example.", "com today")
+	assert.False(t, aborted)
+	assert.Equal(t, "the codename is [REDACTED], ask [REDACTED] today", out)
+
+	// the same text whole
+	out, aborted = f.Apply("the codename is Project Falcon, ask bob.smith@example.com today")
+	assert.False(t, aborted)
+	assert.Equal(t, "the codename is [REDACTED], ask [REDACTED] today", out)
+}
+
+func TestStreamHoldsBackLittle(t *testing.T) {
+	f := newFilter(t, []string{"Falcon"}, nil)
+	s := f.Stream()
+
+	out, _ := s.Write("a reply that goes on and on")
+	assert.Equal(t, "a reply that goes on ", out, "only the last len(pattern) bytes wait")
+	out, _ = s.Write(" Falc")
+	assert.Equal(t, "and o", out)
+	out, _ = s.Write("on flies")
+	assert.Equal(t, "n [REDACTED]", out)
+	assert.Equal(t, " flies", s.Flush())
+}
+
+func TestStreamAbort(t *testing.T) {
+	f := newFilter(t, []string{"secret"}, []string{`(?i)internal use only`})
+
+	s := f.Stream()
+	out, aborted := stream(s, "here is the secret plan, ", "marked INTERNAL ", "USE", " ONLY and more", " text")
+	assert.True(t, aborted)
+	assert.Equal(t, "here is the [REDACTED] plan, marked ", out)
+
+	text, aborted := s.Write("after the end")
+	assert.True(t, aborted)
+	assert.Empty(t, text)
+	assert.Empty(t, s.Flush())
+
+	out, aborted = f.Apply("fine until internal use only, then not")
+	assert.True(t, aborted)
+	assert.Equal(t, "fine until ", out)
+}
+
+func TestStreamKeepsRunesWhole(t *testing.T) {
+	f := newFilter(t, []string{"тайна"}, nil)
+	s := f.Stream()
+
+	var out strings.Builder
+	for _, d := range []string{"это ", "не т", "айна, а при", "вет"} {
+		text, _ := s.Write(d)
+		assert.True(t, strings.ToValidUTF8(text, "?") == text, "delta %q splits a rune", text)
+		out.WriteString(text)
+	}
+	out.WriteString(s.Flush())
+	assert.Equal(t, "это не [REDACTED], а привет", out.String())
+}
+
+func TestNilFilter(t *testing.T) {
+	f, err := New(config.FiltersConfig{Mask: "x", MaxMatch: 64})
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	out, aborted := stream(f.Stream(), "a", "b")
+	assert.False(t, aborted)
+	assert.Equal(t, "ab", out)
+}
+
+func TestMaxLen(t *testing.T) {
+	for pattern, want := range map[string]int{
+		"Falcon":         6,
+		"(?i)falcon":     6 * 4,
+		`[a-z]{2,5}@x`:   7,
+		"foo|barbaz":     6,
+		`\bfalcon\b`:     6,
+		`[\w.]+@x\.com`:  64,
+		`internal.*only`: 64,
+		"(cat|dog)s?\\.": 5,
+	} {
+		f := newFilter(t, []string{pattern}, nil)
+		assert.Equal(t, want+1, f.window, pattern)
+	}
+}
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// Result is the outcome of the last probe
+type Result struct {
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+// Probe checks an upstream at most once per ttl, health checks in between
+// get the cached result so load balancers polling every second cost nothing
+type Probe struct {
+	check func() error
+	ttl   time.Duration
+	now   func() time.Time
+
+	// held while probing, concurrent callers wait for the same probe
+	mu   sync.Mutex
+	last *Result
+}
+
+func NewProbe(check func() error, ttl time.Duration) *Probe {
+	return &Probe{check: check, ttl: ttl, now: time.Now}
+}
+
+// Result probes when the cached result is older than the ttl
+func (p *Probe) Result() Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.last != nil && p.now().Sub(p.last.CheckedAt) < p.ttl {
+		return *p.last
+	}
+
+	start := p.now()
+	err := p.check()
+	r := Result{
+		Reachable: err == nil,
+		CheckedAt: p.now(),
+		LatencyMS: p.now().Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	p.last = &r
+	return r
+}
@@ -0,0 +1,36 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeCachesForTTL(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	var fail error
+	p := NewProbe(func() error {
+		calls++
+		return fail
+	}, time.Minute)
+	p.now = func() time.Time { return now }
+
+	r := p.Result()
+	assert.True(t, r.Reachable)
+	assert.Equal(t, now, r.CheckedAt)
+
+	// upstream goes down, the cached result stands until the ttl runs out
+	fail = errors.New("models api returned 502")
+	now = now.Add(59 * time.Second)
+	assert.True(t, p.Result().Reachable)
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(time.Second)
+	r = p.Result()
+	assert.False(t, r.Reachable)
+	assert.Equal(t, "models api returned 502", r.Error)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,136 @@
+package hooks
+
+import (
+	"errors"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+const defaultRedaction = "[REDACTED]"
+
+func init() {
+	RegisterRequest("prepend_system", prependSystem)
+	RegisterRequest("regex_redact", regexRedact)
+	RegisterRequest("max_messages", maxMessages)
+	RegisterResponse("regex_replace", regexReplace)
+}
+
+// prependSystem puts text before the system prompt, or adds one
+func prependSystem(h config.HookConfig) (RequestHook, error) {
+	if h.Text == "" {
+		return nil, errors.New("text is required")
+	}
+	return func(req *domain.ChatRequest) error {
+		if len(req.Messages) > 0 && req.Messages[0].Role == "system" {
+			if s, ok := req.Messages[0].Content.(string); ok {
+				req.Messages[0].Content = h.Text + "\n\n" + s
+				return nil
+			}
+		}
+		sys := domain.Message{Role: "system", Content: h.Text}
+		req.Messages = append([]domain.Message{sys}, req.Messages...)
+		return nil
+	}, nil
+}
+
+// regexRedact replaces matches in the text of every message
+func regexRedact(h config.HookConfig) (RequestHook, error) {
+	if h.Pattern == "" {
+		return nil, errors.New("pattern is required")
+	}
+	re, err := compile(h.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	repl := h.Replacement
+	if repl == "" {
+		repl = defaultRedaction
+	}
+
+	return func(req *domain.ChatRequest) error {
+		for i := range req.Messages {
+			req.Messages[i].Content = mapText(req.Messages[i].Content, func(s string) string {
+				return re.ReplaceAllString(s, repl)
+			})
+		}
+		return nil
+	}, nil
+}
+
+// maxMessages keeps the system messages and the last max others. a tool
+// result left without its call is dropped too, upstream rejects it
+func maxMessages(h config.HookConfig) (RequestHook, error) {
+	if h.Max < 1 {
+		return nil, errors.New("max must be at least 1")
+	}
+	return func(req *domain.ChatRequest) error {
+		others := 0
+		for _, m := range req.Messages {
+			if m.Role != "system" {
+				others++
+			}
+		}
+		skip := others - h.Max
+		if skip <= 0 {
+			return nil
+		}
+
+		kept := make([]domain.Message, 0, len(req.Messages)-skip)
+		started := false
+		for _, m := range req.Messages {
+			switch {
+			case m.Role == "system":
+			case skip > 0:
+				skip--
+				continue
+			case m.Role == "tool" && !started:
+				continue
+			default:
+				started = true
+			}
+			kept = append(kept, m)
+		}
+		req.Messages = kept
+		return nil
+	}, nil
+}
+
+func regexReplace(h config.HookConfig) (ResponseHook, error) {
+	if h.Pattern == "" {
+		return nil, errors.New("pattern is required")
+	}
+	re, err := compile(h.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(text string) string {
+		return re.ReplaceAllString(text, h.Replacement)
+	}, nil
+}
+
+// mapText applies fn to a string content or to the text parts of one
+func mapText(content interface{}, fn func(string) string) interface{} {
+	switch c := content.(type) {
+	case string:
+		return fn(c)
+	case []interface{}:
+		out := make([]interface{}, len(c))
+		for i, part := range c {
+			p, ok := part.(map[string]interface{})
+			if !ok || p["type"] != "text" {
+				out[i] = part
+				continue
+			}
+			text, _ := p["text"].(string)
+			cp := make(map[string]interface{}, len(p))
+			for k, v := range p {
+				cp[k] = v
+			}
+			cp["text"] = fn(text)
+			out[i] = cp
+		}
+		return out
+	}
+	return content
+}
@@ -0,0 +1,173 @@
+package hooks
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// RequestHook changes a request before it goes to a provider
+type RequestHook func(req *domain.ChatRequest) error
+
+// ResponseHook rewrites reply content. streams hand it whole lines only,
+// so a pattern must not span a line break to behave the same in both modes
+type ResponseHook func(text string) string
+
+// builders turn a configured hook into its function, by type
+var (
+	mu        sync.RWMutex
+	requests  = map[string]func(config.HookConfig) (RequestHook, error){}
+	responses = map[string]func(config.HookConfig) (ResponseHook, error){}
+)
+
+// RegisterRequest adds a request hook type, compiled-in hooks call it
+// from init. a name already taken is replaced
+func RegisterRequest(name string, build func(config.HookConfig) (RequestHook, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	requests[name] = build
+}
+
+// RegisterResponse adds a response hook type
+func RegisterResponse(name string, build func(config.HookConfig) (ResponseHook, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	responses[name] = build
+}
+
+// Validate builds every hook of cfg once, so a typo fails at startup
+// rather than on the first request of some api key
+func Validate(cfg *config.Config) error {
+	check := func(where string, h config.HookChains) error {
+		if _, err := Request(h.Request); err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		if _, err := Response(h.Response); err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		return nil
+	}
+	if err := check("hooks", cfg.Hooks.HookChains); err != nil {
+		return err
+	}
+	for key, h := range cfg.Hooks.Keys {
+		if err := check("hooks.keys."+key, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Request builds the request chain of hooks, run in order
+func Request(hooks []config.HookConfig) (RequestHook, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	chain := make([]RequestHook, 0, len(hooks))
+	for i, h := range hooks {
+		build, ok := requests[h.Type]
+		if !ok {
+			return nil, fmt.Errorf("request hook %d: unknown type %q", i, h.Type)
+		}
+		fn, err := build(h)
+		if err != nil {
+			return nil, fmt.Errorf("request hook %d (%s): %w", i, h.Type, err)
+		}
+		chain = append(chain, fn)
+	}
+
+	return func(req *domain.ChatRequest) error {
+		for _, fn := range chain {
+			if err := fn(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// Response builds the response chain of hooks, nil when there are none
+func Response(hooks []config.HookConfig) (ResponseHook, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	chain := make([]ResponseHook, 0, len(hooks))
+	for i, h := range hooks {
+		build, ok := responses[h.Type]
+		if !ok {
+			return nil, fmt.Errorf("response hook %d: unknown type %q", i, h.Type)
+		}
+		fn, err := build(h)
+		if err != nil {
+			return nil, fmt.Errorf("response hook %d (%s): %w", i, h.Type, err)
+		}
+		chain = append(chain, fn)
+	}
+
+	return func(text string) string {
+		for _, fn := range chain {
+			text = fn(text)
+		}
+		return text
+	}, nil
+}
+
+// Stream applies a response hook to content that arrives in deltas. text
+// is held back until its line is complete, Flush releases the rest
+type Stream struct {
+	hook ResponseHook
+	tail string
+}
+
+// NewStream wraps hook, a nil hook passes deltas through unchanged
+func NewStream(hook ResponseHook) *Stream {
+	return &Stream{hook: hook}
+}
+
+// Write returns what of delta can be sent now
+func (s *Stream) Write(delta string) string {
+	if s.hook == nil {
+		return delta
+	}
+	s.tail += delta
+	i := strings.LastIndexByte(s.tail, '\n')
+	if i < 0 {
+		return ""
+	}
+	ready := s.tail[:i+1]
+	s.tail = s.tail[i+1:]
+	return s.hook(ready)
+}
+
+// Flush returns the held back text once the stream is over
+func (s *Stream) Flush() string {
+	if s.hook == nil || s.tail == "" {
+		return ""
+	}
+	out := s.hook(s.tail)
+	s.tail = ""
+	return out
+}
+
+// regexes are compiled once, hooks are built per request
+var compiled sync.Map
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := compiled.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiled.Store(pattern, re)
+	return re, nil
+}
@@ -0,0 +1,160 @@
+package hooks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestRequestChainOrder(t *testing.T) {
+	prepend := config.HookConfig{Type: "prepend_system", Text: "Internal project Falcon."}
+	redact := config.HookConfig{Type: "regex_redact", Pattern: `(?i)falcon`}
+	newReq := func() *domain.ChatRequest {
+		return &domain.ChatRequest{Messages: []domain.Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "What is Falcon?"},
+		}}
+	}
+
+	// the redaction sees the prepended text only when it runs after it
+	chain, err := Request([]config.HookConfig{prepend, redact})
+	require.NoError(t, err)
+	req := newReq()
+	require.NoError(t, chain(req))
+	assert.Equal(t, "Internal project [REDACTED].\n\nBe brief.", req.Messages[0].Content)
+	assert.Equal(t, "What is [REDACTED]?", req.Messages[1].Content)
+
+	chain, err = Request([]config.HookConfig{redact, prepend})
+	require.NoError(t, err)
+	req = newReq()
+	require.NoError(t, chain(req))
+	assert.Equal(t, "Internal project Falcon.\n\nBe brief.", req.Messages[0].Content)
+	assert.Equal(t, "What is [REDACTED]?", req.Messages[1].Content)
+}
+
+func TestPrependSystemAddsMessage(t *testing.T) {
+	chain, err := Request([]config.HookConfig{{Type: "prepend_system", Text: "Be brief."}})
+	require.NoError(t, err)
+
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hi"}}}
+	require.NoError(t, chain(req))
+	require.Len(t, req.Messages, 2)
+	assert.Equal(t, domain.Message{Role: "system", Content: "Be brief."}, req.Messages[0])
+}
+
+func TestRegexRedactParts(t *testing.T) {
+	chain, err := Request([]config.HookConfig{{Type: "regex_redact", Pattern: `\d{4}-\d{4}`, Replacement: "####"}})
+	require.NoError(t, err)
+
+	image := map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "https://x/1234-5678.png"}}
+	req := &domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: []interface{}{
+		map[string]interface{}{"type": "text", "text": "card 1234-5678"},
+		image,
+	}}}}
+	require.NoError(t, chain(req))
+
+	parts := req.Messages[0].Content.([]interface{})
+	assert.Equal(t, "card ####", parts[0].(map[string]interface{})["text"])
+	assert.Equal(t, image, parts[1], "only text parts are rewritten")
+}
+
+func TestMaxMessages(t *testing.T) {
+	chain, err := Request([]config.HookConfig{{Type: "max_messages", Max: 2}})
+	require.NoError(t, err)
+
+	req := &domain.ChatRequest{Messages: []domain.Message{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Content: "1"},
+		{Role: "assistant", Content: "2"},
+		{Role: "tool", Content: "3"},
+		{Role: "user", Content: "4"},
+	}}
+	require.NoError(t, chain(req))
+
+	var got []string
+	for _, m := range req.Messages {
+		got = append(got, m.Content.(string))
+	}
+	assert.Equal(t, []string{"sys", "4"}, got, "a tool result cut off from its call goes too")
+}
+
+func TestBuildErrors(t *testing.T) {
+	for _, hooks := range [][]config.HookConfig{
+		{{Type: "nope"}},
+		{{Type: "prepend_system"}},
+		{{Type: "regex_redact", Pattern: "("}},
+		{{Type: "max_messages"}},
+	} {
+		_, err := Request(hooks)
+		assert.Error(t, err, hooks[0].Type)
+	}
+	_, err := Response([]config.HookConfig{{Type: "regex_replace"}})
+	assert.Error(t, err)
+
+	err = Validate(&config.Config{Hooks: config.HooksConfig{Keys: map[string]config.HookChains{
+		"sk-a": {Response: []config.HookConfig{{Type: "prepend_system"}}},
+	}}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hooks.keys.sk-a")
+}
+
+func TestRegisterCustom(t *testing.T) {
+	RegisterRequest("test_reject", func(h config.HookConfig) (RequestHook, error) {
+		word := h.Options["word"]
+		return func(req *domain.ChatRequest) error {
+			for _, m := range req.Messages {
+				if s, _ := m.Content.(string); strings.Contains(s, word) {
+					return errors.New("rejected")
+				}
+			}
+			return nil
+		}, nil
+	})
+
+	chain, err := Request([]config.HookConfig{{Type: "test_reject", Options: map[string]string{"word": "secret"}}})
+	require.NoError(t, err)
+	assert.NoError(t, chain(&domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "hello"}}}))
+	assert.Error(t, chain(&domain.ChatRequest{Messages: []domain.Message{{Role: "user", Content: "the secret"}}}))
+}
+
+func TestStreamMatchesWhole(t *testing.T) {
+	hook, err := Response([]config.HookConfig{
+		{Type: "regex_replace", Pattern: `sk-[a-z0-9]+`, Replacement: "sk-***"},
+		{Type: "regex_replace", Pattern: `sk-\*\*\*`, Replacement: "<key>"},
+	})
+	require.NoError(t, err)
+
+	text := "use sk-abc123 here\nand sk-def456 there\nno key"
+	whole := hook(text)
+	assert.Equal(t, "use <key> here\nand <key> there\nno key", whole, "hooks run in order")
+
+	// every way of cutting the text in two must give the same reply
+	for i := 0; i <= len(text); i++ {
+		s := NewStream(hook)
+		got := s.Write(text[:i]) + s.Write(text[i:]) + s.Flush()
+		assert.Equal(t, whole, got, "split at "+text[:i])
+	}
+
+	var b strings.Builder
+	s := NewStream(hook)
+	for i := range text {
+		b.WriteString(s.Write(text[i : i+1]))
+	}
+	b.WriteString(s.Flush())
+	assert.Equal(t, whole, b.String(), "byte by byte")
+}
+
+func TestStreamWithoutHook(t *testing.T) {
+	hook, err := Response(nil)
+	require.NoError(t, err)
+	assert.Nil(t, hook)
+
+	s := NewStream(hook)
+	assert.Equal(t, "partial", s.Write("partial"))
+	assert.Empty(t, s.Flush())
+}
@@ -0,0 +1,435 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+)
+
+// Upstream is the provider whose model list the catalog tracks
+type Upstream interface {
+	ListModels() ([]string, error)
+	SupportsModel(model string) bool
+}
+
+// Pin records which upstream model id a configured alias resolved to
+type Pin struct {
+	Alias      string `json:"alias"`
+	Target     string `json:"target"`
+	Upstream   string `json:"upstream"`
+	Broken     bool   `json:"broken"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+type DriftEvent struct {
+	Event  string    `json:"event"`
+	Alias  string    `json:"alias"`
+	From   string    `json:"from"`
+	To     string    `json:"to,omitempty"`
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// Model is one entry of /v1/models
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// mo extension, left out in the strict compat profile
+	Mo *Capabilities `json:"mo,omitempty"`
+}
+
+// Capabilities tells a client what a model can do before it asks
+type Capabilities struct {
+	// provider serving the model, the target's for an alias
+	Provider          string `json:"provider"`
+	SupportsTools     bool   `json:"supports_tools"`
+	SupportsVision    bool   `json:"supports_vision"`
+	SupportsReasoning bool   `json:"supports_reasoning"`
+	// limits.context_tokens of the model, 0 when not configured
+	MaxContextTokens int `json:"max_context_tokens,omitempty"`
+}
+
+// list age past which a request refreshes it, when the config has none
+const defaultTTL = 15 * time.Minute
+
+// Catalog caches the upstream model list and keeps configured aliases
+// pinned to ids that still exist, repinning or flagging them on renames
+type Catalog struct {
+	upstream Upstream
+	policy   string
+	webhook  string
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu   sync.RWMutex
+	pins map[string]*Pin
+	// aliases onto models of other providers, resolved but not tracked
+	aliases map[string]string
+
+	// last upstream list, when it was asked for and when it last succeeded
+	ids        []string
+	attempted  time.Time
+	fetched    time.Time
+	refreshing bool
+	// first time an id was seen, so created does not move between calls
+	created map[string]int64
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewCatalog(cfg *config.Config, upstream Upstream) *Catalog {
+	c := &Catalog{
+		upstream: upstream,
+		policy:   cfg.Model.OnDrift,
+		webhook:  cfg.Model.DriftWebhook,
+		ttl:      cfg.Model.ModelsTTL,
+		now:      time.Now,
+		pins:     make(map[string]*Pin),
+		aliases:  make(map[string]string),
+		created:  make(map[string]int64),
+		stop:     make(chan struct{}),
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultTTL
+	}
+
+	// models served by other providers never show up in this list
+	if d := cfg.Model.Default; d != "" && upstream.SupportsModel(d) {
+		c.pins[d] = &Pin{Alias: d, Target: d, Upstream: d}
+	}
+	for alias, target := range cfg.Model.Aliases {
+		if upstream.SupportsModel(target) {
+			c.pins[alias] = &Pin{Alias: alias, Target: target, Upstream: target}
+		} else {
+			c.aliases[alias] = target
+		}
+	}
+
+	return c
+}
+
+// Resolve maps an alias to its pinned upstream id, other models pass through
+func (c *Catalog) Resolve(model string) string {
+	if c == nil {
+		return model
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if pin, ok := c.pins[model]; ok {
+		return pin.Upstream
+	}
+	if target, ok := c.aliases[model]; ok {
+		return target
+	}
+	return model
+}
+
+func (c *Catalog) Pins() []Pin {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make([]Pin, 0, len(c.pins))
+	for _, p := range c.pins {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Alias < out[j].Alias })
+	return out
+}
+
+// Broken reports whether the alias lost its upstream model
+func (c *Catalog) Broken(alias string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	pin, ok := c.pins[alias]
+	return ok && pin.Broken
+}
+
+func (c *Catalog) Refresh() error {
+	c.mu.Lock()
+	c.attempted = c.now()
+	c.mu.Unlock()
+
+	ids, err := c.upstream.ListModels()
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	var events []DriftEvent
+
+	c.mu.Lock()
+	c.ids = ids
+	c.fetched = c.now()
+	for _, id := range ids {
+		c.stamp(id)
+	}
+
+	for _, pin := range c.pins {
+		if set[pin.Upstream] {
+			pin.Broken = false
+			pin.Suggestion = ""
+			continue
+		}
+
+		match := closestModel(pin.Upstream, ids)
+		event := DriftEvent{
+			Event: "model_drift",
+			Alias: pin.Alias,
+			From:  pin.Upstream,
+			To:    match,
+			Time:  time.Now(),
+		}
+
+		if match != "" && c.policy == "repin" {
+			pin.Upstream = match
+			pin.Broken = false
+			pin.Suggestion = ""
+			event.Action = "repinned"
+		} else {
+			if pin.Broken && pin.Suggestion == match {
+				// already reported
+				continue
+			}
+			pin.Broken = true
+			pin.Suggestion = match
+			event.Action = "broken"
+		}
+		events = append(events, event)
+	}
+	c.mu.Unlock()
+
+	for _, e := range events {
+		c.report(e)
+	}
+
+	return nil
+}
+
+// Models lists the upstream models and the configured aliases. the list
+// comes from the last refresh, one older than the ttl is served while a
+// new one is fetched, only a catalog that never asked waits for it
+func (c *Catalog) Models() []Model {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	first := c.attempted.IsZero()
+	stale := !first && !c.refreshing && c.now().Sub(c.attempted) > c.ttl
+	if stale {
+		c.refreshing = true
+	}
+	c.mu.Unlock()
+
+	if first {
+		if err := c.Refresh(); err != nil {
+			logger.Debug().Err(err).Msg("models refresh failed")
+		}
+	} else if stale {
+		go func() {
+			if err := c.Refresh(); err != nil {
+				logger.Debug().Err(err).Msg("models refresh failed")
+			}
+			c.mu.Lock()
+			c.refreshing = false
+			c.mu.Unlock()
+		}()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]Model, 0, len(c.ids)+len(c.pins)+len(c.aliases))
+	seen := make(map[string]bool)
+	for _, id := range c.ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, Model{ID: id, Object: "model", Created: c.created[id], OwnedBy: "zhipu"})
+		}
+	}
+
+	aliases := make([]string, 0, len(c.pins)+len(c.aliases))
+	for alias := range c.pins {
+		aliases = append(aliases, alias)
+	}
+	for alias := range c.aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		if !seen[alias] {
+			seen[alias] = true
+			out = append(out, Model{ID: alias, Object: "model", Created: c.stamp(alias), OwnedBy: "mo"})
+		}
+	}
+	return out
+}
+
+// Created is the stable created timestamp of a model mo serves
+func (c *Catalog) Created(id string) int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stamp(id)
+}
+
+// stamp returns when id was first seen, callers hold mu
+func (c *Catalog) stamp(id string) int64 {
+	if t, ok := c.created[id]; ok {
+		return t
+	}
+	t := c.now().Unix()
+	c.created[id] = t
+	return t
+}
+
+// Run refreshes the catalog every interval until Close
+func (c *Catalog) Run(interval time.Duration) {
+	if err := c.Refresh(); err != nil {
+		logger.Debug().Err(err).Msg("models refresh failed")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Refresh(); err != nil {
+				logger.Debug().Err(err).Msg("models refresh failed")
+			}
+		}
+	}
+}
+
+func (c *Catalog) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+func (c *Catalog) report(e DriftEvent) {
+	if e.Action == "repinned" {
+		logger.Warn().
+			Str("alias", e.Alias).
+			Str("from", e.From).
+			Str("to", e.To).
+			Msg("UPSTREAM MODEL RENAMED: alias repinned")
+	} else {
+		logger.Error().
+			Str("alias", e.Alias).
+			Str("missing", e.From).
+			Str("suggestion", e.To).
+			Msg("UPSTREAM MODEL MISSING: alias marked broken")
+	}
+
+	if c.webhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		resp, err := httpclient.New(10 * time.Second).Do(newJSONRequest(c.webhook, body))
+		if err != nil {
+			logger.Warn().Err(err).Msg("drift webhook failed")
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+func newJSONRequest(url string, body []byte) *http.Request {
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// closestModel picks the most plausible rename of id among candidates:
+// ids sharing its stem (everything before the last '-') win, otherwise the
+// smallest edit distance within a quarter of the id length
+func closestModel(id string, candidates []string) string {
+	stem := id
+	if i := strings.LastIndex(id, "-"); i > 0 {
+		stem = id[:i+1]
+	}
+
+	best := ""
+	bestDist := -1
+	for _, c := range candidates {
+		if strings.HasPrefix(c, stem) {
+			d := editDistance(id, c)
+			if bestDist < 0 || d < bestDist {
+				best, bestDist = c, d
+			}
+		}
+	}
+	if best != "" {
+		return best
+	}
+
+	limit := len(id) / 4
+	if limit < 2 {
+		limit = 2
+	}
+	for _, c := range candidates {
+		d := editDistance(strings.ToLower(id), strings.ToLower(c))
+		if d <= limit && (bestDist < 0 || d < bestDist) {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
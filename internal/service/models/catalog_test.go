@@ -0,0 +1,201 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+type fakeUpstream struct {
+	ids []string
+}
+
+func (f *fakeUpstream) ListModels() ([]string, error) { return f.ids, nil }
+
+func (f *fakeUpstream) SupportsModel(model string) bool {
+	return !strings.HasPrefix(model, "coder-")
+}
+
+func testConfig(policy, webhook string) *config.Config {
+	return &config.Config{Model: config.ModelConfig{
+		Default:      "GLM-4-6-API-V1",
+		Aliases:      map[string]string{"glm": "GLM-4-6-API-V1", "coder": "coder-model"},
+		OnDrift:      policy,
+		DriftWebhook: webhook,
+	}}
+}
+
+func TestCatalogRename(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		renamed     []string
+		wantModel   string
+		wantBroken  bool
+		wantSuggest string
+	}{
+		{"repin", "repin", []string{"GLM-4-6-API-V2", "0727-360B-API"}, "GLM-4-6-API-V2", false, ""},
+		{"broken", "broken", []string{"GLM-4-6-API-V2", "0727-360B-API"}, "GLM-4-6-API-V1", true, "GLM-4-6-API-V2"},
+		{"no candidate", "repin", []string{"0727-360B-API"}, "GLM-4-6-API-V1", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := &fakeUpstream{ids: []string{"GLM-4-6-API-V1", "0727-360B-API"}}
+			c := NewCatalog(testConfig(tt.policy, ""), up)
+
+			require.NoError(t, c.Refresh())
+			assert.Equal(t, "GLM-4-6-API-V1", c.Resolve("glm"))
+			assert.False(t, c.Broken("glm"))
+
+			up.ids = tt.renamed
+			require.NoError(t, c.Refresh())
+
+			assert.Equal(t, tt.wantModel, c.Resolve("glm"))
+			assert.Equal(t, tt.wantModel, c.Resolve("GLM-4-6-API-V1"))
+			assert.Equal(t, tt.wantBroken, c.Broken("glm"))
+			assert.Equal(t, "unknown", c.Resolve("unknown"))
+
+			// other providers' models are never pinned
+			assert.Equal(t, "coder-model", c.Resolve("coder"))
+			assert.False(t, c.Broken("coder"))
+
+			for _, pin := range c.Pins() {
+				if pin.Alias == "glm" {
+					assert.Equal(t, tt.wantSuggest, pin.Suggestion)
+				}
+			}
+		})
+	}
+}
+
+func TestCatalogDriftWebhook(t *testing.T) {
+	events := make(chan DriftEvent, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e DriftEvent
+		if json.NewDecoder(r.Body).Decode(&e) == nil {
+			events <- e
+		}
+	}))
+	defer hook.Close()
+
+	up := &fakeUpstream{ids: []string{"GLM-4-6-API-V2"}}
+	cfg := testConfig("repin", hook.URL)
+	cfg.Model.Aliases = nil
+	c := NewCatalog(cfg, up)
+
+	require.NoError(t, c.Refresh())
+
+	select {
+	case e := <-events:
+		assert.Equal(t, "model_drift", e.Event)
+		assert.Equal(t, "GLM-4-6-API-V1", e.Alias)
+		assert.Equal(t, "GLM-4-6-API-V1", e.From)
+		assert.Equal(t, "GLM-4-6-API-V2", e.To)
+		assert.Equal(t, "repinned", e.Action)
+	case <-time.After(5 * time.Second):
+		t.Fatal("drift webhook not called")
+	}
+
+	// a repinned alias that still resolves raises nothing further
+	require.NoError(t, c.Refresh())
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClosestModel(t *testing.T) {
+	tests := []struct {
+		id         string
+		candidates []string
+		want       string
+	}{
+		{"GLM-4-6-API-V1", []string{"GLM-4-5", "GLM-4-6-API-V2"}, "GLM-4-6-API-V2"},
+		{"glm-4.6", []string{"GLM-4.6", "qwen"}, "GLM-4.6"},
+		{"GLM-4-6-API-V1", []string{"0727-360B-API"}, ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, closestModel(tt.id, tt.candidates), tt.id)
+	}
+}
+
+type countingUpstream struct {
+	fakeUpstream
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *countingUpstream) ListModels() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.ids, nil
+}
+
+func (f *countingUpstream) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestCatalogModelsCache(t *testing.T) {
+	up := &countingUpstream{fakeUpstream: fakeUpstream{ids: []string{"GLM-4-6-API-V1"}}}
+	cfg := testConfig("broken", "")
+	cfg.Model.ModelsTTL = time.Minute
+	c := NewCatalog(cfg, up)
+
+	now := time.Unix(1_700_000_000, 0)
+	c.now = func() time.Time { return now }
+
+	// nothing fetched yet, the first call waits for the list
+	first := c.Models()
+	assert.Equal(t, 1, up.Calls())
+	require.NotEmpty(t, first)
+	assert.Equal(t, "GLM-4-6-API-V1", first[0].ID)
+
+	now = now.Add(time.Minute)
+	up.ids = []string{"GLM-4-6-API-V1", "GLM-4-5-Air"}
+	assert.Equal(t, first, c.Models(), "within the ttl the cache is served")
+	assert.Equal(t, 1, up.Calls())
+
+	// past the ttl the stale list is served once more while it refreshes
+	now = now.Add(time.Second)
+	assert.Equal(t, first, c.Models())
+	assert.Eventually(t, func() bool { return up.Calls() == 2 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return len(c.Models()) == len(first)+1 }, time.Second, time.Millisecond)
+	assert.Equal(t, 2, up.Calls())
+}
+
+func TestCatalogModelsMerged(t *testing.T) {
+	up := &fakeUpstream{ids: []string{"GLM-4-6-API-V1", "0727-360B-API"}}
+	c := NewCatalog(testConfig("broken", ""), up)
+	require.NoError(t, c.Refresh())
+
+	var ids, owners []string
+	for _, m := range c.Models() {
+		ids = append(ids, m.ID)
+		owners = append(owners, m.OwnedBy)
+		assert.Equal(t, "model", m.Object)
+		assert.NotZero(t, m.Created)
+	}
+	// the default is an upstream id already, aliases follow sorted
+	assert.Equal(t, []string{"GLM-4-6-API-V1", "0727-360B-API", "coder", "glm"}, ids)
+	assert.Equal(t, []string{"zhipu", "zhipu", "mo", "mo"}, owners)
+
+	// created does not move between calls
+	before := c.Models()
+	c.now = func() time.Time { return time.Now().Add(time.Hour) }
+	require.NoError(t, c.Refresh())
+	assert.Equal(t, before, c.Models())
+}
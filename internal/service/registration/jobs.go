@@ -0,0 +1,346 @@
+package registration
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+// job states in the order a registration goes through them
+const (
+	CreatingEmail        = "creating_email"
+	FillingForm          = "filling_form"
+	AwaitingCaptcha      = "awaiting_captcha"
+	AwaitingVerification = "awaiting_verification"
+	// qwen only, the oauth device flow after activation
+	Authorizing = "authorizing"
+	SavingToken = "saving_token"
+	Done        = "done"
+	Failed      = "failed"
+	// a batch stopped early on request
+	Cancelled = "cancelled"
+)
+
+// finished jobs stay pollable this long
+const retain = 7 * 24 * time.Hour
+
+// ErrBusy is returned while a job for the same provider still runs, each
+// one holds a browser window waiting for a human to solve the captcha
+var ErrBusy = errors.New("a registration is already running")
+
+var (
+	ErrNotFound = errors.New("registration not found")
+	// only a batch has accounts left to skip
+	ErrNotBatch = errors.New("only a batch registration can be cancelled")
+	ErrFinished = errors.New("registration already finished")
+)
+
+// Transition is one state change of a job
+type Transition struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// Job is a registration running in the background, polled by id
+type Job struct {
+	ID       string       `json:"id"`
+	Provider string       `json:"provider"`
+	State    string       `json:"state"`
+	History  []Transition `json:"history"`
+	// why a failed job failed
+	Reason     string    `json:"reason,omitempty"`
+	Token      *TokenRef `json:"token,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+
+	// accounts a batch registers, zero for a single registration
+	Count int `json:"count,omitempty"`
+	// one per account of a batch that ran, in order
+	Results []Outcome `json:"results,omitempty"`
+	// the batch stops once the current account is through
+	Cancelling bool `json:"cancelling,omitempty"`
+}
+
+// Outcome is how one account of a batch went
+type Outcome struct {
+	Token *TokenRef `json:"token,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// TokenRef names the token a registration stored. jobs are persisted and
+// polled without auth, the credentials stay in the token store
+type TokenRef struct {
+	ID    string `json:"id"`
+	Email string `json:"email,omitempty"`
+}
+
+func refOf(t *tokenstore.Token) *TokenRef {
+	if t == nil {
+		return nil
+	}
+	return &TokenRef{ID: t.ID, Email: t.Email}
+}
+
+func (j *Job) Finished() bool {
+	return j.State == Done || j.State == Failed || j.State == Cancelled
+}
+
+// Flow runs a registration, moving the job through its states with set
+type Flow func(set func(state string)) (*tokenstore.Token, error)
+
+// Session hands out the flow that registers each account of a batch, end
+// releases what the accounts shared
+type Session func() (account Flow, end func())
+
+// Store persists job records, the token store implements it
+type Store interface {
+	SaveJob(id string, data []byte) error
+	RemoveJob(id string) error
+	Jobs() ([][]byte, error)
+}
+
+type Jobs struct {
+	store Store
+
+	mu   sync.Mutex
+	now  func() time.Time
+	jobs map[string]*Job
+}
+
+// NewJobs loads the jobs kept in store, nil keeps them in memory only.
+// a job still running when mo stopped can not resume, it is failed. every
+// record is written back, older ones held whole tokens
+func NewJobs(store Store) *Jobs {
+	j := &Jobs{store: store, now: time.Now, jobs: make(map[string]*Job)}
+	if store == nil {
+		return j
+	}
+
+	records, err := store.Jobs()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to load registration jobs")
+	}
+	for _, data := range records {
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			continue
+		}
+		if !job.Finished() {
+			job.State = Failed
+			job.Reason = "interrupted by a restart"
+			job.FinishedAt = j.now()
+			job.History = append(job.History, Transition{State: Failed, At: job.FinishedAt})
+		}
+		j.save(&job)
+		j.jobs[job.ID] = &job
+	}
+	return j
+}
+
+// Start runs flow in the background, one job per provider at a time
+func (j *Jobs) Start(provider string, flow Flow) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, err := j.add(provider, 0)
+	if err != nil {
+		return Job{}, err
+	}
+	go j.run(job, flow)
+	return j.copy(job), nil
+}
+
+// StartBatch registers count accounts one after another in the background.
+// a failed account is recorded and the next one started
+func (j *Jobs) StartBatch(provider string, count int, session Session) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, err := j.add(provider, count)
+	if err != nil {
+		return Job{}, err
+	}
+	go j.runBatch(job, session)
+	return j.copy(job), nil
+}
+
+// Cancel stops a batch after the account in progress
+func (j *Jobs) Cancel(id string) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	switch {
+	case !ok:
+		return Job{}, ErrNotFound
+	case job.Count == 0:
+		return Job{}, ErrNotBatch
+	case job.Finished():
+		return Job{}, ErrFinished
+	}
+	if !job.Cancelling {
+		logger.Info().Str("job", job.ID).Str("provider", job.Provider).Msg("registration batch cancelling")
+		job.Cancelling = true
+		j.save(job)
+	}
+	return j.copy(job), nil
+}
+
+// add creates a job, callers hold mu
+func (j *Jobs) add(provider string, count int) (*Job, error) {
+	j.prune()
+
+	for _, job := range j.jobs {
+		if job.Provider == provider && !job.Finished() {
+			return nil, ErrBusy
+		}
+	}
+
+	now := j.now()
+	job := &Job{
+		ID:        uuid.New().String()[:8],
+		Provider:  provider,
+		State:     CreatingEmail,
+		History:   []Transition{{State: CreatingEmail, At: now}},
+		StartedAt: now,
+		Count:     count,
+	}
+	j.jobs[job.ID] = job
+	j.save(job)
+	return job, nil
+}
+
+// Get returns a snapshot of the job
+func (j *Jobs) Get(id string) (Job, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.copy(job), true
+}
+
+func (j *Jobs) run(job *Job, flow Flow) {
+	token, err := flow(j.setter(job))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err != nil {
+		logger.Error().Err(err).Str("job", job.ID).Str("provider", job.Provider).Msg("registration failed")
+		j.finish(job, Failed, err.Error())
+		return
+	}
+	job.Token = refOf(token)
+	j.finish(job, Done, "")
+}
+
+func (j *Jobs) runBatch(job *Job, session Session) {
+	account, end := session()
+	set := j.setter(job)
+
+	for range job.Count {
+		j.mu.Lock()
+		stop := job.Cancelling
+		j.mu.Unlock()
+		if stop {
+			break
+		}
+
+		token, err := account(set)
+
+		j.mu.Lock()
+		outcome := Outcome{Token: refOf(token)}
+		if err != nil {
+			logger.Error().Err(err).Str("job", job.ID).Str("provider", job.Provider).Int("account", len(job.Results)+1).Msg("registration failed")
+			outcome = Outcome{Error: err.Error()}
+		}
+		job.Results = append(job.Results, outcome)
+		j.save(job)
+		j.mu.Unlock()
+	}
+	end()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	registered := 0
+	for _, o := range job.Results {
+		if o.Error == "" {
+			registered++
+		}
+	}
+	switch {
+	case len(job.Results) < job.Count:
+		j.finish(job, Cancelled, "")
+	case registered == 0:
+		j.finish(job, Failed, "every account failed")
+	default:
+		j.finish(job, Done, "")
+	}
+}
+
+// setter moves job to a state, the set a flow runs with
+func (j *Jobs) setter(job *Job) func(string) {
+	return func(state string) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if job.State == state {
+			return
+		}
+		logger.Info().Str("job", job.ID).Str("provider", job.Provider).Str("state", state).Msg("registration progress")
+		job.State = state
+		job.History = append(job.History, Transition{State: state, At: j.now()})
+		j.save(job)
+	}
+}
+
+// finish ends job in state, callers hold mu
+func (j *Jobs) finish(job *Job, state, reason string) {
+	job.FinishedAt = j.now()
+	job.State = state
+	job.Reason = reason
+	job.History = append(job.History, Transition{State: state, At: job.FinishedAt})
+	j.save(job)
+}
+
+// save writes the job through to the store, callers hold mu
+func (j *Jobs) save(job *Job) {
+	if j.store == nil {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err == nil {
+		err = j.store.SaveJob(job.ID, data)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Str("job", job.ID).Msg("failed to persist registration job")
+	}
+}
+
+// copy snapshots a job, callers hold mu
+func (j *Jobs) copy(job *Job) Job {
+	out := *job
+	out.History = append([]Transition(nil), job.History...)
+	out.Results = append([]Outcome(nil), job.Results...)
+	return out
+}
+
+// prune forgets jobs finished past retention, callers hold mu
+func (j *Jobs) prune() {
+	for id, job := range j.jobs {
+		if job.Finished() && j.now().Sub(job.FinishedAt) > retain {
+			delete(j.jobs, id)
+			if j.store != nil {
+				j.store.RemoveJob(id)
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package registration
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+type memStore struct {
+	mu   sync.Mutex
+	jobs map[string][]byte
+}
+
+func newMemStore() *memStore { return &memStore{jobs: map[string][]byte{}} }
+
+func (m *memStore) SaveJob(id string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[id] = data
+	return nil
+}
+
+func (m *memStore) RemoveJob(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jobs, id)
+	return nil
+}
+
+func (m *memStore) Jobs() ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out [][]byte
+	for _, data := range m.jobs {
+		out = append(out, data)
+	}
+	return out, nil
+}
+
+func waitFinished(t *testing.T, j *Jobs, id string) Job {
+	t.Helper()
+	var job Job
+	require.Eventually(t, func() bool {
+		job, _ = j.Get(id)
+		return job.Finished()
+	}, time.Second, time.Millisecond)
+	return job
+}
+
+func states(job Job) []string {
+	var out []string
+	for _, tr := range job.History {
+		out = append(out, tr.State)
+	}
+	return out
+}
+
+func TestJobs(t *testing.T) {
+	j := NewJobs(nil)
+	release := make(chan struct{})
+
+	job, err := j.Start("qwen", func(set func(string)) (*tokenstore.Token, error) {
+		set(CreatingEmail)
+		set(FillingForm)
+		set(AwaitingCaptcha)
+		<-release
+		set(SavingToken)
+		return &tokenstore.Token{ID: "t1", Provider: "qwen"}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, CreatingEmail, job.State)
+
+	// one browser per provider at a time, other providers are not blocked
+	_, err = j.Start("qwen", nil)
+	assert.ErrorIs(t, err, ErrBusy)
+	other, err := j.Start("glm", func(func(string)) (*tokenstore.Token, error) { return nil, errors.New("no captcha") })
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, _ = j.Get(job.ID)
+		return job.State == AwaitingCaptcha
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	done := waitFinished(t, j, job.ID)
+	assert.Equal(t, Done, done.State)
+	assert.Equal(t, "t1", done.Token.ID)
+	assert.Equal(t, []string{CreatingEmail, FillingForm, AwaitingCaptcha, SavingToken, Done}, states(done))
+	assert.False(t, done.FinishedAt.IsZero())
+
+	failed := waitFinished(t, j, other.ID)
+	assert.Equal(t, "no captcha", failed.Reason)
+	assert.Equal(t, []string{CreatingEmail, Failed}, states(failed))
+
+	_, ok := j.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestJobsSurviveRestart(t *testing.T) {
+	store := newMemStore()
+	j := NewJobs(store)
+
+	finished, err := j.Start("glm", func(set func(string)) (*tokenstore.Token, error) {
+		return &tokenstore.Token{ID: "t1", Email: "a@x.io", Token: "jwt-secret", RefreshToken: "rt-secret"}, nil
+	})
+	require.NoError(t, err)
+	waitFinished(t, j, finished.ID)
+
+	hang := make(chan struct{})
+	defer close(hang)
+	running, err := j.Start("qwen", func(set func(string)) (*tokenstore.Token, error) {
+		set(AwaitingVerification)
+		<-hang
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, _ := j.Get(running.ID)
+		return job.State == AwaitingVerification
+	}, time.Second, time.Millisecond)
+
+	// a record from before jobs kept only a reference
+	store.SaveJob("legacy", []byte(`{"id":"legacy","provider":"glm","state":"done","token":{"id":"t0","email":"b@x.io","token":"jwt-old"}}`))
+
+	restarted := NewJobs(store)
+
+	job, ok := restarted.Get(finished.ID)
+	require.True(t, ok)
+	assert.Equal(t, Done, job.State)
+	assert.Equal(t, &TokenRef{ID: "t1", Email: "a@x.io"}, job.Token)
+
+	// the credentials are never written with the job
+	store.mu.Lock()
+	for id, data := range store.jobs {
+		assert.NotContains(t, string(data), "secret", id)
+		assert.NotContains(t, string(data), "jwt-old", id)
+	}
+	store.mu.Unlock()
+
+	job, ok = restarted.Get(running.ID)
+	require.True(t, ok)
+	assert.Equal(t, Failed, job.State)
+	assert.Equal(t, "interrupted by a restart", job.Reason)
+	assert.Equal(t, []string{CreatingEmail, AwaitingVerification, Failed}, states(job))
+
+	// the failure is written back, a second restart sees the same
+	var stored Job
+	store.mu.Lock()
+	data := store.jobs[running.ID]
+	store.mu.Unlock()
+	require.NoError(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, Failed, stored.State)
+}
+
+func TestJobsPrune(t *testing.T) {
+	store := newMemStore()
+	j := NewJobs(store)
+	now := time.Now()
+	j.now = func() time.Time { return now }
+
+	job, err := j.Start("qwen", func(func(string)) (*tokenstore.Token, error) { return nil, errors.New("x") })
+	require.NoError(t, err)
+	waitFinished(t, j, job.ID)
+
+	j.mu.Lock()
+	now = now.Add(retain + time.Second)
+	j.mu.Unlock()
+
+	// pruning happens on the next start
+	_, err = j.Start("glm", func(func(string)) (*tokenstore.Token, error) { return nil, nil })
+	require.NoError(t, err)
+	_, ok := j.Get(job.ID)
+	assert.False(t, ok)
+
+	store.mu.Lock()
+	assert.NotContains(t, store.jobs, job.ID)
+	store.mu.Unlock()
+}
+
+// countingSession fails the accounts listed in fail, numbered from 1
+func countingSession(fail map[int]bool, ended *int) Session {
+	return func() (Flow, func()) {
+		n := 0
+		account := func(set func(string)) (*tokenstore.Token, error) {
+			n++
+			set(CreatingEmail)
+			set(SavingToken)
+			if fail[n] {
+				return nil, errors.New("verify link not found")
+			}
+			return &tokenstore.Token{ID: string(rune('a' + n - 1)), Token: "jwt-secret"}, nil
+		}
+		return account, func() { *ended++ }
+	}
+}
+
+func TestBatch(t *testing.T) {
+	store := newMemStore()
+	j := NewJobs(store)
+
+	ended := 0
+	job, err := j.StartBatch("glm", 3, countingSession(map[int]bool{2: true}, &ended))
+	require.NoError(t, err)
+	assert.Equal(t, 3, job.Count)
+
+	done := waitFinished(t, j, job.ID)
+	assert.Equal(t, Done, done.State)
+	assert.Equal(t, 1, ended)
+	require.Len(t, done.Results, 3)
+	assert.Equal(t, "a", done.Results[0].Token.ID)
+	assert.Nil(t, done.Results[1].Token)
+	assert.Equal(t, "verify link not found", done.Results[1].Error)
+	assert.Equal(t, "c", done.Results[2].Token.ID)
+	data, _ := json.Marshal(done)
+	assert.NotContains(t, string(data), "jwt-secret", "results name tokens, they do not carry them")
+	store.mu.Lock()
+	assert.NotContains(t, string(store.jobs[done.ID]), "jwt-secret")
+	store.mu.Unlock()
+	assert.Equal(t, []string{
+		CreatingEmail, SavingToken, CreatingEmail, SavingToken, CreatingEmail, SavingToken, Done,
+	}, states(done))
+
+	_, err = j.Cancel(done.ID)
+	assert.ErrorIs(t, err, ErrFinished)
+
+	// nothing registered fails the batch
+	job, err = j.StartBatch("glm", 2, countingSession(map[int]bool{1: true, 2: true}, &ended))
+	require.NoError(t, err)
+	failed := waitFinished(t, j, job.ID)
+	assert.Equal(t, Failed, failed.State)
+	assert.Equal(t, "every account failed", failed.Reason)
+	assert.Len(t, failed.Results, 2)
+}
+
+func TestBatchCancel(t *testing.T) {
+	j := NewJobs(nil)
+
+	release := make(chan struct{})
+	ended := false
+	job, err := j.StartBatch("qwen", 5, func() (Flow, func()) {
+		return func(set func(string)) (*tokenstore.Token, error) {
+			set(AwaitingCaptcha)
+			<-release
+			return &tokenstore.Token{ID: "t"}, nil
+		}, func() { ended = true }
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, _ = j.Get(job.ID)
+		return job.State == AwaitingCaptcha
+	}, time.Second, time.Millisecond)
+
+	cancelling, err := j.Cancel(job.ID)
+	require.NoError(t, err)
+	assert.True(t, cancelling.Cancelling)
+	assert.Equal(t, AwaitingCaptcha, cancelling.State)
+
+	// the account in progress still finishes
+	close(release)
+	done := waitFinished(t, j, job.ID)
+	assert.Equal(t, Cancelled, done.State)
+	assert.Len(t, done.Results, 1)
+	assert.True(t, ended)
+
+	_, err = j.Cancel("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	single, err := j.Start("qwen", func(func(string)) (*tokenstore.Token, error) { return nil, nil })
+	require.NoError(t, err)
+	_, err = j.Cancel(single.ID)
+	assert.ErrorIs(t, err, ErrNotBatch)
+}
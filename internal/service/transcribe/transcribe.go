@@ -0,0 +1,67 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+)
+
+// timeouts come from the request context, audio.timeout per call
+var client = httpclient.New(0)
+
+// Transcribe sends audio to cfg's openai compatible /v1/audio/transcriptions
+// and returns the text. format is the input_audio format, wav or mp3, and
+// names the upload
+func Transcribe(ctx context.Context, cfg config.AudioConfig, audio []byte, format string) (string, error) {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "audio."+format)
+	if err != nil {
+		return "", fmt.Errorf("create form: %w", err)
+	}
+	part.Write(audio)
+	mw.WriteField("model", cfg.Model)
+	mw.WriteField("response_format", "json")
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.TranscriptionURL, &body)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("transcribe: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("transcribe failed %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode transcription: %w", err)
+	}
+	return strings.TrimSpace(result.Text), nil
+}
@@ -0,0 +1,41 @@
+package transcribe
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+)
+
+func TestTranscribe(t *testing.T) {
+	audio := []byte("RIFF\x00\x01\x02\x03WAVEfmt ")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-audio" {
+			http.Error(w, `{"error":{"message":"bad key"}}`, http.StatusUnauthorized)
+			return
+		}
+		f, header, err := r.FormFile("file")
+		require.NoError(t, err)
+		got, _ := io.ReadAll(f)
+		assert.Equal(t, audio, got)
+		assert.Equal(t, "audio.wav", header.Filename)
+		assert.Equal(t, "whisper-1", r.FormValue("model"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"text":" turn the lights off \n"}`))
+	}))
+	defer srv.Close()
+
+	cfg := config.AudioConfig{TranscriptionURL: srv.URL + "/v1/audio/transcriptions", APIKey: "sk-audio", Model: "whisper-1"}
+	text, err := Transcribe(context.Background(), cfg, audio, "wav")
+	require.NoError(t, err)
+	assert.Equal(t, "turn the lights off", text)
+
+	cfg.APIKey = "sk-wrong"
+	_, err = Transcribe(context.Background(), cfg, audio, "wav")
+	assert.ErrorContains(t, err, "401")
+}
@@ -0,0 +1,264 @@
+package usage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/pkg/logger"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+// Groups a report can be broken down by
+var Groups = []string{"token", "key", "model"}
+
+const (
+	dayLayout = "2006-01-02"
+	// entries wait at most this long before they reach the store
+	flushEvery = 2 * time.Second
+	// a batch this large is written without waiting for the tick
+	flushBatch = 512
+	// entries beyond this backlog are dropped rather than block a request
+	journalBacklog = 4096
+)
+
+// Entry is one completion as the journal books it
+type Entry struct {
+	Time             time.Time
+	Provider         string
+	TokenID          string
+	APIKey           string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Journal books completions into daily counters per token, api key and
+// model, plus running totals per token. Book only queues, a background loop
+// folds entries together and writes them in batches
+type Journal struct {
+	store   *tokenstore.Store
+	entries chan Entry
+	flushes chan chan error
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func NewJournal(store *tokenstore.Store) *Journal {
+	j := &Journal{
+		store:   store,
+		entries: make(chan Entry, journalBacklog),
+		flushes: make(chan chan error),
+		done:    make(chan struct{}),
+	}
+	go j.run()
+	return j
+}
+
+// Book queues an entry, never blocking the caller
+func (j *Journal) Book(e Entry) {
+	select {
+	case j.entries <- e:
+	default:
+		if n := j.dropped.Add(1); n == 1 || n%1000 == 0 {
+			logger.Warn().Int64("dropped", n).Msg("usage journal backlog full, dropping entries")
+		}
+	}
+}
+
+// Flush writes everything queued so far
+func (j *Journal) Flush() error {
+	reply := make(chan error)
+	select {
+	case j.flushes <- reply:
+		return <-reply
+	case <-j.done:
+		return nil
+	}
+}
+
+// Close writes what is queued and stops the loop
+func (j *Journal) Close() error {
+	err := j.Flush()
+	close(j.done)
+	return err
+}
+
+func (j *Journal) run() {
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+
+	pending := make(map[string]tokenstore.Counts)
+	queued := 0
+	write := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		queued = 0
+		if err := j.store.AddUsage(pending); err != nil {
+			// kept for the next flush
+			logger.Error().Err(err).Msg("usage journal write failed")
+			return err
+		}
+		pending = make(map[string]tokenstore.Counts)
+		return nil
+	}
+	drain := func() {
+		for {
+			select {
+			case e := <-j.entries:
+				fold(pending, e)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case e := <-j.entries:
+			fold(pending, e)
+			if queued++; queued >= flushBatch {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case reply := <-j.flushes:
+			drain()
+			reply <- write()
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// fold adds e to every counter it counts towards
+func fold(pending map[string]tokenstore.Counts, e Entry) {
+	d := tokenstore.Counts{Requests: 1, PromptTokens: int64(e.PromptTokens), CompletionTokens: int64(e.CompletionTokens)}
+	day := e.Time.UTC().Format(dayLayout)
+	token := tokenRef(e.Provider, e.TokenID)
+
+	for _, key := range []string{
+		"day:" + day + ":token:" + token,
+		"day:" + day + ":key:" + KeyID(e.APIKey),
+		"day:" + day + ":model:" + e.Model,
+		"total:token:" + token,
+	} {
+		c := pending[key]
+		c.Add(d)
+		pending[key] = c
+	}
+}
+
+func tokenRef(provider, id string) string {
+	if id == "" {
+		id = "unknown"
+	}
+	return provider + "/" + id
+}
+
+// KeyID names an api key in reports without storing any of it, a hash
+// prefix tells keys apart
+func KeyID(key string) string {
+	if key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:6])
+}
+
+// Row is the usage of one token, key or model on one day
+type Row struct {
+	Day string `json:"day"`
+	ID  string `json:"id"`
+	// only set when grouped by token
+	Provider string `json:"provider,omitempty"`
+	tokenstore.Counts
+}
+
+// Report returns the daily counters of group for the utc days from..to,
+// both included, sorted by day and then by most requests
+func (j *Journal) Report(group string, from, to time.Time) ([]Row, error) {
+	if !validGroup(group) {
+		return nil, fmt.Errorf("unknown group %q, want one of %s", group, strings.Join(Groups, ", "))
+	}
+	if err := j.Flush(); err != nil {
+		return nil, err
+	}
+
+	rows := []Row{}
+	last := to.UTC().Format(dayLayout)
+	for d := from.UTC(); d.Format(dayLayout) <= last; d = d.AddDate(0, 0, 1) {
+		day := d.Format(dayLayout)
+		prefix := "day:" + day + ":" + group + ":"
+		counts, err := j.store.Usage(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		var daily []Row
+		for key, c := range counts {
+			r := Row{Day: day, ID: strings.TrimPrefix(key, prefix), Counts: c}
+			if group == "token" {
+				r.Provider, r.ID, _ = strings.Cut(r.ID, "/")
+			}
+			daily = append(daily, r)
+		}
+		sort.Slice(daily, func(a, b int) bool {
+			if daily[a].Requests != daily[b].Requests {
+				return daily[a].Requests > daily[b].Requests
+			}
+			return daily[a].ID < daily[b].ID
+		})
+		rows = append(rows, daily...)
+	}
+	return rows, nil
+}
+
+// TokenTotals returns the running totals per token, keyed provider/id
+func (j *Journal) TokenTotals() (map[string]tokenstore.Counts, error) {
+	if err := j.Flush(); err != nil {
+		return nil, err
+	}
+	counts, err := j.store.Usage("total:token:")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]tokenstore.Counts, len(counts))
+	for key, c := range counts {
+		out[strings.TrimPrefix(key, "total:token:")] = c
+	}
+	return out, nil
+}
+
+// TokenTotal picks a token out of TokenTotals
+func TokenTotal(totals map[string]tokenstore.Counts, provider, id string) tokenstore.Counts {
+	return totals[tokenRef(provider, id)]
+}
+
+func validGroup(group string) bool {
+	for _, g := range Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultJournal atomic.Pointer[Journal]
+
+// SetJournal makes j receive the entries of Book, nil stops booking
+func SetJournal(j *Journal) {
+	defaultJournal.Store(j)
+}
+
+// Book queues e in the journal set with SetJournal, if any
+func Book(e Entry) {
+	if j := defaultJournal.Load(); j != nil {
+		j.Book(e)
+	}
+}
@@ -0,0 +1,92 @@
+package usage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/pkg/tokenstore"
+)
+
+func newTestJournal(t *testing.T) *Journal {
+	store, err := tokenstore.New(t.TempDir())
+	require.NoError(t, err)
+	j := NewJournal(store)
+	t.Cleanup(func() {
+		j.Close()
+		store.Close()
+	})
+	return j
+}
+
+func TestJournalMidnightUTC(t *testing.T) {
+	j := newTestJournal(t)
+	midnight := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	// utc+3, still the evening of 1 march locally once past midnight utc
+	msk := time.FixedZone("MSK", 3*3600)
+
+	for _, e := range []Entry{
+		{Time: midnight.Add(-time.Nanosecond), Provider: "glm", TokenID: "a", APIKey: "sk-one", Model: "glm-4.6", PromptTokens: 10, CompletionTokens: 1},
+		{Time: midnight, Provider: "glm", TokenID: "a", APIKey: "sk-one", Model: "glm-4.6", PromptTokens: 20, CompletionTokens: 2},
+		{Time: midnight.Add(time.Hour).In(msk), Provider: "qwen", TokenID: "b", APIKey: "sk-two", Model: "coder-model", PromptTokens: 30, CompletionTokens: 3},
+		{Time: midnight.Add(24*time.Hour - time.Nanosecond), Provider: "glm", TokenID: "a", APIKey: "sk-one", Model: "glm-4.6", PromptTokens: 40, CompletionTokens: 4},
+	} {
+		j.Book(e)
+	}
+
+	feb := midnight.AddDate(0, 0, -1)
+	rows, err := j.Report("token", feb, feb)
+	require.NoError(t, err)
+	assert.Equal(t, []Row{
+		{Day: "2026-02-28", ID: "a", Provider: "glm", Counts: tokenstore.Counts{Requests: 1, PromptTokens: 10, CompletionTokens: 1}},
+	}, rows)
+
+	rows, err = j.Report("token", midnight, midnight)
+	require.NoError(t, err)
+	assert.Equal(t, []Row{
+		{Day: "2026-03-01", ID: "a", Provider: "glm", Counts: tokenstore.Counts{Requests: 2, PromptTokens: 60, CompletionTokens: 6}},
+		{Day: "2026-03-01", ID: "b", Provider: "qwen", Counts: tokenstore.Counts{Requests: 1, PromptTokens: 30, CompletionTokens: 3}},
+	}, rows)
+
+	rows, err = j.Report("key", feb, midnight.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	assert.Equal(t, []Row{
+		{Day: "2026-02-28", ID: KeyID("sk-one"), Counts: tokenstore.Counts{Requests: 1, PromptTokens: 10, CompletionTokens: 1}},
+		{Day: "2026-03-01", ID: KeyID("sk-one"), Counts: tokenstore.Counts{Requests: 2, PromptTokens: 60, CompletionTokens: 6}},
+		{Day: "2026-03-01", ID: KeyID("sk-two"), Counts: tokenstore.Counts{Requests: 1, PromptTokens: 30, CompletionTokens: 3}},
+	}, rows, "2 march is empty")
+
+	rows, err = j.Report("model", midnight, midnight)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "glm-4.6", rows[0].ID)
+
+	totals, err := j.TokenTotals()
+	require.NoError(t, err)
+	assert.Equal(t, tokenstore.Counts{Requests: 3, PromptTokens: 70, CompletionTokens: 7}, TokenTotal(totals, "glm", "a"))
+	assert.Zero(t, TokenTotal(totals, "glm", "b"))
+
+	_, err = j.Report("ip", midnight, midnight)
+	assert.ErrorContains(t, err, "unknown group")
+}
+
+func TestJournalAddsAcrossFlushes(t *testing.T) {
+	j := newTestJournal(t)
+	now := time.Now()
+
+	j.Book(Entry{Time: now, Provider: "glm", TokenID: "a", Model: "m", PromptTokens: 1})
+	require.NoError(t, j.Flush())
+	j.Book(Entry{Time: now, Provider: "glm", TokenID: "a", Model: "m", PromptTokens: 2})
+
+	rows, err := j.Report("key", now, now)
+	require.NoError(t, err)
+	assert.Equal(t, []Row{{Day: now.UTC().Format(dayLayout), ID: "anonymous", Counts: tokenstore.Counts{Requests: 2, PromptTokens: 3}}}, rows)
+}
+
+func TestKeyID(t *testing.T) {
+	assert.Equal(t, "anonymous", KeyID(""))
+	assert.Regexp(t, `^key-[0-9a-f]{12}$`, KeyID("sk-abcdef"))
+	assert.NotContains(t, KeyID("sk-abcdef"), "sk-", "no character of the key is shown")
+	assert.NotEqual(t, KeyID("sk-abcdef"), KeyID("sk-abcxyz"))
+}
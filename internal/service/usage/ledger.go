@@ -0,0 +1,110 @@
+package usage
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+// Cost estimates what a completion would cost at the configured prices,
+// nil when the model has no price so reports can tell unknown from free
+func Cost(p config.PricingConfig, model string, u *domain.Usage) *float64 {
+	price, ok := p.Models[model]
+	if !ok || u == nil {
+		return nil
+	}
+
+	cost := float64(u.PromptTokens)/1000*price.Input + float64(u.CompletionTokens)/1000*price.Output
+	return &cost
+}
+
+// ModelUsage is the running total of one model
+type ModelUsage struct {
+	Model            string   `json:"model"`
+	Requests         int64    `json:"requests"`
+	PromptTokens     int64    `json:"prompt_tokens"`
+	CompletionTokens int64    `json:"completion_tokens"`
+	Cost             *float64 `json:"cost"`
+	// requests recorded without a price, their cost is missing from Cost
+	Unpriced int64 `json:"unpriced_requests"`
+}
+
+// Ledger accumulates usage and estimated cost per model
+type Ledger struct {
+	mu     sync.Mutex
+	models map[string]*ModelUsage
+}
+
+func New() *Ledger {
+	return &Ledger{models: make(map[string]*ModelUsage)}
+}
+
+// Record adds a completion and returns its estimated cost
+func (l *Ledger) Record(p config.PricingConfig, model string, u *domain.Usage) *float64 {
+	if u == nil {
+		return nil
+	}
+	cost := Cost(p, model, u)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.models[model]
+	if !ok {
+		m = &ModelUsage{Model: model}
+		l.models[model] = m
+	}
+	m.Requests++
+	m.PromptTokens += int64(u.PromptTokens)
+	m.CompletionTokens += int64(u.CompletionTokens)
+
+	if cost == nil {
+		m.Unpriced++
+		return nil
+	}
+	if m.Cost == nil {
+		m.Cost = new(float64)
+	}
+	*m.Cost += *cost
+	return cost
+}
+
+// Snapshot returns a copy of every model total, sorted by model
+func (l *Ledger) Snapshot() []ModelUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]ModelUsage, 0, len(l.models))
+	for _, m := range l.models {
+		cp := *m
+		if m.Cost != nil {
+			cost := *m.Cost
+			cp.Cost = &cost
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Model < out[j].Model })
+	return out
+}
+
+var defaultLedger atomic.Pointer[Ledger]
+
+func init() {
+	defaultLedger.Store(New())
+}
+
+// SetLedger makes l the ledger of Record and Snapshot and returns the one it replaces
+func SetLedger(l *Ledger) *Ledger {
+	return defaultLedger.Swap(l)
+}
+
+func Record(p config.PricingConfig, model string, u *domain.Usage) *float64 {
+	return defaultLedger.Load().Record(p, model, u)
+}
+
+func Snapshot() []ModelUsage {
+	return defaultLedger.Load().Snapshot()
+}
@@ -0,0 +1,59 @@
+package usage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+)
+
+func TestCost(t *testing.T) {
+	pricing := config.PricingConfig{Models: map[string]config.ModelPrice{
+		"paid": {Input: 0.5, Output: 1.5},
+		"free": {},
+	}}
+	u := &domain.Usage{PromptTokens: 2000, CompletionTokens: 1000, TotalTokens: 3000}
+
+	cost := Cost(pricing, "paid", u)
+	require.NotNil(t, cost)
+	assert.InDelta(t, 2.5, *cost, 1e-9)
+
+	free := Cost(pricing, "free", u)
+	require.NotNil(t, free, "a zero price is free, not unknown")
+	assert.Zero(t, *free)
+
+	assert.Nil(t, Cost(pricing, "unknown", u))
+	assert.Nil(t, Cost(pricing, "paid", nil))
+}
+
+func TestLedger(t *testing.T) {
+	pricing := config.PricingConfig{Models: map[string]config.ModelPrice{"paid": {Input: 1, Output: 2}}}
+	l := New()
+
+	l.Record(pricing, "paid", &domain.Usage{PromptTokens: 1000, CompletionTokens: 500})
+	l.Record(pricing, "paid", &domain.Usage{PromptTokens: 1000, CompletionTokens: 500})
+	assert.Nil(t, l.Record(pricing, "other", &domain.Usage{PromptTokens: 10, CompletionTokens: 5}))
+	l.Record(pricing, "other", nil)
+
+	snap := l.Snapshot()
+	require.Len(t, snap, 2)
+
+	other, paid := snap[0], snap[1]
+	assert.Equal(t, "other", other.Model)
+	assert.Equal(t, int64(1), other.Requests)
+	assert.Equal(t, int64(1), other.Unpriced)
+	assert.Nil(t, other.Cost)
+
+	assert.Equal(t, "paid", paid.Model)
+	assert.Equal(t, int64(2), paid.Requests)
+	assert.Equal(t, int64(2000), paid.PromptTokens)
+	assert.Equal(t, int64(1000), paid.CompletionTokens)
+	require.NotNil(t, paid.Cost)
+	assert.InDelta(t, 4.0, *paid.Cost, 1e-9)
+
+	// the snapshot is a copy
+	*paid.Cost = 0
+	assert.InDelta(t, 4.0, *l.Snapshot()[1].Cost, 1e-9)
+}
@@ -0,0 +1,228 @@
+// Package client talks to a running mo over its openai compatible api, for
+// go services that would otherwise copy mo's types and stream parsing
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/httpclient"
+)
+
+// the wire types are mo's own, every type a request or reply holds
+type (
+	ChatRequest    = domain.ChatRequest
+	Message        = domain.Message
+	StreamOptions  = domain.StreamOptions
+	Tool           = domain.Tool
+	ToolFunction   = domain.ToolFunction
+	ToolCall       = domain.ToolCall
+	FunctionCall   = domain.FunctionCall
+	ResponseFormat = domain.ResponseFormat
+	JSONSchema     = domain.JSONSchema
+
+	ChatResponse            = domain.ChatResponse
+	Choice                  = domain.Choice
+	ResponseMessage         = domain.ResponseMessage
+	UpstreamEvent           = domain.UpstreamEvent
+	Logprobs                = domain.Logprobs
+	TokenLogprob            = domain.TokenLogprob
+	TopLogprob              = domain.TopLogprob
+	Usage                   = domain.Usage
+	PromptTokensDetails     = domain.PromptTokensDetails
+	CompletionTokensDetails = domain.CompletionTokensDetails
+	MoMeta                  = domain.MoMeta
+	Timings                 = domain.Timings
+	APIError                = domain.APIError
+)
+
+// RetryPolicy retries a request that got no usable reply: connection errors,
+// 429 and 502/503/504. a stream that has begun is never retried
+type RetryPolicy = httpclient.RetryPolicy
+
+const (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+type Client struct {
+	base   string
+	key    string
+	http   *http.Client
+	header http.Header
+	retry  RetryPolicy
+	ndjson bool
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sends through h instead of a client without timeout, a
+// timeout on h also bounds how long a stream may run
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// WithHeader adds a header to every request, e.g. X-Mo-Conversation
+func WithHeader(key, value string) Option {
+	return func(c *Client) { c.header.Add(key, value) }
+}
+
+// WithNDJSON asks for streams as json lines instead of sse
+func WithNDJSON() Option {
+	return func(c *Client) { c.ndjson = true }
+}
+
+// NewClient returns a client for the mo at baseURL, e.g.
+// http://localhost:8804. apiKey goes out as a bearer token, empty sends none
+func NewClient(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{
+		base:   strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/v1"),
+		key:    apiKey,
+		http:   &http.Client{},
+		header: http.Header{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ChatCompletion sends req without streaming. a reply other than 200 is an
+// *APIError with its Status set
+func (c *Client) ChatCompletion(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	body := *req
+	body.Stream = false
+	body.StreamOpts = nil
+	body.StreamFormat = ""
+
+	resp, err := c.post(ctx, "/v1/chat/completions", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out ChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &out, nil
+}
+
+// ChatCompletionStream sends req as a stream, the error covers everything up
+// to the reply headers and the Stream everything after. the caller closes it
+func (c *Client) ChatCompletionStream(ctx context.Context, req *ChatRequest) (*Stream, error) {
+	body := *req
+	body.Stream = true
+	if c.ndjson {
+		body.StreamFormat = "ndjson"
+	}
+
+	resp, err := c.post(ctx, "/v1/chat/completions", &body)
+	if err != nil {
+		return nil, err
+	}
+	return NewStream(ctx, resp), nil
+}
+
+// post sends v as json and returns a 200 reply, retrying under c.retry
+func (c *Client) post(ctx context.Context, path string, v any) (*http.Response, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range c.header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.key != "" {
+			req.Header.Set("Authorization", "Bearer "+c.key)
+		}
+
+		resp, err := c.http.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		if err == nil {
+			err = replyError(resp)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		delay, ok := c.retryAfter(attempt, resp, err)
+		if !ok || (c.retry.Budget > 0 && time.Since(start)+delay > c.retry.Budget) {
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryAfter is how long to wait before the next try, false when there is none
+func (c *Client) retryAfter(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt >= c.retry.MaxAttempts {
+		return 0, false
+	}
+	if resp == nil {
+		// a timeout already waited long enough
+		var timeout interface{ Timeout() bool }
+		return backoff(attempt), !errors.As(err, &timeout) || !timeout.Timeout()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	return backoff(attempt), true
+}
+
+// backoff is exponential with full jitter, attempt counts from 1
+func backoff(attempt int) time.Duration {
+	d := min(retryBaseDelay<<min(attempt-1, 8), retryMaxDelay)
+	return time.Duration(rand.Int64N(int64(d)) + 1)
+}
+
+// replyError reads an openai style error reply, falling back to its text
+func replyError(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var body domain.ErrorResponse
+	if json.Unmarshal(data, &body) == nil && body.Error != nil && body.Error.Message != "" {
+		body.Error.Status = resp.StatusCode
+		return body.Error
+	}
+	msg := strings.TrimSpace(string(data))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return domain.NewAPIError(resp.StatusCode, msg)
+}
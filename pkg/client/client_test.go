@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zarazaex69/mo/internal/config"
+	"github.com/zarazaex69/mo/internal/domain"
+	"github.com/zarazaex69/mo/internal/pkg/utils"
+	"github.com/zarazaex69/mo/internal/provider"
+	"github.com/zarazaex69/mo/internal/server"
+)
+
+// zai answers every request with the same z.ai stream
+type zai struct{ deltas []string }
+
+func (zai) Name() string              { return "zai" }
+func (zai) SupportsModel(string) bool { return true }
+func (zai) CredentialStatus() provider.CredentialStatus {
+	return provider.CredentialStatus{Present: true, Valid: true}
+}
+
+func (z zai) SendChatRequest(context.Context, *domain.ChatRequest, string) (*http.Response, error) {
+	var b strings.Builder
+	for i, d := range z.deltas {
+		done := ""
+		if i == len(z.deltas)-1 {
+			done = `, "done": true`
+		}
+		fmt.Fprintf(&b, `data: {"data": {"phase": "answer", "delta_content": %q%s}}`+"\n\n", d, done)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(b.String()))}, nil
+}
+
+// newMo serves mo's chat handler in front of a fake z.ai
+func newMo(t *testing.T, deltas ...string) *httptest.Server {
+	t.Helper()
+	cfg := &config.Config{Model: config.ModelConfig{Default: "glm-4.6"}}
+	h := server.ChatCompletions(config.Static(cfg), provider.NewRegistry(zai{deltas}), nil, utils.NewTokenizer("", false), nil)
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/chat/completions", h)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func hello() *ChatRequest {
+	return &ChatRequest{Messages: []Message{{Role: "user", Content: "hi"}}}
+}
+
+func TestChatCompletion(t *testing.T) {
+	mo := newMo(t, "Hello", " there")
+	c := NewClient(mo.URL+"/v1/", "")
+
+	resp, err := c.ChatCompletion(context.Background(), hello())
+	require.NoError(t, err)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "Hello there", resp.Choices[0].Message.Content)
+	assert.Equal(t, "stop", *resp.Choices[0].FinishReason)
+	assert.NotNil(t, resp.Usage)
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	mo := newMo(t, "Hello", " there")
+	c := NewClient(mo.URL, "")
+
+	req := hello()
+	req.StreamOpts = &StreamOptions{IncludeUsage: true}
+	s, err := c.ChatCompletionStream(context.Background(), req)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var content strings.Builder
+	var usage *Usage
+	ids := map[string]bool{}
+	for s.Next() {
+		chunk := s.Chunk()
+		ids[chunk.ID] = true
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, ch := range chunk.Choices {
+			content.WriteString(ch.Delta.Content)
+		}
+	}
+	require.NoError(t, s.Err())
+	assert.Equal(t, "Hello there", content.String())
+	assert.NotNil(t, usage)
+	assert.Len(t, ids, 1)
+	assert.False(t, s.Next(), "an ended stream stays ended")
+}
+
+func TestStreamFraming(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		err         string
+	}{
+		{
+			name:        "sse with pings and multi-line data",
+			contentType: "text/event-stream",
+			body: ": ping\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\r\n\r\n" +
+				"event: chunk\ndata: {\"choices\":\ndata: [{\"delta\":{\"content\":\"b\"}}]}\n\n" +
+				"data: [DONE]\n\n",
+			want: "ab",
+		},
+		{
+			name:        "sse with bare cr line endings",
+			contentType: "text/event-stream",
+			body:        "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\r\rdata: [DONE]\r\r",
+			want:        "a",
+		},
+		{
+			name:        "sse cut short",
+			contentType: "text/event-stream",
+			body:        "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n",
+			want:        "a",
+			err:         io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name:        "sse error event",
+			contentType: "text/event-stream",
+			body:        "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\ndata: {\"error\":{\"message\":\"upstream stalled\",\"type\":\"upstream_error\"}}\n\ndata: [DONE]\n\n",
+			want:        "a",
+			err:         "upstream stalled",
+		},
+		{
+			name:        "ndjson ends with the body",
+			contentType: "application/x-ndjson",
+			body:        "{\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n{\"choices\":[{\"delta\":{\"content\":\"b\"}}]}\n",
+			want:        "ab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			s, err := NewClient(srv.URL, "").ChatCompletionStream(context.Background(), hello())
+			require.NoError(t, err)
+			defer s.Close()
+
+			var content strings.Builder
+			for s.Next() {
+				content.WriteString(s.Chunk().Choices[0].Delta.Content)
+			}
+			assert.Equal(t, tt.want, content.String())
+			if tt.err == "" {
+				assert.NoError(t, s.Err())
+			} else {
+				assert.EqualError(t, s.Err(), tt.err)
+			}
+		})
+	}
+}
+
+func TestErrorsAndRetry(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer sk-test", r.Header.Get("Authorization"))
+		assert.Equal(t, "c-1", r.Header.Get("X-Mo-Conversation"))
+		switch calls.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"error":{"message":"slow down","type":"rate_limit_error"}}`, http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"message":"unsupported model","type":"invalid_request_error","param":"model","code":"model_not_found"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "sk-test", WithRetry(RetryPolicy{MaxAttempts: 5}), WithHeader("X-Mo-Conversation", "c-1"))
+	_, err := c.ChatCompletion(context.Background(), hello())
+
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, "model_not_found", *apiErr.Code)
+	assert.EqualValues(t, 3, calls.Load(), "429 and 503 are retried, 400 is not")
+
+	calls.Store(1)
+	_, err = NewClient(srv.URL, "sk-test", WithHeader("X-Mo-Conversation", "c-1")).ChatCompletionStream(context.Background(), hello())
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.Status, "no retries unless asked")
+	assert.Equal(t, "Service Unavailable", apiErr.Message)
+}
+
+func TestStreamCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewClient(srv.URL, "").ChatCompletionStream(ctx, hello())
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.True(t, s.Next())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	assert.False(t, s.Next())
+	assert.True(t, errors.Is(s.Err(), context.Canceled), s.Err())
+}
@@ -0,0 +1,52 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zarazaex69/mo/pkg/client"
+)
+
+func ExampleClient_ChatCompletion() {
+	c := client.NewClient("http://localhost:8804", "sk-...",
+		client.WithRetry(client.RetryPolicy{MaxAttempts: 3, Budget: 30 * time.Second}))
+
+	resp, err := c.ChatCompletion(context.Background(), &client.ChatRequest{
+		Model:    "glm-4.6",
+		Messages: []client.Message{{Role: "user", Content: "Say hi"}},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(resp.Choices[0].Message.Content)
+}
+
+func ExampleClient_ChatCompletionStream() {
+	c := client.NewClient("http://localhost:8804", "sk-...")
+
+	s, err := c.ChatCompletionStream(context.Background(), &client.ChatRequest{
+		Model:      "glm-4.6",
+		Messages:   []client.Message{{Role: "user", Content: "Count to five"}},
+		StreamOpts: &client.StreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer s.Close()
+
+	for s.Next() {
+		chunk := s.Chunk()
+		for _, choice := range chunk.Choices {
+			fmt.Print(choice.Delta.Content)
+		}
+		if chunk.Usage != nil {
+			fmt.Println("\ntokens:", chunk.Usage.TotalTokens)
+		}
+	}
+	if err := s.Err(); err != nil {
+		fmt.Println(err)
+	}
+}
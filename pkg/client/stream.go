@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zarazaex69/mo/internal/pkg/sse"
+)
+
+// Stream reads the chunks of a streamed completion:
+//
+//	for s.Next() {
+//		chunk := s.Chunk()
+//	}
+//	if err := s.Err(); err != nil { ... }
+//
+// chunks without choices come after the finish and carry usage, timings or
+// a mo.warning object
+type Stream struct {
+	ctx  context.Context
+	body io.ReadCloser
+	// one of them reads the body, lines for ndjson
+	events *sse.Reader
+	lines  *bufio.Scanner
+	// why reading the body stopped, nil at its end
+	readErr error
+
+	chunk *ChatResponse
+	err   error
+	done  bool
+}
+
+// NewStream reads a streamed completion sent without a Client, resp is its
+// 200 reply. closing the Stream closes the body, ctx is what bounds it
+func NewStream(ctx context.Context, resp *http.Response) *Stream {
+	s := &Stream{ctx: ctx, body: resp.Body}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		s.lines = bufio.NewScanner(resp.Body)
+		s.lines.Buffer(make([]byte, 0, 64*1024), sse.MaxLine)
+	} else {
+		s.events = sse.NewReader(resp.Body)
+	}
+	return s
+}
+
+// Next reads the next chunk, false at the end of the stream or on an error
+func (s *Stream) Next() bool {
+	if s.done {
+		return false
+	}
+
+	data, ok := s.event()
+	if !ok {
+		s.finish(nil)
+		return false
+	}
+
+	var event struct {
+		ChatResponse
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		s.finish(fmt.Errorf("decode chunk: %w", err))
+		return false
+	}
+	if event.Error != nil {
+		s.finish(event.Error)
+		return false
+	}
+	s.chunk = &event.ChatResponse
+	return true
+}
+
+// event returns the data of the next event, false once there is none
+func (s *Stream) event() (string, bool) {
+	if s.lines != nil {
+		for s.lines.Scan() {
+			if line := strings.TrimSpace(s.lines.Text()); line != "" {
+				return line, true
+			}
+		}
+		s.readErr = s.lines.Err()
+		return "", false
+	}
+
+	event, err := s.events.Next()
+	if err != nil {
+		if err != io.EOF {
+			s.readErr = err
+		}
+		return "", false
+	}
+	if event.Data == "[DONE]" {
+		s.done = true
+		return "", false
+	}
+	return event.Data, true
+}
+
+// finish ends the stream with err, or with what the body ended on
+func (s *Stream) finish(err error) {
+	if err == nil {
+		err = s.readErr
+	}
+	if err == nil && !s.done && s.events != nil {
+		// sse ends with [DONE], a body that stops short was cut
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && s.ctx.Err() != nil {
+		err = s.ctx.Err()
+	}
+	s.done = true
+	s.chunk = nil
+	s.err = err
+	s.body.Close()
+}
+
+// Chunk is the chunk read by the last Next
+func (s *Stream) Chunk() *ChatResponse { return s.chunk }
+
+// Err is why the stream ended, nil when it ended normally
+func (s *Stream) Err() error { return s.err }
+
+// Close drops the rest of the stream, it is safe to call more than once
+func (s *Stream) Close() error {
+	if !s.done {
+		s.done = true
+		s.chunk = nil
+	}
+	return s.body.Close()
+}